@@ -0,0 +1,225 @@
+// Package adaptivelimit provides a concurrency limiting middleware that
+// discovers its limit dynamically from observed latencies and failures.
+package adaptivelimit
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dmage/middleware/conntrace"
+	"github.com/dmage/middleware/maxconnections"
+)
+
+// Sample is an observation of a finished request.
+type Sample struct {
+	// RTT is the time the handler took to process the request.
+	RTT time.Duration
+
+	// InFlight is the number of requests that were running when the request
+	// was started, including the request itself.
+	InFlight int
+
+	// Dropped is true if the request failed in a way that indicates
+	// overload (e.g. a server error).
+	Dropped bool
+}
+
+// Algorithm computes concurrency limits. Implementations don't need to be
+// safe for concurrent use, Middleware serializes calls to Update.
+type Algorithm interface {
+	// Update returns a new limit given the current limit and a sample.
+	Update(limit int, s Sample) int
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	// Limiter enforces the current limit. Its OverloadHandler,
+	// MaxWaitInQueue and other options can be configured, but its limit is
+	// managed by Middleware.
+	Limiter *maxconnections.Middleware
+
+	// mu protects algorithm, limit and inflight.
+	mu        sync.Mutex
+	algorithm Algorithm
+	limit     int
+	inflight  int
+
+	// handler to invoke.
+	handler http.Handler
+
+	// MinLimit and MaxLimit bound the limit. MaxLimit is ignored if it is
+	// not positive.
+	MinLimit int
+	MaxLimit int
+
+	// IsDropped reports whether a response with the given status code should
+	// be considered as dropped. By default all 5xx responses are.
+	IsDropped func(statusCode int) bool
+
+	// OnLimitChange, if not nil, is called when the limit is changed.
+	OnLimitChange func(limit int)
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+func defaultIsDropped(statusCode int) bool {
+	return statusCode >= 500
+}
+
+// New returns an http.Handler that runs no more than limit h at the same
+// time, where limit starts at initialLimit and is adjusted by alg. It can
+// enqueue up to maxInQueue requests awaiting to be run.
+func New(initialLimit, maxInQueue int, alg Algorithm, h http.Handler) *Middleware {
+	m := &Middleware{
+		algorithm: alg,
+		limit:     initialLimit,
+		handler:   h,
+		MinLimit:  1,
+		IsDropped: defaultIsDropped,
+		now:       time.Now,
+	}
+	m.Limiter = maxconnections.New(initialLimit, maxInQueue, http.HandlerFunc(m.serveAdmitted))
+	return m
+}
+
+// Limit returns the current limit.
+func (m *Middleware) Limit() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.limit
+}
+
+// Observe updates the limit using s. It is called for every request
+// processed by the middleware, but it can also be used to feed external
+// signals into the algorithm, see ObserveConn.
+func (m *Middleware) Observe(s Sample) {
+	m.mu.Lock()
+	limit := m.clamp(m.algorithm.Update(m.limit, s))
+	changed := limit != m.limit
+	m.limit = limit
+	if changed {
+		m.Limiter.SetMaxRunning(limit)
+	}
+	m.mu.Unlock()
+
+	if changed && m.OnLimitChange != nil {
+		m.OnLimitChange(limit)
+	}
+}
+
+// ObserveConn feeds the time that an outbound request of the handler waited
+// for a connection into the algorithm, so that the limit follows the state
+// of the backend that the handler calls. It can be used as OnConn of a
+// conntrace.Collector:
+//
+//	c := conntrace.New()
+//	c.OnConn = m.ObserveConn
+//	client := &http.Client{Transport: c.RoundTripper(nil)}
+//
+// The wait is the RTT of the sample. A request that waited for a busy
+// connection, i.e. the connection pool was exhausted, is considered as
+// dropped.
+func (m *Middleware) ObserveConn(ci conntrace.ConnInfo) {
+	m.mu.Lock()
+	inflight := m.inflight
+	m.mu.Unlock()
+
+	m.Observe(Sample{
+		RTT:      ci.Wait,
+		InFlight: inflight,
+		Dropped:  ci.PoolWait(),
+	})
+}
+
+// clamp bounds limit by MinLimit and MaxLimit.
+func (m *Middleware) clamp(limit int) int {
+	if m.MaxLimit > 0 && limit > m.MaxLimit {
+		limit = m.MaxLimit
+	}
+	if limit < m.MinLimit {
+		limit = m.MinLimit
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	return limit
+}
+
+// statusRecorder remembers the status code of the response. It implements
+// http.Flusher and http.Hijacker when the underlying writer does.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (sr *statusRecorder) WriteHeader(statusCode int) {
+	if sr.statusCode == 0 {
+		sr.statusCode = statusCode
+	}
+	sr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.statusCode == 0 {
+		sr.statusCode = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// FlushError flushes the response, see http.ResponseController.
+func (sr *statusRecorder) FlushError() error {
+	if sr.statusCode == 0 {
+		sr.statusCode = http.StatusOK
+	}
+	return http.NewResponseController(sr.ResponseWriter).Flush()
+}
+
+func (sr *statusRecorder) Flush() {
+	sr.FlushError()
+}
+
+// Hijack lets the handler take over the connection, see http.Hijacker.
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(sr.ResponseWriter).Hijack()
+}
+
+func (m *Middleware) serveAdmitted(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	m.inflight++
+	inflight := m.inflight
+	m.mu.Unlock()
+
+	sr := &statusRecorder{ResponseWriter: w}
+	start := m.now()
+	defer func() {
+		rtt := m.now().Sub(start)
+
+		m.mu.Lock()
+		m.inflight--
+		m.mu.Unlock()
+
+		statusCode := sr.statusCode
+		if statusCode == 0 {
+			statusCode = http.StatusOK
+		}
+		m.Observe(Sample{
+			RTT:      rtt,
+			InFlight: inflight,
+			Dropped:  m.IsDropped(statusCode),
+		})
+	}()
+	m.handler.ServeHTTP(sr, r)
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Limiter.ServeHTTP(w, r)
+}
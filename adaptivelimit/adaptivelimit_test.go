@@ -0,0 +1,174 @@
+package adaptivelimit
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+	"time"
+
+	"github.com/dmage/middleware/conntrace"
+)
+
+func TestAIMD(t *testing.T) {
+	a := &AIMD{Timeout: 100 * time.Millisecond}
+	testCases := []struct {
+		limit    int
+		sample   Sample
+		expected int
+	}{
+		{10, Sample{RTT: time.Millisecond, InFlight: 5}, 11},
+		{10, Sample{RTT: time.Millisecond, InFlight: 1}, 10},
+		{10, Sample{RTT: time.Millisecond, InFlight: 10, Dropped: true}, 9},
+		{10, Sample{RTT: time.Second, InFlight: 10}, 9},
+	}
+	for _, tc := range testCases {
+		if got := a.Update(tc.limit, tc.sample); got != tc.expected {
+			t.Errorf("Update(%d, %+v) = %d, want %d", tc.limit, tc.sample, got, tc.expected)
+		}
+	}
+}
+
+func TestGradient(t *testing.T) {
+	g := &Gradient{}
+	limit := 10
+	for i := 0; i < 100; i++ {
+		limit = g.Update(limit, Sample{RTT: 10 * time.Millisecond, InFlight: limit})
+	}
+	if limit <= 10 {
+		t.Fatalf("limit = %d after stable latencies, want it to grow", limit)
+	}
+
+	grown := limit
+	for i := 0; i < 20; i++ {
+		limit = g.Update(limit, Sample{RTT: 100 * time.Millisecond, InFlight: limit})
+	}
+	if limit >= grown {
+		t.Fatalf("limit = %d after latency spike, want less than %d", limit, grown)
+	}
+}
+
+func TestVegas(t *testing.T) {
+	v := &Vegas{}
+	if got := v.Update(10, Sample{RTT: 10 * time.Millisecond, InFlight: 10}); got != 10 {
+		t.Fatalf("Update() = %d for the first sample, want %d", got, 10)
+	}
+	if got := v.Update(10, Sample{RTT: 11 * time.Millisecond, InFlight: 10}); got != 11 {
+		t.Fatalf("Update() = %d for a small queue, want %d", got, 11)
+	}
+	if got := v.Update(10, Sample{RTT: 40 * time.Millisecond, InFlight: 10}); got != 9 {
+		t.Fatalf("Update() = %d for a big queue, want %d", got, 9)
+	}
+	if got := v.Update(10, Sample{RTT: 15 * time.Millisecond, InFlight: 10}); got != 10 {
+		t.Fatalf("Update() = %d for a moderate queue, want %d", got, 10)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	statusCode := http.StatusOK
+	h := New(2, 0, &AIMD{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statusCode)
+	}))
+	h.MaxLimit = 3
+
+	var changes []int
+	h.OnLimitChange = func(limit int) {
+		changes = append(changes, limit)
+	}
+
+	serve := func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	serve()
+	if limit := h.Limit(); limit != 3 {
+		t.Fatalf("Limit() = %d, want %d", limit, 3)
+	}
+	serve()
+	if limit := h.Limit(); limit != 3 {
+		t.Fatalf("Limit() = %d above MaxLimit, want %d", limit, 3)
+	}
+	if max := h.Limiter.MaxRunning(); max != 3 {
+		t.Fatalf("Limiter.MaxRunning() = %d, want %d", max, 3)
+	}
+
+	statusCode = http.StatusInternalServerError
+	serve()
+	if limit := h.Limit(); limit != 2 {
+		t.Fatalf("Limit() = %d, want %d", limit, 2)
+	}
+
+	if expected := []int{3, 2}; len(changes) != len(expected) || changes[0] != expected[0] || changes[1] != expected[1] {
+		t.Fatalf("limit changes = %v, want %v", changes, expected)
+	}
+}
+
+func TestObserveConn(t *testing.T) {
+	h := New(10, 0, &AIMD{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	c := conntrace.New()
+	c.OnConn = h.ObserveConn
+
+	getConn := func(info httptrace.GotConnInfo) {
+		trace := httptrace.ContextClientTrace(c.WithContext(context.Background()))
+		trace.GetConn("backend:80")
+		trace.GotConn(info)
+	}
+
+	getConn(httptrace.GotConnInfo{Reused: true, WasIdle: true})
+	if limit := h.Limit(); limit != 10 {
+		t.Fatalf("Limit() = %d after an idle connection, want %d", limit, 10)
+	}
+
+	// The pool of the backend is exhausted.
+	getConn(httptrace.GotConnInfo{Reused: true, WasIdle: false})
+	if limit := h.Limit(); limit != 9 {
+		t.Fatalf("Limit() = %d after a wait for a busy connection, want %d", limit, 9)
+	}
+	if max := h.Limiter.MaxRunning(); max != 9 {
+		t.Fatalf("Limiter.MaxRunning() = %d, want %d", max, 9)
+	}
+}
+
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func TestInterfaces(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws" {
+			hj, ok := w.(http.Hijacker)
+			if !ok {
+				t.Fatal("the writer doesn't implement http.Hijacker")
+			}
+			if _, _, err := hj.Hijack(); err != nil {
+				t.Fatalf("Hijack() = %v, want nil", err)
+			}
+			return
+		}
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("the writer doesn't implement http.Flusher")
+		}
+		f.Flush()
+	})
+	m := New(2, 0, &AIMD{}, h)
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !rec.Flushed {
+		t.Errorf("the response hasn't been flushed")
+	}
+	hj := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	m.ServeHTTP(hj, httptest.NewRequest("GET", "/ws", nil))
+	if !hj.hijacked {
+		t.Errorf("the connection hasn't been hijacked")
+	}
+}
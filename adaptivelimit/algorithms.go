@@ -0,0 +1,146 @@
+package adaptivelimit
+
+import (
+	"math"
+	"time"
+)
+
+// AIMD increases the limit additively while requests succeed and decreases it
+// multiplicatively when a request is dropped.
+type AIMD struct {
+	// BackoffRatio is the factor the limit is multiplied by when a request is
+	// dropped. If it is not in (0, 1), 0.9 is used.
+	BackoffRatio float64
+
+	// Timeout, if positive, is the latency above which requests are
+	// considered as dropped.
+	Timeout time.Duration
+}
+
+// Update implements Algorithm.
+func (a *AIMD) Update(limit int, s Sample) int {
+	if s.Dropped || (a.Timeout > 0 && s.RTT > a.Timeout) {
+		ratio := a.BackoffRatio
+		if ratio <= 0 || ratio >= 1 {
+			ratio = 0.9
+		}
+		return int(float64(limit) * ratio)
+	}
+	// Don't grow the limit if the application doesn't use it.
+	if s.InFlight*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+// Gradient adjusts the limit based on the ratio between the long-term and
+// the short-term average latencies. When the short-term latency grows, the
+// requests are queueing somewhere, and the limit is decreased.
+type Gradient struct {
+	// Tolerance is how much the short-term latency may exceed the long-term
+	// one before the limit is decreased. If it is less than 1, 1.5 is used.
+	Tolerance float64
+
+	// Smoothing is the weight of a new limit. If it is not in (0, 1], 0.2 is
+	// used.
+	Smoothing float64
+
+	// ShortWindow and LongWindow are the numbers of samples that the
+	// averages are computed over. If they are not positive, 10 and 600 are
+	// used.
+	ShortWindow int
+	LongWindow  int
+
+	short, long float64
+	limit       float64
+}
+
+func ewma(avg float64, x float64, window int) float64 {
+	if avg == 0 {
+		return x
+	}
+	alpha := 2 / (float64(window) + 1)
+	return avg + alpha*(x-avg)
+}
+
+// Update implements Algorithm.
+func (g *Gradient) Update(limit int, s Sample) int {
+	tolerance := g.Tolerance
+	if tolerance < 1 {
+		tolerance = 1.5
+	}
+	smoothing := g.Smoothing
+	if smoothing <= 0 || smoothing > 1 {
+		smoothing = 0.2
+	}
+	shortWindow, longWindow := g.ShortWindow, g.LongWindow
+	if shortWindow <= 0 {
+		shortWindow = 10
+	}
+	if longWindow <= 0 {
+		longWindow = 600
+	}
+
+	rtt := float64(s.RTT)
+	g.short = ewma(g.short, rtt, shortWindow)
+	g.long = ewma(g.long, rtt, longWindow)
+	if g.limit == 0 || int(g.limit) != limit {
+		g.limit = float64(limit)
+	}
+
+	// Don't grow the limit if the application doesn't use it.
+	if s.InFlight*2 < limit {
+		return limit
+	}
+
+	gradient := math.Max(0.5, math.Min(1, tolerance*g.long/g.short))
+	queueSize := math.Sqrt(g.limit)
+	newLimit := g.limit*gradient + queueSize
+	g.limit = g.limit*(1-smoothing) + newLimit*smoothing
+	return int(g.limit)
+}
+
+// Vegas estimates the number of queued requests from the latency compared to
+// the minimal observed latency and keeps it between Alpha and Beta.
+type Vegas struct {
+	// Alpha and Beta are the bounds for the estimated queue size. If they
+	// are not positive, 3 and 6 are used.
+	Alpha int
+	Beta  int
+
+	minRTT time.Duration
+}
+
+// Update implements Algorithm.
+func (v *Vegas) Update(limit int, s Sample) int {
+	alpha, beta := v.Alpha, v.Beta
+	if alpha <= 0 {
+		alpha = 3
+	}
+	if beta <= 0 {
+		beta = 6
+	}
+
+	if s.RTT <= 0 {
+		return limit
+	}
+	if v.minRTT == 0 || s.RTT < v.minRTT {
+		v.minRTT = s.RTT
+		return limit
+	}
+
+	if s.Dropped {
+		return limit - 1
+	}
+
+	queueSize := int(math.Ceil(float64(limit) * (1 - float64(v.minRTT)/float64(s.RTT))))
+	switch {
+	case queueSize < alpha:
+		if s.InFlight*2 >= limit {
+			return limit + 1
+		}
+	case queueSize > beta:
+		return limit - 1
+	}
+	return limit
+}
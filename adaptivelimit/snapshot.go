@@ -0,0 +1,111 @@
+package adaptivelimit
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Stateful is implemented by algorithms that learn from samples, so that
+// Middleware.Snapshot can save what they have learned.
+type Stateful interface {
+	// State returns the learned state as JSON.
+	State() ([]byte, error)
+
+	// SetState replaces the learned state with data returned by State.
+	SetState(data []byte) error
+}
+
+// snapshot is the JSON form of the state of Middleware.
+type snapshot struct {
+	Limit     int             `json:"limit"`
+	Algorithm json.RawMessage `json:"algorithm,omitempty"`
+}
+
+// Snapshot returns the current limit and the state of the algorithm as
+// JSON, see middleware.Snapshotter. Restoring it after a deploy saves the
+// algorithm from rediscovering the limit, which otherwise makes the limit
+// oscillate under load.
+func (m *Middleware) Snapshot() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := snapshot{Limit: m.limit}
+	if alg, ok := m.algorithm.(Stateful); ok {
+		state, err := alg.State()
+		if err != nil {
+			return nil, err
+		}
+		s.Algorithm = state
+	}
+	return json.Marshal(s)
+}
+
+// Restore replaces the limit and the state of the algorithm with the ones
+// saved by Snapshot. The limit is bounded by MinLimit and MaxLimit.
+func (m *Middleware) Restore(data []byte) error {
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	if alg, ok := m.algorithm.(Stateful); ok && len(s.Algorithm) > 0 {
+		if err := alg.SetState(s.Algorithm); err != nil {
+			m.mu.Unlock()
+			return err
+		}
+	}
+	limit := m.clamp(s.Limit)
+	changed := limit != m.limit
+	m.limit = limit
+	if changed {
+		m.Limiter.SetMaxRunning(limit)
+	}
+	m.mu.Unlock()
+
+	if changed && m.OnLimitChange != nil {
+		m.OnLimitChange(limit)
+	}
+	return nil
+}
+
+// gradientState is the learned state of Gradient.
+type gradientState struct {
+	Short float64 `json:"short"`
+	Long  float64 `json:"long"`
+	Limit float64 `json:"limit"`
+}
+
+// State implements Stateful.
+func (g *Gradient) State() ([]byte, error) {
+	return json.Marshal(gradientState{Short: g.short, Long: g.long, Limit: g.limit})
+}
+
+// SetState implements Stateful.
+func (g *Gradient) SetState(data []byte) error {
+	var s gradientState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	g.short, g.long, g.limit = s.Short, s.Long, s.Limit
+	return nil
+}
+
+// vegasState is the learned state of Vegas.
+type vegasState struct {
+	MinRTT time.Duration `json:"min_rtt"`
+}
+
+// State implements Stateful.
+func (v *Vegas) State() ([]byte, error) {
+	return json.Marshal(vegasState{MinRTT: v.minRTT})
+}
+
+// SetState implements Stateful.
+func (v *Vegas) SetState(data []byte) error {
+	var s vegasState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v.minRTT = s.MinRTT
+	return nil
+}
@@ -0,0 +1,60 @@
+package adaptivelimit
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	alg := &Vegas{}
+	m := New(10, 0, alg, http.NotFoundHandler())
+	m.Observe(Sample{RTT: 10 * time.Millisecond, InFlight: 10})
+	m.Observe(Sample{RTT: 10 * time.Millisecond, InFlight: 10, Dropped: true})
+	data, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restoredAlg := &Vegas{}
+	restored := New(1, 0, restoredAlg, http.NotFoundHandler())
+	restored.MaxLimit = 5
+	var changes []int
+	restored.OnLimitChange = func(limit int) {
+		changes = append(changes, limit)
+	}
+	if err := restored.Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	if restoredAlg.minRTT != 10*time.Millisecond {
+		t.Fatalf("minRTT = %s, want the learned minimal latency", restoredAlg.minRTT)
+	}
+	if limit := restored.Limit(); limit != 5 {
+		t.Fatalf("Limit() = %d, want the restored limit bounded by MaxLimit", limit)
+	}
+	if max := restored.Limiter.MaxRunning(); max != 5 {
+		t.Fatalf("Limiter.MaxRunning() = %d, want %d", max, 5)
+	}
+	if len(changes) != 1 || changes[0] != 5 {
+		t.Fatalf("limit changes = %v, want [5]", changes)
+	}
+}
+
+func TestSnapshotGradient(t *testing.T) {
+	g := &Gradient{}
+	m := New(10, 0, g, http.NotFoundHandler())
+	for i := 0; i < 10; i++ {
+		m.Observe(Sample{RTT: 10 * time.Millisecond, InFlight: 10})
+	}
+	data, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &Gradient{}
+	if err := New(1, 0, restored, http.NotFoundHandler()).Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	if restored.short != g.short || restored.long != g.long || restored.limit != g.limit {
+		t.Fatalf("restored state = %+v, want %+v", restored, g)
+	}
+}
@@ -0,0 +1,316 @@
+// Package auth authenticates requests with bearer tokens or API keys.
+//
+// The middleware extracts credentials from the request and passes them to a
+// Validator, which is supplied by the application, e.g. a lookup in a table
+// of API keys or a verification of a JWT. The principal returned by the
+// validator is put into the request context, so that handlers and the
+// middlewares down the chain can use it, e.g. PrincipalKey gives each
+// principal its own bucket in ratelimit or its own limiter in
+// maxconnections.Keyed.
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dmage/middleware/decisionlog"
+)
+
+const defaultAPIKeyHeader = "X-API-Key"
+
+var (
+	// ErrNoCredentials is reported for requests without credentials.
+	ErrNoCredentials = errors.New("auth: no credentials")
+
+	// ErrInvalidCredentials should be returned by validators for unknown,
+	// expired or malformed credentials. Such requests are rejected with
+	// 401 Unauthorized.
+	ErrInvalidCredentials = errors.New("auth: invalid credentials")
+
+	// ErrForbidden should be returned by validators for valid credentials
+	// that don't grant access to the request. Such requests are rejected
+	// with 403 Forbidden.
+	ErrForbidden = errors.New("auth: forbidden")
+)
+
+func defaultUnauthorizedHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+}
+
+func defaultForbiddenHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "403 forbidden", http.StatusForbidden)
+}
+
+func defaultErrorHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "503 authentication is unavailable, please try again later", http.StatusServiceUnavailable)
+}
+
+// UnauthorizedHandler is a default UnauthorizedHandler for Middleware.
+var UnauthorizedHandler http.Handler = http.HandlerFunc(defaultUnauthorizedHandler)
+
+// ForbiddenHandler is a default ForbiddenHandler for Middleware.
+var ForbiddenHandler http.Handler = http.HandlerFunc(defaultForbiddenHandler)
+
+// ErrorHandler is a default ErrorHandler for Middleware.
+var ErrorHandler http.Handler = http.HandlerFunc(defaultErrorHandler)
+
+// Scheme is the way the credentials have been sent.
+type Scheme string
+
+const (
+	// SchemeBearer is the Authorization header with the Bearer scheme,
+	// see RFC 6750.
+	SchemeBearer Scheme = "bearer"
+
+	// SchemeAPIKey is the API key header or query parameter.
+	SchemeAPIKey Scheme = "apikey"
+)
+
+// Credentials are the credentials extracted from a request.
+type Credentials struct {
+	Scheme Scheme
+	Token  string
+}
+
+// Principal is an authenticated client.
+type Principal struct {
+	// ID identifies the client, e.g. a user or service account name.
+	ID string
+
+	// Attributes are arbitrary properties of the principal provided by
+	// the validator, e.g. its plan or roles.
+	Attributes map[string]string
+}
+
+// Validator checks credentials.
+type Validator interface {
+	// Validate returns the principal for the credentials. It should return
+	// ErrInvalidCredentials or ErrForbidden, possibly wrapped, if the
+	// request should be rejected, other errors are considered failures of
+	// the validator.
+	Validate(ctx context.Context, creds Credentials) (*Principal, error)
+}
+
+// ValidatorFunc is an adapter to allow the use of ordinary functions as
+// Validator.
+type ValidatorFunc func(ctx context.Context, creds Credentials) (*Principal, error)
+
+// Validate calls f(ctx, creds).
+func (f ValidatorFunc) Validate(ctx context.Context, creds Credentials) (*Principal, error) {
+	return f(ctx, creds)
+}
+
+type principalKey struct{}
+
+type errorKey struct{}
+
+// NewContext returns a copy of ctx that carries p.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal of the request, or nil if the request
+// is anonymous.
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// ErrorFromContext returns the error that the request has been rejected
+// with. It can be used by the handlers of Middleware.
+func ErrorFromContext(ctx context.Context) error {
+	err, _ := ctx.Value(errorKey{}).(error)
+	return err
+}
+
+// PrincipalKey returns the ID of the principal of the request. It can be used
+// as Key of ratelimit.Middleware or maxconnections.Keyed that are wrapped by
+// Middleware. Anonymous requests share the empty key.
+func PrincipalKey(r *http.Request) string {
+	if p := FromContext(r.Context()); p != nil {
+		return p.ID
+	}
+	return ""
+}
+
+// Stats contains counters collected by Middleware.
+type Stats struct {
+	// Authenticated is the total number of requests with valid credentials.
+	Authenticated int64 `json:"authenticated"`
+
+	// Anonymous is the total number of requests without credentials that
+	// have been passed to the handler, see Optional.
+	Anonymous int64 `json:"anonymous"`
+
+	// Unauthorized and Forbidden are the total numbers of requests that
+	// have been rejected with 401 and 403.
+	Unauthorized int64 `json:"unauthorized"`
+	Forbidden    int64 `json:"forbidden"`
+
+	// Errors is the total number of requests that have failed because of
+	// the validator.
+	Errors int64 `json:"errors"`
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler   http.Handler
+	validator Validator
+
+	authenticated int64
+	anonymous     int64
+	unauthorized  int64
+	forbidden     int64
+	errors        int64
+
+	// APIKeyHeader is the name of the header that carries an API key. If
+	// empty, API keys are not read from headers. By default it is
+	// X-API-Key.
+	APIKeyHeader string
+
+	// APIKeyQuery, if not empty, is the name of the query parameter that
+	// carries an API key. The parameter is removed from the URL before the
+	// request is passed to the handler, but query strings tend to end up
+	// in access logs of proxies, so headers should be preferred.
+	APIKeyQuery string
+
+	// Realm is sent in the WWW-Authenticate header of 401 responses.
+	Realm string
+
+	// Optional lets requests without credentials through as anonymous.
+	// Requests with invalid credentials are rejected regardless.
+	Optional bool
+
+	// Skip, if not nil, reports whether the request is passed to the
+	// handler without authentication, e.g. health checks.
+	Skip func(r *http.Request) bool
+
+	// UnauthorizedHandler is called for requests without credentials or
+	// with invalid ones, ForbiddenHandler for requests whose credentials
+	// don't grant access, and ErrorHandler for requests whose credentials
+	// cannot be validated. The error is available through
+	// ErrorFromContext.
+	UnauthorizedHandler http.Handler
+	ForbiddenHandler    http.Handler
+	ErrorHandler        http.Handler
+}
+
+// New returns an http.Handler that passes to h the requests whose
+// credentials are accepted by v.
+func New(v Validator, h http.Handler) *Middleware {
+	return &Middleware{
+		handler:             h,
+		validator:           v,
+		APIKeyHeader:        defaultAPIKeyHeader,
+		UnauthorizedHandler: UnauthorizedHandler,
+		ForbiddenHandler:    ForbiddenHandler,
+		ErrorHandler:        ErrorHandler,
+	}
+}
+
+// Credentials extracts the credentials from r. The Authorization header is
+// preferred to the API key. It returns false if the request has no
+// credentials.
+func (m *Middleware) Credentials(r *http.Request) (Credentials, bool) {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		if token = strings.TrimSpace(token); token != "" {
+			return Credentials{Scheme: SchemeBearer, Token: token}, true
+		}
+	}
+	if m.APIKeyHeader != "" {
+		if key := r.Header.Get(m.APIKeyHeader); key != "" {
+			return Credentials{Scheme: SchemeAPIKey, Token: key}, true
+		}
+	}
+	if m.APIKeyQuery != "" {
+		if key := r.URL.Query().Get(m.APIKeyQuery); key != "" {
+			return Credentials{Scheme: SchemeAPIKey, Token: key}, true
+		}
+	}
+	return Credentials{}, false
+}
+
+// stripAPIKey returns r without the API key query parameter.
+func (m *Middleware) stripAPIKey(r *http.Request) *http.Request {
+	if m.APIKeyQuery == "" {
+		return r
+	}
+	q := r.URL.Query()
+	if _, ok := q[m.APIKeyQuery]; !ok {
+		return r
+	}
+	q.Del(m.APIKeyQuery)
+	r2 := r.Clone(r.Context())
+	r2.URL.RawQuery = q.Encode()
+	r2.RequestURI = r2.URL.RequestURI()
+	return r2
+}
+
+// Stats returns a snapshot of the collected counters.
+func (m *Middleware) Stats() Stats {
+	return Stats{
+		Authenticated: atomic.LoadInt64(&m.authenticated),
+		Anonymous:     atomic.LoadInt64(&m.anonymous),
+		Unauthorized:  atomic.LoadInt64(&m.unauthorized),
+		Forbidden:     atomic.LoadInt64(&m.forbidden),
+		Errors:        atomic.LoadInt64(&m.errors),
+	}
+}
+
+// reject responds to a request that hasn't been authenticated.
+func (m *Middleware) reject(w http.ResponseWriter, r *http.Request, err error) {
+	var h http.Handler
+	var reason string
+	switch {
+	case errors.Is(err, ErrNoCredentials) || errors.Is(err, ErrInvalidCredentials):
+		atomic.AddInt64(&m.unauthorized, 1)
+		challenge := "Bearer"
+		if m.Realm != "" {
+			challenge += ` realm="` + m.Realm + `"`
+		}
+		if errors.Is(err, ErrInvalidCredentials) {
+			challenge += `, error="invalid_token"`
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+		h, reason = m.UnauthorizedHandler, "unauthorized"
+	case errors.Is(err, ErrForbidden):
+		atomic.AddInt64(&m.forbidden, 1)
+		h, reason = m.ForbiddenHandler, "forbidden"
+	default:
+		atomic.AddInt64(&m.errors, 1)
+		h, reason = m.ErrorHandler, "validator failed"
+	}
+	decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "auth", Action: decisionlog.Deny, Reason: reason + ": " + err.Error()})
+	h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), errorKey{}, err)))
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.Skip != nil && m.Skip(r) {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+	creds, ok := m.Credentials(r)
+	if !ok {
+		if m.Optional {
+			atomic.AddInt64(&m.anonymous, 1)
+			m.handler.ServeHTTP(w, r)
+			return
+		}
+		m.reject(w, r, ErrNoCredentials)
+		return
+	}
+	p, err := m.validator.Validate(r.Context(), creds)
+	if err == nil && p == nil {
+		err = ErrInvalidCredentials
+	}
+	if err != nil {
+		m.reject(w, r, err)
+		return
+	}
+	atomic.AddInt64(&m.authenticated, 1)
+	r = m.stripAPIKey(r)
+	m.handler.ServeHTTP(w, r.WithContext(NewContext(r.Context(), p)))
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	v := ValidatorFunc(func(ctx context.Context, creds Credentials) (*Principal, error) {
+		switch creds.Token {
+		case "alice-token":
+			return &Principal{ID: "alice"}, nil
+		case "bob-token":
+			return nil, ErrForbidden
+		case "broken":
+			return nil, errors.New("database is down")
+		}
+		return nil, ErrInvalidCredentials
+	})
+	var got, query string
+	m := New(v, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = PrincipalKey(r)
+		query = r.URL.RawQuery
+	}))
+	m.APIKeyQuery = "api_key"
+	m.Realm = "api"
+
+	testCases := []struct {
+		name      string
+		target    string
+		header    string
+		value     string
+		status    int
+		principal string
+	}{
+		{"bearer", "/", "Authorization", "Bearer alice-token", http.StatusOK, "alice"},
+		{"api key header", "/", "X-API-Key", "alice-token", http.StatusOK, "alice"},
+		{"api key query", "/?api_key=alice-token&x=1", "", "", http.StatusOK, "alice"},
+		{"basic", "/", "Authorization", "Basic YWxpY2U6cGFzcw==", http.StatusUnauthorized, ""},
+		{"none", "/", "", "", http.StatusUnauthorized, ""},
+		{"invalid", "/", "Authorization", "Bearer nope", http.StatusUnauthorized, ""},
+		{"forbidden", "/", "Authorization", "Bearer bob-token", http.StatusForbidden, ""},
+		{"broken", "/", "Authorization", "Bearer broken", http.StatusServiceUnavailable, ""},
+	}
+	for _, tc := range testCases {
+		got, query = "", ""
+		r := httptest.NewRequest("GET", tc.target, nil)
+		if tc.header != "" {
+			r.Header.Set(tc.header, tc.value)
+		}
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, r)
+		if rec.Code != tc.status {
+			t.Errorf("%s: status = %d, want %d", tc.name, rec.Code, tc.status)
+		}
+		if got != tc.principal {
+			t.Errorf("%s: principal = %q, want %q", tc.name, got, tc.principal)
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate challenge", tc.name)
+		}
+	}
+
+	got, query = "", ""
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?api_key=alice-token&x=1", nil))
+	if query != "x=1" {
+		t.Fatalf("query = %q, want the API key to be removed", query)
+	}
+
+	m.Optional = true
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || got != "" {
+		t.Fatalf("anonymous request: status = %d, principal = %q, want 200 without a principal", rec.Code, got)
+	}
+	if stats := m.Stats(); stats.Authenticated != 4 || stats.Anonymous != 1 || stats.Unauthorized != 3 || stats.Forbidden != 1 || stats.Errors != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
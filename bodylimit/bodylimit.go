@@ -0,0 +1,141 @@
+// Package bodylimit limits the size of request bodies. Bodies are read
+// through http.MaxBytesReader, so a handler that reads more than the limit
+// gets an *http.MaxBytesError and the server closes the connection after the
+// response instead of draining the rest of the body.
+package bodylimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/dmage/middleware/decisionlog"
+	"github.com/dmage/middleware/maxconnections"
+)
+
+func defaultTooLargeHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "413 request entity too large", http.StatusRequestEntityTooLarge)
+}
+
+// TooLargeHandler is a default TooLargeHandler for Middleware.
+var TooLargeHandler http.Handler = http.HandlerFunc(defaultTooLargeHandler)
+
+type limitKey struct{}
+
+// limitInfo is stored in contexts of requests that pass through Middleware.
+type limitInfo struct {
+	limit           int64
+	tooLargeHandler http.Handler
+}
+
+// LimitFromContext returns the body size limit of the request with ctx. It
+// returns false if the request has no limit.
+func LimitFromContext(ctx context.Context) (int64, bool) {
+	info, ok := ctx.Value(limitKey{}).(*limitInfo)
+	if !ok {
+		return 0, false
+	}
+	return info.limit, true
+}
+
+// HandleError responds with the TooLargeHandler of the middleware and
+// returns true if err is caused by a body larger than the limit. Otherwise
+// it returns false and doesn't write anything, so that handlers can use it
+// as
+//
+//	if err != nil {
+//		if !bodylimit.HandleError(w, r, err) {
+//			http.Error(w, err.Error(), http.StatusBadRequest)
+//		}
+//		return
+//	}
+func HandleError(w http.ResponseWriter, r *http.Request, err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(err, &maxBytesErr) {
+		return false
+	}
+	h := TooLargeHandler
+	if info, ok := r.Context().Value(limitKey{}).(*limitInfo); ok {
+		h = info.tooLargeHandler
+	}
+	h.ServeHTTP(w, r)
+	return true
+}
+
+// route is a set of requests with their own limit.
+type route struct {
+	match func(r *http.Request) bool
+	limit int64
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler http.Handler
+	routes  []route
+	def     int64
+
+	// CheckContentLength makes the middleware reject requests whose
+	// Content-Length exceeds the limit before the handler is called and
+	// anything is read.
+	CheckContentLength bool
+
+	// TooLargeHandler is called for requests rejected by
+	// CheckContentLength and by HandleError.
+	TooLargeHandler http.Handler
+}
+
+// New returns an http.Handler that limits request bodies to n bytes, unless
+// a more specific limit is registered for the request, and passes requests
+// to h. If n is negative, such requests have no limit. Routes should be
+// registered before the middleware starts serving requests.
+func New(n int64, h http.Handler) *Middleware {
+	return &Middleware{
+		handler:         h,
+		def:             n,
+		TooLargeHandler: TooLargeHandler,
+	}
+}
+
+// HandleFunc registers limit n for requests for which match returns true.
+// Routes are matched in the order they are registered.
+func (m *Middleware) HandleFunc(match func(r *http.Request) bool, n int64) {
+	m.routes = append(m.routes, route{match: match, limit: n})
+}
+
+// Handle registers limit n for requests that match pattern, see
+// maxconnections.MatchPattern.
+func (m *Middleware) Handle(pattern string, n int64) {
+	m.HandleFunc(maxconnections.MatchPattern(pattern), n)
+}
+
+// Limit returns the body size limit for r, negative if there is none.
+func (m *Middleware) Limit(r *http.Request) int64 {
+	for _, route := range m.routes {
+		if route.match(r) {
+			return route.limit
+		}
+	}
+	return m.def
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	limit := m.Limit(r)
+	if limit < 0 {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), limitKey{}, &limitInfo{limit: limit, tooLargeHandler: m.TooLargeHandler})
+	r = r.WithContext(ctx)
+	if m.CheckContentLength && r.ContentLength > limit {
+		decisionlog.Record(ctx, decisionlog.Decision{Middleware: "bodylimit", Action: decisionlog.Deny, Reason: "content length exceeds the limit"})
+		// The body is not read, so the connection can't be reused.
+		w.Header().Set("Connection", "close")
+		m.TooLargeHandler.ServeHTTP(w, r)
+		return
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	m.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,58 @@
+package bodylimit
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	var called bool
+	m := New(10, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			if !HandleError(w, r, err) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+		w.Write(data)
+	}))
+	m.Handle("/upload", 100)
+	m.Handle("/unlimited", -1)
+	m.TooLargeHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := LimitFromContext(r.Context())
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		io.WriteString(w, "limit "+strings.Repeat("!", int(limit/10)))
+	})
+
+	testCases := []struct {
+		path               string
+		size               int
+		checkContentLength bool
+		status             int
+		body               string
+		called             bool
+	}{
+		{"/", 10, false, http.StatusOK, strings.Repeat("x", 10), true},
+		{"/", 11, false, http.StatusRequestEntityTooLarge, "limit !", true},
+		{"/", 11, true, http.StatusRequestEntityTooLarge, "limit !", false},
+		{"/upload", 50, true, http.StatusOK, strings.Repeat("x", 50), true},
+		{"/unlimited", 1000, true, http.StatusOK, strings.Repeat("x", 1000), true},
+	}
+	for _, tc := range testCases {
+		called = false
+		m.CheckContentLength = tc.checkContentLength
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("POST", tc.path, strings.NewReader(strings.Repeat("x", tc.size))))
+		if rec.Code != tc.status || rec.Body.String() != tc.body {
+			t.Errorf("%s %d: got %d %q, want %d %q", tc.path, tc.size, rec.Code, rec.Body.String(), tc.status, tc.body)
+		}
+		if called != tc.called {
+			t.Errorf("%s %d: handler called = %v, want %v", tc.path, tc.size, called, tc.called)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stats contains counters collected by Middleware.
+type Stats struct {
+	// Hits and Misses are the numbers of requests that were served from
+	// the cache and by the handler.
+	Hits   int64
+	Misses int64
+
+	// Stored is the number of responses put into the cache.
+	Stored int64
+
+	// SuppressedSetCookie, SuppressedAuthorization and SuppressedPrivate
+	// are the numbers of responses that were not stored because they could
+	// leak user-specific data, see AllowPrivate.
+	SuppressedSetCookie     int64
+	SuppressedAuthorization int64
+	SuppressedPrivate       int64
+
+	// Bypassed is the number of requests that were passed to the handler
+	// without looking into the cache because of their Cache-Control.
+	Bypassed int64
+
+	// TooLarge is the number of responses that were not stored because
+	// their bodies exceeded MaxEntrySize.
+	TooLarge int64
+
+	// StoreErrors is the number of failed Store operations. Requests are
+	// served by the handler when the store fails.
+	StoreErrors int64
+}
+
+// Middleware implements the http.Handler interface. It serves GET and HEAD
+// requests from a cache of successful responses.
+//
+// As a shared cache, it refuses to store responses that are likely to be
+// user-specific: responses with Set-Cookie, responses marked with
+// Cache-Control: private, and responses to requests with Authorization
+// unless the response is explicitly marked as public.
+//
+// Cache-Control directives of requests are honored: no-store bypasses the
+// cache, no-cache makes the handler serve the request and refresh the
+// cache, max-age limits the age of a cached response, and only-if-cached
+// makes a miss respond with 504 Gateway Timeout.
+type Middleware struct {
+	handler http.Handler
+	ttl     time.Duration
+
+	mu    sync.Mutex
+	stats Stats
+
+	// Store keeps the responses. By default it is a MemoryStore for up to
+	// 10000 entries and 64 MiB. It should be set before the middleware
+	// starts serving requests.
+	Store Store
+
+	// Key returns the cache key of the request. By default the zero
+	// KeyBuilder is used. Responses with the Vary header are stored as
+	// separate variants for the values of the listed request headers, so
+	// the key doesn't need to include them.
+	Key KeyFunc
+
+	// MaxEntrySize is the maximum size of a stored response body in
+	// bytes. Larger responses are passed to the client without being
+	// buffered. By default it is 1 MiB.
+	MaxEntrySize int64
+
+	// AllowPrivate, if not nil, allows to store user-specific responses for
+	// the requests for which it returns true. It is meant for routes whose
+	// responses are known to be safe to share despite the guard.
+	AllowPrivate func(r *http.Request) bool
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// New returns an http.Handler that caches responses of h for ttl, unless the
+// response sets its own max-age.
+func New(ttl time.Duration, h http.Handler) *Middleware {
+	return &Middleware{
+		handler: h,
+		ttl:     ttl,
+		Store:   NewMemoryStore(defaultMaxEntries, defaultMaxBytes),
+		Key:     (&KeyBuilder{}).Key,
+
+		MaxEntrySize: defaultMaxEntrySize,
+
+		now: time.Now,
+	}
+}
+
+// Stats returns a snapshot of the collected counters.
+func (m *Middleware) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+// cacheControl parses the Cache-Control header into a map of directives.
+func cacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range h["Cache-Control"] {
+		for _, d := range strings.Split(value, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			parts := strings.SplitN(d, "=", 2)
+			arg := ""
+			if len(parts) == 2 {
+				arg = strings.Trim(parts[1], `"`)
+			}
+			directives[strings.ToLower(parts[0])] = arg
+		}
+	}
+	return directives
+}
+
+// ttlFor returns how long the response can be stored, or 0 if it cannot be
+// stored at all.
+func (m *Middleware) ttlFor(cc map[string]string) time.Duration {
+	if _, ok := cc["no-store"]; ok {
+		return 0
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if arg, ok := cc[name]; ok {
+			seconds, err := strconv.Atoi(arg)
+			if err != nil || seconds <= 0 {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return m.ttl
+}
+
+// suppress reports whether the response must not be stored because it may
+// be user-specific, and updates the counters. It should be called with mu
+// held.
+func (m *Middleware) suppress(r *http.Request, header http.Header, cc map[string]string) bool {
+	var counter *int64
+	switch {
+	case len(header["Set-Cookie"]) > 0:
+		counter = &m.stats.SuppressedSetCookie
+	case hasDirective(cc, "private"):
+		counter = &m.stats.SuppressedPrivate
+	case r.Header.Get("Authorization") != "" && !hasDirective(cc, "public") && !hasDirective(cc, "s-maxage"):
+		counter = &m.stats.SuppressedAuthorization
+	default:
+		return false
+	}
+	if m.AllowPrivate != nil && m.AllowPrivate(r) {
+		return false
+	}
+	*counter++
+	return true
+}
+
+func hasDirective(cc map[string]string, name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// recorder passes the response to the client and keeps a copy of it unless
+// the body exceeds max bytes.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	max    int64
+
+	// tooLarge is set when the body has exceeded max, the copy is dropped
+	// then.
+	tooLarge bool
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if !rec.tooLarge {
+		if rec.max > 0 && int64(rec.body.Len()+len(p)) > rec.max {
+			rec.tooLarge = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(p)
+		}
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+func serve(w http.ResponseWriter, r *http.Request, e *Entry, now time.Time) {
+	for name, values := range e.Header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.Header().Set("Age", strconv.Itoa(int(now.Sub(e.Stored)/time.Second)))
+	w.WriteHeader(e.Status)
+	if r.Method != "HEAD" {
+		w.Write(e.Body)
+	}
+}
+
+// fresh reports whether e can be served for a request with the Cache-Control
+// directives cc.
+func fresh(e *Entry, cc map[string]string, now time.Time) bool {
+	if !now.Before(e.Expires) {
+		return false
+	}
+	if arg, ok := cc["max-age"]; ok {
+		seconds, err := strconv.Atoi(arg)
+		if err != nil || now.Sub(e.Stored) > time.Duration(seconds)*time.Second {
+			return false
+		}
+	}
+	return true
+}
+
+// varyHeaders returns the request headers listed in the Vary header of a
+// response. It returns false if the response varies on something else than
+// request headers, i.e. it has Vary: *.
+func varyHeaders(h http.Header) ([]string, bool) {
+	var names []string
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				names = append(names, textproto.CanonicalMIMEHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// variantKey returns the key of the variant of the response for key that
+// matches the values of the headers of r.
+func variantKey(key string, headers []string, r *http.Request) string {
+	var sb strings.Builder
+	sb.WriteString(key)
+	for _, name := range headers {
+		sb.WriteString("\nv:")
+		sb.WriteString(name)
+		sb.WriteByte('=')
+		sb.WriteString(url.QueryEscape(strings.Join(r.Header.Values(name), ",")))
+	}
+	return sb.String()
+}
+
+// lookup returns the entry for r with key, following the index of variants
+// if the response has the Vary header. It also returns the key of the
+// entry.
+func (m *Middleware) lookup(ctx context.Context, key string, r *http.Request) (*Entry, string, bool, error) {
+	e, ok, err := m.Store.Get(ctx, key)
+	if err != nil || !ok || len(e.Vary) == 0 {
+		return e, key, ok, err
+	}
+	key = variantKey(key, e.Vary, r)
+	e, ok, err = m.Store.Get(ctx, key)
+	return e, key, ok, err
+}
+
+// storeError counts a failed Store operation.
+func (m *Middleware) storeError() {
+	m.mu.Lock()
+	m.stats.StoreErrors++
+	m.mu.Unlock()
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+
+	reqCC := cacheControl(r.Header)
+	if hasDirective(reqCC, "no-store") {
+		m.mu.Lock()
+		m.stats.Bypassed++
+		m.mu.Unlock()
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	key := m.Key(r)
+	now := m.now()
+
+	if !hasDirective(reqCC, "no-cache") {
+		e, entryKey, ok, err := m.lookup(ctx, key, r)
+		if err != nil {
+			m.storeError()
+		} else if ok && fresh(e, reqCC, now) {
+			m.mu.Lock()
+			m.stats.Hits++
+			m.mu.Unlock()
+			serve(w, r, e, now)
+			return
+		} else if ok && !now.Before(e.Expires) {
+			if err := m.Store.Delete(ctx, entryKey); err != nil {
+				m.storeError()
+			}
+		}
+	}
+	m.mu.Lock()
+	m.stats.Misses++
+	m.mu.Unlock()
+	if hasDirective(reqCC, "only-if-cached") {
+		http.Error(w, "504 gateway timeout", http.StatusGatewayTimeout)
+		return
+	}
+
+	rec := &recorder{ResponseWriter: w, max: m.MaxEntrySize}
+	m.handler.ServeHTTP(rec, r)
+	if rec.status == 0 {
+		// The handler has written nothing, the server will respond with
+		// 200 OK and an empty body.
+		rec.status = http.StatusOK
+	}
+
+	// HEAD responses have no body, so only GET responses are stored.
+	if r.Method != "GET" || rec.status != http.StatusOK {
+		return
+	}
+	header := w.Header()
+	cc := cacheControl(header)
+	ttl := m.ttlFor(cc)
+	if ttl <= 0 {
+		return
+	}
+
+	vary, ok := varyHeaders(header)
+	if !ok {
+		return
+	}
+
+	m.mu.Lock()
+	suppressed := m.suppress(r, header, cc)
+	if !suppressed && rec.tooLarge {
+		m.stats.TooLarge++
+	}
+	m.mu.Unlock()
+	if suppressed || rec.tooLarge {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	if len(vary) > 0 {
+		index := &Entry{
+			Vary:    vary,
+			Stored:  now,
+			Expires: now.Add(ttl),
+		}
+		if err := m.Store.Set(ctx, key, index); err != nil {
+			m.storeError()
+			return
+		}
+		key = variantKey(key, vary, r)
+	}
+	err := m.Store.Set(ctx, key, &Entry{
+		Status:  rec.status,
+		Header:  header.Clone(),
+		Body:    rec.body.Bytes(),
+		Stored:  now,
+		Expires: now.Add(ttl),
+	})
+	if err != nil {
+		m.storeError()
+		return
+	}
+	m.mu.Lock()
+	m.stats.Stored++
+	m.mu.Unlock()
+}
@@ -0,0 +1,251 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	calls := 0
+	m := New(time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("hello"))
+	}))
+	now := time.Unix(0, 0)
+	m.now = func() time.Time {
+		return now
+	}
+
+	get := func() string {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Body.String()
+	}
+
+	for i := 0; i < 2; i++ {
+		if body := get(); body != "hello" {
+			t.Fatalf("request %d: body = %q, want %q", i, body, "hello")
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("calls = %d, want 1", calls)
+	}
+
+	now = now.Add(time.Minute)
+	get()
+	if calls != 2 {
+		t.Fatalf("calls after expiration = %d, want 2", calls)
+	}
+
+	stats := m.Stats()
+	if expected := (Stats{Hits: 1, Misses: 2, Stored: 2}); stats != expected {
+		t.Fatalf("Stats() = %+v, want %+v", stats, expected)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	testCases := []struct {
+		cacheControl string
+		stored       bool
+	}{
+		{"", true},
+		{"max-age=60", true},
+		{"max-age=0", false},
+		{"no-store", false},
+		{"no-cache", false},
+		{"public, s-maxage=10", true},
+	}
+	for _, tc := range testCases {
+		m := New(time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.cacheControl != "" {
+				w.Header().Set("Cache-Control", tc.cacheControl)
+			}
+		}))
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if stored := m.Stats().Stored == 1; stored != tc.stored {
+			t.Errorf("Cache-Control %q: stored = %v, want %v", tc.cacheControl, stored, tc.stored)
+		}
+	}
+}
+
+func TestPrivateGuard(t *testing.T) {
+	testCases := []struct {
+		name          string
+		header        http.Header
+		authorization bool
+		allow         bool
+		expected      Stats
+	}{
+		{
+			name:     "set-cookie",
+			header:   http.Header{"Set-Cookie": {"session=1"}},
+			expected: Stats{Misses: 1, SuppressedSetCookie: 1},
+		},
+		{
+			name:     "private",
+			header:   http.Header{"Cache-Control": {"private, max-age=60"}},
+			expected: Stats{Misses: 1, SuppressedPrivate: 1},
+		},
+		{
+			name:          "authorization",
+			authorization: true,
+			expected:      Stats{Misses: 1, SuppressedAuthorization: 1},
+		},
+		{
+			name:          "authorization with public response",
+			header:        http.Header{"Cache-Control": {"public"}},
+			authorization: true,
+			expected:      Stats{Misses: 1, Stored: 1},
+		},
+		{
+			name:     "allowed",
+			header:   http.Header{"Set-Cookie": {"session=1"}},
+			allow:    true,
+			expected: Stats{Misses: 1, Stored: 1},
+		},
+	}
+	for _, tc := range testCases {
+		m := New(time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, values := range tc.header {
+				w.Header()[name] = values
+			}
+		}))
+		if tc.allow {
+			m.AllowPrivate = func(r *http.Request) bool {
+				return true
+			}
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		if tc.authorization {
+			r.Header.Set("Authorization", "Bearer secret")
+		}
+		m.ServeHTTP(httptest.NewRecorder(), r)
+		if stats := m.Stats(); stats != tc.expected {
+			t.Errorf("%s: Stats() = %+v, want %+v", tc.name, stats, tc.expected)
+		}
+	}
+}
+
+func TestRequestCacheControl(t *testing.T) {
+	calls := 0
+	m := New(time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("hello"))
+	}))
+	now := time.Unix(0, 0)
+	m.now = func() time.Time {
+		return now
+	}
+
+	get := func(cacheControl string) int {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		if cacheControl != "" {
+			r.Header.Set("Cache-Control", cacheControl)
+		}
+		m.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	if code := get("only-if-cached"); code != http.StatusGatewayTimeout {
+		t.Fatalf("only-if-cached miss: status = %d, want %d", code, http.StatusGatewayTimeout)
+	}
+	get("no-store")
+	get("")
+	now = now.Add(10 * time.Second)
+	steps := []struct {
+		cacheControl string
+		calls        int
+	}{
+		{"", 2},
+		{"max-age=20", 2},
+		{"max-age=5", 3},
+		{"no-cache", 4},
+		{"only-if-cached", 4},
+	}
+	for _, step := range steps {
+		get(step.cacheControl)
+		if calls != step.calls {
+			t.Fatalf("Cache-Control %q: calls = %d, want %d", step.cacheControl, calls, step.calls)
+		}
+	}
+	if stats := m.Stats(); stats.Bypassed != 1 || stats.Hits != 3 {
+		t.Fatalf("Stats() = %+v, want 1 bypassed request and 3 hits", stats)
+	}
+}
+
+func TestVary(t *testing.T) {
+	calls := 0
+	m := New(time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Vary", "Accept-Encoding")
+		if r.Header.Get("Accept-Encoding") == "gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write([]byte("compressed"))
+			return
+		}
+		w.Write([]byte("plain"))
+	}))
+
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, r)
+		return rec
+	}
+
+	get("gzip")
+	if rec := get(""); rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != "plain" {
+		t.Fatalf("response without Accept-Encoding: %q %q, want the plain variant", rec.Header().Get("Content-Encoding"), rec.Body.String())
+	}
+	if rec := get("gzip"); rec.Header().Get("Content-Encoding") != "gzip" || rec.Body.String() != "compressed" {
+		t.Fatalf("response with Accept-Encoding: %q %q, want the gzip variant", rec.Header().Get("Content-Encoding"), rec.Body.String())
+	}
+	get("")
+	if calls != 2 {
+		t.Fatalf("calls = %d, want each variant to be served by the handler once", calls)
+	}
+}
+
+func TestVaryStar(t *testing.T) {
+	m := New(time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "*")
+		w.Write([]byte("hello"))
+	}))
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if stats := m.Stats(); stats.Stored != 0 {
+		t.Fatalf("Stored = %d, want responses with Vary: * not to be stored", stats.Stored)
+	}
+}
+
+func TestMaxEntrySize(t *testing.T) {
+	m := New(time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 4; i++ {
+			w.Write([]byte("0123456789"))
+		}
+	}))
+	m.MaxEntrySize = 25
+	var rec *recorder
+	next := m.handler
+	m.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec = w.(*recorder)
+		next.ServeHTTP(w, r)
+	})
+
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, httptest.NewRequest("GET", "/", nil))
+	if res.Body.Len() != 40 {
+		t.Fatalf("body length = %d, want the whole response to reach the client", res.Body.Len())
+	}
+	if !rec.tooLarge || rec.body.Len() != 0 {
+		t.Fatalf("recorded %d bytes, want the copy to be dropped", rec.body.Len())
+	}
+	if stats := m.Stats(); stats.Stored != 0 || stats.TooLarge != 1 {
+		t.Fatalf("Stats() = %+v, want the response not to be stored", stats)
+	}
+}
@@ -0,0 +1,107 @@
+// Package cache provides building blocks for caching HTTP responses.
+package cache
+
+import (
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// KeyFunc returns the cache key of the request.
+type KeyFunc func(r *http.Request) string
+
+// KeyBuilder builds cache keys from selected parts of requests. The zero
+// value uses the method, the host, the path and all query parameters.
+//
+// Query parameters are always sorted, so that ?a=1&b=2 and ?b=2&a=1 share
+// the same key.
+type KeyBuilder struct {
+	// Headers is the list of request headers whose values are part of the
+	// key, for example Accept-Encoding or Accept-Language.
+	Headers []string
+
+	// Cookies is the list of cookies whose values are part of the key.
+	Cookies []string
+
+	// Query, if not nil, is the allowlist of query parameters that are part
+	// of the key. Other parameters are ignored.
+	Query []string
+
+	// IgnoreQuery excludes all query parameters from the key.
+	IgnoreQuery bool
+
+	// Lowercase lowercases the path and the values of query parameters,
+	// headers and cookies.
+	Lowercase bool
+}
+
+// Key returns the cache key of the request.
+func (b *KeyBuilder) Key(r *http.Request) string {
+	var sb strings.Builder
+	sb.WriteString(r.Method)
+	sb.WriteByte(' ')
+	sb.WriteString(strings.ToLower(r.Host))
+	sb.WriteString(b.normalize(r.URL.EscapedPath()))
+
+	if !b.IgnoreQuery {
+		if q := b.query(r.URL.Query()); q != "" {
+			sb.WriteByte('?')
+			sb.WriteString(q)
+		}
+	}
+
+	for _, name := range b.Headers {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		values := r.Header[name]
+		sb.WriteString("\nh:")
+		sb.WriteString(name)
+		sb.WriteByte('=')
+		sb.WriteString(url.QueryEscape(b.normalize(strings.Join(values, ","))))
+	}
+
+	for _, name := range b.Cookies {
+		sb.WriteString("\nc:")
+		sb.WriteString(name)
+		sb.WriteByte('=')
+		if c, err := r.Cookie(name); err == nil {
+			sb.WriteString(url.QueryEscape(b.normalize(c.Value)))
+		}
+	}
+
+	return sb.String()
+}
+
+func (b *KeyBuilder) normalize(s string) string {
+	if b.Lowercase {
+		return strings.ToLower(s)
+	}
+	return s
+}
+
+func (b *KeyBuilder) query(values url.Values) string {
+	if b.Query != nil {
+		allowed := make(url.Values, len(b.Query))
+		for _, name := range b.Query {
+			if v, ok := values[name]; ok {
+				allowed[name] = v
+			}
+		}
+		values = allowed
+	}
+	if b.Lowercase {
+		for name, v := range values {
+			lower := make([]string, len(v))
+			for i := range v {
+				lower[i] = strings.ToLower(v[i])
+			}
+			values[name] = lower
+		}
+	}
+	for _, v := range values {
+		sort.Strings(v)
+	}
+	// Encode sorts the parameters by name.
+	return values.Encode()
+}
@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newRequest(target string, header http.Header) *http.Request {
+	r := httptest.NewRequest("GET", target, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	return r
+}
+
+func TestKeyBuilder(t *testing.T) {
+	testCases := []struct {
+		name    string
+		builder KeyBuilder
+		a, b    *http.Request
+		same    bool
+	}{
+		{
+			name: "query order",
+			a:    newRequest("http://example.com/x?a=1&b=2", nil),
+			b:    newRequest("http://example.com/x?b=2&a=1", nil),
+			same: true,
+		},
+		{
+			name: "query values",
+			a:    newRequest("http://example.com/x?a=1", nil),
+			b:    newRequest("http://example.com/x?a=2", nil),
+			same: false,
+		},
+		{
+			name:    "query allowlist",
+			builder: KeyBuilder{Query: []string{"page"}},
+			a:       newRequest("http://example.com/x?page=2&utm_source=mail", nil),
+			b:       newRequest("http://example.com/x?page=2", nil),
+			same:    true,
+		},
+		{
+			name:    "query allowlist keeps allowed",
+			builder: KeyBuilder{Query: []string{"page"}},
+			a:       newRequest("http://example.com/x?page=1", nil),
+			b:       newRequest("http://example.com/x?page=2", nil),
+			same:    false,
+		},
+		{
+			name:    "ignore query",
+			builder: KeyBuilder{IgnoreQuery: true},
+			a:       newRequest("http://example.com/x?a=1", nil),
+			b:       newRequest("http://example.com/x", nil),
+			same:    true,
+		},
+		{
+			name: "path case",
+			a:    newRequest("http://example.com/X", nil),
+			b:    newRequest("http://example.com/x", nil),
+			same: false,
+		},
+		{
+			name:    "lowercase",
+			builder: KeyBuilder{Lowercase: true, Headers: []string{"Accept-Language"}},
+			a:       newRequest("http://example.com/X?q=Foo", http.Header{"Accept-Language": {"EN"}}),
+			b:       newRequest("http://example.com/x?q=foo", http.Header{"Accept-Language": {"en"}}),
+			same:    true,
+		},
+		{
+			name:    "headers",
+			builder: KeyBuilder{Headers: []string{"accept-encoding"}},
+			a:       newRequest("http://example.com/x", http.Header{"Accept-Encoding": {"gzip"}}),
+			b:       newRequest("http://example.com/x", nil),
+			same:    false,
+		},
+		{
+			name: "unselected headers",
+			a:    newRequest("http://example.com/x", http.Header{"Accept-Encoding": {"gzip"}}),
+			b:    newRequest("http://example.com/x", nil),
+			same: true,
+		},
+		{
+			name:    "cookies",
+			builder: KeyBuilder{Cookies: []string{"lang"}},
+			a:       newRequest("http://example.com/x", http.Header{"Cookie": {"lang=en; session=1"}}),
+			b:       newRequest("http://example.com/x", http.Header{"Cookie": {"lang=en; session=2"}}),
+			same:    true,
+		},
+		{
+			name:    "cookie values",
+			builder: KeyBuilder{Cookies: []string{"lang"}},
+			a:       newRequest("http://example.com/x", http.Header{"Cookie": {"lang=en"}}),
+			b:       newRequest("http://example.com/x", http.Header{"Cookie": {"lang=de"}}),
+			same:    false,
+		},
+		{
+			name:    "header value cannot forge a cookie",
+			builder: KeyBuilder{Headers: []string{"X-A"}, Cookies: []string{"lang"}},
+			a:       newRequest("http://example.com/x", http.Header{"X-A": {"1\nc:lang=en"}}),
+			b:       newRequest("http://example.com/x", http.Header{"X-A": {"1"}, "Cookie": {"lang=en"}}),
+			same:    false,
+		},
+	}
+	for _, tc := range testCases {
+		a, b := tc.builder.Key(tc.a), tc.builder.Key(tc.b)
+		if (a == b) != tc.same {
+			t.Errorf("%s: keys %q and %q, want same=%v", tc.name, a, b, tc.same)
+		}
+	}
+}
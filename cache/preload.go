@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+// maxSitemapDepth is the maximum nesting of sitemap indexes.
+const maxSitemapDepth = 3
+
+// discardWriter is an http.ResponseWriter that keeps the status and the body
+// of the response.
+type discardWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(p)
+}
+
+// Preloader warms up a cache by requesting URLs through it, e.g. before the
+// instance is marked as ready.
+type Preloader struct {
+	cache *Middleware
+
+	// Limiter admits the preload requests. It can be shared with the
+	// middleware that serves the traffic, so that preloading doesn't take
+	// the capacity needed by clients.
+	Limiter *maxconnections.Limiter
+
+	// Header, if not nil, is added to every preload request.
+	Header http.Header
+
+	// OnError, if not nil, is called for each URL that couldn't be
+	// preloaded.
+	OnError func(url string, err error)
+}
+
+// NewPreloader returns a Preloader for m that makes up to concurrency requests
+// at the same time.
+func NewPreloader(m *Middleware, concurrency int) *Preloader {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Preloader{
+		cache:   m,
+		Limiter: maxconnections.NewLimiter(concurrency, 1),
+	}
+}
+
+// request returns a GET request for url.
+func (p *Preloader) request(ctx context.Context, url string) (*http.Request, error) {
+	r, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.RequestURI = r.URL.RequestURI()
+	for name, values := range p.Header {
+		r.Header[name] = values
+	}
+	return r.WithContext(ctx), nil
+}
+
+// get passes a GET request for url to h and returns the response body.
+func (p *Preloader) get(ctx context.Context, h http.Handler, url string) ([]byte, error) {
+	r, err := p.request(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	w := &discardWriter{header: make(http.Header)}
+	h.ServeHTTP(w, r)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status != http.StatusOK {
+		return nil, fmt.Errorf("cache: preload %s: unexpected status %d", url, w.status)
+	}
+	return w.body.Bytes(), nil
+}
+
+// Preload requests urls through the cache. It returns when all requests are
+// finished, or when ctx is done or the limiter rejects a request. Failures
+// of individual URLs are reported to OnError.
+func (p *Preloader) Preload(ctx context.Context, urls []string) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, url := range urls {
+		release, err := p.Limiter.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			defer release()
+			if _, err := p.get(ctx, p.cache, url); err != nil && p.OnError != nil {
+				p.OnError(url, err)
+			}
+		}(url)
+	}
+	return ctx.Err()
+}
+
+// sitemap is a sitemap or a sitemap index, see https://www.sitemaps.org.
+type sitemap struct {
+	URLs     []string `xml:"url>loc"`
+	Sitemaps []string `xml:"sitemap>loc"`
+}
+
+// sitemapURLs returns the URLs listed in the sitemap at url and in the
+// sitemaps it refers to.
+func (p *Preloader) sitemapURLs(ctx context.Context, url string, depth int) ([]string, error) {
+	// Sitemaps are fetched from the handler directly, they don't need to
+	// be cached.
+	body, err := p.get(ctx, p.cache.handler, url)
+	if err != nil {
+		return nil, err
+	}
+	var s sitemap
+	if err := xml.Unmarshal(body, &s); err != nil {
+		return nil, fmt.Errorf("cache: parse sitemap %s: %v", url, err)
+	}
+	urls := make([]string, 0, len(s.URLs))
+	for _, u := range s.URLs {
+		urls = append(urls, strings.TrimSpace(u))
+	}
+	if len(s.Sitemaps) > 0 && depth >= maxSitemapDepth {
+		return nil, fmt.Errorf("cache: sitemap %s: sitemap indexes are nested too deep", url)
+	}
+	for _, child := range s.Sitemaps {
+		childURLs, err := p.sitemapURLs(ctx, strings.TrimSpace(child), depth+1)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, childURLs...)
+	}
+	return urls, nil
+}
+
+// PreloadSitemap preloads the URLs listed in the sitemap at sitemapURL. The
+// sitemap is requested from the handler of the cache, it can be a sitemap
+// index that refers to other sitemaps.
+func (p *Preloader) PreloadSitemap(ctx context.Context, sitemapURL string) error {
+	urls, err := p.sitemapURLs(ctx, sitemapURL, 0)
+	if err != nil {
+		return err
+	}
+	return p.Preload(ctx, urls)
+}
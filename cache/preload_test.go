@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPreloadSitemap(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	m := New(time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>http://example.com/sitemap-pages.xml</loc></sitemap>
+</sitemapindex>`))
+		case "/sitemap-pages.xml":
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>http://example.com/a</loc></url>
+  <url><loc>http://example.com/b</loc></url>
+  <url><loc>http://example.com/c</loc></url>
+  <url><loc>http://example.com/missing</loc></url>
+</urlset>`))
+		case "/missing":
+			http.NotFound(w, r)
+		default:
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			w.Write([]byte(r.URL.Path))
+		}
+	}))
+
+	var failed []string
+	p := NewPreloader(m, 2)
+	p.OnError = func(url string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed = append(failed, url)
+	}
+	if err := p.PreloadSitemap(context.Background(), "http://example.com/sitemap.xml"); err != nil {
+		t.Fatalf("PreloadSitemap() = %v, want nil", err)
+	}
+
+	if len(failed) != 1 || failed[0] != "http://example.com/missing" {
+		t.Fatalf("failed = %q, want [http://example.com/missing]", failed)
+	}
+	if maxRunning > 2 {
+		t.Fatalf("maxRunning = %d, want at most 2", maxRunning)
+	}
+	if stats := m.Stats(); stats.Stored != 3 {
+		t.Fatalf("Stored = %d, want 3", stats.Stored)
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/b", nil))
+	if body := rec.Body.String(); body != "/b" {
+		t.Fatalf("body = %q, want %q", body, "/b")
+	}
+	if stats := m.Stats(); stats.Hits != 1 {
+		t.Fatalf("Hits = %d, want 1", stats.Hits)
+	}
+}
+
+func TestPreloadCanceled(t *testing.T) {
+	m := New(time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := NewPreloader(m, 1).Preload(ctx, []string{"http://example.com/"}); err == nil {
+		t.Fatalf("Preload() = nil, want an error")
+	}
+}
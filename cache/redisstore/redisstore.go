@@ -0,0 +1,109 @@
+// Package redisstore implements a cache.Store that shares cached responses
+// between processes using Redis.
+package redisstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dmage/middleware/cache"
+)
+
+// Client is the subset of a Redis client used by Store. For example, a
+// go-redis client can be adapted as
+//
+//	redisstore.EvalFunc(func(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+//		return rdb.Eval(ctx, script, keys, args...).Result()
+//	})
+type Client interface {
+	// Eval runs a Lua script and returns its result.
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+// EvalFunc is an adapter to allow the use of ordinary functions as Client.
+type EvalFunc func(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+
+// Eval calls f(ctx, script, keys, args...).
+func (f EvalFunc) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	return f(ctx, script, keys, args...)
+}
+
+const (
+	getScript    = `return redis.call('GET', KEYS[1])`
+	setScript    = `return redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])`
+	deleteScript = `return redis.call('DEL', KEYS[1])`
+)
+
+// Store implements the cache.Store interface. Entries are stored as JSON
+// documents under Prefix + key and expire in Redis when they become stale.
+type Store struct {
+	client Client
+
+	// Prefix is prepended to cache keys to get Redis keys. By default it is
+	// "cache:".
+	Prefix string
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+var _ cache.Store = (*Store)(nil)
+
+// New returns a Store that uses client.
+func New(client Client) *Store {
+	return &Store{
+		client: client,
+		Prefix: "cache:",
+		now:    time.Now,
+	}
+}
+
+// Get implements cache.Store.
+func (s *Store) Get(ctx context.Context, key string) (*cache.Entry, bool, error) {
+	res, err := s.client.Eval(ctx, getScript, []string{s.Prefix + key})
+	if err != nil {
+		return nil, false, fmt.Errorf("redisstore: get: %w", err)
+	}
+	var data []byte
+	switch v := res.(type) {
+	case nil:
+		return nil, false, nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return nil, false, fmt.Errorf("redisstore: get: unexpected result %T", res)
+	}
+	var e cache.Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, false, fmt.Errorf("redisstore: get: %w", err)
+	}
+	return &e, true, nil
+}
+
+// Set implements cache.Store.
+func (s *Store) Set(ctx context.Context, key string, e *cache.Entry) error {
+	ttl := e.Expires.Sub(s.now())
+	if ttl < time.Millisecond {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("redisstore: set: %w", err)
+	}
+	if _, err := s.client.Eval(ctx, setScript, []string{s.Prefix + key}, string(data), ttl.Milliseconds()); err != nil {
+		return fmt.Errorf("redisstore: set: %w", err)
+	}
+	return nil
+}
+
+// Delete implements cache.Store.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	if _, err := s.client.Eval(ctx, deleteScript, []string{s.Prefix + key}); err != nil {
+		return fmt.Errorf("redisstore: delete: %w", err)
+	}
+	return nil
+}
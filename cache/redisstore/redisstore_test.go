@@ -0,0 +1,72 @@
+package redisstore
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dmage/middleware/cache"
+)
+
+// fakeRedis emulates the scripts and records TTLs.
+type fakeRedis struct {
+	values map[string]string
+	ttls   map[string]int64
+}
+
+func (f *fakeRedis) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	switch script {
+	case getScript:
+		v, ok := f.values[keys[0]]
+		if !ok {
+			return nil, nil
+		}
+		return v, nil
+	case setScript:
+		f.values[keys[0]] = args[0].(string)
+		f.ttls[keys[0]] = args[1].(int64)
+		return "OK", nil
+	case deleteScript:
+		delete(f.values, keys[0])
+		return int64(1), nil
+	}
+	panic("unexpected script")
+}
+
+func TestStore(t *testing.T) {
+	redis := &fakeRedis{values: map[string]string{}, ttls: map[string]int64{}}
+	now := time.Unix(100, 0)
+	s := New(redis)
+	s.now = func() time.Time {
+		return now
+	}
+	ctx := context.Background()
+
+	e := &cache.Entry{
+		Status:  http.StatusOK,
+		Header:  http.Header{"Content-Type": {"text/plain"}},
+		Body:    []byte("hello"),
+		Stored:  now,
+		Expires: now.Add(time.Minute),
+	}
+	if err := s.Set(ctx, "GET /", e); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := redis.ttls["cache:GET /"]; ttl != 60000 {
+		t.Fatalf("TTL = %d ms, want the time until the entry expires", ttl)
+	}
+	got, ok, err := s.Get(ctx, "GET /")
+	if err != nil || !ok {
+		t.Fatalf("Get() = %v, %v", ok, err)
+	}
+	if string(got.Body) != "hello" || got.Header.Get("Content-Type") != "text/plain" || !got.Expires.Equal(e.Expires) {
+		t.Fatalf("Get() = %+v, want %+v", got, e)
+	}
+	if err := s.Delete(ctx, "GET /"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := s.Get(ctx, "GET /"); ok {
+		t.Fatalf("the entry hasn't been deleted")
+	}
+}
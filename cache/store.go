@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxEntries   = 10000
+	defaultMaxBytes     = 64 << 20
+	defaultMaxEntrySize = 1 << 20
+)
+
+// Entry is a stored response.
+type Entry struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+
+	// Stored is when the response has been stored, it is used for the
+	// max-age directive of requests.
+	Stored time.Time `json:"stored"`
+
+	// Expires is when the response becomes stale.
+	Expires time.Time `json:"expires"`
+
+	// Vary, if not empty, makes the entry an index of the variants of a
+	// response with the Vary header: it lists the request headers, and the
+	// variants are stored under keys that include their values, see
+	// variantKey.
+	Vary []string `json:"vary,omitempty"`
+}
+
+// size returns the approximate memory footprint of e in bytes.
+func (e *Entry) size() int64 {
+	n := int64(len(e.Body))
+	for name, values := range e.Header {
+		n += int64(len(name))
+		for _, v := range values {
+			n += int64(len(v))
+		}
+	}
+	return n
+}
+
+// Store keeps responses. Stores may drop entries at any time, e.g. when
+// they are full, and may return expired entries, Middleware checks Expires
+// itself. Stores that are shared between replicas let them share the cache.
+type Store interface {
+	// Get returns the entry for key. It returns false if there is none.
+	Get(ctx context.Context, key string) (*Entry, bool, error)
+
+	// Set stores e for key. e must not be modified afterwards.
+	Set(ctx context.Context, key string, e *Entry) error
+
+	// Delete removes the entry for key.
+	Delete(ctx context.Context, key string) error
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+	size  int64
+}
+
+// MemoryStore is a Store that keeps entries in memory and evicts the least
+// recently used ones when it exceeds its bounds.
+type MemoryStore struct {
+	maxEntries int
+	maxBytes   int64
+
+	mu        sync.Mutex
+	items     map[string]*list.Element
+	lru       *list.List // front is the most recently used
+	bytes     int64
+	evictions int64
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore returns a MemoryStore that keeps up to maxEntries entries
+// with up to maxBytes bytes of headers and bodies in total. Non-positive
+// bounds are not enforced.
+func NewMemoryStore(maxEntries int, maxBytes int64) *MemoryStore {
+	return &MemoryStore{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		items:      make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Get implements Store.
+func (s *MemoryStore) Get(ctx context.Context, key string) (*Entry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+	s.lru.MoveToFront(el)
+	return el.Value.(*memoryItem).entry, true, nil
+}
+
+// Set implements Store. Entries larger than maxBytes are not stored.
+func (s *MemoryStore) Set(ctx context.Context, key string, e *Entry) error {
+	size := e.size()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+	if s.maxBytes > 0 && size > s.maxBytes {
+		return nil
+	}
+	s.items[key] = s.lru.PushFront(&memoryItem{key: key, entry: e, size: size})
+	s.bytes += size
+	for (s.maxEntries > 0 && s.lru.Len() > s.maxEntries) || (s.maxBytes > 0 && s.bytes > s.maxBytes) {
+		s.remove(s.lru.Back().Value.(*memoryItem).key)
+		s.evictions++
+	}
+	return nil
+}
+
+// Delete implements Store.
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+	return nil
+}
+
+// remove removes the entry for key. It should be called with mu held.
+func (s *MemoryStore) remove(key string) {
+	el, ok := s.items[key]
+	if !ok {
+		return
+	}
+	s.lru.Remove(el)
+	delete(s.items, key)
+	s.bytes -= el.Value.(*memoryItem).size
+}
+
+// Len returns the number of entries and their total size in bytes.
+func (s *MemoryStore) Len() (entries int, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len(), s.bytes
+}
+
+// Evictions returns the number of entries that have been evicted to keep
+// the store within its bounds.
+func (s *MemoryStore) Evictions() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.evictions
+}
@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore(2, 10)
+	entry := func(body string) *Entry {
+		return &Entry{Status: 200, Body: []byte(body)}
+	}
+
+	s.Set(ctx, "a", entry("aaa"))
+	s.Set(ctx, "b", entry("bbb"))
+	s.Get(ctx, "a")
+	s.Set(ctx, "c", entry("ccc"))
+	if _, ok, _ := s.Get(ctx, "b"); ok {
+		t.Fatalf("the least recently used entry hasn't been evicted by MaxEntries")
+	}
+
+	s.Set(ctx, "d", entry("dddddddd"))
+	if entries, bytes := s.Len(); entries != 1 || bytes != 8 {
+		t.Fatalf("Len() = %d, %d; want 1 entry of 8 bytes", entries, bytes)
+	}
+	if _, ok, _ := s.Get(ctx, "d"); !ok {
+		t.Fatalf("the new entry has been evicted")
+	}
+	if evictions := s.Evictions(); evictions != 3 {
+		t.Fatalf("Evictions() = %d, want 3", evictions)
+	}
+
+	s.Set(ctx, "e", entry("too large entry"))
+	if _, ok, _ := s.Get(ctx, "e"); ok {
+		t.Fatalf("an entry larger than MaxBytes has been stored")
+	}
+	s.Delete(ctx, "d")
+	if entries, bytes := s.Len(); entries != 0 || bytes != 0 {
+		t.Fatalf("Len() = %d, %d after Delete, want an empty store", entries, bytes)
+	}
+}
@@ -0,0 +1,257 @@
+// Package canary splits traffic between a primary and a canary handler, e.g.
+// the current and the next version of a backend:
+//
+//	m := canary.New(current, next, 0.05)
+//	m.Key = canary.CookieKey("session")
+//	m.Force = canary.HeaderMatch("X-Canary", "1")
+//
+// Requests that Force matches always go to the canary. Other requests go to
+// it with the probability of the weight. With Key, the split is sticky: a key
+// goes to the same arm as long as the weight doesn't change, and keys that
+// go to the canary stay there when the weight is increased.
+package canary
+
+import (
+	"bufio"
+	"context"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// Arm is a handler of the middleware.
+type Arm int
+
+const (
+	// Primary is the handler that gets the rest of the traffic.
+	Primary Arm = iota
+
+	// Canary is the handler that gets the share of the weight.
+	Canary
+)
+
+func (a Arm) String() string {
+	if a == Canary {
+		return "canary"
+	}
+	return "primary"
+}
+
+type armKey struct{}
+
+// ArmFromContext returns the arm that serves the request, e.g. to add it to
+// access logs.
+func ArmFromContext(ctx context.Context) (Arm, bool) {
+	a, ok := ctx.Value(armKey{}).(Arm)
+	return a, ok
+}
+
+// ArmStats contains counters of an arm.
+type ArmStats struct {
+	// Requests is the total number of requests served by the arm.
+	Requests int64 `json:"requests"`
+
+	// Errors is the total number of responses with 5xx status codes.
+	Errors int64 `json:"errors"`
+
+	// InFlight is the number of requests that are being served.
+	InFlight int64 `json:"in_flight"`
+}
+
+// Stats contains counters collected by Middleware.
+type Stats struct {
+	Weight  float64  `json:"weight"`
+	Primary ArmStats `json:"primary"`
+	Canary  ArmStats `json:"canary"`
+}
+
+// CookieKey returns a Key that is the value of the cookie with the given
+// name.
+func CookieKey(name string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		c, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return c.Value
+	}
+}
+
+// HeaderKey returns a Key that is the value of the header with the given
+// name, e.g. a user ID set by an authenticating proxy.
+func HeaderKey(name string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// HeaderMatch returns a Force function that matches requests with the given
+// header value.
+func HeaderMatch(name, value string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		return r.Header.Get(name) == value
+	}
+}
+
+// statusWriter remembers the status code of the response. It implements
+// http.Flusher and http.Hijacker when the underlying writer does.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// FlushError flushes the response, see http.ResponseController.
+func (w *statusWriter) FlushError() error {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statusWriter) Flush() {
+	w.FlushError()
+}
+
+// Hijack lets the handler take over the connection, see http.Hijacker.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// armCounters are the counters of an arm.
+type armCounters struct {
+	requests int64
+	errors   int64
+	inFlight int64
+}
+
+func (c *armCounters) stats() ArmStats {
+	return ArmStats{
+		Requests: atomic.LoadInt64(&c.requests),
+		Errors:   atomic.LoadInt64(&c.errors),
+		InFlight: atomic.LoadInt64(&c.inFlight),
+	}
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handlers [2]http.Handler
+	counters [2]armCounters
+
+	// weight is math.Float64bits of the weight.
+	weight uint64
+
+	// Force, if not nil, reports whether the request must be served by the
+	// canary regardless of the weight, e.g. for testers.
+	Force func(r *http.Request) bool
+
+	// Key, if not nil, returns the key that makes the split sticky, e.g. a
+	// user ID. Requests with empty keys are split randomly.
+	Key func(r *http.Request) string
+
+	// random allows to override rand.Float64 for tests.
+	random func() float64
+}
+
+// New returns an http.Handler that passes the share weight, from 0 to 1, of
+// requests to canary and the rest to primary.
+func New(primary, canary http.Handler, weight float64) *Middleware {
+	m := &Middleware{
+		handlers: [2]http.Handler{primary, canary},
+		random:   rand.Float64,
+	}
+	m.SetWeight(weight)
+	return m
+}
+
+// Weight returns the share of requests that go to the canary.
+func (m *Middleware) Weight() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&m.weight))
+}
+
+// SetWeight changes the share of requests that go to the canary. It is
+// clamped to the range from 0 to 1.
+func (m *Middleware) SetWeight(weight float64) {
+	weight = math.Max(0, math.Min(1, weight))
+	atomic.StoreUint64(&m.weight, math.Float64bits(weight))
+}
+
+// mix is the finalizer of MurmurHash3. FNV hashes of similar keys, e.g.
+// sequential user IDs, differ mostly in the low bits, mix spreads them.
+func mix(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// point returns a number from 0 to 1 that is compared to the weight.
+func (m *Middleware) point(r *http.Request) float64 {
+	if m.Key != nil {
+		if key := m.Key(r); key != "" {
+			h := fnv.New64a()
+			h.Write([]byte(key))
+			return float64(mix(h.Sum64())) / (1 << 64)
+		}
+	}
+	return m.random()
+}
+
+// Choose returns the arm that serves the request.
+func (m *Middleware) Choose(r *http.Request) Arm {
+	if m.Force != nil && m.Force(r) {
+		return Canary
+	}
+	if m.point(r) < m.Weight() {
+		return Canary
+	}
+	return Primary
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	arm := m.Choose(r)
+	c := &m.counters[arm]
+	atomic.AddInt64(&c.requests, 1)
+	atomic.AddInt64(&c.inFlight, 1)
+	defer atomic.AddInt64(&c.inFlight, -1)
+
+	sw := &statusWriter{ResponseWriter: w}
+	defer func() {
+		if sw.status >= 500 {
+			atomic.AddInt64(&c.errors, 1)
+		}
+	}()
+	m.handlers[arm].ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), armKey{}, arm)))
+}
+
+// Stats returns a snapshot of the collected counters.
+func (m *Middleware) Stats() Stats {
+	return Stats{
+		Weight:  m.Weight(),
+		Primary: m.counters[Primary].stats(),
+		Canary:  m.counters[Canary].stats(),
+	}
+}
@@ -0,0 +1,120 @@
+package canary
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestCanary(t *testing.T) {
+	arms := func(w http.ResponseWriter, r *http.Request) {
+		arm, _ := ArmFromContext(r.Context())
+		if arm == Canary {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte(arm.String()))
+	}
+	m := New(http.HandlerFunc(arms), http.HandlerFunc(arms), 0.3)
+	m.Force = HeaderMatch("X-Canary", "1")
+	point := 0.5
+	m.random = func() float64 { return point }
+
+	serve := func(r *http.Request) string {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, r)
+		return rec.Body.String()
+	}
+	if arm := serve(httptest.NewRequest("GET", "/", nil)); arm != "primary" {
+		t.Fatalf("arm = %s, want primary", arm)
+	}
+	point = 0.1
+	if arm := serve(httptest.NewRequest("GET", "/", nil)); arm != "canary" {
+		t.Fatalf("arm = %s, want canary", arm)
+	}
+
+	m.SetWeight(0)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Canary", "1")
+	if arm := serve(r); arm != "canary" {
+		t.Fatalf("arm = %s, want forced canary", arm)
+	}
+
+	if stats := m.Stats(); stats.Primary.Requests != 1 || stats.Canary.Requests != 2 || stats.Canary.Errors != 2 || stats.Primary.Errors != 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestCanarySticky(t *testing.T) {
+	m := New(http.NotFoundHandler(), http.NotFoundHandler(), 0.2)
+	m.Key = HeaderKey("X-User")
+	m.random = func() float64 {
+		t.Fatal("keyed requests are split randomly")
+		return 0
+	}
+
+	canary := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", strconv.Itoa(i))
+		if m.Choose(r) == Canary {
+			canary[strconv.Itoa(i)] = true
+		}
+	}
+	if n := len(canary); n < 150 || n > 250 {
+		t.Fatalf("%d of 1000 keys go to the canary, want about 200", n)
+	}
+
+	// Keys stay on the canary when the weight is increased.
+	m.SetWeight(0.5)
+	for key := range canary {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", key)
+		if m.Choose(r) != Canary {
+			t.Fatalf("key %s has left the canary", key)
+		}
+	}
+}
+
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func TestInterfaces(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws" {
+			hj, ok := w.(http.Hijacker)
+			if !ok {
+				t.Fatal("the writer doesn't implement http.Hijacker")
+			}
+			if _, _, err := hj.Hijack(); err != nil {
+				t.Fatalf("Hijack() = %v, want nil", err)
+			}
+			return
+		}
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("the writer doesn't implement http.Flusher")
+		}
+		f.Flush()
+	})
+	m := New(h, h, 0.5)
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !rec.Flushed {
+		t.Errorf("the response hasn't been flushed")
+	}
+	hj := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	m.ServeHTTP(hj, httptest.NewRequest("GET", "/ws", nil))
+	if !hj.hijacked {
+		t.Errorf("the connection hasn't been hijacked")
+	}
+}
@@ -0,0 +1,53 @@
+// Package chiadapter helps to use the middlewares of this repository with
+// the chi router.
+//
+// chi middlewares have the same signature as middleware.Constructor, so they
+// can be passed to Router.Use and Router.With as is:
+//
+//	r := chi.NewRouter()
+//	r.Use(middleware.Wrap(recovery.New))
+//	r.With(func(h http.Handler) http.Handler {
+//		k := maxconnections.NewKeyed(2, 10, 1000, h)
+//		k.Key = chiadapter.RoutePattern
+//		return k
+//	}).Post("/upload/{bucket}", upload)
+//
+// chi matches routes while the request passes through the router, so the
+// route pattern is complete only in middlewares that are added with With,
+// Route or Group next to the handler, not in the ones added with Use of the
+// root router.
+package chiadapter
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/dmage/middleware"
+)
+
+// Middlewares converts a Stack into chi middlewares, so it can be passed to
+// Router.Use as Use(chiadapter.Middlewares(s)...).
+func Middlewares(s middleware.Stack) chi.Middlewares {
+	res := make(chi.Middlewares, len(s))
+	for i, c := range s {
+		res[i] = c
+	}
+	return res
+}
+
+// RoutePattern returns the method and the route pattern that chi has matched
+// so far, e.g. "POST /upload/{bucket}". It can be used as a key of keyed and
+// per-route limits, and as httpmetrics Route. It returns an empty string for
+// requests that are not served by chi.
+func RoutePattern(r *http.Request) string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil {
+		return ""
+	}
+	pattern := rctx.RoutePattern()
+	if pattern == "" {
+		return ""
+	}
+	return r.Method + " " + pattern
+}
@@ -0,0 +1,41 @@
+package chiadapter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/dmage/middleware"
+)
+
+func TestRoutePattern(t *testing.T) {
+	var pattern string
+	r := chi.NewRouter()
+	r.Use(Middlewares(middleware.Chain(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Used", "1")
+			h.ServeHTTP(w, r)
+		})
+	}))...)
+	r.With(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pattern = RoutePattern(r)
+			h.ServeHTTP(w, r)
+		})
+	}).Post("/upload/{bucket}", func(w http.ResponseWriter, r *http.Request) {})
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/upload/photos", nil))
+	if rec.Header().Get("X-Used") != "1" {
+		t.Error("the stack is not used")
+	}
+	if pattern != "POST /upload/{bucket}" {
+		t.Errorf("RoutePattern() = %q, want %q", pattern, "POST /upload/{bucket}")
+	}
+
+	if p := RoutePattern(httptest.NewRequest("GET", "/", nil)); p != "" {
+		t.Errorf("RoutePattern() without chi = %q, want empty", p)
+	}
+}
@@ -0,0 +1,493 @@
+// Package circuitbreaker stops passing requests to a handler that keeps
+// failing. While the circuit is open, requests are rejected locally without
+// touching the handler, so a broken dependency behind it gets time to
+// recover and clients get a fast error instead of waiting for a timeout.
+// After OpenTimeout a few probe requests are let through, and the circuit
+// closes again if they succeed.
+package circuitbreaker
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dmage/middleware/decisionlog"
+)
+
+const (
+	defaultWindow           = 10 * time.Second
+	defaultOpenTimeout      = 5 * time.Second
+	defaultHalfOpenRequests = 1
+	defaultSyncInterval     = time.Second
+)
+
+// State is the state of a circuit.
+type State int
+
+const (
+	// Closed passes requests to the handler and counts failures.
+	Closed State = iota
+
+	// Open rejects requests.
+	Open
+
+	// HalfOpen passes a limited number of probe requests to the handler.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// MarshalText implements encoding.TextMarshaler, so that Stats are published
+// with readable states.
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *State) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "closed":
+		*s = Closed
+	case "open":
+		*s = Open
+	case "half-open":
+		*s = HalfOpen
+	default:
+		return errors.New("circuitbreaker: unknown state " + string(text))
+	}
+	return nil
+}
+
+// SharedState is the state of a circuit that is shared between instances.
+type SharedState struct {
+	// State is either Open or Closed.
+	State State `json:"state"`
+
+	// Since is when the circuit has entered the state.
+	Since time.Time `json:"since"`
+}
+
+// Store shares states of circuits between instances, so that a new instance
+// doesn't have to send requests to a broken upstream to learn that it is
+// broken.
+type Store interface {
+	// Load returns the state of the circuit name. It returns false if the
+	// state is unknown.
+	Load(ctx context.Context, name string) (SharedState, bool, error)
+
+	// Save stores the state of the circuit name.
+	Save(ctx context.Context, name string, state SharedState) error
+}
+
+func defaultOpenHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "503 service is temporarily unavailable, please try again later", http.StatusServiceUnavailable)
+}
+
+// OpenHandler is a default OpenHandler for Middleware.
+var OpenHandler http.Handler = http.HandlerFunc(defaultOpenHandler)
+
+// IsServerError reports whether status is a 5xx status. It is the default
+// IsFailure of Middleware.
+func IsServerError(status int) bool {
+	return status >= 500
+}
+
+// Stats describes the state of a Middleware.
+type Stats struct {
+	// State is the current state of the circuit.
+	State State `json:"state"`
+
+	// Requests and Failures are the numbers of requests and failures in
+	// the current window.
+	Requests int `json:"requests"`
+	Failures int `json:"failures"`
+
+	// ConsecutiveFailures is the number of failures since the latest
+	// success.
+	ConsecutiveFailures int `json:"consecutive_failures"`
+
+	// Rejected is the total number of requests rejected while the circuit
+	// was open.
+	Rejected int64 `json:"rejected"`
+
+	// Trips is the total number of times the circuit has opened.
+	Trips int64 `json:"trips"`
+}
+
+// statusWriter remembers the status code of the response. It implements
+// http.Flusher and http.Hijacker when the underlying writer does.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// FlushError flushes the response, see http.ResponseController.
+func (w *statusWriter) FlushError() error {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statusWriter) Flush() {
+	w.FlushError()
+}
+
+// Hijack lets the handler take over the connection, see http.Hijacker.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler http.Handler
+
+	// mu protects the fields below up to the configuration.
+	mu          sync.Mutex
+	state       State
+	windowStart time.Time
+	requests    int
+	failures    int
+	consecutive int
+	openedAt    time.Time
+	probes      int
+	successes   int
+	rejected    int64
+	trips       int64
+	lastSync    time.Time
+	syncing     bool
+
+	// FailureRate, if positive, is the fraction of failed requests within
+	// Window (e.g. 0.5) that trips the circuit, once there have been at
+	// least MinRequests requests in the window.
+	FailureRate float64
+	MinRequests int
+
+	// Window is the period over which FailureRate is computed. Counts are
+	// reset at the end of every window. By default it is 10 seconds.
+	Window time.Duration
+
+	// ConsecutiveFailures, if positive, is the number of failures in a row
+	// that trips the circuit.
+	ConsecutiveFailures int
+
+	// OpenTimeout is how long the circuit stays open before it lets probe
+	// requests through. By default it is 5 seconds.
+	OpenTimeout time.Duration
+
+	// HalfOpenRequests is the number of probe requests in the half-open
+	// state. If all of them succeed, the circuit closes, the first failure
+	// opens it again. Other requests are rejected while the probes run. By
+	// default it is 1.
+	HalfOpenRequests int
+
+	// IsFailure reports whether the response status is a failure. By
+	// default it is IsServerError. Handlers that panic are always failures.
+	IsFailure func(status int) bool
+
+	// OpenHandler is called for requests rejected while the circuit is
+	// open.
+	OpenHandler http.Handler
+
+	// OnStateChange, if not nil, is called when the circuit changes its
+	// state. It is called with the internal lock held, so it must not call
+	// methods of the middleware.
+	OnStateChange func(from, to State)
+
+	// Store, if not nil, shares the state of the circuit with other
+	// instances under Name. An instance adopts the Open state of another
+	// instance if it is closed, and the Closed state if it has opened
+	// before the other instance has closed the circuit. Probes in the
+	// half-open state are still sent by every instance.
+	Store Store
+	Name  string
+
+	// SyncInterval is how often the state is loaded from Store. The request
+	// that triggers the load waits for it. By default it is 1 second.
+	SyncInterval time.Duration
+
+	// OnStoreError, if not nil, is called when Store fails. The circuit
+	// keeps working with its local state.
+	OnStoreError func(err error)
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// New returns an http.Handler that passes requests to h while the circuit is
+// closed. The trip conditions, FailureRate and ConsecutiveFailures, should be
+// set before the middleware starts serving requests.
+func New(h http.Handler) *Middleware {
+	return &Middleware{
+		handler:          h,
+		Window:           defaultWindow,
+		OpenTimeout:      defaultOpenTimeout,
+		HalfOpenRequests: defaultHalfOpenRequests,
+		IsFailure:        IsServerError,
+		OpenHandler:      OpenHandler,
+		now:              time.Now,
+	}
+}
+
+func orDefault(value, def time.Duration) time.Duration {
+	if value <= 0 {
+		return def
+	}
+	return value
+}
+
+// setState changes the state of the circuit. It should be called with mu
+// held.
+func (m *Middleware) setState(state State, now time.Time) {
+	from := m.state
+	m.state = state
+	m.requests, m.failures, m.consecutive = 0, 0, 0
+	m.windowStart = now
+	switch state {
+	case Open:
+		m.openedAt = now
+		m.trips++
+	case HalfOpen:
+		m.probes, m.successes = 0, 0
+	}
+	if m.OnStateChange != nil && from != state {
+		m.OnStateChange(from, state)
+	}
+}
+
+// shared returns the state to save to Store after the circuit has changed
+// its state from before, or nil if it shouldn't be saved. It should be
+// called with mu held.
+func (m *Middleware) shared(before State, now time.Time) *SharedState {
+	if m.Store == nil || m.state == before || m.state == HalfOpen {
+		return nil
+	}
+	return &SharedState{State: m.state, Since: now}
+}
+
+// save stores s in Store if s is not nil.
+func (m *Middleware) save(ctx context.Context, s *SharedState) {
+	if s == nil {
+		return
+	}
+	if err := m.Store.Save(context.WithoutCancel(ctx), m.Name, *s); err != nil && m.OnStoreError != nil {
+		m.OnStoreError(err)
+	}
+}
+
+// adopt changes the state of the circuit according to the state of other
+// instances. It should be called with mu held.
+func (m *Middleware) adopt(s SharedState, now time.Time) {
+	switch {
+	case s.State == Open && m.state == Closed && now.Sub(s.Since) < orDefault(m.OpenTimeout, defaultOpenTimeout):
+		m.setState(Open, now)
+		m.openedAt = s.Since
+	case s.State == Closed && m.state == Open && s.Since.After(m.openedAt):
+		m.setState(Closed, now)
+	}
+}
+
+// sync loads the state of the circuit from Store if SyncInterval has passed
+// since the last load.
+func (m *Middleware) sync(ctx context.Context) {
+	now := m.now()
+	m.mu.Lock()
+	if m.syncing || (!m.lastSync.IsZero() && now.Sub(m.lastSync) < orDefault(m.SyncInterval, defaultSyncInterval)) {
+		m.mu.Unlock()
+		return
+	}
+	m.syncing = true
+	m.mu.Unlock()
+
+	s, ok, err := m.Store.Load(ctx, m.Name)
+
+	m.mu.Lock()
+	m.syncing = false
+	m.lastSync = now
+	if err == nil && ok {
+		m.adopt(s, now)
+	}
+	m.mu.Unlock()
+	if err != nil && m.OnStoreError != nil {
+		m.OnStoreError(err)
+	}
+}
+
+// allow reports whether a request may be passed to the handler and whether
+// it is a probe.
+func (m *Middleware) allow() (ok, probe bool) {
+	now := m.now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch m.state {
+	case Closed:
+		if now.Sub(m.windowStart) >= orDefault(m.Window, defaultWindow) {
+			m.windowStart = now
+			m.requests, m.failures = 0, 0
+		}
+		return true, false
+	case Open:
+		if now.Sub(m.openedAt) < orDefault(m.OpenTimeout, defaultOpenTimeout) {
+			m.rejected++
+			return false, false
+		}
+		m.setState(HalfOpen, now)
+	}
+
+	halfOpenRequests := m.HalfOpenRequests
+	if halfOpenRequests <= 0 {
+		halfOpenRequests = defaultHalfOpenRequests
+	}
+	if m.probes >= halfOpenRequests {
+		m.rejected++
+		return false, false
+	}
+	m.probes++
+	return true, true
+}
+
+// tripped reports whether the counts of the closed circuit should open it.
+// It should be called with mu held.
+func (m *Middleware) tripped() bool {
+	if m.ConsecutiveFailures > 0 && m.consecutive >= m.ConsecutiveFailures {
+		return true
+	}
+	return m.FailureRate > 0 && m.requests >= m.MinRequests &&
+		float64(m.failures) >= m.FailureRate*float64(m.requests)
+}
+
+// record counts the outcome of a request that has been passed to the
+// handler. It returns the state to save to Store if the circuit has changed
+// its state.
+func (m *Middleware) record(failed, probe bool) *SharedState {
+	now := m.now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	before := m.state
+	m.recordLocked(failed, probe, now)
+	return m.shared(before, now)
+}
+
+// recordLocked counts the outcome of a request. It should be called with mu
+// held.
+func (m *Middleware) recordLocked(failed, probe bool, now time.Time) {
+	if probe {
+		// Probes of an earlier half-open state may finish after the
+		// circuit has changed its state.
+		if m.state != HalfOpen {
+			return
+		}
+		if failed {
+			m.setState(Open, now)
+			return
+		}
+		halfOpenRequests := m.HalfOpenRequests
+		if halfOpenRequests <= 0 {
+			halfOpenRequests = defaultHalfOpenRequests
+		}
+		if m.successes++; m.successes >= halfOpenRequests {
+			m.setState(Closed, now)
+		}
+		return
+	}
+
+	if m.state != Closed {
+		return
+	}
+	m.requests++
+	if failed {
+		m.failures++
+		m.consecutive++
+	} else {
+		m.consecutive = 0
+	}
+	if m.tripped() {
+		m.setState(Open, now)
+	}
+}
+
+// State returns the current state of the circuit.
+func (m *Middleware) State() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Stats returns a snapshot of the state of the middleware.
+func (m *Middleware) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return Stats{
+		State:               m.state,
+		Requests:            m.requests,
+		Failures:            m.failures,
+		ConsecutiveFailures: m.consecutive,
+		Rejected:            m.rejected,
+		Trips:               m.trips,
+	}
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.Store != nil {
+		m.sync(r.Context())
+	}
+	ok, probe := m.allow()
+	if !ok {
+		decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "circuitbreaker", Action: decisionlog.Deny, Reason: "circuit open"})
+		m.OpenHandler.ServeHTTP(w, r)
+		return
+	}
+	if probe {
+		decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "circuitbreaker", Action: decisionlog.Allow, Reason: "probe"})
+	}
+
+	sw := &statusWriter{ResponseWriter: w}
+	failed := true
+	defer func() {
+		m.save(r.Context(), m.record(failed, probe))
+	}()
+	m.handler.ServeHTTP(sw, r)
+	status := sw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	isFailure := m.IsFailure
+	if isFailure == nil {
+		isFailure = IsServerError
+	}
+	failed = isFailure(status)
+}
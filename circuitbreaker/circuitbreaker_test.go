@@ -0,0 +1,239 @@
+package circuitbreaker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConsecutiveFailures(t *testing.T) {
+	now := time.Unix(0, 0)
+	status := http.StatusInternalServerError
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	m.ConsecutiveFailures = 2
+	m.OpenTimeout = time.Second
+	m.now = func() time.Time {
+		return now
+	}
+	var changes []string
+	m.OnStateChange = func(from, to State) {
+		changes = append(changes, from.String()+"->"+to.String())
+	}
+
+	serve := func() int {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Code
+	}
+
+	steps := []struct {
+		advance time.Duration
+		status  int
+		code    int
+		state   State
+	}{
+		{0, http.StatusInternalServerError, http.StatusInternalServerError, Closed},
+		{0, http.StatusOK, http.StatusOK, Closed},
+		{0, http.StatusInternalServerError, http.StatusInternalServerError, Closed},
+		{0, http.StatusBadGateway, http.StatusBadGateway, Open},
+		{0, http.StatusOK, http.StatusServiceUnavailable, Open},
+		{time.Second, http.StatusInternalServerError, http.StatusInternalServerError, Open},
+		{time.Second, http.StatusNotFound, http.StatusNotFound, Closed},
+	}
+	for i, step := range steps {
+		now = now.Add(step.advance)
+		status = step.status
+		if code := serve(); code != step.code {
+			t.Errorf("step %d: status = %d, want %d", i, code, step.code)
+		}
+		if state := m.State(); state != step.state {
+			t.Errorf("step %d: state = %s, want %s", i, state, step.state)
+		}
+	}
+
+	expected := []string{"closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed"}
+	if len(changes) != len(expected) {
+		t.Fatalf("state changes = %v, want %v", changes, expected)
+	}
+	for i := range changes {
+		if changes[i] != expected[i] {
+			t.Fatalf("state changes = %v, want %v", changes, expected)
+		}
+	}
+	if stats := m.Stats(); stats.Trips != 2 || stats.Rejected != 1 {
+		t.Fatalf("Stats() = %+v, want 2 trips and 1 rejected request", stats)
+	}
+}
+
+func TestFailureRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	fail := false
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	m.FailureRate = 0.5
+	m.MinRequests = 4
+	m.Window = time.Minute
+	m.now = func() time.Time {
+		return now
+	}
+
+	for i, f := range []bool{true, false, true, false} {
+		fail = f
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		expected := Closed
+		if i == 3 {
+			// 2 failures of 4 requests.
+			expected = Open
+		}
+		if state := m.State(); state != expected {
+			t.Fatalf("request %d: state = %s, want %s", i, state, expected)
+		}
+	}
+}
+
+func TestWindow(t *testing.T) {
+	now := time.Unix(0, 0)
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	m.FailureRate = 0.5
+	m.MinRequests = 2
+	m.Window = time.Second
+	m.now = func() time.Time {
+		return now
+	}
+
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	now = now.Add(time.Second)
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if stats := m.Stats(); stats.State != Closed || stats.Requests != 1 {
+		t.Fatalf("Stats() = %+v, want closed with 1 request in the window", stats)
+	}
+
+	data, err := json.Marshal(m.Stats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var published struct {
+		State string
+	}
+	if err := json.Unmarshal(data, &published); err != nil || published.State != "closed" {
+		t.Fatalf("published state = %q, %v; want closed", published.State, err)
+	}
+}
+
+// memoryStore is a Store shared by middlewares of the test.
+type memoryStore map[string]SharedState
+
+func (s memoryStore) Load(ctx context.Context, name string) (SharedState, bool, error) {
+	state, ok := s[name]
+	return state, ok, nil
+}
+
+func (s memoryStore) Save(ctx context.Context, name string, state SharedState) error {
+	s[name] = state
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	now := time.Unix(0, 0)
+	store := memoryStore{}
+	status := http.StatusInternalServerError
+	newMiddleware := func() *Middleware {
+		m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		m.ConsecutiveFailures = 1
+		m.OpenTimeout = 10 * time.Second
+		m.Store = store
+		m.Name = "upstream"
+		m.now = func() time.Time {
+			return now
+		}
+		return m
+	}
+	serve := func(m *Middleware) int {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Code
+	}
+
+	a := newMiddleware()
+	serve(a)
+	if state := store["upstream"]; state.State != Open || !state.Since.Equal(now) {
+		t.Fatalf("stored state = %+v, want open", state)
+	}
+
+	// A new instance learns that the upstream is down without sending
+	// requests to it.
+	now = now.Add(time.Second)
+	b := newMiddleware()
+	b.OpenTimeout = time.Hour
+	if code := serve(b); code != http.StatusServiceUnavailable {
+		t.Fatalf("status of the new instance = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	// The first instance closes the circuit after its probe has succeeded,
+	// the second one adopts the state instead of waiting for its own
+	// OpenTimeout.
+	now = now.Add(10 * time.Second)
+	status = http.StatusOK
+	serve(a)
+	if state := store["upstream"]; state.State != Closed {
+		t.Fatalf("stored state = %+v, want closed", state)
+	}
+	if code := serve(b); code != http.StatusOK || b.State() != Closed {
+		t.Fatalf("second instance: status = %d, state = %s; want 200 and closed", code, b.State())
+	}
+}
+
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func TestInterfaces(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws" {
+			hj, ok := w.(http.Hijacker)
+			if !ok {
+				t.Fatal("the writer doesn't implement http.Hijacker")
+			}
+			if _, _, err := hj.Hijack(); err != nil {
+				t.Fatalf("Hijack() = %v, want nil", err)
+			}
+			return
+		}
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("the writer doesn't implement http.Flusher")
+		}
+		f.Flush()
+	})
+	m := New(h)
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !rec.Flushed {
+		t.Errorf("the response hasn't been flushed")
+	}
+	hj := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	m.ServeHTTP(hj, httptest.NewRequest("GET", "/ws", nil))
+	if !hj.hijacked {
+		t.Errorf("the connection hasn't been hijacked")
+	}
+}
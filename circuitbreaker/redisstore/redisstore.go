@@ -0,0 +1,104 @@
+// Package redisstore implements a circuitbreaker.Store that shares states of
+// circuits between processes using Redis.
+package redisstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dmage/middleware/circuitbreaker"
+)
+
+// Client is the subset of a Redis client used by Store. For example, a
+// go-redis client can be adapted as
+//
+//	redisstore.EvalFunc(func(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+//		return rdb.Eval(ctx, script, keys, args...).Result()
+//	})
+type Client interface {
+	// Eval runs a Lua script and returns its result.
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+// EvalFunc is an adapter to allow the use of ordinary functions as Client.
+type EvalFunc func(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+
+// Eval calls f(ctx, script, keys, args...).
+func (f EvalFunc) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	return f(ctx, script, keys, args...)
+}
+
+const (
+	loadScript = `return redis.call('GET', KEYS[1])`
+	saveScript = `return redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])`
+)
+
+const defaultTTL = time.Hour
+
+// Store implements the circuitbreaker.Store interface. States are stored as
+// JSON documents under Prefix + name.
+type Store struct {
+	client Client
+
+	// Prefix is prepended to names of circuits to get Redis keys. By
+	// default it is "circuitbreaker:".
+	Prefix string
+
+	// TTL is how long a state is kept after it has been saved, so that
+	// states of removed circuits don't stay in Redis forever. By default it
+	// is 1 hour.
+	TTL time.Duration
+}
+
+var _ circuitbreaker.Store = (*Store)(nil)
+
+// New returns a Store that uses client.
+func New(client Client) *Store {
+	return &Store{
+		client: client,
+		Prefix: "circuitbreaker:",
+		TTL:    defaultTTL,
+	}
+}
+
+// Load implements circuitbreaker.Store.
+func (s *Store) Load(ctx context.Context, name string) (circuitbreaker.SharedState, bool, error) {
+	var state circuitbreaker.SharedState
+	res, err := s.client.Eval(ctx, loadScript, []string{s.Prefix + name})
+	if err != nil {
+		return state, false, fmt.Errorf("redisstore: load %s: %w", name, err)
+	}
+	var data []byte
+	switch v := res.(type) {
+	case nil:
+		return state, false, nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return state, false, fmt.Errorf("redisstore: load %s: unexpected result %T", name, res)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, false, fmt.Errorf("redisstore: load %s: %w", name, err)
+	}
+	return state, true, nil
+}
+
+// Save implements circuitbreaker.Store.
+func (s *Store) Save(ctx context.Context, name string, state circuitbreaker.SharedState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("redisstore: save %s: %w", name, err)
+	}
+	ttl := s.TTL
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	if _, err := s.client.Eval(ctx, saveScript, []string{s.Prefix + name}, string(data), ttl.Milliseconds()); err != nil {
+		return fmt.Errorf("redisstore: save %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package redisstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dmage/middleware/circuitbreaker"
+)
+
+// fakeRedis emulates GET and SET of the scripts.
+type fakeRedis map[string]string
+
+func (f fakeRedis) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	switch script {
+	case loadScript:
+		v, ok := f[keys[0]]
+		if !ok {
+			return nil, nil
+		}
+		return v, nil
+	case saveScript:
+		f[keys[0]] = args[0].(string)
+		return "OK", nil
+	}
+	panic("unexpected script")
+}
+
+func TestStore(t *testing.T) {
+	redis := fakeRedis{}
+	s := New(redis)
+	ctx := context.Background()
+
+	if _, ok, err := s.Load(ctx, "upstream"); err != nil || ok {
+		t.Fatalf("Load() of an unknown circuit = %v, %v, want not found", ok, err)
+	}
+
+	since := time.Unix(100, 0).UTC()
+	if err := s.Save(ctx, "upstream", circuitbreaker.SharedState{State: circuitbreaker.Open, Since: since}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := redis["circuitbreaker:upstream"]; !ok {
+		t.Fatalf("the state hasn't been saved under the prefixed key: %v", redis)
+	}
+	state, ok, err := s.Load(ctx, "upstream")
+	if err != nil || !ok {
+		t.Fatalf("Load() = %v, %v", ok, err)
+	}
+	if state.State != circuitbreaker.Open || !state.Since.Equal(since) {
+		t.Fatalf("Load() = %+v, want open since %v", state, since)
+	}
+}
@@ -0,0 +1,64 @@
+// Command middleware-lint validates a middleware policy document and prints
+// the effective policy of each route.
+//
+// Usage:
+//
+//	middleware-lint [-q] config.json
+//
+// It exits with a non-zero status if the document is invalid, so it can be
+// used to check a configuration before it is deployed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/dmage/middleware/config"
+)
+
+func main() {
+	quiet := flag.Bool("q", false, "don't print effective policies")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-q] config.json\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	c, err := config.Parse(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+
+	if !*quiet {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, r := range c.Effective() {
+			pattern := r.Pattern
+			if pattern == "" {
+				pattern = "(default)"
+			}
+			fmt.Fprintf(w, "%s\t%s\n", pattern, r.Policy)
+		}
+		w.Flush()
+	}
+
+	errs := c.Validate()
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flag.Arg(0), err)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,215 @@
+// Package coalesce collapses concurrent identical GET requests into a single
+// execution of the handler. The first request (the leader) is served by the
+// handler as usual, and its buffered response is sent to requests that have
+// arrived while it was running. Together with maxconnections it keeps a
+// thundering herd, e.g. on a cache expiry, from occupying all running units
+// with the same work.
+//
+// Requests are identical when they have the same fingerprint (see the
+// fingerprint package) or, if there is none in the request context, the
+// same Key. Responses that set cookies are never shared.
+package coalesce
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+
+	"github.com/dmage/middleware/cache"
+	"github.com/dmage/middleware/fingerprint"
+)
+
+const defaultMaxBodySize = 1 << 20
+
+// Stats contains counters collected by Middleware.
+type Stats struct {
+	// Leaders is the number of requests that have been passed to the
+	// handler on behalf of others. Requests that no one has waited for are
+	// not counted.
+	Leaders int64 `json:"leaders"`
+
+	// Coalesced is the number of requests that have got the response of a
+	// leader.
+	Coalesced int64 `json:"coalesced"`
+
+	// Fallbacks is the number of requests that have waited for a leader,
+	// but have been passed to the handler because the response of the
+	// leader could not be shared.
+	Fallbacks int64 `json:"fallbacks"`
+}
+
+// call is an execution of the handler shared by several requests.
+type call struct {
+	done chan struct{}
+
+	// waiters is the number of requests that wait for the response. It is
+	// protected by the mutex of Middleware.
+	waiters int
+
+	// The fields below are set before done is closed. ok is false if the
+	// response cannot be shared.
+	ok     bool
+	status int
+	header http.Header
+	body   []byte
+}
+
+// recorder passes the response of the leader to its client and keeps a copy
+// of it.
+type recorder struct {
+	http.ResponseWriter
+	maxBodySize int
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	tooLarge    bool
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 && status >= 200 {
+		rec.status = status
+		rec.header = rec.ResponseWriter.Header().Clone()
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.tooLarge {
+		if rec.body.Len()+len(p) > rec.maxBodySize {
+			rec.tooLarge = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(p)
+		}
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (rec *recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler http.Handler
+
+	mu    sync.Mutex
+	calls map[string]*call
+	stats Stats
+
+	// Key returns the key of a request without a fingerprint. By default
+	// the method, the URL, Authorization and Cookie are used, so that
+	// responses of different users are not shared.
+	Key cache.KeyFunc
+
+	// MaxBodySize is the maximum size of a response body that is shared.
+	// Waiting requests are passed to the handler if the response of the
+	// leader is larger. By default it is 1 MiB.
+	MaxBodySize int
+}
+
+// New returns an http.Handler that passes requests to h and coalesces
+// concurrent identical GET requests.
+func New(h http.Handler) *Middleware {
+	return &Middleware{
+		handler:     h,
+		calls:       make(map[string]*call),
+		Key:         (&cache.KeyBuilder{Headers: []string{"Authorization", "Cookie"}}).Key,
+		MaxBodySize: defaultMaxBodySize,
+	}
+}
+
+// Stats returns a snapshot of the collected counters.
+func (m *Middleware) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+func (m *Middleware) key(r *http.Request) string {
+	if fp := fingerprint.FromContext(r.Context()); fp != "" {
+		return fp
+	}
+	return m.Key(r)
+}
+
+// lead passes r to the handler and shares the response with c.
+func (m *Middleware) lead(w http.ResponseWriter, r *http.Request, key string, c *call) {
+	maxBodySize := m.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = defaultMaxBodySize
+	}
+	rec := &recorder{ResponseWriter: w, maxBodySize: maxBodySize}
+	completed := false
+	defer func() {
+		m.mu.Lock()
+		delete(m.calls, key)
+		if c.waiters > 0 {
+			m.stats.Leaders++
+		}
+		m.mu.Unlock()
+
+		// A response of a canceled request may be incomplete, and a panic
+		// leaves no response at all.
+		if completed && r.Context().Err() == nil && !rec.tooLarge && len(rec.header.Values("Set-Cookie")) == 0 {
+			c.ok = true
+			c.status = rec.status
+			c.header = rec.header
+			c.body = rec.body.Bytes()
+		}
+		close(c.done)
+	}()
+	m.handler.ServeHTTP(rec, r)
+	if rec.status == 0 {
+		// The handler has written nothing, the server will respond with
+		// 200 OK and an empty body.
+		rec.WriteHeader(http.StatusOK)
+	}
+	completed = true
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+
+	key := m.key(r)
+	m.mu.Lock()
+	c, ok := m.calls[key]
+	if !ok {
+		c = &call{done: make(chan struct{})}
+		m.calls[key] = c
+		m.mu.Unlock()
+		m.lead(w, r, key, c)
+		return
+	}
+	c.waiters++
+	m.mu.Unlock()
+
+	select {
+	case <-c.done:
+	case <-r.Context().Done():
+		return
+	}
+
+	if !c.ok {
+		m.mu.Lock()
+		m.stats.Fallbacks++
+		m.mu.Unlock()
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+	m.mu.Lock()
+	m.stats.Coalesced++
+	m.mu.Unlock()
+	for name, values := range c.header.Clone() {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(c.status)
+	w.Write(c.body)
+}
@@ -0,0 +1,112 @@
+package coalesce
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesce(t *testing.T) {
+	var calls int64
+	var release chan struct{}
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&calls, 1)
+		if r.URL.Query().Get("cookie") != "" {
+			w.Header().Set("Set-Cookie", "session="+strconv.FormatInt(n, 10))
+		}
+		if n == 1 {
+			<-release
+		}
+		w.Write([]byte("response " + strconv.FormatInt(n, 10)))
+	}))
+
+	// waitFor waits until cond is true for the state of m.
+	waitFor := func(cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			m.mu.Lock()
+			ok := cond()
+			m.mu.Unlock()
+			if ok {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("timeout")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// serve sends a leader and n requests that arrive while the leader is
+	// running, and returns the bodies of the responses.
+	serve := func(target string, n int, auth func(i int) string) []string {
+		atomic.StoreInt64(&calls, 0)
+		release = make(chan struct{})
+		bodies := make([]string, n+1)
+		var finished int64
+		var wg sync.WaitGroup
+		start := func(i int) {
+			r := httptest.NewRequest("GET", target, nil)
+			if auth != nil {
+				r.Header.Set("Authorization", auth(i))
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rec := httptest.NewRecorder()
+				m.ServeHTTP(rec, r)
+				bodies[i] = rec.Body.String()
+				atomic.AddInt64(&finished, 1)
+			}()
+		}
+		start(0)
+		waitFor(func() bool { return len(m.calls) == 1 })
+		for i := 1; i <= n; i++ {
+			start(i)
+		}
+		waitFor(func() bool {
+			waiting := 0
+			for _, c := range m.calls {
+				waiting += c.waiters
+			}
+			// Requests that are not identical to the leader become
+			// leaders themselves and may finish right away.
+			return waiting+len(m.calls)-1+int(atomic.LoadInt64(&finished)) >= n
+		})
+		close(release)
+		wg.Wait()
+		return bodies
+	}
+
+	for i, body := range serve("/a", 3, nil) {
+		if body != "response 1" {
+			t.Errorf("request %d: body = %q, want the response of the leader", i, body)
+		}
+	}
+	if stats := m.Stats(); stats.Leaders != 1 || stats.Coalesced != 3 {
+		t.Errorf("Stats() = %+v, want 1 leader and 3 coalesced requests", stats)
+	}
+
+	// Responses with cookies are not shared.
+	serve("/a?cookie=1", 2, nil)
+	if calls := atomic.LoadInt64(&calls); calls != 3 {
+		t.Errorf("the handler has been called %d times for responses with cookies, want 3", calls)
+	}
+	if stats := m.Stats(); stats.Fallbacks != 2 {
+		t.Errorf("Stats() = %+v, want 2 fallbacks", stats)
+	}
+
+	// Requests of different users are not identical.
+	serve("/a", 1, func(i int) string { return "Bearer " + strconv.Itoa(i) })
+	if calls := atomic.LoadInt64(&calls); calls != 2 {
+		t.Errorf("the handler has been called %d times for different users, want 2", calls)
+	}
+	if stats := m.Stats(); stats.Leaders != 2 {
+		t.Errorf("Stats() = %+v, want 2 leaders, requests without followers are not leaders", stats)
+	}
+}
@@ -0,0 +1,322 @@
+// Package compress compresses responses. GzipMiddleware uses gzip or
+// deflate. Middleware uses shared dictionaries, see Compression Dictionary
+// Transport (RFC 9842): responses that resemble a dictionary the client
+// already has, e.g. API responses with repetitive JSON, compress much better
+// than with general-purpose encodings.
+//
+// The package doesn't depend on Brotli or Zstandard implementations, the
+// dictionary encoders are provided by the user, see Encoder.
+package compress
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// EncodingDCB is Brotli compressed with a dictionary.
+	EncodingDCB = "dcb"
+
+	// EncodingDCZ is Zstandard compressed with a dictionary.
+	EncodingDCZ = "dcz"
+)
+
+// defaultMaxAge is the default lifetime of dictionaries in client caches.
+const defaultMaxAge = 24 * time.Hour
+
+// Encoder compresses data with a dictionary.
+type Encoder interface {
+	// Encoding returns the content coding of the encoder, e.g. EncodingDCZ.
+	Encoding() string
+
+	// NewWriter returns a writer that compresses data into w using dict.
+	// The response is complete when the writer is closed.
+	NewWriter(w io.Writer, dict []byte) (io.WriteCloser, error)
+}
+
+// Dictionary is a shared dictionary.
+type Dictionary struct {
+	// Data is the content of the dictionary.
+	Data []byte
+
+	// Match is the URL pattern of requests for which clients may use the
+	// dictionary, e.g. "/api/v1/*".
+	Match string
+
+	// ID, if not empty, is sent back by clients in the Dictionary-ID header.
+	ID string
+
+	// MaxAge is how long clients may keep the dictionary. By default it is
+	// one day.
+	MaxAge time.Duration
+
+	hash [sha256.Size]byte
+}
+
+// Middleware implements the http.Handler interface. It serves registered
+// dictionaries and compresses responses for clients that announce them in
+// the Available-Dictionary header.
+type Middleware struct {
+	handler  http.Handler
+	encoders []Encoder
+
+	// dictionaries are keyed by their SHA-256 hashes, paths by the paths at
+	// which they are served.
+	dictionaries map[[sha256.Size]byte]*Dictionary
+	paths        map[string]*Dictionary
+
+	// ContentTypes are the media types that are compressed, see
+	// GzipMiddleware.ContentTypes. By default it is DefaultContentTypes.
+	ContentTypes []string
+}
+
+// New returns an http.Handler that compresses responses of h using encoders.
+// If the client accepts several of them, the first one is used.
+func New(h http.Handler, encoders ...Encoder) *Middleware {
+	return &Middleware{
+		handler:      h,
+		encoders:     encoders,
+		dictionaries: make(map[[sha256.Size]byte]*Dictionary),
+		paths:        make(map[string]*Dictionary),
+		ContentTypes: DefaultContentTypes,
+	}
+}
+
+// AddDictionary registers d and serves it at path. Dictionaries should be
+// registered before the middleware starts serving requests.
+func (m *Middleware) AddDictionary(path string, d *Dictionary) {
+	d.hash = sha256.Sum256(d.Data)
+	m.dictionaries[d.hash] = d
+	m.paths[path] = d
+}
+
+// parseAvailableDictionary parses the hash from the Available-Dictionary
+// header, which is a structured field byte sequence like ":base64:".
+func parseAvailableDictionary(value string) (hash [sha256.Size]byte, ok bool) {
+	value = strings.TrimSpace(value)
+	if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+		return hash, false
+	}
+	b, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+	if err != nil || len(b) != sha256.Size {
+		return hash, false
+	}
+	copy(hash[:], b)
+	return hash, true
+}
+
+// accepts reports whether the Accept-Encoding header value allows encoding.
+func accepts(acceptEncoding, encoding string) bool {
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(item, ";")
+		if !strings.EqualFold(strings.TrimSpace(parts[0]), encoding) {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// negotiate returns the encoder and the dictionary for r, or nil if the
+// response shouldn't be compressed with a dictionary.
+func (m *Middleware) negotiate(r *http.Request) (Encoder, *Dictionary) {
+	if r.Method == "HEAD" {
+		return nil, nil
+	}
+	hash, ok := parseAvailableDictionary(r.Header.Get("Available-Dictionary"))
+	if !ok {
+		return nil, nil
+	}
+	d := m.dictionaries[hash]
+	if d == nil {
+		return nil, nil
+	}
+	acceptEncoding := r.Header.Get("Accept-Encoding")
+	for _, enc := range m.encoders {
+		if accepts(acceptEncoding, enc.Encoding()) {
+			return enc, d
+		}
+	}
+	return nil, nil
+}
+
+// serveDictionary serves d and tells the client to use it for future
+// requests.
+func serveDictionary(w http.ResponseWriter, r *http.Request, d *Dictionary) {
+	useAs := "match=" + strconv.Quote(d.Match)
+	if d.ID != "" {
+		useAs += ", id=" + strconv.Quote(d.ID)
+	}
+	maxAge := d.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultMaxAge
+	}
+	h := w.Header()
+	h.Set("Use-As-Dictionary", useAs)
+	h.Set("Cache-Control", "public, max-age="+strconv.FormatInt(int64(maxAge/time.Second), 10))
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Length", strconv.Itoa(len(d.Data)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		w.Write(d.Data)
+	}
+}
+
+// header returns the prefix of a response body encoded with encoding, which
+// identifies the dictionary. Encodings other than EncodingDCB and
+// EncodingDCZ have no prefix.
+func header(encoding string, d *Dictionary) []byte {
+	var magic []byte
+	switch encoding {
+	case EncodingDCB:
+		magic = []byte{0xff, 0x44, 0x43, 0x42}
+	case EncodingDCZ:
+		magic = []byte{0x5e, 0x2a, 0x4d, 0x18, 0x20, 0x00, 0x00, 0x00}
+	default:
+		return nil
+	}
+	return append(magic, d.hash[:]...)
+}
+
+// encodingWriter compresses successful responses with a dictionary. The
+// decision is made on the first write, so that responses without
+// Content-Type can be sniffed.
+type encodingWriter struct {
+	http.ResponseWriter
+	m   *Middleware
+	enc Encoder
+	d   *Dictionary
+
+	status  int
+	started bool           // the header has been sent
+	w       io.WriteCloser // nil if the response is passed as is
+	err     error
+}
+
+func (ew *encodingWriter) WriteHeader(status int) {
+	if ew.status != 0 || ew.started {
+		return
+	}
+	if status < 200 {
+		// Informational responses are sent as is.
+		ew.ResponseWriter.WriteHeader(status)
+		return
+	}
+	ew.status = status
+	if status != http.StatusOK {
+		ew.start(nil, false)
+	}
+}
+
+// start sends the header. The response is compressed if compress is true
+// and data, the beginning of the body, is compressible.
+func (ew *encodingWriter) start(data []byte, compress bool) {
+	ew.started = true
+	if ew.status == 0 {
+		ew.status = http.StatusOK
+	}
+	h := ew.Header()
+	if compress && compressible(h, data, ew.m.ContentTypes) {
+		// The encoder is created before the header is touched, so that the
+		// response is sent as is if it fails.
+		if w, err := ew.enc.NewWriter(ew.ResponseWriter, ew.d.Data); err == nil {
+			ew.w = w
+			h.Set("Content-Encoding", ew.enc.Encoding())
+			h.Del("Content-Length")
+			h.Del("Accept-Ranges")
+		}
+	}
+	ew.ResponseWriter.WriteHeader(ew.status)
+	if ew.w != nil {
+		_, ew.err = ew.ResponseWriter.Write(header(ew.enc.Encoding(), ew.d))
+	}
+}
+
+func (ew *encodingWriter) Write(p []byte) (int, error) {
+	if ew.status == 0 {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if !ew.started {
+		ew.start(p, true)
+	}
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	if ew.w == nil {
+		return ew.ResponseWriter.Write(p)
+	}
+	return ew.w.Write(p)
+}
+
+// FlushError sends the compressed data to the client, see
+// http.ResponseController. The encoder is flushed if it has a Flush method.
+func (ew *encodingWriter) FlushError() error {
+	if !ew.started {
+		ew.start(nil, true)
+	}
+	if ew.err != nil {
+		return ew.err
+	}
+	if f, ok := ew.w.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(ew.ResponseWriter).Flush()
+}
+
+func (ew *encodingWriter) Flush() {
+	ew.FlushError()
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (ew *encodingWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// close finishes the compressed response.
+func (ew *encodingWriter) close() {
+	if !ew.started {
+		if ew.status == 0 {
+			// The handler hasn't written anything, let the server send
+			// the default response.
+			return
+		}
+		ew.start(nil, false)
+	}
+	if ew.w != nil {
+		ew.w.Close()
+	}
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if d := m.paths[r.URL.Path]; d != nil && (r.Method == "GET" || r.Method == "HEAD") {
+		serveDictionary(w, r, d)
+		return
+	}
+
+	// The response depends on these headers even if it is not compressed,
+	// caches must not serve it to clients with other dictionaries.
+	w.Header().Add("Vary", "Accept-Encoding, Available-Dictionary")
+	enc, d := m.negotiate(r)
+	if enc == nil {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+	ew := &encodingWriter{ResponseWriter: w, m: m, enc: enc, d: d}
+	defer ew.close()
+	m.handler.ServeHTTP(ew, r)
+}
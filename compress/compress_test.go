@@ -0,0 +1,193 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// flateEncoder pretends to be a Zstandard encoder, but uses DEFLATE with a
+// preset dictionary.
+type flateEncoder struct{}
+
+func (flateEncoder) Encoding() string {
+	return EncodingDCZ
+}
+
+func (flateEncoder) NewWriter(w io.Writer, dict []byte) (io.WriteCloser, error) {
+	return flate.NewWriterDict(w, flate.BestCompression, dict)
+}
+
+// failingEncoder can't create writers.
+type failingEncoder struct{}
+
+func (failingEncoder) Encoding() string {
+	return EncodingDCZ
+}
+
+func (failingEncoder) NewWriter(w io.Writer, dict []byte) (io.WriteCloser, error) {
+	return nil, errors.New("no encoder")
+}
+
+func TestParseAvailableDictionary(t *testing.T) {
+	hash := sha256.Sum256([]byte("dictionary"))
+	value := ":" + base64.StdEncoding.EncodeToString(hash[:]) + ":"
+	if h, ok := parseAvailableDictionary(value); !ok || h != hash {
+		t.Fatalf("parseAvailableDictionary(%q) = %x, %v; want %x, true", value, h, ok, hash)
+	}
+	for _, value := range []string{"", "::", "abc", ":" + base64.StdEncoding.EncodeToString([]byte("short")) + ":"} {
+		if _, ok := parseAvailableDictionary(value); ok {
+			t.Errorf("parseAvailableDictionary(%q) = true, want false", value)
+		}
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	testCases := []struct {
+		acceptEncoding string
+		expected       bool
+	}{
+		{"gzip, br, zstd, dcb, dcz", true},
+		{"gzip, DCZ;q=0.5", true},
+		{"gzip, dcz;q=0", false},
+		{"gzip, dczx", false},
+		{"", false},
+	}
+	for _, tc := range testCases {
+		if ok := accepts(tc.acceptEncoding, EncodingDCZ); ok != tc.expected {
+			t.Errorf("accepts(%q) = %v, want %v", tc.acceptEncoding, ok, tc.expected)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	body := `{"items":[{"id":1,"name":"widget","price":{"amount":100,"currency":"EUR"}}]}`
+	dict := &Dictionary{
+		Data:  []byte(`{"items":[{"id":,"name":"","price":{"amount":,"currency":"EUR"}}]}`),
+		Match: "/api/*",
+		ID:    "v1",
+	}
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}), flateEncoder{})
+	m.AddDictionary("/dictionaries/v1", dict)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/dictionaries/v1", nil))
+	if useAs := rec.Header().Get("Use-As-Dictionary"); useAs != `match="/api/*", id="v1"` {
+		t.Fatalf("Use-As-Dictionary = %q, want %q", useAs, `match="/api/*", id="v1"`)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), dict.Data) {
+		t.Fatalf("dictionary body = %q, want %q", rec.Body.Bytes(), dict.Data)
+	}
+
+	hash := sha256.Sum256(dict.Data)
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		r.Header.Set("Available-Dictionary", ":"+base64.StdEncoding.EncodeToString(hash[:])+":")
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, r)
+		return rec
+	}
+
+	rec = get("/api/items", "gzip, dcz")
+	if encoding := rec.Header().Get("Content-Encoding"); encoding != EncodingDCZ {
+		t.Fatalf("Content-Encoding = %q, want %q", encoding, EncodingDCZ)
+	}
+	if vary := rec.Header().Get("Vary"); !strings.Contains(vary, "Available-Dictionary") {
+		t.Fatalf("Vary = %q, want it to contain Available-Dictionary", vary)
+	}
+	prefix := append([]byte{0x5e, 0x2a, 0x4d, 0x18, 0x20, 0x00, 0x00, 0x00}, hash[:]...)
+	encoded := rec.Body.Bytes()
+	if !bytes.HasPrefix(encoded, prefix) {
+		t.Fatalf("body doesn't start with the dcz header: %x", encoded)
+	}
+	decoded, err := ioutil.ReadAll(flate.NewReaderDict(bytes.NewReader(encoded[len(prefix):]), dict.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != body {
+		t.Fatalf("decoded body = %q, want %q", decoded, body)
+	}
+
+	// The client doesn't support the encoding.
+	rec = get("/api/items", "gzip")
+	if encoding := rec.Header().Get("Content-Encoding"); encoding != "" || rec.Body.String() != body {
+		t.Fatalf("Content-Encoding = %q, body = %q; want an uncompressed response", encoding, rec.Body.String())
+	}
+
+	// Errors are not compressed.
+	rec = get("/api/missing", "dcz")
+	if encoding := rec.Header().Get("Content-Encoding"); encoding != "" || rec.Code != http.StatusNotFound {
+		t.Fatalf("Content-Encoding = %q, status = %d; want an uncompressed 404", encoding, rec.Code)
+	}
+}
+
+func TestMiddlewareUncompressible(t *testing.T) {
+	dict := &Dictionary{Data: []byte("dictionary"), Match: "/*"}
+	hash := sha256.Sum256(dict.Data)
+	get := func(m *Middleware, path string) *httptest.ResponseRecorder {
+		m.AddDictionary("/dictionary", dict)
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Encoding", "dcz")
+		r.Header.Set("Available-Dictionary", ":"+base64.StdEncoding.EncodeToString(hash[:])+":")
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, r)
+		return rec
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image" {
+			w.Header().Set("Content-Type", "image/png")
+		}
+		w.Write([]byte("\x89PNG data"))
+	})
+
+	rec := get(New(h, flateEncoder{}), "/image")
+	if encoding := rec.Header().Get("Content-Encoding"); encoding != "" || rec.Body.String() != "\x89PNG data" {
+		t.Fatalf("Content-Encoding = %q, body = %q; want an uncompressed image", encoding, rec.Body.String())
+	}
+
+	rec = get(New(h, failingEncoder{}), "/text")
+	if encoding := rec.Header().Get("Content-Encoding"); encoding != "" || rec.Body.String() != "\x89PNG data" {
+		t.Fatalf("Content-Encoding = %q, body = %q; want an uncompressed response when the encoder fails", encoding, rec.Body.String())
+	}
+}
+
+func TestMiddlewareFlush(t *testing.T) {
+	dict := &Dictionary{Data: []byte("data: "), Match: "/*"}
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("Flush() = %v", err)
+		}
+	}), flateEncoder{})
+	m.AddDictionary("/dictionary", dict)
+
+	hash := sha256.Sum256(dict.Data)
+	r := httptest.NewRequest("GET", "/events", nil)
+	r.Header.Set("Accept-Encoding", "dcz")
+	r.Header.Set("Available-Dictionary", ":"+base64.StdEncoding.EncodeToString(hash[:])+":")
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, r)
+	if !rec.Flushed {
+		t.Fatalf("the response hasn't been flushed")
+	}
+	if encoding := rec.Header().Get("Content-Encoding"); encoding != EncodingDCZ {
+		t.Fatalf("Content-Encoding = %q, want a compressed stream", encoding)
+	}
+}
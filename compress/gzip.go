@@ -0,0 +1,307 @@
+package compress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	// EncodingGzip is gzip.
+	EncodingGzip = "gzip"
+
+	// EncodingDeflate is zlib-wrapped DEFLATE.
+	EncodingDeflate = "deflate"
+)
+
+const defaultMinSize = 1024
+
+// DefaultContentTypes are the media types that GzipMiddleware compresses by
+// default. Other types, e.g. images, are usually compressed already.
+var DefaultContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/*+json",
+	"application/javascript",
+	"application/xml",
+	"application/*+xml",
+	"image/svg+xml",
+}
+
+// resettable is a compressor that can be reused for another response.
+type resettable interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// GzipMiddleware implements the http.Handler interface. It compresses
+// responses with gzip or deflate, whichever the client accepts, gzip is
+// preferred.
+type GzipMiddleware struct {
+	handler http.Handler
+	pools   map[string]*sync.Pool
+
+	// Level is the compression level, see compress/flate. It should be set
+	// before the middleware starts serving requests.
+	Level int
+
+	// MinSize is the minimum size of a response body that is compressed.
+	// Smaller bodies don't get smaller enough to pay for the compression.
+	// Streamed responses that are flushed are compressed regardless of
+	// their size. By default it is 1024.
+	MinSize int
+
+	// ContentTypes are the media types that are compressed. A type can
+	// be a wildcard like "text/*" or "application/*+json". Responses
+	// without Content-Type are sniffed. By default it is
+	// DefaultContentTypes.
+	ContentTypes []string
+}
+
+// NewGzip returns an http.Handler that compresses responses of h with gzip
+// or deflate.
+func NewGzip(h http.Handler) *GzipMiddleware {
+	m := &GzipMiddleware{
+		handler:      h,
+		Level:        gzip.DefaultCompression,
+		MinSize:      defaultMinSize,
+		ContentTypes: DefaultContentTypes,
+	}
+	m.pools = map[string]*sync.Pool{
+		EncodingGzip: {New: func() interface{} {
+			w, err := gzip.NewWriterLevel(nil, m.Level)
+			if err != nil {
+				w = gzip.NewWriter(nil)
+			}
+			return w
+		}},
+		EncodingDeflate: {New: func() interface{} {
+			w, err := zlib.NewWriterLevel(nil, m.Level)
+			if err != nil {
+				w = zlib.NewWriter(nil)
+			}
+			return w
+		}},
+	}
+	return m
+}
+
+// matchContentType reports whether the media type of contentType is one of
+// patterns.
+func matchContentType(contentType string, patterns []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		if pattern == mediaType {
+			return true
+		}
+		if i := strings.IndexByte(pattern, '*'); i >= 0 &&
+			len(mediaType) >= len(pattern)-1 &&
+			strings.HasPrefix(mediaType, pattern[:i]) &&
+			strings.HasSuffix(mediaType, pattern[i+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// addVary adds value to the Vary header unless it is already there.
+func addVary(h http.Header, value string) {
+	for _, v := range h.Values("Vary") {
+		for _, item := range strings.Split(v, ",") {
+			item = strings.TrimSpace(item)
+			if item == "*" || strings.EqualFold(item, value) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", value)
+}
+
+// gzipWriter buffers the beginning of the response until it is known
+// whether the response should be compressed.
+type gzipWriter struct {
+	http.ResponseWriter
+	m        *GzipMiddleware
+	encoding string
+
+	status  int
+	started bool // the header has been sent
+	buf     []byte
+	cw      resettable // nil if the response is passed as is
+}
+
+func (gw *gzipWriter) WriteHeader(status int) {
+	if gw.status != 0 || gw.started {
+		return
+	}
+	if status < 200 {
+		// Informational responses are sent as is.
+		gw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	gw.status = status
+	if status != http.StatusOK && status != http.StatusCreated && status != http.StatusAccepted && status != http.StatusNonAuthoritativeInfo {
+		gw.start(false)
+	}
+}
+
+// compressible reports whether a response with the header h should be
+// compressed judging by its headers and data, the beginning of its body,
+// which is sniffed if the response has no Content-Type. If contentTypes is
+// nil, DefaultContentTypes are used.
+func compressible(h http.Header, data []byte, contentTypes []string) bool {
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	contentType := h.Get("Content-Type")
+	if contentType == "" {
+		if _, ok := h["Content-Type"]; ok {
+			// The handler has disabled sniffing.
+			return false
+		}
+		contentType = http.DetectContentType(data)
+		h.Set("Content-Type", contentType)
+	}
+	if contentTypes == nil {
+		contentTypes = DefaultContentTypes
+	}
+	return matchContentType(contentType, contentTypes)
+}
+
+// start sends the header and the buffered data.
+func (gw *gzipWriter) start(compress bool) error {
+	gw.started = true
+	if gw.status == 0 {
+		gw.status = http.StatusOK
+	}
+	h := gw.Header()
+	if compress && compressible(h, gw.buf, gw.m.ContentTypes) {
+		h.Set("Content-Encoding", gw.encoding)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			// The compressed representation isn't byte-for-byte the
+			// same as the uncompressed one.
+			h.Set("ETag", "W/"+etag)
+		}
+		gw.cw = gw.m.pools[gw.encoding].Get().(resettable)
+		gw.cw.Reset(gw.ResponseWriter)
+	}
+	gw.ResponseWriter.WriteHeader(gw.status)
+	buf := gw.buf
+	gw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := gw.write(buf)
+	return err
+}
+
+func (gw *gzipWriter) write(p []byte) (int, error) {
+	if gw.cw != nil {
+		return gw.cw.Write(p)
+	}
+	return gw.ResponseWriter.Write(p)
+}
+
+func (gw *gzipWriter) Write(p []byte) (int, error) {
+	if gw.status == 0 {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.started {
+		return gw.write(p)
+	}
+	gw.buf = append(gw.buf, p...)
+	minSize := gw.m.MinSize
+	if minSize <= 0 {
+		minSize = defaultMinSize
+	}
+	if len(gw.buf) >= minSize {
+		if err := gw.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// FlushError sends the buffered data to the client, see
+// http.ResponseController. A flushed response is compressed regardless of
+// MinSize, as the rest of it is likely to be streamed.
+func (gw *gzipWriter) FlushError() error {
+	if !gw.started {
+		if err := gw.start(true); err != nil {
+			return err
+		}
+	}
+	if gw.cw != nil {
+		if err := gw.cw.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+func (gw *gzipWriter) Flush() {
+	gw.FlushError()
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (gw *gzipWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+// close finishes the response. Responses that are smaller than MinSize are
+// sent as is.
+func (gw *gzipWriter) close() {
+	if !gw.started {
+		if gw.status == 0 && len(gw.buf) == 0 {
+			// The handler hasn't written anything, let the server send
+			// the default response.
+			return
+		}
+		gw.start(false)
+	}
+	if gw.cw != nil {
+		gw.cw.Close()
+		gw.cw.Reset(nil)
+		gw.m.pools[gw.encoding].Put(gw.cw)
+		gw.cw = nil
+	}
+}
+
+// negotiate returns the encoding for r, or an empty string if the response
+// shouldn't be compressed.
+func (m *GzipMiddleware) negotiate(r *http.Request) string {
+	if r.Method == "HEAD" {
+		return ""
+	}
+	acceptEncoding := r.Header.Get("Accept-Encoding")
+	for _, encoding := range []string{EncodingGzip, EncodingDeflate} {
+		if accepts(acceptEncoding, encoding) {
+			return encoding
+		}
+	}
+	return ""
+}
+
+func (m *GzipMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The response depends on Accept-Encoding even if it is not
+	// compressed, caches must not serve it to other clients.
+	addVary(w.Header(), "Accept-Encoding")
+	encoding := m.negotiate(r)
+	if encoding == "" || r.Header.Get("Range") != "" {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+	gw := &gzipWriter{ResponseWriter: w, m: m, encoding: encoding}
+	defer gw.close()
+	m.handler.ServeHTTP(gw, r)
+}
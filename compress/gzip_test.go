@@ -0,0 +1,135 @@
+package compress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMatchContentType(t *testing.T) {
+	testCases := []struct {
+		contentType string
+		expected    bool
+	}{
+		{"text/html; charset=utf-8", true},
+		{"application/json", true},
+		{"application/problem+json", true},
+		{"application/octet-stream", false},
+		{"image/png", false},
+		{"invalid", false},
+	}
+	for _, tc := range testCases {
+		if ok := matchContentType(tc.contentType, DefaultContentTypes); ok != tc.expected {
+			t.Errorf("matchContentType(%q) = %v, want %v", tc.contentType, ok, tc.expected)
+		}
+	}
+}
+
+func decode(t *testing.T, encoding string, body io.Reader) string {
+	t.Helper()
+	var r io.Reader
+	var err error
+	switch encoding {
+	case EncodingGzip:
+		r, err = gzip.NewReader(body)
+	case EncodingDeflate:
+		r, err = zlib.NewReader(body)
+	default:
+		r = body
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestGzipMiddleware(t *testing.T) {
+	large := strings.Repeat("hello, world! ", 100)
+	m := NewGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Write([]byte("small"))
+		case "/png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(large))
+		case "/etag":
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Length", "1400")
+			w.Write([]byte(large))
+		default:
+			w.Write([]byte(large[:500]))
+			w.Write([]byte(large[500:]))
+		}
+	}))
+
+	testCases := []struct {
+		path           string
+		acceptEncoding string
+		encoding       string
+		body           string
+	}{
+		{"/", "gzip, deflate", EncodingGzip, large},
+		{"/", "deflate", EncodingDeflate, large},
+		{"/", "gzip;q=0, br", "", large},
+		{"/small", "gzip", "", "small"},
+		{"/png", "gzip", "", large},
+		{"/etag", "gzip", EncodingGzip, large},
+	}
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", tc.path, nil)
+		r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		m.ServeHTTP(rec, r)
+
+		res := rec.Result()
+		if encoding := res.Header.Get("Content-Encoding"); encoding != tc.encoding {
+			t.Errorf("%s %q: Content-Encoding = %q, want %q", tc.path, tc.acceptEncoding, encoding, tc.encoding)
+			continue
+		}
+		if body := decode(t, tc.encoding, res.Body); body != tc.body {
+			t.Errorf("%s %q: body = %q, want %q", tc.path, tc.acceptEncoding, body, tc.body)
+		}
+		if vary := res.Header.Values("Vary"); len(vary) != 1 || vary[0] != "Accept-Encoding" {
+			t.Errorf("%s %q: Vary = %q, want Accept-Encoding", tc.path, tc.acceptEncoding, vary)
+		}
+		if tc.path == "/etag" {
+			if etag := res.Header.Get("ETag"); etag != `W/"v1"` {
+				t.Errorf("ETag = %s, want a weak one", etag)
+			}
+			if res.Header.Get("Content-Length") != "" {
+				t.Errorf("Content-Length of a compressed response = %s, want none", res.Header.Get("Content-Length"))
+			}
+		}
+	}
+}
+
+func TestGzipFlush(t *testing.T) {
+	m := NewGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+	}))
+
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/events", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	m.ServeHTTP(rec, r)
+	if !rec.Flushed {
+		t.Fatalf("the response hasn't been flushed")
+	}
+	if encoding := rec.Header().Get("Content-Encoding"); encoding != EncodingGzip {
+		t.Fatalf("Content-Encoding = %q, want a compressed stream", encoding)
+	}
+	if body := decode(t, EncodingGzip, rec.Body); body != "data: 1\n\n" {
+		t.Fatalf("body = %q", body)
+	}
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/dmage/middleware/exempt"
+	"github.com/dmage/middleware/maxconnections"
+	"github.com/dmage/middleware/ratelimit"
+	"github.com/dmage/middleware/timeout"
+)
+
+// queueDisciplines maps the values of MaxConnections.QueueDiscipline to the
+// disciplines of maxconnections.
+var queueDisciplines = map[string]maxconnections.QueueDiscipline{
+	"":              maxconnections.FIFO,
+	"fifo":          maxconnections.FIFO,
+	"lifo":          maxconnections.LIFO,
+	"adaptive-lifo": maxconnections.AdaptiveLIFO,
+	"fair-share":    maxconnections.FairShare,
+	"edf":           maxconnections.EarliestDeadline,
+}
+
+// BuildPolicy wraps h into the middlewares of p. Requests pass through the
+// rate limiter first, so that rejected requests don't take connection
+// slots, then through maxconnections, and the timeout applies only to the
+// handler, not to the time in the queue.
+//
+// If the rate limit has a window, it is a sliding window that allows burst
+// requests per window, and the rate is ignored.
+func BuildPolicy(p Policy, h http.Handler) http.Handler {
+	if p.Timeout != nil {
+		h = timeout.New(p.Timeout.Duration, h)
+	}
+	if mc := p.MaxConnections; mc != nil {
+		m := maxconnections.New(mc.MaxRunning, mc.MaxInQueue, h)
+		m.MaxWaitInQueue = mc.MaxWaitInQueue.Duration
+		m.SoftLimit = mc.SoftLimit
+		m.QueueDiscipline = queueDisciplines[mc.QueueDiscipline]
+		m.DryRun = mc.DryRun
+		if len(mc.ExemptMethods) > 0 {
+			m.Skip = exempt.Methods(mc.ExemptMethods...)
+		}
+		h = m
+	}
+	if rl := p.RateLimit; rl != nil {
+		l := ratelimit.NewLimiter(rl.Rate, rl.Burst)
+		if rl.Window.Duration > 0 {
+			l = ratelimit.NewLimiter(float64(rl.Burst)/rl.Window.Seconds(), rl.Burst)
+			l.Algorithm = ratelimit.SlidingWindow
+		}
+		m := ratelimit.NewWithLimiter(l, h)
+		if len(rl.ExemptMethods) > 0 {
+			m.Skip = exempt.Methods(rl.ExemptMethods...)
+		}
+		h = m
+	}
+	return h
+}
+
+// builtRoute is an effective route with its middlewares.
+type builtRoute struct {
+	Route
+
+	// match is nil for the defaults.
+	match   func(r *http.Request) bool
+	handler http.Handler
+}
+
+// router dispatches requests to the middlewares of the first matching
+// route.
+type router struct {
+	config *Config
+	routes []builtRoute
+}
+
+// build returns a router for the policies of c that are effective at t. The
+// middlewares of routes that have the same pattern and policy in prev are
+// reused, so that their limiters keep their state.
+func build(c *Config, t time.Time, prev *router, h http.Handler) *router {
+	rt := &router{config: c}
+	for _, r := range c.EffectiveAt(t) {
+		br := builtRoute{Route: r}
+		if r.Pattern != "" {
+			br.match = maxconnections.MatchPattern(r.Pattern)
+		}
+		if prev != nil {
+			for _, old := range prev.routes {
+				if old.Pattern == r.Pattern && reflect.DeepEqual(old.Policy, r.Policy) {
+					br.handler = old.handler
+					break
+				}
+			}
+		}
+		if br.handler == nil {
+			br.handler = BuildPolicy(r.Policy, h)
+		}
+		rt.routes = append(rt.routes, br)
+	}
+	return rt
+}
+
+// changed reports whether the policies of the router differ from the
+// policies of its config that are effective at t.
+func (rt *router) changed(t time.Time) bool {
+	routes := rt.config.EffectiveAt(t)
+	for i, r := range routes {
+		if !reflect.DeepEqual(rt.routes[i].Policy, r.Policy) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, br := range rt.routes {
+		if br.match == nil || br.match(r) {
+			br.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+}
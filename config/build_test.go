@@ -0,0 +1,83 @@
+package config
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildRoutes(t *testing.T) {
+	c, err := Parse(strings.NewReader(`{
+		"defaults": {"ratelimit": {"rate": 100, "burst": 100}},
+		"routes": [{"pattern": "POST /upload/", "ratelimit": {"rate": 1, "burst": 1}}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := build(c, time.Now(), nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(method, path string) int {
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec.Code
+	}
+	if status := serve("POST", "/upload/a"); status != http.StatusOK {
+		t.Fatalf("status = %d, want the first upload to be allowed", status)
+	}
+	if status := serve("POST", "/upload/b"); status != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want the second upload to be limited", status)
+	}
+	if status := serve("GET", "/upload/b"); status != http.StatusOK {
+		t.Fatalf("status = %d, want other requests to get the defaults", status)
+	}
+
+	// Unchanged routes keep their middlewares.
+	next := build(c, time.Now(), rt, http.NotFoundHandler())
+	for i := range rt.routes {
+		if next.routes[i].handler != rt.routes[i].handler {
+			t.Errorf("route %d is rebuilt", i)
+		}
+	}
+}
+
+func TestBuildPolicyTimeout(t *testing.T) {
+	timeout := Duration{10 * time.Millisecond}
+	h := BuildPolicy(Policy{
+		MaxConnections: &MaxConnections{MaxRunning: 1, QueueDiscipline: "lifo"},
+		Timeout:        &timeout,
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the handler to time out", rec.Code)
+	}
+}
+
+func TestBuildPolicyExemptMethods(t *testing.T) {
+	p := Policy{
+		RateLimit: &RateLimit{Rate: 1, Burst: 1, ExemptMethods: []string{"OPTIONS", "HEAD"}},
+	}
+	if s := p.String(); s != "ratelimit(rate=1 burst=1 window=0s exempt=OPTIONS,HEAD)" {
+		t.Fatalf("String() = %q", s)
+	}
+	h := BuildPolicy(p, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i, tc := range []struct {
+		method string
+		status int
+	}{
+		{"GET", http.StatusOK},
+		{"OPTIONS", http.StatusOK},
+		{"HEAD", http.StatusOK},
+		{"GET", http.StatusTooManyRequests},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tc.method, "/", nil))
+		if rec.Code != tc.status {
+			t.Errorf("request %d: status = %d, want %d", i, rec.Code, tc.status)
+		}
+	}
+}
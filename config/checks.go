@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ClockResolution is the smallest duration that timers can reliably measure.
+// Windows shorter than that are effectively zero.
+const ClockResolution = time.Millisecond
+
+// QueueDisciplines are the valid values of MaxConnections.QueueDiscipline.
+var QueueDisciplines = []string{"fifo", "lifo", "adaptive-lifo", "fair-share", "edf"}
+
+func init() {
+	Register("pattern", checkPattern)
+	Register("maxconnections", checkMaxConnections)
+	Register("ratelimit", checkRateLimit)
+	Register("timeout", checkTimeout)
+}
+
+func checkPattern(pattern string, p Policy) error {
+	if i := strings.IndexAny(pattern, " \t"); i >= 0 {
+		method := pattern[:i]
+		if method != strings.ToUpper(method) {
+			return fmt.Errorf("method %q should be upper case", method)
+		}
+		pattern = strings.TrimLeft(pattern[i:], " \t")
+	}
+	if pattern != "" && !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("path %q should start with /", pattern)
+	}
+	return nil
+}
+
+func checkMaxConnections(pattern string, p Policy) error {
+	mc := p.MaxConnections
+	if mc == nil {
+		return nil
+	}
+	if mc.MaxRunning < 1 {
+		return fmt.Errorf("maxRunning is %d, should be at least 1", mc.MaxRunning)
+	}
+	if mc.MaxInQueue < 0 {
+		return fmt.Errorf("maxInQueue is %d, should not be negative", mc.MaxInQueue)
+	}
+	if mc.MaxWaitInQueue.Duration < 0 {
+		return fmt.Errorf("maxWaitInQueue is %s, should not be negative", mc.MaxWaitInQueue)
+	}
+	if mc.SoftLimit > mc.MaxRunning+mc.MaxInQueue {
+		return fmt.Errorf("softLimit %d is never reached, maxRunning+maxInQueue is %d", mc.SoftLimit, mc.MaxRunning+mc.MaxInQueue)
+	}
+	if mc.QueueDiscipline != "" {
+		valid := false
+		for _, d := range QueueDisciplines {
+			valid = valid || d == mc.QueueDiscipline
+		}
+		if !valid {
+			return fmt.Errorf("unknown queueDiscipline %q, should be one of %s", mc.QueueDiscipline, strings.Join(QueueDisciplines, ", "))
+		}
+	}
+	if p.Timeout != nil && mc.MaxWaitInQueue.Duration > p.Timeout.Duration {
+		return fmt.Errorf("maxWaitInQueue %s is longer than the handler timeout %s", mc.MaxWaitInQueue, p.Timeout)
+	}
+	return nil
+}
+
+func checkRateLimit(pattern string, p Policy) error {
+	rl := p.RateLimit
+	if rl == nil {
+		return nil
+	}
+	if rl.Rate <= 0 {
+		return fmt.Errorf("rate is %g, should be positive", rl.Rate)
+	}
+	if rl.Burst < 1 {
+		return fmt.Errorf("burst is %d, should be at least 1", rl.Burst)
+	}
+	if rl.Window.Duration != 0 && rl.Window.Duration < ClockResolution {
+		return fmt.Errorf("window %s is shorter than the clock resolution %s", rl.Window, ClockResolution)
+	}
+	return nil
+}
+
+func checkTimeout(pattern string, p Policy) error {
+	if p.Timeout != nil && p.Timeout.Duration <= 0 {
+		return fmt.Errorf("timeout is %s, should be positive", p.Timeout)
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+// Package config describes middleware policies in a JSON document,
+// validates them and builds the middlewares, see Handler.
+//
+// A document contains default policies and per-route policies:
+//
+//	{
+//		"defaults": {
+//			"maxconnections": {"maxRunning": 100, "maxInQueue": 1000, "maxWaitInQueue": "1s"},
+//			"timeout": "5s"
+//		},
+//		"routes": [
+//			{"pattern": "POST /upload/", "maxconnections": {"maxRunning": 4}}
+//		]
+//	}
+//
+// A section of a route replaces the corresponding default section as a
+// whole.
+//
+// Policies can be changed by named schedules, e.g. during business hours or
+// maintenance windows. The first override whose schedule is active replaces
+// the sections it has, see Config.EffectiveAt:
+//
+//	{
+//		"schedules": {
+//			"maintenance": {"windows": [{"start": "2026-11-01T02:00:00Z", "end": "2026-11-01T04:00:00Z"}]}
+//		},
+//		"defaults": {"ratelimit": {"rate": 100, "burst": 200}},
+//		"overrides": [{"schedule": "maintenance", "ratelimit": {"rate": 10, "burst": 10}}]
+//	}
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Duration is a time.Duration that is encoded in JSON as a string like "1.5s".
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration should be a string like \"1s\", got %s", data)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// MaxConnections is the policy for the maxconnections middleware.
+type MaxConnections struct {
+	MaxRunning      int      `json:"maxRunning"`
+	MaxInQueue      int      `json:"maxInQueue"`
+	MaxWaitInQueue  Duration `json:"maxWaitInQueue"`
+	SoftLimit       int      `json:"softLimit,omitempty"`
+	QueueDiscipline string   `json:"queueDiscipline,omitempty"`
+	DryRun          bool     `json:"dryRun,omitempty"`
+	ExemptMethods   []string `json:"exemptMethods,omitempty"`
+}
+
+// RateLimit is the policy for rate limiting.
+type RateLimit struct {
+	Rate          float64  `json:"rate"`
+	Burst         int      `json:"burst"`
+	Window        Duration `json:"window"`
+	ExemptMethods []string `json:"exemptMethods,omitempty"`
+}
+
+// Policy is a set of middleware policies. Nil sections are not configured.
+type Policy struct {
+	MaxConnections *MaxConnections `json:"maxconnections,omitempty"`
+	RateLimit      *RateLimit      `json:"ratelimit,omitempty"`
+
+	// Timeout is the handler timeout.
+	Timeout *Duration `json:"timeout,omitempty"`
+}
+
+// merge returns p with its nil sections taken from defaults.
+func (p Policy) merge(defaults Policy) Policy {
+	if p.MaxConnections == nil {
+		p.MaxConnections = defaults.MaxConnections
+	}
+	if p.RateLimit == nil {
+		p.RateLimit = defaults.RateLimit
+	}
+	if p.Timeout == nil {
+		p.Timeout = defaults.Timeout
+	}
+	return p
+}
+
+// Route is a policy for requests that match Pattern, see
+// maxconnections.MatchPattern for the syntax.
+type Route struct {
+	Pattern string `json:"pattern"`
+	Policy
+
+	// Overrides change the policy of the route according to schedules.
+	Overrides []Override `json:"overrides,omitempty"`
+}
+
+// Config is a policy document.
+type Config struct {
+	Schedules map[string]Schedule `json:"schedules,omitempty"`
+	Defaults  Policy              `json:"defaults"`
+	Overrides []Override          `json:"overrides,omitempty"`
+	Routes    []Route             `json:"routes"`
+}
+
+// Parse reads a document from r. Unknown fields are errors, so that
+// misspelled options are not silently ignored.
+func Parse(r io.Reader) (*Config, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var c Config
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+	return &c, nil
+}
+
+// Effective returns the routes with the defaults applied. Requests that
+// don't match any route get the defaults, they are returned as the last
+// route with an empty pattern.
+func (c *Config) Effective() []Route {
+	routes := make([]Route, 0, len(c.Routes)+1)
+	for _, r := range c.Routes {
+		routes = append(routes, Route{
+			Pattern: r.Pattern,
+			Policy:  r.Policy.merge(c.Defaults),
+		})
+	}
+	return append(routes, Route{Policy: c.Defaults})
+}
+
+// A Check validates the effective policy of a route. The pattern is empty
+// for the defaults.
+type Check func(pattern string, p Policy) error
+
+var (
+	checksMu sync.Mutex
+	checks   = make(map[string]Check)
+)
+
+// Register adds a check that is run by Validate. Packages that support
+// additional policy options can register checks for them. Register panics
+// if a check with the same name is already registered.
+func Register(name string, check Check) {
+	checksMu.Lock()
+	defer checksMu.Unlock()
+	if _, ok := checks[name]; ok {
+		panic("config: check " + name + " is already registered")
+	}
+	checks[name] = check
+}
+
+// Validate runs registered checks for every effective route and reports all
+// problems found.
+func (c *Config) Validate() []error {
+	checksMu.Lock()
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]Check, len(names))
+	for i, name := range names {
+		list[i] = checks[name]
+	}
+	checksMu.Unlock()
+
+	var errs []error
+	schedules := make([]string, 0, len(c.Schedules))
+	for name := range c.Schedules {
+		schedules = append(schedules, name)
+	}
+	sort.Strings(schedules)
+	for _, name := range schedules {
+		if _, err := c.Schedules[name].compile(); err != nil {
+			errs = append(errs, fmt.Errorf("schedule %q: %v", name, err))
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, r := range c.Effective() {
+		route := "defaults"
+		overrides := c.Overrides
+		if i < len(c.Routes) {
+			overrides = c.Routes[i].Overrides
+			route = fmt.Sprintf("route %q", r.Pattern)
+			if r.Pattern == "" {
+				errs = append(errs, fmt.Errorf("route %d: empty pattern", i))
+			} else if seen[r.Pattern] {
+				errs = append(errs, fmt.Errorf("%s: duplicate pattern", route))
+			}
+			seen[r.Pattern] = true
+		}
+		for j, check := range list {
+			if err := check(r.Pattern, r.Policy); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s: %v", route, names[j], err))
+			}
+		}
+		errs = append(errs, c.validateOverrides(route, r.Pattern, r.Policy, overrides, list, names)...)
+	}
+	return errs
+}
+
+// String returns a short human-readable description of the policy.
+func (p Policy) String() string {
+	var parts []string
+	if mc := p.MaxConnections; mc != nil {
+		s := fmt.Sprintf("maxconnections(running=%d queue=%d", mc.MaxRunning, mc.MaxInQueue)
+		if mc.MaxWaitInQueue.Duration > 0 {
+			s += fmt.Sprintf(" wait=%s", mc.MaxWaitInQueue)
+		}
+		if mc.SoftLimit > 0 {
+			s += fmt.Sprintf(" soft=%d", mc.SoftLimit)
+		}
+		if mc.QueueDiscipline != "" {
+			s += " " + mc.QueueDiscipline
+		}
+		if mc.DryRun {
+			s += " dry-run"
+		}
+		if len(mc.ExemptMethods) > 0 {
+			s += " exempt=" + strings.Join(mc.ExemptMethods, ",")
+		}
+		parts = append(parts, s+")")
+	}
+	if rl := p.RateLimit; rl != nil {
+		s := fmt.Sprintf("ratelimit(rate=%g burst=%d window=%s", rl.Rate, rl.Burst, rl.Window)
+		if len(rl.ExemptMethods) > 0 {
+			s += " exempt=" + strings.Join(rl.ExemptMethods, ",")
+		}
+		parts = append(parts, s+")")
+	}
+	if p.Timeout != nil {
+		parts = append(parts, fmt.Sprintf("timeout=%s", p.Timeout))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, " ")
+}
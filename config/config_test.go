@@ -0,0 +1,78 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	c, err := Parse(strings.NewReader(`{
+		"defaults": {"maxconnections": {"maxRunning": 10, "maxInQueue": 100, "maxWaitInQueue": "1s"}, "timeout": "5s"},
+		"routes": [{"pattern": "POST /upload/", "maxconnections": {"maxRunning": 2, "maxInQueue": 0}}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := c.Effective()
+	if len(routes) != 2 {
+		t.Fatalf("len(Effective()) = %d, want 2", len(routes))
+	}
+	upload := routes[0]
+	if upload.Pattern != "POST /upload/" || upload.MaxConnections.MaxRunning != 2 || upload.Timeout.Duration != 5*time.Second {
+		t.Fatalf("Effective()[0] = %s %s, want the route section and the default timeout", upload.Pattern, upload.Policy)
+	}
+	if expected := "maxconnections(running=10 queue=100 wait=1s) timeout=5s"; routes[1].String() != expected {
+		t.Fatalf("defaults = %s, want %s", routes[1].Policy, expected)
+	}
+
+	if errs := c.Validate(); len(errs) != 0 {
+		t.Fatalf("Validate() = %v, want no errors", errs)
+	}
+}
+
+func TestParseUnknownField(t *testing.T) {
+	_, err := Parse(strings.NewReader(`{"defaults": {"maxconnections": {"maxRuning": 10}}}`))
+	if err == nil {
+		t.Fatal("Parse() with a misspelled field: got nil error")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		doc      string
+		expected string
+	}{
+		{
+			`{"defaults": {"maxconnections": {"maxRunning": 1, "maxWaitInQueue": "10s"}, "timeout": "5s"}}`,
+			"defaults: maxconnections: maxWaitInQueue 10s is longer than the handler timeout 5s",
+		},
+		{
+			`{"routes": [{"pattern": "/a", "ratelimit": {"rate": 1, "burst": 1, "window": "100us"}}]}`,
+			`route "/a": ratelimit: window 100µs is shorter than the clock resolution 1ms`,
+		},
+		{
+			`{"routes": [{"pattern": "/a"}, {"pattern": "/a"}]}`,
+			`route "/a": duplicate pattern`,
+		},
+		{
+			`{"routes": [{"pattern": "get /a"}]}`,
+			`route "get /a": pattern: method "get" should be upper case`,
+		},
+		{
+			`{"defaults": {"maxconnections": {"maxRunning": 1, "queueDiscipline": "random"}}}`,
+			`defaults: maxconnections: unknown queueDiscipline "random", should be one of fifo, lifo, adaptive-lifo, fair-share, edf`,
+		},
+	}
+	for _, tc := range testCases {
+		c, err := Parse(strings.NewReader(tc.doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs := c.Validate()
+		if len(errs) != 1 || errs[0].Error() != tc.expected {
+			t.Errorf("Validate(%s) = %v, want [%s]", tc.doc, errs, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Handler is an http.Handler that applies the policies of a Config and can
+// switch to another Config at runtime. The switch is atomic: requests that
+// are in flight complete with the middlewares they started with, and new
+// requests use the new ones. Routes whose effective policy doesn't change
+// keep their middlewares, so that their limiters keep their state.
+//
+//	h, err := config.LoadHandler("/etc/app/middleware.json", mux)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	go h.WatchFile(ctx, "/etc/app/middleware.json", 10*time.Second, func(err error) {
+//		log.Printf("middleware config: %v", err)
+//	})
+type Handler struct {
+	// handler to invoke.
+	handler http.Handler
+
+	mu      sync.RWMutex
+	current *router
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// NewHandler returns a Handler that applies c to requests passed to h. It
+// returns an error if c is invalid.
+func NewHandler(c *Config, h http.Handler) (*Handler, error) {
+	ch := &Handler{
+		handler: h,
+		now:     time.Now,
+	}
+	if err := ch.Update(c); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// LoadHandler is like NewHandler, but it reads the config from a file.
+func LoadHandler(path string, h http.Handler) (*Handler, error) {
+	c, err := ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewHandler(c, h)
+}
+
+// ParseFile reads a document from a file, see Parse.
+func ParseFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(bytes.NewReader(data))
+}
+
+// routes returns the current router.
+func (h *Handler) routes() *router {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.current
+}
+
+// Config returns the applied config.
+func (h *Handler) Config() *Config {
+	return h.routes().config
+}
+
+// Update validates c and applies it. If c is invalid, the current config
+// stays in effect and the problems are returned.
+func (h *Handler) Update(c *Config) error {
+	if errs := c.Validate(); len(errs) != 0 {
+		return errors.Join(errs...)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.current = build(c, h.now(), h.current, h.handler)
+	return nil
+}
+
+// Refresh applies the schedules of the current config again if the
+// effective policies have changed since the config was applied. WatchFile
+// calls it periodically.
+func (h *Handler) Refresh() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	if h.current.changed(now) {
+		h.current = build(h.current.config, now, h.current, h.handler)
+	}
+}
+
+// WatchFile checks the file every interval until ctx is done, and applies
+// the config from it when its contents change. Errors, e.g. an invalid
+// document, are passed to onError, if it is not nil, and the current config
+// stays in effect. Between changes, it refreshes schedules, see Refresh.
+func (h *Handler) WatchFile(ctx context.Context, path string, interval time.Duration, onError func(err error)) {
+	// The file is applied on the first check, as it may have changed since
+	// the current config was loaded. Unchanged routes keep their
+	// middlewares.
+	var last []byte
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		data, err := os.ReadFile(path)
+		if err == nil && !bytes.Equal(data, last) {
+			last = data
+			var c *Config
+			c, err = Parse(bytes.NewReader(data))
+			if err == nil {
+				err = h.Update(c)
+			}
+		}
+		if err != nil && onError != nil {
+			onError(err)
+		}
+		h.Refresh()
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.routes().ServeHTTP(w, r)
+}
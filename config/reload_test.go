@@ -0,0 +1,143 @@
+package config
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandlerUpdate(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	c, err := Parse(strings.NewReader(`{"defaults": {"maxconnections": {"maxRunning": 1, "maxInQueue": 0}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHandler(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(path string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+	done := make(chan int)
+	go func() {
+		done <- serve("/slow")
+	}()
+	<-started
+	if status := serve("/"); status != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the limit of the first config", status)
+	}
+
+	invalid, err := Parse(strings.NewReader(`{"defaults": {"maxconnections": {"maxRunning": 0}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Update(invalid); err == nil {
+		t.Fatal("Update() with an invalid config: got nil error")
+	}
+	if h.Config() != c {
+		t.Fatal("the invalid config is applied")
+	}
+
+	updated, err := Parse(strings.NewReader(`{"defaults": {"maxconnections": {"maxRunning": 2, "maxInQueue": 0}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Update(updated); err != nil {
+		t.Fatal(err)
+	}
+	if status := serve("/"); status != http.StatusOK {
+		t.Fatalf("status = %d, want the request to be admitted by the new config", status)
+	}
+
+	// The request that started before the update completes.
+	close(release)
+	if status := <-done; status != http.StatusOK {
+		t.Fatalf("in-flight request status = %d", status)
+	}
+}
+
+func TestHandlerRefresh(t *testing.T) {
+	c, err := Parse(strings.NewReader(`{
+		"schedules": {"maintenance": {"windows": [{"start": "2026-11-01T02:00:00Z", "end": "2026-11-01T04:00:00Z"}]}},
+		"defaults": {"timeout": "5s"},
+		"overrides": [{"schedule": "maintenance", "timeout": "1m"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 11, 1, 1, 0, 0, 0, time.UTC)
+	h := &Handler{
+		handler: http.NotFoundHandler(),
+		now: func() time.Time {
+			return now
+		},
+	}
+	if err := h.Update(c); err != nil {
+		t.Fatal(err)
+	}
+	before := h.routes()
+
+	h.Refresh()
+	if h.routes() != before {
+		t.Fatal("the config is rebuilt without changes")
+	}
+
+	now = now.Add(2 * time.Hour)
+	h.Refresh()
+	if timeout := h.routes().routes[0].Timeout.Duration; timeout != time.Minute {
+		t.Fatalf("timeout = %s during maintenance, want 1m", timeout)
+	}
+}
+
+func TestHandlerWatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "middleware.json")
+	if err := os.WriteFile(path, []byte(`{"defaults": {"timeout": "5s"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := LoadHandler(path, http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 10)
+	go h.WatchFile(ctx, path, time.Millisecond, func(err error) {
+		errs <- err
+	})
+
+	if err := os.WriteFile(path, []byte(`{"defaults": {"timeout": "0s"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatal("the invalid config is not reported")
+	}
+
+	if err := os.WriteFile(path, []byte(`{"defaults": {"timeout": "7s"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for h.Config().Defaults.Timeout.Duration != 7*time.Second {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout = %s, want the config to be reloaded", h.Config().Defaults.Timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,247 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	dateLayout = "2006-01-02"
+	timeLayout = "15:04"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a period of absolute time, e.g. a maintenance window.
+type Window struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Schedule is a predicate on time. It is active when the time matches the
+// recurring part (Days and Hours), is on one of Dates or is within one of
+// Windows, and is not on one of ExceptDates. For example, business hours
+// are
+//
+//	{"timezone": "Europe/Berlin", "days": ["mon", "tue", "wed", "thu", "fri"], "hours": "09:00-18:00", "exceptDates": ["2026-12-25"]}
+type Schedule struct {
+	// Timezone is an IANA time zone name for Days, Hours and dates. By
+	// default it is UTC.
+	Timezone string `json:"timezone,omitempty"`
+
+	// Days are the days of the week of the recurring part, "mon" to
+	// "sun". If only Hours is set, it is every day.
+	Days []string `json:"days,omitempty"`
+
+	// Hours is the time of day of the recurring part, e.g. "22:00-06:00"
+	// wraps past midnight. If only Days is set, it is the whole day.
+	Hours string `json:"hours,omitempty"`
+
+	// Dates are whole days, e.g. blackout dates, like "2026-12-31".
+	Dates []string `json:"dates,omitempty"`
+
+	// Windows are periods of absolute time.
+	Windows []Window `json:"windows,omitempty"`
+
+	// ExceptDates are days when the schedule is not active, e.g. holidays
+	// for business hours.
+	ExceptDates []string `json:"exceptDates,omitempty"`
+}
+
+// clock is a time of day in minutes since midnight.
+type clock int
+
+func parseClock(s string) (clock, error) {
+	t, err := time.Parse(timeLayout, strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("time of day %q should be like 09:30", s)
+	}
+	return clock(t.Hour()*60 + t.Minute()), nil
+}
+
+// compiledSchedule is a Schedule with parsed fields.
+type compiledSchedule struct {
+	loc        *time.Location
+	recurring  bool
+	days       map[time.Weekday]bool // nil means every day
+	from, to   clock
+	allDay     bool
+	dates      map[string]bool
+	exceptions map[string]bool
+	windows    []Window
+}
+
+func parseDates(dates []string) (map[string]bool, error) {
+	m := make(map[string]bool, len(dates))
+	for _, d := range dates {
+		if _, err := time.Parse(dateLayout, d); err != nil {
+			return nil, fmt.Errorf("date %q should be like 2006-01-02", d)
+		}
+		m[d] = true
+	}
+	return m, nil
+}
+
+func (s Schedule) compile() (*compiledSchedule, error) {
+	cs := &compiledSchedule{
+		loc:       time.UTC,
+		recurring: len(s.Days) > 0 || s.Hours != "",
+		allDay:    s.Hours == "",
+		windows:   s.Windows,
+	}
+	if s.Timezone != "" {
+		loc, err := time.LoadLocation(s.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown timezone %q", s.Timezone)
+		}
+		cs.loc = loc
+	}
+	if len(s.Days) > 0 {
+		cs.days = make(map[time.Weekday]bool)
+		for _, d := range s.Days {
+			wd, ok := weekdays[strings.ToLower(d)]
+			if !ok {
+				return nil, fmt.Errorf("unknown day %q, should be one of mon, tue, wed, thu, fri, sat, sun", d)
+			}
+			cs.days[wd] = true
+		}
+	}
+	if s.Hours != "" {
+		from, to, ok := strings.Cut(s.Hours, "-")
+		if !ok {
+			return nil, fmt.Errorf("hours %q should be like 09:00-18:00", s.Hours)
+		}
+		var err error
+		if cs.from, err = parseClock(from); err != nil {
+			return nil, err
+		}
+		if cs.to, err = parseClock(to); err != nil {
+			return nil, err
+		}
+		if cs.from == cs.to {
+			return nil, fmt.Errorf("hours %q are empty", s.Hours)
+		}
+	}
+	var err error
+	if cs.dates, err = parseDates(s.Dates); err != nil {
+		return nil, err
+	}
+	if cs.exceptions, err = parseDates(s.ExceptDates); err != nil {
+		return nil, err
+	}
+	for _, w := range s.Windows {
+		if !w.End.After(w.Start) {
+			return nil, fmt.Errorf("window %s - %s ends before it starts", w.Start.Format(time.RFC3339), w.End.Format(time.RFC3339))
+		}
+	}
+	if !cs.recurring && len(cs.dates) == 0 && len(cs.windows) == 0 {
+		return nil, fmt.Errorf("schedule is never active")
+	}
+	return cs, nil
+}
+
+func (cs *compiledSchedule) active(t time.Time) bool {
+	local := t.In(cs.loc)
+	if cs.exceptions[local.Format(dateLayout)] {
+		return false
+	}
+	if cs.dates[local.Format(dateLayout)] {
+		return true
+	}
+	for _, w := range cs.windows {
+		if !t.Before(w.Start) && t.Before(w.End) {
+			return true
+		}
+	}
+	if !cs.recurring {
+		return false
+	}
+	if cs.allDay {
+		return cs.days[local.Weekday()]
+	}
+	now := clock(local.Hour()*60 + local.Minute())
+	day := local.Weekday()
+	if cs.from < cs.to {
+		return now >= cs.from && now < cs.to && (cs.days == nil || cs.days[day])
+	}
+	// The hours wrap past midnight, the part after midnight belongs to the
+	// day when the period has started.
+	if now >= cs.from {
+		return cs.days == nil || cs.days[day]
+	}
+	if now < cs.to {
+		return cs.days == nil || cs.days[(day+6)%7]
+	}
+	return false
+}
+
+// Active reports whether the schedule is active at t. An invalid schedule
+// is never active, see Config.Validate.
+func (s Schedule) Active(t time.Time) bool {
+	cs, err := s.compile()
+	if err != nil {
+		return false
+	}
+	return cs.active(t)
+}
+
+// Override replaces sections of a policy while Schedule is active.
+type Override struct {
+	// Schedule is the name of a schedule of the document.
+	Schedule string `json:"schedule"`
+	Policy
+}
+
+// apply returns p with the sections of the first override whose schedule
+// is active at t.
+func (c *Config) apply(p Policy, overrides []Override, t time.Time) Policy {
+	for _, o := range overrides {
+		if s, ok := c.Schedules[o.Schedule]; ok && s.Active(t) {
+			return o.Policy.merge(p)
+		}
+	}
+	return p
+}
+
+// EffectiveAt is like Effective, but it applies the overrides whose
+// schedules are active at t. It should be called again when schedules
+// change, e.g. every minute.
+func (c *Config) EffectiveAt(t time.Time) []Route {
+	defaults := c.apply(c.Defaults, c.Overrides, t)
+	routes := make([]Route, 0, len(c.Routes)+1)
+	for _, r := range c.Routes {
+		routes = append(routes, Route{
+			Pattern: r.Pattern,
+			Policy:  c.apply(r.Policy, r.Overrides, t).merge(defaults),
+		})
+	}
+	return append(routes, Route{Policy: defaults})
+}
+
+// validateOverrides checks the references to schedules and the policies of
+// overrides of a route.
+func (c *Config) validateOverrides(route, pattern string, base Policy, overrides []Override, checks []Check, names []string) []error {
+	var errs []error
+	for _, o := range overrides {
+		if _, ok := c.Schedules[o.Schedule]; !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown schedule %q", route, o.Schedule))
+			continue
+		}
+		p := o.Policy.merge(base)
+		for j, check := range checks {
+			if err := check(pattern, p); err != nil {
+				errs = append(errs, fmt.Errorf("%s during %s: %s: %v", route, o.Schedule, names[j], err))
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleActive(t *testing.T) {
+	businessHours := Schedule{
+		Timezone:    "Europe/Berlin",
+		Days:        []string{"mon", "tue", "wed", "thu", "fri"},
+		Hours:       "09:00-18:00",
+		ExceptDates: []string{"2026-12-25"},
+	}
+	nights := Schedule{Days: []string{"fri"}, Hours: "22:00-06:00"}
+	blackout := Schedule{
+		Dates:   []string{"2026-12-31"},
+		Windows: []Window{{Start: time.Date(2026, 11, 1, 2, 0, 0, 0, time.UTC), End: time.Date(2026, 11, 1, 4, 0, 0, 0, time.UTC)}},
+	}
+
+	testCases := []struct {
+		name     string
+		schedule Schedule
+		time     string
+		expected bool
+	}{
+		{"business hours", businessHours, "2026-10-15T07:30:00Z", true}, // 09:30 in Berlin
+		{"before business hours", businessHours, "2026-10-15T06:30:00Z", false},
+		{"weekend", businessHours, "2026-10-17T10:00:00Z", false},
+		{"holiday", businessHours, "2026-12-25T10:00:00Z", false},
+		{"friday night", nights, "2026-10-16T23:00:00Z", true},
+		{"saturday morning", nights, "2026-10-17T05:59:00Z", true},
+		{"saturday night", nights, "2026-10-17T23:00:00Z", false},
+		{"blackout date", blackout, "2026-12-31T12:00:00Z", true},
+		{"maintenance window", blackout, "2026-11-01T03:00:00Z", true},
+		{"after maintenance", blackout, "2026-11-01T04:00:00Z", false},
+	}
+	for _, tc := range testCases {
+		tm, err := time.Parse(time.RFC3339, tc.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if active := tc.schedule.Active(tm); active != tc.expected {
+			t.Errorf("%s: Active(%s) = %v, want %v", tc.name, tc.time, active, tc.expected)
+		}
+	}
+}
+
+func TestEffectiveAt(t *testing.T) {
+	c, err := Parse(strings.NewReader(`{
+		"schedules": {
+			"night": {"hours": "22:00-06:00"},
+			"maintenance": {"windows": [{"start": "2026-11-01T02:00:00Z", "end": "2026-11-01T04:00:00Z"}]}
+		},
+		"defaults": {"ratelimit": {"rate": 100, "burst": 200}, "timeout": "5s"},
+		"overrides": [{"schedule": "maintenance", "ratelimit": {"rate": 10, "burst": 10}}],
+		"routes": [{"pattern": "/report", "overrides": [{"schedule": "night", "timeout": "1m"}]}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := c.Validate(); len(errs) != 0 {
+		t.Fatalf("Validate() = %v, want no errors", errs)
+	}
+
+	testCases := []struct {
+		time     string
+		expected []string
+	}{
+		{"2026-10-15T12:00:00Z", []string{
+			"ratelimit(rate=100 burst=200 window=0s) timeout=5s",
+			"ratelimit(rate=100 burst=200 window=0s) timeout=5s",
+		}},
+		{"2026-11-01T03:00:00Z", []string{
+			"ratelimit(rate=10 burst=10 window=0s) timeout=1m0s",
+			"ratelimit(rate=10 burst=10 window=0s) timeout=5s",
+		}},
+	}
+	for _, tc := range testCases {
+		tm, err := time.Parse(time.RFC3339, tc.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes := c.EffectiveAt(tm)
+		for i, r := range routes {
+			if r.String() != tc.expected[i] {
+				t.Errorf("%s: route %d: %s, want %s", tc.time, i, r.Policy, tc.expected[i])
+			}
+		}
+	}
+}
+
+func TestValidateSchedules(t *testing.T) {
+	testCases := []struct {
+		doc      string
+		expected string
+	}{
+		{
+			`{"schedules": {"x": {"days": ["monday"]}}}`,
+			`schedule "x": unknown day "monday", should be one of mon, tue, wed, thu, fri, sat, sun`,
+		},
+		{
+			`{"schedules": {"x": {"hours": "9-18"}}}`,
+			`schedule "x": time of day "9" should be like 09:30`,
+		},
+		{
+			`{"overrides": [{"schedule": "x"}]}`,
+			`defaults: unknown schedule "x"`,
+		},
+		{
+			`{"schedules": {"x": {"hours": "09:00-18:00"}}, "routes": [{"pattern": "/a", "overrides": [{"schedule": "x", "timeout": "0s"}]}]}`,
+			`route "/a" during x: timeout: timeout is 0s, should be positive`,
+		},
+	}
+	for _, tc := range testCases {
+		c, err := Parse(strings.NewReader(tc.doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs := c.Validate()
+		if len(errs) != 1 || errs[0].Error() != tc.expected {
+			t.Errorf("Validate(%s) = %v, want [%s]", tc.doc, errs, tc.expected)
+		}
+	}
+}
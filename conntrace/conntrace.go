@@ -0,0 +1,213 @@
+// Package conntrace collects statistics about connections that an
+// http.Transport uses for outbound requests.
+package conntrace
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// ConnInfo describes how a connection was obtained for a single request.
+type ConnInfo struct {
+	// Reused is true if the connection has been used for other requests.
+	Reused bool
+
+	// WasIdle is true if the connection was taken from the idle pool. A
+	// reused connection that was not idle means that the request waited for
+	// another request to return the connection to the pool.
+	WasIdle bool
+
+	// Wait is the time between asking the transport for a connection and
+	// getting it.
+	Wait time.Duration
+
+	// DNS, Connect and TLS are the durations of the DNS lookup, the TCP
+	// connect and the TLS handshake. They are zero for reused connections.
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+}
+
+// PoolWait reports whether the request waited for a busy connection to be
+// returned to the pool, i.e. the pool was exhausted.
+func (ci ConnInfo) PoolWait() bool {
+	return ci.Reused && !ci.WasIdle
+}
+
+// Stats contains cumulative counters collected by Collector.
+type Stats struct {
+	// Conns is the number of obtained connections.
+	Conns int64
+
+	// NewConns is the number of newly established connections.
+	NewConns int64
+
+	// ReusedConns is the number of reused connections.
+	ReusedConns int64
+
+	// PoolWaits is the number of requests that waited for a busy connection.
+	PoolWaits int64
+
+	// Wait is the total time spent waiting for connections.
+	Wait time.Duration
+
+	// PoolWait is the total time spent waiting for busy connections.
+	PoolWait time.Duration
+
+	// DNS, Connect and TLS are the total durations of DNS lookups, TCP
+	// connects and TLS handshakes.
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+}
+
+// Collector collects connection statistics using httptrace.
+type Collector struct {
+	mu    sync.Mutex
+	stats Stats
+
+	// OnConn, if not nil, is called every time a request gets a connection.
+	// It allows to feed connection pool behavior into other components such
+	// as concurrency controllers, see adaptivelimit.Middleware.ObserveConn.
+	OnConn func(ConnInfo)
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// New returns a new Collector.
+func New() *Collector {
+	return &Collector{
+		now: time.Now,
+	}
+}
+
+// Stats returns a snapshot of the collected statistics.
+func (c *Collector) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *Collector) record(ci ConnInfo) {
+	c.mu.Lock()
+	c.stats.Conns++
+	if ci.Reused {
+		c.stats.ReusedConns++
+	} else {
+		c.stats.NewConns++
+	}
+	if ci.PoolWait() {
+		c.stats.PoolWaits++
+		c.stats.PoolWait += ci.Wait
+	}
+	c.stats.Wait += ci.Wait
+	c.stats.DNS += ci.DNS
+	c.stats.Connect += ci.Connect
+	c.stats.TLS += ci.TLS
+	c.mu.Unlock()
+
+	if c.OnConn != nil {
+		c.OnConn(ci)
+	}
+}
+
+// requestTrace tracks a single request. httptrace hooks may be called from
+// different goroutines, so the state is protected by a mutex.
+type requestTrace struct {
+	c *Collector
+
+	mu           sync.Mutex
+	ci           ConnInfo
+	getConn      time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+}
+
+func (rt *requestTrace) since(t time.Time) time.Duration {
+	if t.IsZero() {
+		return 0
+	}
+	return rt.c.now().Sub(t)
+}
+
+func (rt *requestTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			rt.mu.Lock()
+			defer rt.mu.Unlock()
+			rt.getConn = rt.c.now()
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			rt.mu.Lock()
+			defer rt.mu.Unlock()
+			rt.dnsStart = rt.c.now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			rt.mu.Lock()
+			defer rt.mu.Unlock()
+			rt.ci.DNS = rt.since(rt.dnsStart)
+		},
+		ConnectStart: func(network, addr string) {
+			rt.mu.Lock()
+			defer rt.mu.Unlock()
+			rt.connectStart = rt.c.now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			rt.mu.Lock()
+			defer rt.mu.Unlock()
+			rt.ci.Connect = rt.since(rt.connectStart)
+		},
+		TLSHandshakeStart: func() {
+			rt.mu.Lock()
+			defer rt.mu.Unlock()
+			rt.tlsStart = rt.c.now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			rt.mu.Lock()
+			defer rt.mu.Unlock()
+			rt.ci.TLS = rt.since(rt.tlsStart)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			rt.mu.Lock()
+			rt.ci.Reused = info.Reused
+			rt.ci.WasIdle = info.WasIdle
+			rt.ci.Wait = rt.since(rt.getConn)
+			ci := rt.ci
+			rt.mu.Unlock()
+
+			rt.c.record(ci)
+		},
+	}
+}
+
+// WithContext returns a context that collects statistics for requests that
+// are made with it.
+func (c *Collector) WithContext(ctx context.Context) context.Context {
+	rt := &requestTrace{c: c}
+	return httptrace.WithClientTrace(ctx, rt.clientTrace())
+}
+
+type roundTripper struct {
+	c    *Collector
+	next http.RoundTripper
+}
+
+func (t roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.next.RoundTrip(req.WithContext(t.c.WithContext(req.Context())))
+}
+
+// RoundTripper returns an http.RoundTripper that collects statistics for
+// requests that are sent through next. If next is nil,
+// http.DefaultTransport is used.
+func (c *Collector) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return roundTripper{c: c, next: next}
+}
@@ -0,0 +1,80 @@
+package conntrace
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+	"time"
+)
+
+func TestCollector(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "OK", http.StatusOK)
+	}))
+	defer ts.Close()
+
+	c := New()
+	var infos []ConnInfo
+	c.OnConn = func(ci ConnInfo) {
+		infos = append(infos, ci)
+	}
+
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: c.RoundTripper(transport)}
+
+	for i := 0; i < 3; i++ {
+		res, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatalf("failed to get %s: %s", ts.URL, err)
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}
+
+	stats := c.Stats()
+	if stats.Conns != 3 {
+		t.Errorf("stats.Conns = %d, want %d", stats.Conns, 3)
+	}
+	if stats.NewConns != 1 {
+		t.Errorf("stats.NewConns = %d, want %d", stats.NewConns, 1)
+	}
+	if stats.ReusedConns != 2 {
+		t.Errorf("stats.ReusedConns = %d, want %d", stats.ReusedConns, 2)
+	}
+	if stats.PoolWaits != 0 {
+		t.Errorf("stats.PoolWaits = %d, want %d", stats.PoolWaits, 0)
+	}
+	if len(infos) != 3 {
+		t.Fatalf("OnConn is called %d times, want %d", len(infos), 3)
+	}
+	if infos[0].Reused || !infos[1].Reused || !infos[1].WasIdle {
+		t.Errorf("infos = %+v, want the first connection to be new and the others to be reused from the idle pool", infos)
+	}
+}
+
+func TestCollectorPoolWait(t *testing.T) {
+	c := New()
+	start := time.Unix(0, 0)
+	now := start
+	c.now = func() time.Time {
+		return now
+	}
+
+	rt := &requestTrace{c: c}
+	trace := rt.clientTrace()
+	trace.GetConn("example.com:80")
+	now = now.Add(50 * time.Millisecond)
+	trace.GotConn(httptrace.GotConnInfo{Reused: true, WasIdle: false})
+
+	stats := c.Stats()
+	if stats.PoolWaits != 1 {
+		t.Errorf("stats.PoolWaits = %d, want %d", stats.PoolWaits, 1)
+	}
+	if expected := 50 * time.Millisecond; stats.PoolWait != expected {
+		t.Errorf("stats.PoolWait = %s, want %s", stats.PoolWait, expected)
+	}
+}
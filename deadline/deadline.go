@@ -0,0 +1,235 @@
+// Package deadline propagates the time budget of requests between services.
+// Middleware takes the timeout of an inbound request from a header set by
+// the client and attaches a matching deadline to the request context, and
+// Transport forwards the remaining budget on outbound requests, so that
+// every service of the chain stops working on a request nobody is waiting
+// for. Combined with maxconnections.Limiter.DeadlineAware, such requests
+// don't even take places in the queues:
+//
+//	h = deadline.New(h)
+//	client := &http.Client{Transport: deadline.NewTransport(nil)}
+package deadline
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultHeader is the default header that carries timeouts. It is the
+	// same header as maxconnections.TimeoutHeader.
+	DefaultHeader = "X-Request-Timeout"
+
+	// GRPCHeader is the header that carries timeouts of gRPC requests, see
+	// GRPCTimeout.
+	GRPCHeader = "Grpc-Timeout"
+)
+
+// Format encodes timeouts in headers.
+type Format interface {
+	// Parse parses the value of a header.
+	Parse(s string) (time.Duration, error)
+
+	// Format returns the header value for the timeout d.
+	Format(d time.Duration) string
+}
+
+var (
+	// Duration is the format of time.ParseDuration, e.g. "250ms". It is
+	// used by maxconnections.SetPropagationHeaders.
+	Duration Format = durationFormat{}
+
+	// GRPCTimeout is the format of the grpc-timeout header: up to 8 digits
+	// followed by a unit, one of H, M, S, m, u and n, e.g. "250m".
+	GRPCTimeout Format = grpcFormat{}
+)
+
+type durationFormat struct{}
+
+func (durationFormat) Parse(s string) (time.Duration, error) {
+	return time.ParseDuration(s)
+}
+
+func (durationFormat) Format(d time.Duration) string {
+	return d.Truncate(time.Millisecond).String()
+}
+
+// errInvalidGRPCTimeout is returned for malformed grpc-timeout values.
+var errInvalidGRPCTimeout = errors.New("deadline: invalid grpc-timeout value")
+
+// grpcUnits are the units of grpc-timeout from the finest to the coarsest.
+var grpcUnits = []struct {
+	unit byte
+	d    time.Duration
+}{
+	{'n', time.Nanosecond},
+	{'u', time.Microsecond},
+	{'m', time.Millisecond},
+	{'S', time.Second},
+	{'M', time.Minute},
+	{'H', time.Hour},
+}
+
+// grpcMaxValue is the largest number that fits into 8 digits.
+const grpcMaxValue = 99999999
+
+type grpcFormat struct{}
+
+func (grpcFormat) Parse(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, errInvalidGRPCTimeout
+	}
+	value, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || value < 0 {
+		return 0, errInvalidGRPCTimeout
+	}
+	for _, u := range grpcUnits {
+		if u.unit == s[len(s)-1] {
+			return time.Duration(value) * u.d, nil
+		}
+	}
+	return 0, errInvalidGRPCTimeout
+}
+
+// Format uses the finest unit in which d fits into 8 digits. The value is
+// rounded down, so that the upstream doesn't overestimate the budget.
+func (grpcFormat) Format(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	for _, u := range grpcUnits {
+		if d/u.d <= grpcMaxValue {
+			return strconv.FormatInt(int64(d/u.d), 10) + string(u.unit)
+		}
+	}
+	return strconv.Itoa(grpcMaxValue) + "H"
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler http.Handler
+
+	// Header is the request header with the timeout set by the client. By
+	// default it is DefaultHeader.
+	Header string
+
+	// Format is the format of Header. By default it is Duration.
+	Format Format
+
+	// Max, if positive, caps the timeouts of clients, so that a client
+	// can't make the server work on a request longer than it would allow.
+	Max time.Duration
+
+	// Default, if positive, is the timeout of requests without a valid
+	// Header.
+	Default time.Duration
+
+	// ExpiredHandler, if not nil, is called instead of the handler for
+	// requests whose budget has already been used up by the services
+	// before this one, e.g. to respond with 504.
+	ExpiredHandler http.Handler
+}
+
+// New returns an http.Handler that passes requests to h with the deadline
+// from Header in their context.
+func New(h http.Handler) *Middleware {
+	return &Middleware{
+		handler: h,
+		Header:  DefaultHeader,
+		Format:  Duration,
+	}
+}
+
+// timeout returns the timeout of r. It returns false if r has no timeout.
+func (m *Middleware) timeout(r *http.Request) (time.Duration, bool) {
+	d, ok := time.Duration(0), false
+	if v := r.Header.Get(m.Header); v != "" {
+		format := m.Format
+		if format == nil {
+			format = Duration
+		}
+		if parsed, err := format.Parse(v); err == nil && parsed >= 0 {
+			d, ok = parsed, true
+		}
+	}
+	if !ok && m.Default > 0 {
+		d, ok = m.Default, true
+	}
+	if ok && m.Max > 0 && d > m.Max {
+		d = m.Max
+	}
+	return d, ok
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d, ok := m.timeout(r)
+	if !ok {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+	if d == 0 && m.ExpiredHandler != nil {
+		m.ExpiredHandler.ServeHTTP(w, r)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	defer cancel()
+	m.handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// Transport implements the http.RoundTripper interface. It sets the time
+// remaining before the context deadline of outbound requests, so that the
+// upstream can stop working on them when this process stops waiting.
+type Transport struct {
+	next http.RoundTripper
+
+	// Header is the request header that is set to the remaining time. By
+	// default it is DefaultHeader.
+	Header string
+
+	// Format is the format of Header. By default it is Duration.
+	Format Format
+
+	// Margin is subtracted from the remaining time to leave this process
+	// time to receive and handle the response.
+	Margin time.Duration
+}
+
+// NewTransport returns a Transport that sends requests through next. If next
+// is nil, http.DefaultTransport is used.
+func NewTransport(next http.RoundTripper) *Transport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &Transport{
+		next:   next,
+		Header: DefaultHeader,
+		Format: Duration,
+	}
+}
+
+// RoundTrip implements http.RoundTripper. Requests whose deadline has
+// passed are not sent.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	deadline, ok := req.Context().Deadline()
+	if !ok || t.Header == "" {
+		return t.next.RoundTrip(req)
+	}
+	remaining := time.Until(deadline) - t.Margin
+	if remaining <= 0 {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, context.DeadlineExceeded
+	}
+	format := t.Format
+	if format == nil {
+		format = Duration
+	}
+	// RoundTrip must not modify the request.
+	req = req.Clone(req.Context())
+	req.Header.Set(t.Header, format.Format(remaining))
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,141 @@
+package deadline
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestGRPCTimeout(t *testing.T) {
+	for s, expected := range map[string]time.Duration{
+		"250m":      250 * time.Millisecond,
+		"1S":        time.Second,
+		"2H":        2 * time.Hour,
+		"99999999n": 99999999 * time.Nanosecond,
+	} {
+		if d, err := GRPCTimeout.Parse(s); err != nil || d != expected {
+			t.Errorf("Parse(%q) = %s, %v, want %s", s, d, err, expected)
+		}
+	}
+	for _, s := range []string{"", "m", "1", "1x", "-1m", "123456789m"} {
+		if _, err := GRPCTimeout.Parse(s); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", s)
+		}
+	}
+	for d, expected := range map[time.Duration]string{
+		-time.Second:           "0n",
+		250 * time.Millisecond: "250000u",
+		time.Second:            "1000000u",
+		2 * time.Hour:          "7200000m",
+	} {
+		if s := GRPCTimeout.Format(d); s != expected {
+			t.Errorf("Format(%s) = %q, want %q", d, s, expected)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var remaining time.Duration
+	var hasDeadline bool
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var deadline time.Time
+		deadline, hasDeadline = r.Context().Deadline()
+		remaining = time.Until(deadline)
+	}))
+	m.Max = time.Minute
+	m.ExpiredHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGatewayTimeout)
+	})
+
+	serve := func(timeout string) int {
+		hasDeadline = false
+		r := httptest.NewRequest("GET", "/", nil)
+		if timeout != "" {
+			r.Header.Set(DefaultHeader, timeout)
+		}
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	serve("")
+	if hasDeadline {
+		t.Fatal("a request without a timeout has got a deadline")
+	}
+	serve("10s")
+	if !hasDeadline || remaining > 10*time.Second || remaining < 9*time.Second {
+		t.Fatalf("remaining = %s, %t, want about 10s", remaining, hasDeadline)
+	}
+	serve("1h")
+	if !hasDeadline || remaining > time.Minute {
+		t.Fatalf("remaining = %s, want the timeout to be capped by Max", remaining)
+	}
+	serve("invalid")
+	if hasDeadline {
+		t.Fatal("a request with an invalid timeout has got a deadline")
+	}
+	if code := serve("0s"); code != http.StatusGatewayTimeout || hasDeadline {
+		t.Fatalf("status = %d, want an expired request to get ExpiredHandler", code)
+	}
+
+	m.Default = time.Second
+	serve("")
+	if !hasDeadline || remaining > time.Second {
+		t.Fatalf("remaining = %s, %t, want Default", remaining, hasDeadline)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var upstream string
+	sent := 0
+	tr := NewTransport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent++
+		upstream = req.Header.Get(GRPCHeader)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	}))
+	tr.Header = GRPCHeader
+	tr.Format = GRPCTimeout
+	tr.Margin = 5 * time.Second
+	client := &http.Client{Transport: tr}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://example.com/", nil)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	d, err := GRPCTimeout.Parse(upstream)
+	if err != nil || d > 55*time.Second || d < 54*time.Second {
+		t.Fatalf("upstream timeout = %q, want about 55s", upstream)
+	}
+	if req.Header.Get(GRPCHeader) != "" {
+		t.Fatal("RoundTrip has modified the request")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, _ = http.NewRequestWithContext(ctx, "GET", "http://example.com/", nil)
+	if _, err := client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Do() = %v, want the request within Margin of its deadline not to be sent", err)
+	}
+	if sent != 1 {
+		t.Fatalf("sent %d requests, want %d", sent, 1)
+	}
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Debug is an http.Handler that serves the descriptions of the components of
+// a Registry as JSON. It exposes internals of the process and should be
+// protected like /debug/pprof.
+type Debug struct {
+	// Registry is the set of described components.
+	Registry *Registry
+
+	// AllowUpdates enables POST requests with the form values name and
+	// limit that change the limit of the named component, see
+	// Registry.Register. It is disabled by default.
+	AllowUpdates bool
+}
+
+// DebugHandler returns a Debug handler for reg that doesn't allow updates.
+func DebugHandler(reg *Registry) *Debug {
+	return &Debug{
+		Registry: reg,
+	}
+}
+
+func (d *Debug) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		if !d.AllowUpdates {
+			http.Error(w, "updates are disabled", http.StatusForbidden)
+			return
+		}
+		if !d.update(w, r) {
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(d.Registry.Describe())
+}
+
+// update changes the limit of a component. It writes an error response and
+// returns false if the request is invalid.
+func (d *Debug) update(w http.ResponseWriter, r *http.Request) bool {
+	name := r.FormValue("name")
+	c, ok := d.Registry.Get(name)
+	if !ok {
+		http.Error(w, "unknown component", http.StatusNotFound)
+		return false
+	}
+	s, ok := c.(Updatable)
+	if !ok {
+		http.Error(w, "the limit of the component cannot be changed", http.StatusBadRequest)
+		return false
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 0 {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return false
+	}
+	s.SetMaxRunning(limit)
+	return true
+}
@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dmage/middleware/circuitbreaker"
+	"github.com/dmage/middleware/maxconnections"
+)
+
+func TestDebugHandler(t *testing.T) {
+	reg := NewRegistry()
+	limiter := maxconnections.NewLimiter(4, 0)
+	reg.Register("api", limiter)
+	reg.Register("backend", circuitbreaker.New(http.NotFoundHandler()))
+
+	release, err := limiter.Acquire(httptest.NewRequest("GET", "/", nil).Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	d := DebugHandler(reg)
+	rec := httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/middleware", nil))
+	var components []struct {
+		Name        string  `json:"name"`
+		Type        string  `json:"type"`
+		Limit       int     `json:"limit"`
+		State       string  `json:"state"`
+		Utilization float64 `json:"utilization"`
+		Adjustable  bool    `json:"adjustable"`
+		Stats       struct {
+			Running  int   `json:"running"`
+			Admitted int64 `json:"admitted"`
+		} `json:"stats"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &components); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	if len(components) != 2 {
+		t.Fatalf("got %d components, want 2: %s", len(components), rec.Body)
+	}
+	api, backend := components[0], components[1]
+	if api.Name != "api" || api.Type != "*maxconnections.Limiter" || api.Limit != 4 || api.Utilization != 0.25 || !api.Adjustable || api.Stats.Running != 1 || api.Stats.Admitted != 1 {
+		t.Errorf("api = %+v", api)
+	}
+	if backend.Name != "backend" || backend.State != "closed" || backend.Adjustable {
+		t.Errorf("backend = %+v", backend)
+	}
+
+	update := func(form url.Values) int {
+		r := httptest.NewRequest("POST", "/debug/middleware", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		d.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	if status := update(url.Values{"name": {"api"}, "limit": {"8"}}); status != http.StatusForbidden {
+		t.Fatalf("status = %d, want updates to be disabled by default", status)
+	}
+
+	d.AllowUpdates = true
+	if status := update(url.Values{"name": {"api"}, "limit": {"8"}}); status != http.StatusOK {
+		t.Fatalf("status = %d, want the limit to be updated", status)
+	}
+	if limit := limiter.MaxRunning(); limit != 8 {
+		t.Fatalf("limit = %d, want 8", limit)
+	}
+	for _, tc := range []struct {
+		form   url.Values
+		status int
+	}{
+		{url.Values{"name": {"unknown"}, "limit": {"8"}}, http.StatusNotFound},
+		{url.Values{"name": {"backend"}, "limit": {"8"}}, http.StatusBadRequest},
+		{url.Values{"name": {"api"}, "limit": {"many"}}, http.StatusBadRequest},
+	} {
+		if status := update(tc.form); status != tc.status {
+			t.Errorf("%v: status = %d, want %d", tc.form, status, tc.status)
+		}
+	}
+}
+
+func TestRegistryRegisterTwice(t *testing.T) {
+	reg := NewRegistry()
+	reg.Register("api", maxconnections.NewLimiter(1, 0))
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a name twice doesn't panic")
+		}
+	}()
+	reg.Register("api", maxconnections.NewLimiter(1, 0))
+}
@@ -0,0 +1,289 @@
+// Package decisionlog records the decisions that middlewares make about
+// sampled requests. When a request is rejected deep in a chain of
+// middlewares, the log entry of the request shows which middleware rejected
+// it, by which rule and why, and which middlewares let it through before.
+//
+// Middlewares of this repository report their decisions with Record. Record
+// does nothing for requests that are not sampled by a Middleware, so it is
+// cheap to call on every request.
+package decisionlog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dmage/middleware/requestid"
+)
+
+const (
+	defaultSampleRate = 0.01
+	defaultSize       = 100
+)
+
+// Action is the kind of a decision.
+type Action int
+
+const (
+	// Allow means that the request is passed on as is.
+	Allow Action = iota
+
+	// Deny means that the request is rejected.
+	Deny
+
+	// Transform means that the request or the response is modified, e.g.
+	// a parameter is capped.
+	Transform
+)
+
+func (a Action) String() string {
+	switch a {
+	case Allow:
+		return "allow"
+	case Deny:
+		return "deny"
+	case Transform:
+		return "transform"
+	}
+	return "unknown"
+}
+
+// MarshalText implements encoding.TextMarshaler, so that entries are dumped
+// with readable actions.
+func (a Action) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// Decision is a decision of a middleware about a request.
+type Decision struct {
+	// Middleware is the name of the middleware, e.g. "ratelimit".
+	Middleware string `json:"middleware"`
+
+	// Action is what the middleware has done with the request.
+	Action Action `json:"action"`
+
+	// Rule identifies the rule that has been applied, e.g. the rate limit
+	// key or the route. It may be empty.
+	Rule string `json:"rule,omitempty"`
+
+	// Reason explains the decision, e.g. "queue full".
+	Reason string `json:"reason,omitempty"`
+
+	// Time is when the decision has been made. Record sets it.
+	Time time.Time `json:"time"`
+}
+
+// Entry is the log entry of a sampled request.
+type Entry struct {
+	Time      time.Time     `json:"time"`
+	Method    string        `json:"method"`
+	Path      string        `json:"path"`
+	RequestID string        `json:"request_id,omitempty"`
+	Status    int           `json:"status"`
+	Duration  time.Duration `json:"duration"`
+	Decisions []Decision    `json:"decisions"`
+}
+
+// trail collects the decisions of a sampled request.
+type trail struct {
+	mu        sync.Mutex
+	decisions []Decision
+	now       func() time.Time
+}
+
+type trailKey struct{}
+
+// Record adds d to the log entry of the request with ctx if the request is
+// sampled.
+func Record(ctx context.Context, d Decision) {
+	t, _ := ctx.Value(trailKey{}).(*trail)
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d.Time = t.now()
+	t.decisions = append(t.decisions, d)
+}
+
+// Sampled reports whether the decisions of the request with ctx are
+// recorded, so that middlewares can skip preparing expensive reasons.
+func Sampled(ctx context.Context) bool {
+	return ctx.Value(trailKey{}) != nil
+}
+
+// statusWriter remembers the status code of the response. It implements
+// http.Flusher and http.Hijacker when the underlying writer does.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// FlushError flushes the response, see http.ResponseController.
+func (w *statusWriter) FlushError() error {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statusWriter) Flush() {
+	w.FlushError()
+}
+
+// Hijack lets the handler take over the connection, see http.Hijacker.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Middleware implements the http.Handler interface. It should be the
+// outermost middleware of the chain.
+type Middleware struct {
+	handler http.Handler
+
+	// mu protects the fields below up to the configuration.
+	mu      sync.Mutex
+	entries []Entry // ring buffer
+	next    int
+
+	// SampleRate is the fraction of requests whose decisions are
+	// recorded. By default it is 0.01. It is not used if Sample is set.
+	SampleRate float64
+
+	// Sample, if not nil, reports whether the decisions of the request
+	// should be recorded, e.g. for requests with a debug header.
+	Sample func(r *http.Request) bool
+
+	// Size is the number of the latest entries that are kept for Entries.
+	// By default it is 100.
+	Size int
+
+	// OnEntry, if not nil, is called with the entry of every sampled
+	// request, e.g. to write it to a log.
+	OnEntry func(e Entry)
+
+	// now and random allow to override time.Now and rand.Float64 for
+	// tests.
+	now    func() time.Time
+	random func() float64
+}
+
+// New returns an http.Handler that passes requests to h and records the
+// decisions about sampled requests.
+func New(h http.Handler) *Middleware {
+	return &Middleware{
+		handler:    h,
+		SampleRate: defaultSampleRate,
+		Size:       defaultSize,
+		now:        time.Now,
+		random:     rand.Float64,
+	}
+}
+
+// sample reports whether r should be sampled.
+func (m *Middleware) sample(r *http.Request) bool {
+	if m.Sample != nil {
+		return m.Sample(r)
+	}
+	return m.random() < m.SampleRate
+}
+
+// add stores e in the ring buffer.
+func (m *Middleware) add(e Entry) {
+	size := m.Size
+	if size <= 0 {
+		size = defaultSize
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.entries) < size {
+		m.entries = append(m.entries, e)
+		return
+	}
+	m.entries[m.next%len(m.entries)] = e
+	m.next++
+}
+
+// Entries returns the latest entries, oldest first.
+func (m *Middleware) Entries() []Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := make([]Entry, 0, len(m.entries))
+	start := 0
+	if len(m.entries) > 0 {
+		start = m.next % len(m.entries)
+	}
+	entries = append(entries, m.entries[start:]...)
+	entries = append(entries, m.entries[:start]...)
+	return entries
+}
+
+// DumpHandler returns an http.Handler that serves the latest entries as
+// JSON. It exposes details of requests, so it should be served only to
+// operators, like /debug/vars.
+func (m *Middleware) DumpHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(m.Entries())
+	})
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !m.sample(r) {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+
+	start := m.now()
+	t := &trail{now: m.now}
+	sw := &statusWriter{ResponseWriter: w}
+	defer func() {
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		t.mu.Lock()
+		decisions := t.decisions
+		t.mu.Unlock()
+		e := Entry{
+			Time:      start,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			RequestID: requestid.FromContext(r.Context()),
+			Status:    status,
+			Duration:  m.now().Sub(start),
+			Decisions: decisions,
+		}
+		m.add(e)
+		if m.OnEntry != nil {
+			m.OnEntry(e)
+		}
+	}()
+	m.handler.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), trailKey{}, t)))
+}
@@ -0,0 +1,134 @@
+package decisionlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	// guard emulates a middleware that rejects requests with ?deny.
+	guard := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("deny") != "" {
+				Record(r.Context(), Decision{Middleware: "guard", Action: Deny, Rule: "deny", Reason: "denied by the test"})
+				http.Error(w, "403 forbidden", http.StatusForbidden)
+				return
+			}
+			Record(r.Context(), Decision{Middleware: "guard", Action: Allow})
+			h.ServeHTTP(w, r)
+		})
+	}
+
+	now := time.Unix(0, 0)
+	m := New(guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	m.Size = 2
+	m.Sample = func(r *http.Request) bool {
+		return r.Header.Get("X-Debug") != ""
+	}
+	m.now = func() time.Time {
+		return now
+	}
+	var onEntry int
+	m.OnEntry = func(e Entry) {
+		onEntry++
+	}
+
+	for i, target := range []string{"/a", "/b?deny=1", "/c", "/d?deny=1"} {
+		r := httptest.NewRequest("GET", target, nil)
+		if i != 2 {
+			r.Header.Set("X-Debug", "1")
+		}
+		m.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if onEntry != 3 {
+		t.Fatalf("OnEntry has been called %d times, want 3", onEntry)
+	}
+
+	rec := httptest.NewRecorder()
+	m.DumpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/decisions", nil))
+	var entries []struct {
+		Path      string
+		Status    int
+		Decisions []struct {
+			Middleware string
+			Action     string
+			Rule       string
+			Reason     string
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("%s: %v", rec.Body.String(), err)
+	}
+
+	var got []string
+	for _, e := range entries {
+		s := e.Path + " " + strconv.Itoa(e.Status)
+		for _, d := range e.Decisions {
+			s += " " + d.Middleware + ":" + d.Action + ":" + d.Rule + ":" + d.Reason
+		}
+		got = append(got, s)
+	}
+	expected := []string{
+		"/b 403 guard:deny:deny:denied by the test",
+		"/d 403 guard:deny:deny:denied by the test",
+	}
+	if len(got) != len(expected) || got[0] != expected[0] || got[1] != expected[1] {
+		t.Fatalf("entries = %q, want %q", got, expected)
+	}
+}
+
+func TestRecordWithoutSampling(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	if Sampled(r.Context()) {
+		t.Fatalf("Sampled() = true for a request without a trail")
+	}
+	Record(r.Context(), Decision{Middleware: "test", Action: Deny})
+}
+
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func TestInterfaces(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws" {
+			hj, ok := w.(http.Hijacker)
+			if !ok {
+				t.Fatal("the writer doesn't implement http.Hijacker")
+			}
+			if _, _, err := hj.Hijack(); err != nil {
+				t.Fatalf("Hijack() = %v, want nil", err)
+			}
+			return
+		}
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("the writer doesn't implement http.Flusher")
+		}
+		f.Flush()
+	})
+	m := New(h)
+	m.SampleRate = 1
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !rec.Flushed {
+		t.Errorf("the response hasn't been flushed")
+	}
+	hj := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	m.ServeHTTP(hj, httptest.NewRequest("GET", "/ws", nil))
+	if !hj.hijacked {
+		t.Errorf("the connection hasn't been hijacked")
+	}
+}
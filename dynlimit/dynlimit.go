@@ -0,0 +1,220 @@
+// Package dynlimit drives the limits of registered components from an
+// external source, e.g. a mounted ConfigMap, an HTTP endpoint of a control
+// plane or a callback, so that limits can be tuned across a fleet without
+// redeploying it:
+//
+//	middleware.Register("api", m)
+//	c := dynlimit.New(middleware.DefaultRegistry, dynlimit.FileSource("/etc/limits/limits.json"))
+//	c.Validate = dynlimit.MaxChange(2)
+//	c.OnChange = func(name string, old, new int) {
+//		log.Printf("limit of %s changed from %d to %d", name, old, new)
+//	}
+//	go c.Poll(ctx)
+//
+// Components should implement middleware.Updatable, e.g.
+// maxconnections.Limiter and Middleware.
+package dynlimit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dmage/middleware"
+)
+
+// ErrUnknownComponent is returned for limits of components that are not
+// registered.
+var ErrUnknownComponent = errors.New("dynlimit: unknown component")
+
+// ErrNotUpdatable is returned for limits of components that don't implement
+// middleware.Updatable.
+var ErrNotUpdatable = errors.New("dynlimit: component is not updatable")
+
+// MaxChange returns a function for Controller.Validate that rejects limits
+// that differ from the current ones more than factor times, so that a typo
+// in the source cannot take the service down.
+func MaxChange(factor float64) func(name string, old, new int) error {
+	return func(name string, old, new int) error {
+		if old > 0 && (float64(new) > float64(old)*factor || float64(new)*factor < float64(old)) {
+			return fmt.Errorf("dynlimit: %s: change from %d to %d exceeds %g times", name, old, new, factor)
+		}
+		return nil
+	}
+}
+
+// Controller applies limits from a Source to the components of a Registry.
+type Controller struct {
+	// Registry contains the components.
+	Registry *middleware.Registry
+
+	// Source provides the limits. Components that are not mentioned keep
+	// their limits.
+	Source Source
+
+	// Interval is the time between polls of Source. The default is 10
+	// seconds.
+	Interval time.Duration
+
+	// Validate, if not nil, is called for every limit that is going to be
+	// changed. If it returns an error for any of them, none of the limits
+	// are changed. Limits less than 1 are always rejected.
+	Validate func(name string, old, new int) error
+
+	// OnChange, if not nil, is called after a limit is changed.
+	OnChange func(name string, old, new int)
+
+	// OnError, if not nil, is called when Poll fails to read or apply the
+	// limits.
+	OnError func(err error)
+
+	// mu serializes updates.
+	mu sync.Mutex
+}
+
+// New returns a Controller that applies the limits of src to the components
+// of reg.
+func New(reg *middleware.Registry, src Source) *Controller {
+	return &Controller{
+		Registry: reg,
+		Source:   src,
+		Interval: 10 * time.Second,
+	}
+}
+
+// Apply validates the limits and applies them. If any of them is invalid,
+// nothing is changed and the problems are returned.
+func (c *Controller) Apply(limits Limits) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := make([]string, 0, len(limits))
+	for name := range limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	components := make(map[string]middleware.Updatable, len(limits))
+	for _, name := range names {
+		v, ok := c.Registry.Get(name)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrUnknownComponent, name))
+			continue
+		}
+		u, ok := v.(middleware.Updatable)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrNotUpdatable, name))
+			continue
+		}
+		old, n := u.MaxRunning(), limits[name]
+		if n == old {
+			continue
+		}
+		if n < 1 {
+			errs = append(errs, fmt.Errorf("dynlimit: %s: limit is %d, should be at least 1", name, n))
+			continue
+		}
+		if c.Validate != nil {
+			if err := c.Validate(name, old, n); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		components[name] = u
+	}
+	if len(errs) != 0 {
+		return errors.Join(errs...)
+	}
+
+	for _, name := range names {
+		u, ok := components[name]
+		if !ok {
+			continue
+		}
+		old := u.MaxRunning()
+		u.SetMaxRunning(limits[name])
+		if c.OnChange != nil {
+			c.OnChange(name, old, limits[name])
+		}
+	}
+	return nil
+}
+
+// Update reads the limits from Source and applies them.
+func (c *Controller) Update(ctx context.Context) error {
+	limits, err := c.Source.Limits(ctx)
+	if err != nil {
+		return err
+	}
+	return c.Apply(limits)
+}
+
+// Poll updates the limits right away and then every Interval until ctx is
+// done.
+func (c *Controller) Poll(ctx context.Context) {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		if err := c.Update(ctx); err != nil && ctx.Err() == nil && c.OnError != nil {
+			c.OnError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Handler returns an http.Handler that serves the limits of the updatable
+// components as a JSON object on GET, and applies a JSON object of limits
+// sent with PUT or POST, so that a controller can push limits to the
+// process. It allows to change limits and should be protected like
+// /debug/pprof.
+func (c *Controller) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPut, http.MethodPost:
+			limits, err := parseLimits(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := c.Apply(limits); err != nil {
+				status := http.StatusUnprocessableEntity
+				if errors.Is(err, ErrUnknownComponent) {
+					status = http.StatusNotFound
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(c.Current())
+	})
+}
+
+// Current returns the limits of the updatable components of the registry.
+func (c *Controller) Current() Limits {
+	limits := make(Limits)
+	for _, name := range c.Registry.Names() {
+		if v, ok := c.Registry.Get(name); ok {
+			if u, ok := v.(middleware.Updatable); ok {
+				limits[name] = u.MaxRunning()
+			}
+		}
+	}
+	return limits
+}
@@ -0,0 +1,111 @@
+package dynlimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmage/middleware"
+	"github.com/dmage/middleware/maxconnections"
+	"github.com/dmage/middleware/ratelimit"
+)
+
+func TestApply(t *testing.T) {
+	reg := middleware.NewRegistry()
+	api := maxconnections.NewLimiter(10, 0)
+	reg.Register("api", api)
+	reg.Register("uploads", maxconnections.NewLimiter(4, 0))
+	reg.Register("ratelimit", ratelimit.NewLimiter(1, 1))
+
+	var changes []string
+	c := New(reg, nil)
+	c.Validate = MaxChange(2)
+	c.OnChange = func(name string, old, new int) {
+		changes = append(changes, name)
+	}
+
+	for _, tc := range []struct {
+		limits Limits
+		err    error
+	}{
+		{Limits{"api": 20, "unknown": 1}, ErrUnknownComponent},
+		{Limits{"api": 20, "ratelimit": 1}, ErrNotUpdatable},
+		{Limits{"api": 20, "uploads": 0}, nil},
+		{Limits{"api": 21}, nil},
+	} {
+		err := c.Apply(tc.limits)
+		if err == nil || tc.err != nil && !errors.Is(err, tc.err) {
+			t.Errorf("Apply(%v) = %v, want %v", tc.limits, err, tc.err)
+		}
+	}
+	if limit := api.MaxRunning(); limit != 10 {
+		t.Fatalf("limit = %d after invalid updates, want 10", limit)
+	}
+
+	if err := c.Apply(Limits{"api": 20, "uploads": 4}); err != nil {
+		t.Fatal(err)
+	}
+	if limit := api.MaxRunning(); limit != 20 {
+		t.Fatalf("limit = %d, want 20", limit)
+	}
+	if len(changes) != 1 || changes[0] != "api" {
+		t.Fatalf("changes = %v, want only api to be changed", changes)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	reg := middleware.NewRegistry()
+	api := maxconnections.NewLimiter(10, 0)
+	reg.Register("api", api)
+
+	updated := make(chan struct{})
+	c := New(reg, SourceFunc(func(ctx context.Context) (Limits, error) {
+		return Limits{"api": 5}, nil
+	}))
+	c.OnChange = func(name string, old, new int) {
+		close(updated)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Poll(ctx)
+
+	select {
+	case <-updated:
+	case <-time.After(time.Second):
+		t.Fatal("the limit is not updated")
+	}
+	if limit := api.MaxRunning(); limit != 5 {
+		t.Fatalf("limit = %d, want 5", limit)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	reg := middleware.NewRegistry()
+	reg.Register("api", maxconnections.NewLimiter(10, 0))
+	h := New(reg, nil).Handler()
+
+	for _, tc := range []struct {
+		method, body string
+		status       int
+		response     string
+	}{
+		{"GET", "", http.StatusOK, `{"api":10}`},
+		{"PUT", `{"api": 12}`, http.StatusOK, `{"api":12}`},
+		{"PUT", `{"db": 12}`, http.StatusNotFound, ""},
+		{"PUT", `{"api": -1}`, http.StatusUnprocessableEntity, ""},
+		{"PUT", `{"api": "many"}`, http.StatusBadRequest, ""},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tc.method, "/limits", strings.NewReader(tc.body)))
+		if rec.Code != tc.status {
+			t.Errorf("%s %s: status = %d, want %d", tc.method, tc.body, rec.Code, tc.status)
+		}
+		if body := strings.TrimSpace(rec.Body.String()); tc.response != "" && body != tc.response {
+			t.Errorf("%s %s: body = %s, want %s", tc.method, tc.body, body, tc.response)
+		}
+	}
+}
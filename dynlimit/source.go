@@ -0,0 +1,74 @@
+package dynlimit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// Limits are the limits of components by their names in a registry.
+type Limits map[string]int
+
+// Source provides the desired limits.
+type Source interface {
+	Limits(ctx context.Context) (Limits, error)
+}
+
+// SourceFunc is an adapter that allows to use an ordinary function as a
+// Source, e.g. a callback that reads limits from a control plane.
+type SourceFunc func(ctx context.Context) (Limits, error)
+
+// Limits calls f(ctx).
+func (f SourceFunc) Limits(ctx context.Context) (Limits, error) {
+	return f(ctx)
+}
+
+// parseLimits decodes a JSON object like {"api": 100}.
+func parseLimits(r io.Reader) (Limits, error) {
+	dec := json.NewDecoder(r)
+	var l Limits
+	if err := dec.Decode(&l); err != nil {
+		return nil, fmt.Errorf("dynlimit: %v", err)
+	}
+	return l, nil
+}
+
+// FileSource returns a Source that reads limits from a JSON file like
+// {"api": 100}, e.g. a mounted Kubernetes ConfigMap. The file is read on
+// every call, so it picks up changes of the mount.
+func FileSource(path string) Source {
+	return SourceFunc(func(ctx context.Context) (Limits, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return parseLimits(bytes.NewReader(data))
+	})
+}
+
+// HTTPSource returns a Source that fetches limits as a JSON object like
+// {"api": 100} from url. If client is nil, http.DefaultClient is used.
+func HTTPSource(client *http.Client, url string) Source {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return SourceFunc(func(ctx context.Context) (Limits, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("dynlimit: %s: unexpected status %s", url, resp.Status)
+		}
+		return parseLimits(resp.Body)
+	})
+}
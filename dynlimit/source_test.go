@@ -0,0 +1,54 @@
+package dynlimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.json")
+	if err := os.WriteFile(path, []byte(`{"api": 100}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	limits, err := FileSource(path).Limits(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 1 || limits["api"] != 100 {
+		t.Fatalf("limits = %v", limits)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"api": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FileSource(path).Limits(context.Background()); err == nil {
+		t.Fatal("a truncated file: got nil error")
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/limits" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"api": 50}`))
+	}))
+	defer srv.Close()
+
+	limits, err := HTTPSource(nil, srv.URL+"/limits").Limits(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits["api"] != 50 {
+		t.Fatalf("limits = %v", limits)
+	}
+
+	if _, err := HTTPSource(srv.Client(), srv.URL+"/missing").Limits(context.Background()); err == nil {
+		t.Fatal("404: got nil error")
+	}
+}
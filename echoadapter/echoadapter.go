@@ -0,0 +1,88 @@
+// Package echoadapter converts the middlewares of this repository into echo
+// middlewares:
+//
+//	e := echo.New()
+//	e.Use(echoadapter.Wrap(middleware.Wrap(recovery.New)))
+//	e.POST("/upload/:bucket", upload, echoadapter.Wrap(func(h http.Handler) http.Handler {
+//		k := maxconnections.NewKeyed(2, 10, 1000, h)
+//		k.Key = echoadapter.RoutePattern
+//		return k
+//	}))
+//
+// The request and the response writer that the middleware passes to its
+// handler are installed into the echo.Context for the rest of the chain, and
+// the original ones are restored afterwards. The error of the chain is
+// returned by the middleware, so that it reaches the HTTPErrorHandler of
+// echo.
+//
+// echo.Context is not safe for concurrent use, so middlewares that keep
+// running the handler after they have returned, like timeout, must not write
+// to the response when the handler is still running.
+package echoadapter
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/dmage/middleware"
+)
+
+type contextKey struct{}
+
+// Wrap converts a middleware into an echo.MiddlewareFunc.
+func Wrap(c middleware.Constructor) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ec echo.Context) error {
+			var err error
+			h := c(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				resp, req := ec.Response(), ec.Request()
+				defer func() {
+					ec.SetResponse(resp)
+					ec.SetRequest(req)
+				}()
+				if w != http.ResponseWriter(resp) {
+					// The writer of the middleware writes to resp,
+					// so the handler gets a new echo.Response on
+					// top of it.
+					ec.SetResponse(echo.NewResponse(w, ec.Echo()))
+				}
+				ec.SetRequest(r)
+				err = next(ec)
+			}))
+			req := ec.Request()
+			h.ServeHTTP(ec.Response(), req.WithContext(context.WithValue(req.Context(), contextKey{}, ec)))
+			return err
+		}
+	}
+}
+
+// Stack converts a Stack into echo middlewares, so it can be passed to
+// echo.Echo.Use as Use(echoadapter.Stack(s)...).
+func Stack(s middleware.Stack) []echo.MiddlewareFunc {
+	res := make([]echo.MiddlewareFunc, len(s))
+	for i, c := range s {
+		res[i] = Wrap(c)
+	}
+	return res
+}
+
+// Context returns the echo.Context of a request that is passed to a
+// middleware by Wrap.
+func Context(r *http.Request) (echo.Context, bool) {
+	ec, ok := r.Context().Value(contextKey{}).(echo.Context)
+	return ec, ok
+}
+
+// RoutePattern returns the method and the route pattern that echo has
+// matched, e.g. "POST /upload/:bucket". It can be used as a key of keyed and
+// per-route limits, and as httpmetrics Route. It returns an empty string for
+// requests that are not passed by Wrap or that don't match a route.
+func RoutePattern(r *http.Request) string {
+	ec, ok := Context(r)
+	if !ok || ec.Path() == "" {
+		return ""
+	}
+	return r.Method + " " + ec.Path()
+}
@@ -0,0 +1,82 @@
+package echoadapter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/dmage/middleware"
+	"github.com/dmage/middleware/maxconnections"
+)
+
+type ctxKey struct{}
+
+func TestWrap(t *testing.T) {
+	var pattern string
+	var value interface{}
+	e := echo.New()
+	e.Use(Stack(middleware.Chain(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pattern = RoutePattern(r)
+			w.Header().Set("X-Wrapped", "1")
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, "value")))
+		})
+	}))...)
+	e.GET("/users/:id", func(ec echo.Context) error {
+		value = ec.Request().Context().Value(ctxKey{})
+		return ec.String(http.StatusCreated, "ok")
+	})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/users/1", nil))
+	if rec.Code != http.StatusCreated || rec.Body.String() != "ok" || rec.Header().Get("X-Wrapped") != "1" {
+		t.Fatalf("response = %d %q %v", rec.Code, rec.Body, rec.Header())
+	}
+	if pattern != "GET /users/:id" {
+		t.Errorf("RoutePattern() = %q, want %q", pattern, "GET /users/:id")
+	}
+	if value != "value" {
+		t.Errorf("the handler doesn't see the context of the middleware")
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	e := echo.New()
+	e.Use(Wrap(middleware.Wrap(func(h http.Handler) *maxconnections.Middleware {
+		return maxconnections.New(1, 0, h)
+	})))
+	e.GET("/", func(ec echo.Context) error {
+		return echo.NewHTTPError(http.StatusTeapot, errors.New("teapot"))
+	})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusTeapot {
+		t.Fatalf("status = %d, want the error of the handler to reach echo", rec.Code)
+	}
+}
+
+func TestWrapReject(t *testing.T) {
+	called := false
+	e := echo.New()
+	e.Use(Wrap(func(h http.Handler) http.Handler {
+		return maxconnections.New(0, 0, h)
+	}))
+	e.GET("/", func(ec echo.Context) error {
+		called = true
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the request to be rejected", rec.Code)
+	}
+	if called {
+		t.Fatal("the handler is called for a rejected request")
+	}
+}
@@ -0,0 +1,278 @@
+// Package egresslimit paces outbound requests per tenant, so that one tenant
+// cannot exhaust a shared quota of a third-party API.
+package egresslimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+// ErrRateLimited is returned when a request would have to wait longer than
+// MaxWait or than its context deadline allows.
+var ErrRateLimited = errors.New("egresslimit: rate limit exceeded")
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of ctx that carries the tenant name.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant name from ctx, or an empty string.
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+func defaultKey(r *http.Request) string {
+	return TenantFromContext(r.Context())
+}
+
+// bucket is a token bucket. The number of tokens can go negative, that
+// means that requests have reserved future tokens.
+type bucket struct {
+	tokens float64
+	last   time.Time
+
+	// rate is the current rate. It may be lower than the configured one
+	// if the upstream asked us to slow down.
+	rate float64
+
+	// blockedUntil is the time before which no requests should be sent.
+	blockedUntil time.Time
+}
+
+// Transport implements the http.RoundTripper interface.
+type Transport struct {
+	next  http.RoundTripper
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	inserts int
+
+	// Key returns the key of the request. By default it is the tenant from
+	// the request context, see WithTenant.
+	Key func(r *http.Request) string
+
+	// MaxWait, if positive, is the maximum time a request can wait for its
+	// turn. Requests that would wait longer fail with ErrRateLimited.
+	MaxWait time.Duration
+
+	// ShedWaiting makes Sheddable requests (see maxconnections.WithCriticality)
+	// fail with ErrRateLimited instead of waiting for their turn, so that
+	// they don't delay more critical requests of the same key.
+	ShedWaiting bool
+
+	// PropagationHeaders makes RoundTrip set the criticality and the
+	// remaining deadline of outbound requests, see
+	// maxconnections.SetPropagationHeaders.
+	PropagationHeaders bool
+
+	// IgnoreHeaders disables adjusting the pace using RateLimit-Remaining,
+	// RateLimit-Reset and Retry-After headers of upstream responses.
+	IgnoreHeaders bool
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// New returns a Transport that sends up to rate requests per second for each
+// key through next, with bursts of up to burst requests. If next is nil,
+// http.DefaultTransport is used.
+func New(rate float64, burst int, next http.RoundTripper) *Transport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Transport{
+		next:    next,
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		Key:     defaultKey,
+		now:     time.Now,
+	}
+}
+
+// cleanupInterval is the number of new keys after which idle buckets are
+// removed.
+const cleanupInterval = 1024
+
+// getBucket returns the bucket for key. It should be called with mu held.
+func (t *Transport) getBucket(key string, now time.Time) *bucket {
+	b := t.buckets[key]
+	if b == nil {
+		if t.inserts++; t.inserts%cleanupInterval == 0 {
+			for k, b := range t.buckets {
+				t.refill(b, now)
+				if b.tokens >= t.burst && !now.Before(b.blockedUntil) {
+					delete(t.buckets, k)
+				}
+			}
+		}
+		b = &bucket{tokens: t.burst, last: now, rate: t.rate}
+		t.buckets[key] = b
+	}
+	return b
+}
+
+// refill adds tokens accumulated since the last update. It should be called
+// with mu held.
+func (t *Transport) refill(b *bucket, now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > t.burst {
+			b.tokens = t.burst
+		}
+		b.last = now
+	}
+}
+
+// reserve takes a token for a request of key and returns how long the
+// request should wait before it is sent. If the wait exceeds MaxWait, no
+// token is taken and ok is false.
+func (t *Transport) reserve(key string) (wait time.Duration, ok bool) {
+	return t.reserveWithin(key, t.maxWait(context.Background()))
+}
+
+// reserveWithin is like reserve, but limits the wait to maxWait instead of
+// MaxWait. A negative maxWait means no limit.
+func (t *Transport) reserveWithin(key string, maxWait time.Duration) (wait time.Duration, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	b := t.getBucket(key, now)
+	t.refill(b, now)
+
+	if b.tokens < 1 && b.rate > 0 {
+		wait = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+	if blocked := b.blockedUntil.Sub(now); blocked > wait {
+		wait = blocked
+	}
+	if maxWait >= 0 && wait > maxWait {
+		return 0, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+// cancel returns a token that was reserved for a request that has not been
+// sent.
+func (t *Transport) cancel(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if b := t.buckets[key]; b != nil {
+		b.tokens++
+	}
+}
+
+// adjust updates the pace of key according to the upstream response headers.
+func (t *Transport) adjust(key string, res *http.Response) {
+	h := res.Header
+	get := func(name string) (int, bool) {
+		v := h.Get(name)
+		if v == "" {
+			v = h.Get("X-" + name)
+		}
+		n, err := strconv.Atoi(v)
+		return n, err == nil && n >= 0
+	}
+	remaining, hasRemaining := get("RateLimit-Remaining")
+	reset, hasReset := get("RateLimit-Reset")
+	retryAfter, retryAfterErr := strconv.Atoi(h.Get("Retry-After"))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	b := t.getBucket(key, now)
+
+	if (res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable) && retryAfterErr == nil && retryAfter >= 0 {
+		b.blockedUntil = now.Add(time.Duration(retryAfter) * time.Second)
+	}
+	if !hasRemaining || !hasReset {
+		return
+	}
+	t.refill(b, now)
+	switch {
+	case remaining == 0:
+		b.blockedUntil = now.Add(time.Duration(reset) * time.Second)
+		b.tokens = 0
+		b.rate = t.rate
+	case reset > 0:
+		// Spread the remaining quota over the rest of the window.
+		b.rate = float64(remaining) / float64(reset)
+		if b.rate > t.rate {
+			b.rate = t.rate
+		}
+	default:
+		b.rate = t.rate
+	}
+}
+
+// maxWait returns how long a request with ctx can wait for its turn, or a
+// negative value if there is no limit. A request cannot wait past its
+// context deadline.
+func (t *Transport) maxWait(ctx context.Context) time.Duration {
+	if t.ShedWaiting && maxconnections.CriticalityFromContext(ctx) == maxconnections.Sheddable {
+		return 0
+	}
+	maxWait := time.Duration(-1)
+	if t.MaxWait > 0 {
+		maxWait = t.MaxWait
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := deadline.Sub(t.now())
+		if remaining < 0 {
+			remaining = 0
+		}
+		if maxWait < 0 || remaining < maxWait {
+			maxWait = remaining
+		}
+	}
+	return maxWait
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := t.Key(req)
+	wait, ok := t.reserveWithin(key, t.maxWait(req.Context()))
+	if !ok {
+		return nil, ErrRateLimited
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			t.cancel(key)
+			return nil, req.Context().Err()
+		}
+	}
+	if t.PropagationHeaders {
+		// RoundTrip must not modify the request.
+		req = req.Clone(req.Context())
+		maxconnections.SetPropagationHeaders(req.Context(), req.Header, maxconnections.CriticalityFromContext(req.Context()))
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if !t.IgnoreHeaders {
+		t.adjust(key, res)
+	}
+	return res, nil
+}
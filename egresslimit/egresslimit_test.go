@@ -0,0 +1,164 @@
+package egresslimit
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestReserve(t *testing.T) {
+	tr := New(10, 2, nil)
+	now := time.Unix(0, 0)
+	tr.now = func() time.Time {
+		return now
+	}
+
+	testCases := []struct {
+		key  string
+		wait time.Duration
+	}{
+		{"a", 0},
+		{"a", 0},
+		{"a", 100 * time.Millisecond},
+		{"a", 200 * time.Millisecond},
+		{"b", 0}, // tenants are independent
+	}
+	for i, tc := range testCases {
+		wait, ok := tr.reserve(tc.key)
+		if !ok || wait != tc.wait {
+			t.Errorf("request %d: reserve(%q) = %s, %v; want %s, true", i, tc.key, wait, ok, tc.wait)
+		}
+	}
+
+	tr.MaxWait = 250 * time.Millisecond
+	if _, ok := tr.reserve("a"); ok {
+		t.Errorf("reserve() = true for a request that would wait longer than MaxWait")
+	}
+
+	now = now.Add(time.Second)
+	if wait, ok := tr.reserve("a"); !ok || wait != 0 {
+		t.Errorf("reserve() = %s, %v after the bucket is refilled; want 0, true", wait, ok)
+	}
+}
+
+func TestAdjust(t *testing.T) {
+	tr := New(10, 1, nil)
+	now := time.Unix(0, 0)
+	tr.now = func() time.Time {
+		return now
+	}
+
+	respond := func(statusCode int, header http.Header) {
+		tr.adjust("a", &http.Response{StatusCode: statusCode, Header: header})
+	}
+
+	// 5 requests remaining for 10 seconds is a pace of 0.5 rps.
+	respond(http.StatusOK, http.Header{"Ratelimit-Remaining": {"5"}, "Ratelimit-Reset": {"10"}})
+	tr.reserve("a")
+	if wait, _ := tr.reserve("a"); wait != 2*time.Second {
+		t.Errorf("wait = %s, want %s", wait, 2*time.Second)
+	}
+
+	// The quota is exhausted.
+	respond(http.StatusOK, http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {"30"}})
+	if wait, _ := tr.reserve("a"); wait != 30*time.Second {
+		t.Errorf("wait = %s, want %s", wait, 30*time.Second)
+	}
+
+	respond(http.StatusTooManyRequests, http.Header{"Retry-After": {"60"}})
+	if wait, _ := tr.reserve("a"); wait != time.Minute {
+		t.Errorf("wait = %s, want %s", wait, time.Minute)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	var keys []string
+	tr := New(1000, 1, roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		keys = append(keys, TenantFromContext(req.Context()))
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	}))
+
+	for _, tenant := range []string{"acme", "acme", "globex"} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req = req.WithContext(WithTenant(req.Context(), tenant))
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip() = %v, want nil", err)
+		}
+		res.Body.Close()
+	}
+	if expected := "acme acme globex"; strings.Join(keys, " ") != expected {
+		t.Fatalf("keys = %q, want %q", keys, expected)
+	}
+
+	// A waiting request is canceled with its context.
+	tr.adjust("acme", &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"60"}}})
+	ctx, cancel := context.WithCancel(WithTenant(context.Background(), "acme"))
+	time.AfterFunc(time.Millisecond, cancel)
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if _, err := tr.RoundTrip(req.WithContext(ctx)); err != context.Canceled {
+		t.Fatalf("RoundTrip() = %v, want %v", err, context.Canceled)
+	}
+
+	// A request that cannot get its turn before its deadline fails right
+	// away.
+	ctx, cancel = context.WithTimeout(WithTenant(context.Background(), "acme"), 30*time.Second)
+	defer cancel()
+	if _, err := tr.RoundTrip(req.WithContext(ctx)); err != ErrRateLimited {
+		t.Fatalf("RoundTrip() = %v, want %v", err, ErrRateLimited)
+	}
+}
+
+func TestPriorityInheritance(t *testing.T) {
+	var header http.Header
+	tr := New(1, 1, roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		header = req.Header
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	}))
+	tr.ShedWaiting = true
+	tr.PropagationHeaders = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	ctx = maxconnections.WithCriticality(ctx, maxconnections.Sheddable)
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req = req.WithContext(ctx)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() = %v, want nil", err)
+	}
+	res.Body.Close()
+	if c := header.Get(maxconnections.CriticalityHeader); c != "sheddable" {
+		t.Errorf("%s = %q, want %q", maxconnections.CriticalityHeader, c, "sheddable")
+	}
+	if d, err := time.ParseDuration(header.Get(maxconnections.TimeoutHeader)); err != nil || d <= 59*time.Minute || d > time.Hour {
+		t.Errorf("%s = %q, want about 1h", maxconnections.TimeoutHeader, header.Get(maxconnections.TimeoutHeader))
+	}
+	if len(req.Header) != 0 {
+		t.Errorf("the original request has been modified: %v", req.Header)
+	}
+
+	// The bucket is empty, a sheddable request doesn't wait for a token.
+	if _, err := tr.RoundTrip(req); err != ErrRateLimited {
+		t.Fatalf("RoundTrip() = %v, want %v", err, ErrRateLimited)
+	}
+}
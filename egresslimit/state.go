@@ -0,0 +1,60 @@
+package egresslimit
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// bucketState is the serialized form of a bucket.
+type bucketState struct {
+	Tokens       float64   `json:"tokens"`
+	Last         time.Time `json:"last"`
+	Rate         float64   `json:"rate"`
+	BlockedUntil time.Time `json:"blockedUntil,omitempty"`
+}
+
+// MarshalState returns the state of the buckets, so that it can be handed
+// over to another process, see package handoff.
+func (t *Transport) MarshalState() ([]byte, error) {
+	t.mu.Lock()
+	state := make(map[string]bucketState, len(t.buckets))
+	for key, b := range t.buckets {
+		state[key] = bucketState{
+			Tokens:       b.tokens,
+			Last:         b.last,
+			Rate:         b.rate,
+			BlockedUntil: b.blockedUntil,
+		}
+	}
+	t.mu.Unlock()
+	return json.Marshal(state)
+}
+
+// UnmarshalState replaces the buckets with the state returned by
+// MarshalState. Values that exceed the current configuration are clamped to
+// it.
+func (t *Transport) UnmarshalState(data []byte) error {
+	var state map[string]bucketState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, s := range state {
+		b := &bucket{
+			tokens:       s.Tokens,
+			last:         s.Last,
+			rate:         s.Rate,
+			blockedUntil: s.BlockedUntil,
+		}
+		if b.tokens > t.burst {
+			b.tokens = t.burst
+		}
+		if b.rate <= 0 || b.rate > t.rate {
+			b.rate = t.rate
+		}
+		t.buckets[key] = b
+	}
+	return nil
+}
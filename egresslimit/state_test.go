@@ -0,0 +1,37 @@
+package egresslimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestState(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock := func() time.Time {
+		return now
+	}
+
+	old := New(10, 2, nil)
+	old.now = clock
+	old.reserve("a")
+	old.reserve("a")
+
+	data, err := old.MarshalState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new process allows a bigger burst, but the bucket of "a" has
+	// been emptied by the old one.
+	tr := New(10, 5, nil)
+	tr.now = clock
+	if err := tr.UnmarshalState(data); err != nil {
+		t.Fatal(err)
+	}
+	if wait, ok := tr.reserve("a"); !ok || wait != 100*time.Millisecond {
+		t.Fatalf("reserve(a) = %s, %v; want 100ms, true", wait, ok)
+	}
+	if wait, ok := tr.reserve("b"); !ok || wait != 0 {
+		t.Fatalf("reserve(b) = %s, %v; want 0s, true", wait, ok)
+	}
+}
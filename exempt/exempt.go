@@ -0,0 +1,126 @@
+// Package exempt provides declarative rules that exempt requests from
+// limits. A Rule can be used as the Skip function of maxconnections and
+// ratelimit middlewares:
+//
+//	m := maxconnections.New(100, 100, h)
+//	m.Skip = exempt.Any(
+//		exempt.Methods("OPTIONS", "HEAD"),
+//		exempt.SignedHeader("X-Internal-Bypass", time.Minute, secret),
+//	)
+package exempt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rule reports whether the request is exempt.
+type Rule func(r *http.Request) bool
+
+// Any returns a rule that exempts requests exempted by any of rules.
+func Any(rules ...Rule) Rule {
+	return func(r *http.Request) bool {
+		for _, rule := range rules {
+			if rule(r) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Methods returns a rule that exempts requests with one of the given
+// methods, e.g. OPTIONS preflights and HEAD requests.
+func Methods(methods ...string) Rule {
+	set := make(map[string]bool, len(methods))
+	for _, m := range methods {
+		set[strings.ToUpper(m)] = true
+	}
+	return func(r *http.Request) bool {
+		return set[r.Method]
+	}
+}
+
+// Paths returns a rule that exempts requests with one of the given paths,
+// e.g. "/healthz".
+func Paths(paths ...string) Rule {
+	set := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		set[p] = true
+	}
+	return func(r *http.Request) bool {
+		return set[r.URL.Path]
+	}
+}
+
+// Header returns a rule that exempts requests whose header name has the
+// given value. The header should be removed from untrusted requests before
+// they reach the middleware, see SignedHeader for a header that can't be
+// forged.
+func Header(name, value string) Rule {
+	return func(r *http.Request) bool {
+		return r.Header.Get(name) == value
+	}
+}
+
+// mac returns the signature of the timestamp ts.
+func mac(secret []byte, ts string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(ts))
+	return h.Sum(nil)
+}
+
+// Sign returns a value for the header of SignedHeader that is valid from t
+// for the maxAge of the rule.
+func Sign(secret []byte, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return ts + "." + hex.EncodeToString(mac(secret, ts))
+}
+
+// SignedHeader returns a rule that exempts requests with a valid signature
+// in the header name, e.g. calls of internal services that must not be
+// limited. The value is "<unix time>.<hex HMAC-SHA256 of the time>", see
+// Sign. It is valid for maxAge after the time, and for a minute before it
+// to allow for clock skew. The signature may be made with any of secrets, so
+// that secrets can be rotated. Within maxAge a value can be replayed, so it
+// should be sent only over trusted connections.
+func SignedHeader(name string, maxAge time.Duration, secrets ...[]byte) Rule {
+	return signedHeader(name, maxAge, secrets, time.Now)
+}
+
+func signedHeader(name string, maxAge time.Duration, secrets [][]byte, now func() time.Time) Rule {
+	return func(r *http.Request) bool {
+		v := r.Header.Get(name)
+		if v == "" {
+			return false
+		}
+		i := strings.IndexByte(v, '.')
+		if i < 0 {
+			return false
+		}
+		ts, sig := v[:i], v[i+1:]
+		unix, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return false
+		}
+		age := now().Sub(time.Unix(unix, 0))
+		if age > maxAge || age < -time.Minute {
+			return false
+		}
+		got, err := hex.DecodeString(sig)
+		if err != nil {
+			return false
+		}
+		for _, secret := range secrets {
+			if hmac.Equal(got, mac(secret, ts)) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,73 @@
+package exempt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRules(t *testing.T) {
+	rule := Any(Methods("options", "HEAD"), Paths("/healthz"), Header("X-Debug", "1"))
+	testCases := []struct {
+		method, path, debug string
+		expected            bool
+	}{
+		{"GET", "/", "", false},
+		{"OPTIONS", "/", "", true},
+		{"HEAD", "/", "", true},
+		{"GET", "/healthz", "", true},
+		{"POST", "/", "1", true},
+		{"POST", "/", "0", false},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.debug != "" {
+			r.Header.Set("X-Debug", tc.debug)
+		}
+		if got := rule(r); got != tc.expected {
+			t.Errorf("%s %s (X-Debug: %q): exempt = %v, want %v", tc.method, tc.path, tc.debug, got, tc.expected)
+		}
+	}
+}
+
+func TestSignedHeader(t *testing.T) {
+	now := time.Unix(1000, 0)
+	oldSecret, secret := []byte("old"), []byte("new")
+	rule := signedHeader("X-Bypass", time.Minute, [][]byte{secret, oldSecret}, func() time.Time {
+		return now
+	})
+
+	testCases := []struct {
+		name     string
+		value    string
+		expected bool
+	}{
+		{"missing", "", false},
+		{"valid", Sign(secret, now), true},
+		{"old secret", Sign(oldSecret, now.Add(-30*time.Second)), true},
+		{"expired", Sign(secret, now.Add(-2*time.Minute)), false},
+		{"from the future", Sign(secret, now.Add(2*time.Minute)), false},
+		{"clock skew", Sign(secret, now.Add(30*time.Second)), true},
+		{"unknown secret", Sign([]byte("forged"), now), false},
+		{"tampered time", "1001" + Sign(secret, now)[4:], false},
+		{"malformed", "1000", false},
+		{"bad signature", "1000.zz", false},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tc.value != "" {
+			r.Header.Set("X-Bypass", tc.value)
+		}
+		if got := rule(r); got != tc.expected {
+			t.Errorf("%s: exempt = %v, want %v", tc.name, got, tc.expected)
+		}
+	}
+}
+
+func TestSkip(t *testing.T) {
+	var skip func(r *http.Request) bool = Methods("OPTIONS")
+	if !skip(httptest.NewRequest("OPTIONS", "/", nil)) {
+		t.Fatal("a Rule doesn't work as a Skip function")
+	}
+}
@@ -0,0 +1,127 @@
+// Package fingerprint computes stable fingerprints of requests. A fingerprint
+// covers the method, the normalized URL, the hash of the body and the
+// identity of the client, so a retry of a request has the same fingerprint
+// as the original one. Middlewares that need to recognize the same request,
+// e.g. to deduplicate or to coalesce requests, should take it from the
+// request context, so that they agree on what the same request is.
+package fingerprint
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/dmage/middleware/cache"
+)
+
+const defaultMaxBodySize = 1 << 20
+
+type fingerprintKey struct{}
+
+// NewContext returns a copy of ctx that carries the fingerprint fp.
+func NewContext(ctx context.Context, fp string) context.Context {
+	return context.WithValue(ctx, fingerprintKey{}, fp)
+}
+
+// FromContext returns the fingerprint from ctx, or an empty string if the
+// request has no fingerprint, e.g. because its body is too large.
+func FromContext(ctx context.Context) string {
+	fp, _ := ctx.Value(fingerprintKey{}).(string)
+	return fp
+}
+
+// AuthorizationIdentity returns the Authorization header of r. It is the
+// default identity of Fingerprinter.
+func AuthorizationIdentity(r *http.Request) string {
+	return r.Header.Get("Authorization")
+}
+
+// Fingerprinter computes fingerprints of requests.
+type Fingerprinter struct {
+	// Key selects the parts of the URL and the headers that are part of
+	// the fingerprint, see cache.KeyBuilder. The zero value uses the
+	// method, the host, the path and all query parameters.
+	Key cache.KeyBuilder
+
+	// Identity returns the identity of the client, e.g. the user ID, so
+	// that the same requests of different clients have different
+	// fingerprints. By default it is AuthorizationIdentity.
+	Identity func(r *http.Request) string
+
+	// MaxBodySize is the maximum size of the body that is hashed. Requests
+	// with larger bodies have no fingerprint. By default it is 1 MiB.
+	MaxBodySize int64
+}
+
+// Fingerprint returns the fingerprint of r. The body of r is read and
+// replaced with a reader of the same content. If the body is larger than
+// MaxBodySize, it returns false.
+func (f *Fingerprinter) Fingerprint(r *http.Request) (string, bool, error) {
+	maxBodySize := f.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = defaultMaxBodySize
+	}
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+		if err != nil {
+			return "", false, err
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		if int64(len(body)) > maxBodySize {
+			return "", false, nil
+		}
+	}
+
+	identity := f.Identity
+	if identity == nil {
+		identity = AuthorizationIdentity
+	}
+	bodyHash := sha256.Sum256(body)
+
+	h := sha256.New()
+	io.WriteString(h, f.Key.Key(r))
+	h.Write([]byte{0})
+	io.WriteString(h, identity(r))
+	h.Write([]byte{0})
+	h.Write(bodyHash[:])
+	return hex.EncodeToString(h.Sum(nil)), true, nil
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	Fingerprinter
+	handler http.Handler
+}
+
+// New returns an http.Handler that passes requests to h with their
+// fingerprints in the context, see FromContext.
+func New(h http.Handler) *Middleware {
+	return &Middleware{
+		Fingerprinter: Fingerprinter{
+			Identity:    AuthorizationIdentity,
+			MaxBodySize: defaultMaxBodySize,
+		},
+		handler: h,
+	}
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fp, ok, err := m.Fingerprint(r)
+	if err != nil {
+		http.Error(w, "400 failed to read the request body", http.StatusBadRequest)
+		return
+	}
+	if ok {
+		r = r.WithContext(NewContext(r.Context(), fp))
+	}
+	m.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,84 @@
+package fingerprint
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	newRequest := func(method, target, auth, body string) *http.Request {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		return r
+	}
+
+	testCases := []struct {
+		name string
+		a, b *http.Request
+		same bool
+	}{
+		{
+			name: "query order",
+			a:    newRequest("POST", "http://example.com/orders?a=1&b=2", "u1", "{}"),
+			b:    newRequest("POST", "http://example.com/orders?b=2&a=1", "u1", "{}"),
+			same: true,
+		},
+		{
+			name: "method",
+			a:    newRequest("POST", "http://example.com/orders", "u1", ""),
+			b:    newRequest("PUT", "http://example.com/orders", "u1", ""),
+			same: false,
+		},
+		{
+			name: "body",
+			a:    newRequest("POST", "http://example.com/orders", "u1", `{"n":1}`),
+			b:    newRequest("POST", "http://example.com/orders", "u1", `{"n":2}`),
+			same: false,
+		},
+		{
+			name: "identity",
+			a:    newRequest("POST", "http://example.com/orders", "u1", "{}"),
+			b:    newRequest("POST", "http://example.com/orders", "u2", "{}"),
+			same: false,
+		},
+	}
+	var f Fingerprinter
+	for _, tc := range testCases {
+		a, _, err := f.Fingerprint(tc.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _, err := f.Fingerprint(tc.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (a == b) != tc.same {
+			t.Errorf("%s: fingerprints %s and %s, want same=%v", tc.name, a, b, tc.same)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var fp, body string
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fp = FromContext(r.Context())
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+	}))
+	m.MaxBodySize = 4
+
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader("1234")))
+	if fp == "" || body != "1234" {
+		t.Fatalf("fingerprint %q, body %q; want a fingerprint and the original body", fp, body)
+	}
+
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader("12345")))
+	if fp != "" || body != "12345" {
+		t.Fatalf("fingerprint %q, body %q; want no fingerprint and the original body", fp, body)
+	}
+}
@@ -0,0 +1,133 @@
+// Package ginadapter converts the middlewares of this repository into gin
+// middlewares:
+//
+//	r := gin.New()
+//	r.Use(ginadapter.Wrap(middleware.Wrap(recovery.New)))
+//	r.POST("/upload/:bucket", ginadapter.Wrap(func(h http.Handler) http.Handler {
+//		k := maxconnections.NewKeyed(2, 10, 1000, h)
+//		k.Key = ginadapter.RoutePattern
+//		return k
+//	}), upload)
+//
+// The request and the response writer that the middleware passes to its
+// handler, e.g. with a context that carries a deadline or with a writer that
+// records the status, are installed into the gin.Context for the rest of the
+// chain, and the original ones are restored afterwards. If the middleware
+// doesn't call its handler, e.g. because it rejects the request, the chain is
+// aborted.
+//
+// gin.Context is not safe for concurrent use, so middlewares that keep
+// running the handler after they have returned, like timeout, must not write
+// to the response when the handler is still running.
+package ginadapter
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/dmage/middleware"
+)
+
+type contextKey struct{}
+
+// Wrap converts a middleware into a gin.HandlerFunc.
+func Wrap(c middleware.Constructor) gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		called := false
+		h := c(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			writer, req := gc.Writer, gc.Request
+			defer func() {
+				gc.Writer, gc.Request = writer, req
+			}()
+			if gw, ok := w.(gin.ResponseWriter); !ok || gw != writer {
+				gc.Writer = &responseWriter{ResponseWriter: writer, w: w}
+			}
+			gc.Request = r
+			gc.Next()
+		}))
+		h.ServeHTTP(gc.Writer, gc.Request.WithContext(context.WithValue(gc.Request.Context(), contextKey{}, gc)))
+		if !called {
+			gc.Abort()
+		}
+	}
+}
+
+// Stack converts a Stack into gin middlewares, so it can be passed to
+// gin.Engine.Use as Use(ginadapter.Stack(s)...).
+func Stack(s middleware.Stack) []gin.HandlerFunc {
+	res := make([]gin.HandlerFunc, len(s))
+	for i, c := range s {
+		res[i] = Wrap(c)
+	}
+	return res
+}
+
+// Context returns the gin.Context of a request that is passed to a
+// middleware by Wrap.
+func Context(r *http.Request) (*gin.Context, bool) {
+	gc, ok := r.Context().Value(contextKey{}).(*gin.Context)
+	return gc, ok
+}
+
+// RoutePattern returns the method and the route pattern that gin has
+// matched, e.g. "POST /upload/:bucket". It can be used as a key of keyed and
+// per-route limits, and as httpmetrics Route. It returns an empty string for
+// requests that are not passed by Wrap or that don't match a route.
+func RoutePattern(r *http.Request) string {
+	gc, ok := Context(r)
+	if !ok || gc.FullPath() == "" {
+		return ""
+	}
+	return r.Method + " " + gc.FullPath()
+}
+
+// responseWriter is a gin.ResponseWriter that writes the response through the
+// writer of a middleware. The status and the size are reported by the
+// original writer, which receives the response from the middleware.
+type responseWriter struct {
+	gin.ResponseWriter
+
+	// w is the writer that the middleware has passed to its handler.
+	w http.ResponseWriter
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.w.Header()
+}
+
+func (rw *responseWriter) WriteHeader(statusCode int) {
+	rw.w.WriteHeader(statusCode)
+}
+
+func (rw *responseWriter) WriteHeaderNow() {
+	if !rw.Written() {
+		rw.w.WriteHeader(rw.Status())
+	}
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	return rw.w.Write(p)
+}
+
+func (rw *responseWriter) WriteString(s string) (int, error) {
+	return rw.w.Write([]byte(s))
+}
+
+func (rw *responseWriter) Flush() {
+	http.NewResponseController(rw.w).Flush()
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(rw.w).Hijack()
+}
+
+// Unwrap allows http.ResponseController to reach the writer of the
+// middleware.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.w
+}
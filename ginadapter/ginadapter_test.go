@@ -0,0 +1,68 @@
+package ginadapter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/dmage/middleware"
+	"github.com/dmage/middleware/maxconnections"
+)
+
+type ctxKey struct{}
+
+func TestWrap(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var pattern string
+	var value interface{}
+	r := gin.New()
+	r.Use(Stack(middleware.Chain(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pattern = RoutePattern(r)
+			w.Header().Set("X-Wrapped", "1")
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, "value")))
+		})
+	}))...)
+	r.GET("/users/:id", func(gc *gin.Context) {
+		value = gc.Request.Context().Value(ctxKey{})
+		gc.String(http.StatusCreated, "ok")
+	})
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/users/1", nil))
+	if rec.Code != http.StatusCreated || rec.Body.String() != "ok" || rec.Header().Get("X-Wrapped") != "1" {
+		t.Fatalf("response = %d %q %v", rec.Code, rec.Body, rec.Header())
+	}
+	if pattern != "GET /users/:id" {
+		t.Errorf("RoutePattern() = %q, want %q", pattern, "GET /users/:id")
+	}
+	if value != "value" {
+		t.Errorf("the handler doesn't see the context of the middleware")
+	}
+}
+
+func TestWrapReject(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	called := false
+	r := gin.New()
+	r.Use(Wrap(func(h http.Handler) http.Handler {
+		return maxconnections.New(0, 0, h)
+	}))
+	r.GET("/", func(gc *gin.Context) {
+		called = true
+	})
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the request to be rejected", rec.Code)
+	}
+	if called {
+		t.Fatal("the handler is called for a rejected request")
+	}
+}
@@ -0,0 +1,162 @@
+// Package handoff passes in-memory state, e.g. rate limit buckets, from an
+// old process to a new one during a rolling restart, so that limits are not
+// reset on every deploy.
+//
+// Both processes use the same Unix socket path. The new process calls
+// Takeover: it fetches the state from the old process, if there is one, and
+// starts serving its own state for the next process.
+package handoff
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrNoPeer is returned by Restore when there is no process to take the state
+// from.
+var ErrNoPeer = errors.New("handoff: no process is serving the state")
+
+// Timeout is the maximum duration of a handoff.
+var Timeout = 5 * time.Second
+
+// Stateful is implemented by objects whose state can be handed off.
+type Stateful interface {
+	MarshalState() ([]byte, error)
+	UnmarshalState(data []byte) error
+}
+
+// States maps names to objects. The names should be the same in the old and
+// the new process, states with unknown names are ignored.
+type States map[string]Stateful
+
+// Restore fetches the state from the process that serves it on path and
+// passes it to states.
+func Restore(path string, states States) error {
+	conn, err := net.DialTimeout("unix", path, Timeout)
+	if err != nil {
+		return ErrNoPeer
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(Timeout))
+
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return fmt.Errorf("handoff: %v", err)
+	}
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return fmt.Errorf("handoff: %v", err)
+	}
+	for name, s := range states {
+		if state, ok := msg[name]; ok {
+			if err := s.UnmarshalState(state); err != nil {
+				return fmt.Errorf("handoff: %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Server serves the state to the next process.
+type Server struct {
+	path   string
+	states States
+	ln     *net.UnixListener
+	file   os.FileInfo
+	wg     sync.WaitGroup
+
+	// OnError, if not nil, is called when the state cannot be served.
+	OnError func(err error)
+}
+
+// Listen starts serving states on path. A stale socket of a previous process
+// is replaced.
+func Listen(path string, states States) (*Server, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The path may be taken over by the next process, so it is removed by
+	// Close only if it still belongs to us.
+	ln.SetUnlinkOnClose(false)
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	s := &Server{
+		path:   path,
+		states: states,
+		ln:     ln,
+		file:   fi,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Takeover restores states from the previous process, if there is one, and
+// starts serving them on path.
+func Takeover(path string, states States) (*Server, error) {
+	if err := Restore(path, states); err != nil && err != ErrNoPeer {
+		return nil, err
+	}
+	return Listen(path, states)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		if err := s.handoff(conn); err != nil && s.OnError != nil {
+			s.OnError(err)
+		}
+	}
+}
+
+func (s *Server) handoff(conn net.Conn) error {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(Timeout))
+
+	msg := make(map[string]json.RawMessage, len(s.states))
+	for name, st := range s.states {
+		state, err := st.MarshalState()
+		if err != nil {
+			return fmt.Errorf("handoff: %s: %v", name, err)
+		}
+		msg[name] = state
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("handoff: %v", err)
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+// Close stops serving the state.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.wg.Wait()
+	if fi, statErr := os.Lstat(s.path); statErr == nil && os.SameFile(fi, s.file) {
+		os.Remove(s.path)
+	}
+	return err
+}
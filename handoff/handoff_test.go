@@ -0,0 +1,86 @@
+package handoff
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type value struct {
+	mu   sync.Mutex
+	data string
+}
+
+func (v *value) get() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.data
+}
+
+func (v *value) set(data string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.data = data
+}
+
+func (v *value) MarshalState() ([]byte, error) {
+	return []byte(`"` + v.get() + `"`), nil
+}
+
+func (v *value) UnmarshalState(data []byte) error {
+	v.set(string(data[1 : len(data)-1]))
+	return nil
+}
+
+func TestTakeover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.sock")
+
+	old := &value{data: "warm"}
+	oldServer, err := Takeover(path, States{"buckets": old})
+	if err != nil {
+		t.Fatalf("Takeover() for the first process = %v, want nil", err)
+	}
+	if old.get() != "warm" {
+		t.Fatalf("the first process got state %q, want its own", old.get())
+	}
+
+	next := &value{}
+	nextServer, err := Takeover(path, States{"buckets": next, "unknown": &value{}})
+	if err != nil {
+		t.Fatalf("Takeover() = %v, want nil", err)
+	}
+	defer nextServer.Close()
+	if next.get() != "warm" {
+		t.Fatalf("restored state %q, want %q", next.get(), "warm")
+	}
+
+	// The old process exits, the socket must still serve the new state.
+	oldServer.Close()
+	next.set("warmer")
+	third := &value{}
+	if err := Restore(path, States{"buckets": third}); err != nil {
+		t.Fatalf("Restore() after the old process exited = %v, want nil", err)
+	}
+	if third.get() != "warmer" {
+		t.Fatalf("restored state %q, want %q", third.get(), "warmer")
+	}
+}
+
+func TestRestoreNoPeer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := Restore(filepath.Join(dir, "state.sock"), States{}); err != ErrNoPeer {
+		t.Fatalf("Restore() = %v, want %v", err, ErrNoPeer)
+	}
+}
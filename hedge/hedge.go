@@ -0,0 +1,358 @@
+// Package hedge cuts the tail latency of outbound requests. If a response
+// hasn't arrived after a delay, e.g. the 95th percentile of the latency,
+// Transport sends the same request once more and uses whichever response
+// arrives first, the other attempt is canceled.
+//
+// Only idempotent requests are hedged, as the upstream may process both
+// attempts. A hedge budget caps the extra load: when the upstream slows down
+// as a whole, most requests exceed the delay, and hedging all of them would
+// double the load of an upstream that is already struggling.
+//
+// Transport complements maxconnections.RoundTripper: if it is wrapped by the
+// limiter, a hedged request occupies a single unit of the limiter; if it
+// wraps the limiter, every attempt is accounted.
+package hedge
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDelay      = 100 * time.Millisecond
+	defaultSamples    = 1000
+	defaultMinSamples = 100
+	defaultRatio      = 0.1
+	defaultWindow     = 10 * time.Second
+)
+
+// Stats contains counters collected by Transport.
+type Stats struct {
+	// Requests is the total number of requests that could be hedged.
+	Requests int64 `json:"requests"`
+
+	// Hedges is the total number of hedge requests that have been sent.
+	Hedges int64 `json:"hedges"`
+
+	// HedgeWins is the total number of hedge requests whose responses have
+	// been used.
+	HedgeWins int64 `json:"hedge_wins"`
+
+	// OverBudget is the total number of hedge requests that haven't been
+	// sent because the budget was exhausted.
+	OverBudget int64 `json:"over_budget"`
+
+	// Delay is the current delay before a hedge request.
+	Delay time.Duration `json:"delay"`
+}
+
+// Transport implements the http.RoundTripper interface.
+type Transport struct {
+	next http.RoundTripper
+
+	// mu protects the fields below up to the configuration.
+	mu          sync.Mutex
+	latencies   []time.Duration // a ring of recent latencies
+	pos         int
+	delay       time.Duration // the cached percentile
+	dirty       int           // samples since the percentile was computed
+	windowStart time.Time
+	requests    float64
+	hedges      float64
+	prevReqs    float64
+	prevHedges  float64
+	stats       Stats
+
+	// Delay is how long Transport waits for a response before it sends a
+	// hedge request. If Percentile is set, it is used until enough
+	// latencies are observed. By default it is 100 milliseconds.
+	Delay time.Duration
+
+	// Percentile, if set, makes the delay follow the given percentile of
+	// the latencies of recent requests, e.g. 0.95.
+	Percentile float64
+
+	// Samples is the number of recent latencies the percentile is computed
+	// from. By default it is 1000.
+	Samples int
+
+	// MinSamples is the number of latencies that should be observed before
+	// the percentile replaces Delay. By default it is 100.
+	MinSamples int
+
+	// Ratio is the maximum number of hedge requests per request, e.g. 0.1
+	// lets through one hedge request per ten requests. By default it is
+	// 0.1.
+	Ratio float64
+
+	// MinHedges is the number of hedge requests per Window that are allowed
+	// regardless of Ratio.
+	MinHedges int
+
+	// Window is the period over which the requests are counted for the
+	// budget. By default it is 10 seconds.
+	Window time.Duration
+
+	// Hedgeable, if not nil, reports whether a request may be hedged. By
+	// default requests with idempotent methods are hedged. Requests whose
+	// bodies cannot be replayed are never hedged.
+	Hedgeable func(req *http.Request) bool
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// New returns an http.RoundTripper that sends requests through next and
+// hedges the slow ones. If next is nil, http.DefaultTransport is used.
+func New(next http.RoundTripper) *Transport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &Transport{
+		next:       next,
+		Delay:      defaultDelay,
+		Samples:    defaultSamples,
+		MinSamples: defaultMinSamples,
+		Ratio:      defaultRatio,
+		Window:     defaultWindow,
+		now:        time.Now,
+	}
+}
+
+// Idempotent reports whether the method of req is idempotent, see RFC 9110,
+// Section 9.2.2. Requests with Idempotency-Key are idempotent too.
+func Idempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+func (t *Transport) hedgeable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	if t.Hedgeable != nil {
+		return t.Hedgeable(req)
+	}
+	return Idempotent(req)
+}
+
+// currentDelay returns the delay before a hedge request. It should be called
+// with mu held.
+func (t *Transport) currentDelay() time.Duration {
+	delay := t.Delay
+	if delay <= 0 {
+		delay = defaultDelay
+	}
+	if t.Percentile <= 0 {
+		return delay
+	}
+	minSamples := t.MinSamples
+	if minSamples <= 0 {
+		minSamples = defaultMinSamples
+	}
+	if len(t.latencies) < minSamples {
+		return delay
+	}
+	if t.delay == 0 || t.dirty >= len(t.latencies)/10 {
+		sorted := append([]time.Duration(nil), t.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		i := int(t.Percentile * float64(len(sorted)))
+		if i >= len(sorted) {
+			i = len(sorted) - 1
+		}
+		t.delay = sorted[i]
+		t.dirty = 0
+	}
+	return t.delay
+}
+
+// observe records the latency of a request. It should be called with mu
+// held.
+func (t *Transport) observe(latency time.Duration) {
+	if t.Percentile <= 0 {
+		return
+	}
+	samples := t.Samples
+	if samples <= 0 {
+		samples = defaultSamples
+	}
+	if len(t.latencies) < samples {
+		t.latencies = append(t.latencies, latency)
+	} else {
+		t.latencies[t.pos%len(t.latencies)] = latency
+		t.pos++
+	}
+	t.dirty++
+}
+
+// advance moves the budget window forward to now. It should be called with
+// mu held.
+func (t *Transport) advance(now time.Time) (weight float64) {
+	window := t.Window
+	if window <= 0 {
+		window = defaultWindow
+	}
+	elapsed := now.Sub(t.windowStart)
+	switch {
+	case elapsed >= 2*window:
+		t.prevReqs, t.prevHedges = 0, 0
+		t.requests, t.hedges = 0, 0
+		t.windowStart = now
+		elapsed = 0
+	case elapsed >= window:
+		t.prevReqs, t.prevHedges = t.requests, t.hedges
+		t.requests, t.hedges = 0, 0
+		t.windowStart = t.windowStart.Add(window)
+		elapsed -= window
+	}
+	return 1 - float64(elapsed)/float64(window)
+}
+
+// start counts a hedgeable request and returns the delay before its hedge
+// request.
+func (t *Transport) start() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(t.now())
+	t.requests++
+	t.stats.Requests++
+	return t.currentDelay()
+}
+
+// allowHedge reports whether a hedge request fits into the budget and counts
+// it.
+func (t *Transport) allowHedge() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	weight := t.advance(t.now())
+	requests := t.requests + weight*t.prevReqs
+	hedges := t.hedges + weight*t.prevHedges
+	if hedges+1 > float64(t.MinHedges) && hedges+1 > t.Ratio*requests {
+		t.stats.OverBudget++
+		return false
+	}
+	t.hedges++
+	t.stats.Hedges++
+	return true
+}
+
+// attempt is the outcome of a single round trip.
+type attempt struct {
+	resp  *http.Response
+	err   error
+	hedge bool
+}
+
+// cancelBody cancels the context of the attempt when the response body is
+// closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// send starts an attempt in a separate goroutine. The attempt is canceled
+// by the returned function.
+func (t *Transport) send(req *http.Request, hedge bool, results chan<- attempt) (context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	r := req.WithContext(ctx)
+	if hedge && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		r.Body = body
+	}
+	go func() {
+		resp, err := t.next.RoundTrip(r)
+		results <- attempt{resp: resp, err: err, hedge: hedge}
+	}()
+	return cancel, nil
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.hedgeable(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	start := t.now()
+	delay := t.start()
+	results := make(chan attempt, 2)
+	cancelPrimary, err := t.send(req, false, results)
+	if err != nil {
+		return nil, err
+	}
+	cancelHedge := context.CancelFunc(func() {})
+	pending := 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if !t.allowHedge() {
+				continue
+			}
+			if cancel, err := t.send(req, true, results); err == nil {
+				cancelHedge = cancel
+				pending++
+			}
+		case a := <-results:
+			pending--
+			if a.err != nil && pending > 0 {
+				// The other attempt may still succeed.
+				continue
+			}
+			if a.err != nil {
+				cancelPrimary()
+				cancelHedge()
+				return nil, a.err
+			}
+
+			// The context of the winner lives until its body is closed.
+			cancelWinner, cancelLoser := cancelPrimary, cancelHedge
+			if a.hedge {
+				cancelWinner, cancelLoser = cancelHedge, cancelPrimary
+			}
+			cancelLoser()
+			if pending > 0 {
+				go func() {
+					if loser := <-results; loser.resp != nil {
+						loser.resp.Body.Close()
+					}
+				}()
+			}
+
+			t.mu.Lock()
+			t.observe(t.now().Sub(start))
+			if a.hedge {
+				t.stats.HedgeWins++
+			}
+			t.mu.Unlock()
+
+			a.resp.Body = &cancelBody{ReadCloser: a.resp.Body, cancel: cancelWinner}
+			return a.resp, nil
+		}
+	}
+}
+
+// Stats returns a snapshot of the collected counters.
+func (t *Transport) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := t.stats
+	stats.Delay = t.currentDelay()
+	return stats
+}
@@ -0,0 +1,107 @@
+package hedge
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func response(body string) *http.Response {
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+}
+
+func TestHedge(t *testing.T) {
+	var calls int32
+	canceled := make(chan struct{})
+	tr := New(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// The first attempt hangs until it is canceled.
+			<-req.Context().Done()
+			close(canceled)
+			return nil, req.Context().Err()
+		}
+		body, _ := io.ReadAll(req.Body)
+		return response("hedge " + string(body)), nil
+	}))
+	tr.Delay = 10 * time.Millisecond
+	tr.MinHedges = 1
+
+	req, _ := http.NewRequest("PUT", "http://example.com/", strings.NewReader("body"))
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hedge body" {
+		t.Fatalf("body = %q, want the response of the hedge request", body)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatalf("the losing attempt hasn't been canceled")
+	}
+	if stats := tr.Stats(); stats.Requests != 1 || stats.Hedges != 1 || stats.HedgeWins != 1 {
+		t.Fatalf("stats = %+v, want one request won by its hedge", stats)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	var mu sync.Mutex
+	var calls int
+	tr := New(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		return response("ok"), nil
+	}))
+	tr.Delay = time.Millisecond
+	tr.Ratio = 0
+	tr.MinHedges = 1
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if stats := tr.Stats(); stats.Hedges != 1 || stats.OverBudget != 2 {
+		t.Fatalf("stats = %+v, want 1 hedge and 2 over budget", stats)
+	}
+
+	// Non-idempotent requests are not hedged.
+	req, _ := http.NewRequest("POST", "http://example.com/", strings.NewReader("x"))
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if stats := tr.Stats(); stats.Requests != 3 {
+		t.Fatalf("requests = %d, want the POST request not to be counted", stats.Requests)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	tr := New(nil)
+	tr.Percentile = 0.9
+	tr.MinSamples = 10
+	for i := 1; i <= 10; i++ {
+		tr.observe(time.Duration(i) * time.Millisecond)
+	}
+	if delay := tr.Stats().Delay; delay != 10*time.Millisecond {
+		t.Fatalf("delay = %v, want 10ms", delay)
+	}
+}
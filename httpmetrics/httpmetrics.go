@@ -0,0 +1,247 @@
+// Package httpmetrics records request durations, request and response sizes
+// and the number of requests in flight, labeled by method, route pattern and
+// status class.
+//
+// Metrics are passed to a Recorder, see the prombridge subpackage for
+// Prometheus. Labels use route patterns instead of paths to keep their
+// cardinality bounded. The pattern is taken after the handler returns, when
+// the router has matched the request:
+//
+//   - http.ServeMux sets Request.Pattern, it is used by default;
+//   - other routers can report the pattern with SetRoute, e.g. for chi
+//     chi.RouteContext(r.Context()).RoutePattern() can be returned by the
+//     Route option, and for gorilla/mux a router middleware can call
+//     SetRoute with the template of mux.CurrentRoute(r).
+package httpmetrics
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// UnmatchedRoute is the route label of requests without a route pattern.
+const UnmatchedRoute = "unmatched"
+
+// Labels describe a finished request.
+type Labels struct {
+	// Method is the request method, or "OTHER" for non-standard methods.
+	Method string
+
+	// Route is the route pattern or UnmatchedRoute.
+	Route string
+
+	// StatusClass is the class of the status code like "2xx".
+	StatusClass string
+}
+
+// Recorder receives metrics. Methods are called synchronously and must be
+// safe for concurrent use.
+type Recorder interface {
+	// InFlight adds delta to the number of requests in flight. The route is
+	// not known until the handler returns, so the gauge is labeled by the
+	// method only.
+	InFlight(method string, delta int)
+
+	// Observe records a finished request. requestSize is the number of
+	// bytes of the request body read by the handler.
+	Observe(l Labels, duration time.Duration, requestSize, responseSize int64)
+}
+
+type routeKey struct{}
+
+// routeHolder is shared by copies of the request, so that a route set deep
+// inside the handler is visible to the middleware.
+type routeHolder struct {
+	route string
+}
+
+// SetRoute reports the route pattern of the request with ctx. It is a no-op
+// if the request doesn't pass through Middleware.
+func SetRoute(ctx context.Context, route string) {
+	if h, ok := ctx.Value(routeKey{}).(*routeHolder); ok {
+		h.route = route
+	}
+}
+
+// method returns the method label. Unknown methods are collapsed, so that
+// clients can't create new label values.
+func method(m string) string {
+	switch m {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "CONNECT", "OPTIONS", "TRACE":
+		return m
+	}
+	return "OTHER"
+}
+
+// ServeMuxPattern returns the pattern that http.ServeMux has matched for r.
+func ServeMuxPattern(r *http.Request) string {
+	return r.Pattern
+}
+
+// StatusClass returns the class of status like "2xx".
+func StatusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// body counts bytes read from the request body.
+type body struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// responseWriter records the status code and the size of the response.
+type responseWriter struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	hijacked bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom lets the underlying writer use sendfile, see io.ReaderFrom.
+func (w *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		// Hide ReadFrom of w from io.Copy.
+		n, err = io.Copy(struct{ io.Writer }{w.ResponseWriter}, src)
+	}
+	w.bytes += n
+	return n, err
+}
+
+// FlushError flushes the response, see http.ResponseController.
+func (w *responseWriter) FlushError() error {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *responseWriter) Flush() {
+	w.FlushError()
+}
+
+// Hijack lets the handler take over the connection, see http.Hijacker.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler  http.Handler
+	recorder Recorder
+
+	// Route returns the route pattern of a request after the handler has
+	// returned. A pattern reported with SetRoute takes precedence. By
+	// default it is ServeMuxPattern.
+	Route func(r *http.Request) string
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// New returns an http.Handler that passes requests to h and records their
+// metrics with rec.
+func New(rec Recorder, h http.Handler) *Middleware {
+	return &Middleware{
+		handler:  h,
+		recorder: rec,
+		Route:    ServeMuxPattern,
+		now:      time.Now,
+	}
+}
+
+// route returns the route label of r.
+func (m *Middleware) route(r *http.Request, holder *routeHolder) string {
+	route := holder.route
+	if route == "" && m.Route != nil {
+		route = m.Route(r)
+	}
+	if route == "" {
+		return UnmatchedRoute
+	}
+	return route
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := m.now()
+	holder := &routeHolder{}
+	r = r.WithContext(context.WithValue(r.Context(), routeKey{}, holder))
+	var b *body
+	if r.Body != nil && r.Body != http.NoBody {
+		b = &body{ReadCloser: r.Body}
+		r.Body = b
+	}
+	rw := &responseWriter{ResponseWriter: w}
+
+	method := method(r.Method)
+	m.recorder.InFlight(method, 1)
+	panicked := true
+	defer func() {
+		m.recorder.InFlight(method, -1)
+		status := rw.status
+		switch {
+		case rw.hijacked:
+			status = http.StatusSwitchingProtocols
+		case panicked && status == 0:
+			status = http.StatusInternalServerError
+		case status == 0:
+			status = http.StatusOK
+		}
+		var requestSize int64
+		if b != nil {
+			requestSize = b.n
+		}
+		m.recorder.Observe(Labels{
+			Method:      method,
+			Route:       m.route(r, holder),
+			StatusClass: StatusClass(status),
+		}, m.now().Sub(start), requestSize, rw.bytes)
+	}()
+	m.handler.ServeHTTP(rw, r)
+	panicked = false
+}
@@ -0,0 +1,92 @@
+// ServeMux patterns with methods and wildcards need the current mux.
+//
+//go:debug httpmuxgo121=0
+
+package httpmetrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type observation struct {
+	labels       Labels
+	duration     time.Duration
+	requestSize  int64
+	responseSize int64
+}
+
+type fakeRecorder struct {
+	mu           sync.Mutex
+	inFlight     map[string]int
+	observations []observation
+}
+
+func (f *fakeRecorder) InFlight(method string, delta int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inFlight[method] += delta
+}
+
+func (f *fakeRecorder) Observe(l Labels, duration time.Duration, requestSize, responseSize int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.observations = append(f.observations, observation{l, duration, requestSize, responseSize})
+}
+
+func TestMiddleware(t *testing.T) {
+	rec := &fakeRecorder{inFlight: make(map[string]int)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if n := rec.inFlight["POST"]; n != 1 {
+			t.Errorf("in flight = %d, want 1", n)
+		}
+		data, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(data)
+	})
+	mux.HandleFunc("/custom/", func(w http.ResponseWriter, r *http.Request) {
+		// E.g. a subrouter that knows a more specific pattern.
+		SetRoute(r.Context(), "/custom/{name}")
+		http.Error(w, "failed", http.StatusBadGateway)
+	})
+
+	now := time.Unix(0, 0)
+	m := New(rec, mux)
+	m.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest("POST", "/items/1", strings.NewReader("hello")),
+		httptest.NewRequest("GET", "/custom/x", nil),
+		httptest.NewRequest("PROPFIND", "/unknown", nil),
+	} {
+		m.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	expected := []observation{
+		{Labels{"POST", "POST /items/{id}", "2xx"}, time.Second, 5, 5},
+		{Labels{"GET", "/custom/{name}", "5xx"}, time.Second, 0, 7},
+		{Labels{"OTHER", UnmatchedRoute, "4xx"}, time.Second, 0, 19},
+	}
+	if len(rec.observations) != len(expected) {
+		t.Fatalf("observations = %+v, want %+v", rec.observations, expected)
+	}
+	for i := range expected {
+		if rec.observations[i] != expected[i] {
+			t.Errorf("observation %d = %+v, want %+v", i, rec.observations[i], expected[i])
+		}
+	}
+	for method, n := range rec.inFlight {
+		if n != 0 {
+			t.Errorf("in flight %s = %d after all requests, want 0", method, n)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Package prombridge exposes httpmetrics as Prometheus metrics.
+package prombridge
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/dmage/middleware/httpmetrics"
+)
+
+var labelNames = []string{"method", "route", "status_class"}
+
+// Recorder implements the httpmetrics.Recorder and prometheus.Collector
+// interfaces, so it can be registered as
+//
+//	rec := prombridge.New("myapp")
+//	prometheus.MustRegister(rec)
+//	handler = httpmetrics.New(rec, handler)
+type Recorder struct {
+	inFlight     *prometheus.GaugeVec
+	duration     *prometheus.HistogramVec
+	requestSize  *prometheus.HistogramVec
+	responseSize *prometheus.HistogramVec
+}
+
+var (
+	_ httpmetrics.Recorder = (*Recorder)(nil)
+	_ prometheus.Collector = (*Recorder)(nil)
+)
+
+// New returns a Recorder with metrics in the given namespace.
+func New(namespace string) *Recorder {
+	sizeBuckets := prometheus.ExponentialBuckets(64, 4, 10)
+	return &Recorder{
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "requests_in_flight",
+			Help:      "Number of requests that are being served.",
+		}, []string{"method"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Time spent serving requests.",
+			Buckets:   prometheus.DefBuckets,
+		}, labelNames),
+		requestSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_size_bytes",
+			Help:      "Size of request bodies read by handlers.",
+			Buckets:   sizeBuckets,
+		}, labelNames),
+		responseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "response_size_bytes",
+			Help:      "Size of response bodies.",
+			Buckets:   sizeBuckets,
+		}, labelNames),
+	}
+}
+
+// InFlight implements httpmetrics.Recorder.
+func (r *Recorder) InFlight(method string, delta int) {
+	r.inFlight.WithLabelValues(method).Add(float64(delta))
+}
+
+// Observe implements httpmetrics.Recorder.
+func (r *Recorder) Observe(l httpmetrics.Labels, duration time.Duration, requestSize, responseSize int64) {
+	values := []string{l.Method, l.Route, l.StatusClass}
+	r.duration.WithLabelValues(values...).Observe(duration.Seconds())
+	r.requestSize.WithLabelValues(values...).Observe(float64(requestSize))
+	r.responseSize.WithLabelValues(values...).Observe(float64(responseSize))
+}
+
+// Describe implements prometheus.Collector.
+func (r *Recorder) Describe(ch chan<- *prometheus.Desc) {
+	r.inFlight.Describe(ch)
+	r.duration.Describe(ch)
+	r.requestSize.Describe(ch)
+	r.responseSize.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (r *Recorder) Collect(ch chan<- prometheus.Metric) {
+	r.inFlight.Collect(ch)
+	r.duration.Collect(ch)
+	r.requestSize.Collect(ch)
+	r.responseSize.Collect(ch)
+}
@@ -0,0 +1,366 @@
+// Package idempotency implements the Idempotency-Key pattern for unsafe
+// methods. The first request with a key is passed to the handler and its
+// response is recorded; duplicates that arrive while it is being served wait
+// for it, and later duplicates get the recorded response without calling the
+// handler. A key that is reused for a different request is rejected.
+//
+// Keys are scoped by the identity of the client, so clients can't replay
+// responses of each other. Responses with 5xx status codes, and requests
+// that panic or are canceled, are not recorded, so they can be retried.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dmage/middleware/fingerprint"
+)
+
+const (
+	// DefaultHeader is the request header with the idempotency key.
+	DefaultHeader = "Idempotency-Key"
+
+	// ReplayedHeader is set on recorded responses that are sent again.
+	ReplayedHeader = "Idempotent-Replayed"
+)
+
+const (
+	defaultTTL          = 24 * time.Hour
+	defaultMaxWait      = 10 * time.Second
+	defaultPollInterval = 50 * time.Millisecond
+	defaultMaxBodySize  = 1 << 20
+	defaultMaxKeyLength = 255
+)
+
+func defaultMismatchHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "422 idempotency key is reused for a different request", http.StatusUnprocessableEntity)
+}
+
+// MismatchHandler is a default MismatchHandler for Middleware.
+var MismatchHandler http.Handler = http.HandlerFunc(defaultMismatchHandler)
+
+func defaultInProgressHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "409 a request with the same idempotency key is in progress", http.StatusConflict)
+}
+
+// InProgressHandler is a default InProgressHandler for Middleware.
+var InProgressHandler http.Handler = http.HandlerFunc(defaultInProgressHandler)
+
+// Stats contains counters collected by Middleware.
+type Stats struct {
+	// Executed is the number of requests with keys passed to the handler.
+	Executed int64 `json:"executed"`
+
+	// Replayed is the number of requests served with recorded responses.
+	Replayed int64 `json:"replayed"`
+
+	// Mismatched is the number of requests rejected because their key has
+	// been used for a different request.
+	Mismatched int64 `json:"mismatched"`
+
+	// InProgress is the number of requests rejected because the request
+	// with the same key hasn't finished in MaxWait.
+	InProgress int64 `json:"in_progress"`
+
+	// StoreErrors is the number of failed Store operations. Requests are
+	// passed to the handler when the store fails.
+	StoreErrors int64 `json:"store_errors"`
+}
+
+// recorder passes the response to the client and keeps a copy of it.
+type recorder struct {
+	http.ResponseWriter
+	maxBodySize int
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	tooLarge    bool
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 && status >= 200 {
+		rec.status = status
+		rec.header = rec.ResponseWriter.Header().Clone()
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.tooLarge {
+		if rec.body.Len()+len(p) > rec.maxBodySize {
+			rec.tooLarge = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(p)
+		}
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (rec *recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Middleware implements the http.Handler interface. The Fingerprinter
+// decides whether two requests with the same key are the same request, its
+// Identity scopes the keys.
+type Middleware struct {
+	fingerprint.Fingerprinter
+	handler http.Handler
+	store   Store
+
+	mu    sync.Mutex
+	stats Stats
+
+	// Header is the request header with the idempotency key. By default it
+	// is DefaultHeader.
+	Header string
+
+	// Methods are the methods for which keys are honored. By default they
+	// are POST and PATCH; PUT and DELETE are idempotent by definition.
+	Methods []string
+
+	// TTL is how long a recorded response is kept. By default it is 24
+	// hours.
+	TTL time.Duration
+
+	// MaxWait is how long a duplicate waits for the request with the same
+	// key before InProgressHandler is called. By default it is 10 seconds.
+	MaxWait time.Duration
+
+	// PollInterval is how often a waiting duplicate checks the store. By
+	// default it is 50 milliseconds.
+	PollInterval time.Duration
+
+	// MaxResponseSize is the maximum size of a response body that is
+	// recorded. Larger responses are not recorded, so their requests can be
+	// retried. By default it is 1 MiB.
+	MaxResponseSize int
+
+	// MismatchHandler is called for requests whose key has been used for
+	// a different request.
+	MismatchHandler http.Handler
+
+	// InProgressHandler is called for duplicates whose original request
+	// hasn't finished in MaxWait.
+	InProgressHandler http.Handler
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// New returns an http.Handler that deduplicates requests with idempotency
+// keys using store and passes other requests to h. If store is nil, a
+// MemoryStore is used.
+func New(store Store, h http.Handler) *Middleware {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	return &Middleware{
+		Fingerprinter: fingerprint.Fingerprinter{
+			Identity:    fingerprint.AuthorizationIdentity,
+			MaxBodySize: defaultMaxBodySize,
+		},
+		handler:           h,
+		store:             store,
+		Header:            DefaultHeader,
+		Methods:           []string{"POST", "PATCH"},
+		TTL:               defaultTTL,
+		MaxWait:           defaultMaxWait,
+		PollInterval:      defaultPollInterval,
+		MaxResponseSize:   defaultMaxBodySize,
+		MismatchHandler:   MismatchHandler,
+		InProgressHandler: InProgressHandler,
+		now:               time.Now,
+	}
+}
+
+// Stats returns a snapshot of the collected counters.
+func (m *Middleware) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+func (m *Middleware) count(counter *int64) {
+	m.mu.Lock()
+	*counter++
+	m.mu.Unlock()
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// applies reports whether keys are honored for the method of r.
+func (m *Middleware) applies(r *http.Request) bool {
+	for _, method := range m.Methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	return false
+}
+
+// storeKey returns the key of the record, scoped by the client identity.
+func (m *Middleware) storeKey(r *http.Request, key string) string {
+	identity := m.Identity
+	if identity == nil {
+		identity = fingerprint.AuthorizationIdentity
+	}
+	sum := sha256.Sum256([]byte(identity(r)))
+	return hex.EncodeToString(sum[:16]) + ":" + key
+}
+
+func replay(w http.ResponseWriter, rec *Record) {
+	for name, values := range rec.Header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(rec.Status)
+	w.Write(rec.Body)
+}
+
+// wait polls the store until the request with key finishes. It returns the
+// record of the finished request, or nil if the request has been abandoned
+// and the current request has taken its place.
+func (m *Middleware) wait(r *http.Request, key, fp string) (*Record, bool, error) {
+	ctx := r.Context()
+	deadline := m.now().Add(orDefault(m.MaxWait, defaultMaxWait))
+	ticker := time.NewTicker(orDefault(m.PollInterval, defaultPollInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-ticker.C:
+		}
+		existing, err := m.store.Begin(ctx, key, fp, orDefault(m.TTL, defaultTTL))
+		if err != nil || existing == nil || existing.Done {
+			return existing, true, err
+		}
+		if !m.now().Before(deadline) {
+			return existing, false, nil
+		}
+	}
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	header := m.Header
+	if header == "" {
+		header = DefaultHeader
+	}
+	idemKey := r.Header.Get(header)
+	if idemKey == "" || !m.applies(r) {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+	if len(idemKey) > defaultMaxKeyLength {
+		http.Error(w, "400 idempotency key is too long", http.StatusBadRequest)
+		return
+	}
+
+	fp := fingerprint.FromContext(r.Context())
+	if fp == "" {
+		var ok bool
+		var err error
+		fp, ok, err = m.Fingerprint(r)
+		if err != nil {
+			http.Error(w, "400 failed to read the request body", http.StatusBadRequest)
+			return
+		}
+		if !ok {
+			http.Error(w, "413 request body is too large for an idempotent request", http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	key := m.storeKey(r, idemKey)
+	ttl := orDefault(m.TTL, defaultTTL)
+	existing, err := m.store.Begin(ctx, key, fp, ttl)
+	if err != nil {
+		m.count(&m.stats.StoreErrors)
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+	if existing != nil {
+		if existing.Fingerprint != fp {
+			m.count(&m.stats.Mismatched)
+			m.MismatchHandler.ServeHTTP(w, r)
+			return
+		}
+		if !existing.Done {
+			var finished bool
+			existing, finished, err = m.wait(r, key, fp)
+			switch {
+			case err != nil && ctx.Err() != nil:
+				return
+			case err != nil:
+				m.count(&m.stats.StoreErrors)
+				m.handler.ServeHTTP(w, r)
+				return
+			case !finished:
+				m.count(&m.stats.InProgress)
+				m.InProgressHandler.ServeHTTP(w, r)
+				return
+			}
+		}
+		if existing != nil {
+			if existing.Fingerprint != fp {
+				m.count(&m.stats.Mismatched)
+				m.MismatchHandler.ServeHTTP(w, r)
+				return
+			}
+			m.count(&m.stats.Replayed)
+			replay(w, existing)
+			return
+		}
+		// The original request has been abandoned, this one has taken
+		// its place.
+	}
+
+	m.count(&m.stats.Executed)
+	maxResponseSize := m.MaxResponseSize
+	if maxResponseSize <= 0 {
+		maxResponseSize = defaultMaxBodySize
+	}
+	rec := &recorder{ResponseWriter: w, maxBodySize: maxResponseSize}
+	completed := false
+	defer func() {
+		storeCtx := context.WithoutCancel(ctx)
+		if completed && ctx.Err() == nil && !rec.tooLarge && rec.status < 500 {
+			err = m.store.Complete(storeCtx, key, &Record{
+				Fingerprint: fp,
+				Done:        true,
+				Status:      rec.status,
+				Header:      rec.header,
+				Body:        rec.body.Bytes(),
+			}, ttl)
+		} else {
+			err = m.store.Abandon(storeCtx, key)
+		}
+		if err != nil {
+			m.count(&m.stats.StoreErrors)
+		}
+	}()
+	m.handler.ServeHTTP(rec, r)
+	if rec.status == 0 {
+		// The handler has written nothing, the server will respond with
+		// 200 OK and an empty body.
+		rec.WriteHeader(http.StatusOK)
+	}
+	completed = true
+}
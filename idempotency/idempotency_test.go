@@ -0,0 +1,127 @@
+package idempotency
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	calls := 0
+	status := http.StatusCreated
+	m := New(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Location", "/orders/"+strconv.Itoa(calls))
+		w.WriteHeader(status)
+		w.Write([]byte("order " + strconv.Itoa(calls)))
+	}))
+
+	post := func(key, auth, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/orders", strings.NewReader(body))
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		r.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, r)
+		return rec
+	}
+
+	post("a", "alice", "{}")
+	rec := post("a", "alice", "{}")
+	if calls != 1 || rec.Code != http.StatusCreated || rec.Body.String() != "order 1" || rec.Header().Get("Location") != "/orders/1" {
+		t.Fatalf("duplicate: calls = %d, response = %d %q; want the recorded response", calls, rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get(ReplayedHeader) != "true" {
+		t.Fatalf("the replayed response has no %s header", ReplayedHeader)
+	}
+
+	if rec := post("a", "alice", `{"other": true}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("reused key: status = %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+	if post("a", "bob", "{}"); calls != 2 {
+		t.Fatalf("the same key of another client: calls = %d, want 2", calls)
+	}
+	if post("", "alice", "{}"); calls != 3 {
+		t.Fatalf("a request without a key: calls = %d, want 3", calls)
+	}
+
+	// Server errors are not recorded, so the request can be retried.
+	status = http.StatusServiceUnavailable
+	post("b", "alice", "{}")
+	status = http.StatusCreated
+	if rec := post("b", "alice", "{}"); calls != 5 || rec.Code != http.StatusCreated {
+		t.Fatalf("retry after a server error: calls = %d, status = %d; want the handler to be called", calls, rec.Code)
+	}
+
+	if stats := m.Stats(); stats.Executed != 4 || stats.Replayed != 1 || stats.Mismatched != 1 {
+		t.Fatalf("Stats() = %+v", stats)
+	}
+}
+
+func TestConcurrentDuplicates(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	started := make(chan struct{})
+	release := make(chan struct{})
+	m := New(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}))
+	m.PollInterval = time.Millisecond
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 3)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest("POST", "/", nil)
+			r.Header.Set("Idempotency-Key", "k")
+			rec := httptest.NewRecorder()
+			m.ServeHTTP(rec, r)
+			bodies[i] = rec.Body.String()
+		}(i)
+		if i == 0 {
+			<-started
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("calls = %d, want 1", calls)
+	}
+	for i, body := range bodies {
+		if body != "done" {
+			t.Errorf("request %d: body = %q, want the response of the first request", i, body)
+		}
+	}
+
+	// A request with the same key is in progress, e.g. in another replica.
+	m.MaxWait = time.Millisecond
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Idempotency-Key", "slow")
+	fp, _, err := m.Fingerprint(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.store.Begin(context.Background(), m.storeKey(r, "slow"), fp, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, r)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want %d while the first request is in progress", rec.Code, http.StatusConflict)
+	}
+}
@@ -0,0 +1,112 @@
+package idempotency
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Record is the state of an idempotency key.
+type Record struct {
+	// Fingerprint is the fingerprint of the request that has used the
+	// key first.
+	Fingerprint string `json:"fingerprint"`
+
+	// Done is false while the first request is being served.
+	Done bool `json:"done"`
+
+	// Status, Header and Body are the recorded response, they are set when
+	// Done is true.
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// Store keeps records of idempotency keys. Implementations must make Begin
+// atomic, so that only one of concurrent requests with the same key is
+// served.
+type Store interface {
+	// Begin creates an in-progress record with fingerprint for key that
+	// expires after ttl, unless there is a record for key already. In that
+	// case it returns the existing record.
+	Begin(ctx context.Context, key, fingerprint string, ttl time.Duration) (existing *Record, err error)
+
+	// Complete replaces the record for key with rec that expires after ttl.
+	Complete(ctx context.Context, key string, rec *Record, ttl time.Duration) error
+
+	// Abandon removes the in-progress record for key, so that the request
+	// can be retried.
+	Abandon(ctx context.Context, key string) error
+}
+
+type memoryRecord struct {
+	rec     *Record
+	expires time.Time
+}
+
+// MemoryStore is a Store that keeps records in memory. It is suitable for a
+// single process.
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]memoryRecord
+	inserts int
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// cleanupInterval is how many records are created between sweeps of
+// expired records.
+const cleanupInterval = 1024
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		records: make(map[string]memoryRecord),
+		now:     time.Now,
+	}
+}
+
+// Begin implements Store.
+func (s *MemoryStore) Begin(ctx context.Context, key, fingerprint string, ttl time.Duration) (*Record, error) {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.records[key]; ok && now.Before(r.expires) {
+		return r.rec, nil
+	}
+	if s.inserts++; s.inserts%cleanupInterval == 0 {
+		for k, r := range s.records {
+			if !now.Before(r.expires) {
+				delete(s.records, k)
+			}
+		}
+	}
+	s.records[key] = memoryRecord{
+		rec:     &Record{Fingerprint: fingerprint},
+		expires: now.Add(ttl),
+	}
+	return nil, nil
+}
+
+// Complete implements Store.
+func (s *MemoryStore) Complete(ctx context.Context, key string, rec *Record, ttl time.Duration) error {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[key] = memoryRecord{rec: rec, expires: now.Add(ttl)}
+	return nil
+}
+
+// Abandon implements Store.
+func (s *MemoryStore) Abandon(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.records[key]; ok && !r.rec.Done {
+		delete(s.records, key)
+	}
+	return nil
+}
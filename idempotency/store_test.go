@@ -0,0 +1,38 @@
+package idempotency
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	s := NewMemoryStore()
+	s.now = func() time.Time {
+		return now
+	}
+
+	if existing, _ := s.Begin(ctx, "k", "fp", time.Minute); existing != nil {
+		t.Fatalf("Begin() of a new key = %+v, want nil", existing)
+	}
+	if existing, _ := s.Begin(ctx, "k", "other", time.Minute); existing == nil || existing.Done || existing.Fingerprint != "fp" {
+		t.Fatalf("Begin() of a key in progress = %+v, want the in-progress record", existing)
+	}
+
+	s.Abandon(ctx, "k")
+	if existing, _ := s.Begin(ctx, "k", "fp2", time.Minute); existing != nil {
+		t.Fatalf("Begin() of an abandoned key = %+v, want nil", existing)
+	}
+	s.Complete(ctx, "k", &Record{Fingerprint: "fp2", Done: true, Status: 201}, time.Hour)
+	s.Abandon(ctx, "k")
+	if existing, _ := s.Begin(ctx, "k", "fp2", time.Minute); existing == nil || existing.Status != 201 {
+		t.Fatalf("Begin() of a completed key = %+v, want the recorded response", existing)
+	}
+
+	now = now.Add(time.Hour)
+	if existing, _ := s.Begin(ctx, "k", "fp3", time.Minute); existing != nil {
+		t.Fatalf("Begin() of an expired key = %+v, want nil", existing)
+	}
+}
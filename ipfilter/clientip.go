@@ -0,0 +1,132 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Extractor determines the address of the client that has sent a request,
+// possibly through reverse proxies.
+//
+// The header set by proxies is trusted only if the request comes from a
+// trusted proxy, otherwise any client could pick an address by sending the
+// header itself. The header is read from right to left, skipping the
+// addresses of trusted proxies, and the first address that is not a trusted
+// proxy is the client.
+//
+// No header is trusted by default: the proxies must overwrite or append to
+// the header, otherwise clients can still spoof the leftmost addresses, and
+// only the operator knows which header that is. The zero value uses only
+// RemoteAddr.
+type Extractor struct {
+	// TrustedProxies are the networks of the reverse proxies in front of
+	// the server.
+	TrustedProxies []netip.Prefix
+
+	// Header is the header that the trusted proxies set to the addresses
+	// of clients, e.g. "X-Forwarded-For". Forwarded is parsed according to
+	// RFC 7239, other headers are comma-separated lists of addresses. If
+	// empty, only RemoteAddr is used.
+	Header string
+}
+
+// parseAddr parses an address that may have a port and brackets, e.g.
+// "192.0.2.1", "192.0.2.1:443", "[2001:db8::1]:443". IPv4-mapped IPv6
+// addresses are unmapped.
+func parseAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// RemoteAddr returns the address of the peer of the request, i.e. the
+// client or the nearest proxy.
+func RemoteAddr(r *http.Request) (netip.Addr, bool) {
+	return parseAddr(r.RemoteAddr)
+}
+
+func (e *Extractor) trusted(addr netip.Addr) bool {
+	for _, p := range e.TrustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the for= values of a Forwarded header, see RFC 7239.
+func forwardedFor(value string) []string {
+	var addrs []string
+	for _, elem := range strings.Split(value, ",") {
+		for _, pair := range strings.Split(elem, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(k, "for") {
+				addrs = append(addrs, strings.Trim(v, `"`))
+			}
+		}
+	}
+	return addrs
+}
+
+// hops returns the addresses from the header, the nearest proxy is the last.
+func hops(r *http.Request, header string) ([]string, bool) {
+	values := r.Header.Values(header)
+	if len(values) == 0 {
+		return nil, false
+	}
+	value := strings.Join(values, ",")
+	if http.CanonicalHeaderKey(header) == "Forwarded" {
+		return forwardedFor(value), true
+	}
+	return strings.Split(value, ","), true
+}
+
+// ClientIP returns the address of the client. It reports false if the
+// address cannot be determined, e.g. a trusted proxy has sent an obfuscated
+// identifier.
+func (e *Extractor) ClientIP(r *http.Request) (netip.Addr, bool) {
+	addr, ok := RemoteAddr(r)
+	if !ok || !e.trusted(addr) {
+		return addr, ok
+	}
+	if e.Header == "" {
+		return addr, true
+	}
+	list, ok := hops(r, e.Header)
+	if !ok {
+		return addr, true
+	}
+	for i := len(list) - 1; i >= 0; i-- {
+		addr, ok = parseAddr(list[i])
+		if !ok {
+			return netip.Addr{}, false
+		}
+		if !e.trusted(addr) {
+			return addr, true
+		}
+	}
+	// All hops are trusted proxies, the leftmost one is the closest to the
+	// client.
+	return addr, true
+}
+
+// Key returns the address of the client as a string. It can be used as Key
+// of ratelimit.Middleware or maxconnections.Keyed instead of RemoteAddrKey
+// when the server is behind reverse proxies. Requests whose address cannot
+// be determined share the empty key.
+func (e *Extractor) Key(r *http.Request) string {
+	addr, ok := e.ClientIP(r)
+	if !ok {
+		return ""
+	}
+	return addr.String()
+}
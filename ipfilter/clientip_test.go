@@ -0,0 +1,45 @@
+package ipfilter
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParsePrefixes([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name       string
+		trusted    string
+		remoteAddr string
+		header     string
+		value      string
+		expected   string
+	}{
+		{"direct", "X-Forwarded-For", "192.0.2.1:1234", "", "", "192.0.2.1"},
+		{"untrusted peer", "X-Forwarded-For", "192.0.2.1:1234", "X-Forwarded-For", "198.51.100.1", "192.0.2.1"},
+		{"x-forwarded-for", "X-Forwarded-For", "10.0.0.1:1234", "X-Forwarded-For", "203.0.113.9, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"all trusted", "X-Forwarded-For", "10.0.0.1:1234", "X-Forwarded-For", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"x-real-ip", "X-Real-IP", "10.0.0.1:1234", "X-Real-IP", "198.51.100.1", "198.51.100.1"},
+		{"forwarded", "Forwarded", "10.0.0.1:1234", "Forwarded", `for=198.51.100.1;proto=https, for="[2001:db8::1]:443"`, "2001:db8::1"},
+		{"obfuscated", "Forwarded", "10.0.0.1:1234", "Forwarded", "for=_hidden", ""},
+		{"ipv4-mapped", "X-Forwarded-For", "[::ffff:10.0.0.1]:1234", "X-Forwarded-For", "198.51.100.1", "198.51.100.1"},
+		{"no header", "X-Forwarded-For", "10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"other header", "X-Forwarded-For", "10.0.0.1:1234", "Forwarded", "for=198.51.100.1", "10.0.0.1"},
+		{"no trusted header", "", "10.0.0.1:1234", "X-Forwarded-For", "198.51.100.1", "10.0.0.1"},
+	}
+	for _, tc := range testCases {
+		e := &Extractor{TrustedProxies: proxies, Header: tc.trusted}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		if tc.header != "" {
+			r.Header.Set(tc.header, tc.value)
+		}
+		if key := e.Key(r); key != tc.expected {
+			t.Errorf("%s: Key() = %q, want %q", tc.name, key, tc.expected)
+		}
+	}
+}
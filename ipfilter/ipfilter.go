@@ -0,0 +1,164 @@
+// Package ipfilter allows or denies requests by the address of the client.
+//
+// Extractor determines the address of the client behind trusted reverse
+// proxies. It is also useful on its own as Key of rate limiters and keyed
+// concurrency limiters.
+package ipfilter
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dmage/middleware/decisionlog"
+)
+
+func defaultForbiddenHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "403 forbidden", http.StatusForbidden)
+}
+
+// ForbiddenHandler is a default ForbiddenHandler for Middleware.
+var ForbiddenHandler http.Handler = http.HandlerFunc(defaultForbiddenHandler)
+
+// ParsePrefixes parses a list of networks in CIDR notation, e.g.
+// "10.0.0.0/8". A single address is a network of its own.
+func ParsePrefixes(ss []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(ss))
+	for _, s := range ss {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// lookup returns the first prefix of list that contains addr.
+func lookup(list []netip.Prefix, addr netip.Addr) (netip.Prefix, bool) {
+	for _, p := range list {
+		if p.Contains(addr) {
+			return p, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// Stats contains counters collected by Middleware.
+type Stats struct {
+	// Allowed is the total number of requests that have been allowed.
+	Allowed int64 `json:"allowed"`
+
+	// Denied is the total number of requests that have been denied.
+	Denied int64 `json:"denied"`
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler http.Handler
+
+	// mu protects the lists.
+	mu    sync.RWMutex
+	allow []netip.Prefix
+	deny  []netip.Prefix
+
+	allowed int64
+	denied  int64
+
+	// Extractor determines the address of the client.
+	Extractor Extractor
+
+	// AllowUnknown allows requests whose client address cannot be
+	// determined, e.g. a trusted proxy has sent an obfuscated identifier,
+	// when the allowlist is empty. Such requests are denied by default, as
+	// they can't be checked against the denylist.
+	AllowUnknown bool
+
+	// ForbiddenHandler is called for denied requests.
+	ForbiddenHandler http.Handler
+}
+
+// New returns an http.Handler that passes requests to h unless they are
+// denied by the lists, see SetAllow and SetDeny. Initially both lists are
+// empty and all requests with a known client address are allowed, see
+// AllowUnknown.
+func New(h http.Handler) *Middleware {
+	return &Middleware{
+		handler:          h,
+		ForbiddenHandler: ForbiddenHandler,
+	}
+}
+
+// SetAllow replaces the allowlist. If it is not empty, only clients from its
+// networks are allowed. It is safe to call it while the middleware is
+// serving requests.
+func (m *Middleware) SetAllow(prefixes []netip.Prefix) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.allow = prefixes
+}
+
+// SetDeny replaces the denylist. Clients from its networks are denied even
+// if they are in the allowlist.
+func (m *Middleware) SetDeny(prefixes []netip.Prefix) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deny = prefixes
+}
+
+// check reports whether the client at addr is allowed, and the rule that
+// has decided it.
+func (m *Middleware) check(addr netip.Addr, ok bool) (allowed bool, rule string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !ok {
+		// An unknown client can't be proven to be in the allowlist.
+		return m.AllowUnknown && len(m.allow) == 0, "unknown address"
+	}
+	if p, found := lookup(m.deny, addr); found {
+		return false, "deny " + p.String()
+	}
+	if len(m.allow) == 0 {
+		return true, ""
+	}
+	if p, found := lookup(m.allow, addr); found {
+		return true, "allow " + p.String()
+	}
+	return false, "not in allowlist"
+}
+
+// Stats returns a snapshot of the collected counters.
+func (m *Middleware) Stats() Stats {
+	return Stats{
+		Allowed: atomic.LoadInt64(&m.allowed),
+		Denied:  atomic.LoadInt64(&m.denied),
+	}
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	addr, ok := m.Extractor.ClientIP(r)
+	allowed, rule := m.check(addr, ok)
+	if !allowed {
+		atomic.AddInt64(&m.denied, 1)
+		decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "ipfilter", Action: decisionlog.Deny, Rule: rule, Reason: "client address " + addr.String()})
+		m.ForbiddenHandler.ServeHTTP(w, r)
+		return
+	}
+	atomic.AddInt64(&m.allowed, 1)
+	m.handler.ServeHTTP(w, r)
+}
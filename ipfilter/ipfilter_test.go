@@ -0,0 +1,84 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	allow, err := ParsePrefixes([]string{"192.0.2.0/24", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, err := ParsePrefixes([]string{"192.0.2.66"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(remoteAddr string) int {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		m.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	if status := do("198.51.100.1:1234"); status != http.StatusOK {
+		t.Fatalf("status = %d with empty lists, want %d", status, http.StatusOK)
+	}
+
+	m.SetAllow(allow)
+	m.SetDeny(deny)
+	testCases := []struct {
+		remoteAddr string
+		status     int
+	}{
+		{"192.0.2.1:1234", http.StatusOK},
+		{"[2001:db8::1]:1234", http.StatusOK},
+		{"192.0.2.66:1234", http.StatusForbidden},
+		{"198.51.100.1:1234", http.StatusForbidden},
+		{"garbage", http.StatusForbidden},
+	}
+	for _, tc := range testCases {
+		if status := do(tc.remoteAddr); status != tc.status {
+			t.Errorf("%s: status = %d, want %d", tc.remoteAddr, status, tc.status)
+		}
+	}
+	if stats := m.Stats(); stats.Allowed != 3 || stats.Denied != 3 {
+		t.Fatalf("stats = %+v, want 3 allowed and 3 denied", stats)
+	}
+}
+
+func TestUnknownAddress(t *testing.T) {
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func() int {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "garbage"
+		m.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	if status := do(); status != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", status, http.StatusForbidden)
+	}
+	m.AllowUnknown = true
+	if status := do(); status != http.StatusOK {
+		t.Fatalf("status = %d with AllowUnknown, want %d", status, http.StatusOK)
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	if _, err := ParsePrefixes([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatalf("ParsePrefixes() with an invalid prefix succeeded")
+	}
+	prefixes, err := ParsePrefixes([]string{"10.1.2.3/8", "::ffff:192.0.2.0/120"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefixes[0].String() != "10.0.0.0/8" || prefixes[1].String() != "192.0.2.0/24" {
+		t.Fatalf("prefixes = %v, want masked and unmapped ones", prefixes)
+	}
+}
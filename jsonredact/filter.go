@@ -0,0 +1,501 @@
+package jsonredact
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrSyntax is returned by Filter when its input is not valid JSON. The
+// filter doesn't write anything after the error, so a malformed document
+// can't leak the fields that should have been removed.
+var ErrSyntax = errors.New("jsonredact: invalid JSON")
+
+// DefaultReplacement is the default Replacement of Rules.
+const DefaultReplacement = "[REDACTED]"
+
+// Rules select fields of JSON documents by their paths. A path is a list of
+// object keys and array indexes separated by dots, e.g. "users.0.email". In
+// patterns, "*" matches any single key or index and "**" matches any number
+// of them, e.g. "users.*.email" or "**.password".
+type Rules struct {
+	// Remove contains patterns of fields that are removed with their keys.
+	Remove []string
+
+	// Mask contains patterns of fields whose values are replaced with
+	// Replacement. If a field matches both lists, it is removed.
+	Mask []string
+
+	// Replacement is the string that replaces masked values. By default it
+	// is DefaultReplacement.
+	Replacement string
+
+	// Keep, if not empty, contains patterns of fields that are kept, other
+	// fields are removed. Array indexes are not part of the paths for these
+	// patterns, so "items.id" keeps the id of every element of items. The
+	// Remove and Mask patterns still apply to kept fields.
+	Keep []string
+}
+
+// action is what happens with a field.
+type action int
+
+const (
+	keep action = iota
+	remove
+	mask
+)
+
+// compiledRules are Rules with patterns split into segments.
+type compiledRules struct {
+	remove      [][]string
+	mask        [][]string
+	keep        [][]string
+	replacement []byte
+}
+
+func compile(patterns []string) [][]string {
+	var compiled [][]string
+	for _, p := range patterns {
+		if p != "" {
+			compiled = append(compiled, strings.Split(p, "."))
+		}
+	}
+	return compiled
+}
+
+func (r Rules) compile() *compiledRules {
+	replacement := r.Replacement
+	if replacement == "" {
+		replacement = DefaultReplacement
+	}
+	quoted, _ := json.Marshal(replacement)
+	return &compiledRules{
+		remove:      compile(r.Remove),
+		mask:        compile(r.Mask),
+		keep:        compile(r.Keep),
+		replacement: quoted,
+	}
+}
+
+// match reports whether path matches pattern.
+func match(pattern, path []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(path); i >= 0; i-- {
+				if match(pattern[1:], path[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(path) == 0 || (pattern[0] != "*" && pattern[0] != path[0]) {
+			return false
+		}
+		pattern, path = pattern[1:], path[1:]
+	}
+	return len(path) == 0
+}
+
+// matchPrefix reports whether path matches a prefix of pattern, i.e. some
+// descendants of path may match pattern.
+func matchPrefix(pattern, path []string) bool {
+	for len(path) > 0 {
+		if len(pattern) == 0 {
+			return false
+		}
+		if pattern[0] == "**" {
+			return true
+		}
+		if pattern[0] != "*" && pattern[0] != path[0] {
+			return false
+		}
+		pattern, path = pattern[1:], path[1:]
+	}
+	return true
+}
+
+// keeps returns whether a field with keys is kept according to the Keep
+// patterns, and whether all its descendants are kept too.
+func (r *compiledRules) keeps(keys []string) (kept, all bool) {
+	for _, p := range r.keep {
+		if match(p, keys) {
+			return true, true
+		}
+	}
+	for _, p := range r.keep {
+		if matchPrefix(p, keys) {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+func (r *compiledRules) action(path []string) action {
+	for _, p := range r.remove {
+		if match(p, path) {
+			return remove
+		}
+	}
+	for _, p := range r.mask {
+		if match(p, path) {
+			return mask
+		}
+	}
+	return keep
+}
+
+// frame is an object or an array that is being filtered.
+type frame struct {
+	object bool
+
+	// key is the key of the current member of an object, index is the
+	// index of the current element of an array.
+	key   string
+	index int
+
+	// emitted is the number of members that have been written, it is used
+	// to put commas between them.
+	emitted int
+
+	// keepAll is true if all descendants of the container are kept
+	// according to the Keep patterns.
+	keepAll bool
+}
+
+// states of the scanner.
+const (
+	stValue        = iota // expecting a value
+	stValueOrEnd          // expecting a value or ']' right after '['
+	stString              // inside a string value
+	stStringEscape        // after a backslash in a string value
+	stLiteral             // inside a number, true, false or null
+	stKeyOrEnd            // expecting a key or '}' right after '{'
+	stKey                 // expecting a key after a comma
+	stKeyString           // inside a key
+	stKeyEscape           // after a backslash in a key
+	stColon               // expecting a colon after a key
+	stAfterValue          // expecting a comma or the end of the container
+	stFailed              // the input is invalid
+)
+
+// Filter is an io.WriteCloser that passes JSON documents to the underlying
+// writer with fields selected by Rules removed or masked. It processes the
+// input as it arrives and doesn't buffer whole documents, only object keys
+// are kept until they are complete. Insignificant whitespace inside
+// documents is removed. A stream of several documents separated by
+// whitespace, e.g. JSON Lines, is supported.
+type Filter struct {
+	w     io.Writer
+	rules *compiledRules
+
+	state int
+	stack []frame
+	key   []byte // raw bytes of the key being read, without quotes
+	out   []byte // output of the current Write call
+
+	// skip, if not negative, is the depth of the stack at which the value
+	// that is being skipped has started. Nothing is written while skipping.
+	skip int
+
+	// keepAll is the keepAll flag for the container that the next value
+	// may start.
+	keepAll bool
+}
+
+// NewFilter returns a Filter that writes filtered documents to w.
+func NewFilter(w io.Writer, rules Rules) *Filter {
+	return &Filter{
+		w:     w,
+		rules: rules.compile(),
+		skip:  -1,
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func (f *Filter) emit(p ...byte) {
+	if f.skip < 0 {
+		f.out = append(f.out, p...)
+	}
+}
+
+// path returns the path of a new member of the innermost container with
+// the key or index last.
+func (f *Filter) path(last string) []string {
+	path := make([]string, 0, len(f.stack))
+	for _, fr := range f.stack[:len(f.stack)-1] {
+		if fr.object {
+			path = append(path, fr.key)
+		} else {
+			path = append(path, strconv.Itoa(fr.index))
+		}
+	}
+	return append(path, last)
+}
+
+// keys returns the object keys on the path to the current member of the
+// innermost container.
+func (f *Filter) keys() []string {
+	keys := make([]string, 0, len(f.stack))
+	for _, fr := range f.stack {
+		if fr.object {
+			keys = append(keys, fr.key)
+		}
+	}
+	return keys
+}
+
+// separate writes a comma if the innermost container already has members.
+func (f *Filter) separate(fr *frame) {
+	if fr.emitted > 0 {
+		f.emit(',')
+	}
+	fr.emitted++
+}
+
+// beginMember decides what happens with a new member of the innermost
+// container at the current position. For objects the key has been read, for
+// arrays this is called before the first byte of the element.
+func (f *Filter) beginMember() {
+	if f.skip >= 0 {
+		return
+	}
+	fr := &f.stack[len(f.stack)-1]
+	f.keepAll = fr.keepAll
+	if len(f.rules.keep) > 0 && !f.keepAll {
+		kept, all := f.rules.keeps(f.keys())
+		if !kept {
+			f.skip = len(f.stack)
+			return
+		}
+		f.keepAll = all
+	}
+	var last string
+	if fr.object {
+		last = fr.key
+	} else {
+		last = strconv.Itoa(fr.index)
+	}
+	switch f.rules.action(f.path(last)) {
+	case remove:
+		f.skip = len(f.stack)
+	case mask:
+		f.separate(fr)
+		if fr.object {
+			f.emit('"')
+			f.emit(f.key...)
+			f.emit('"', ':')
+		}
+		f.emit(f.rules.replacement...)
+		f.skip = len(f.stack)
+	default:
+		f.separate(fr)
+		if fr.object {
+			f.emit('"')
+			f.emit(f.key...)
+			f.emit('"')
+		}
+	}
+}
+
+// endValue is called when a value is complete.
+func (f *Filter) endValue() {
+	f.state = stAfterValue
+	if f.skip == len(f.stack) {
+		f.skip = -1
+	}
+}
+
+// beginValue processes c, the first byte of a value.
+func (f *Filter) beginValue(c byte) bool {
+	if len(f.stack) == 0 {
+		f.keepAll = len(f.rules.keep) == 0
+	}
+	switch {
+	case c == '{':
+		f.emit(c)
+		f.stack = append(f.stack, frame{object: true, keepAll: f.keepAll})
+		f.state = stKeyOrEnd
+	case c == '[':
+		f.emit(c)
+		f.stack = append(f.stack, frame{keepAll: f.keepAll})
+		f.state = stValueOrEnd
+	case c == '"':
+		f.emit(c)
+		f.state = stString
+	case c == '-' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z'):
+		f.emit(c)
+		f.state = stLiteral
+	default:
+		return false
+	}
+	return true
+}
+
+// endContainer processes c, which closes the innermost container.
+func (f *Filter) endContainer(c byte) bool {
+	if len(f.stack) == 0 {
+		return false
+	}
+	if fr := f.stack[len(f.stack)-1]; (c == '}') != fr.object {
+		return false
+	}
+	f.stack = f.stack[:len(f.stack)-1]
+	f.emit(c)
+	f.endValue()
+	return true
+}
+
+// step processes the byte c. It returns false if the input is invalid.
+func (f *Filter) step(c byte) bool {
+	switch f.state {
+	case stValueOrEnd:
+		if isSpace(c) {
+			return true
+		}
+		if c == ']' {
+			return f.endContainer(c)
+		}
+		f.beginMember()
+		return f.beginValue(c)
+	case stValue:
+		if isSpace(c) {
+			if len(f.stack) == 0 {
+				f.emit(c)
+			}
+			return true
+		}
+		return f.beginValue(c)
+	case stString:
+		f.emit(c)
+		switch c {
+		case '\\':
+			f.state = stStringEscape
+		case '"':
+			f.endValue()
+		}
+		return true
+	case stStringEscape:
+		f.emit(c)
+		f.state = stString
+		return true
+	case stLiteral:
+		if isSpace(c) || c == ',' || c == '}' || c == ']' {
+			f.endValue()
+			return f.step(c)
+		}
+		f.emit(c)
+		return true
+	case stKeyOrEnd, stKey:
+		if isSpace(c) {
+			return true
+		}
+		if c == '}' && f.state == stKeyOrEnd {
+			return f.endContainer(c)
+		}
+		if c != '"' {
+			return false
+		}
+		f.key = f.key[:0]
+		f.state = stKeyString
+		return true
+	case stKeyString:
+		switch c {
+		case '\\':
+			f.key = append(f.key, c)
+			f.state = stKeyEscape
+		case '"':
+			var key string
+			if err := json.Unmarshal(append(append([]byte{'"'}, f.key...), '"'), &key); err != nil {
+				return false
+			}
+			f.stack[len(f.stack)-1].key = key
+			f.beginMember()
+			f.state = stColon
+		default:
+			f.key = append(f.key, c)
+		}
+		return true
+	case stKeyEscape:
+		f.key = append(f.key, c)
+		f.state = stKeyString
+		return true
+	case stColon:
+		if isSpace(c) {
+			return true
+		}
+		if c != ':' {
+			return false
+		}
+		f.emit(c)
+		f.state = stValue
+		return true
+	case stAfterValue:
+		if len(f.stack) == 0 {
+			// The next document of a stream.
+			f.state = stValue
+			return f.step(c)
+		}
+		if isSpace(c) {
+			return true
+		}
+		fr := &f.stack[len(f.stack)-1]
+		switch c {
+		case ',':
+			if fr.object {
+				f.state = stKey
+			} else {
+				fr.index++
+				f.state = stValue
+				f.beginMember()
+			}
+			return true
+		case '}', ']':
+			return f.endContainer(c)
+		}
+	}
+	return false
+}
+
+// Write filters p and writes the result to the underlying writer.
+func (f *Filter) Write(p []byte) (int, error) {
+	if f.state == stFailed {
+		return 0, ErrSyntax
+	}
+	f.out = f.out[:0]
+	for i, c := range p {
+		if !f.step(c) {
+			f.state = stFailed
+			if _, err := f.w.Write(f.out); err != nil {
+				return i, err
+			}
+			return i, ErrSyntax
+		}
+	}
+	if len(f.out) > 0 {
+		if _, err := f.w.Write(f.out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close checks that the input ends with a complete document. It doesn't
+// close the underlying writer.
+func (f *Filter) Close() error {
+	switch f.state {
+	case stLiteral:
+		f.endValue()
+	case stFailed:
+		return ErrSyntax
+	}
+	if len(f.stack) != 0 || (f.state != stAfterValue && f.state != stValue) {
+		return ErrSyntax
+	}
+	return nil
+}
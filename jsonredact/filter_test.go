@@ -0,0 +1,116 @@
+package jsonredact
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"email", "email", true},
+		{"email", "user.email", false},
+		{"user.email", "user.email", true},
+		{"users.*.email", "users.0.email", true},
+		{"users.*.email", "users.email", false},
+		{"**.password", "password", true},
+		{"**.password", "a.b.password", true},
+		{"**.password", "a.password.b", false},
+		{"a.**", "a.b.c", true},
+	}
+	for _, tc := range testCases {
+		if m := match(compile([]string{tc.pattern})[0], compile([]string{tc.path})[0]); m != tc.match {
+			t.Errorf("match(%q, %q) = %v, want %v", tc.pattern, tc.path, m, tc.match)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	rules := Rules{
+		Remove: []string{"**.password", "tokens.1"},
+		Mask:   []string{"users.*.email", "card"},
+	}
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{`{"name": "a", "password": "secret"}`, `{"name":"a"}`},
+		{`{"password": "secret", "name": "a"}`, `{"name":"a"}`},
+		{`{"password": {"old": "x", "new": ["y"]}}`, `{}`},
+		{`{"users": [{"id": 1, "email": "a@example.com"}, {"email": null, "id": 2}]}`, `{"users":[{"id":1,"email":"[REDACTED]"},{"email":"[REDACTED]","id":2}]}`},
+		{`{"card": {"number": "4111", "cvc": 123}, "ok": true}`, `{"card":"[REDACTED]","ok":true}`},
+		{`{"tokens": ["a", "b", "c"]}`, `{"tokens":["a","c"]}`},
+		{`{"password": "secret", "s": "a \"password\": \\"}`, `{"s":"a \"password\": \\"}`},
+		{`[1, 2.5e3, -3, null]`, `[1,2.5e3,-3,null]`},
+		{"{\"password\": 1}\n{\"id\": 2}\n", "{}\n{\"id\":2}\n"},
+		{`42`, `42`},
+	}
+	for _, tc := range testCases {
+		// The input is written byte by byte to check that values can span
+		// writes.
+		var buf bytes.Buffer
+		f := NewFilter(&buf, rules)
+		for i := 0; i < len(tc.input); i++ {
+			if _, err := f.Write([]byte{tc.input[i]}); err != nil {
+				t.Fatalf("%s: Write() = %v", tc.input, err)
+			}
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("%s: Close() = %v", tc.input, err)
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("%s: output = %s, want %s", tc.input, buf.String(), tc.expected)
+		}
+	}
+}
+
+func TestFilterKeep(t *testing.T) {
+	rules := Rules{
+		Keep:   []string{"id", "items.title", "author"},
+		Remove: []string{"author.password"},
+	}
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{`{"id": 1, "name": "a"}`, `{"id":1}`},
+		{`{"items": [{"id": 1, "title": "x"}, {"title": "y", "tags": ["a"]}]}`, `{"items":[{"title":"x"},{"title":"y"}]}`},
+		{`{"author": {"name": "a", "password": "x", "links": {"home": "/"}}}`, `{"author":{"name":"a","links":{"home":"/"}}}`},
+		{`{"name": {"id": 1}, "id": {"name": 2}}`, `{"id":{"name":2}}`},
+		{"{\"author\": {\"name\": \"a\"}}\n{\"name\": \"b\"}\n", "{\"author\":{\"name\":\"a\"}}\n{}\n"},
+		{`[{"id": 1, "name": "a"}]`, `[{"id":1}]`},
+	}
+	for _, tc := range testCases {
+		var buf bytes.Buffer
+		f := NewFilter(&buf, rules)
+		if _, err := f.Write([]byte(tc.input)); err != nil {
+			t.Fatalf("%s: Write() = %v", tc.input, err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("%s: Close() = %v", tc.input, err)
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("%s: output = %s, want %s", tc.input, buf.String(), tc.expected)
+		}
+	}
+}
+
+func TestFilterSyntaxError(t *testing.T) {
+	for _, input := range []string{`{"a": 1,, "password": "x"}`, `{"a" 1}`, `[1}`, `{"a": 1`, `{,}`} {
+		var buf bytes.Buffer
+		f := NewFilter(&buf, Rules{Remove: []string{"password"}})
+		_, err := f.Write([]byte(input))
+		if err == nil {
+			err = f.Close()
+		}
+		if err != ErrSyntax {
+			t.Errorf("%s: err = %v, want %v", input, err, ErrSyntax)
+		}
+		if bytes.Contains(buf.Bytes(), []byte("password")) {
+			t.Errorf("%s: output = %s, want no password", input, buf.String())
+		}
+	}
+}
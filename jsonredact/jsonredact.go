@@ -0,0 +1,114 @@
+// Package jsonredact removes or masks fields of JSON responses, e.g. to meet
+// compliance requirements for responses proxied from legacy backends. The
+// responses are filtered as they are written, without buffering whole
+// payloads.
+package jsonredact
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ErrContentEncoding is reported to OnError for JSON responses with a
+// Content-Encoding, e.g. gzip. They can't be filtered, so their bodies are
+// dropped rather than passed unfiltered.
+var ErrContentEncoding = errors.New("jsonredact: encoded responses can't be filtered")
+
+// isJSON reports whether contentType is a JSON media type, e.g.
+// application/json or application/problem+json.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || mediaType == "application/x-ndjson" || strings.HasSuffix(mediaType, "+json")
+}
+
+// Middleware implements the http.Handler interface. It filters JSON
+// responses of the handler, other responses are passed as is.
+type Middleware struct {
+	handler http.Handler
+	rules   Rules
+
+	// OnError, if not nil, is called when a response can't be filtered,
+	// e.g. because it is not valid JSON. The rest of such response is
+	// dropped.
+	OnError func(r *http.Request, err error)
+}
+
+// New returns an http.Handler that filters JSON responses of h with rules.
+func New(h http.Handler, rules Rules) *Middleware {
+	return &Middleware{
+		handler: h,
+		rules:   rules,
+	}
+}
+
+// responseWriter filters the response body if it is JSON.
+type responseWriter struct {
+	http.ResponseWriter
+	m *Middleware
+	r *http.Request
+
+	wroteHeader bool
+	filter      *Filter
+	err         error
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	h := rw.Header()
+	if isJSON(h.Get("Content-Type")) {
+		h.Del("Content-Length")
+		rw.filter = NewFilter(rw.ResponseWriter, rw.m.rules)
+		if enc := h.Get("Content-Encoding"); enc != "" && enc != "identity" {
+			rw.fail(ErrContentEncoding)
+		}
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) fail(err error) {
+	if rw.err == nil {
+		rw.err = err
+		if rw.m.OnError != nil {
+			rw.m.OnError(rw.r, err)
+		}
+	}
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.filter == nil {
+		return rw.ResponseWriter.Write(p)
+	}
+	if rw.err != nil {
+		return 0, rw.err
+	}
+	n, err := rw.filter.Write(p)
+	if err == ErrSyntax {
+		rw.fail(err)
+	}
+	return n, err
+}
+
+func (rw *responseWriter) close() {
+	if rw.filter != nil && rw.err == nil {
+		if err := rw.filter.Close(); err != nil {
+			rw.fail(err)
+		}
+	}
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rw := &responseWriter{ResponseWriter: w, m: m, r: r}
+	defer rw.close()
+	m.handler.ServeHTTP(rw, r)
+}
@@ -0,0 +1,53 @@
+package jsonredact
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	var errs []error
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/text":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(`{"ssn": "123"}`))
+		case "/broken":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id": 1, "ssn" "123"}`))
+		default:
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Header().Set("Content-Length", "38")
+			w.Write([]byte(`{"id": 1, `))
+			w.Write([]byte(`"ssn": "123-45-6789"}`))
+		}
+	}), Rules{Mask: []string{"ssn"}})
+	m.OnError = func(r *http.Request, err error) {
+		errs = append(errs, err)
+	}
+
+	testCases := []struct {
+		path     string
+		expected string
+		errors   int
+	}{
+		{"/", `{"id":1,"ssn":"[REDACTED]"}`, 0},
+		{"/text", `{"ssn": "123"}`, 0},
+		{"/broken", `{"id":1,"ssn":"[REDACTED]"`, 1},
+	}
+	for _, tc := range testCases {
+		errs = nil
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if body := rec.Body.String(); body != tc.expected {
+			t.Errorf("%s: body = %s, want %s", tc.path, body, tc.expected)
+		}
+		if len(errs) != tc.errors {
+			t.Errorf("%s: errors = %v, want %d errors", tc.path, errs, tc.errors)
+		}
+		if tc.path == "/" && rec.Header().Get("Content-Length") != "" {
+			t.Errorf("%s: Content-Length = %q, want it to be removed", tc.path, rec.Header().Get("Content-Length"))
+		}
+	}
+}
@@ -0,0 +1,286 @@
+// Package lifecycle runs start and shutdown hooks of components in dependency
+// order. A server usually has to stop accepting requests, drain the limiters,
+// flush caches and let metrics be scraped one last time, and every step
+// depends on the previous ones. Components register their hooks with a
+// Coordinator together with the names of the components they depend on, and
+// the coordinator runs the hooks in the right order.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrStarted is returned by Register after the coordinator has been started.
+var ErrStarted = errors.New("lifecycle: coordinator has been started")
+
+// Phase is a step of the life of a component.
+type Phase int
+
+const (
+	// Starting is the phase before the components serve requests.
+	Starting Phase = iota
+
+	// Ready is the phase when all components have started.
+	Ready
+
+	// Draining is the phase when the components finish the requests they
+	// have, e.g. with maxconnections.Limiter.Shutdown.
+	Draining
+
+	// Stopping is the phase when the components release their resources.
+	Stopping
+
+	// Stopped is the phase after all hooks have run.
+	Stopped
+)
+
+func (p Phase) String() string {
+	switch p {
+	case Starting:
+		return "starting"
+	case Ready:
+		return "ready"
+	case Draining:
+		return "draining"
+	case Stopping:
+		return "stopping"
+	case Stopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// Hook is a function that is run when a component enters a phase. It should
+// return when ctx is done.
+type Hook func(ctx context.Context) error
+
+// Hooks are the hooks of a component. Nil hooks are skipped.
+type Hooks struct {
+	// OnStart is run when the component is started. The components that
+	// it depends on have already been started.
+	OnStart Hook
+
+	// OnReady is run when all components have started.
+	OnReady Hook
+
+	// OnDrain is run when the shutdown begins. The components that depend
+	// on the component have already been drained.
+	OnDrain Hook
+
+	// OnStop is run when all components have been drained. The components
+	// that depend on the component have already been stopped.
+	OnStop Hook
+}
+
+// Shutdowner is implemented by middlewares that can be drained, e.g.
+// maxconnections.Limiter.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// DrainHooks returns Hooks that shut s down when the component is drained.
+func DrainHooks(s Shutdowner) Hooks {
+	return Hooks{OnDrain: s.Shutdown}
+}
+
+// HookError is returned when a hook fails.
+type HookError struct {
+	// Component is the name of the component whose hook has failed.
+	Component string
+
+	// Phase is the phase of the hook.
+	Phase Phase
+
+	// Err is the error returned by the hook.
+	Err error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("lifecycle: %s: %s hook: %v", e.Component, e.Phase, e.Err)
+}
+
+// Unwrap returns the error returned by the hook.
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// component is a registered component.
+type component struct {
+	name  string
+	hooks Hooks
+	deps  []string
+}
+
+// Coordinator runs hooks of components. Components should be registered
+// before Start.
+type Coordinator struct {
+	mu         sync.Mutex
+	components map[string]*component
+	names      []string // in the order of registration
+	phase      Phase
+	started    bool
+}
+
+// New returns a new Coordinator.
+func New() *Coordinator {
+	return &Coordinator{
+		components: make(map[string]*component),
+	}
+}
+
+// Register adds the component name with the given hooks. The component is
+// started after and stopped before the components deps. The dependencies may
+// be registered later, but before Start.
+func (c *Coordinator) Register(name string, hooks Hooks, deps ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.started {
+		return ErrStarted
+	}
+	if _, ok := c.components[name]; ok {
+		return fmt.Errorf("lifecycle: component %s is already registered", name)
+	}
+	c.components[name] = &component{name: name, hooks: hooks, deps: deps}
+	c.names = append(c.names, name)
+	return nil
+}
+
+// order returns the components sorted so that every component follows its
+// dependencies. Independent components keep the order of registration. It
+// should be called with mu held.
+func (c *Coordinator) order() ([]*component, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(c.components))
+	var sorted []*component
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("lifecycle: dependency cycle: %v", append(path, name))
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		comp := c.components[name]
+		for _, dep := range comp.deps {
+			if _, ok := c.components[dep]; !ok {
+				return fmt.Errorf("lifecycle: component %s depends on unknown component %s", name, dep)
+			}
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		sorted = append(sorted, comp)
+		return nil
+	}
+	for _, name := range c.names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// setPhase changes the current phase.
+func (c *Coordinator) setPhase(p Phase) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.phase = p
+}
+
+// Phase returns the current phase.
+func (c *Coordinator) Phase() Phase {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.phase
+}
+
+// Ready reports whether all components have started and the shutdown hasn't
+// begun. It can be used for readiness probes.
+func (c *Coordinator) Ready() bool {
+	return c.Phase() == Ready
+}
+
+// run runs the hook of the given phase of every component in the given
+// order. If stopOnError is true, it stops at the first failure, otherwise
+// it runs all hooks. It returns the first error.
+func run(ctx context.Context, components []*component, phase Phase, hook func(Hooks) Hook, stopOnError bool) error {
+	var first error
+	for _, comp := range components {
+		h := hook(comp.hooks)
+		if h == nil {
+			continue
+		}
+		if err := h(ctx); err != nil {
+			err = &HookError{Component: comp.name, Phase: phase, Err: err}
+			if stopOnError {
+				return err
+			}
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// Start runs OnStart hooks of the components, dependencies first, and then
+// their OnReady hooks in the same order. It stops at the first failure; the
+// components that have been started are not stopped, Shutdown should be
+// called for that. Start can be called only once.
+func (c *Coordinator) Start(ctx context.Context) error {
+	c.mu.Lock()
+	if c.started {
+		c.mu.Unlock()
+		return ErrStarted
+	}
+	c.started = true
+	components, err := c.order()
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := run(ctx, components, Starting, func(h Hooks) Hook { return h.OnStart }, true); err != nil {
+		return err
+	}
+	if err := run(ctx, components, Ready, func(h Hooks) Hook { return h.OnReady }, true); err != nil {
+		return err
+	}
+	c.setPhase(Ready)
+	return nil
+}
+
+// Shutdown runs OnDrain hooks of the components, dependent components first,
+// and then their OnStop hooks in the same order. All hooks are run even if
+// some of them fail or ctx is done, and the first error is returned.
+func (c *Coordinator) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	components, err := c.order()
+	c.started = true
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for i, j := 0, len(components)-1; i < j; i, j = i+1, j-1 {
+		components[i], components[j] = components[j], components[i]
+	}
+
+	c.setPhase(Draining)
+	drainErr := run(ctx, components, Draining, func(h Hooks) Hook { return h.OnDrain }, false)
+	c.setPhase(Stopping)
+	stopErr := run(ctx, components, Stopping, func(h Hooks) Hook { return h.OnStop }, false)
+	c.setPhase(Stopped)
+	if drainErr != nil {
+		return drainErr
+	}
+	return stopErr
+}
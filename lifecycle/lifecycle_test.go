@@ -0,0 +1,111 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestOrder(t *testing.T) {
+	var calls []string
+	hooks := func(name string) Hooks {
+		record := func(phase string) Hook {
+			return func(ctx context.Context) error {
+				calls = append(calls, phase+":"+name)
+				return nil
+			}
+		}
+		return Hooks{
+			OnStart: record("start"),
+			OnReady: record("ready"),
+			OnDrain: record("drain"),
+			OnStop:  record("stop"),
+		}
+	}
+
+	c := New()
+	// The server depends on the limiter, which depends on the cache, which
+	// depends on the metrics.
+	mustRegister(t, c, "server", hooks("server"), "limiter")
+	mustRegister(t, c, "limiter", hooks("limiter"), "cache")
+	mustRegister(t, c, "metrics", hooks("metrics"))
+	mustRegister(t, c, "cache", hooks("cache"), "metrics")
+
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start() = %v, want nil", err)
+	}
+	if !c.Ready() {
+		t.Fatalf("Ready() = false after Start")
+	}
+	if err := c.Register("late", Hooks{}); err != ErrStarted {
+		t.Fatalf("Register() = %v after Start, want %v", err, ErrStarted)
+	}
+	if err := c.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() = %v, want nil", err)
+	}
+	if phase := c.Phase(); phase != Stopped {
+		t.Fatalf("Phase() = %s, want %s", phase, Stopped)
+	}
+
+	expected := "start:metrics start:cache start:limiter start:server " +
+		"ready:metrics ready:cache ready:limiter ready:server " +
+		"drain:server drain:limiter drain:cache drain:metrics " +
+		"stop:server stop:limiter stop:cache stop:metrics"
+	if got := strings.Join(calls, " "); got != expected {
+		t.Fatalf("calls:\n%s\nwant:\n%s", got, expected)
+	}
+}
+
+func mustRegister(t *testing.T, c *Coordinator, name string, hooks Hooks, deps ...string) {
+	t.Helper()
+	if err := c.Register(name, hooks, deps...); err != nil {
+		t.Fatalf("Register(%q) = %v, want nil", name, err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	c := New()
+	mustRegister(t, c, "a", Hooks{}, "b")
+	mustRegister(t, c, "b", Hooks{}, "a")
+	if err := c.Register("a", Hooks{}); err == nil {
+		t.Fatalf("Register() = nil for a duplicate component")
+	}
+	if err := c.Start(context.Background()); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Fatalf("Start() = %v, want a dependency cycle error", err)
+	}
+
+	c = New()
+	mustRegister(t, c, "a", Hooks{}, "missing")
+	if err := c.Start(context.Background()); err == nil || !strings.Contains(err.Error(), "unknown component missing") {
+		t.Fatalf("Start() = %v, want an unknown component error", err)
+	}
+
+	failure := errors.New("flush failed")
+	var stopped []string
+	c = New()
+	mustRegister(t, c, "cache", Hooks{
+		OnDrain: func(ctx context.Context) error { return failure },
+		OnStop: func(ctx context.Context) error {
+			stopped = append(stopped, "cache")
+			return nil
+		},
+	})
+	mustRegister(t, c, "metrics", Hooks{
+		OnStop: func(ctx context.Context) error {
+			stopped = append(stopped, "metrics")
+			return nil
+		},
+	})
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start() = %v, want nil", err)
+	}
+	err := c.Shutdown(context.Background())
+	var hookErr *HookError
+	if !errors.As(err, &hookErr) || hookErr.Component != "cache" || hookErr.Phase != Draining || !errors.Is(err, failure) {
+		t.Fatalf("Shutdown() = %v, want the drain error of cache", err)
+	}
+	if len(stopped) != 2 {
+		t.Fatalf("stopped = %v, want all components to be stopped", stopped)
+	}
+}
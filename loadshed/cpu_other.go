@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package loadshed
+
+import "time"
+
+// processCPUTime returns the user and system CPU time used by the process.
+// It is not available on this system.
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,163 @@
+// Package loadshed rejects a fraction of requests while the process is under
+// resource pressure: high CPU usage, memory usage, GC pauses or number of
+// goroutines. It complements maxconnections, which protects against too
+// many concurrent requests, but not against a few memory-heavy ones.
+package loadshed
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dmage/middleware/decisionlog"
+)
+
+// defaultInterval is the default sampling interval.
+const defaultInterval = time.Second
+
+// defaultFraction is the default fraction of rejected requests.
+const defaultFraction = 0.5
+
+func defaultOverloadHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "503 service is overloaded, please try again later", http.StatusServiceUnavailable)
+}
+
+// OverloadHandler is a default OverloadHandler for Middleware.
+var OverloadHandler http.Handler = http.HandlerFunc(defaultOverloadHandler)
+
+// Thresholds are the limits of Signals, see Signals for the meaning of the
+// fields. Zero values disable the corresponding checks.
+type Thresholds struct {
+	// CPU is a fraction of the available cores, e.g. 0.9.
+	CPU float64
+
+	// RSS is the resident set size in bytes. It should be set below the
+	// memory limit of the container with some margin for requests that are
+	// already running.
+	RSS uint64
+
+	GCPause    time.Duration
+	Goroutines int
+}
+
+// Exceeded reports whether s exceeds any of the thresholds.
+func (t Thresholds) Exceeded(s Signals) bool {
+	return (t.CPU > 0 && s.CPU >= t.CPU) ||
+		(t.RSS > 0 && s.RSS >= t.RSS) ||
+		(t.GCPause > 0 && s.GCPause >= t.GCPause) ||
+		(t.Goroutines > 0 && s.Goroutines >= t.Goroutines)
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler    http.Handler
+	thresholds Thresholds
+	sampler    sampler
+
+	// lastSample is the time of the latest sample in nanoseconds, it is
+	// used to let only one request take a sample.
+	lastSample int64
+
+	// shedding is non-zero while the thresholds are exceeded.
+	shedding int32
+	shed     int64
+
+	// mu protects signals.
+	mu      sync.Mutex
+	signals Signals
+
+	// Interval is how often the signals are sampled. Sampling stops the
+	// world for a short time to read memory statistics. By default it is
+	// one second.
+	Interval time.Duration
+
+	// Fraction is the fraction of requests that are rejected while the
+	// thresholds are exceeded. By default it is 0.5.
+	Fraction float64
+
+	// OverloadHandler is called for rejected requests.
+	OverloadHandler http.Handler
+
+	// sample allows to override the sampler for tests.
+	sample func() Signals
+
+	// random allows to override rand.Float64 for tests.
+	random func() float64
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// New returns an http.Handler that passes requests to h, but rejects a part
+// of them while the signals of the process exceed thresholds.
+func New(thresholds Thresholds, h http.Handler) *Middleware {
+	m := &Middleware{
+		handler:         h,
+		thresholds:      thresholds,
+		OverloadHandler: OverloadHandler,
+		random:          rand.Float64,
+		now:             time.Now,
+	}
+	m.sample = m.sampler.sample
+	return m
+}
+
+// Signals returns the latest sampled signals.
+func (m *Middleware) Signals() Signals {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.signals
+}
+
+// Shedding reports whether the thresholds were exceeded at the latest
+// sample.
+func (m *Middleware) Shedding() bool {
+	return atomic.LoadInt32(&m.shedding) != 0
+}
+
+// Shed returns the number of rejected requests.
+func (m *Middleware) Shed() int64 {
+	return atomic.LoadInt64(&m.shed)
+}
+
+// update takes a new sample if the previous one is older than Interval.
+func (m *Middleware) update() {
+	interval := m.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	now := m.now().UnixNano()
+	last := atomic.LoadInt64(&m.lastSample)
+	if now-last < int64(interval) || !atomic.CompareAndSwapInt64(&m.lastSample, last, now) {
+		return
+	}
+
+	s := m.sample()
+	m.mu.Lock()
+	m.signals = s
+	m.mu.Unlock()
+	if m.thresholds.Exceeded(s) {
+		atomic.StoreInt32(&m.shedding, 1)
+	} else {
+		atomic.StoreInt32(&m.shedding, 0)
+	}
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.update()
+	if m.Shedding() {
+		fraction := m.Fraction
+		if fraction <= 0 {
+			fraction = defaultFraction
+		}
+		if m.random() < fraction {
+			atomic.AddInt64(&m.shed, 1)
+			decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "loadshed", Action: decisionlog.Deny, Reason: "shedding"})
+			m.OverloadHandler.ServeHTTP(w, r)
+			return
+		}
+	}
+	m.handler.ServeHTTP(w, r)
+}
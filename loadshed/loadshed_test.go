@@ -0,0 +1,89 @@
+package loadshed
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestThresholds(t *testing.T) {
+	thresholds := Thresholds{CPU: 0.9, RSS: 1 << 30, Goroutines: 1000}
+	testCases := []struct {
+		signals  Signals
+		exceeded bool
+	}{
+		{Signals{CPU: 0.5, RSS: 1 << 20, Goroutines: 10}, false},
+		{Signals{CPU: 0.95}, true},
+		{Signals{RSS: 2 << 30}, true},
+		{Signals{Goroutines: 1000}, true},
+		{Signals{GCPause: time.Second}, false}, // the check is disabled
+	}
+	for _, tc := range testCases {
+		if exceeded := thresholds.Exceeded(tc.signals); exceeded != tc.exceeded {
+			t.Errorf("Exceeded(%+v) = %v, want %v", tc.signals, exceeded, tc.exceeded)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	m := New(Thresholds{RSS: 100}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	now := time.Unix(0, 0)
+	m.now = func() time.Time {
+		return now
+	}
+	signals := Signals{RSS: 50}
+	samples := 0
+	m.sample = func() Signals {
+		samples++
+		return signals
+	}
+	random := 0.0
+	m.random = func() float64 {
+		random += 0.25
+		if random >= 1 {
+			random = 0
+		}
+		return random
+	}
+
+	serve := func(n int) (rejected int) {
+		for i := 0; i < n; i++ {
+			rec := httptest.NewRecorder()
+			m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			if rec.Code == http.StatusServiceUnavailable {
+				rejected++
+			}
+		}
+		return rejected
+	}
+
+	now = now.Add(time.Second)
+	if rejected := serve(4); rejected != 0 {
+		t.Fatalf("rejected = %d, want 0", rejected)
+	}
+	if samples != 1 {
+		t.Fatalf("samples = %d, want 1", samples)
+	}
+
+	// The memory usage grows, but the next sample is not taken yet.
+	signals.RSS = 200
+	if rejected := serve(4); rejected != 0 {
+		t.Fatalf("rejected = %d before the next sample, want 0", rejected)
+	}
+
+	now = now.Add(time.Second)
+	m.Fraction = 0.5
+	if rejected := serve(4); rejected != 2 {
+		t.Fatalf("rejected = %d, want 2", rejected)
+	}
+	if !m.Shedding() || m.Shed() != 2 || m.Signals().RSS != 200 {
+		t.Fatalf("Shedding() = %v, Shed() = %d, Signals() = %+v", m.Shedding(), m.Shed(), m.Signals())
+	}
+
+	signals.RSS = 50
+	now = now.Add(time.Second)
+	if rejected := serve(4); rejected != 0 {
+		t.Fatalf("rejected = %d after recovery, want 0", rejected)
+	}
+}
@@ -0,0 +1,27 @@
+package loadshed
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// rss returns the resident set size of the process from /proc/self/statm.
+// If it cannot be read, the memory obtained by the runtime is returned.
+func rss(ms *runtime.MemStats) uint64 {
+	data, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return ms.Sys
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return ms.Sys
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return ms.Sys
+	}
+	return pages * uint64(os.Getpagesize())
+}
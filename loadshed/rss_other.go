@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package loadshed
+
+import "runtime"
+
+// rss returns the memory obtained by the runtime from the OS, which is an
+// approximation of the resident set size.
+func rss(ms *runtime.MemStats) uint64 {
+	return ms.Sys
+}
@@ -0,0 +1,72 @@
+package loadshed
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Signals are measurements of the process.
+type Signals struct {
+	// CPU is the CPU time used by the process since the previous sample
+	// divided by the wall time and GOMAXPROCS, so 1 means that all
+	// available cores are busy. It is 0 on systems where the process CPU
+	// time is not available.
+	CPU float64
+
+	// RSS is the resident set size of the process in bytes. On systems
+	// other than Linux it is the memory obtained by the Go runtime from the
+	// OS.
+	RSS uint64
+
+	// GCPause is the longest GC pause since the previous sample.
+	GCPause time.Duration
+
+	// Goroutines is the number of goroutines.
+	Goroutines int
+}
+
+// sampler reads Signals of the process.
+type sampler struct {
+	mu      sync.Mutex
+	last    time.Time
+	cpuTime time.Duration
+	numGC   uint32
+}
+
+// sample returns the current signals.
+func (s *sampler) sample() Signals {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	signals := Signals{
+		RSS:        rss(&ms),
+		Goroutines: runtime.NumGoroutine(),
+	}
+
+	// PauseNs is a circular buffer of recent pauses.
+	var pause uint64
+	n := ms.NumGC - s.numGC
+	if n > uint32(len(ms.PauseNs)) {
+		n = uint32(len(ms.PauseNs))
+	}
+	for i := uint32(0); i < n; i++ {
+		if p := ms.PauseNs[(ms.NumGC-i+255)%256]; p > pause {
+			pause = p
+		}
+	}
+	signals.GCPause = time.Duration(pause)
+	s.numGC = ms.NumGC
+
+	now := time.Now()
+	if cpuTime, ok := processCPUTime(); ok {
+		if !s.last.IsZero() && now.After(s.last) {
+			signals.CPU = float64(cpuTime-s.cpuTime) / float64(now.Sub(s.last)) / float64(runtime.GOMAXPROCS(0))
+		}
+		s.cpuTime = cpuTime
+	}
+	s.last = now
+	return signals
+}
@@ -0,0 +1,32 @@
+package loadshed
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestSampler(t *testing.T) {
+	var s sampler
+	s.sample()
+
+	// Burn some CPU and trigger a GC.
+	deadline := time.Now().Add(20 * time.Millisecond)
+	for time.Now().Before(deadline) {
+	}
+	runtime.GC()
+
+	signals := s.sample()
+	if signals.RSS == 0 {
+		t.Errorf("RSS = 0, want a positive value")
+	}
+	if signals.Goroutines < 1 {
+		t.Errorf("Goroutines = %d, want at least 1", signals.Goroutines)
+	}
+	if signals.GCPause <= 0 {
+		t.Errorf("GCPause = %s, want a positive value", signals.GCPause)
+	}
+	if _, ok := processCPUTime(); ok && signals.CPU <= 0 {
+		t.Errorf("CPU = %v, want a positive value", signals.CPU)
+	}
+}
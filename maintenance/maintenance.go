@@ -0,0 +1,138 @@
+// Package maintenance takes a service down for maintenance without
+// redeploying it. While the maintenance mode is enabled, the middleware
+// responds with 503 Service Unavailable to all requests or to the matching
+// ones, so that clients back off instead of hitting half-migrated data.
+//
+// The mode is toggled at runtime with Enable and Disable, or through
+// AdminHandler. Requests matched by Skip, e.g. health checks, are passed to
+// the handler regardless, so that the orchestrator doesn't restart the
+// instances that are in maintenance.
+package maintenance
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/dmage/middleware/decisionlog"
+)
+
+func defaultMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "503 service is under maintenance, please try again later", http.StatusServiceUnavailable)
+}
+
+// MaintenanceHandler is a default MaintenanceHandler for Middleware.
+var MaintenanceHandler http.Handler = http.HandlerFunc(defaultMaintenanceHandler)
+
+// Stats contains counters collected by Middleware.
+type Stats struct {
+	// Enabled reports whether the maintenance mode is enabled.
+	Enabled bool `json:"enabled"`
+
+	// Rejected is the total number of requests that have been rejected
+	// because of the maintenance.
+	Rejected int64 `json:"rejected"`
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler  http.Handler
+	enabled  int32
+	rejected int64
+
+	// Match, if not nil, reports whether the request is affected by the
+	// maintenance, e.g. maxconnections.MatchPattern("POST /orders/"). By
+	// default all requests are affected.
+	Match func(r *http.Request) bool
+
+	// Skip, if not nil, reports whether the request is passed to the
+	// handler even if it matches, e.g. maxconnections.SkipPaths("/healthz").
+	Skip func(r *http.Request) bool
+
+	// RetryAfter, if positive, is sent in the Retry-After header of the
+	// rejected requests.
+	RetryAfter time.Duration
+
+	// MaintenanceHandler is called for requests that are rejected because
+	// of the maintenance, e.g. to serve a maintenance page.
+	MaintenanceHandler http.Handler
+}
+
+// New returns an http.Handler that passes requests to h unless the
+// maintenance mode is enabled. The mode is disabled initially.
+func New(h http.Handler) *Middleware {
+	return &Middleware{
+		handler:            h,
+		MaintenanceHandler: MaintenanceHandler,
+	}
+}
+
+// Enable enables the maintenance mode. It is safe to call it while the
+// middleware is serving requests.
+func (m *Middleware) Enable() {
+	atomic.StoreInt32(&m.enabled, 1)
+}
+
+// Disable disables the maintenance mode.
+func (m *Middleware) Disable() {
+	atomic.StoreInt32(&m.enabled, 0)
+}
+
+// Enabled reports whether the maintenance mode is enabled.
+func (m *Middleware) Enabled() bool {
+	return atomic.LoadInt32(&m.enabled) != 0
+}
+
+// Stats returns a snapshot of the collected counters.
+func (m *Middleware) Stats() Stats {
+	return Stats{
+		Enabled:  m.Enabled(),
+		Rejected: atomic.LoadInt64(&m.rejected),
+	}
+}
+
+// AdminHandler returns an http.Handler that reports the state of the
+// maintenance mode on GET and changes it on POST with the form value
+// enabled, e.g. "enabled=true". It lets anybody take the service down, so it
+// should be served only to operators, like /debug/vars.
+func (m *Middleware) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD":
+		case "POST":
+			enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+			if err != nil {
+				http.Error(w, "400 enabled should be true or false", http.StatusBadRequest)
+				return
+			}
+			if enabled {
+				m.Enable()
+			} else {
+				m.Disable()
+			}
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "{\"enabled\": %t}\n", m.Enabled())
+	})
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !m.Enabled() ||
+		(m.Match != nil && !m.Match(r)) ||
+		(m.Skip != nil && m.Skip(r)) {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+	atomic.AddInt64(&m.rejected, 1)
+	decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "maintenance", Action: decisionlog.Deny, Reason: "maintenance mode"})
+	if m.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((m.RetryAfter+time.Second-1)/time.Second)))
+	}
+	m.MaintenanceHandler.ServeHTTP(w, r)
+}
@@ -0,0 +1,78 @@
+package maintenance
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+func TestMaintenance(t *testing.T) {
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	m.Match = maxconnections.MatchPattern("/api/")
+	m.Skip = maxconnections.SkipPaths("/api/healthz")
+	m.RetryAfter = 90 * time.Second
+
+	testCases := []struct {
+		path   string
+		status int
+	}{
+		{"/api/orders", http.StatusServiceUnavailable},
+		{"/api/healthz", http.StatusOK},
+		{"/static/app.js", http.StatusOK},
+	}
+	for _, enabled := range []bool{false, true} {
+		if enabled {
+			m.Enable()
+		}
+		for _, tc := range testCases {
+			status := tc.status
+			if !enabled {
+				status = http.StatusOK
+			}
+			rec := httptest.NewRecorder()
+			m.ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+			if rec.Code != status {
+				t.Errorf("enabled=%t %s: status = %d, want %d", enabled, tc.path, rec.Code, status)
+			}
+			if rec.Code == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") != "90" {
+				t.Errorf("%s: Retry-After = %q, want 90", tc.path, rec.Header().Get("Retry-After"))
+			}
+		}
+	}
+	if stats := m.Stats(); !stats.Enabled || stats.Rejected != 1 {
+		t.Fatalf("stats = %+v, want enabled with 1 rejected request", stats)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	admin := m.AdminHandler()
+
+	testCases := []struct {
+		method, body string
+		status       int
+		enabled      bool
+	}{
+		{"POST", "enabled=true", http.StatusOK, true},
+		{"GET", "", http.StatusOK, true},
+		{"POST", "enabled=maybe", http.StatusBadRequest, true},
+		{"DELETE", "", http.StatusMethodNotAllowed, true},
+		{"POST", "enabled=false", http.StatusOK, false},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(tc.method, "/debug/maintenance", strings.NewReader(tc.body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, r)
+		if rec.Code != tc.status {
+			t.Errorf("%s %q: status = %d, want %d", tc.method, tc.body, rec.Code, tc.status)
+		}
+		if m.Enabled() != tc.enabled {
+			t.Errorf("%s %q: Enabled() = %t, want %t", tc.method, tc.body, m.Enabled(), tc.enabled)
+		}
+	}
+}
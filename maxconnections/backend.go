@@ -0,0 +1,63 @@
+package maxconnections
+
+import (
+	"context"
+	"time"
+)
+
+// Lease is a set of running units taken from a Backend.
+type Lease interface {
+	// Release returns the units to the backend.
+	Release(ctx context.Context) error
+}
+
+// Backend accounts running units shared by several middlewares, possibly in
+// different processes. The middleware still enforces its own limits, a
+// request that is admitted locally additionally needs a lease from the
+// backend.
+type Backend interface {
+	// TryAcquire tries to take n units without waiting. It returns a nil
+	// Lease if there are not enough free units.
+	TryAcquire(ctx context.Context, n int) (Lease, error)
+}
+
+// defaultBackendRetryInterval is the default value of BackendRetryInterval.
+const defaultBackendRetryInterval = 10 * time.Millisecond
+
+// acquireBackend waits for a lease of n units from the backend. The request
+// can wait for the lease no longer than its maximum wait in the queue.
+func (l *Limiter) acquireBackend(ctx context.Context, n int) (Lease, error) {
+	interval := l.BackendRetryInterval
+	if interval <= 0 {
+		interval = defaultBackendRetryInterval
+	}
+
+	var timeout <-chan time.Time
+	if maxWait := l.maxWait(ctx); maxWait > 0 {
+		timer := l.startTimer(maxWait)
+		defer l.stopTimer(timer)
+		timeout = timer.C()
+	}
+
+	for {
+		lease, err := l.Backend.TryAcquire(ctx, n)
+		if err != nil {
+			return nil, err
+		}
+		if lease != nil {
+			return lease, nil
+		}
+
+		retry := l.startTimer(interval)
+		select {
+		case <-retry.C():
+			l.stopTimer(retry)
+		case <-timeout:
+			l.stopTimer(retry)
+			return nil, ErrOverloaded
+		case <-ctx.Done():
+			l.stopTimer(retry)
+			return nil, ErrCanceled
+		}
+	}
+}
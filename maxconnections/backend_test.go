@@ -0,0 +1,98 @@
+package maxconnections
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeBackend struct {
+	mu   sync.Mutex
+	max  int
+	used int
+	err  error
+}
+
+type fakeLease struct {
+	b *fakeBackend
+	n int
+}
+
+func (l fakeLease) Release(ctx context.Context) error {
+	l.b.mu.Lock()
+	defer l.b.mu.Unlock()
+	l.b.used -= l.n
+	return nil
+}
+
+func (b *fakeBackend) TryAcquire(ctx context.Context, n int) (Lease, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.used+n > b.max {
+		return nil, nil
+	}
+	b.used += n
+	return fakeLease{b: b, n: n}, nil
+}
+
+func TestBackend(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	backend := &fakeBackend{max: 1}
+	handlerBarrier := make(chan struct{})
+	started := make(chan struct{})
+	h := New(2, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-handlerBarrier
+	}))
+	h.Backend = backend
+	h.BackendRetryInterval = time.Millisecond
+
+	done := make(chan int)
+	serve := func() {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		done <- rr.Code
+	}
+
+	go serve()
+	<-started
+	go serve()
+
+	// The second request is admitted locally, but waits for the backend.
+	waitRunning(t, h, 2, timeout)
+	select {
+	case <-started:
+		t.Fatal("the second request is started while the backend is full")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	handlerBarrier <- struct{}{}
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", code, http.StatusOK)
+	}
+	select {
+	case <-started:
+	case <-time.After(timeout):
+		t.Fatal("timeout while waiting for the second request to start")
+	}
+	handlerBarrier <- struct{}{}
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", code, http.StatusOK)
+	}
+
+	backend.err = errors.New("backend is down")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status code = %d when the backend fails, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	waitRunning(t, h, 0, timeout)
+}
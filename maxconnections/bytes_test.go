@@ -0,0 +1,59 @@
+package maxconnections
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBytes(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := New(10, 10, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > 0 {
+			started <- struct{}{}
+			<-release
+		}
+	}))
+	h.Bytes = NewLimiter(100, 0)
+
+	upload := func(size int) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", size))))
+		return rec.Code
+	}
+
+	codes := make(chan int)
+	go func() {
+		codes <- upload(60)
+	}()
+	<-started
+
+	if code := upload(60); code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the upload over the byte budget to be rejected", code)
+	}
+	if code := upload(200); code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the upload larger than the budget to be rejected", code)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want requests without a body to pass", rec.Code)
+	}
+	if stats := h.Stats(); stats.Running != 1 {
+		t.Fatalf("running = %d, want the rejected uploads to release their units", stats.Running)
+	}
+
+	close(release)
+	if code := <-codes; code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	waitRunning(t, h, 0, timeout)
+	if running := h.Bytes.Stats().Running; running != 0 {
+		t.Fatalf("bytes running = %d, want 0", running)
+	}
+}
@@ -0,0 +1,87 @@
+package maxconnections
+
+import (
+	"mime"
+	"net/http"
+)
+
+// Classes of requests returned by ClassifyUploads.
+const (
+	ClassUpload  = "upload"
+	ClassDefault = "default"
+)
+
+// Class is a named class of requests for Classify.
+type Class struct {
+	// Name is the name of the class, e.g. the name of a bucket of
+	// Partitioned or of a limiter for SelectByName.
+	Name string
+
+	// Match reports whether the request belongs to the class.
+	Match func(r *http.Request) bool
+}
+
+// Classify returns a function that returns the Name of the first of classes
+// that matches the request, or def if none of them does. It can be used as
+// Partitioned.Classify and as the name function of SelectByName.
+func Classify(def string, classes ...Class) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		for _, c := range classes {
+			if c.Match(r) {
+				return c.Name
+			}
+		}
+		return def
+	}
+}
+
+// HasContentType returns a function that reports whether the media type of
+// the request body is one of mediaTypes, e.g. "multipart/form-data".
+// Parameters of the Content-Type header, such as boundary, are ignored.
+func HasContentType(mediaTypes ...string) func(r *http.Request) bool {
+	set := make(map[string]bool, len(mediaTypes))
+	for _, t := range mediaTypes {
+		set[t] = true
+	}
+	return func(r *http.Request) bool {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		return err == nil && set[mediaType]
+	}
+}
+
+// IsMultipart reports whether the request has a multipart/form-data body,
+// which is how browsers upload files.
+var IsMultipart = HasContentType("multipart/form-data")
+
+// BodyLargerThan returns a function that reports whether the request body
+// is larger than n bytes. A body of unknown length, e.g. a chunked one, is
+// considered large, as nothing limits its size.
+func BodyLargerThan(n int64) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		if r.ContentLength < 0 {
+			return r.Body != nil && r.Body != http.NoBody
+		}
+		return r.ContentLength > n
+	}
+}
+
+// ClassifyUploads returns a classifier that puts multipart uploads and
+// requests with bodies larger than threshold bytes into ClassUpload and
+// other requests into ClassDefault, so that heavy ingest traffic gets its
+// own small running pool and doesn't take the headroom of lightweight API
+// calls:
+//
+//	m := maxconnections.New(100, 100, h)
+//	m.Select = maxconnections.SelectByName(map[string]*maxconnections.Limiter{
+//		maxconnections.ClassUpload:  maxconnections.NewLimiter(4, 10),
+//		maxconnections.ClassDefault: m.Limiter,
+//	}, maxconnections.ClassifyUploads(1<<20))
+func ClassifyUploads(threshold int64) func(r *http.Request) string {
+	large := BodyLargerThan(threshold)
+	return Classify(ClassDefault, Class{
+		Name: ClassUpload,
+		Match: func(r *http.Request) bool {
+			return IsMultipart(r) || large(r)
+		},
+	})
+}
@@ -0,0 +1,79 @@
+package maxconnections
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClassifyUploads(t *testing.T) {
+	classify := ClassifyUploads(1024)
+	newRequest := func(contentType string, body io.Reader, length int64) *http.Request {
+		r := httptest.NewRequest("POST", "/", body)
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		r.ContentLength = length
+		return r
+	}
+	testCases := []struct {
+		name     string
+		r        *http.Request
+		expected string
+	}{
+		{"get", httptest.NewRequest("GET", "/", nil), ClassDefault},
+		{"small json", newRequest("application/json", strings.NewReader("{}"), 2), ClassDefault},
+		{"multipart", newRequest("multipart/form-data; boundary=x", strings.NewReader("--x--"), 5), ClassUpload},
+		{"large", newRequest("application/octet-stream", strings.NewReader(""), 2048), ClassUpload},
+		{"chunked", newRequest("application/json", strings.NewReader("{}"), -1), ClassUpload},
+		{"invalid content type", newRequest("multipart/", strings.NewReader(""), 0), ClassDefault},
+	}
+	for _, tc := range testCases {
+		if got := classify(tc.r); got != tc.expected {
+			t.Errorf("%s: class = %q, want %q", tc.name, got, tc.expected)
+		}
+	}
+}
+
+func TestClassifySelect(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	m := New(10, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IsMultipart(r) {
+			started <- struct{}{}
+			<-release
+		}
+	}))
+	uploads := NewLimiter(1, 0)
+	m.Select = SelectByName(map[string]*Limiter{
+		ClassUpload:  uploads,
+		ClassDefault: m.Limiter,
+	}, Classify(ClassDefault, Class{Name: ClassUpload, Match: IsMultipart}))
+
+	upload := func() *http.Request {
+		r := httptest.NewRequest("POST", "/upload", strings.NewReader("--x--"))
+		r.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+		return r
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.ServeHTTP(httptest.NewRecorder(), upload())
+	}()
+	<-started
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, upload())
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the second upload to be rejected", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/api", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want API calls to keep their headroom", rec.Code)
+	}
+	close(release)
+	<-done
+}
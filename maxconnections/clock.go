@@ -0,0 +1,63 @@
+package maxconnections
+
+import "time"
+
+// Clock is a source of time for a Limiter. It allows to control time in tests
+// of code that uses the middleware.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTimer returns a timer that fires after d.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer created by a Clock, see time.Timer.
+type Timer interface {
+	// C returns the channel on which the timer delivers its time.
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing. It returns false if the timer
+	// has already fired or been stopped.
+	Stop() bool
+}
+
+// SystemClock is the Clock of the time package. Limiters use it by default.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+// systemTimer is a Timer of SystemClock.
+type systemTimer struct {
+	t *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t systemTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+// now returns the current time of the limiter clock.
+func (l *Limiter) now() time.Time {
+	return clockNow(l.Clock)
+}
+
+// clockNow returns the current time of the clock c, or of SystemClock if c is
+// nil.
+func clockNow(c Clock) time.Time {
+	if c != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,96 @@
+package maxconnections
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// testClock is a Clock with overridable functions. Functions that are nil
+// fall back to SystemClock.
+type testClock struct {
+	now      func() time.Time
+	newTimer func(d time.Duration) Timer
+}
+
+func (c *testClock) Now() time.Time {
+	if c.now == nil {
+		return SystemClock.Now()
+	}
+	return c.now()
+}
+
+func (c *testClock) NewTimer(d time.Duration) Timer {
+	if c.newTimer == nil {
+		return SystemClock.NewTimer(d)
+	}
+	return c.newTimer(d)
+}
+
+// chanTimer is a Timer that fires when a value is sent to the channel or the
+// channel is closed.
+type chanTimer chan time.Time
+
+func (t chanTimer) C() <-chan time.Time {
+	return t
+}
+
+func (t chanTimer) Stop() bool {
+	return true
+}
+
+func TestClock(t *testing.T) {
+	fire := make(chan time.Time)
+	var timeouts []time.Duration
+	l := NewLimiter(1, 1)
+	l.MaxWaitInQueue = time.Minute
+	l.Clock = &testClock{
+		newTimer: func(d time.Duration) Timer {
+			timeouts = append(timeouts, d)
+			return chanTimer(fire)
+		},
+	}
+
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire() = %v, want nil", err)
+	}
+	defer release()
+
+	errs := make(chan error)
+	go func() {
+		_, err := l.Acquire(context.Background())
+		errs <- err
+	}()
+	fire <- time.Time{}
+	if err := <-errs; err != ErrOverloaded {
+		t.Fatalf("Acquire() = %v, want %v", err, ErrOverloaded)
+	}
+	if len(timeouts) != 1 || timeouts[0] != time.Minute {
+		t.Fatalf("timeouts = %v, want [%v]", timeouts, time.Minute)
+	}
+}
+
+func TestQueueTimeoutJitter(t *testing.T) {
+	l := NewLimiter(1, 1)
+	l.MaxWaitInQueue = time.Minute
+	l.QueueTimeoutJitter = 0.5
+	for _, tc := range []struct {
+		random   float64
+		expected time.Duration
+	}{
+		{0, 30 * time.Second},
+		{0.5, time.Minute},
+		{0.75, 75 * time.Second},
+	} {
+		l.random = func() float64 { return tc.random }
+		if d := l.maxWait(context.Background()); d != tc.expected {
+			t.Errorf("maxWait() with random %g = %s, want %s", tc.random, d, tc.expected)
+		}
+	}
+
+	// Requests without a queue timeout don't get one.
+	if d := l.maxWait(WithMaxQueueWait(context.Background(), 0)); d != 0 {
+		t.Errorf("maxWait() without a timeout = %s, want 0", d)
+	}
+}
@@ -0,0 +1,106 @@
+package maxconnections
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// connCloserCleanupInterval is the number of new clients after which expired
+// counters are removed.
+const connCloserCleanupInterval = 1024
+
+// rejections counts the rejections of a client within a window.
+type rejections struct {
+	start time.Time
+	count int
+}
+
+// ConnCloser asks persistently rejected clients to close their connections.
+// Keeping hot keep-alive connections to an overloaded instance prolongs the
+// incident, while new connections are spread by the load balancer to other
+// replicas.
+//
+// When a client has been rejected Rejections times within Window, its
+// rejections get the "Connection: close" header. HTTP/1 servers close the
+// connection after the response, the HTTP/2 server of net/http removes the
+// header and sends GOAWAY, so that the client opens a new connection for
+// further requests.
+type ConnCloser struct {
+	// Key returns the key of the client. By default it is RemoteAddrKey.
+	Key func(r *http.Request) string
+
+	// Rejections is the number of rejections within Window after which the
+	// connections of the client are closed.
+	Rejections int
+
+	// Window is the period within which rejections are counted.
+	Window time.Duration
+
+	maxKeys int
+
+	mu      sync.Mutex
+	clients map[string]*rejections
+	inserts int
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// NewConnCloser returns a ConnCloser that closes the connections of clients
+// that have been rejected n times within window. Up to maxKeys clients are
+// tracked at the same time, others are not counted until the counters of
+// tracked clients expire.
+func NewConnCloser(n int, window time.Duration, maxKeys int) *ConnCloser {
+	return &ConnCloser{
+		Key:        RemoteAddrKey,
+		Rejections: n,
+		Window:     window,
+		maxKeys:    maxKeys,
+		clients:    make(map[string]*rejections),
+		now:        time.Now,
+	}
+}
+
+// cleanup removes expired counters. It should be called with mu held.
+func (c *ConnCloser) cleanup(now time.Time) {
+	for key, rej := range c.clients {
+		if now.Sub(rej.start) >= c.Window {
+			delete(c.clients, key)
+		}
+	}
+}
+
+// reject counts a rejection of the client of r and reports whether its
+// connection should be closed.
+func (c *ConnCloser) reject(r *http.Request) bool {
+	key := c.Key(r)
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rej := c.clients[key]
+	if rej == nil {
+		if c.inserts++; c.inserts%connCloserCleanupInterval == 0 {
+			c.cleanup(now)
+		}
+		if len(c.clients) >= c.maxKeys {
+			return false
+		}
+		rej = &rejections{start: now}
+		c.clients[key] = rej
+	} else if now.Sub(rej.start) >= c.Window {
+		*rej = rejections{start: now}
+	}
+	rej.count++
+	return rej.count >= c.Rejections
+}
+
+// Rejected counts a rejection of the client of r and, if the client has been
+// rejected too often, sets "Connection: close" on w. Middlewares call it
+// before they call the handlers of rejected requests.
+func (c *ConnCloser) Rejected(w http.ResponseWriter, r *http.Request) {
+	if c.reject(r) {
+		w.Header().Set("Connection", "close")
+	}
+}
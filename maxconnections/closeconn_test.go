@@ -0,0 +1,46 @@
+package maxconnections
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConnCloser(t *testing.T) {
+	now := time.Unix(0, 0)
+	m := New(0, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	m.CloseConnections = NewConnCloser(3, time.Second, 1)
+	m.CloseConnections.now = func() time.Time {
+		return now
+	}
+
+	serve := func(addr string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, r)
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+		}
+		return rec.Header().Get("Connection")
+	}
+
+	for i, expected := range []string{"", "", "close", "close"} {
+		if v := serve("192.0.2.1:1234"); v != expected {
+			t.Fatalf("rejection %d: Connection = %q, want %q", i, v, expected)
+		}
+	}
+
+	// Only one client is tracked.
+	for i := 0; i < 3; i++ {
+		if v := serve("192.0.2.2:1234"); v != "" {
+			t.Fatalf("untracked client: Connection = %q, want none", v)
+		}
+	}
+
+	now = now.Add(time.Second)
+	if v := serve("192.0.2.1:1234"); v != "" {
+		t.Fatalf("after the window: Connection = %q, want none", v)
+	}
+}
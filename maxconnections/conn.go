@@ -0,0 +1,57 @@
+package maxconnections
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// connSeq is the last identifier assigned by ConnContext.
+var connSeq uint64
+
+type connKey struct{}
+
+// ConnContext is a function for http.Server.ConnContext that marks the
+// requests of each connection with a unique identifier, see ConnKey.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, atomic.AddUint64(&connSeq, 1))
+}
+
+// ConnKey returns a key that identifies the client connection of the
+// request. Requests multiplexed over the same HTTP/2 connection share the
+// key. It uses the identifier set by ConnContext, if the server has it,
+// otherwise the local and the remote addresses, which may be reused by a
+// later connection of the same client.
+func ConnKey(r *http.Request) string {
+	if id, ok := r.Context().Value(connKey{}).(uint64); ok {
+		return "conn-" + strconv.FormatUint(id, 10)
+	}
+	local := ""
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		local = addr.String()
+	}
+	return local + "|" + r.RemoteAddr
+}
+
+// NewPerConnection returns an http.Handler that runs no more than maxStreams
+// requests of the same client connection at the same time. It can enqueue up
+// to maxInQueue requests per connection. Up to maxConns connections are
+// tracked at the same time.
+//
+// A single HTTP/2 client can multiplex many streams over one connection, and
+// the server admits up to http2.Server.MaxConcurrentStreams of them, so
+// without a per-connection limit one client can occupy the entire running
+// budget of a global limiter that is wrapped by this middleware:
+//
+//	global := maxconnections.New(100, 100, h)
+//	srv := &http.Server{
+//		Handler:     maxconnections.NewPerConnection(10, 10, 10000, global),
+//		ConnContext: maxconnections.ConnContext,
+//	}
+func NewPerConnection(maxStreams, maxInQueue, maxConns int, h http.Handler) *Keyed {
+	k := NewKeyed(maxStreams, maxInQueue, maxConns, h)
+	k.Key = ConnKey
+	return k
+}
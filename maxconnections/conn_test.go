@@ -0,0 +1,59 @@
+package maxconnections
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestPerConnection(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	k := NewPerConnection(1, 0, 10, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+
+	conn1 := ConnContext(context.Background(), nil)
+	conn2 := ConnContext(context.Background(), nil)
+	if ConnKey(httptest.NewRequest("GET", "/", nil).WithContext(conn1)) == ConnKey(httptest.NewRequest("GET", "/", nil).WithContext(conn2)) {
+		t.Fatalf("connections share a key")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		k.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(conn1))
+	}()
+	<-started
+
+	// Another stream of the same connection is rejected.
+	rec := httptest.NewRecorder()
+	k.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil).WithContext(conn1))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the second stream to be rejected", rec.Code)
+	}
+
+	// Other connections are not affected.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		k.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(conn2))
+	}()
+	<-started
+	close(release)
+	wg.Wait()
+}
+
+func TestConnKeyWithoutConnContext(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}))
+	if key := ConnKey(r); key != "10.0.0.1:443|192.0.2.1:1234" {
+		t.Fatalf("ConnKey() = %q", key)
+	}
+}
@@ -0,0 +1,71 @@
+package maxconnections
+
+import "context"
+
+// Criticality is the importance of a request. When the limiter is busy, less
+// critical requests are rejected first, see Limiter.SheddableThreshold.
+type Criticality int
+
+const (
+	// Critical requests are never shed. It is the default criticality.
+	Critical Criticality = iota
+
+	// DegradedOK requests can be shed when the limiter is almost full,
+	// e.g. requests whose failure degrades the page but doesn't break it.
+	DegradedOK
+
+	// Sheddable requests are shed first, e.g. prefetches and analytics.
+	Sheddable
+)
+
+func (c Criticality) String() string {
+	switch c {
+	case Critical:
+		return "critical"
+	case DegradedOK:
+		return "degraded-ok"
+	case Sheddable:
+		return "sheddable"
+	}
+	return "unknown"
+}
+
+type criticalityKey struct{}
+
+// WithCriticality returns a copy of ctx that marks requests with c.
+func WithCriticality(ctx context.Context, c Criticality) context.Context {
+	return context.WithValue(ctx, criticalityKey{}, c)
+}
+
+// CriticalityFromContext returns the criticality of the request with ctx.
+// Requests without a criticality are Critical.
+func CriticalityFromContext(ctx context.Context) Criticality {
+	c, _ := ctx.Value(criticalityKey{}).(Criticality)
+	return c
+}
+
+// shed reports whether a request with ctx should be rejected because of its
+// criticality.
+func (l *Limiter) shed(ctx context.Context) bool {
+	if l.SheddableThreshold <= 0 && l.DegradedOKThreshold <= 0 {
+		return false
+	}
+	var thresholds []float64
+	switch CriticalityFromContext(ctx) {
+	case Sheddable:
+		// Sheddable requests are less critical than DegradedOK ones, so
+		// they are shed at both thresholds.
+		thresholds = []float64{l.SheddableThreshold, l.DegradedOKThreshold}
+	case DegradedOK:
+		thresholds = []float64{l.DegradedOKThreshold}
+	default:
+		return false
+	}
+	utilization := float64(l.runningUnits()) / float64(l.effectiveMaxRunning())
+	for _, threshold := range thresholds {
+		if threshold > 0 && utilization >= threshold {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package maxconnections
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCriticality(t *testing.T) {
+	l := NewLimiter(10, 0)
+	l.SheddableThreshold = 0.5
+	l.DegradedOKThreshold = 0.8
+
+	ctx := func(c Criticality) context.Context {
+		return WithCriticality(context.Background(), c)
+	}
+	var releases []func()
+	acquire := func(c Criticality) error {
+		release, err := l.Acquire(ctx(c))
+		if err == nil {
+			releases = append(releases, release)
+		}
+		return err
+	}
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+
+	testCases := []struct {
+		running     int
+		criticality Criticality
+		err         error
+	}{
+		{0, Sheddable, nil},
+		{4, Sheddable, nil},
+		{5, Sheddable, ErrOverloaded},
+		{5, DegradedOK, nil},
+		{7, DegradedOK, nil},
+		{8, DegradedOK, ErrOverloaded},
+		{8, Critical, nil},
+		{9, Critical, nil},
+	}
+	for _, tc := range testCases {
+		for l.runningUnits() < tc.running {
+			if err := acquire(Critical); err != nil {
+				t.Fatalf("Acquire() = %v, want nil", err)
+			}
+		}
+		if err := acquire(tc.criticality); err != tc.err {
+			t.Errorf("running %d: Acquire(%s) = %v, want %v", tc.running, tc.criticality, err, tc.err)
+		}
+	}
+	if stats := l.Stats(); stats.Shed != 2 {
+		t.Fatalf("Shed = %d, want 2", stats.Shed)
+	}
+}
+
+func TestMiddlewareCriticality(t *testing.T) {
+	h := New(2, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.SheddableThreshold = 0.5
+	h.Criticality = func(r *http.Request) Criticality {
+		if r.URL.Path == "/prefetch" {
+			return Sheddable
+		}
+		return Critical
+	}
+
+	release, err := h.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire() = %v, want nil", err)
+	}
+	defer release()
+
+	for _, tc := range []struct {
+		path string
+		code int
+	}{
+		{"/prefetch", http.StatusServiceUnavailable},
+		{"/", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if rec.Code != tc.code {
+			t.Errorf("%s: status = %d, want %d", tc.path, rec.Code, tc.code)
+		}
+	}
+}
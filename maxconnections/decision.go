@@ -0,0 +1,97 @@
+package maxconnections
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Decision describes the rejection of a request.
+type Decision struct {
+	// Limiter is the Name of the limiter that has rejected the request.
+	Limiter string
+
+	// Key is the key of the request: the QueueKey of Middleware or the Key
+	// of Keyed.
+	Key string
+
+	// Reason is the cause of the rejection: "queue full", "queue timeout",
+	// "shed", "latency SLO" or "backend".
+	Reason string
+
+	// QueueLength is the number of requests that were queued when the
+	// request was rejected.
+	QueueLength int
+
+	// Wait is the time the request has been waiting before the rejection.
+	Wait time.Duration
+
+	// RetryAfter is a suggested delay before a retry: the estimated time
+	// until the queue is drained. It is zero if there is no estimate, see
+	// Limiter.EstimateQueueWait.
+	RetryAfter time.Duration
+}
+
+type rejectionKey struct{}
+
+// withRejection returns r with the rejected admission a in its context. The
+// Decision is built only if a handler asks for it, so that rejections stay
+// cheap under overload.
+func withRejection(r *http.Request, a admission) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), rejectionKey{}, a))
+}
+
+// DecisionFromContext returns the decision for a request rejected by
+// Middleware or Keyed. It returns false if the request hasn't been rejected.
+func DecisionFromContext(ctx context.Context) (Decision, bool) {
+	a, ok := ctx.Value(rejectionKey{}).(admission)
+	if !ok {
+		return Decision{}, false
+	}
+	d := Decision{
+		Key:         a.key,
+		Reason:      a.overload.String(),
+		QueueLength: a.queue.Length,
+		Wait:        a.wait,
+		RetryAfter:  a.queue.EstimatedWait,
+	}
+	if a.l != nil {
+		d.Limiter = a.l.Name
+		if d.QueueLength == 0 || d.RetryAfter == 0 {
+			// The request hasn't met the queue, e.g. it has been shed,
+			// so the queue is looked at now.
+			a.l.mu.Lock()
+			status := a.l.rejectedStatus()
+			a.l.mu.Unlock()
+			if d.QueueLength == 0 {
+				d.QueueLength = status.Length
+			}
+			if d.RetryAfter == 0 {
+				d.RetryAfter = status.EstimatedWait
+			}
+		}
+	}
+	return d, true
+}
+
+// OverloadHandlerFunc is an http.Handler for rejected requests that gets the
+// Decision of the rejection, so that it can build a response with the
+// details the limiter knows about:
+//
+//	m.OverloadHandler = maxconnections.OverloadHandlerFunc(func(w http.ResponseWriter, r *http.Request, d maxconnections.Decision) {
+//		if d.RetryAfter > 0 {
+//			w.Header().Set("Retry-After", strconv.Itoa(int(d.RetryAfter/time.Second)+1))
+//		}
+//		http.Error(w, "overloaded: "+d.Reason, http.StatusServiceUnavailable)
+//	})
+//
+// It can be used as OverloadHandler, QueueFullHandler and
+// QueueTimeoutHandler. If the request hasn't been rejected by Middleware or
+// Keyed, the Decision is empty.
+type OverloadHandlerFunc func(w http.ResponseWriter, r *http.Request, d Decision)
+
+// ServeHTTP calls f(w, r, d) with the decision of r.
+func (f OverloadHandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d, _ := DecisionFromContext(r.Context())
+	f(w, r, d)
+}
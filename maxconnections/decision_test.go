@@ -0,0 +1,101 @@
+package maxconnections
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOverloadHandlerFunc(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	m := New(1, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	m.Name = "api"
+	m.QueueKey = func(r *http.Request) string {
+		return r.Header.Get("X-Tenant")
+	}
+	var decision Decision
+	m.OverloadHandler = OverloadHandlerFunc(func(w http.ResponseWriter, r *http.Request, d Decision) {
+		decision = d
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}()
+	}
+	<-started
+	waitQueued(t, m, 1, time.Second)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Tenant", "alice")
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, r)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want the request to be rejected", rec.Code)
+	}
+	expected := Decision{Limiter: "api", Key: "alice", Reason: "queue full", QueueLength: 1}
+	decision.Wait = 0
+	if decision != expected {
+		t.Fatalf("decision = %+v, want %+v", decision, expected)
+	}
+
+	close(release)
+	<-started
+	wg.Wait()
+}
+
+func TestOverloadHandlerFuncKeyed(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	k := NewKeyed(1, 0, 10, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	k.Key = func(r *http.Request) string {
+		return "alice"
+	}
+	var decision Decision
+	k.OverloadHandler = OverloadHandlerFunc(func(w http.ResponseWriter, r *http.Request, d Decision) {
+		decision = d
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		k.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	<-started
+	k.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	close(release)
+	<-done
+
+	if decision.Key != "alice" || decision.Reason != "queue full" {
+		t.Fatalf("decision = %+v, want a rejection of alice because of the full queue", decision)
+	}
+}
+
+func TestDecisionFromContextWithoutRejection(t *testing.T) {
+	var called bool
+	OverloadHandlerFunc(func(w http.ResponseWriter, r *http.Request, d Decision) {
+		called = true
+		if d != (Decision{}) {
+			t.Errorf("decision = %+v, want an empty one", d)
+		}
+	}).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !called {
+		t.Fatal("the handler hasn't been called")
+	}
+	if _, ok := DecisionFromContext(httptest.NewRequest("GET", "/", nil).Context()); ok {
+		t.Fatal("DecisionFromContext() = true for a request that hasn't been rejected")
+	}
+}
@@ -0,0 +1,75 @@
+package maxconnections
+
+import (
+	"context"
+	"sync"
+)
+
+// Token holds running units of a limiter until it is released.
+type Token struct {
+	once    sync.Once
+	release func()
+}
+
+// Release frees the running units of the token. It is safe to call it more
+// than once.
+func (t *Token) Release() {
+	t.once.Do(t.release)
+}
+
+// AcquireDetached is like Acquire, but returns the running unit as a Token
+// that can be passed to the code that finishes the work, e.g. a goroutine
+// that outlives the request.
+func (l *Limiter) AcquireDetached(ctx context.Context) (*Token, error) {
+	release, err := l.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Token{release: release}, nil
+}
+
+type detachKey struct{}
+
+// detachable is the admission of a request that the handler can take over
+// from the middleware, see Middleware.Detachable.
+type detachable struct {
+	mu      sync.Mutex
+	token   *Token
+	release func()
+}
+
+// detach returns the token for the running units of the request.
+func (d *detachable) detach() *Token {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.token == nil {
+		d.token = &Token{release: d.release}
+	}
+	return d.token
+}
+
+// finish releases the running units of the request, unless they have been
+// detached.
+func (d *detachable) finish() {
+	d.mu.Lock()
+	detached := d.token != nil
+	d.mu.Unlock()
+	if !detached {
+		d.release()
+	}
+}
+
+// DetachFromContext takes over the running units of the request from the
+// middleware that admitted it, so that they are not released when the
+// handler returns. The caller must call Release of the token when the work
+// of the request is done, e.g. when a handler that responds with 202
+// Accepted finishes the work in a goroutine. Calling it again returns the
+// same token. It returns false if the middleware doesn't have Detachable
+// set.
+func DetachFromContext(ctx context.Context) (*Token, bool) {
+	d, ok := ctx.Value(detachKey{}).(*detachable)
+	if !ok {
+		return nil, false
+	}
+	return d.detach(), true
+}
@@ -0,0 +1,59 @@
+package maxconnections
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcquireDetached(t *testing.T) {
+	l := NewLimiter(1, 0)
+	token, err := l.AcquireDetached(context.Background())
+	if err != nil {
+		t.Fatalf("AcquireDetached() = %v, want nil", err)
+	}
+	if _, err := l.AcquireDetached(context.Background()); err != ErrOverloaded {
+		t.Fatalf("AcquireDetached() = %v, want %v", err, ErrOverloaded)
+	}
+	token.Release()
+	token.Release()
+	if running := l.Stats().Running; running != 0 {
+		t.Fatalf("running = %d after Release, want 0", running)
+	}
+}
+
+func TestDetachable(t *testing.T) {
+	tokens := make(chan *Token, 1)
+	h := New(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := DetachFromContext(r.Context())
+		if !ok {
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		tokens <- token
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d as DetachFromContext fails without Detachable", rec.Code, http.StatusOK)
+	}
+	if running := h.Stats().Running; running != 0 {
+		t.Fatalf("running = %d without Detachable, want 0", running)
+	}
+
+	h.Detachable = true
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	if running := h.Stats().Running; running != 1 {
+		t.Fatalf("running = %d after the handler has returned, want 1", running)
+	}
+	(<-tokens).Release()
+	if running := h.Stats().Running; running != 0 {
+		t.Fatalf("running = %d after Release, want 0", running)
+	}
+}
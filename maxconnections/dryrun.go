@@ -0,0 +1,62 @@
+package maxconnections
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// acquireDryRun admits a request that needs n running units without waiting,
+// and counts the decision that the limiter would have made, see DryRun. The
+// requests that run above the limit stand for the queue: a request is
+// counted as queued if the excess fits into the queue, and as rejected
+// otherwise.
+func (l *Limiter) acquireDryRun(ctx context.Context, n int, key string) (admission, error) {
+	l.mu.Lock()
+	closed, maxInQueue := l.closed, l.queueCapacity()
+	l.mu.Unlock()
+	if closed {
+		l.counters.count(ErrShutdown)
+		return admission{}, ErrShutdown
+	}
+
+	var err error
+	cause := overloadQueueFull
+	if l.shed(ctx) {
+		err, cause = ErrOverloaded, overloadShed
+	} else if l.sloShed() {
+		err, cause = ErrOverloaded, overloadSLO
+	}
+	running := atomic.AddInt64(&l.running, int64(n))
+	if l.Parent != nil {
+		// The units of Parent are released with the request.
+		atomic.AddInt64(&l.Parent.running, int64(n))
+	}
+	if excess := running - l.effectiveMaxRunning(); err == nil && excess > 0 {
+		if excess > int64(maxInQueue) {
+			err = ErrOverloaded
+		} else {
+			atomic.AddInt64(&l.counters.dryRunQueued, 1)
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&l.counters.dryRunRejected, 1)
+	}
+
+	l.counters.count(nil)
+	if l.Observer != nil {
+		l.Observer.Admitted(ctx, 0)
+	}
+	if l.Events != nil {
+		l.emit(Event{
+			Key:         key,
+			Cost:        n,
+			Criticality: CriticalityFromContext(ctx),
+			DryRun:      true,
+		}, err, cause)
+	}
+	a := admission{l: l, n: n}
+	if l.estimating() || l.LatencySLO > 0 {
+		a.start = l.now()
+	}
+	return a, nil
+}
@@ -0,0 +1,39 @@
+package maxconnections
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	events := NewEventChan(10)
+	l := NewLimiter(1, 1)
+	l.DryRun = true
+	l.Events = events.Send
+
+	var releases []func()
+	for i := 0; i < 3; i++ {
+		release, err := l.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire() = %v, want nil in the dry-run mode", err)
+		}
+		releases = append(releases, release)
+	}
+
+	stats := l.Stats()
+	if stats.Admitted != 3 || stats.Overloaded != 0 || stats.DryRunQueued != 1 || stats.DryRunRejected != 1 {
+		t.Fatalf("stats = %+v, want 3 admitted, 1 would-be queued and 1 would-be rejected", stats)
+	}
+	for i, outcome := range []string{OutcomeAdmitted, OutcomeAdmitted, "overloaded"} {
+		if e := <-events.C; e.Outcome != outcome || !e.DryRun {
+			t.Fatalf("event %d = %+v, want a dry-run %s", i, e, outcome)
+		}
+	}
+
+	for _, release := range releases {
+		release()
+	}
+	if running := l.Stats().Running; running != 0 {
+		t.Fatalf("running = %d, want 0", running)
+	}
+}
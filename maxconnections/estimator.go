@@ -0,0 +1,142 @@
+package maxconnections
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ewmaAlpha is the weight of a new observation in moving averages.
+const ewmaAlpha = 0.1
+
+// estimatorWindow is the number of recent observations from which the
+// percentiles of an estimator are computed.
+const estimatorWindow = 256
+
+// ewma is an exponentially weighted moving average.
+type ewma struct {
+	value       float64
+	initialized bool
+}
+
+func (e *ewma) observe(x float64) {
+	if !e.initialized {
+		e.value = x
+		e.initialized = true
+		return
+	}
+	e.value += ewmaAlpha * (x - e.value)
+}
+
+// estimator tracks the moving average and the recent observations of a
+// duration.
+type estimator struct {
+	mu      sync.Mutex
+	avg     ewma
+	samples [estimatorWindow]time.Duration
+	n       int // number of samples in the window
+	pos     int // position of the next sample
+}
+
+func (e *estimator) observe(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.avg.observe(float64(d))
+	e.samples[e.pos] = d
+	e.pos = (e.pos + 1) % estimatorWindow
+	if e.n < estimatorWindow {
+		e.n++
+	}
+}
+
+// average returns the moving average. It returns false if nothing has been
+// observed yet.
+func (e *estimator) average() (time.Duration, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return time.Duration(e.avg.value), e.avg.initialized
+}
+
+// percentile returns the p-th percentile, 0 < p <= 100, of the recent
+// observations. It returns false if nothing has been observed yet.
+func (e *estimator) percentile(p float64) (time.Duration, bool) {
+	e.mu.Lock()
+	sorted := make([]time.Duration, e.n)
+	copy(sorted, e.samples[:e.n])
+	e.mu.Unlock()
+	if len(sorted) == 0 {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(math.Ceil(p*float64(len(sorted))/100)) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i], true
+}
+
+// estimating reports whether the limiter tracks queue waits and service
+// times.
+func (l *Limiter) estimating() bool {
+	return l.DeadlineAware || l.EstimateQueueWait || l.TargetQueueWait > 0
+}
+
+// EstimateWait returns how long a new request that needs n running units
+// would wait in the queue, assuming that queued requests are served at the
+// rate observed recently. It returns false if there is no data for the
+// estimate, e.g. because neither EstimateQueueWait nor DeadlineAware is set.
+func (l *Limiter) EstimateWait(n int) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.estimatedWait(n)
+}
+
+// ServiceTime returns the moving average of the time handlers take to
+// process requests. It returns false if there is no data yet, see
+// EstimateQueueWait.
+func (l *Limiter) ServiceTime() (time.Duration, bool) {
+	return l.serviceTime.average()
+}
+
+// ServiceTimePercentile returns the p-th percentile, 0 < p <= 100, of recent
+// handler service times. It returns false if there is no data yet, see
+// EstimateQueueWait.
+func (l *Limiter) ServiceTimePercentile(p float64) (time.Duration, bool) {
+	return l.serviceTime.percentile(p)
+}
+
+// QueueWait returns the moving average of the time admitted requests have
+// waited in the queue. Requests admitted without queuing count as zero
+// waits. It returns false if there is no data yet, see EstimateQueueWait.
+func (l *Limiter) QueueWait() (time.Duration, bool) {
+	return l.queueWait.average()
+}
+
+// QueueWaitPercentile returns the p-th percentile, 0 < p <= 100, of the
+// recent waits of admitted requests in the queue. It returns false if there
+// is no data yet, see EstimateQueueWait.
+func (l *Limiter) QueueWaitPercentile(p float64) (time.Duration, bool) {
+	return l.queueWait.percentile(p)
+}
+
+// estimatedWait returns how long a request that needs n units would wait in
+// the queue, assuming that queued requests are served at the rate observed
+// recently. It returns false if there is no data for the estimate yet. It
+// should be called with mu held.
+func (l *Limiter) estimatedWait(n int) (time.Duration, bool) {
+	return l.waitFor(l.queuedCost + n)
+}
+
+// waitFor returns how long it takes to serve queued requests that need units
+// running units in total. It should be called with mu held.
+func (l *Limiter) waitFor(units int) (time.Duration, bool) {
+	maxRunning := int(l.effectiveMaxRunning())
+	serviceTime, ok := l.serviceTime.average()
+	if !ok || maxRunning <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(serviceTime) * float64(units) / float64(maxRunning)), true
+}
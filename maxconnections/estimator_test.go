@@ -0,0 +1,80 @@
+package maxconnections
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEstimatorPercentile(t *testing.T) {
+	var e estimator
+	if _, ok := e.percentile(50); ok {
+		t.Fatalf("percentile() = true without observations")
+	}
+	for i := 1; i <= 100; i++ {
+		e.observe(time.Duration(i) * time.Millisecond)
+	}
+	for _, tc := range []struct {
+		p    float64
+		want time.Duration
+	}{
+		{50, 50 * time.Millisecond},
+		{95, 95 * time.Millisecond},
+		{100, 100 * time.Millisecond},
+		{0, 1 * time.Millisecond},
+	} {
+		if got, _ := e.percentile(tc.p); got != tc.want {
+			t.Errorf("percentile(%v) = %v, want %v", tc.p, got, tc.want)
+		}
+	}
+
+	// Old observations leave the window.
+	for i := 0; i < estimatorWindow; i++ {
+		e.observe(time.Second)
+	}
+	if got, _ := e.percentile(1); got != time.Second {
+		t.Fatalf("percentile(1) = %v, want 1s", got)
+	}
+}
+
+func TestEstimates(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewLimiter(1, 1)
+	l.Clock = &testClock{now: func() time.Time { return now }}
+
+	if _, ok := l.EstimateWait(1); ok {
+		t.Fatalf("EstimateWait() = true without tracking")
+	}
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire() = %v, want nil", err)
+	}
+	release()
+	if _, ok := l.ServiceTime(); ok {
+		t.Fatalf("ServiceTime() = true without EstimateQueueWait")
+	}
+
+	l.EstimateQueueWait = true
+	release, err = l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire() = %v, want nil", err)
+	}
+	now = now.Add(200 * time.Millisecond)
+	release()
+
+	if d, ok := l.ServiceTime(); !ok || d != 200*time.Millisecond {
+		t.Fatalf("ServiceTime() = %v, %v, want 200ms", d, ok)
+	}
+	if d, ok := l.ServiceTimePercentile(99); !ok || d != 200*time.Millisecond {
+		t.Fatalf("ServiceTimePercentile(99) = %v, %v, want 200ms", d, ok)
+	}
+	if d, ok := l.QueueWait(); !ok || d != 0 {
+		t.Fatalf("QueueWait() = %v, %v, want 0 for a request that hasn't queued", d, ok)
+	}
+	if d, ok := l.EstimateWait(1); !ok || d != 200*time.Millisecond {
+		t.Fatalf("EstimateWait(1) = %v, %v, want 200ms", d, ok)
+	}
+	if d, ok := l.QueueWaitPercentile(50); !ok || d != 0 {
+		t.Fatalf("QueueWaitPercentile(50) = %v, %v, want 0", d, ok)
+	}
+}
@@ -0,0 +1,90 @@
+package maxconnections
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Event describes an admission decision of a limiter, see Limiter.Events.
+type Event struct {
+	// Time is the time of the decision.
+	Time time.Time `json:"time"`
+
+	// Limiter is the Name of the limiter.
+	Limiter string `json:"limiter,omitempty"`
+
+	// Key is the queue key of the request, see Middleware.QueueKey.
+	Key string `json:"key,omitempty"`
+
+	// Cost is the number of running units that the request needs.
+	Cost int `json:"cost"`
+
+	// Criticality is the criticality of the request.
+	Criticality Criticality `json:"criticality"`
+
+	// QueueWait is how long the request has waited for the decision.
+	QueueWait time.Duration `json:"queue_wait"`
+
+	// Outcome is "admitted" for admitted requests and the Reason of the
+	// rejection otherwise.
+	Outcome string `json:"outcome"`
+
+	// Cause is the cause of an "overloaded" rejection, e.g. "queue full"
+	// or "queue timeout".
+	Cause string `json:"cause,omitempty"`
+
+	// DryRun reports whether the limiter is in the DryRun mode. Such
+	// requests are admitted regardless of Outcome, which is the decision
+	// that the limiter would have made.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Brownout reports whether the request was admitted above the soft
+	// limit, see BrownoutFromContext.
+	Brownout bool `json:"brownout,omitempty"`
+}
+
+// OutcomeAdmitted is the Outcome of events of admitted requests.
+const OutcomeAdmitted = "admitted"
+
+// EventChan is a bounded buffer of events. Its Send method can be used as
+// Limiter.Events, events that don't fit into the buffer are dropped, so a
+// slow consumer doesn't slow down admission.
+type EventChan struct {
+	// C delivers the events.
+	C chan Event
+
+	dropped int64
+}
+
+// NewEventChan returns an EventChan that buffers up to size events.
+func NewEventChan(size int) *EventChan {
+	return &EventChan{C: make(chan Event, size)}
+}
+
+// Send puts e into the buffer, or drops it if the buffer is full.
+func (c *EventChan) Send(e Event) {
+	select {
+	case c.C <- e:
+	default:
+		atomic.AddInt64(&c.dropped, 1)
+	}
+}
+
+// Dropped returns the number of events that have been dropped.
+func (c *EventChan) Dropped() int64 {
+	return atomic.LoadInt64(&c.dropped)
+}
+
+// emit sends the event for the decision err about a request to Events.
+func (l *Limiter) emit(e Event, err error, cause overload) {
+	e.Time = l.now()
+	e.Limiter = l.Name
+	e.Outcome = OutcomeAdmitted
+	if err != nil {
+		e.Outcome = Reason(err)
+		if err == ErrOverloaded {
+			e.Cause = cause.String()
+		}
+	}
+	l.Events(e)
+}
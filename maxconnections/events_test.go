@@ -0,0 +1,41 @@
+package maxconnections
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	now := time.Unix(100, 0)
+	events := NewEventChan(2)
+	l := NewLimiter(1, 0)
+	l.Name = "api"
+	l.Events = events.Send
+	l.Clock = &testClock{now: func() time.Time { return now }}
+
+	a, err := l.acquire(context.Background(), 1, "client")
+	if err != nil {
+		t.Fatalf("acquire() = %v, want nil", err)
+	}
+	defer l.done(a)
+	if _, err := l.acquire(context.Background(), 1, "client"); err != ErrOverloaded {
+		t.Fatalf("acquire() = %v, want %v", err, ErrOverloaded)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.acquire(ctx, 1, "")
+
+	expected := []Event{
+		{Time: now, Limiter: "api", Key: "client", Cost: 1, Outcome: OutcomeAdmitted},
+		{Time: now, Limiter: "api", Key: "client", Cost: 1, Outcome: "overloaded", Cause: "queue full"},
+	}
+	for _, e := range expected {
+		if got := <-events.C; got != e {
+			t.Errorf("event = %+v, want %+v", got, e)
+		}
+	}
+	if dropped := events.Dropped(); dropped != 1 {
+		t.Fatalf("Dropped() = %d, want 1", dropped)
+	}
+}
@@ -0,0 +1,117 @@
+package maxconnections
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEvictOldest(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Unix(0, 0)
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	m := New(1, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	m.Clock = &testClock{now: func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}}
+	m.EvictOldest = true
+	m.MinEvictionAge = time.Second
+	m.QueueTimeoutHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGatewayTimeout)
+	})
+
+	codes := make(chan int, 3)
+	serve := func() {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		codes <- rec.Code
+	}
+	go serve()
+	<-started
+	go serve()
+	waitQueued(t, m, 1, time.Second)
+
+	// The queued request is too young to be evicted.
+	advance(time.Second / 2)
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the new request to be rejected", rec.Code)
+	}
+
+	advance(time.Second / 2)
+	go serve()
+	if code := <-codes; code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want the oldest request to be evicted with QueueTimeoutHandler", code)
+	}
+	waitQueued(t, m, 1, time.Second)
+
+	close(release)
+	<-started
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
+		}
+	}
+	if stats := m.Stats(); stats.Evicted != 1 || stats.QueueTimeout != 1 || stats.QueueFull != 1 {
+		t.Fatalf("stats = %+v, want 1 evicted request", stats)
+	}
+}
+
+func TestEvictOldestDeadlineAware(t *testing.T) {
+	now := time.Now()
+	l := New(1, 1, nil)
+	l.DeadlineAware = true
+	l.EvictOldest = true
+	l.Clock = &testClock{now: func() time.Time {
+		return now
+	}}
+
+	// One request with a service time of a second has finished and
+	// another one is running.
+	for i := 0; i < 2; i++ {
+		if _, err := l.enqueueRunning(context.Background(), 1, ""); err != nil {
+			t.Fatalf("enqueueRunning() = %v, want nil", err)
+		}
+		if i == 0 {
+			l.finish(1, now.Add(-time.Second))
+		}
+	}
+	errs := make(chan error)
+	go func() {
+		_, err := l.enqueueRunning(context.Background(), 1, "")
+		errs <- err
+	}()
+	waitQueued(t, l, 1, time.Second)
+
+	// The new request can't be served before its deadline, so the queued
+	// one isn't evicted for it.
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(10*time.Millisecond))
+	defer cancel()
+	if _, err := l.enqueueRunning(ctx, 1, ""); err != ErrOverloaded {
+		t.Fatalf("enqueueRunning() = %v, want %v", err, ErrOverloaded)
+	}
+	if stats := l.Stats(); stats.Queued != 1 || stats.Evicted != 0 {
+		t.Fatalf("stats = %+v, want the queued request to stay", stats)
+	}
+
+	l.finish(1, now)
+	if err := <-errs; err != nil {
+		t.Fatalf("enqueueRunning() = %v, want nil", err)
+	}
+}
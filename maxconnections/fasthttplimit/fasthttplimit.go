@@ -0,0 +1,111 @@
+// Package fasthttplimit limits the number of concurrent fasthttp requests
+// using maxconnections, with the same queueing, timeout and overload
+// semantics as for net/http:
+//
+//	l := maxconnections.NewLimiter(100, 1000)
+//	l.MaxWaitInQueue = time.Second
+//	srv := &fasthttp.Server{
+//		Handler: fasthttplimit.New(l, handler).Handler,
+//	}
+//
+// fasthttp runs hijack handlers after the request handler returns, so
+// hijacked connections don't hold running units.
+package fasthttplimit
+
+import (
+	"github.com/valyala/fasthttp"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+func defaultOverloadHandler(ctx *fasthttp.RequestCtx) {
+	ctx.Error("503 service is overloaded, please try again later", fasthttp.StatusServiceUnavailable)
+}
+
+// OverloadHandler is a default OverloadHandler for Middleware.
+var OverloadHandler fasthttp.RequestHandler = defaultOverloadHandler
+
+func defaultShutdownHandler(ctx *fasthttp.RequestCtx) {
+	ctx.Error("503 service is shutting down", fasthttp.StatusServiceUnavailable)
+}
+
+// ShutdownHandler is a default ShutdownHandler for Middleware.
+var ShutdownHandler fasthttp.RequestHandler = defaultShutdownHandler
+
+func defaultCanceledHandler(ctx *fasthttp.RequestCtx) {
+	ctx.SetStatusCode(maxconnections.StatusClientClosedRequest)
+}
+
+// CanceledHandler is a default CanceledHandler for Middleware.
+var CanceledHandler fasthttp.RequestHandler = defaultCanceledHandler
+
+// Middleware admits fasthttp requests through a maxconnections.Limiter.
+type Middleware struct {
+	// Limiter admits requests. It can be shared with net/http middlewares
+	// and gRPC interceptors.
+	*maxconnections.Limiter
+
+	// handler to invoke.
+	handler fasthttp.RequestHandler
+
+	// Skip, if not nil, reports whether the request bypasses the limiter,
+	// e.g. health checks.
+	Skip func(ctx *fasthttp.RequestCtx) bool
+
+	// Cost, if not nil, returns the number of running units that the
+	// request needs. If Cost returns a value less than 1, the request needs
+	// one unit.
+	Cost func(ctx *fasthttp.RequestCtx) int
+
+	// OverloadHandler is called for requests that are rejected with
+	// maxconnections.ErrOverloaded.
+	OverloadHandler fasthttp.RequestHandler
+
+	// ShutdownHandler is called for requests that are rejected because
+	// Shutdown has been called.
+	ShutdownHandler fasthttp.RequestHandler
+
+	// CanceledHandler is called for requests whose context is done before
+	// they are admitted.
+	CanceledHandler fasthttp.RequestHandler
+}
+
+// New returns a Middleware that passes requests admitted by l to h.
+func New(l *maxconnections.Limiter, h fasthttp.RequestHandler) *Middleware {
+	return &Middleware{
+		Limiter:         l,
+		handler:         h,
+		OverloadHandler: OverloadHandler,
+		ShutdownHandler: ShutdownHandler,
+		CanceledHandler: CanceledHandler,
+	}
+}
+
+// Handler is a fasthttp.RequestHandler.
+func (m *Middleware) Handler(ctx *fasthttp.RequestCtx) {
+	if m.Skip != nil && m.Skip(ctx) {
+		m.handler(ctx)
+		return
+	}
+	n := 1
+	if m.Cost != nil {
+		n = m.Cost(ctx)
+	}
+	// RequestCtx is a context.Context that is done when the server shuts
+	// down.
+	release, err := m.AcquireN(ctx, n)
+	switch err {
+	case nil:
+	case maxconnections.ErrShutdown:
+		m.ShutdownHandler(ctx)
+		return
+	case maxconnections.ErrCanceled:
+		m.CanceledHandler(ctx)
+		return
+	default:
+		m.OverloadHandler(ctx)
+		return
+	}
+	defer release()
+	m.handler(ctx)
+}
@@ -0,0 +1,52 @@
+package fasthttplimit
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+// newCtx returns an initialized RequestCtx for a request to uri.
+func newCtx(uri string) *fasthttp.RequestCtx {
+	var req fasthttp.Request
+	req.SetRequestURI(uri)
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, nil, nil)
+	return &ctx
+}
+
+func TestHandler(t *testing.T) {
+	l := maxconnections.NewLimiter(1, 0)
+	var nested *fasthttp.RequestCtx
+	var m *Middleware
+	m = New(l, func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) == "/outer" {
+			nested = newCtx("/inner")
+			m.Handler(nested)
+		}
+	})
+	m.Skip = func(ctx *fasthttp.RequestCtx) bool {
+		return string(ctx.Path()) == "/healthz"
+	}
+
+	ctx := newCtx("/outer")
+	m.Handler(ctx)
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusOK {
+		t.Fatalf("status = %d, want the first request to be admitted", code)
+	}
+	if code := nested.Response.StatusCode(); code != fasthttp.StatusServiceUnavailable {
+		t.Fatalf("nested status = %d, want the nested request to be rejected", code)
+	}
+	if stats := l.Stats(); stats.Running != 0 || stats.Admitted != 1 || stats.Overloaded != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	health := newCtx("/healthz")
+	l.SetMaxRunning(0)
+	m.Handler(health)
+	if code := health.Response.StatusCode(); code != fasthttp.StatusOK {
+		t.Fatalf("health check status = %d, want it to bypass the limiter", code)
+	}
+}
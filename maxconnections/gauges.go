@@ -0,0 +1,101 @@
+package maxconnections
+
+import "math"
+
+// Metric describes a metric of a Limiter, see Limiter.Describe. It allows to
+// bind the state of a limiter to any metrics system without the package
+// depending on its client library.
+type Metric struct {
+	// Name is the name of the metric, it is the JSON name of the field of
+	// Stats, e.g. "running" or "queue_full".
+	Name string
+
+	// Description is a human-readable description of the metric.
+	Description string
+
+	// Cumulative is true for counters that only grow, and false for
+	// gauges.
+	Cumulative bool
+
+	// Value returns the current value of the metric. Durations are in
+	// seconds.
+	Value func() float64
+}
+
+// Sample is a value of a metric read by Limiter.Read.
+type Sample struct {
+	// Name is the name of the metric.
+	Name string
+
+	// Value is the value of the metric. It is NaN if the limiter doesn't
+	// have such a metric.
+	Value float64
+}
+
+// metricDefinitions are the metrics of Limiter in the order of Describe.
+var metricDefinitions = []struct {
+	name        string
+	description string
+	cumulative  bool
+	value       func(s *Stats) float64
+}{
+	{"running", "Running units occupied by admitted requests.", false, func(s *Stats) float64 { return float64(s.Running) }},
+	{"max_running", "Maximum number of running units.", false, func(s *Stats) float64 { return float64(s.MaxRunning) }},
+	{"effective_max_running", "Maximum number of running units reduced by the slow start ramp.", false, func(s *Stats) float64 { return float64(s.EffectiveMaxRunning) }},
+	{"queued", "Requests waiting in the queue.", false, func(s *Stats) float64 { return float64(s.Queued) }},
+	{"max_in_queue", "Capacity of the queue.", false, func(s *Stats) float64 { return float64(s.MaxInQueue) }},
+	{"effective_max_in_queue", "Capacity of the queue derived from the target queue wait.", false, func(s *Stats) float64 { return float64(s.EffectiveMaxInQueue) }},
+	{"admitted", "Admitted requests.", true, func(s *Stats) float64 { return float64(s.Admitted) }},
+	{"overloaded", "Requests rejected because of overload.", true, func(s *Stats) float64 { return float64(s.Overloaded) }},
+	{"queue_full", "Overloaded requests rejected without waiting.", true, func(s *Stats) float64 { return float64(s.QueueFull) }},
+	{"queue_timeout", "Overloaded requests rejected after waiting in the queue.", true, func(s *Stats) float64 { return float64(s.QueueTimeout) }},
+	{"shed", "Overloaded requests rejected because of their criticality.", true, func(s *Stats) float64 { return float64(s.Shed) }},
+	{"slo_shed", "Overloaded requests rejected because of the latency SLO.", true, func(s *Stats) float64 { return float64(s.SLOShed) }},
+	{"latency_p95", "The p95 of recent service times in seconds.", false, func(s *Stats) float64 { return s.LatencyP95.Seconds() }},
+	{"slo_shed_fraction", "Fraction of requests rejected because of the latency SLO.", false, func(s *Stats) float64 { return s.SLOShedFraction }},
+	{"shutdown_rejected", "Requests rejected because of shutdown.", true, func(s *Stats) float64 { return float64(s.ShutdownRejected) }},
+	{"canceled", "Requests canceled before they were admitted.", true, func(s *Stats) float64 { return float64(s.Canceled) }},
+	{"queue_canceled", "Requests canceled while waiting in the queue.", true, func(s *Stats) float64 { return float64(s.QueueCanceled) }},
+	{"duplicates", "Requests rejected as duplicates of queued requests.", true, func(s *Stats) float64 { return float64(s.Duplicates) }},
+	{"dry_run_queued", "Requests that would have been queued without dry run.", true, func(s *Stats) float64 { return float64(s.DryRunQueued) }},
+	{"dry_run_rejected", "Requests that would have been rejected without dry run.", true, func(s *Stats) float64 { return float64(s.DryRunRejected) }},
+	{"paced", "Requests delayed by pacing.", true, func(s *Stats) float64 { return float64(s.Paced) }},
+	{"evicted", "Queued requests rejected to make place for new ones.", true, func(s *Stats) float64 { return float64(s.Evicted) }},
+	{"write_stall", "Time handlers have been blocked writing responses in seconds.", true, func(s *Stats) float64 { return s.WriteStall.Seconds() }},
+	{"stall_releases", "Releases of running units because of stalled writes.", true, func(s *Stats) float64 { return float64(s.StallReleases) }},
+	{"hijacked", "Requests that have hijacked their connections.", true, func(s *Stats) float64 { return float64(s.Hijacked) }},
+	{"streamed", "Requests that have moved to the streaming limiter.", true, func(s *Stats) float64 { return float64(s.Streamed) }},
+}
+
+// Describe returns the metrics of l. Each Metric.Value takes a snapshot of
+// the stats, use Read to get several metrics from one snapshot.
+func (l *Limiter) Describe() []Metric {
+	metrics := make([]Metric, len(metricDefinitions))
+	for i, def := range metricDefinitions {
+		value := def.value
+		metrics[i] = Metric{
+			Name:        def.name,
+			Description: def.description,
+			Cumulative:  def.cumulative,
+			Value: func() float64 {
+				stats := l.Stats()
+				return value(&stats)
+			},
+		}
+	}
+	return metrics
+}
+
+// Read sets the values of samples from a snapshot of the stats of l.
+func (l *Limiter) Read(samples []Sample) {
+	stats := l.Stats()
+	for i := range samples {
+		samples[i].Value = math.NaN()
+		for _, def := range metricDefinitions {
+			if def.name == samples[i].Name {
+				samples[i].Value = def.value(&stats)
+				break
+			}
+		}
+	}
+}
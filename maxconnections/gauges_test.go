@@ -0,0 +1,49 @@
+package maxconnections
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDescribe(t *testing.T) {
+	l := NewLimiter(2, 1)
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	values := map[string]float64{}
+	for _, m := range l.Describe() {
+		if m.Description == "" {
+			t.Errorf("%s has no description", m.Name)
+		}
+		values[m.Name] = m.Value()
+	}
+	if values["running"] != 1 || values["max_running"] != 2 || values["max_in_queue"] != 1 || values["admitted"] != 1 {
+		t.Fatalf("values = %v", values)
+	}
+
+	samples := []Sample{{Name: "running"}, {Name: "admitted"}, {Name: "unknown"}}
+	l.Read(samples)
+	if samples[0].Value != 1 || samples[1].Value != 1 || !math.IsNaN(samples[2].Value) {
+		t.Fatalf("Read() = %v", samples)
+	}
+}
+
+func TestDescribeCoversStats(t *testing.T) {
+	names := map[string]bool{}
+	for _, m := range NewLimiter(1, 0).Describe() {
+		names[m.Name] = true
+	}
+	typ := reflect.TypeOf(Stats{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if !names[name] {
+			t.Errorf("Stats.%s has no metric %q", typ.Field(i).Name, name)
+		}
+	}
+}
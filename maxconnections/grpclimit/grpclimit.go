@@ -0,0 +1,65 @@
+// Package grpclimit provides gRPC server interceptors that limit the number
+// of concurrent calls using maxconnections.
+package grpclimit
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+// Cost returns the number of running units for a call to fullMethod. A nil
+// Cost means one unit for every call.
+type Cost func(ctx context.Context, fullMethod string) int
+
+func (c Cost) units(ctx context.Context, fullMethod string) int {
+	if c == nil {
+		return 1
+	}
+	return c(ctx, fullMethod)
+}
+
+// statusError converts a rejection error to a gRPC status. Overloaded calls
+// get RESOURCE_EXHAUSTED, calls rejected during shutdown get UNAVAILABLE so
+// that clients can retry them on another server, and calls that were
+// canceled before admission get CANCELED.
+func statusError(err error) error {
+	switch err {
+	case maxconnections.ErrShutdown:
+		return status.Error(codes.Unavailable, err.Error())
+	case maxconnections.ErrCanceled:
+		return status.Error(codes.Canceled, err.Error())
+	}
+	return status.Error(codes.ResourceExhausted, err.Error())
+}
+
+// UnaryServerInterceptor returns an interceptor that admits unary calls
+// through l.
+func UnaryServerInterceptor(l *maxconnections.Limiter, cost Cost) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		release, err := l.AcquireN(ctx, cost.units(ctx, info.FullMethod))
+		if err != nil {
+			return nil, statusError(err)
+		}
+		defer release()
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns an interceptor that admits streaming calls
+// through l. A stream occupies its running units until the handler returns.
+func StreamServerInterceptor(l *maxconnections.Limiter, cost Cost) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := ss.Context()
+		release, err := l.AcquireN(ctx, cost.units(ctx, info.FullMethod))
+		if err != nil {
+			return statusError(err)
+		}
+		defer release()
+		return handler(srv, ss)
+	}
+}
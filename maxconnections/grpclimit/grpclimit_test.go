@@ -0,0 +1,70 @@
+package grpclimit
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ss serverStream) Context() context.Context {
+	return ss.ctx
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	l := maxconnections.NewLimiter(1, 0)
+	interceptor := UnaryServerInterceptor(l, nil)
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Service/Method"}
+
+	var nested error
+	_, err := interceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		_, nested = interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		return "ok", nil
+	})
+	if err != nil {
+		t.Fatalf("interceptor() = %v, want nil", err)
+	}
+	if code := status.Code(nested); code != codes.ResourceExhausted {
+		t.Fatalf("the nested call got code %s, want %s", code, codes.ResourceExhausted)
+	}
+
+	if _, err := interceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}); err != nil {
+		t.Fatalf("interceptor() after the first call has finished = %v, want nil", err)
+	}
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	l := maxconnections.NewLimiter(2, 0)
+	interceptor := StreamServerInterceptor(l, func(ctx context.Context, fullMethod string) int {
+		return 2
+	})
+	info := &grpc.StreamServerInfo{FullMethod: "/test.Service/Stream"}
+	ss := serverStream{ctx: context.Background()}
+
+	var nested error
+	err := interceptor(nil, ss, info, func(srv interface{}, stream grpc.ServerStream) error {
+		nested = interceptor(srv, stream, info, func(srv interface{}, stream grpc.ServerStream) error {
+			return nil
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("interceptor() = %v, want nil", err)
+	}
+	if code := status.Code(nested); code != codes.ResourceExhausted {
+		t.Fatalf("the nested call got code %s, want %s", code, codes.ResourceExhausted)
+	}
+}
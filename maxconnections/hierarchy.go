@@ -0,0 +1,139 @@
+package maxconnections
+
+import (
+	"container/list"
+	"net/http"
+	"sync/atomic"
+)
+
+// takeUnits takes n running units of l and, if l has Parent, of the parent
+// in one step: either the request gets both or it gets none. If waiting is
+// true, the request is at the head of the queue of l and l waits for the
+// parent in its turn if the parent has no free units, see takeChild. It
+// should be called with mu held.
+func (l *Limiter) takeUnits(n int, waiting bool) (bool, error) {
+	if _, ok := l.take(n); !ok {
+		if waiting && l.Parent != nil {
+			// The request waits for units of l, not of the parent.
+			l.Parent.unblock(l)
+		}
+		return false, nil
+	}
+	if l.Parent == nil {
+		return true, nil
+	}
+	ok, err := l.Parent.takeChild(l, n, waiting)
+	if !ok {
+		atomic.AddInt64(&l.running, -int64(n))
+	}
+	return ok, err
+}
+
+// takeChild takes n running units of l for a request of its child c. The
+// children whose queued requests wait for l are queued in blocked and get
+// freed units in turn, so new requests don't take units before them. If
+// waiting is true, the request of c is queued, and c is put at the back of
+// blocked if the request doesn't get the units.
+func (l *Limiter) takeChild(c *Limiter, n int, waiting bool) (bool, error) {
+	if _, ok, err := l.tryFast(n); ok || err != nil {
+		if ok {
+			atomic.AddInt64(&l.counters.admitted, 1)
+		}
+		return ok, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		l.updateSlow()
+		return false, ErrShutdown
+	}
+	atomic.StoreInt32(&l.slow, 1)
+	var e *list.Element
+	for e = l.blocked.Front(); e != nil && e.Value.(*Limiter) != c; e = e.Next() {
+	}
+	if l.waiting() == 0 && (l.blocked.Len() == 0 || l.blocked.Front() == e) {
+		if _, ok := l.take(n); ok {
+			if e != nil {
+				// Other children get the next units.
+				l.blocked.Remove(e)
+			}
+			l.updateSlow()
+			atomic.AddInt64(&l.counters.admitted, 1)
+			return true, nil
+		}
+	}
+	if waiting && e == nil {
+		l.blocked.PushBack(c)
+	}
+	l.updateSlow()
+	return false, nil
+}
+
+// unblock removes c from the children that wait for l. It should be called
+// with mu of c held.
+func (l *Limiter) unblock(c *Limiter) {
+	l.mu.Lock()
+	var front bool
+	for e := l.blocked.Front(); e != nil; e = e.Next() {
+		if e.Value.(*Limiter) == c {
+			front = e == l.blocked.Front()
+			l.blocked.Remove(e)
+			break
+		}
+	}
+	next := front && l.blocked.Len() > 0
+	l.updateSlow()
+	l.mu.Unlock()
+
+	if next {
+		// The next child might fit into the free units, but its mu
+		// cannot be taken while mu of c is held.
+		go l.notifyChildren()
+	}
+}
+
+// notifyChildren passes free running units of l to the children that wait
+// for them. It should be called without any mu held.
+func (l *Limiter) notifyChildren() {
+	for atomic.LoadInt32(&l.slow) != 0 {
+		l.mu.Lock()
+		e := l.blocked.Front()
+		l.mu.Unlock()
+		if e == nil {
+			return
+		}
+
+		c := e.Value.(*Limiter)
+		c.mu.Lock()
+		c.notify()
+		c.mu.Unlock()
+
+		l.mu.Lock()
+		blocked := l.blocked.Front() == e
+		l.mu.Unlock()
+		if blocked {
+			// The child still waits for units.
+			return
+		}
+	}
+}
+
+// NewHierarchical returns an http.Handler that runs no more than maxRunning
+// h at the same time for each key and queues up to maxInQueue requests for
+// each key, like NewKeyed, while all keys together run no more than
+// totalRunning h at the same time. The limiter of the total is Parent of the
+// returned Keyed and of the limiters of the keys. Requests of a key wait in
+// the queue of its limiter both for units of the key and for units of the
+// total, and the keys whose requests wait for the total get its units in
+// turn.
+func NewHierarchical(maxRunning, maxInQueue, totalRunning, maxKeys int, h http.Handler) *Keyed {
+	parent := NewLimiter(totalRunning, 0)
+	k := NewKeyedWithRegistry(NewRegistry(maxKeys, func(key string) *Limiter {
+		l := NewLimiter(maxRunning, maxInQueue)
+		l.Parent = parent
+		return l
+	}), h)
+	k.Parent = parent
+	return k
+}
@@ -0,0 +1,144 @@
+package maxconnections
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHierarchical(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	k := NewHierarchical(2, 0, 3, 10, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	k.Key = func(r *http.Request) string {
+		return r.Header.Get("X-Tenant")
+	}
+
+	var wg sync.WaitGroup
+	serve := func(tenant string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("X-Tenant", tenant)
+			k.ServeHTTP(httptest.NewRecorder(), r)
+		}()
+		<-started
+	}
+	status := func(tenant string) int {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Tenant", tenant)
+		rec := httptest.NewRecorder()
+		k.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	serve("a")
+	serve("a")
+	if code := status("a"); code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the third request of a tenant to be rejected", code)
+	}
+	serve("b")
+	if running := k.Parent.Stats().Running; running != 3 {
+		t.Fatalf("total running = %d, want 3", running)
+	}
+
+	// The total is exhausted and b has no queue to wait for it.
+	if code := status("b"); code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the request over the total to be rejected", code)
+	}
+	l, done, err := k.Get("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	if running := l.Stats().Running; running != 1 {
+		t.Fatalf("running of b = %d, want the rejected request not to take a unit", running)
+	}
+
+	close(release)
+	wg.Wait()
+	if running := k.Parent.Stats().Running; running != 0 {
+		t.Fatalf("total running = %d, want 0", running)
+	}
+}
+
+func TestParent(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	parent := NewLimiter(1, 0)
+	a := NewLimiter(1, 1)
+	a.Parent = parent
+	b := NewLimiter(1, 1)
+	b.Parent = parent
+	c := NewLimiter(1, 1)
+	c.Parent = parent
+
+	release, err := a.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admitted := make(chan string, 2)
+	wait := func(name string, l *Limiter) {
+		go func() {
+			release, err := l.Acquire(context.Background())
+			if err != nil {
+				t.Errorf("%s: Acquire() = %v, want nil", name, err)
+				admitted <- name
+				return
+			}
+			admitted <- name
+			release()
+		}()
+		deadline := time.Now().Add(timeout)
+		for l.Stats().Queued != 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: stats = %+v, want a queued request", name, l.Stats())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	wait("b", b)
+	wait("c", c)
+
+	// The queued requests don't hold the units of their limiters while
+	// they wait for the parent.
+	if running := b.Stats().Running + c.Stats().Running; running != 0 {
+		t.Fatalf("running = %d while the parent is full, want 0", running)
+	}
+	if _, err := c.Acquire(context.Background()); err != ErrOverloaded {
+		t.Fatalf("Acquire() = %v when the queue of c is full, want %v", err, ErrOverloaded)
+	}
+
+	// The children get the units of the parent in the order they have
+	// started to wait for them.
+	release()
+	for _, expected := range []string{"b", "c"} {
+		select {
+		case name := <-admitted:
+			if name != expected {
+				t.Fatalf("admitted %s, want %s", name, expected)
+			}
+		case <-time.After(timeout):
+			t.Fatalf("%s is not admitted", expected)
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for parent.Stats().Running != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("parent stats = %+v, want nothing running", parent.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats := parent.Stats(); stats.Admitted != 3 {
+		t.Fatalf("parent stats = %+v, want 3 admitted requests", stats)
+	}
+}
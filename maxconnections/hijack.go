@@ -0,0 +1,72 @@
+package maxconnections
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// hijackWriter moves the request from the limiter of the middleware to the
+// LongLived limiter when the handler hijacks the connection, e.g. to serve a
+// WebSocket.
+type hijackWriter struct {
+	http.ResponseWriter
+
+	m   *Middleware
+	ctx context.Context
+
+	// release frees the running units of the request in the limiter of
+	// the middleware. It is safe to call it more than once.
+	release func()
+}
+
+// Hijack lets the handler take over the connection, see http.Hijacker. The
+// connection occupies a running unit of LongLived until it is closed. If
+// LongLived has no free units, the connection is not hijacked and
+// ErrOverloaded is returned right away, so that the handler can still
+// respond to the request.
+func (hw *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	l := hw.m.LongLived
+	a, ok := l.tryAcquire(hw.ctx, 1)
+	if !ok {
+		return nil, nil, ErrOverloaded
+	}
+	conn, rw, err := http.NewResponseController(hw.ResponseWriter).Hijack()
+	if err != nil {
+		l.done(a)
+		return nil, nil, err
+	}
+	atomic.AddInt64(&hw.m.counters.hijacked, 1)
+	hw.release()
+	return &longLivedConn{Conn: conn, release: func() { l.done(a) }}, rw, nil
+}
+
+// FlushError flushes the response, see http.ResponseController.
+func (hw *hijackWriter) FlushError() error {
+	return http.NewResponseController(hw.ResponseWriter).Flush()
+}
+
+func (hw *hijackWriter) Flush() {
+	hw.FlushError()
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (hw *hijackWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+// longLivedConn releases its running unit of LongLived when it is closed.
+type longLivedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *longLivedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
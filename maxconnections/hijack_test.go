@@ -0,0 +1,104 @@
+package maxconnections
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// hijackRecorder is a ResponseRecorder that can be hijacked.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (rec *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return rec.conn, bufio.NewReadWriter(bufio.NewReader(rec.conn), bufio.NewWriter(rec.conn)), nil
+}
+
+func TestLongLived(t *testing.T) {
+	conns := make(chan net.Conn, 2)
+	m := New(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		// The connection outlives the handler, like a WebSocket served
+		// by its own goroutines.
+		conns <- conn
+	}))
+	m.LongLived = NewLimiter(1, 0)
+
+	hijack := func() int {
+		client, server := net.Pipe()
+		defer client.Close()
+		rec := &hijackRecorder{ResponseRecorder: httptest.NewRecorder(), conn: server}
+		m.ServeHTTP(rec, httptest.NewRequest("GET", "/ws", nil))
+		return rec.Code
+	}
+
+	if status := hijack(); status != http.StatusOK {
+		t.Fatalf("status = %d, want the connection to be hijacked", status)
+	}
+	if stats := m.Stats(); stats.Running != 0 || stats.Hijacked != 1 {
+		t.Fatalf("stats = %+v, want the running unit to be released on hijack", stats)
+	}
+	if running := m.LongLived.Stats().Running; running != 1 {
+		t.Fatalf("long-lived running = %d, want 1", running)
+	}
+
+	// The long-lived pool is full, but ordinary requests are still served.
+	if status := hijack(); status != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the second hijack to be rejected", status)
+	}
+	if stats := m.Stats(); stats.Running != 0 || stats.Admitted != 2 {
+		t.Fatalf("stats = %+v, want 2 admitted requests and nothing running", stats)
+	}
+
+	(<-conns).Close()
+	if running := m.LongLived.Stats().Running; running != 0 {
+		t.Fatalf("long-lived running = %d after the connection is closed, want 0", running)
+	}
+}
+
+func TestLongLivedFull(t *testing.T) {
+	m := New(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, err := http.NewResponseController(w).Hijack(); err != ErrOverloaded {
+			t.Errorf("Hijack() = %v, want %v", err, ErrOverloaded)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	// LongLived has place in the queue, but the hijack must not wait there
+	// while the request holds its unit.
+	m.LongLived = NewLimiter(1, 10)
+	release, err := m.LongLived.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	done := make(chan int)
+	go func() {
+		client, server := net.Pipe()
+		defer client.Close()
+		rec := &hijackRecorder{ResponseRecorder: httptest.NewRecorder(), conn: server}
+		m.ServeHTTP(rec, httptest.NewRequest("GET", "/ws", nil))
+		done <- rec.Code
+	}()
+	select {
+	case status := <-done:
+		if status != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d, want the hijack to be rejected", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the hijack waits in the queue of LongLived")
+	}
+	if queued := m.LongLived.Stats().Queued; queued != 0 {
+		t.Fatalf("long-lived queued = %d, want 0", queued)
+	}
+}
@@ -0,0 +1,108 @@
+package maxconnections
+
+import "net/http"
+
+// HostLimit is the limit of outbound requests to a host.
+type HostLimit = KeyLimit
+
+// HostRoundTripper implements the http.RoundTripper interface. It limits
+// the number of outbound requests that are in flight at the same time for
+// each destination host, so one slow upstream can't consume the whole
+// outbound budget while others sit idle. It can be combined with a
+// RoundTripper to cap the total number of outbound requests as well.
+type HostRoundTripper struct {
+	// Registry holds the limiters of the hosts.
+	*Registry
+
+	next http.RoundTripper
+
+	// Default is the limit of hosts that are not listed in Hosts.
+	Default HostLimit
+
+	// Hosts overrides Default for some hosts. The keys are the values of
+	// Key, by default the host and the port of the URL as in URL.Host. It
+	// should not be modified after the first request.
+	Hosts map[string]HostLimit
+
+	// Key returns the key of the destination of the request, see HostKey.
+	Key func(req *http.Request) string
+
+	// SynthesizeResponse makes RoundTrip return a 503 response instead of an
+	// error when the request is rejected.
+	SynthesizeResponse bool
+
+	// PropagationHeaders makes RoundTrip set CriticalityHeader and
+	// TimeoutHeader of outbound requests, see RoundTripper.PropagationHeaders.
+	PropagationHeaders bool
+}
+
+// HostKey returns the host and the port of the request URL. It is the
+// default Key of HostRoundTripper.
+func HostKey(req *http.Request) string {
+	return req.URL.Host
+}
+
+// NewHostRoundTripper returns a HostRoundTripper that sends no more than
+// maxRunning requests to each host through next at the same time and can
+// enqueue up to maxInQueue requests for each host, unless Hosts overrides
+// the limit for the host. Up to maxHosts hosts are tracked at the same time,
+// see Registry. If next is nil, http.DefaultTransport is used.
+//
+// A request occupies its running unit until its response body is closed.
+func NewHostRoundTripper(maxRunning, maxInQueue, maxHosts int, next http.RoundTripper) *HostRoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	t := &HostRoundTripper{
+		next:    next,
+		Default: HostLimit{MaxRunning: maxRunning, MaxInQueue: maxInQueue},
+		Key:     HostKey,
+	}
+	t.Registry = NewRegistry(maxHosts, t.newLimiter)
+	return t
+}
+
+// newLimiter returns a limiter for the host key.
+func (t *HostRoundTripper) newLimiter(key string) *Limiter {
+	limit, ok := t.Hosts[key]
+	if !ok {
+		limit = t.Default
+	}
+	return NewLimiter(limit.MaxRunning, limit.MaxInQueue)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *HostRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Context().Err() != nil {
+		return rejected(req, ErrCanceled, t.SynthesizeResponse)
+	}
+	l, release, err := t.Get(t.Key(req))
+	if err != nil {
+		return rejected(req, err, t.SynthesizeResponse)
+	}
+	a, err := l.acquire(req.Context(), 1, "")
+	if err != nil {
+		release()
+		return rejected(req, err, t.SynthesizeResponse)
+	}
+	done := func() {
+		l.done(a)
+		release()
+	}
+	if t.PropagationHeaders {
+		// RoundTrip must not modify the request.
+		req = req.Clone(req.Context())
+		SetPropagationHeaders(req.Context(), req.Header, CriticalityFromContext(req.Context()))
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	res.Body = &releaseBody{
+		ReadCloser: res.Body,
+		release:    done,
+	}
+	return res, nil
+}
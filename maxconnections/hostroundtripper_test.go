@@ -0,0 +1,63 @@
+package maxconnections
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHostRoundTripper(t *testing.T) {
+	rt := NewHostRoundTripper(1, 0, 10, roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader("OK")),
+			Request:    req,
+		}, nil
+	}))
+	rt.Hosts = map[string]HostLimit{"fast.example.com": {MaxRunning: 2}}
+
+	roundTrip := func(url string) (*http.Response, error) {
+		t.Helper()
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rt.RoundTrip(req)
+	}
+
+	slow, err := roundTrip("http://slow.example.com/")
+	if err != nil {
+		t.Fatalf("RoundTrip() = %v, want nil", err)
+	}
+	if _, err := roundTrip("http://slow.example.com/other"); err != ErrOverloaded {
+		t.Fatalf("RoundTrip() = %v, want %v for the busy host", err, ErrOverloaded)
+	}
+
+	// Other hosts are not affected, and the override applies.
+	for i := 0; i < 2; i++ {
+		res, err := roundTrip("http://fast.example.com/")
+		if err != nil {
+			t.Fatalf("RoundTrip() = %v, want nil for another host", err)
+		}
+		defer res.Body.Close()
+	}
+	if _, err := roundTrip("http://fast.example.com/"); err != ErrOverloaded {
+		t.Fatalf("RoundTrip() = %v, want %v after 2 requests to the host", err, ErrOverloaded)
+	}
+
+	slow.Body.Close()
+	res, err := roundTrip("http://slow.example.com/")
+	if err != nil {
+		t.Fatalf("RoundTrip() = %v, want nil after the body is closed", err)
+	}
+	res.Body.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequest("GET", "http://slow.example.com/", nil)
+	if _, err := rt.RoundTrip(req.WithContext(ctx)); err != context.Canceled {
+		t.Fatalf("RoundTrip() with a canceled context = %v, want %v", err, context.Canceled)
+	}
+}
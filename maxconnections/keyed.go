@@ -0,0 +1,159 @@
+package maxconnections
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// RemoteAddrKey returns the host part of r.RemoteAddr. It is the default Key
+// of Keyed.
+func RemoteAddrKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Keyed implements the http.Handler interface. It gives each key, e.g. each
+// client address, its own limiter, so one client can't occupy all the
+// capacity of the handler.
+type Keyed struct {
+	// Registry holds the limiters. Limiters that it creates can be
+	// configured through its newLimiter function.
+	*Registry
+
+	// handler to invoke.
+	handler http.Handler
+
+	// Parent, if not nil, is the limiter that caps all keys together, see
+	// NewHierarchical.
+	Parent *Limiter
+
+	// Key returns the key of the request. Behind reverse proxies,
+	// ipfilter.Extractor.Key gives the address of the client.
+	Key func(r *http.Request) string
+
+	// Skip, if not nil, reports whether the request bypasses the limiters,
+	// see Middleware.Skip.
+	Skip func(r *http.Request) bool
+
+	// OverloadHandler is called if the limiter of the request is overloaded,
+	// or if there is no room for the key of the request.
+	OverloadHandler http.Handler
+
+	// QueueFullHandler, if not nil, is called instead of OverloadHandler for
+	// requests that are rejected without waiting.
+	QueueFullHandler http.Handler
+
+	// QueueTimeoutHandler, if not nil, is called instead of OverloadHandler
+	// for requests that are rejected after waiting in the queue.
+	QueueTimeoutHandler http.Handler
+
+	// ShutdownHandler is called for requests that are not admitted because
+	// Shutdown has been called.
+	ShutdownHandler http.Handler
+
+	// CanceledHandler is called for requests whose context is done before
+	// they are admitted, see ErrCanceled.
+	CanceledHandler http.Handler
+
+	// CloseConnections, if not nil, counts rejections per client and asks
+	// clients that are rejected too often to close their connections, see
+	// ConnCloser.
+	CloseConnections *ConnCloser
+}
+
+// NewKeyed returns an http.Handler that runs no more than maxRunning h at the
+// same time for each key and queues up to maxInQueue requests for each key.
+// Up to maxKeys keys are tracked at the same time, see Registry.
+func NewKeyed(maxRunning, maxInQueue, maxKeys int, h http.Handler) *Keyed {
+	return NewKeyedWithRegistry(NewRegistry(maxKeys, func(key string) *Limiter {
+		return NewLimiter(maxRunning, maxInQueue)
+	}), h)
+}
+
+// NewPerSession returns an http.Handler that runs no more than maxRunning h at
+// the same time for each session and queues up to maxInQueue requests for
+// each session, e.g. at most 3 concurrent report generations per user. key
+// returns the session or the user of the request, e.g. from the
+// authentication middleware; requests with the empty key share a limiter, so
+// anonymous requests should be skipped or rejected before. Up to maxSessions
+// sessions are tracked at the same time, and the state of a session is
+// removed after it has been idle for idleTimeout.
+func NewPerSession(maxRunning, maxInQueue, maxSessions int, idleTimeout time.Duration, key func(r *http.Request) string, h http.Handler) *Keyed {
+	reg := NewRegistry(maxSessions, func(key string) *Limiter {
+		return NewLimiter(maxRunning, maxInQueue)
+	})
+	reg.IdleTimeout = idleTimeout
+	k := NewKeyedWithRegistry(reg, h)
+	k.Key = key
+	return k
+}
+
+// NewKeyedWithRegistry returns an http.Handler that runs h when the limiter
+// for the key of the request from reg admits it.
+func NewKeyedWithRegistry(reg *Registry, h http.Handler) *Keyed {
+	return &Keyed{
+		Registry: reg,
+		handler:  h,
+		Key:      RemoteAddrKey,
+
+		OverloadHandler: OverloadHandler,
+		ShutdownHandler: ShutdownHandler,
+		CanceledHandler: CanceledHandler,
+	}
+}
+
+// admit waits until r is admitted by the limiter for its key.
+func (k *Keyed) admit(r *http.Request) (*Limiter, admission, func(), error) {
+	key := k.Key(r)
+	l, release, err := k.Get(key)
+	if err != nil {
+		return nil, admission{key: key}, nil, err
+	}
+	a, err := l.acquire(r.Context(), 1, "")
+	if err != nil {
+		release()
+		// The admission carries the cause of the rejection.
+		a.key = key
+		return nil, a, nil, err
+	}
+	return l, a, release, nil
+}
+
+// overloadHandler returns the handler for a request rejected because of
+// cause.
+func (k *Keyed) overloadHandler(cause overload) http.Handler {
+	switch {
+	case (cause == overloadQueueFull || cause == overloadShed || cause == overloadSLO) && k.QueueFullHandler != nil:
+		return k.QueueFullHandler
+	case cause == overloadQueueTimeout && k.QueueTimeoutHandler != nil:
+		return k.QueueTimeoutHandler
+	}
+	return k.OverloadHandler
+}
+
+func (k *Keyed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if k.Skip != nil && k.Skip(r) {
+		k.handler.ServeHTTP(w, r)
+		return
+	}
+	l, a, release, err := k.admit(r)
+	switch err {
+	case nil:
+		defer release()
+		defer l.done(a)
+		k.handler.ServeHTTP(w, withAdmission(r, a, true))
+	case ErrShutdown:
+		k.ShutdownHandler.ServeHTTP(w, r)
+	case ErrCanceled:
+		k.CanceledHandler.ServeHTTP(w, r)
+	default:
+		if k.CloseConnections != nil {
+			k.CloseConnections.Rejected(w, r)
+		}
+		k.overloadHandler(a.overload).ServeHTTP(w, withRejection(r, a))
+	}
+}
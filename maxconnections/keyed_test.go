@@ -0,0 +1,67 @@
+package maxconnections
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestKeyed(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	k := NewKeyed(1, 0, 10, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Block") != "" {
+			started <- struct{}{}
+			<-unblock
+		}
+	}))
+
+	serve := func(remoteAddr string, block bool) int {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		if block {
+			r.Header.Set("X-Block", "1")
+		}
+		w := httptest.NewRecorder()
+		k.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	done := make(chan int)
+	go func() {
+		done <- serve("192.0.2.1:1234", true)
+	}()
+	<-started
+
+	// Requests from the same address share the limit.
+	if code := serve("192.0.2.1:5678", false); code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := serve("192.0.2.2:1234", false); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+
+	close(unblock)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if n := k.Len(); n != 2 {
+		t.Fatalf("Len() = %d, want 2", n)
+	}
+}
+
+func TestPerSession(t *testing.T) {
+	k := NewPerSession(1, 0, 10, time.Minute, func(r *http.Request) string {
+		return r.Header.Get("X-User")
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if k.IdleTimeout != time.Minute {
+		t.Fatalf("IdleTimeout = %v, want 1m", k.IdleTimeout)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-User", "alice")
+	k.ServeHTTP(httptest.NewRecorder(), r)
+	if _, ok := k.Registry.shard("alice").entries["alice"]; !ok {
+		t.Fatalf("the session is not tracked")
+	}
+}
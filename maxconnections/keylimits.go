@@ -0,0 +1,122 @@
+package maxconnections
+
+import (
+	"net/http"
+	"sync"
+)
+
+// KeyLimit is the limit of requests of a key.
+type KeyLimit struct {
+	// MaxRunning is a maximum number of requests of the key that run at
+	// the same time.
+	MaxRunning int
+
+	// MaxInQueue is a maximum number of requests of the key that can wait
+	// for their turn.
+	MaxInQueue int
+}
+
+// KeyLimits holds the limits of keys of a Registry: a default limit and
+// per-key overrides, e.g. for plan tiers of tenants. Limits can be changed
+// at runtime, the changes apply to the limiters that are already tracked.
+type KeyLimits struct {
+	mu         sync.RWMutex
+	def        KeyLimit
+	overrides  map[string]KeyLimit
+	registries []*Registry
+}
+
+// NewKeyLimits returns KeyLimits with the default limit of maxRunning
+// running and maxInQueue queued requests per key.
+func NewKeyLimits(maxRunning, maxInQueue int) *KeyLimits {
+	return &KeyLimits{
+		def:       KeyLimit{MaxRunning: maxRunning, MaxInQueue: maxInQueue},
+		overrides: make(map[string]KeyLimit),
+	}
+}
+
+// Limit returns the limit of key.
+func (k *KeyLimits) Limit(key string) KeyLimit {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if limit, ok := k.overrides[key]; ok {
+		return limit
+	}
+	return k.def
+}
+
+// SetDefault changes the limit of keys without overrides.
+func (k *KeyLimits) SetDefault(limit KeyLimit) {
+	k.mu.Lock()
+	k.def = limit
+	k.mu.Unlock()
+	k.apply(func(key string) bool {
+		k.mu.RLock()
+		defer k.mu.RUnlock()
+		_, ok := k.overrides[key]
+		return !ok
+	})
+}
+
+// Set overrides the limit of key.
+func (k *KeyLimits) Set(key string, limit KeyLimit) {
+	k.mu.Lock()
+	k.overrides[key] = limit
+	k.mu.Unlock()
+	k.apply(func(name string) bool { return name == key })
+}
+
+// Delete removes the override of key, so that the key gets the default
+// limit.
+func (k *KeyLimits) Delete(key string) {
+	k.mu.Lock()
+	delete(k.overrides, key)
+	k.mu.Unlock()
+	k.apply(func(name string) bool { return name == key })
+}
+
+// apply updates the tracked limiters of the keys selected by match.
+func (k *KeyLimits) apply(match func(key string) bool) {
+	k.mu.RLock()
+	registries := k.registries
+	k.mu.RUnlock()
+	for _, reg := range registries {
+		reg.each(func(key string, l *Limiter) {
+			if !match(key) {
+				return
+			}
+			limit := k.Limit(key)
+			l.SetMaxRunning(limit.MaxRunning)
+			l.SetMaxInQueue(limit.MaxInQueue)
+		})
+	}
+}
+
+// NewLimiter returns a limiter for key with its current limit.
+func (k *KeyLimits) NewLimiter(key string) *Limiter {
+	limit := k.Limit(key)
+	return NewLimiter(limit.MaxRunning, limit.MaxInQueue)
+}
+
+// NewRegistry returns a Registry that tracks up to maxKeys keys with their
+// limits from k, see NewRegistry. Changes of the limits are applied to the
+// limiters of the registry.
+func (k *KeyLimits) NewRegistry(maxKeys int) *Registry {
+	reg := NewRegistry(maxKeys, k.NewLimiter)
+	k.mu.Lock()
+	k.registries = append(k.registries, reg)
+	k.mu.Unlock()
+	return reg
+}
+
+// NewKeyedWithLimits returns an http.Handler that runs h for each key within
+// the limit of the key from limits. Up to maxKeys keys are tracked at the
+// same time.
+//
+//	limits := maxconnections.NewKeyLimits(5, 10)
+//	limits.Set("acme", maxconnections.KeyLimit{MaxRunning: 50, MaxInQueue: 100})
+//	k := maxconnections.NewKeyedWithLimits(limits, 10000, h)
+//	k.Key = tenantKey
+func NewKeyedWithLimits(limits *KeyLimits, maxKeys int, h http.Handler) *Keyed {
+	return NewKeyedWithRegistry(limits.NewRegistry(maxKeys), h)
+}
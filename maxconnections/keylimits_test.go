@@ -0,0 +1,38 @@
+package maxconnections
+
+import "testing"
+
+func TestKeyLimits(t *testing.T) {
+	limits := NewKeyLimits(5, 10)
+	limits.Set("acme", KeyLimit{MaxRunning: 50, MaxInQueue: 100})
+	reg := limits.NewRegistry(10)
+
+	get := func(key string) *Limiter {
+		t.Helper()
+		l, release, err := reg.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%q) = %v", key, err)
+		}
+		release()
+		return l
+	}
+	expect := func(key string, maxRunning, maxInQueue int) {
+		t.Helper()
+		if stats := get(key).Stats(); stats.MaxRunning != maxRunning || stats.MaxInQueue != maxInQueue {
+			t.Fatalf("%s: limits = %d/%d, want %d/%d", key, stats.MaxRunning, stats.MaxInQueue, maxRunning, maxInQueue)
+		}
+	}
+
+	expect("acme", 50, 100)
+	expect("other", 5, 10)
+
+	// Changes apply to the tracked limiters.
+	limits.SetDefault(KeyLimit{MaxRunning: 2, MaxInQueue: 3})
+	expect("acme", 50, 100)
+	expect("other", 2, 3)
+	limits.Set("other", KeyLimit{MaxRunning: 20, MaxInQueue: 30})
+	expect("other", 20, 30)
+	limits.Delete("acme")
+	expect("acme", 2, 3)
+	expect("new", 2, 3)
+}
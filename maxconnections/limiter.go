@@ -0,0 +1,1248 @@
+package maxconnections
+
+import (
+	"container/list"
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QueueDiscipline defines the order in which queued requests are admitted.
+type QueueDiscipline int
+
+const (
+	// FIFO admits the oldest requests first.
+	FIFO QueueDiscipline = iota
+
+	// LIFO admits the newest requests first.
+	LIFO
+
+	// AdaptiveLIFO admits requests in FIFO order while the oldest request
+	// has been waiting no longer than AdaptiveLIFOThreshold, and in LIFO
+	// order otherwise. Under sustained overload the oldest requests are
+	// likely to be abandoned by their clients, so it is better to serve fresh
+	// ones.
+	AdaptiveLIFO
+
+	// FairShare groups queued requests by their keys (see
+	// Middleware.QueueKey) and hands out running
+	// units across the keys in proportion to their weights, see QueueWeight,
+	// so a single key cannot monopolize the limiter by flooding the queue.
+	// Requests of the same key are admitted in FIFO order.
+	FairShare
+
+	// EarliestDeadline admits requests with the earliest context deadline
+	// first, so that requests with tight deadlines get running units before
+	// the ones that can afford to wait. Requests without a deadline are
+	// admitted in FIFO order after all requests with a deadline. A request
+	// whose deadline comes before it can be served, according to the
+	// recent service times (see EstimateQueueWait), is rejected when its
+	// turn comes instead of occupying running units for nothing.
+	EarliestDeadline
+)
+
+// waiter is a request in the queue.
+type waiter struct {
+	// ctx is the request context.
+	ctx context.Context
+
+	// n is the number of running units that the request needs.
+	n int
+
+	// key is the queue key of the request, see Middleware.QueueKey.
+	key string
+
+	// enqueued is the time when the request was put into the queue.
+	enqueued time.Time
+
+	// deadline is the deadline of ctx, if it has one.
+	deadline time.Time
+
+	// dup is the duplicate key of the request, see
+	// Middleware.DuplicateKey.
+	dup string
+
+	// qr is the request in the Queue of the limiter.
+	qr *QueuedRequest
+
+	// ready is closed when the request is admitted or rejected.
+	ready chan struct{}
+
+	// err is set before ready is closed. If it is nil, the request has got
+	// its running units.
+	err error
+}
+
+// Limiter limits the number of running units and queues requests that wait
+// for free units. It implements the admission logic of Middleware and can be
+// shared by several middlewares, so that different handler trees draw from
+// the same budget.
+type Limiter struct {
+	// running is the number of units occupied by admitted requests.
+	// maxRunning is a maximum number of running units. They are accessed
+	// atomically, so that requests can be admitted without taking mu while
+	// there are free units.
+	running    int64
+	maxRunning int64
+
+	// rampStart is the time in nanoseconds when the SlowStart ramp has
+	// started, and warm is non-zero once it has finished. They are
+	// accessed atomically.
+	rampStart int64
+	warm      int32
+
+	// sloFraction is the bits of the float64 fraction of requests that are
+	// rejected because of LatencySLO, it is accessed atomically.
+	sloFraction uint64
+
+	// slow is non-zero while requests must go through the slow path under
+	// mu: there are queued requests or the limiter is shut down. It is set
+	// before running is checked on the slow path, and checked after running
+	// is changed on the fast path, so that either side sees the other.
+	slow int32
+
+	// mu protects the fields below up to counters.
+	mu sync.Mutex
+
+	// maxInQueue is a maximum number of requests that can wait for running
+	// units. If the queue is full, the request is rejected.
+	maxInQueue int
+
+	// queuedCost is the number of units requested by queued requests.
+	queuedCost int
+
+	// queuedByKey is the number of queued requests per key.
+	queuedByKey map[string]int
+
+	// queuedByDup is the queued request for each duplicate key.
+	queuedByDup map[string]queuedDup
+
+	// queue contains waiters that are admitted before waiters from lowQueue.
+	queue list.List
+
+	// lowQueue contains deprioritized waiters, see SoftLimit.
+	lowQueue list.List
+
+	// orders are the queues that order the waiters of queue and lowQueue,
+	// see newQueue.
+	orders [2]Queue
+
+	// blocked contains the children of the limiter whose queued requests
+	// wait for its running units, see Parent.
+	blocked list.List
+
+	// fairPass is the virtual time of each queued key for the FairShare
+	// discipline. A key with the smallest pass is served next, and its pass
+	// grows by the cost of the admitted request divided by its weight.
+	fairPass map[string]float64
+
+	// fairTime is the pass of the most recently served key. Keys that join
+	// the queue start from it, so idle keys don't accumulate credit.
+	fairTime float64
+
+	// sweeping is true while the sweeper goroutine is running.
+	sweeping bool
+
+	// serviceTime and queueWait track the time handlers take to process
+	// requests and the time admitted requests wait in the queue. They are
+	// tracked only if DeadlineAware, EstimateQueueWait or TargetQueueWait
+	// is set.
+	serviceTime estimator
+	queueWait   estimator
+
+	// closed is set by Shutdown. Once it is set, no new requests are
+	// admitted.
+	closed bool
+
+	// idle is closed when running drops to zero after Shutdown.
+	idle       chan struct{}
+	idleClosed bool
+
+	// counters are updated atomically.
+	counters counters
+
+	// latency tracks service times for LatencySLO.
+	latency latencyWindow
+
+	// report tracks recent events for Report.
+	report reporter
+
+	// random allows to override rand.Float64 for tests.
+	random func() float64
+
+	// MaxWaitInQueue is a maximum wait time in the queue. It can be
+	// overridden for individual requests, see WithMaxQueueWait.
+	MaxWaitInQueue time.Duration
+
+	// QueueTimeoutJitter, if positive, is the fraction (e.g. 0.2) by which
+	// the queue timeout of each request is randomly lengthened or
+	// shortened, so that requests that were queued together by a burst
+	// are not rejected, and don't retry, all at the same moment.
+	QueueTimeoutJitter float64
+
+	// SoftLimit, if positive, is a threshold for the number of running and
+	// queued units. Requests that arrive when the threshold is reached are
+	// still admitted or queued, but they are deprioritized: they get a
+	// running slot only when no other request is waiting. Such requests are
+	// marked in their context, see BrownoutFromContext. Requests that arrive
+	// when both running slots and the queue are exhausted are rejected.
+	SoftLimit int
+
+	// TargetQueueWait, if positive, sizes the queue by time instead of by
+	// the number of requests: the capacity of the queue is the number of
+	// requests that the running units serve within TargetQueueWait at the
+	// recently observed service time (Little's law), clamped between
+	// MinInQueue and maxInQueue. The capacity follows the performance of
+	// handlers, so that the queue never holds more than about
+	// TargetQueueWait of work. Until service times are observed, the
+	// capacity is maxInQueue. See EffectiveMaxInQueue.
+	TargetQueueWait time.Duration
+	MinInQueue      int
+
+	// PaceLimit and MaxPaceDelay, if positive, enable pacing: requests
+	// that arrive when the number of running and queued units has reached
+	// PaceLimit wait before they are admitted or queued, so that the load
+	// is smoothed with extra latency rather than rejections. The delay
+	// grows linearly with the load from a fraction of MaxPaceDelay at
+	// PaceLimit to MaxPaceDelay when the queue is full. Requests are still
+	// rejected when both running slots and the queue are exhausted after
+	// the delay. The delay counts as a part of the queue wait.
+	PaceLimit    int
+	MaxPaceDelay time.Duration
+
+	// SheddableThreshold and DegradedOKThreshold, if positive, are the
+	// fractions of MaxRunning (e.g. 0.8 and 0.95) at which requests with
+	// the Sheddable and DegradedOK criticality are rejected, so that the
+	// limiter sheds less critical work progressively instead of failing all
+	// requests at once. See WithCriticality.
+	SheddableThreshold  float64
+	DegradedOKThreshold float64
+
+	// QueueDiscipline is the order in which queued requests are admitted.
+	// Deprioritized requests are always admitted after other requests. It
+	// should be set before the limiter is used.
+	QueueDiscipline QueueDiscipline
+
+	// NewQueue, if not nil, creates the Queue that orders queued requests
+	// for admission instead of QueueDiscipline, e.g. to admit requests by
+	// a business priority. It is called once for the queue and once for
+	// the queue of deprioritized requests (see SoftLimit) when they get
+	// their first requests. NewFIFOQueue, NewLIFOQueue and NewEDFQueue are
+	// the Queues of the FIFO, LIFO and EarliestDeadline disciplines. It
+	// should be set before the limiter is used.
+	NewQueue func() Queue
+
+	// AdaptiveLIFOThreshold is the queue wait after which the AdaptiveLIFO
+	// discipline switches to LIFO order.
+	AdaptiveLIFOThreshold time.Duration
+
+	// SweepInterval, if positive, enables a background sweep of the queue
+	// with the given interval. The sweep rejects requests whose context is
+	// done and requests that have been in the queue longer than MaxQueueAge
+	// (or MaxLowQueueAge for deprioritized requests), so that dead waiters
+	// free the queue capacity.
+	SweepInterval time.Duration
+
+	// MaxQueueAge and MaxLowQueueAge, if positive, are maximum ages of normal
+	// and deprioritized requests in the queue. They are enforced by the sweep.
+	MaxQueueAge    time.Duration
+	MaxLowQueueAge time.Duration
+
+	// DeadlineAware enables rejecting requests whose context deadline is
+	// shorter than the estimated queue wait. The wait is estimated from
+	// recent handler service times and the amount of queued work, so such
+	// requests are rejected immediately instead of occupying the queue until
+	// they are abandoned.
+	DeadlineAware bool
+
+	// EstimateQueueWait enables tracking of handler service times and queue
+	// waits for the estimates of QueueStatus.EstimatedWait, EstimateWait and
+	// the percentile accessors. DeadlineAware and TargetQueueWait imply
+	// it.
+	EstimateQueueWait bool
+
+	// LatencySLO, if positive, enables shedding by latency. The limiter
+	// tracks the p95 of recent handler service times, and while it exceeds
+	// LatencySLO, a growing fraction of new requests is rejected regardless
+	// of their criticality. When the latency improves, the fraction goes
+	// back to zero. Unlike MaxRunning, it follows slowdowns of downstream
+	// services that make each request take longer.
+	LatencySLO time.Duration
+
+	// QueuePerKey, if positive, partitions the queue capacity between the
+	// keys of requests (see Middleware.QueueKey). Each key is guaranteed
+	// QueuePerKey places in the queue. While other keys are idle, a key can
+	// borrow their places up to maxInQueue in total. When a key that hasn't
+	// used its guaranteed places finds the queue full, the newest request of
+	// a key that exceeds its share is rejected to reclaim the place.
+	QueuePerKey int
+
+	// EvictOldest makes a full queue take a new request by rejecting the
+	// oldest queued request, which gets QueueTimeoutHandler, instead of
+	// rejecting the new one. Deprioritized requests are evicted first, and
+	// they never push out normal ones. Only requests that have been queued
+	// for at least MinEvictionAge are evicted. Combined with LIFO, it keeps
+	// the queue fresh under overload rather than serving requests whose
+	// clients have likely given up.
+	EvictOldest    bool
+	MinEvictionAge time.Duration
+
+	// QueueWeight, if not nil, returns the weight of the key for the
+	// FairShare discipline. A key with weight 2 gets twice as many running
+	// units as a key with weight 1 while both have queued requests. Weights
+	// less than 1 are treated as 1.
+	QueueWeight func(key string) int
+
+	// Observer, if not nil, receives admission events.
+	Observer Observer
+
+	// Events, if not nil, receives a record of every admission decision,
+	// e.g. for an audit pipeline or an offline analysis of overloads. It is
+	// called synchronously, see EventChan for a buffered sink.
+	Events func(Event)
+
+	// Name identifies the limiter in Events.
+	Name string
+
+	// DryRun makes the limiter admit all requests right away while it
+	// counts the decisions it would have made, see Stats.DryRunQueued and
+	// Stats.DryRunRejected, and reports them to Events. Observer sees all
+	// requests as admitted. It allows to validate limits in production
+	// before enforcing them. Only Shutdown still rejects requests.
+	DryRun bool
+
+	// ReportWindow, if positive, enables tracking of the arrival, service
+	// and rejection rates and of the utilization over a sliding window of
+	// the given length, see Report. It costs reading the clock twice per
+	// request.
+	ReportWindow time.Duration
+
+	// Backend, if not nil, is consulted for every locally admitted request.
+	// The request runs only when it gets a lease from the backend, so
+	// several middlewares can share a global limit. If the backend returns
+	// an error, the request is rejected.
+	Backend Backend
+
+	// Parent, if not nil, is a limiter that caps this limiter together with
+	// others, see NewHierarchical. A request runs only when it gets running
+	// units both from the limiter and from Parent, it takes them in one
+	// step, so it never holds the units of one while it waits for the
+	// other. Queued requests wait for the units of Parent in the queue of
+	// the limiter. Parent must not have a Parent itself.
+	Parent *Limiter
+
+	// BackendRetryInterval is how often the backend is asked for a lease
+	// while the request is waiting for it.
+	BackendRetryInterval time.Duration
+
+	// Clock, if not nil, is used instead of SystemClock, e.g. to control
+	// queue timeouts in tests.
+	Clock Clock
+
+	// SlowStart, if positive, is the duration of a ramp after NewLimiter
+	// or Reset during which the effective maximum of running units grows
+	// linearly from SlowStartMin to MaxRunning, so that cold caches and
+	// upstreams are not hit with full concurrency right after a restart.
+	// The queue admits requests as running ones finish, so queued requests
+	// are not admitted by the growth of the limit alone.
+	SlowStart time.Duration
+
+	// SlowStartMin is the effective maximum of running units at the start
+	// of the SlowStart ramp. If it is less than 1, it is 1.
+	SlowStartMin int
+}
+
+// NewLimiter returns a Limiter that admits up to maxRunning units at the same
+// time and queues up to maxInQueue requests.
+func NewLimiter(maxRunning, maxInQueue int) *Limiter {
+	return &Limiter{
+		maxRunning: int64(maxRunning),
+		rampStart:  time.Now().UnixNano(),
+		maxInQueue: maxInQueue,
+		idle:       make(chan struct{}),
+	}
+}
+
+// Shutdown stops admitting new requests and waits for admitted requests to
+// finish. Requests that arrive after Shutdown is called, as well as requests
+// that are in the queue, are rejected with ErrShutdown. If ctx expires
+// before all admitted requests are finished, Shutdown returns ctx.Err().
+func (l *Limiter) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		for _, q := range l.queues() {
+			for e := q.Front(); e != nil; e = e.Next() {
+				w := e.Value.(*waiter)
+				w.err = ErrShutdown
+				close(w.ready)
+			}
+			q.Init()
+		}
+		l.queuedCost = 0
+		l.queuedByKey = nil
+		l.queuedByDup = nil
+		l.orders = [2]Queue{}
+		l.fairPass = nil
+		l.updateSlow()
+		l.checkIdle()
+	}
+	l.mu.Unlock()
+	// The children that wait for units reject their requests.
+	l.notifyChildren()
+
+	select {
+	case <-l.idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// MaxRunning returns the maximum number of running units.
+func (l *Limiter) MaxRunning() int {
+	return int(atomic.LoadInt64(&l.maxRunning))
+}
+
+// Utilization returns the fraction of the running units that are in use.
+// It can exceed 1 if the limit has been decreased below the number of running
+// units.
+func (l *Limiter) Utilization() float64 {
+	max := l.MaxRunning()
+	if max <= 0 {
+		return 0
+	}
+	return float64(l.runningUnits()) / float64(max)
+}
+
+// SetMaxRunning changes the maximum number of running units. If the limit is
+// increased, queued requests are admitted immediately. If it is decreased,
+// running handlers are not affected, but new requests are not admitted until
+// the number of running units drops below the new limit.
+func (l *Limiter) SetMaxRunning(n int) {
+	l.mu.Lock()
+	atomic.StoreInt64(&l.maxRunning, int64(n))
+	l.notify()
+	l.mu.Unlock()
+	l.notifyChildren()
+}
+
+// SetMaxInQueue changes the capacity of the queue. If the queue holds more
+// requests than the new capacity, they keep waiting, but no new requests are
+// queued until the queue shrinks below the capacity.
+func (l *Limiter) SetMaxInQueue(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxInQueue = n
+}
+
+// Brownout reports whether the number of running and queued requests has
+// reached SoftLimit.
+func (l *Limiter) Brownout() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.brownout()
+}
+
+func (l *Limiter) brownout() bool {
+	return l.SoftLimit > 0 && l.runningUnits()+l.queuedCost >= l.SoftLimit
+}
+
+// runningUnits returns the number of running units.
+func (l *Limiter) runningUnits() int {
+	return int(atomic.LoadInt64(&l.running))
+}
+
+// take occupies n running units if they are free. It returns the number of
+// units that were running before.
+func (l *Limiter) take(n int) (running int, ok bool) {
+	for {
+		r := atomic.LoadInt64(&l.running)
+		if r+int64(n) > l.effectiveMaxRunning() {
+			return int(r), false
+		}
+		if atomic.CompareAndSwapInt64(&l.running, r, r+int64(n)) {
+			return int(r), true
+		}
+	}
+}
+
+// tryFast admits a request that needs n units without taking mu if nobody is
+// queued and there are free units. If ok is false and err is nil, the request
+// should go through the slow path.
+func (l *Limiter) tryFast(n int) (brownout, ok bool, err error) {
+	if atomic.LoadInt32(&l.slow) != 0 {
+		return false, false, nil
+	}
+	running, ok := l.take(n)
+	if !ok {
+		return false, false, nil
+	}
+	if atomic.LoadInt32(&l.slow) != 0 {
+		// Shutdown might have been called concurrently.
+		l.mu.Lock()
+		closed := l.closed
+		l.mu.Unlock()
+		if closed {
+			l.releaseLocal(n)
+			return false, false, ErrShutdown
+		}
+	}
+	if l.Parent != nil {
+		if ok, err := l.Parent.takeChild(l, n, false); !ok {
+			l.releaseLocal(n)
+			return false, false, err
+		}
+	}
+	return l.SoftLimit > 0 && running >= l.SoftLimit, true, nil
+}
+
+// updateSlow enables the fast path if nothing prevents it. It should be
+// called with mu held.
+func (l *Limiter) updateSlow() {
+	if l.closed || l.waiting() > 0 || l.blocked.Len() > 0 {
+		atomic.StoreInt32(&l.slow, 1)
+	} else {
+		atomic.StoreInt32(&l.slow, 0)
+	}
+}
+
+// checkIdle closes idle if the limiter is shut down and all admitted
+// requests are finished. It should be called with mu held.
+func (l *Limiter) checkIdle() {
+	if l.closed && !l.idleClosed && atomic.LoadInt64(&l.running) == 0 {
+		l.idleClosed = true
+		close(l.idle)
+	}
+}
+
+// isIdle reports whether the limiter has no running or queued requests.
+func (l *Limiter) isIdle() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.runningUnits() == 0 && l.waiting() == 0
+}
+
+// queues returns the queues in the order of their priority.
+func (l *Limiter) queues() []*list.List {
+	return []*list.List{&l.queue, &l.lowQueue}
+}
+
+// waiting returns the number of queued requests. It should be called with mu
+// held.
+func (l *Limiter) waiting() int {
+	return l.queue.Len() + l.lowQueue.Len()
+}
+
+// reclaim rejects the newest queued request of a key that has borrowed queue
+// places from other keys. It reports whether a place has been freed. It
+// should be called with mu held.
+func (l *Limiter) reclaim(key string) bool {
+	if l.QueuePerKey <= 0 || l.queuedByKey[key] >= l.QueuePerKey {
+		return false
+	}
+	queues := l.queues()
+	for i := len(queues) - 1; i >= 0; i-- {
+		q := queues[i]
+		for e := q.Back(); e != nil; e = e.Prev() {
+			w := e.Value.(*waiter)
+			if l.queuedByKey[w.key] <= l.QueuePerKey {
+				continue
+			}
+			l.remove(q, e)
+			w.err = ErrOverloaded
+			close(w.ready)
+			return true
+		}
+	}
+	return false
+}
+
+// queuedDup is a queued request with a duplicate key.
+type queuedDup struct {
+	q *list.List
+	e *list.Element
+}
+
+// duplicate describes how the limiter treats duplicates of a request, see
+// Middleware.DuplicateKey.
+type duplicate struct {
+	key     string
+	replace bool
+}
+
+type duplicateKey struct{}
+
+// withDuplicateKey returns a copy of ctx that marks the request with the
+// duplicate key.
+func withDuplicateKey(ctx context.Context, key string, replace bool) context.Context {
+	return context.WithValue(ctx, duplicateKey{}, duplicate{key: key, replace: replace})
+}
+
+// collapse handles a request with the duplicate key dup that is about to be
+// queued. It reports false if the request should be rejected because an
+// older request with the same key is in the queue. If dup.replace is set,
+// the older request is rejected instead. It should be called with mu held.
+func (l *Limiter) collapse(dup duplicate) bool {
+	if dup.key == "" {
+		return true
+	}
+	old, ok := l.queuedByDup[dup.key]
+	if !ok {
+		return true
+	}
+	atomic.AddInt64(&l.counters.duplicates, 1)
+	if !dup.replace {
+		return false
+	}
+	w := old.e.Value.(*waiter)
+	l.remove(old.q, old.e)
+	w.err = ErrOverloaded
+	close(w.ready)
+	return true
+}
+
+// remove removes the waiter e from the queue q. It should be called with mu
+// held.
+func (l *Limiter) remove(q *list.List, e *list.Element) {
+	w := e.Value.(*waiter)
+	q.Remove(e)
+	l.order(q).Remove(w.qr)
+	if w.dup != "" && l.queuedByDup[w.dup].e == e {
+		delete(l.queuedByDup, w.dup)
+	}
+	l.queuedCost -= w.n
+	if l.queuedByKey[w.key]--; l.queuedByKey[w.key] == 0 {
+		delete(l.queuedByKey, w.key)
+		delete(l.fairPass, w.key)
+	}
+	l.updateSlow()
+}
+
+// evict rejects the oldest queued request to make place for a new one if
+// EvictOldest is set, see MinEvictionAge. A new deprioritized request, for
+// which brownout is true, can push out only deprioritized requests. It
+// reports whether a place has been freed. It should be called with mu held.
+func (l *Limiter) evict(brownout bool) bool {
+	if !l.EvictOldest {
+		return false
+	}
+	queues := []*list.List{&l.lowQueue}
+	if !brownout {
+		queues = append(queues, &l.queue)
+	}
+	now := l.now()
+	for _, q := range queues {
+		// Requests are appended to the lists, so the front one is the
+		// oldest regardless of the order of admission.
+		e := q.Front()
+		if e == nil {
+			continue
+		}
+		w := e.Value.(*waiter)
+		if now.Sub(w.enqueued) < l.MinEvictionAge {
+			continue
+		}
+		l.remove(q, e)
+		w.err = ErrOverloaded
+		close(w.ready)
+		atomic.AddInt64(&l.counters.evicted, 1)
+		return true
+	}
+	return false
+}
+
+// enqueueRunning waits for n running units. It reports whether the request is
+// admitted in brownout mode.
+func (l *Limiter) enqueueRunning(ctx context.Context, n int, key string) (brownout bool, err error) {
+	brownout, _, _, err = l.enqueue(ctx, n, key)
+	return brownout, err
+}
+
+// enqueue is like enqueueRunning, but it also reports whether the request has
+// been queued and its queue status, see QueueStatusFromContext. The status is
+// zero if the request hasn't met the queue.
+func (l *Limiter) enqueue(ctx context.Context, n int, key string) (brownout, queued bool, status QueueStatus, err error) {
+	if brownout, ok, err := l.tryFast(n); ok || err != nil {
+		return brownout, false, QueueStatus{}, err
+	}
+
+	l.mu.Lock()
+	if l.closed {
+		l.updateSlow()
+		l.mu.Unlock()
+		return false, false, QueueStatus{}, ErrShutdown
+	}
+	atomic.StoreInt32(&l.slow, 1)
+	brownout = l.brownout()
+	if l.waiting() == 0 {
+		if ok, err := l.takeUnits(n, false); ok || err != nil {
+			l.updateSlow()
+			l.mu.Unlock()
+			if err != nil {
+				return false, false, QueueStatus{}, err
+			}
+			return brownout, false, QueueStatus{}, nil
+		}
+	}
+
+	// Slow-path. Requests that can't be served before their deadline are
+	// rejected before anything is done for them, e.g. before an older
+	// request is evicted to make place.
+	if l.DeadlineAware {
+		if deadline, ok := ctx.Deadline(); ok {
+			if wait, ok := l.estimatedWait(n); ok && deadline.Sub(l.now()) < wait {
+				status = l.rejectedStatus()
+				l.updateSlow()
+				l.mu.Unlock()
+				return false, false, status, ErrOverloaded
+			}
+		}
+	}
+	dup, _ := ctx.Value(duplicateKey{}).(duplicate)
+	if n > l.MaxRunning() || !l.collapse(dup) || (l.waiting() >= l.queueCapacity() && !l.reclaim(key) && !l.evict(brownout)) {
+		status = l.rejectedStatus()
+		l.updateSlow()
+		l.mu.Unlock()
+		return false, false, status, ErrOverloaded
+	}
+	// Replacing, reclaiming or evicting a queued request may have enabled
+	// the fast path if the queue has become empty, but the request is
+	// about to be queued.
+	atomic.StoreInt32(&l.slow, 1)
+	q := &l.queue
+	if brownout {
+		q = &l.lowQueue
+	}
+	w := &waiter{
+		ctx:      ctx,
+		n:        n,
+		key:      key,
+		enqueued: l.now(),
+		ready:    make(chan struct{}),
+	}
+	w.deadline, _ = ctx.Deadline()
+	w.dup = dup.key
+	elem := q.PushBack(w)
+	w.qr = &QueuedRequest{
+		Context:  ctx,
+		Cost:     n,
+		Key:      key,
+		Enqueued: w.enqueued,
+		Deadline: w.deadline,
+		e:        elem,
+	}
+	l.order(q).Push(w.qr)
+	if dup.key != "" {
+		if l.queuedByDup == nil {
+			l.queuedByDup = make(map[string]queuedDup)
+		}
+		l.queuedByDup[dup.key] = queuedDup{q: q, e: elem}
+	}
+	l.queuedCost += n
+	if l.queuedByKey == nil {
+		l.queuedByKey = make(map[string]int)
+		l.fairPass = make(map[string]float64)
+	}
+	if l.queuedByKey[key]++; l.queuedByKey[key] == 1 {
+		l.fairPass[key] = l.fairTime
+	}
+	if l.SweepInterval > 0 && !l.sweeping {
+		l.sweeping = true
+		go l.sweepLoop(l.SweepInterval)
+	}
+	status = l.queueStatus(q, elem)
+	if l.Parent != nil {
+		// The request might be queued only because Parent is full, it
+		// should wait for Parent in its turn.
+		l.notify()
+	}
+	l.mu.Unlock()
+
+	if l.Observer != nil {
+		l.Observer.Queued(ctx)
+	}
+
+	var timeout <-chan time.Time
+	if maxWait := l.maxWait(ctx); maxWait > 0 {
+		timer := l.startTimer(maxWait)
+		defer l.stopTimer(timer)
+		timeout = timer.C()
+	}
+
+	progress, _ := ctx.Value(queueProgressKey{}).(*queueProgress)
+	for waiting := true; waiting; {
+		var progressTimer Timer
+		var tick <-chan time.Time
+		if progress != nil {
+			progressTimer = l.startTimer(progress.interval)
+			tick = progressTimer.C()
+		}
+		select {
+		case <-w.ready:
+			waiting = false
+		case <-timeout:
+			waiting = false
+		case <-ctx.Done():
+			waiting = false
+		case <-tick:
+			l.mu.Lock()
+			select {
+			case <-w.ready:
+				l.mu.Unlock()
+			default:
+				current := l.queueStatus(q, elem)
+				l.mu.Unlock()
+				progress.report(current)
+			}
+		}
+		if progressTimer != nil {
+			l.stopTimer(progressTimer)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-w.ready:
+		// The request has been admitted or rejected, possibly while we
+		// were waiting for the lock.
+		return brownout, true, status, w.err
+	default:
+	}
+	status = l.queueStatus(q, elem)
+	l.remove(q, elem)
+	// The waiter might have been blocking smaller requests behind it.
+	l.notify()
+	if ctx.Err() != nil {
+		// The client has gone away, nobody is going to read a
+		// rejection.
+		return false, true, status, ErrCanceled
+	}
+	return false, true, status, ErrOverloaded
+}
+
+// maxWait returns the maximum wait time in the queue for a request with ctx,
+// with QueueTimeoutJitter applied.
+func (l *Limiter) maxWait(ctx context.Context) time.Duration {
+	d := l.MaxWaitInQueue
+	if override, ok := ctx.Value(maxQueueWaitKey{}).(time.Duration); ok {
+		d = override
+	}
+	if d <= 0 || l.QueueTimeoutJitter <= 0 {
+		return d
+	}
+	random := l.random
+	if random == nil {
+		random = rand.Float64
+	}
+	return time.Duration(float64(d) * (1 + l.QueueTimeoutJitter*(2*random()-1)))
+}
+
+// next returns the waiter from q that should be admitted next according to
+// its Queue. It should be called with mu held.
+func (l *Limiter) next(q *list.List) *list.Element {
+	if qr := l.order(q).Peek(); qr != nil {
+		return qr.e
+	}
+	return nil
+}
+
+// hopeless reports whether w, a waiter of q, cannot be served before its
+// deadline. Only queues that order requests by their deadlines, see
+// NewEDFQueue, give up on such requests. It should be called with mu held.
+func (l *Limiter) hopeless(q *list.List, w *waiter) bool {
+	if _, ok := l.order(q).(*deadlineQueue); !ok || w.deadline.IsZero() {
+		return false
+	}
+	serviceTime, _ := l.serviceTime.average()
+	return w.deadline.Sub(l.now()) < serviceTime
+}
+
+// weight returns the FairShare weight of the key.
+func (l *Limiter) weight(key string) int {
+	if l.QueueWeight == nil {
+		return 1
+	}
+	if w := l.QueueWeight(key); w > 1 {
+		return w
+	}
+	return 1
+}
+
+// charge advances the pass of the key of w, a waiter of q, that is being
+// admitted. It should be called with mu held before w is removed from q.
+func (l *Limiter) charge(q *list.List, w *waiter) {
+	if _, ok := l.order(q).(*fairQueue); !ok {
+		return
+	}
+	l.fairTime = l.fairPass[w.key]
+	l.fairPass[w.key] += float64(w.n) / float64(l.weight(w.key))
+}
+
+// notify passes free running units to waiters. Waiters are admitted in order,
+// a waiter that needs more units than available blocks the waiters behind
+// it. It should be called with mu held.
+func (l *Limiter) notify() {
+	for _, q := range l.queues() {
+		for {
+			e := l.next(q)
+			if e == nil {
+				break
+			}
+			w := e.Value.(*waiter)
+			if l.hopeless(q, w) {
+				l.remove(q, e)
+				w.err = ErrOverloaded
+				if w.ctx.Err() != nil {
+					w.err = ErrCanceled
+				}
+				close(w.ready)
+				continue
+			}
+			ok, err := l.takeUnits(w.n, true)
+			if err != nil {
+				l.remove(q, e)
+				w.err = err
+				close(w.ready)
+				continue
+			}
+			if !ok {
+				return
+			}
+			l.charge(q, w)
+			l.remove(q, e)
+			close(w.ready)
+		}
+	}
+	if l.Parent != nil {
+		l.Parent.unblock(l)
+	}
+}
+
+// sweepLoop periodically sweeps the queue until it becomes empty.
+func (l *Limiter) sweepLoop(interval time.Duration) {
+	for {
+		timer := l.startTimer(interval)
+		<-timer.C()
+		l.stopTimer(timer)
+
+		l.mu.Lock()
+		l.sweep()
+		if l.waiting() == 0 {
+			l.sweeping = false
+			l.mu.Unlock()
+			return
+		}
+		l.mu.Unlock()
+	}
+}
+
+// sweep rejects queued requests whose context is done or that are too old.
+// It should be called with mu held.
+func (l *Limiter) sweep() {
+	now := l.now()
+	for i, q := range l.queues() {
+		maxAge := l.MaxQueueAge
+		if i > 0 {
+			maxAge = l.MaxLowQueueAge
+		}
+		var next *list.Element
+		for e := q.Front(); e != nil; e = next {
+			next = e.Next()
+			w := e.Value.(*waiter)
+			if w.ctx.Err() == nil && (maxAge <= 0 || now.Sub(w.enqueued) <= maxAge) {
+				continue
+			}
+			l.remove(q, e)
+			w.err = ErrOverloaded
+			if w.ctx.Err() != nil {
+				w.err = ErrCanceled
+			}
+			close(w.ready)
+		}
+	}
+	l.notify()
+}
+
+// releaseRunning frees n running units of the limiter and of Parent and
+// passes them to waiters, if there are any.
+func (l *Limiter) releaseRunning(n int) {
+	l.releaseLocal(n)
+	l.notifyChildren()
+	if l.Parent != nil {
+		l.Parent.releaseRunning(n)
+	}
+}
+
+// releaseLocal is like releaseRunning, but it frees only the units of the
+// limiter itself.
+func (l *Limiter) releaseLocal(n int) {
+	atomic.AddInt64(&l.running, -int64(n))
+	if atomic.LoadInt32(&l.slow) != 0 {
+		l.mu.Lock()
+		l.notify()
+		l.checkIdle()
+		l.mu.Unlock()
+	}
+}
+
+// finish records the service time of a request that has been started at
+// start, if it is set, and frees its n running units.
+func (l *Limiter) finish(n int, start time.Time) {
+	if !start.IsZero() {
+		now := l.now()
+		serviceTime := now.Sub(start)
+		if l.ReportWindow > 0 {
+			l.report.completion(l.ReportWindow, now, n, serviceTime)
+		}
+		if l.estimating() {
+			l.serviceTime.observe(serviceTime)
+		}
+		if l.LatencySLO > 0 {
+			l.observeLatency(serviceTime)
+		}
+	}
+	l.releaseRunning(n)
+}
+
+// overload is the cause of an ErrOverloaded rejection.
+type overload int
+
+const (
+	// overloadOther is a rejection by the backend.
+	overloadOther overload = iota
+
+	// overloadQueueFull is a rejection of a request that has not been
+	// queued, e.g. because the queue is full.
+	overloadQueueFull
+
+	// overloadQueueTimeout is a rejection of a request that has been
+	// waiting for running units or for a backend lease.
+	overloadQueueTimeout
+
+	// overloadShed is a rejection because of the criticality of the
+	// request.
+	overloadShed
+
+	// overloadSLO is a rejection because the latency exceeds LatencySLO.
+	overloadSLO
+)
+
+func (o overload) String() string {
+	switch o {
+	case overloadQueueFull:
+		return "queue full"
+	case overloadQueueTimeout:
+		return "queue timeout"
+	case overloadShed:
+		return "shed"
+	case overloadSLO:
+		return "latency SLO"
+	}
+	return "backend"
+}
+
+// admission is an admitted request.
+type admission struct {
+	l        *Limiter
+	n        int
+	brownout bool
+	lease    Lease
+	wait     time.Duration
+
+	// bytes is the admission of Middleware.Bytes, if the request has one.
+	bytes *admission
+
+	// criticality is the criticality of the request that has been used for
+	// the admission.
+	criticality Criticality
+
+	// start is the time when the request was admitted. It is set only if
+	// the service time is tracked.
+	start time.Time
+
+	// overload is the cause of the rejection if the request has been
+	// rejected with ErrOverloaded.
+	overload overload
+
+	// queue is the queue status of the request. Its Length is zero if the
+	// request hasn't met the queue.
+	queue QueueStatus
+
+	// key is the key of the request if it has been rejected, see Decision.
+	key string
+}
+
+// acquire waits until a request gets n running units locally and from the
+// backend.
+func (l *Limiter) acquire(ctx context.Context, n int, key string) (admission, error) {
+	if l.DryRun {
+		return l.acquireDryRun(ctx, n, key)
+	}
+	// The clock is read only when the request may wait, as reading it is a
+	// noticeable part of the fast path.
+	var arrived time.Time
+	var brownout, ok, queued bool
+	var status QueueStatus
+	var err error
+	cause := overloadQueueFull
+	if l.PaceLimit > 0 && l.MaxPaceDelay > 0 {
+		arrived = l.pace(ctx)
+	}
+	if ctx.Err() != nil {
+		err = ErrCanceled
+	} else if l.shed(ctx) {
+		err = ErrOverloaded
+		cause = overloadShed
+	} else if l.sloShed() {
+		err = ErrOverloaded
+		cause = overloadSLO
+	} else if brownout, ok, err = l.tryFast(n); !ok && err == nil {
+		if arrived.IsZero() {
+			arrived = l.now()
+		}
+		brownout, queued, status, err = l.enqueue(ctx, n, key)
+		if queued {
+			cause = overloadQueueTimeout
+		}
+	}
+	var lease Lease
+	if err == nil && l.Backend != nil {
+		if arrived.IsZero() {
+			arrived = l.now()
+		}
+		lease, err = l.acquireBackend(ctx, n)
+		if err != nil {
+			l.releaseRunning(n)
+			if err != ErrOverloaded && err != ErrCanceled {
+				cause = overloadOther
+			}
+			if err != ErrCanceled {
+				err = ErrOverloaded
+			}
+		}
+	}
+	var wait time.Duration
+	if !arrived.IsZero() {
+		wait = l.now().Sub(arrived)
+	}
+	l.counters.count(err)
+	if l.ReportWindow > 0 {
+		l.report.arrival(l.ReportWindow, l.now(), err == ErrOverloaded)
+	}
+	if err == ErrCanceled && !arrived.IsZero() {
+		atomic.AddInt64(&l.counters.queueCanceled, 1)
+	}
+	if l.Events != nil {
+		l.emit(Event{
+			Key:         key,
+			Cost:        n,
+			Criticality: CriticalityFromContext(ctx),
+			QueueWait:   wait,
+			Brownout:    brownout && err == nil,
+		}, err, cause)
+	}
+	if err != nil {
+		if err == ErrOverloaded {
+			l.counters.countOverload(cause)
+		}
+		if l.Observer != nil {
+			l.Observer.Rejected(ctx, wait, err)
+		}
+		return admission{l: l, wait: wait, overload: cause, queue: status, key: key}, err
+	}
+	if l.Observer != nil {
+		l.Observer.Admitted(ctx, wait)
+	}
+	if l.estimating() {
+		l.queueWait.observe(wait)
+	}
+	a := admission{
+		l:        l,
+		n:        n,
+		brownout: brownout,
+		lease:    lease,
+		wait:     wait,
+		queue:    status,
+	}
+	if l.estimating() || l.LatencySLO > 0 || l.ReportWindow > 0 {
+		a.start = l.now()
+	}
+	return a, nil
+}
+
+// tryAcquire admits a request that needs n units only if they are free
+// right now, without queueing. It is used to move admitted requests between
+// limiters, as a request must not wait in a queue while it holds units of
+// another limiter.
+func (l *Limiter) tryAcquire(ctx context.Context, n int) (admission, bool) {
+	brownout, ok, err := l.tryFast(n)
+	if !ok || err != nil {
+		return admission{}, false
+	}
+	var lease Lease
+	if l.Backend != nil {
+		lease, err = l.Backend.TryAcquire(ctx, n)
+		if err != nil || lease == nil {
+			l.releaseRunning(n)
+			return admission{}, false
+		}
+	}
+	l.counters.count(nil)
+	if l.Observer != nil {
+		l.Observer.Admitted(ctx, 0)
+	}
+	if l.Events != nil {
+		l.emit(Event{
+			Cost:        n,
+			Criticality: CriticalityFromContext(ctx),
+			Brownout:    brownout,
+		}, nil, overloadQueueFull)
+	}
+	a := admission{l: l, n: n, brownout: brownout, lease: lease}
+	if l.estimating() || l.LatencySLO > 0 || l.ReportWindow > 0 {
+		a.start = l.now()
+	}
+	return a, true
+}
+
+// done releases the running units of the admitted request a.
+func (l *Limiter) done(a admission) {
+	if a.bytes != nil {
+		a.bytes.l.done(*a.bytes)
+	}
+	if a.lease != nil {
+		a.lease.Release(context.Background())
+	}
+	l.finish(a.n, a.start)
+}
+
+// Acquire waits for one running unit with the same queueing and timeout
+// semantics as for HTTP requests. It allows to apply the limits to work that
+// isn't an HTTP request, e.g. background jobs or message consumers. On
+// success the caller must call release when the work is done, release is
+// safe to call more than once.
+func (l *Limiter) Acquire(ctx context.Context) (release func(), err error) {
+	return l.AcquireN(ctx, 1)
+}
+
+// AcquireN is like Acquire, but waits for n running units. If n is less than
+// 1, one unit is acquired.
+func (l *Limiter) AcquireN(ctx context.Context, n int) (release func(), err error) {
+	if n < 1 {
+		n = 1
+	}
+	a, err := l.acquire(ctx, n, "")
+	if err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.done(a)
+		})
+	}, nil
+}
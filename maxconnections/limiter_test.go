@@ -0,0 +1,77 @@
+package maxconnections
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSharedLimiter(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	l := NewLimiter(1, 0)
+	release := make(chan struct{})
+	a := NewWithLimiter(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	b := NewWithLimiter(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	done := make(chan struct{})
+	go func() {
+		a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		close(done)
+	}()
+	waitRunning(t, a, 1, timeout)
+
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("b: status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	close(release)
+	<-done
+
+	rec = httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("b: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if stats := l.Stats(); stats.Admitted != 2 || stats.Overloaded != 1 {
+		t.Fatalf("Stats() = %+v, want 2 admitted and 1 overloaded", stats)
+	}
+}
+
+func TestLimiterAcquire(t *testing.T) {
+	l := NewLimiter(1, 0)
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire() = %v, want nil", err)
+	}
+	if _, err := l.Acquire(context.Background()); err != ErrOverloaded {
+		t.Fatalf("Acquire() = %v, want %v", err, ErrOverloaded)
+	}
+
+	release()
+	release()
+	if stats := l.Stats(); stats.Running != 0 {
+		t.Fatalf("Running = %d after double release, want 0", stats.Running)
+	}
+}
+
+func BenchmarkAcquireUncontended(b *testing.B) {
+	l := NewLimiter(1<<20, 0)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			release, err := l.Acquire(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
+			release()
+		}
+	})
+}
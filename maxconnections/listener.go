@@ -0,0 +1,52 @@
+package maxconnections
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+type listenerKey struct{}
+
+// WithListener returns a copy of ctx that carries the name of the listener
+// that has accepted the request.
+func WithListener(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, listenerKey{}, name)
+}
+
+// ListenerFromContext returns the name of the listener that has accepted the
+// request, or an empty string if the name is not set.
+func ListenerFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(listenerKey{}).(string)
+	return name
+}
+
+// BaseContext returns a function for http.Server.BaseContext that marks all
+// requests of the server with the listener name. When a process serves
+// several listeners with one handler tree, limits can be scoped per listener
+// using a Router with OnListener routes, or shared between listeners by
+// routing their requests to the same limiter:
+//
+//	rt := maxconnections.NewRouter(100, 100, h) // shared by default
+//	rt.HandleFunc(maxconnections.OnListener("internal"), 10, 10)
+//	public := &http.Server{Handler: rt, BaseContext: maxconnections.BaseContext("public")}
+//	internal := &http.Server{Handler: rt, BaseContext: maxconnections.BaseContext("internal")}
+func BaseContext(name string) func(net.Listener) context.Context {
+	return func(net.Listener) context.Context {
+		return WithListener(context.Background(), name)
+	}
+}
+
+// OnListener returns a matcher for requests accepted by any of the named
+// listeners.
+func OnListener(names ...string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		name := ListenerFromContext(r.Context())
+		for _, n := range names {
+			if n == name {
+				return true
+			}
+		}
+		return false
+	}
+}
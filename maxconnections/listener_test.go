@@ -0,0 +1,38 @@
+package maxconnections
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestListener(t *testing.T) {
+	names := make(chan string, 1)
+	rt := NewRouter(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		names <- ListenerFromContext(r.Context())
+	}))
+	internal := rt.HandleFunc(OnListener("internal", "admin"), 1, 0)
+
+	ts := httptest.NewUnstartedServer(rt)
+	ts.Config.BaseContext = BaseContext("internal")
+	ts.Start()
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("failed to get %s: %s", ts.URL, err)
+	}
+	res.Body.Close()
+	if name := <-names; name != "internal" {
+		t.Fatalf("ListenerFromContext() = %q, want %q", name, "internal")
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	if m := rt.Limiter(r); m != rt.Default() {
+		t.Fatal("a request without a listener is not routed to the default limiter")
+	}
+	r = r.WithContext(WithListener(r.Context(), "admin"))
+	if m := rt.Limiter(r); m != internal {
+		t.Fatal("a request from the admin listener is not routed to the internal limiter")
+	}
+}
@@ -2,101 +2,564 @@ package maxconnections
 
 import (
 	"context"
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
+
+	"github.com/dmage/middleware/decisionlog"
 )
 
-func defaultOverloadHandler(w http.ResponseWriter, r *http.Request) {
-	http.Error(w, "503 service is overloaded, please try again later", http.StatusServiceUnavailable)
+var (
+	// ErrOverloaded is returned when a request is rejected because there
+	// are no free running units and no space in the queue, or because the
+	// request has not got running units in time.
+	ErrOverloaded = errors.New("maxconnections: overloaded")
+
+	// ErrShutdown is returned when a request is rejected because Shutdown
+	// has been called.
+	ErrShutdown = errors.New("maxconnections: shut down")
+
+	// ErrCanceled is returned when the request context is done before the
+	// request is admitted, e.g. the client has hung up while a proxy was
+	// holding the request or while the request was waiting in the queue.
+	// Requests that are already canceled when they arrive don't take queue
+	// places.
+	ErrCanceled = errors.New("maxconnections: request canceled")
+)
+
+// OverloadHandler is a default OverloadHandler for Middleware. Clients that
+// accept JSON get an RFC 7807 problem, see ProblemHandler.
+var OverloadHandler http.Handler = NewProblemHandler(http.StatusServiceUnavailable, "service is overloaded", "503 service is overloaded, please try again later")
+
+func defaultShutdownHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "503 service is shutting down", http.StatusServiceUnavailable)
 }
 
-// OverloadHandler is a default OverloadHandler for Middleware.
-var OverloadHandler http.Handler = http.HandlerFunc(defaultOverloadHandler)
+// ShutdownHandler is a default ShutdownHandler for Middleware.
+var ShutdownHandler http.Handler = http.HandlerFunc(defaultShutdownHandler)
+
+// StatusClientClosedRequest is the non-standard status code that is used by
+// CanceledHandler. It never reaches the client, but it distinguishes such
+// requests in access logs.
+const StatusClientClosedRequest = 499
+
+func defaultCanceledHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(StatusClientClosedRequest)
+}
+
+// CanceledHandler is a default CanceledHandler for Middleware. It writes no
+// body, as nobody is going to read it.
+var CanceledHandler http.Handler = http.HandlerFunc(defaultCanceledHandler)
+
+type brownoutKey struct{}
+
+// BrownoutFromContext reports whether the request was admitted while the
+// middleware was above its soft limit. Handlers may use it to degrade
+// responses, e.g. to skip expensive optional work.
+func BrownoutFromContext(ctx context.Context) bool {
+	brownout, _ := ctx.Value(brownoutKey{}).(bool)
+	return brownout
+}
+
+type maxQueueWaitKey struct{}
+
+// WithMaxQueueWait returns a copy of ctx that overrides MaxWaitInQueue for
+// requests with the context. If d is not positive, such requests wait in the
+// queue without a limit.
+func WithMaxQueueWait(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, maxQueueWaitKey{}, d)
+}
+
+type queueWaitKey struct{}
+
+// QueueWaitFromContext returns how long the request waited for admission.
+// Handlers may subtract it from their own latency measurements.
+func QueueWaitFromContext(ctx context.Context) time.Duration {
+	wait, _ := ctx.Value(queueWaitKey{}).(time.Duration)
+	return wait
+}
 
 // Middleware implements the http.Handler interface.
 type Middleware struct {
-	// running is a buffered channel. Before invoking the handler, an empty
-	// struct is sent to the channel. When the handler is finished, one element
-	// is received back from the channel. If the channel's buffer is full, the
-	// request is enqueued.
-	running chan struct{}
-
-	// queue is a buffered channel. An empty struct is placed into the channel
-	// while a request is waiting for a spot in the running channel's buffer.
-	// If the queue channel's buffer is full, the request is proccess by
-	// OverloadHandler.
-	queue chan struct{}
+	// Limiter admits requests. It can be shared with other middlewares.
+	*Limiter
 
 	// handler to invoke.
 	handler http.Handler
 
-	// MaxWaitInQueue is a maximum wait time in the queue.
-	MaxWaitInQueue time.Duration
+	// Skip, if not nil, reports whether the request bypasses the limiter.
+	// Skipped requests are passed to the handler right away and don't
+	// occupy running units, so health checks, readiness probes and metrics
+	// scrapes keep working when the server is overloaded. See SkipPaths and
+	// the exempt package for other rules.
+	Skip func(r *http.Request) bool
+
+	// Select, if not nil, returns the limiter that admits the request
+	// instead of Limiter, so that the choice can depend on anything in the
+	// request, e.g. headers or the authenticated principal. If it returns
+	// nil, the request bypasses the middleware like with Skip. See
+	// SelectByName.
+	Select func(r *http.Request) *Limiter
+
+	// QueueKey, if not nil, returns the queue key of the request. Keys are
+	// used to partition the queue capacity, see QueuePerKey, and by the
+	// FairShare discipline.
+	QueueKey func(r *http.Request) string
+
+	// DuplicateKey, if not nil, returns a key that identifies duplicates of
+	// the request, see ClientRequestKey. If a request with the same
+	// non-empty key is already waiting in the queue, the new request is
+	// rejected without waiting, or, if ReplaceDuplicates is set, it takes a
+	// place at the end of the queue and the older request is rejected.
+	// Impatient clients that keep hitting refresh don't multiply the queue
+	// pressure this way.
+	DuplicateKey      func(r *http.Request) string
+	ReplaceDuplicates bool
+
+	// Detachable allows handlers to keep the running units of their
+	// requests after they return, see DetachFromContext.
+	Detachable bool
+
+	// Cost, if not nil, returns the number of running units that the request
+	// needs. Heavy requests can occupy several units, so fewer of them can run
+	// at the same time. If Cost returns a value less than 1, the request needs
+	// one unit. Requests that need more than maxRunning units are rejected.
+	Cost func(r *http.Request) int
+
+	// MaxQueueWaitHeader, if not empty, is the name of a request header
+	// (e.g. X-Max-Queue-Wait) that overrides MaxWaitInQueue for the request,
+	// see WithMaxQueueWait. Its value is a duration like "200ms", invalid
+	// values are ignored. Clients can use it to wait longer than others, so
+	// it should be removed from untrusted requests before they reach the
+	// middleware.
+	MaxQueueWaitHeader string
 
-	// OverloadHandler is called if there is no space in running and queue
-	// channels.
+	// Criticality, if not nil, returns the criticality of the request,
+	// see WithCriticality. Otherwise the criticality is taken from the
+	// request context.
+	Criticality func(r *http.Request) Criticality
+
+	// PropagationHeaders makes the middleware take the criticality and the
+	// deadline of requests from CriticalityHeader and TimeoutHeader, which
+	// are set by a RoundTripper with PropagationHeaders. The headers should
+	// be removed from untrusted requests before they reach the middleware.
+	PropagationHeaders bool
+
+	// QueueWaitHeader, if not empty, is the name of a response header (e.g.
+	// X-Queue-Wait-Ms) that is set to the queue wait of the request in
+	// milliseconds.
+	QueueWaitHeader string
+
+	// QueuePositionHeader and QueueEstimateHeader, if not empty, are the
+	// names of response headers (e.g. X-Queue-Position and
+	// X-Queue-Estimate-Ms) that are set to the queue position and the
+	// estimated wait in milliseconds of requests that have met the queue,
+	// see QueueStatusFromContext. They are set on admitted responses and
+	// before the handlers of rejected requests are called.
+	QueuePositionHeader string
+	QueueEstimateHeader string
+
+	// QueueProgressInterval, if positive, makes requests that wait in the
+	// queue longer than the interval send 103 Early Hints responses with
+	// QueuePositionHeader and QueueEstimateHeader every interval, so that
+	// clients of long queues can show the progress, e.g. "you are #7 in
+	// queue". Clients that don't expect informational responses ignore
+	// them.
+	QueueProgressInterval time.Duration
+
+	// OverloadHandler is called if there are no free running slots and no
+	// space in the queue.
 	OverloadHandler http.Handler
 
-	// newTimer allows to override the function newTimer for tests.
-	newTimer func(d time.Duration) *time.Timer
+	// QueueFullHandler, if not nil, is called instead of OverloadHandler for
+	// requests that are rejected without waiting, e.g. because the queue is
+	// full or because of their criticality.
+	QueueFullHandler http.Handler
+
+	// QueueTimeoutHandler, if not nil, is called instead of OverloadHandler
+	// for requests that are rejected after waiting in the queue, e.g.
+	// because MaxWaitInQueue has expired.
+	QueueTimeoutHandler http.Handler
+
+	// ShutdownHandler is called for requests that are not admitted because
+	// Shutdown has been called.
+	ShutdownHandler http.Handler
+
+	// CanceledHandler is called for requests whose context is done before
+	// they are admitted, see ErrCanceled. The default one writes the
+	// StatusClientClosedRequest status without a body, so that logging
+	// middlewares can tell such requests from rejections.
+	CanceledHandler http.Handler
+
+	// OnCanceled, if not nil, is called for requests whose context is done
+	// before they are admitted, before CanceledHandler.
+	OnCanceled func(r *http.Request)
+
+	// CloseConnections, if not nil, counts rejections per client and asks
+	// clients that are rejected too often to close their connections, see
+	// ConnCloser.
+	CloseConnections *ConnCloser
+
+	// OnPanic, if not nil, is called when the handler of an admitted
+	// request panics, including with http.ErrAbortHandler, with the value
+	// passed to panic. The panic continues after it returns. The running
+	// units of the request are released whether or not OnPanic is set.
+	OnPanic func(r *http.Request, v interface{})
+
+	// TrackWriteStall enables tracking of the time that handlers spend
+	// blocked writing responses, see WriteStallFromContext and
+	// Stats.WriteStall.
+	TrackWriteStall bool
+
+	// StallRelease, if positive, enables tracking of write stalls and
+	// releases the running units of a request whose write has been
+	// blocked longer than StallRelease, so that slow clients don't hold
+	// them. When the write returns, the request waits for its units in the
+	// queue like a new request. If it cannot get them, e.g. because the
+	// queue is full, it finishes without them.
+	StallRelease time.Duration
+
+	// LongLived, if not nil, is the limiter for hijacked connections, e.g.
+	// WebSockets. When a handler hijacks its connection, the request
+	// releases its running units and the connection occupies a running
+	// unit of LongLived until it is closed, so that a few long-lived
+	// connections cannot consume the concurrency budget of ordinary
+	// requests forever. If LongLived has no free units, Hijack fails with
+	// ErrOverloaded. Without LongLived a hijacked connection keeps its
+	// units until the handler returns.
+	LongLived *Limiter
+
+	// Streaming, if not nil, is the limiter for streaming responses, e.g.
+	// server-sent events, long polls and large downloads, so that
+	// long streams and short API calls don't share a running pool, which
+	// would make its limit meaningless for both. Requests matched by
+	// IsStreaming are admitted by Streaming instead of the limiter of the
+	// middleware. With StreamOnFlush, other requests move to Streaming
+	// when their handlers flush the response for the first time.
+	Streaming *Limiter
+
+	// IsStreaming, if not nil, reports whether the request is going to
+	// get a streaming response, see IsEventStream.
+	IsStreaming func(r *http.Request) bool
+
+	// StreamOnFlush makes requests release their running units and occupy
+	// a unit of Streaming when they flush the response for the first
+	// time. If Streaming has no free units, the request keeps its units.
+	StreamOnFlush bool
+
+	// Bytes, if not nil, limits the total declared size of the bodies of
+	// running requests in addition to their number. A request needs as
+	// many running units of Bytes as its Content-Length, so the byte
+	// budget is the maxRunning of Bytes, e.g. NewLimiter(1<<30, 100) for
+	// 1 GiB. Requests wait for Bytes after they are admitted by the
+	// limiter of the middleware, uploads larger than the budget are
+	// rejected. Requests without a body don't use Bytes, requests with an
+	// unknown length need UnknownBodyBytes units.
+	Bytes            *Limiter
+	UnknownBodyBytes int
+
+	// ServerTiming makes the middleware add the queue wait of admitted
+	// requests to the Server-Timing response header as the "queue" metric,
+	// and send the duration of the handler in the Server-Timing trailer as
+	// the "handler" metric, so that browsers and proxies can see where the
+	// time went. Trailers are sent only with chunked HTTP/1.1 and HTTP/2
+	// responses, e.g. streamed ones.
+	ServerTiming bool
+
+	// NoParallelism stops the middleware from attaching its limiter to the
+	// context of admitted requests, so that ParallelismFromContext returns
+	// the number of CPUs for them. By default, the hint costs every
+	// admitted request two allocations, a context value and a shallow copy
+	// of the request that carries it, and they are the only allocations of
+	// a request that is admitted without waiting. With NoParallelism such
+	// requests cost no allocations at all. Other details of the admission,
+	// see withAdmission, are attached only if they differ from their
+	// defaults, so they don't cost anything on this path either way.
+	NoParallelism bool
 }
 
 // New returns an http.Handler that runs no more than maxRunning h at the same
 // time. It can enqueue up to maxInQueue requests awaiting to be run, for other
 // requests OverloadHandler will be invoked.
 func New(maxRunning, maxInQueue int, h http.Handler) *Middleware {
+	return NewWithLimiter(NewLimiter(maxRunning, maxInQueue), h)
+}
+
+// NewWithLimiter returns an http.Handler that runs h when l admits the
+// request. Several middlewares created with the same l share its running
+// units and queue.
+func NewWithLimiter(l *Limiter, h http.Handler) *Middleware {
 	return &Middleware{
-		running: make(chan struct{}, maxRunning),
-		queue:   make(chan struct{}, maxInQueue),
+		Limiter: l,
 		handler: h,
 
 		OverloadHandler: OverloadHandler,
-		newTimer:        time.NewTimer,
+		ShutdownHandler: ShutdownHandler,
+		CanceledHandler: CanceledHandler,
 	}
 }
 
-func (m *Middleware) enqueueRunning(ctx context.Context) bool {
-	select {
-	case m.running <- struct{}{}:
-		return true
-	default:
+// cost returns the number of running units for r.
+func (m *Middleware) cost(r *http.Request) int {
+	if m.Cost == nil {
+		return 1
+	}
+	if n := m.Cost(r); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// queueKey returns the queue key for r.
+func (m *Middleware) queueKey(r *http.Request) string {
+	if m.QueueKey == nil {
+		return ""
 	}
+	return m.QueueKey(r)
+}
 
-	// Slow-path.
-	select {
-	case m.queue <- struct{}{}:
-		defer func() {
-			<-m.queue
-		}()
-	default:
-		return false
+// ClientRequestKey returns a DuplicateKey function that considers requests
+// duplicates if they come from the same client, according to client, and
+// have the same method and path. Requests of unknown clients, for which
+// client returns an empty string, are never duplicates.
+func ClientRequestKey(client func(r *http.Request) string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		c := client(r)
+		if c == "" {
+			return ""
+		}
+		return c + " " + r.Method + " " + r.URL.Path
+	}
+}
+
+// limiter returns the limiter for r, see Select. It returns nil if r
+// bypasses the middleware.
+func (m *Middleware) limiter(r *http.Request) *Limiter {
+	if m.Skip != nil && m.Skip(r) {
+		return nil
+	}
+	if m.Select != nil {
+		return m.Select(r)
+	}
+	return m.Limiter
+}
+
+// SelectByName returns a Select function that looks up the limiter of the
+// request by the name that name returns. Requests with names that are not
+// in limiters bypass the middleware.
+func SelectByName(limiters map[string]*Limiter, name func(r *http.Request) string) func(r *http.Request) *Limiter {
+	return func(r *http.Request) *Limiter {
+		return limiters[name(r)]
+	}
+}
+
+// admit waits until r gets its running units from l.
+func (m *Middleware) admit(r *http.Request, l *Limiter) (admission, error) {
+	ctx := r.Context()
+	if m.MaxQueueWaitHeader != "" {
+		if d, err := time.ParseDuration(r.Header.Get(m.MaxQueueWaitHeader)); err == nil {
+			ctx = WithMaxQueueWait(ctx, d)
+		}
+	}
+	if m.Criticality != nil {
+		ctx = WithCriticality(ctx, m.Criticality(r))
+	}
+	if m.DuplicateKey != nil {
+		ctx = withDuplicateKey(ctx, m.DuplicateKey(r), m.ReplaceDuplicates)
+	}
+	if m.Streaming != nil && m.IsStreaming != nil && m.IsStreaming(r) {
+		l = m.Streaming
+	}
+	a, err := l.acquire(ctx, m.cost(r), m.queueKey(r))
+	if err == nil && m.Bytes != nil {
+		if n := m.bodyBytes(r); n > 0 {
+			b, err := m.Bytes.acquire(ctx, n, m.queueKey(r))
+			if err != nil {
+				l.done(a)
+				b.criticality = CriticalityFromContext(ctx)
+				return b, err
+			}
+			a.bytes = &b
+		}
+	}
+	a.criticality = CriticalityFromContext(ctx)
+	return a, err
+}
+
+// bodyBytes returns the number of running units of Bytes that r needs.
+func (m *Middleware) bodyBytes(r *http.Request) int {
+	switch {
+	case r.ContentLength > int64(math.MaxInt):
+		return math.MaxInt
+	case r.ContentLength >= 0:
+		return int(r.ContentLength)
+	}
+	return m.UnknownBodyBytes
+}
+
+// withAdmission returns r with the details of the admission a in its
+// context, see QueueWaitFromContext, BrownoutFromContext,
+// QueueStatusFromContext and, if parallelism is true,
+// ParallelismFromContext. Only details that differ from their defaults are
+// added, so a request that is admitted without waiting may be returned as
+// is. The criticality of the admission is kept, so that outbound requests
+// of the handler inherit it.
+func withAdmission(r *http.Request, a admission, parallelism bool) *http.Request {
+	ctx := r.Context()
+	if a.wait != 0 {
+		ctx = context.WithValue(ctx, queueWaitKey{}, a.wait)
+	}
+	if a.criticality != CriticalityFromContext(ctx) {
+		ctx = WithCriticality(ctx, a.criticality)
 	}
+	if parallelism {
+		ctx = context.WithValue(ctx, limiterKey{}, a.l)
+	}
+	if a.queue.Length > 0 {
+		ctx = context.WithValue(ctx, queueStatusKey{}, a.queue)
+	}
+	if a.brownout {
+		ctx = context.WithValue(ctx, brownoutKey{}, true)
+	}
+	if ctx == r.Context() {
+		return r
+	}
+	return r.WithContext(ctx)
+}
 
-	var timer *time.Timer
-	var timeout <-chan time.Time
-	if m.MaxWaitInQueue > 0 {
-		timer = m.newTimer(m.MaxWaitInQueue)
-		defer timer.Stop()
-		timeout = timer.C
+// handlePanic passes the panic of the handler of r to OnPanic and continues
+// panicking. It should be deferred.
+func (m *Middleware) handlePanic(r *http.Request) {
+	if v := recover(); v != nil {
+		m.OnPanic(r, v)
+		panic(v)
 	}
+}
 
-	select {
-	case m.running <- struct{}{}:
-		return true
-	case <-timeout:
-	case <-ctx.Done():
+// tracksResponse reports whether the request admitted with a needs a
+// wrapped ResponseWriter or a release that can be called before the handler
+// returns.
+func (m *Middleware) tracksResponse(a admission) bool {
+	return m.TrackWriteStall || m.StallRelease > 0 || m.Detachable ||
+		(m.Streaming != nil && m.StreamOnFlush && a.l != m.Streaming) ||
+		m.LongLived != nil
+}
+
+// serveTracked runs the handler for the request admitted with a, see
+// tracksResponse.
+func (m *Middleware) serveTracked(w http.ResponseWriter, r *http.Request, a admission) {
+	var sw *stallWriter
+	if m.TrackWriteStall || m.StallRelease > 0 {
+		sw, r = m.trackWriteStall(w, r, a.l, a.n)
+		w = sw
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			if sw != nil {
+				a.n = sw.detach()
+			}
+			a.l.done(a)
+		})
+	}
+	if m.Detachable {
+		d := &detachable{release: release}
+		r = r.WithContext(context.WithValue(r.Context(), detachKey{}, d))
+		defer d.finish()
+	} else {
+		defer release()
+	}
+	if m.Streaming != nil && m.StreamOnFlush && a.l != m.Streaming {
+		stw := &streamWriter{ResponseWriter: w, m: m, ctx: r.Context(), release: release}
+		defer stw.done()
+		w = stw
+	}
+	if m.LongLived != nil {
+		w = &hijackWriter{ResponseWriter: w, m: m, ctx: r.Context(), release: release}
+	}
+	m.handler.ServeHTTP(w, r)
+}
+
+// overloadHandler returns the handler for a request that is rejected with
+// ErrOverloaded because of cause.
+func (m *Middleware) overloadHandler(cause overload) http.Handler {
+	switch {
+	case (cause == overloadQueueFull || cause == overloadShed || cause == overloadSLO) && m.QueueFullHandler != nil:
+		return m.QueueFullHandler
+	case cause == overloadQueueTimeout && m.QueueTimeoutHandler != nil:
+		return m.QueueTimeoutHandler
+	}
+	return m.OverloadHandler
+}
+
+// SkipPaths returns a Skip function for requests with one of the given
+// paths, e.g. "/healthz", "/readyz" and "/metrics".
+func SkipPaths(paths ...string) func(r *http.Request) bool {
+	set := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		set[p] = true
+	}
+	return func(r *http.Request) bool {
+		return set[r.URL.Path]
 	}
-	return false
 }
 
 func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if m.enqueueRunning(r.Context()) {
-		defer func() {
-			<-m.running
-		}()
+	l := m.limiter(r)
+	if l == nil {
 		m.handler.ServeHTTP(w, r)
 		return
 	}
-
-	m.OverloadHandler.ServeHTTP(w, r)
+	if m.PropagationHeaders {
+		var cancel context.CancelFunc
+		r, cancel = WithPropagationHeaders(r)
+		defer cancel()
+	}
+	a, err := m.admit(m.withQueueProgressHints(w, r), l)
+	if a.queue.Length > 0 {
+		m.setQueueStatusHeaders(w.Header(), a.queue)
+	}
+	switch err {
+	case nil:
+		decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "maxconnections", Action: decisionlog.Allow})
+		r = withAdmission(r, a, !m.NoParallelism)
+		if m.QueueWaitHeader != "" {
+			w.Header().Set(m.QueueWaitHeader, strconv.FormatInt(int64(a.wait/time.Millisecond), 10))
+		}
+		if m.ServerTiming {
+			defer finishServerTiming(w, a.l, startServerTiming(w, a))
+		}
+		if m.OnPanic != nil {
+			defer m.handlePanic(r)
+		}
+		if m.tracksResponse(a) {
+			m.serveTracked(w, r, a)
+			return
+		}
+		// The common path doesn't allocate. The units are released by a
+		// deferred call, so that a panicking handler doesn't leak them.
+		defer a.l.done(a)
+		m.handler.ServeHTTP(w, r)
+	case ErrShutdown:
+		decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "maxconnections", Action: decisionlog.Deny, Reason: "shutdown"})
+		m.ShutdownHandler.ServeHTTP(w, r)
+	case ErrCanceled:
+		decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "maxconnections", Action: decisionlog.Deny, Reason: "canceled"})
+		if m.OnCanceled != nil {
+			m.OnCanceled(r)
+		}
+		m.CanceledHandler.ServeHTTP(w, r)
+	default:
+		decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "maxconnections", Action: decisionlog.Deny, Reason: a.overload.String()})
+		if a.queue.Length > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), queueStatusKey{}, a.queue))
+		}
+		if m.CloseConnections != nil {
+			m.CloseConnections.Rejected(w, r)
+		}
+		m.overloadHandler(a.overload).ServeHTTP(w, withRejection(r, a))
+	}
 }
@@ -1,9 +1,13 @@
 package maxconnections
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"runtime"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -52,6 +56,23 @@ func (c *counter) Equal(m map[int]int) bool {
 	return true
 }
 
+// waitQueued waits until n requests are in the queue of m.
+func waitQueued(t *testing.T, m *Middleware, n int, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		m.mu.Lock()
+		waiting := m.waiting()
+		m.mu.Unlock()
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout while waiting for %d requests in the queue, got %d", n, waiting)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func TestCoutner(t *testing.T) {
 	c := newCounter()
 	c.Add(100, 1)
@@ -95,10 +116,10 @@ func TestMaxConnections(t *testing.T) {
 	}))
 
 	deadline := make(chan time.Time)
-	h.newTimer = func(d time.Duration) *time.Timer {
-		t := time.NewTimer(d)
-		t.C = deadline
-		return t
+	h.Clock = &testClock{
+		newTimer: func(d time.Duration) Timer {
+			return chanTimer(deadline)
+		},
 	}
 	h.MaxWaitInQueue = 1 // all clients in the queue will be rejected when the channel deadline is closed.
 
@@ -164,3 +185,1085 @@ func TestMaxConnections(t *testing.T) {
 		t.Errorf("c = %v, want %v", c.Values(), expected)
 	}
 }
+
+func TestShutdown(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	handlerBarrier := make(chan struct{})
+	started := make(chan struct{})
+	h := New(1, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-handlerBarrier
+		http.Error(w, "OK", http.StatusOK)
+	}))
+	h.ShutdownHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "shutting down", http.StatusGone)
+	})
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	c := newCounter()
+	done := make(chan struct{})
+	get := func() {
+		res, err := http.Get(ts.URL)
+		if err != nil {
+			t.Errorf("failed to get %s: %s", ts.URL, err)
+		} else {
+			c.Add(res.StatusCode, 1)
+			res.Body.Close()
+		}
+		done <- struct{}{}
+	}
+	wait := func(ch <-chan struct{}, reason string) {
+		select {
+		case <-ch:
+		case <-time.After(timeout):
+			t.Fatal(reason)
+		}
+	}
+
+	go get()
+	wait(started, "timeout while waiting for the handler to start")
+	go get()
+
+	waitQueued(t, h, 1, timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	wait(done, "timeout while waiting for the queued client to be rejected")
+	go get()
+	wait(done, "timeout while waiting for the new client to be rejected")
+	if expected := map[int]int{http.StatusGone: 2}; !c.Equal(expected) {
+		t.Errorf("c = %v, want %v", c.Values(), expected)
+	}
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- h.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdownDone:
+		t.Fatalf("Shutdown() = %v before the running handler has finished", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(handlerBarrier)
+	wait(done, "timeout while waiting for the running client")
+	select {
+	case err := <-shutdownDone:
+		if err != nil {
+			t.Fatalf("Shutdown() = %v, want nil", err)
+		}
+	case <-time.After(timeout):
+		t.Fatal("timeout while waiting for Shutdown")
+	}
+	if expected := map[int]int{http.StatusOK: 1, http.StatusGone: 2}; !c.Equal(expected) {
+		t.Errorf("c = %v, want %v", c.Values(), expected)
+	}
+}
+
+func TestSoftLimit(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	h := New(1, 3, nil)
+	h.SoftLimit = 3
+
+	type result struct {
+		name     string
+		brownout bool
+		err      error
+	}
+	results := make(chan result)
+	enqueue := func(ctx context.Context, name string) {
+		go func() {
+			brownout, err := h.enqueueRunning(ctx, 1, "")
+			results <- result{name: name, brownout: brownout, err: err}
+		}()
+	}
+	next := func() result {
+		select {
+		case res := <-results:
+			return res
+		case <-time.After(timeout):
+			t.Fatal("timeout while waiting for a request")
+		}
+		return result{}
+	}
+
+	if brownout, err := h.enqueueRunning(context.Background(), 1, ""); brownout || err != nil {
+		t.Fatalf("enqueueRunning() = %v, %v; want false, nil", brownout, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	enqueue(ctx, "b")
+	waitQueued(t, h, 1, timeout)
+	if h.Brownout() {
+		t.Fatal("Brownout() = true, want false")
+	}
+	enqueue(ctx, "c")
+	waitQueued(t, h, 2, timeout)
+	if !h.Brownout() {
+		t.Fatal("Brownout() = false, want true")
+	}
+
+	enqueue(context.Background(), "d")
+	waitQueued(t, h, 3, timeout)
+
+	cancel()
+	for i := 0; i < 2; i++ {
+		if res := next(); res.err != ErrCanceled {
+			t.Fatalf("request %s: err = %v, want %v", res.name, res.err, ErrCanceled)
+		}
+	}
+
+	// The load is below the soft limit again, so the new request should be
+	// admitted before the deprioritized one.
+	enqueue(context.Background(), "e")
+	waitQueued(t, h, 2, timeout)
+
+	h.releaseRunning(1)
+	if res := next(); res.name != "e" || res.brownout || res.err != nil {
+		t.Fatalf("got %+v, want request e admitted without brownout", res)
+	}
+	h.releaseRunning(1)
+	if res := next(); res.name != "d" || !res.brownout || res.err != nil {
+		t.Fatalf("got %+v, want request d admitted in brownout", res)
+	}
+}
+
+// waitRunning waits until n handlers are running in m.
+func waitRunning(t *testing.T, m *Middleware, n int, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		running := m.runningUnits()
+		if running == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout while waiting for %d running requests, got %d", n, running)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCost(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	h := New(3, 3, nil)
+
+	admitted := make(chan int)
+	enqueue := func(n int) {
+		go func() {
+			_, err := h.enqueueRunning(context.Background(), n, "")
+			if err != nil {
+				t.Errorf("enqueueRunning(%d) = %v, want nil", n, err)
+			}
+			admitted <- n
+		}()
+	}
+	expectAdmitted := func(n int) {
+		select {
+		case got := <-admitted:
+			if got != n {
+				t.Fatalf("admitted request with cost %d, want %d", got, n)
+			}
+		case <-time.After(timeout):
+			t.Fatalf("timeout while waiting for request with cost %d", n)
+		}
+	}
+
+	if _, err := h.enqueueRunning(context.Background(), 4, ""); err != ErrOverloaded {
+		t.Fatalf("enqueueRunning(4) = %v, want %v", err, ErrOverloaded)
+	}
+
+	enqueue(2)
+	expectAdmitted(2)
+
+	// The heavy request should block the light one behind it.
+	enqueue(3)
+	waitQueued(t, h, 1, timeout)
+	enqueue(1)
+	waitQueued(t, h, 2, timeout)
+
+	h.releaseRunning(2)
+	expectAdmitted(3)
+	waitQueued(t, h, 1, timeout)
+
+	h.releaseRunning(3)
+	expectAdmitted(1)
+
+	h.mu.Lock()
+	running, queuedCost := h.runningUnits(), h.queuedCost
+	h.mu.Unlock()
+	if running != 1 || queuedCost != 0 {
+		t.Fatalf("running = %d, queuedCost = %d; want 1, 0", running, queuedCost)
+	}
+}
+
+func TestSetMaxRunning(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	h := New(1, 2, nil)
+	if _, err := h.enqueueRunning(context.Background(), 1, ""); err != nil {
+		t.Fatalf("enqueueRunning() = %v, want nil", err)
+	}
+
+	admitted := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			if _, err := h.enqueueRunning(context.Background(), 1, ""); err != nil {
+				t.Errorf("enqueueRunning() = %v, want nil", err)
+			}
+			admitted <- struct{}{}
+		}()
+	}
+	waitQueued(t, h, 2, timeout)
+
+	h.SetMaxRunning(3)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-admitted:
+		case <-time.After(timeout):
+			t.Fatal("timeout while waiting for queued requests to be admitted")
+		}
+	}
+
+	h.SetMaxRunning(1)
+	if max := h.MaxRunning(); max != 1 {
+		t.Fatalf("MaxRunning() = %d, want %d", max, 1)
+	}
+	h.releaseRunning(1)
+	go func() {
+		h.enqueueRunning(context.Background(), 1, "")
+		admitted <- struct{}{}
+	}()
+	waitQueued(t, h, 1, timeout)
+	h.releaseRunning(1)
+	h.releaseRunning(1)
+	select {
+	case <-admitted:
+	case <-time.After(timeout):
+		t.Fatal("timeout while waiting for the queued request to be admitted")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	now := time.Unix(0, 0)
+	h := New(1, 3, nil)
+	h.SoftLimit = 3
+	h.MaxLowQueueAge = time.Minute
+	h.Clock = &testClock{
+		now: func() time.Time {
+			return now
+		},
+	}
+
+	if _, err := h.enqueueRunning(context.Background(), 1, ""); err != nil {
+		t.Fatalf("enqueueRunning() = %v, want nil", err)
+	}
+
+	errs := make(chan error)
+	enqueue := func(ctx context.Context) {
+		go func() {
+			_, err := h.enqueueRunning(ctx, 1, "")
+			errs <- err
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	enqueue(ctx)
+	waitQueued(t, h, 1, timeout)
+	enqueue(context.Background())
+	waitQueued(t, h, 2, timeout)
+	enqueue(context.Background()) // deprioritized
+	waitQueued(t, h, 3, timeout)
+
+	now = now.Add(2 * time.Minute)
+	h.mu.Lock()
+	h.sweep()
+	h.mu.Unlock()
+	select {
+	case err := <-errs:
+		if err != ErrOverloaded {
+			t.Fatalf("the old deprioritized request got %v, want %v", err, ErrOverloaded)
+		}
+	case <-time.After(timeout):
+		t.Fatal("timeout while waiting for the old request to be evicted")
+	}
+	waitQueued(t, h, 2, timeout)
+
+	// Make sure the canceled request is still in the queue when the sweep
+	// runs: hold the lock while the context is canceled.
+	h.mu.Lock()
+	cancel()
+	h.sweep()
+	if waiting := h.waiting(); waiting != 1 {
+		t.Errorf("%d requests in the queue after the sweep, want %d", waiting, 1)
+	}
+	h.mu.Unlock()
+	if err := <-errs; err != ErrCanceled {
+		t.Fatalf("the canceled request got %v, want %v", err, ErrCanceled)
+	}
+
+	h.releaseRunning(1)
+	if err := <-errs; err != nil {
+		t.Fatalf("the normal request got %v, want nil", err)
+	}
+}
+
+func TestSweepLoop(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	h := New(1, 1, nil)
+	h.SweepInterval = time.Millisecond
+	h.MaxQueueAge = time.Nanosecond
+
+	if _, err := h.enqueueRunning(context.Background(), 1, ""); err != nil {
+		t.Fatalf("enqueueRunning() = %v, want nil", err)
+	}
+	errs := make(chan error)
+	go func() {
+		_, err := h.enqueueRunning(context.Background(), 1, "")
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		if err != ErrOverloaded {
+			t.Fatalf("enqueueRunning() = %v, want %v", err, ErrOverloaded)
+		}
+	case <-time.After(timeout):
+		t.Fatal("timeout while waiting for the request to be swept")
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		h.mu.Lock()
+		sweeping := h.sweeping
+		h.mu.Unlock()
+		if !sweeping {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout while waiting for the sweeper to stop")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDeadlineAware(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	now := time.Now()
+	h := New(2, 4, nil)
+	h.DeadlineAware = true
+	h.Clock = &testClock{
+		now: func() time.Time {
+			return now
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := h.enqueueRunning(context.Background(), 1, ""); err != nil {
+			t.Fatalf("enqueueRunning() = %v, want nil", err)
+		}
+	}
+
+	// Without service time samples there is no estimate.
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(timeout))
+	defer cancel()
+	errs := make(chan error)
+	go func() {
+		_, err := h.enqueueRunning(ctx, 1, "")
+		errs <- err
+	}()
+	waitQueued(t, h, 1, timeout)
+
+	h.finish(1, now.Add(-100*time.Millisecond))
+	if err := <-errs; err != nil {
+		t.Fatalf("enqueueRunning() = %v, want nil", err)
+	}
+
+	// One request in the queue and two running slots with 100ms service
+	// time: the new request has to wait about 100ms.
+	go func() {
+		_, err := h.enqueueRunning(context.Background(), 1, "")
+		errs <- err
+	}()
+	waitQueued(t, h, 1, timeout)
+
+	ctx, cancel = context.WithDeadline(context.Background(), now.Add(50*time.Millisecond))
+	defer cancel()
+	if _, err := h.enqueueRunning(ctx, 1, ""); err != ErrOverloaded {
+		t.Fatalf("enqueueRunning() with a short deadline = %v, want %v", err, ErrOverloaded)
+	}
+
+	ctx, cancel = context.WithDeadline(context.Background(), now.Add(time.Hour))
+	defer cancel()
+	go func() {
+		_, err := h.enqueueRunning(ctx, 1, "")
+		errs <- err
+	}()
+	waitQueued(t, h, 2, timeout)
+	h.releaseRunning(1)
+	h.releaseRunning(1)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("enqueueRunning() = %v, want nil", err)
+		}
+	}
+}
+
+func TestQueueKey(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	h := New(1, 3, nil)
+	h.QueueKey = func(r *http.Request) string {
+		return ""
+	}
+	h.QueuePerKey = 1
+
+	if _, err := h.enqueueRunning(context.Background(), 1, ""); err != nil {
+		t.Fatalf("enqueueRunning() = %v, want nil", err)
+	}
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result)
+	enqueue := func(name, key string) {
+		go func() {
+			_, err := h.enqueueRunning(context.Background(), 1, key)
+			results <- result{name: name, err: err}
+		}()
+	}
+	next := func() result {
+		select {
+		case res := <-results:
+			return res
+		case <-time.After(timeout):
+			t.Fatal("timeout while waiting for a request")
+		}
+		return result{}
+	}
+
+	// The key a borrows places of other keys.
+	enqueue("a1", "a")
+	waitQueued(t, h, 1, timeout)
+	enqueue("a2", "a")
+	waitQueued(t, h, 2, timeout)
+	enqueue("a3", "a")
+	waitQueued(t, h, 3, timeout)
+
+	// The key b reclaims its place.
+	enqueue("b1", "b")
+	if res := next(); res.name != "a3" || res.err != ErrOverloaded {
+		t.Fatalf("got %+v, want a3 to be rejected", res)
+	}
+	waitQueued(t, h, 3, timeout)
+
+	enqueue("c1", "c")
+	if res := next(); res.name != "a2" || res.err != ErrOverloaded {
+		t.Fatalf("got %+v, want a2 to be rejected", res)
+	}
+	waitQueued(t, h, 3, timeout)
+
+	// Nobody exceeds its share now.
+	if _, err := h.enqueueRunning(context.Background(), 1, "d"); err != ErrOverloaded {
+		t.Fatalf("enqueueRunning() = %v, want %v", err, ErrOverloaded)
+	}
+	if _, err := h.enqueueRunning(context.Background(), 1, "a"); err != ErrOverloaded {
+		t.Fatalf("enqueueRunning() = %v, want %v", err, ErrOverloaded)
+	}
+
+	for _, expected := range []string{"a1", "b1", "c1"} {
+		h.releaseRunning(1)
+		if res := next(); res.name != expected || res.err != nil {
+			t.Fatalf("got %+v, want %s to be admitted", res, expected)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.queuedByKey) != 0 {
+		t.Fatalf("queuedByKey = %v, want it to be empty", h.queuedByKey)
+	}
+}
+
+func TestQueueDiscipline(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	testCases := []struct {
+		name       string
+		discipline QueueDiscipline
+		age        time.Duration
+		expected   []string
+	}{
+		{"FIFO", FIFO, time.Minute, []string{"a", "b", "c"}},
+		{"LIFO", LIFO, 0, []string{"c", "b", "a"}},
+		{"AdaptiveLIFO/fresh", AdaptiveLIFO, time.Millisecond, []string{"a", "b", "c"}},
+		{"AdaptiveLIFO/stale", AdaptiveLIFO, time.Minute, []string{"c", "b", "a"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			now := time.Unix(0, 0)
+			h := New(1, 3, nil)
+			h.QueueDiscipline = tc.discipline
+			h.AdaptiveLIFOThreshold = time.Second
+			h.Clock = &testClock{
+				now: func() time.Time {
+					mu.Lock()
+					defer mu.Unlock()
+					return now
+				},
+			}
+
+			if _, err := h.enqueueRunning(context.Background(), 1, ""); err != nil {
+				t.Fatalf("enqueueRunning() = %v, want nil", err)
+			}
+			admitted := make(chan string)
+			for i, name := range []string{"a", "b", "c"} {
+				name := name
+				go func() {
+					if _, err := h.enqueueRunning(context.Background(), 1, ""); err != nil {
+						t.Errorf("enqueueRunning() = %v, want nil", err)
+					}
+					admitted <- name
+				}()
+				waitQueued(t, h, i+1, timeout)
+			}
+
+			mu.Lock()
+			now = now.Add(tc.age)
+			mu.Unlock()
+
+			for _, expected := range tc.expected {
+				h.releaseRunning(1)
+				select {
+				case name := <-admitted:
+					if name != expected {
+						t.Fatalf("admitted %s, want %s", name, expected)
+					}
+				case <-time.After(timeout):
+					t.Fatal("timeout while waiting for a request")
+				}
+			}
+		})
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	h := New(2, 1, nil)
+	release, err := h.AcquireN(context.Background(), 2)
+	if err != nil {
+		t.Fatalf("AcquireN(2) = %v, want nil", err)
+	}
+
+	errs := make(chan error)
+	go func() {
+		release, err := h.Acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		errs <- err
+	}()
+	waitQueued(t, h, 1, timeout)
+	if _, err := h.Acquire(context.Background()); err != ErrOverloaded {
+		t.Fatalf("Acquire() = %v, want %v", err, ErrOverloaded)
+	}
+
+	release()
+	if err := <-errs; err != nil {
+		t.Fatalf("Acquire() = %v, want nil", err)
+	}
+	waitRunning(t, h, 0, timeout)
+}
+
+func TestQueueWait(t *testing.T) {
+	const timeout = 1 * time.Second
+	const delay = 20 * time.Millisecond
+
+	waits := make(chan time.Duration, 1)
+	h := New(1, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		waits <- QueueWaitFromContext(r.Context())
+	}))
+	h.QueueWaitHeader = "X-Queue-Wait-Ms"
+
+	release, err := h.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire() = %v, want nil", err)
+	}
+
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		close(done)
+	}()
+	waitQueued(t, h, 1, timeout)
+	time.Sleep(delay)
+	release()
+	<-done
+
+	if wait := <-waits; wait < delay {
+		t.Fatalf("QueueWaitFromContext = %v, want at least %v", wait, delay)
+	}
+	ms, err := strconv.Atoi(rec.Header().Get("X-Queue-Wait-Ms"))
+	if err != nil || time.Duration(ms)*time.Millisecond < delay {
+		t.Fatalf("X-Queue-Wait-Ms = %q, want at least %d", rec.Header().Get("X-Queue-Wait-Ms"), delay/time.Millisecond)
+	}
+}
+
+func TestFairShare(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	testCases := []struct {
+		name     string
+		weights  map[string]int
+		expected []string
+	}{
+		{"equal", nil, []string{"a1", "b1", "a2", "b2", "a3"}},
+		{"weighted", map[string]int{"a": 2}, []string{"a1", "b1", "a2", "a3", "b2"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := New(1, 5, nil)
+			h.QueueDiscipline = FairShare
+			h.QueueKey = func(r *http.Request) string {
+				return ""
+			}
+			h.QueueWeight = func(key string) int {
+				return tc.weights[key]
+			}
+
+			if _, err := h.enqueueRunning(context.Background(), 1, ""); err != nil {
+				t.Fatalf("enqueueRunning() = %v, want nil", err)
+			}
+			admitted := make(chan string)
+			for i, name := range []string{"a1", "a2", "a3", "b1", "b2"} {
+				name := name
+				go func() {
+					if _, err := h.enqueueRunning(context.Background(), 1, name[:1]); err != nil {
+						t.Errorf("enqueueRunning() = %v, want nil", err)
+					}
+					admitted <- name
+				}()
+				waitQueued(t, h, i+1, timeout)
+			}
+
+			for _, expected := range tc.expected {
+				h.releaseRunning(1)
+				select {
+				case name := <-admitted:
+					if name != expected {
+						t.Fatalf("admitted %s, want %s", name, expected)
+					}
+				case <-time.After(timeout):
+					t.Fatal("timeout while waiting for a request")
+				}
+			}
+		})
+	}
+}
+
+func TestEarliestDeadline(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	h := New(1, 5, nil)
+	h.QueueDiscipline = EarliestDeadline
+	h.EstimateQueueWait = true
+	h.serviceTime.observe(time.Hour)
+
+	if _, err := h.enqueueRunning(context.Background(), 1, ""); err != nil {
+		t.Fatalf("enqueueRunning() = %v, want nil", err)
+	}
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result)
+	deadlines := []struct {
+		name    string
+		timeout time.Duration
+	}{
+		{"none", 0},
+		{"3h", 3 * time.Hour},
+		{"hopeless", time.Minute},
+		{"1h", 90 * time.Minute},
+		{"2h", 2 * time.Hour},
+	}
+	for i, d := range deadlines {
+		d := d
+		go func() {
+			ctx := context.Background()
+			if d.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, d.timeout)
+				defer cancel()
+			}
+			_, err := h.enqueueRunning(ctx, 1, "")
+			results <- result{d.name, err}
+		}()
+		waitQueued(t, h, i+1, timeout)
+	}
+
+	receive := func() result {
+		t.Helper()
+		select {
+		case r := <-results:
+			return r
+		case <-time.After(timeout):
+			t.Fatal("timeout while waiting for a request")
+		}
+		return result{}
+	}
+
+	// The request that cannot make it in time is rejected when the first
+	// unit is freed, and the unit goes to the next deadline.
+	h.releaseRunning(1)
+	got := map[string]error{}
+	for i := 0; i < 2; i++ {
+		r := receive()
+		got[r.name] = r.err
+	}
+	if err, ok := got["hopeless"]; !ok || err != ErrOverloaded {
+		t.Fatalf("got %v, want hopeless rejected with %v", got, ErrOverloaded)
+	}
+	if err, ok := got["1h"]; !ok || err != nil {
+		t.Fatalf("got %v, want 1h admitted", got)
+	}
+	for _, expected := range []string{"2h", "3h", "none"} {
+		h.releaseRunning(1)
+		if r := receive(); r.name != expected || r.err != nil {
+			t.Fatalf("got %s with %v, want %s admitted", r.name, r.err, expected)
+		}
+	}
+}
+
+func TestCanceledRequest(t *testing.T) {
+	called := false
+	h := New(1, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+
+	if called {
+		t.Fatal("the handler was called for a canceled request")
+	}
+	if rec.Code != StatusClientClosedRequest || rec.Body.Len() != 0 {
+		t.Fatalf("response = %d %q, want %d with no body", rec.Code, rec.Body.String(), StatusClientClosedRequest)
+	}
+	if stats := h.Stats(); stats.Canceled != 1 || stats.Overloaded != 0 || stats.Running != 0 {
+		t.Fatalf("Stats() = %+v, want 1 canceled", stats)
+	}
+}
+
+func TestCanceledInQueue(t *testing.T) {
+	h := New(1, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	var canceled []string
+	h.OnCanceled = func(r *http.Request) {
+		canceled = append(canceled, r.URL.Path)
+	}
+	release, err := h.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/queued", nil).WithContext(ctx))
+	}()
+	waitQueued(t, h, 1, time.Second)
+	cancel()
+	<-done
+
+	if rec.Code != StatusClientClosedRequest || rec.Body.Len() != 0 {
+		t.Fatalf("response = %d %q, want %d with no body", rec.Code, rec.Body.String(), StatusClientClosedRequest)
+	}
+	if len(canceled) != 1 || canceled[0] != "/queued" {
+		t.Fatalf("OnCanceled got %v", canceled)
+	}
+	if stats := h.Stats(); stats.Canceled != 1 || stats.QueueCanceled != 1 || stats.Overloaded != 0 {
+		t.Fatalf("Stats() = %+v, want 1 request canceled in the queue", stats)
+	}
+}
+
+func TestMaxQueueWaitOverride(t *testing.T) {
+	h := New(1, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.MaxWaitInQueue = time.Minute
+	h.MaxQueueWaitHeader = "X-Max-Queue-Wait"
+
+	release, err := h.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire() = %v, want nil", err)
+	}
+	defer release()
+
+	ctx := WithMaxQueueWait(context.Background(), 10*time.Millisecond)
+	if _, err := h.Acquire(ctx); err != ErrOverloaded {
+		t.Fatalf("Acquire() = %v, want %v", err, ErrOverloaded)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Max-Queue-Wait", "10ms")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestQueueFullAndTimeoutHandlers(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	h := New(1, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.MaxWaitInQueue = 20 * time.Millisecond
+	h.QueueFullHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	h.QueueTimeoutHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGatewayTimeout)
+	})
+
+	release, err := h.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire() = %v, want nil", err)
+	}
+	defer release()
+
+	codes := make(chan int)
+	serve := func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		codes <- rec.Code
+	}
+	go serve()
+	waitQueued(t, h, 1, timeout)
+	go serve()
+	if code := <-codes; code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if code := <-codes; code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want %d", code, http.StatusGatewayTimeout)
+	}
+
+	stats := h.Stats()
+	if stats.Overloaded != 2 || stats.QueueFull != 1 || stats.QueueTimeout != 1 {
+		t.Fatalf("Overloaded, QueueFull, QueueTimeout = %d, %d, %d; want 2, 1, 1", stats.Overloaded, stats.QueueFull, stats.QueueTimeout)
+	}
+
+	// Without specific handlers, OverloadHandler is used.
+	h.QueueFullHandler = nil
+	go serve()
+	waitQueued(t, h, 1, timeout)
+	go serve()
+	if code := <-codes; code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := <-codes; code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want %d", code, http.StatusGatewayTimeout)
+	}
+}
+
+func TestSkip(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := New(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+	}))
+	h.Skip = SkipPaths("/healthz", "/metrics")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+	}()
+	<-started
+
+	for path, expected := range map[string]int{
+		"/healthz": http.StatusOK,
+		"/metrics": http.StatusOK,
+		"/":        http.StatusServiceUnavailable,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != expected {
+			t.Errorf("%s: status = %d, want %d", path, rec.Code, expected)
+		}
+	}
+	if stats := h.Stats(); stats.Running != 1 || stats.Overloaded != 1 {
+		t.Errorf("Stats() = %+v, want skipped requests not to be counted", stats)
+	}
+
+	close(release)
+	<-done
+}
+
+func TestDuplicates(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	for _, replace := range []bool{false, true} {
+		h := New(1, 10, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		h.DuplicateKey = ClientRequestKey(RemoteAddrKey)
+		h.ReplaceDuplicates = replace
+
+		release, err := h.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire() = %v, want nil", err)
+		}
+
+		serve := func(path string) chan int {
+			codes := make(chan int, 1)
+			go func() {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+				codes <- rec.Code
+			}()
+			return codes
+		}
+		first := serve("/page")
+		waitQueued(t, h, 1, timeout)
+		other := serve("/other")
+		waitQueued(t, h, 2, timeout)
+
+		second := serve("/page")
+		older, newer := first, second
+		if !replace {
+			older, newer = second, first
+		}
+		select {
+		case code := <-older:
+			if code != http.StatusServiceUnavailable {
+				t.Fatalf("replace=%v: status = %d, want the duplicate to be rejected", replace, code)
+			}
+		case <-time.After(timeout):
+			t.Fatalf("replace=%v: timeout while waiting for the duplicate to be rejected", replace)
+		}
+		waitQueued(t, h, 2, timeout)
+
+		release()
+		for _, codes := range []chan int{newer, other} {
+			if code := <-codes; code != http.StatusOK {
+				t.Fatalf("replace=%v: status = %d, want %d", replace, code, http.StatusOK)
+			}
+		}
+		if stats := h.Stats(); stats.Duplicates != 1 {
+			t.Fatalf("replace=%v: stats = %+v, want 1 duplicate", replace, stats)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	var selected *Limiter
+	h := New(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		selected, _ = r.Context().Value(limiterKey{}).(*Limiter)
+	}))
+	premium := NewLimiter(1, 0)
+	h.Select = SelectByName(map[string]*Limiter{
+		"":        h.Limiter,
+		"premium": premium,
+	}, func(r *http.Request) string {
+		return r.Header.Get("X-Plan")
+	})
+
+	serve := func(plan string) *Limiter {
+		selected = nil
+		r := httptest.NewRequest("GET", "/", nil)
+		if plan != "" {
+			r.Header.Set("X-Plan", plan)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d", plan, rec.Code, http.StatusOK)
+		}
+		return selected
+	}
+	if l := serve(""); l != h.Limiter {
+		t.Fatalf("default request went through %p, want the default limiter", l)
+	}
+	if l := serve("premium"); l != premium {
+		t.Fatalf("premium request went through %p, want %p", l, premium)
+	}
+	if l := serve("internal"); l != nil {
+		t.Fatalf("unknown plan went through %p, want it to bypass the limiters", l)
+	}
+	if admitted := premium.Stats().Admitted; admitted != 1 {
+		t.Fatalf("premium admitted = %d, want 1", admitted)
+	}
+}
+
+// nopResponseWriter is a ResponseWriter that discards the response.
+type nopResponseWriter struct {
+	header http.Header
+}
+
+func (w *nopResponseWriter) Header() http.Header         { return w.header }
+func (w *nopResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *nopResponseWriter) WriteHeader(statusCode int)  {}
+
+func TestServeHTTPAllocs(t *testing.T) {
+	testCases := []struct {
+		name          string
+		noParallelism bool
+		expected      float64
+	}{
+		// The limiter in the context for ParallelismFromContext and the
+		// copy of the request that carries it.
+		{"default", false, 2},
+		{"no parallelism", true, 0},
+	}
+	for _, tc := range testCases {
+		var parallelism int
+		h := New(10, 10, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			parallelism = ParallelismFromContext(r.Context())
+		}))
+		h.NoParallelism = tc.noParallelism
+		w := &nopResponseWriter{header: make(http.Header)}
+		r := httptest.NewRequest("GET", "/", nil)
+		if allocs := testing.AllocsPerRun(100, func() { h.ServeHTTP(w, r) }); allocs != tc.expected {
+			t.Errorf("%s: ServeHTTP() makes %v allocations, want %v", tc.name, allocs, tc.expected)
+		}
+		if parallelism != runtime.GOMAXPROCS(0) {
+			t.Errorf("%s: parallelism = %d, want %d", tc.name, parallelism, runtime.GOMAXPROCS(0))
+		}
+	}
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	for _, noParallelism := range []bool{false, true} {
+		b.Run(fmt.Sprintf("NoParallelism=%v", noParallelism), func(b *testing.B) {
+			h := New(1<<20, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			h.NoParallelism = noParallelism
+			r := httptest.NewRequest("GET", "/", nil)
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				w := &nopResponseWriter{header: make(http.Header)}
+				for pb.Next() {
+					h.ServeHTTP(w, r)
+				}
+			})
+		})
+	}
+}
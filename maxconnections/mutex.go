@@ -0,0 +1,52 @@
+package maxconnections
+
+import (
+	"net/http"
+	"time"
+)
+
+func defaultConflictHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "409 another request for the resource is in progress", http.StatusConflict)
+}
+
+// ConflictHandler is a default QueueTimeoutHandler for keyed mutexes, see
+// NewKeyedMutex.
+var ConflictHandler http.Handler = http.HandlerFunc(defaultConflictHandler)
+
+// PathKey returns the path of the request. It is the default Key of keyed
+// mutexes.
+func PathKey(r *http.Request) string {
+	return r.URL.Path
+}
+
+// SafeMethod reports whether the method of r is safe, i.e. the request
+// doesn't modify resources. It is the default Skip of keyed mutexes.
+func SafeMethod(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// NewKeyedMutex returns an http.Handler that serializes requests with the
+// same key, so that only one mutation of a resource runs at a time. A
+// request waits up to maxWait for the previous one, then ConflictHandler
+// responds with 409. If more than maxInQueue requests are waiting for the
+// same key, the others are rejected with OverloadHandler right away. Up to
+// maxKeys keys are tracked at the same time.
+//
+// By default the key is the path of the request and requests with safe
+// methods are not serialized; Key and Skip can be changed, e.g. to lock
+// "/accounts/{id}" for all its subresources.
+func NewKeyedMutex(maxWait time.Duration, maxInQueue, maxKeys int, h http.Handler) *Keyed {
+	k := NewKeyedWithRegistry(NewRegistry(maxKeys, func(key string) *Limiter {
+		l := NewLimiter(1, maxInQueue)
+		l.MaxWaitInQueue = maxWait
+		return l
+	}), h)
+	k.Key = PathKey
+	k.Skip = SafeMethod
+	k.QueueTimeoutHandler = ConflictHandler
+	return k
+}
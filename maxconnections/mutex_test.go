@@ -0,0 +1,57 @@
+package maxconnections
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	k := NewKeyedMutex(10*time.Millisecond, 1, 10, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Block") != "" {
+			started <- struct{}{}
+			<-unblock
+		}
+	}))
+
+	serve := func(method, path string, block bool) int {
+		r := httptest.NewRequest(method, path, nil)
+		if block {
+			r.Header.Set("X-Block", "1")
+		}
+		w := httptest.NewRecorder()
+		k.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	done := make(chan int)
+	go func() {
+		done <- serve("POST", "/accounts/1", true)
+	}()
+	<-started
+
+	testCases := []struct {
+		method, path string
+		expected     int
+	}{
+		{"PUT", "/accounts/1", http.StatusConflict},
+		{"GET", "/accounts/1", http.StatusOK},
+		{"PUT", "/accounts/2", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		if code := serve(tc.method, tc.path, false); code != tc.expected {
+			t.Errorf("%s %s: status = %d, want %d", tc.method, tc.path, code, tc.expected)
+		}
+	}
+
+	close(unblock)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if code := serve("PUT", "/accounts/1", false); code != http.StatusOK {
+		t.Fatalf("status after the first request = %d, want %d", code, http.StatusOK)
+	}
+}
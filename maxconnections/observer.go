@@ -0,0 +1,73 @@
+package maxconnections
+
+import (
+	"context"
+	"time"
+)
+
+// Names of events and attributes that tracing integrations use to describe
+// admission of requests.
+const (
+	EventQueued   = "maxconnections.queued"
+	EventAdmitted = "maxconnections.admitted"
+	EventRejected = "maxconnections.rejected"
+
+	AttributeLimiter   = "maxconnections.limiter"
+	AttributeQueueWait = "maxconnections.queue_wait_ms"
+	AttributeReason    = "maxconnections.rejection_reason"
+)
+
+// Reason returns a short description of a rejection error, suitable for
+// metric labels and trace attributes.
+func Reason(err error) string {
+	switch err {
+	case nil:
+		return ""
+	case ErrOverloaded:
+		return "overloaded"
+	case ErrShutdown:
+		return "shutdown"
+	case ErrCanceled:
+		return "canceled"
+	}
+	return "error"
+}
+
+// Observer receives admission events of requests. It is the instrumentation
+// point for tracing and metrics integrations. Methods are called
+// synchronously and must be safe for concurrent use.
+type Observer interface {
+	// Queued is called when the request is put into the queue.
+	Queued(ctx context.Context)
+
+	// Admitted is called when the request gets its running units. wait is
+	// the time the request has been waiting for them.
+	Admitted(ctx context.Context, wait time.Duration)
+
+	// Rejected is called when the request is rejected with err.
+	Rejected(ctx context.Context, wait time.Duration, err error)
+}
+
+// Observers is an Observer that passes events to all its elements.
+type Observers []Observer
+
+// Queued implements Observer.
+func (o Observers) Queued(ctx context.Context) {
+	for _, observer := range o {
+		observer.Queued(ctx)
+	}
+}
+
+// Admitted implements Observer.
+func (o Observers) Admitted(ctx context.Context, wait time.Duration) {
+	for _, observer := range o {
+		observer.Admitted(ctx, wait)
+	}
+}
+
+// Rejected implements Observer.
+func (o Observers) Rejected(ctx context.Context, wait time.Duration, err error) {
+	for _, observer := range o {
+		observer.Rejected(ctx, wait, err)
+	}
+}
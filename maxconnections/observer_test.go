@@ -0,0 +1,79 @@
+package maxconnections
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(event string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, event)
+}
+
+func (o *recordingObserver) Queued(ctx context.Context) {
+	o.record("queued")
+}
+
+func (o *recordingObserver) Admitted(ctx context.Context, wait time.Duration) {
+	o.record("admitted")
+}
+
+func (o *recordingObserver) Rejected(ctx context.Context, wait time.Duration, err error) {
+	o.record(fmt.Sprintf("rejected: %s", Reason(err)))
+}
+
+func (o *recordingObserver) Events() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string(nil), o.events...)
+}
+
+func TestObserver(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	handlerBarrier := make(chan struct{})
+	h := New(1, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-handlerBarrier
+	}))
+	o1, o2 := &recordingObserver{}, &recordingObserver{}
+	h.Observer = Observers{o1, o2}
+
+	done := make(chan struct{})
+	serve := func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		done <- struct{}{}
+	}
+
+	go serve()
+	waitRunning(t, h, 1, timeout)
+	go serve()
+	waitQueued(t, h, 1, timeout)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	handlerBarrier <- struct{}{}
+	<-done
+	handlerBarrier <- struct{}{}
+	<-done
+
+	h.Shutdown(context.Background())
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	expected := []string{"admitted", "queued", "rejected: overloaded", "admitted", "rejected: shutdown"}
+	for _, o := range []*recordingObserver{o1, o2} {
+		events := o.Events()
+		if fmt.Sprint(events) != fmt.Sprint(expected) {
+			t.Errorf("events = %q, want %q", events, expected)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Package ocbridge reports admission events of maxconnections to
+// OpenCensus spans.
+package ocbridge
+
+import (
+	"context"
+	"time"
+
+	"go.opencensus.io/trace"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+// Observer implements the maxconnections.Observer interface. It annotates
+// the span from the request context, if there is one.
+type Observer struct {
+	// Name is the limiter name that is attached to events.
+	Name string
+}
+
+var _ maxconnections.Observer = (*Observer)(nil)
+
+// New returns an Observer for the limiter with the given name.
+func New(name string) *Observer {
+	return &Observer{Name: name}
+}
+
+// Queued implements maxconnections.Observer.
+func (o *Observer) Queued(ctx context.Context) {
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return
+	}
+	span.Annotate([]trace.Attribute{
+		trace.StringAttribute(maxconnections.AttributeLimiter, o.Name),
+	}, maxconnections.EventQueued)
+}
+
+// Admitted implements maxconnections.Observer.
+func (o *Observer) Admitted(ctx context.Context, wait time.Duration) {
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return
+	}
+	waitAttr := trace.Int64Attribute(maxconnections.AttributeQueueWait, int64(wait/time.Millisecond))
+	span.AddAttributes(waitAttr)
+	span.Annotate([]trace.Attribute{
+		trace.StringAttribute(maxconnections.AttributeLimiter, o.Name),
+		waitAttr,
+	}, maxconnections.EventAdmitted)
+}
+
+// Rejected implements maxconnections.Observer.
+func (o *Observer) Rejected(ctx context.Context, wait time.Duration, err error) {
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return
+	}
+	reasonAttr := trace.StringAttribute(maxconnections.AttributeReason, maxconnections.Reason(err))
+	span.AddAttributes(reasonAttr)
+	span.Annotate([]trace.Attribute{
+		trace.StringAttribute(maxconnections.AttributeLimiter, o.Name),
+		trace.Int64Attribute(maxconnections.AttributeQueueWait, int64(wait/time.Millisecond)),
+		reasonAttr,
+	}, maxconnections.EventRejected)
+}
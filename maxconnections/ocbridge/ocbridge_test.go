@@ -0,0 +1,100 @@
+package ocbridge
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+type exporter struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (e *exporter) ExportSpan(s *trace.SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+func record(t *testing.T, f func(ctx context.Context)) *trace.SpanData {
+	t.Helper()
+	e := &exporter{}
+	trace.RegisterExporter(e)
+	defer trace.UnregisterExporter(e)
+
+	ctx, span := trace.StartSpan(context.Background(), "request", trace.WithSampler(trace.AlwaysSample()))
+	f(ctx)
+	span.End()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(e.spans))
+	}
+	return e.spans[0]
+}
+
+func TestObserver(t *testing.T) {
+	o := New("api")
+	span := record(t, func(ctx context.Context) {
+		o.Queued(ctx)
+		o.Admitted(ctx, 1500*time.Millisecond)
+	})
+
+	annotations := span.Annotations
+	if len(annotations) != 2 || annotations[0].Message != maxconnections.EventQueued || annotations[1].Message != maxconnections.EventAdmitted {
+		t.Fatalf("annotations = %+v, want %s and %s", annotations, maxconnections.EventQueued, maxconnections.EventAdmitted)
+	}
+	for _, a := range annotations {
+		if limiter := a.Attributes[maxconnections.AttributeLimiter]; limiter != "api" {
+			t.Errorf("%s: limiter = %v, want %q", a.Message, limiter, "api")
+		}
+	}
+	if wait := annotations[1].Attributes[maxconnections.AttributeQueueWait]; wait != int64(1500) {
+		t.Errorf("queue wait of the annotation = %v, want 1500", wait)
+	}
+	if wait := span.Attributes[maxconnections.AttributeQueueWait]; wait != int64(1500) {
+		t.Errorf("queue wait of the span = %v, want 1500", wait)
+	}
+}
+
+func TestObserverRejected(t *testing.T) {
+	// The limiter has no running units, so the request is rejected right
+	// away.
+	l := maxconnections.NewLimiter(0, 0)
+	l.Observer = New("api")
+	span := record(t, func(ctx context.Context) {
+		if _, err := l.Acquire(ctx); err != maxconnections.ErrOverloaded {
+			t.Fatalf("Acquire() = %v, want %v", err, maxconnections.ErrOverloaded)
+		}
+	})
+
+	annotations := span.Annotations
+	if len(annotations) != 1 || annotations[0].Message != maxconnections.EventRejected {
+		t.Fatalf("annotations = %+v, want %s", annotations, maxconnections.EventRejected)
+	}
+	attrs := annotations[0].Attributes
+	if limiter := attrs[maxconnections.AttributeLimiter]; limiter != "api" {
+		t.Errorf("limiter = %v, want %q", limiter, "api")
+	}
+	if reason := attrs[maxconnections.AttributeReason]; reason != "overloaded" {
+		t.Errorf("reason of the annotation = %v, want %q", reason, "overloaded")
+	}
+	if reason := span.Attributes[maxconnections.AttributeReason]; reason != "overloaded" {
+		t.Errorf("reason of the span = %v, want %q", reason, "overloaded")
+	}
+}
+
+func TestObserverNoSpan(t *testing.T) {
+	// Requests without a span are ignored.
+	o := New("api")
+	o.Queued(context.Background())
+	o.Admitted(context.Background(), time.Second)
+	o.Rejected(context.Background(), time.Second, maxconnections.ErrOverloaded)
+}
@@ -0,0 +1,70 @@
+// Package otbridge reports admission events of maxconnections to
+// OpenTracing spans.
+package otbridge
+
+import (
+	"context"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+// Observer implements the maxconnections.Observer interface. It logs events
+// to the span from the request context, if there is one.
+type Observer struct {
+	// Name is the limiter name that is attached to events.
+	Name string
+}
+
+var _ maxconnections.Observer = (*Observer)(nil)
+
+// New returns an Observer for the limiter with the given name.
+func New(name string) *Observer {
+	return &Observer{Name: name}
+}
+
+// Queued implements maxconnections.Observer.
+func (o *Observer) Queued(ctx context.Context) {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	span.LogFields(
+		log.String("event", maxconnections.EventQueued),
+		log.String(maxconnections.AttributeLimiter, o.Name),
+	)
+}
+
+// Admitted implements maxconnections.Observer.
+func (o *Observer) Admitted(ctx context.Context, wait time.Duration) {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	waitMs := int64(wait / time.Millisecond)
+	span.SetTag(maxconnections.AttributeQueueWait, waitMs)
+	span.LogFields(
+		log.String("event", maxconnections.EventAdmitted),
+		log.String(maxconnections.AttributeLimiter, o.Name),
+		log.Int64(maxconnections.AttributeQueueWait, waitMs),
+	)
+}
+
+// Rejected implements maxconnections.Observer.
+func (o *Observer) Rejected(ctx context.Context, wait time.Duration, err error) {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	reason := maxconnections.Reason(err)
+	span.SetTag(maxconnections.AttributeReason, reason)
+	span.LogFields(
+		log.String("event", maxconnections.EventRejected),
+		log.String(maxconnections.AttributeLimiter, o.Name),
+		log.Int64(maxconnections.AttributeQueueWait, int64(wait/time.Millisecond)),
+		log.String(maxconnections.AttributeReason, reason),
+	)
+}
@@ -0,0 +1,94 @@
+package otbridge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+func record(t *testing.T, f func(ctx context.Context)) *mocktracer.MockSpan {
+	t.Helper()
+	tracer := mocktracer.New()
+	span := tracer.StartSpan("request")
+	f(opentracing.ContextWithSpan(context.Background(), span))
+	span.Finish()
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	return spans[0]
+}
+
+// fields returns the fields of the log record as strings.
+func fields(r mocktracer.MockLogRecord) map[string]string {
+	m := make(map[string]string, len(r.Fields))
+	for _, f := range r.Fields {
+		m[f.Key] = f.ValueString
+	}
+	return m
+}
+
+func TestObserver(t *testing.T) {
+	o := New("api")
+	span := record(t, func(ctx context.Context) {
+		o.Queued(ctx)
+		o.Admitted(ctx, 1500*time.Millisecond)
+	})
+
+	logs := span.Logs()
+	if len(logs) != 2 || fields(logs[0])["event"] != maxconnections.EventQueued || fields(logs[1])["event"] != maxconnections.EventAdmitted {
+		t.Fatalf("logs = %+v, want %s and %s", logs, maxconnections.EventQueued, maxconnections.EventAdmitted)
+	}
+	for _, r := range logs {
+		if limiter := fields(r)[maxconnections.AttributeLimiter]; limiter != "api" {
+			t.Errorf("%s: limiter = %q, want %q", fields(r)["event"], limiter, "api")
+		}
+	}
+	if wait := fields(logs[1])[maxconnections.AttributeQueueWait]; wait != "1500" {
+		t.Errorf("queue wait of the log = %s, want 1500", wait)
+	}
+	if wait := span.Tag(maxconnections.AttributeQueueWait); wait != int64(1500) {
+		t.Errorf("queue wait of the span = %v, want 1500", wait)
+	}
+}
+
+func TestObserverRejected(t *testing.T) {
+	// The limiter has no running units, so the request is rejected right
+	// away.
+	l := maxconnections.NewLimiter(0, 0)
+	l.Observer = New("api")
+	span := record(t, func(ctx context.Context) {
+		if _, err := l.Acquire(ctx); err != maxconnections.ErrOverloaded {
+			t.Fatalf("Acquire() = %v, want %v", err, maxconnections.ErrOverloaded)
+		}
+	})
+
+	logs := span.Logs()
+	if len(logs) != 1 || fields(logs[0])["event"] != maxconnections.EventRejected {
+		t.Fatalf("logs = %+v, want %s", logs, maxconnections.EventRejected)
+	}
+	f := fields(logs[0])
+	if limiter := f[maxconnections.AttributeLimiter]; limiter != "api" {
+		t.Errorf("limiter = %q, want %q", limiter, "api")
+	}
+	if reason := f[maxconnections.AttributeReason]; reason != "overloaded" {
+		t.Errorf("reason of the log = %q, want %q", reason, "overloaded")
+	}
+	if reason := span.Tag(maxconnections.AttributeReason); reason != "overloaded" {
+		t.Errorf("reason of the span = %v, want %q", reason, "overloaded")
+	}
+}
+
+func TestObserverNoSpan(t *testing.T) {
+	// Requests without a span are ignored.
+	o := New("api")
+	o.Queued(context.Background())
+	o.Admitted(context.Background(), time.Second)
+	o.Rejected(context.Background(), time.Second, maxconnections.ErrOverloaded)
+}
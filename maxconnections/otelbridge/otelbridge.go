@@ -0,0 +1,75 @@
+// Package otelbridge reports admission events of maxconnections to
+// OpenTelemetry spans, so that queueing delay is visible in traces.
+package otelbridge
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+// Observer implements the maxconnections.Observer interface. It adds events
+// and attributes to the span from the request context, if it is recording.
+type Observer struct {
+	// Name is the limiter name that is attached to events.
+	Name string
+}
+
+var _ maxconnections.Observer = (*Observer)(nil)
+
+// New returns an Observer for the limiter with the given name.
+func New(name string) *Observer {
+	return &Observer{Name: name}
+}
+
+func recordingSpan(ctx context.Context) trace.Span {
+	span := trace.SpanFromContext(ctx)
+	if span == nil || !span.IsRecording() {
+		return nil
+	}
+	return span
+}
+
+// Queued implements maxconnections.Observer.
+func (o *Observer) Queued(ctx context.Context) {
+	span := recordingSpan(ctx)
+	if span == nil {
+		return
+	}
+	span.AddEvent(maxconnections.EventQueued, trace.WithAttributes(
+		attribute.String(maxconnections.AttributeLimiter, o.Name),
+	))
+}
+
+// Admitted implements maxconnections.Observer.
+func (o *Observer) Admitted(ctx context.Context, wait time.Duration) {
+	span := recordingSpan(ctx)
+	if span == nil {
+		return
+	}
+	waitAttr := attribute.Int64(maxconnections.AttributeQueueWait, int64(wait/time.Millisecond))
+	span.SetAttributes(waitAttr)
+	span.AddEvent(maxconnections.EventAdmitted, trace.WithAttributes(
+		attribute.String(maxconnections.AttributeLimiter, o.Name),
+		waitAttr,
+	))
+}
+
+// Rejected implements maxconnections.Observer.
+func (o *Observer) Rejected(ctx context.Context, wait time.Duration, err error) {
+	span := recordingSpan(ctx)
+	if span == nil {
+		return
+	}
+	reasonAttr := attribute.String(maxconnections.AttributeReason, maxconnections.Reason(err))
+	span.SetAttributes(reasonAttr)
+	span.AddEvent(maxconnections.EventRejected, trace.WithAttributes(
+		attribute.String(maxconnections.AttributeLimiter, o.Name),
+		attribute.Int64(maxconnections.AttributeQueueWait, int64(wait/time.Millisecond)),
+		reasonAttr,
+	))
+}
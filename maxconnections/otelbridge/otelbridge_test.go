@@ -0,0 +1,94 @@
+package otelbridge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+func attributes(kvs []attribute.KeyValue) map[attribute.Key]attribute.Value {
+	m := make(map[attribute.Key]attribute.Value, len(kvs))
+	for _, kv := range kvs {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+func record(t *testing.T, f func(ctx context.Context)) sdktrace.ReadOnlySpan {
+	t.Helper()
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	ctx, span := tp.Tracer("test").Start(context.Background(), "request")
+	f(ctx)
+	span.End()
+	spans := rec.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	return spans[0]
+}
+
+func TestObserver(t *testing.T) {
+	o := New("api")
+	span := record(t, func(ctx context.Context) {
+		o.Queued(ctx)
+		o.Admitted(ctx, 1500*time.Millisecond)
+	})
+
+	events := span.Events()
+	if len(events) != 2 || events[0].Name != maxconnections.EventQueued || events[1].Name != maxconnections.EventAdmitted {
+		t.Fatalf("events = %+v, want %s and %s", events, maxconnections.EventQueued, maxconnections.EventAdmitted)
+	}
+	for _, e := range events {
+		if limiter := attributes(e.Attributes)[maxconnections.AttributeLimiter].AsString(); limiter != "api" {
+			t.Errorf("%s: limiter = %q, want %q", e.Name, limiter, "api")
+		}
+	}
+	if wait := attributes(events[1].Attributes)[maxconnections.AttributeQueueWait].AsInt64(); wait != 1500 {
+		t.Errorf("queue wait of the event = %d, want 1500", wait)
+	}
+	if wait := attributes(span.Attributes())[maxconnections.AttributeQueueWait].AsInt64(); wait != 1500 {
+		t.Errorf("queue wait of the span = %d, want 1500", wait)
+	}
+}
+
+func TestObserverRejected(t *testing.T) {
+	// The limiter has no running units, so the request is rejected right
+	// away.
+	l := maxconnections.NewLimiter(0, 0)
+	l.Observer = New("api")
+	span := record(t, func(ctx context.Context) {
+		if _, err := l.Acquire(ctx); err != maxconnections.ErrOverloaded {
+			t.Fatalf("Acquire() = %v, want %v", err, maxconnections.ErrOverloaded)
+		}
+	})
+
+	events := span.Events()
+	if len(events) != 1 || events[0].Name != maxconnections.EventRejected {
+		t.Fatalf("events = %+v, want %s", events, maxconnections.EventRejected)
+	}
+	attrs := attributes(events[0].Attributes)
+	if limiter := attrs[maxconnections.AttributeLimiter].AsString(); limiter != "api" {
+		t.Errorf("limiter = %q, want %q", limiter, "api")
+	}
+	if reason := attrs[maxconnections.AttributeReason].AsString(); reason != "overloaded" {
+		t.Errorf("reason of the event = %q, want %q", reason, "overloaded")
+	}
+	if reason := attributes(span.Attributes())[maxconnections.AttributeReason].AsString(); reason != "overloaded" {
+		t.Errorf("reason of the span = %q, want %q", reason, "overloaded")
+	}
+}
+
+func TestObserverNotRecording(t *testing.T) {
+	// Requests without a recording span are ignored.
+	o := New("api")
+	o.Queued(context.Background())
+	o.Admitted(context.Background(), time.Second)
+	o.Rejected(context.Background(), time.Second, maxconnections.ErrOverloaded)
+}
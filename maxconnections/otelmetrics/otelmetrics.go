@@ -0,0 +1,135 @@
+// Package otelmetrics reports the state of maxconnections limiters as
+// OpenTelemetry metrics through an injected metric.Meter, so that services
+// that export only OTLP don't need a Prometheus bridge.
+package otelmetrics
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+// Names of the instruments.
+const (
+	MetricRunning    = "maxconnections.running"
+	MetricMaxRunning = "maxconnections.max_running"
+	MetricQueued     = "maxconnections.queued"
+	MetricRequests   = "maxconnections.requests"
+	MetricQueueWait  = "maxconnections.queue.wait"
+
+	// AttributeOutcome is "admitted" for admitted requests and the
+	// maxconnections.Reason of the rejection otherwise.
+	AttributeOutcome = "maxconnections.outcome"
+)
+
+// Metrics implements the maxconnections.Observer interface. It records the
+// queue wait of every request into a histogram and reports the gauges and
+// the counters of the limiter when the meter collects them.
+type Metrics struct {
+	l     *maxconnections.Limiter
+	attrs attribute.Set
+	wait  metric.Float64Histogram
+	reg   metric.Registration
+}
+
+var _ maxconnections.Observer = (*Metrics)(nil)
+
+// New creates the instruments for the limiter l with the given name in
+// meter. The returned Metrics should be set as the Observer of l, or added
+// to its Observers, to record queue waits:
+//
+//	m, err := otelmetrics.New(meter, "api", l)
+//	if err != nil {
+//		return err
+//	}
+//	l.Observer = m
+func New(meter metric.Meter, name string, l *maxconnections.Limiter) (*Metrics, error) {
+	m := &Metrics{
+		l:     l,
+		attrs: attribute.NewSet(attribute.String(maxconnections.AttributeLimiter, name)),
+	}
+
+	var err error
+	m.wait, err = meter.Float64Histogram(MetricQueueWait,
+		metric.WithDescription("Time requests wait for admission."),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	running, err := meter.Int64ObservableUpDownCounter(MetricRunning,
+		metric.WithDescription("Running units occupied by admitted requests."),
+		metric.WithUnit("{unit}"))
+	if err != nil {
+		return nil, err
+	}
+	maxRunning, err := meter.Int64ObservableUpDownCounter(MetricMaxRunning,
+		metric.WithDescription("Maximum number of running units."),
+		metric.WithUnit("{unit}"))
+	if err != nil {
+		return nil, err
+	}
+	queued, err := meter.Int64ObservableUpDownCounter(MetricQueued,
+		metric.WithDescription("Requests waiting in the queue."),
+		metric.WithUnit("{request}"))
+	if err != nil {
+		return nil, err
+	}
+	requests, err := meter.Int64ObservableCounter(MetricRequests,
+		metric.WithDescription("Admission decisions by outcome."),
+		metric.WithUnit("{request}"))
+	if err != nil {
+		return nil, err
+	}
+
+	m.reg, err = meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		stats := l.Stats()
+		set := metric.WithAttributeSet(m.attrs)
+		o.ObserveInt64(running, int64(stats.Running), set)
+		o.ObserveInt64(maxRunning, int64(stats.MaxRunning), set)
+		o.ObserveInt64(queued, int64(stats.Queued), set)
+		for _, c := range []struct {
+			outcome string
+			value   int64
+		}{
+			{maxconnections.OutcomeAdmitted, stats.Admitted},
+			{maxconnections.Reason(maxconnections.ErrOverloaded), stats.Overloaded},
+			{maxconnections.Reason(maxconnections.ErrShutdown), stats.ShutdownRejected},
+			{maxconnections.Reason(maxconnections.ErrCanceled), stats.Canceled},
+		} {
+			o.ObserveInt64(requests, c.value, m.withOutcome(c.outcome))
+		}
+		return nil
+	}, running, maxRunning, queued, requests)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// withOutcome returns the attributes of the limiter with the outcome.
+func (m *Metrics) withOutcome(outcome string) metric.MeasurementOption {
+	attrs := append(m.attrs.ToSlice(), attribute.String(AttributeOutcome, outcome))
+	return metric.WithAttributes(attrs...)
+}
+
+// Unregister stops reporting the gauges and the counters of the limiter.
+func (m *Metrics) Unregister() error {
+	return m.reg.Unregister()
+}
+
+// Queued implements maxconnections.Observer.
+func (m *Metrics) Queued(ctx context.Context) {}
+
+// Admitted implements maxconnections.Observer.
+func (m *Metrics) Admitted(ctx context.Context, wait time.Duration) {
+	m.wait.Record(ctx, wait.Seconds(), m.withOutcome(maxconnections.OutcomeAdmitted))
+}
+
+// Rejected implements maxconnections.Observer.
+func (m *Metrics) Rejected(ctx context.Context, wait time.Duration, err error) {
+	m.wait.Record(ctx, wait.Seconds(), m.withOutcome(maxconnections.Reason(err)))
+}
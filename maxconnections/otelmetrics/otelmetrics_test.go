@@ -0,0 +1,117 @@
+package otelmetrics
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+func collect(t *testing.T, reader sdkmetric.Reader) map[string]metricdata.Aggregation {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	metrics := make(map[string]metricdata.Aggregation)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			metrics[m.Name] = m.Data
+		}
+	}
+	return metrics
+}
+
+// matches reports whether attrs belong to the limiter "api" and have the
+// outcome, if it is not empty.
+func matches(attrs attribute.Set, outcome string) bool {
+	if v, _ := attrs.Value(maxconnections.AttributeLimiter); v.AsString() != "api" {
+		return false
+	}
+	v, _ := attrs.Value(AttributeOutcome)
+	return v.AsString() == outcome
+}
+
+func sum(t *testing.T, metrics map[string]metricdata.Aggregation, name, outcome string) int64 {
+	t.Helper()
+	data, ok := metrics[name].(metricdata.Sum[int64])
+	if !ok {
+		t.Fatalf("%s = %T, want metricdata.Sum[int64]", name, metrics[name])
+	}
+	for _, dp := range data.DataPoints {
+		if matches(dp.Attributes, outcome) {
+			return dp.Value
+		}
+	}
+	t.Fatalf("%s has no data point with the outcome %q", name, outcome)
+	return 0
+}
+
+func histogramCount(t *testing.T, metrics map[string]metricdata.Aggregation, name, outcome string) uint64 {
+	t.Helper()
+	data, ok := metrics[name].(metricdata.Histogram[float64])
+	if !ok {
+		t.Fatalf("%s = %T, want metricdata.Histogram[float64]", name, metrics[name])
+	}
+	for _, dp := range data.DataPoints {
+		if matches(dp.Attributes, outcome) {
+			return dp.Count
+		}
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	l := maxconnections.NewLimiter(1, 0)
+	m, err := New(provider.Meter("test"), "api", l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Observer = m
+
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire(context.Background()); err != maxconnections.ErrOverloaded {
+		t.Fatalf("Acquire() = %v, want %v", err, maxconnections.ErrOverloaded)
+	}
+
+	metrics := collect(t, reader)
+	for _, c := range []struct {
+		name     string
+		outcome  string
+		expected int64
+	}{
+		{MetricRunning, "", 1},
+		{MetricMaxRunning, "", 1},
+		{MetricQueued, "", 0},
+		{MetricRequests, maxconnections.OutcomeAdmitted, 1},
+		{MetricRequests, "overloaded", 1},
+		{MetricRequests, "shutdown", 0},
+		{MetricRequests, "canceled", 0},
+	} {
+		if value := sum(t, metrics, c.name, c.outcome); value != c.expected {
+			t.Errorf("%s{outcome=%q} = %d, want %d", c.name, c.outcome, value, c.expected)
+		}
+	}
+	for _, outcome := range []string{maxconnections.OutcomeAdmitted, "overloaded"} {
+		if count := histogramCount(t, metrics, MetricQueueWait, outcome); count != 1 {
+			t.Errorf("%s{outcome=%q} count = %d, want 1", MetricQueueWait, outcome, count)
+		}
+	}
+
+	release()
+	if value := sum(t, collect(t, reader), MetricRunning, ""); value != 0 {
+		t.Errorf("%s = %d after the request is finished, want 0", MetricRunning, value)
+	}
+	if err := m.Unregister(); err != nil {
+		t.Fatalf("Unregister() = %v, want nil", err)
+	}
+}
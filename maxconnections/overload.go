@@ -0,0 +1,73 @@
+package maxconnections
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// OverloadStep is an element of OverloadChain.
+type OverloadStep interface {
+	// ServeOverload handles a rejected request. It returns false if the
+	// request is not handled and the next step should be tried. A step that
+	// returns false may still modify response headers, e.g. to set
+	// Retry-After for the following steps.
+	ServeOverload(w http.ResponseWriter, r *http.Request) bool
+}
+
+// OverloadStepFunc is an adapter to allow the use of ordinary functions as
+// OverloadStep.
+type OverloadStepFunc func(w http.ResponseWriter, r *http.Request) bool
+
+// ServeOverload calls f(w, r).
+func (f OverloadStepFunc) ServeOverload(w http.ResponseWriter, r *http.Request) bool {
+	return f(w, r)
+}
+
+// OverloadChain is an http.Handler that tries its steps in order until one
+// of them handles the request. If no step handles the request, the default
+// OverloadHandler is invoked. It allows to compose layered responses for
+// rejected requests, e.g.
+//
+//	m.OverloadHandler = maxconnections.OverloadChain{
+//		maxconnections.RetryAfter(5 * time.Second),
+//		staleCacheStep,
+//		maxconnections.Always(problemHandler),
+//	}
+type OverloadChain []OverloadStep
+
+func (c OverloadChain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, step := range c {
+		if step.ServeOverload(w, r) {
+			return
+		}
+	}
+	OverloadHandler.ServeHTTP(w, r)
+}
+
+// Always returns a step that passes all requests to h.
+func Always(h http.Handler) OverloadStep {
+	return When(nil, h)
+}
+
+// When returns a step that passes requests for which match returns true to
+// h. If match is nil, all requests are passed to h.
+func When(match func(r *http.Request) bool, h http.Handler) OverloadStep {
+	return OverloadStepFunc(func(w http.ResponseWriter, r *http.Request) bool {
+		if match != nil && !match(r) {
+			return false
+		}
+		h.ServeHTTP(w, r)
+		return true
+	})
+}
+
+// RetryAfter returns a step that sets the Retry-After header and passes the
+// request to the next step.
+func RetryAfter(d time.Duration) OverloadStep {
+	seconds := strconv.Itoa(int((d + time.Second - 1) / time.Second))
+	return OverloadStepFunc(func(w http.ResponseWriter, r *http.Request) bool {
+		w.Header().Set("Retry-After", seconds)
+		return false
+	})
+}
@@ -0,0 +1,51 @@
+package maxconnections
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOverloadChain(t *testing.T) {
+	chain := OverloadChain{
+		RetryAfter(1500 * time.Millisecond),
+		When(func(r *http.Request) bool {
+			return r.Method == "GET"
+		}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "stale", http.StatusOK)
+		})),
+		OverloadStepFunc(func(w http.ResponseWriter, r *http.Request) bool {
+			if r.URL.Path != "/json" {
+				return false
+			}
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return true
+		}),
+	}
+
+	testCases := []struct {
+		method      string
+		path        string
+		statusCode  int
+		contentType string
+	}{
+		{"GET", "/", http.StatusOK, "text/plain; charset=utf-8"},
+		{"POST", "/json", http.StatusServiceUnavailable, "application/problem+json"},
+		{"POST", "/", http.StatusServiceUnavailable, "text/plain; charset=utf-8"},
+	}
+	for _, tc := range testCases {
+		rr := httptest.NewRecorder()
+		chain.ServeHTTP(rr, httptest.NewRequest(tc.method, tc.path, nil))
+		if rr.Code != tc.statusCode {
+			t.Errorf("%s %s: status code = %d, want %d", tc.method, tc.path, rr.Code, tc.statusCode)
+		}
+		if contentType := rr.Header().Get("Content-Type"); contentType != tc.contentType {
+			t.Errorf("%s %s: Content-Type = %q, want %q", tc.method, tc.path, contentType, tc.contentType)
+		}
+		if retryAfter := rr.Header().Get("Retry-After"); retryAfter != "2" {
+			t.Errorf("%s %s: Retry-After = %q, want %q", tc.method, tc.path, retryAfter, "2")
+		}
+	}
+}
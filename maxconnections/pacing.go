@@ -0,0 +1,50 @@
+package maxconnections
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// paceDelay returns the delay of a new request, see PaceLimit.
+func (l *Limiter) paceDelay() time.Duration {
+	if atomic.LoadInt32(&l.slow) == 0 && l.runningUnits() < l.PaceLimit {
+		return 0
+	}
+	l.mu.Lock()
+	load := l.runningUnits() + l.queuedCost
+	capacity := int(l.effectiveMaxRunning()) + l.queueCapacity()
+	l.mu.Unlock()
+	if load < l.PaceLimit {
+		return 0
+	}
+	// The delay grows linearly from a step above zero at PaceLimit to
+	// MaxPaceDelay when the queue is full.
+	steps := capacity - l.PaceLimit + 1
+	if steps < 1 || load >= capacity {
+		return l.MaxPaceDelay
+	}
+	return l.MaxPaceDelay * time.Duration(load-l.PaceLimit+1) / time.Duration(steps)
+}
+
+// pace delays a new request if the load is above PaceLimit. It returns the
+// time when the request has arrived if it has been delayed, and the zero
+// time otherwise. If ctx is done during the delay, pace returns early.
+func (l *Limiter) pace(ctx context.Context) time.Time {
+	if ctx.Err() != nil {
+		return time.Time{}
+	}
+	d := l.paceDelay()
+	if d <= 0 {
+		return time.Time{}
+	}
+	arrived := l.now()
+	atomic.AddInt64(&l.counters.paced, 1)
+	t := l.startTimer(d)
+	select {
+	case <-t.C():
+	case <-ctx.Done():
+	}
+	l.stopTimer(t)
+	return arrived
+}
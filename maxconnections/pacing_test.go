@@ -0,0 +1,51 @@
+package maxconnections
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPaceDelay(t *testing.T) {
+	l := NewLimiter(4, 0)
+	l.PaceLimit = 2
+	l.MaxPaceDelay = 90 * time.Millisecond
+
+	for i, expected := range []time.Duration{0, 0, 30 * time.Millisecond, 60 * time.Millisecond, 90 * time.Millisecond} {
+		if d := l.paceDelay(); d != expected {
+			t.Fatalf("load %d: paceDelay() = %v, want %v", i, d, expected)
+		}
+		l.take(1)
+	}
+}
+
+func TestPacing(t *testing.T) {
+	l := NewLimiter(2, 0)
+	l.PaceLimit = 1
+	l.MaxPaceDelay = 40 * time.Millisecond
+
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	release2, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire() = %v, want the request to be delayed rather than rejected", err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Fatalf("Acquire() took %v, want a delay of 20ms", d)
+	}
+	release2()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Acquire(ctx); err != ErrCanceled {
+		t.Fatalf("Acquire() = %v, want %v", err, ErrCanceled)
+	}
+	release()
+
+	if stats := l.Stats(); stats.Paced != 1 || stats.Admitted != 2 {
+		t.Fatalf("stats = %+v, want 1 paced and 2 admitted requests", stats)
+	}
+}
@@ -0,0 +1,102 @@
+package maxconnections
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// servePanicking serves a request with h and returns the value that it has
+// panicked with.
+func servePanicking(h http.Handler, r *http.Request) (v interface{}) {
+	defer func() {
+		v = recover()
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	return nil
+}
+
+func TestPanic(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	errBoom := errors.New("boom")
+	testCases := []struct {
+		name  string
+		value interface{}
+		setup func(m *Middleware)
+	}{
+		{"panic", errBoom, func(m *Middleware) {}},
+		{"abort", http.ErrAbortHandler, func(m *Middleware) {}},
+		{"tracked", errBoom, func(m *Middleware) {
+			m.TrackWriteStall = true
+			m.Detachable = true
+			m.LongLived = NewLimiter(1, 0)
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			block := make(chan struct{})
+			m := New(1, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/panic" {
+					<-block
+					panic(tc.value)
+				}
+			}))
+			tc.setup(m)
+			var hooked []interface{}
+			m.OnPanic = func(r *http.Request, v interface{}) {
+				hooked = append(hooked, v)
+			}
+
+			panics := make(chan interface{})
+			go func() {
+				panics <- servePanicking(m, httptest.NewRequest("GET", "/panic", nil))
+			}()
+			waitRunning(t, m, 1, timeout)
+
+			// A queued request is admitted when the panicking handler
+			// releases its unit.
+			done := make(chan int)
+			go func() {
+				rec := httptest.NewRecorder()
+				m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+				done <- rec.Code
+			}()
+			waitQueued(t, m, 1, timeout)
+
+			close(block)
+			if v := <-panics; v != tc.value {
+				t.Fatalf("panic value = %v, want %v", v, tc.value)
+			}
+			if code := <-done; code != http.StatusOK {
+				t.Fatalf("queued request: status = %d, want %d", code, http.StatusOK)
+			}
+			if len(hooked) != 1 || hooked[0] != tc.value {
+				t.Fatalf("OnPanic got %v, want %v", hooked, tc.value)
+			}
+			if stats := m.Stats(); stats.Running != 0 || stats.Queued != 0 {
+				t.Fatalf("stats = %+v, want nothing running or queued", stats)
+			}
+		})
+	}
+}
+
+func TestPanicKeyed(t *testing.T) {
+	k := NewKeyed(1, 0, 10, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	if v := servePanicking(k, r); v != http.ErrAbortHandler {
+		t.Fatalf("panic value = %v, want %v", v, http.ErrAbortHandler)
+	}
+	l, release, err := k.Get(RemoteAddrKey(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if running := l.Stats().Running; running != 0 {
+		t.Fatalf("running = %d after a panic, want 0", running)
+	}
+}
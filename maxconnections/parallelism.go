@@ -0,0 +1,38 @@
+package maxconnections
+
+import (
+	"context"
+	"runtime"
+)
+
+type limiterKey struct{}
+
+// ParallelismFromContext returns a suggested number of goroutines that the
+// request may use for its own work, e.g. to fan out calls to backends. It is
+// derived from the number of CPUs and the number of running units of the
+// limiter that admitted the request, so that handlers don't multiply the
+// load on the process when many requests are running. For requests that
+// haven't passed through a limiter, or through a Middleware with
+// NoParallelism, it is the number of CPUs. Middleware attaches the limiter to
+// the request context at the cost of two allocations per request, see
+// NoParallelism.
+func ParallelismFromContext(ctx context.Context) int {
+	procs := runtime.GOMAXPROCS(0)
+	l, _ := ctx.Value(limiterKey{}).(*Limiter)
+	if l == nil {
+		return procs
+	}
+	return parallelism(procs, l.runningUnits())
+}
+
+// parallelism divides procs between running units. Every request gets at
+// least one goroutine.
+func parallelism(procs, running int) int {
+	if running < 1 {
+		running = 1
+	}
+	if p := procs / running; p > 1 {
+		return p
+	}
+	return 1
+}
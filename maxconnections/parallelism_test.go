@@ -0,0 +1,46 @@
+package maxconnections
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestParallelism(t *testing.T) {
+	testCases := []struct {
+		procs, running, expected int
+	}{
+		{8, 0, 8},
+		{8, 1, 8},
+		{8, 3, 2},
+		{8, 16, 1},
+	}
+	for _, tc := range testCases {
+		if p := parallelism(tc.procs, tc.running); p != tc.expected {
+			t.Errorf("parallelism(%d, %d) = %d, want %d", tc.procs, tc.running, p, tc.expected)
+		}
+	}
+}
+
+func TestParallelismFromContext(t *testing.T) {
+	procs := runtime.GOMAXPROCS(0)
+	if p := ParallelismFromContext(context.Background()); p != procs {
+		t.Fatalf("without a limiter: ParallelismFromContext() = %d, want %d", p, procs)
+	}
+
+	var p int
+	h := New(2, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p = ParallelismFromContext(r.Context())
+	}))
+	release, err := h.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if expected := parallelism(procs, 2); p != expected {
+		t.Fatalf("with 2 running units: ParallelismFromContext() = %d, want %d", p, expected)
+	}
+}
@@ -0,0 +1,415 @@
+package maxconnections
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// bucket is a class of requests of Partitioned.
+type bucket struct {
+	name string
+
+	// min is the number of running units reserved for the bucket.
+	min int
+
+	// running is the number of running requests of the bucket. The
+	// requests above min occupy units of the shared pool.
+	running int
+
+	// queued is the number of queued requests of the bucket.
+	queued int
+
+	admitted int64
+	rejected int64
+}
+
+// partitionWaiter is a request in the queue of Partitioned.
+type partitionWaiter struct {
+	b     *bucket
+	ready chan struct{}
+
+	// err is set before ready is closed. If it is nil, the request has got
+	// its running unit.
+	err error
+}
+
+// DefaultBucket is the bucket of Partitioned for requests whose Classify
+// result has no reservation. Reserve(DefaultBucket, n) reserves units for
+// such requests.
+const DefaultBucket = "default"
+
+// BucketStats describes the state of a bucket of Partitioned.
+type BucketStats struct {
+	// Min is the number of running units reserved for the bucket.
+	Min int `json:"min"`
+
+	// Running is the number of running requests of the bucket.
+	Running int `json:"running"`
+
+	// Queued is the number of queued requests of the bucket.
+	Queued int `json:"queued"`
+
+	// Admitted is the number of admitted requests of the bucket.
+	Admitted int64 `json:"admitted"`
+
+	// Rejected is the number of rejected requests of the bucket.
+	Rejected int64 `json:"rejected"`
+}
+
+// PartitionedStats describes the state of Partitioned.
+type PartitionedStats struct {
+	// Shared is the size of the shared pool.
+	Shared int `json:"shared"`
+
+	// SharedRunning is the number of requests that occupy units of the
+	// shared pool.
+	SharedRunning int `json:"shared_running"`
+
+	// Buckets describes the buckets by their names.
+	Buckets map[string]BucketStats `json:"buckets"`
+}
+
+// Partitioned implements the http.Handler interface. It splits the running
+// budget into named buckets with reserved units and a shared pool. A request
+// of a bucket runs on a reserved unit of the bucket if there is a free one,
+// otherwise on a unit of the shared pool, so a bucket always gets at least
+// its reserved units, and can use more while the shared pool has room:
+//
+//	p := maxconnections.NewPartitioned(50, 100, classify, h)
+//	p.Reserve("internal", 10)
+//	p.Reserve("public", 40)
+//
+// Requests of buckets without a reservation belong to DefaultBucket, which
+// uses only the shared pool unless it has a reservation of its own.
+type Partitioned struct {
+	handler http.Handler
+
+	mu      sync.Mutex
+	shared  int
+	used    int // units of the shared pool in use
+	buckets map[string]*bucket
+	queue   list.List
+
+	// closed is true after Shutdown, idle is closed when there are no
+	// running requests after that.
+	closed     bool
+	idle       chan struct{}
+	idleClosed bool
+
+	// maxInQueue is a maximum number of requests that can wait for running
+	// units across all buckets.
+	maxInQueue int
+
+	// Classify returns the bucket of the request.
+	Classify func(r *http.Request) string
+
+	// MaxWaitInQueue is a maximum wait time in the queue. It is not limited
+	// if it is not positive.
+	MaxWaitInQueue time.Duration
+
+	// OverloadHandler is called for requests that are not admitted.
+	OverloadHandler http.Handler
+
+	// CanceledHandler is called for requests whose context is done before
+	// they are admitted, see ErrCanceled.
+	CanceledHandler http.Handler
+
+	// ShutdownHandler is called for requests that are rejected because
+	// Shutdown has been called, see ErrShutdown.
+	ShutdownHandler http.Handler
+
+	// Observer, if not nil, receives admission events.
+	Observer Observer
+
+	// Events, if not nil, receives a record of every admission decision,
+	// see Limiter.Events. The Key of an event is the bucket of the request.
+	Events func(Event)
+
+	// Name identifies the limiter in Events.
+	Name string
+
+	// Clock, if not nil, is used instead of SystemClock, e.g. to control
+	// queue timeouts in tests.
+	Clock Clock
+}
+
+// NewPartitioned returns an http.Handler that runs h for requests of the
+// bucket selected by classify. Besides the units reserved by Reserve, there
+// are shared units that any bucket can use. Up to maxInQueue requests can
+// wait for running units.
+func NewPartitioned(shared, maxInQueue int, classify func(r *http.Request) string, h http.Handler) *Partitioned {
+	return &Partitioned{
+		handler:    h,
+		shared:     shared,
+		buckets:    map[string]*bucket{DefaultBucket: {name: DefaultBucket}},
+		idle:       make(chan struct{}),
+		maxInQueue: maxInQueue,
+		Classify:   classify,
+
+		OverloadHandler: OverloadHandler,
+		CanceledHandler: CanceledHandler,
+		ShutdownHandler: ShutdownHandler,
+	}
+}
+
+// Reserve reserves min running units for the bucket name. It adds to the
+// total running budget, which is the shared pool plus the reservations of
+// all buckets.
+func (p *Partitioned) Reserve(name string, min int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b, ok := p.buckets[name]
+	if !ok {
+		b = &bucket{name: name}
+		p.buckets[name] = b
+	}
+	if b.running > b.min {
+		p.used -= b.running - b.min
+	}
+	b.min = min
+	if b.running > b.min {
+		p.used += b.running - b.min
+	}
+	p.notify()
+}
+
+// bucket returns the bucket for the Classify result name. Only the buckets
+// that have been passed to Reserve exist, so that a classifier that passes
+// through request data doesn't make the map grow without bound. It should
+// be called with mu held.
+func (p *Partitioned) bucket(name string) *bucket {
+	if b, ok := p.buckets[name]; ok {
+		return b
+	}
+	return p.buckets[DefaultBucket]
+}
+
+// take gives a running unit to a request of b, if there is one. It should be
+// called with mu held.
+func (p *Partitioned) take(b *bucket) bool {
+	if b.running >= b.min {
+		if p.used >= p.shared {
+			return false
+		}
+		p.used++
+	}
+	b.running++
+	b.admitted++
+	return true
+}
+
+// release frees the running unit of a request of b.
+func (p *Partitioned) release(b *bucket) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b.running > b.min {
+		p.used--
+	}
+	b.running--
+	p.notify()
+	p.checkIdle()
+}
+
+// checkIdle closes idle if Partitioned is shut down and all admitted
+// requests are finished. It should be called with mu held.
+func (p *Partitioned) checkIdle() {
+	if !p.closed || p.idleClosed {
+		return
+	}
+	for _, b := range p.buckets {
+		if b.running > 0 {
+			return
+		}
+	}
+	p.idleClosed = true
+	close(p.idle)
+}
+
+// Shutdown stops admitting new requests and waits for admitted requests to
+// finish, see Limiter.Shutdown.
+func (p *Partitioned) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		for e := p.queue.Front(); e != nil; e = e.Next() {
+			w := e.Value.(*partitionWaiter)
+			w.b.queued--
+			w.b.rejected++
+			w.err = ErrShutdown
+			close(w.ready)
+		}
+		p.queue.Init()
+		p.checkIdle()
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-p.idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// notify passes free running units to waiters in the order of their arrival.
+// A waiter that cannot run doesn't block the waiters of other buckets behind
+// it. It should be called with mu held.
+func (p *Partitioned) notify() {
+	var next *list.Element
+	for e := p.queue.Front(); e != nil; e = next {
+		next = e.Next()
+		w := e.Value.(*partitionWaiter)
+		if !p.take(w.b) {
+			continue
+		}
+		p.queue.Remove(e)
+		w.b.queued--
+		close(w.ready)
+	}
+}
+
+// acquire waits until a request of the bucket name gets a running unit.
+func (p *Partitioned) acquire(ctx context.Context, name string) (*bucket, error) {
+	p.mu.Lock()
+	b := p.bucket(name)
+	p.mu.Unlock()
+	wait, err := p.wait(ctx, b)
+	cause := overloadQueueFull
+	if wait > 0 {
+		cause = overloadQueueTimeout
+	}
+	p.emit(ctx, b.name, wait, err, cause)
+	if p.Observer != nil {
+		if err != nil {
+			p.Observer.Rejected(ctx, wait, err)
+		} else {
+			p.Observer.Admitted(ctx, wait)
+		}
+	}
+	return b, err
+}
+
+// wait waits until a request of b gets a running unit. It returns the time
+// the request has spent in the queue.
+func (p *Partitioned) wait(ctx context.Context, b *bucket) (time.Duration, error) {
+	if ctx.Err() != nil {
+		return 0, ErrCanceled
+	}
+	p.mu.Lock()
+	if p.closed {
+		b.rejected++
+		p.mu.Unlock()
+		return 0, ErrShutdown
+	}
+	if b.queued == 0 && p.take(b) {
+		p.mu.Unlock()
+		return 0, nil
+	}
+	if p.queue.Len() >= p.maxInQueue {
+		b.rejected++
+		p.mu.Unlock()
+		return 0, ErrOverloaded
+	}
+	w := &partitionWaiter{b: b, ready: make(chan struct{})}
+	e := p.queue.PushBack(w)
+	b.queued++
+	p.mu.Unlock()
+	if p.Observer != nil {
+		p.Observer.Queued(ctx)
+	}
+
+	arrived := clockNow(p.Clock)
+	var timeout <-chan time.Time
+	if p.MaxWaitInQueue > 0 {
+		timer := startTimer(p.Clock, p.MaxWaitInQueue)
+		defer stopTimer(timer)
+		timeout = timer.C()
+	}
+	select {
+	case <-w.ready:
+		return clockNow(p.Clock).Sub(arrived), w.err
+	case <-timeout:
+	case <-ctx.Done():
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	wait := clockNow(p.Clock).Sub(arrived)
+	select {
+	case <-w.ready:
+		// The request has been admitted or rejected while we were
+		// waiting for the lock.
+		return wait, w.err
+	default:
+	}
+	p.queue.Remove(e)
+	b.queued--
+	b.rejected++
+	if ctx.Err() != nil {
+		return wait, ErrCanceled
+	}
+	return wait, ErrOverloaded
+}
+
+// emit sends the event for the decision err about a request of the bucket
+// name to Events.
+func (p *Partitioned) emit(ctx context.Context, name string, wait time.Duration, err error, cause overload) {
+	if p.Events == nil {
+		return
+	}
+	e := Event{
+		Time:        clockNow(p.Clock),
+		Limiter:     p.Name,
+		Key:         name,
+		Cost:        1,
+		Criticality: CriticalityFromContext(ctx),
+		QueueWait:   wait,
+		Outcome:     OutcomeAdmitted,
+	}
+	if err != nil {
+		e.Outcome = Reason(err)
+		if err == ErrOverloaded {
+			e.Cause = cause.String()
+		}
+	}
+	p.Events(e)
+}
+
+// Stats returns the current state of the partitions.
+func (p *Partitioned) Stats() PartitionedStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := PartitionedStats{
+		Shared:        p.shared,
+		SharedRunning: p.used,
+		Buckets:       make(map[string]BucketStats, len(p.buckets)),
+	}
+	for name, b := range p.buckets {
+		stats.Buckets[name] = BucketStats{
+			Min:      b.min,
+			Running:  b.running,
+			Queued:   b.queued,
+			Admitted: b.admitted,
+			Rejected: b.rejected,
+		}
+	}
+	return stats
+}
+
+func (p *Partitioned) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, err := p.acquire(r.Context(), p.Classify(r))
+	switch err {
+	case nil:
+		defer p.release(b)
+		p.handler.ServeHTTP(w, r)
+	case ErrCanceled:
+		p.CanceledHandler.ServeHTTP(w, r)
+	case ErrShutdown:
+		p.ShutdownHandler.ServeHTTP(w, r)
+	default:
+		p.OverloadHandler.ServeHTTP(w, r)
+	}
+}
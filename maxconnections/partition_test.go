@@ -0,0 +1,190 @@
+package maxconnections
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPartitioned(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	release := make(chan struct{})
+	started := make(chan string, 10)
+	p := NewPartitioned(1, 10, func(r *http.Request) string {
+		return r.URL.Path[1:]
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- r.URL.Path[1:]
+		<-release
+	}))
+	p.Reserve("internal", 1)
+	p.Reserve("public", 1)
+
+	var wg sync.WaitGroup
+	serve := func(bucket string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/"+bucket, nil))
+		}()
+	}
+	expectStarted := func(expected string) {
+		t.Helper()
+		select {
+		case bucket := <-started:
+			if bucket != expected {
+				t.Fatalf("started %s, want %s", bucket, expected)
+			}
+		case <-time.After(timeout):
+			t.Fatalf("timeout while waiting for %s", expected)
+		}
+	}
+
+	// The public bucket takes its reserved unit and the shared one.
+	serve("public")
+	expectStarted("public")
+	serve("public")
+	expectStarted("public")
+	serve("public")
+	deadline := time.Now().Add(timeout)
+	for p.Stats().Buckets["public"].Queued != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats = %+v, want a queued public request", p.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The internal bucket still has its reserved unit.
+	serve("internal")
+	expectStarted("internal")
+
+	// Buckets without a reservation wait for the shared pool.
+	rec := httptest.NewRecorder()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/batch", nil).WithContext(ctx))
+	if rec.Code != StatusClientClosedRequest {
+		t.Fatalf("status = %d, want %d for a request that could not get a unit", rec.Code, StatusClientClosedRequest)
+	}
+
+	stats := p.Stats()
+	if stats.SharedRunning != 1 || stats.Buckets["public"].Running != 2 || stats.Buckets["internal"].Running != 1 || stats.Buckets[DefaultBucket].Rejected != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	close(release)
+	expectStarted("public")
+	wg.Wait()
+	if stats := p.Stats(); stats.SharedRunning != 0 || stats.Buckets["public"].Admitted != 3 {
+		t.Fatalf("stats = %+v, want 3 admitted public requests and nothing running", stats)
+	}
+}
+
+func TestPartitionedQueueFull(t *testing.T) {
+	p := NewPartitioned(0, 0, func(r *http.Request) string { return "" }, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestPartitionedDefaultBucket(t *testing.T) {
+	p := NewPartitioned(1, 0, func(r *http.Request) string {
+		return r.URL.Path
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	p.Reserve("/reserved", 1)
+	for i := 0; i < 100; i++ {
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/"+strconv.Itoa(i), nil))
+	}
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/reserved", nil))
+
+	stats := p.Stats()
+	if len(stats.Buckets) != 2 || stats.Buckets[DefaultBucket].Admitted != 100 || stats.Buckets["/reserved"].Admitted != 1 {
+		t.Fatalf("stats = %+v, want unreserved requests in the default bucket", stats)
+	}
+}
+
+func TestPartitionedShutdown(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	p := NewPartitioned(1, 10, func(r *http.Request) string { return "" }, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	fire := make(chan time.Time)
+	p.MaxWaitInQueue = time.Minute
+	p.Clock = &testClock{
+		newTimer: func(d time.Duration) Timer {
+			return chanTimer(fire)
+		},
+	}
+	events := NewEventChan(10)
+	p.Events = events.Send
+	p.Name = "partitioned"
+
+	go p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	<-started
+
+	// The queue timeout comes from the clock.
+	done := make(chan int)
+	queue := func() {
+		go func() {
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			done <- rec.Code
+		}()
+		deadline := time.Now().Add(timeout)
+		for p.Stats().Buckets[DefaultBucket].Queued != 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("stats = %+v, want a queued request", p.Stats())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	queue()
+	fire <- time.Time{}
+	if status := <-done; status != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d after the queue timeout, want %d", status, http.StatusServiceUnavailable)
+	}
+
+	// Shutdown rejects queued requests and waits for running ones.
+	queue()
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- p.Shutdown(context.Background())
+	}()
+	<-done
+	if stats := p.Stats(); stats.Buckets[DefaultBucket].Rejected != 2 {
+		t.Fatalf("stats = %+v, want 2 rejected requests", stats)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown() = %v before the running request is finished", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown() = %v, want nil", err)
+	}
+
+	var outcomes []string
+	for len(events.C) > 0 {
+		e := <-events.C
+		if e.Limiter != "partitioned" || e.Key != DefaultBucket {
+			t.Errorf("event = %+v, want the name of the limiter and the bucket", e)
+		}
+		outcomes = append(outcomes, e.Outcome+"/"+e.Cause)
+	}
+	expected := []string{"admitted/", "overloaded/queue timeout", "shutdown/"}
+	if strings.Join(outcomes, ",") != strings.Join(expected, ",") {
+		t.Fatalf("events = %v, want %v", outcomes, expected)
+	}
+}
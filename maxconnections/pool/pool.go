@@ -0,0 +1,67 @@
+// Package pool provides a bounded worker pool whose admission is controlled
+// by a maxconnections limiter, so that background jobs get the same queueing,
+// timeouts and rejections as HTTP requests. A pool created with the limiter
+// of a middleware draws from the same running units, so HTTP requests and
+// jobs share one budget:
+//
+//	m := maxconnections.New(100, 100, h)
+//	jobs := pool.New(m.Limiter)
+//	err := jobs.Submit(ctx, func() { ... })
+package pool
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+// Pool runs functions in goroutines when its limiter admits them.
+type Pool struct {
+	l  *maxconnections.Limiter
+	wg sync.WaitGroup
+
+	// Cost, if not nil, returns the number of running units that a task
+	// submitted with ctx needs, see maxconnections.Middleware.Cost.
+	Cost func(ctx context.Context) int
+}
+
+// New returns a Pool that runs no more tasks at the same time than l admits.
+func New(l *maxconnections.Limiter) *Pool {
+	return &Pool{
+		l: l,
+	}
+}
+
+// Limiter returns the limiter of the pool.
+func (p *Pool) Limiter() *maxconnections.Limiter {
+	return p.l
+}
+
+// Submit waits until the limiter admits the task and runs f in a new
+// goroutine. The task waits in the queue of the limiter like an HTTP
+// request, and its running units are released when f returns, even if it
+// panics. If the task is rejected, Submit returns the error of the limiter,
+// e.g. maxconnections.ErrOverloaded, and f is not called.
+func (p *Pool) Submit(ctx context.Context, f func()) error {
+	n := 1
+	if p.Cost != nil {
+		n = p.Cost(ctx)
+	}
+	release, err := p.l.AcquireN(ctx, n)
+	if err != nil {
+		return err
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer release()
+		f()
+	}()
+	return nil
+}
+
+// Wait waits for the submitted tasks to finish.
+func (p *Pool) Wait() {
+	p.wg.Wait()
+}
@@ -0,0 +1,63 @@
+package pool
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+func TestSubmit(t *testing.T) {
+	m := maxconnections.New(1, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	p := New(m.Limiter)
+
+	release := make(chan struct{})
+	ran := make(chan int, 2)
+	if err := p.Submit(context.Background(), func() {
+		<-release
+		ran <- 1
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The job occupies the running unit of the middleware.
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil).WithContext(maxconnections.WithMaxQueueWait(context.Background(), time.Millisecond)))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the request to be rejected while the job runs", rec.Code)
+	}
+
+	submitted := make(chan error)
+	go func() {
+		submitted <- p.Submit(context.Background(), func() {
+			ran <- 2
+		})
+	}()
+	deadline := time.Now().Add(time.Second)
+	for m.Stats().Queued != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the second job hasn't been queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.Submit(context.Background(), func() {
+		t.Error("a rejected job has been run")
+	}); err != maxconnections.ErrOverloaded {
+		t.Fatalf("Submit() = %v, want %v", err, maxconnections.ErrOverloaded)
+	}
+
+	close(release)
+	if err := <-submitted; err != nil {
+		t.Fatal(err)
+	}
+	p.Wait()
+	if first, second := <-ran, <-ran; first != 1 || second != 2 {
+		t.Fatalf("jobs ran in order %d, %d", first, second)
+	}
+	if running := m.Stats().Running; running != 0 {
+		t.Fatalf("running = %d after the jobs have finished, want 0", running)
+	}
+}
@@ -0,0 +1,102 @@
+package maxconnections
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptsJSON reports whether the client of r accepts JSON responses, i.e.
+// whether its Accept header lists a JSON media type explicitly.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			if mediaType == "application/json" || mediaType == "application/problem+json" || strings.HasSuffix(mediaType, "+json") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ProblemHandler is an http.Handler for rejected requests that honors the
+// Accept header of the request: clients that accept JSON get an RFC 7807
+// application/problem+json response, other clients get a plain text one.
+//
+// The problem has the members type, title and status, retry_after with the
+// number of seconds from the Retry-After header if it is set, e.g. by the
+// RetryAfter step of OverloadChain, and queue with the position, the length
+// and the estimated wait in milliseconds from QueueStatusFromContext if the
+// request has met the queue. Fields can add more members.
+type ProblemHandler struct {
+	// Status is the status code of the response.
+	Status int
+
+	// Type is a URI reference that identifies the problem type. If it is
+	// empty, the type is "about:blank".
+	Type string
+
+	// Title is a short summary of the problem.
+	Title string
+
+	// Text is the body of plain text responses.
+	Text string
+
+	// Fields, if not nil, is called with the problem of the request before
+	// it is written, so that extension members can be added or changed.
+	Fields func(r *http.Request, problem map[string]interface{})
+}
+
+// NewProblemHandler returns a ProblemHandler that responds with status. JSON
+// clients get a problem with title, other clients get text.
+func NewProblemHandler(status int, title, text string) *ProblemHandler {
+	return &ProblemHandler{
+		Status: status,
+		Title:  title,
+		Text:   text,
+	}
+}
+
+// Problem returns the problem details for r.
+func (h *ProblemHandler) Problem(w http.ResponseWriter, r *http.Request) map[string]interface{} {
+	typ := h.Type
+	if typ == "" {
+		typ = "about:blank"
+	}
+	problem := map[string]interface{}{
+		"type":   typ,
+		"title":  h.Title,
+		"status": h.Status,
+	}
+	if retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After")); err == nil {
+		problem["retry_after"] = retryAfter
+	}
+	if status, ok := QueueStatusFromContext(r.Context()); ok {
+		problem["queue"] = map[string]interface{}{
+			"position":          status.Position,
+			"length":            status.Length,
+			"estimated_wait_ms": status.EstimatedWait.Milliseconds(),
+		}
+	}
+	if h.Fields != nil {
+		h.Fields(r, problem)
+	}
+	return problem
+}
+
+func (h *ProblemHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !acceptsJSON(r) {
+		http.Error(w, h.Text, h.Status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(h.Status)
+	json.NewEncoder(w).Encode(h.Problem(w, r))
+}
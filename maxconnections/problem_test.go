@@ -0,0 +1,72 @@
+package maxconnections
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProblemHandler(t *testing.T) {
+	h := NewProblemHandler(http.StatusServiceUnavailable, "service is overloaded", "503 service is overloaded")
+	h.Fields = func(r *http.Request, problem map[string]interface{}) {
+		problem["instance"] = r.URL.Path
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if ct := rec.Header().Get("Content-Type"); rec.Code != http.StatusServiceUnavailable || !strings.HasPrefix(ct, "text/plain") || rec.Body.String() != "503 service is overloaded\n" {
+		t.Fatalf("plain text response: %d %q %q", rec.Code, ct, rec.Body.String())
+	}
+
+	r := httptest.NewRequest("GET", "/api", nil)
+	r.Header.Set("Accept", "text/html;q=0.5, application/json")
+	r = r.WithContext(context.WithValue(r.Context(), queueStatusKey{}, QueueStatus{Length: 3, EstimatedWait: 1500 * time.Millisecond}))
+	rec = httptest.NewRecorder()
+	rec.Header().Set("Retry-After", "2")
+	h.ServeHTTP(rec, r)
+	if ct := rec.Header().Get("Content-Type"); rec.Code != http.StatusServiceUnavailable || ct != "application/problem+json" {
+		t.Fatalf("problem response: %d %q", rec.Code, ct)
+	}
+	var problem struct {
+		Type       string `json:"type"`
+		Title      string `json:"title"`
+		Status     int    `json:"status"`
+		RetryAfter int    `json:"retry_after"`
+		Queue      struct {
+			Position      int   `json:"position"`
+			Length        int   `json:"length"`
+			EstimatedWait int64 `json:"estimated_wait_ms"`
+		} `json:"queue"`
+		Instance string `json:"instance"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.Type != "about:blank" || problem.Title != "service is overloaded" || problem.Status != http.StatusServiceUnavailable ||
+		problem.RetryAfter != 2 || problem.Queue.Length != 3 || problem.Queue.EstimatedWait != 1500 || problem.Instance != "/api" {
+		t.Fatalf("problem = %+v", problem)
+	}
+}
+
+func TestAcceptsJSON(t *testing.T) {
+	testCases := map[string]bool{
+		"":                         false,
+		"*/*":                      false,
+		"text/html":                false,
+		"application/json":         true,
+		"application/problem+json": true,
+		"application/vnd.api+json; charset=utf-8": true,
+		"text/plain, application/json;q=0.9":      true,
+	}
+	for accept, expected := range testCases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", accept)
+		if got := acceptsJSON(r); got != expected {
+			t.Errorf("acceptsJSON(%q) = %v, want %v", accept, got, expected)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package maxconnections
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+const (
+	// CriticalityHeader is the request header that carries the criticality
+	// of a request to the upstream, e.g. "sheddable".
+	CriticalityHeader = "X-Request-Criticality"
+
+	// TimeoutHeader is the request header that carries the time remaining
+	// before the deadline of a request, e.g. "250ms".
+	TimeoutHeader = "X-Request-Timeout"
+)
+
+// ParseCriticality parses the string representation of a criticality.
+func ParseCriticality(s string) (Criticality, bool) {
+	switch s {
+	case "critical":
+		return Critical, true
+	case "degraded-ok":
+		return DegradedOK, true
+	case "sheddable":
+		return Sheddable, true
+	}
+	return Critical, false
+}
+
+// SetPropagationHeaders sets CriticalityHeader and TimeoutHeader of h
+// according to the criticality c and the deadline of ctx, so that the
+// upstream can prioritize the request the same way. Critical requests and
+// requests without a deadline don't get the respective header.
+func SetPropagationHeaders(ctx context.Context, h http.Header, c Criticality) {
+	if c != Critical {
+		h.Set(CriticalityHeader, c.String())
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline).Truncate(time.Millisecond)
+		if remaining < 0 {
+			remaining = 0
+		}
+		h.Set(TimeoutHeader, remaining.String())
+	}
+}
+
+// WithPropagationHeaders returns a shallow copy of r whose context carries
+// the criticality and the deadline from CriticalityHeader and TimeoutHeader,
+// see SetPropagationHeaders. Invalid values are ignored. The returned cancel
+// function should be called when the request is done.
+func WithPropagationHeaders(r *http.Request) (*http.Request, context.CancelFunc) {
+	ctx := r.Context()
+	cancel := context.CancelFunc(func() {})
+	if c, ok := ParseCriticality(r.Header.Get(CriticalityHeader)); ok {
+		ctx = WithCriticality(ctx, c)
+	}
+	if d, err := time.ParseDuration(r.Header.Get(TimeoutHeader)); err == nil && d >= 0 {
+		ctx, cancel = context.WithTimeout(ctx, d)
+	}
+	if ctx == r.Context() {
+		return r, cancel
+	}
+	return r.WithContext(ctx), cancel
+}
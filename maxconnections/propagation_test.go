@@ -0,0 +1,84 @@
+package maxconnections
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPropagationHeaders(t *testing.T) {
+	var outbound http.Header
+	rt := NewRoundTripper(1, 0, roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		outbound = req.Header
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader("OK")),
+			Request:    req,
+		}, nil
+	}))
+	rt.PropagationHeaders = true
+
+	var hasDeadline bool
+	h := New(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, hasDeadline = r.Context().Deadline()
+		req, err := http.NewRequest("GET", "http://example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := rt.RoundTrip(req.WithContext(r.Context()))
+		if err != nil {
+			t.Fatalf("RoundTrip() = %v, want nil", err)
+		}
+		res.Body.Close()
+	}))
+	h.PropagationHeaders = true
+
+	for _, tc := range []struct {
+		criticality string
+		timeout     string
+		deadline    bool
+	}{
+		{"sheddable", "2s", true},
+		{"degraded-ok", "", false},
+		{"", "invalid", false},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(CriticalityHeader, tc.criticality)
+		r.Header.Set(TimeoutHeader, tc.timeout)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		if c := outbound.Get(CriticalityHeader); c != tc.criticality {
+			t.Errorf("%q: outbound %s = %q, want %q", tc.criticality, CriticalityHeader, c, tc.criticality)
+		}
+		if hasDeadline != tc.deadline {
+			t.Errorf("%q: the handler has a deadline: %v, want %v", tc.criticality, hasDeadline, tc.deadline)
+		}
+		timeout := outbound.Get(TimeoutHeader)
+		if !tc.deadline {
+			if timeout != "" {
+				t.Errorf("%q: outbound %s = %q, want none", tc.criticality, TimeoutHeader, timeout)
+			}
+			continue
+		}
+		if d, err := time.ParseDuration(timeout); err != nil || d <= 0 || d > 2*time.Second {
+			t.Errorf("%q: outbound %s = %q, want less than 2s", tc.criticality, TimeoutHeader, timeout)
+		}
+	}
+}
+
+func TestCriticalityInheritance(t *testing.T) {
+	var c Criticality
+	h := New(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c = CriticalityFromContext(r.Context())
+	}))
+	h.Criticality = func(r *http.Request) Criticality {
+		return DegradedOK
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if c != DegradedOK {
+		t.Fatalf("the handler got criticality %s, want %s", c, DegradedOK)
+	}
+}
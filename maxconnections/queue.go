@@ -0,0 +1,250 @@
+package maxconnections
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"time"
+)
+
+// QueuedRequest is a request that waits in the queue of a Limiter.
+type QueuedRequest struct {
+	// Context is the request context.
+	Context context.Context
+
+	// Cost is the number of running units that the request needs.
+	Cost int
+
+	// Key is the queue key of the request, see Middleware.QueueKey.
+	Key string
+
+	// Enqueued is the time when the request was put into the queue.
+	Enqueued time.Time
+
+	// Deadline is the deadline of Context, if it has one.
+	Deadline time.Time
+
+	// e is the element of the request in the queue of the limiter.
+	e *list.Element
+}
+
+// Queue orders queued requests for admission, see Limiter.NewQueue. The
+// limiter calls its methods under its lock, so implementations don't need
+// to be safe for concurrent use, but they should be fast.
+type Queue interface {
+	// Push adds a request to the queue.
+	Push(r *QueuedRequest)
+
+	// Peek returns the request that should be admitted next, or nil if
+	// the queue is empty. The request stays in the queue until the
+	// limiter removes it, e.g. when there are enough free units for it.
+	Peek() *QueuedRequest
+
+	// Remove removes the request from the queue. It is called when the
+	// request is admitted or leaves the queue because it is rejected or
+	// canceled.
+	Remove(r *QueuedRequest)
+
+	// Len returns the number of requests in the queue.
+	Len() int
+}
+
+// listQueue is a Queue that admits requests from one end of a list.
+type listQueue struct {
+	l        list.List
+	elements map[*QueuedRequest]*list.Element
+	lifo     bool
+}
+
+func newListQueue(lifo bool) *listQueue {
+	return &listQueue{elements: make(map[*QueuedRequest]*list.Element), lifo: lifo}
+}
+
+// NewFIFOQueue returns a Queue that admits the oldest requests first, see
+// FIFO.
+func NewFIFOQueue() Queue {
+	return newListQueue(false)
+}
+
+// NewLIFOQueue returns a Queue that admits the newest requests first, see
+// LIFO.
+func NewLIFOQueue() Queue {
+	return newListQueue(true)
+}
+
+func (q *listQueue) Push(r *QueuedRequest) {
+	q.elements[r] = q.l.PushBack(r)
+}
+
+func (q *listQueue) Peek() *QueuedRequest {
+	e := q.l.Front()
+	if q.lifo {
+		e = q.l.Back()
+	}
+	if e == nil {
+		return nil
+	}
+	return e.Value.(*QueuedRequest)
+}
+
+func (q *listQueue) Remove(r *QueuedRequest) {
+	if e, ok := q.elements[r]; ok {
+		q.l.Remove(e)
+		delete(q.elements, r)
+	}
+}
+
+func (q *listQueue) Len() int {
+	return q.l.Len()
+}
+
+// adaptiveQueue is a Queue for the AdaptiveLIFO discipline.
+type adaptiveQueue struct {
+	*listQueue
+	l *Limiter
+}
+
+func (q *adaptiveQueue) Peek() *QueuedRequest {
+	e := q.listQueue.l.Front()
+	if e == nil {
+		return nil
+	}
+	if q.l.now().Sub(e.Value.(*QueuedRequest).Enqueued) > q.l.AdaptiveLIFOThreshold {
+		e = q.listQueue.l.Back()
+	}
+	return e.Value.(*QueuedRequest)
+}
+
+// fairQueue is a Queue for the FairShare discipline. It admits the oldest
+// request of the key with the smallest pass, see Limiter.charge.
+type fairQueue struct {
+	*listQueue
+	l *Limiter
+}
+
+func (q *fairQueue) Peek() *QueuedRequest {
+	var best *QueuedRequest
+	var bestPass float64
+	for e := q.listQueue.l.Front(); e != nil; e = e.Next() {
+		r := e.Value.(*QueuedRequest)
+		if pass := q.l.fairPass[r.Key]; best == nil || pass < bestPass {
+			best, bestPass = r, pass
+		}
+	}
+	return best
+}
+
+// deadlineHeap is a heap of requests ordered by their deadlines. Requests
+// without a deadline come last in arrival order.
+type deadlineHeap struct {
+	requests []*QueuedRequest
+	index    map[*QueuedRequest]int
+	seq      map[*QueuedRequest]uint64
+	next     uint64
+}
+
+func (h *deadlineHeap) Len() int { return len(h.requests) }
+
+func (h *deadlineHeap) Less(i, j int) bool {
+	a, b := h.requests[i], h.requests[j]
+	switch {
+	case a.Deadline.IsZero() != b.Deadline.IsZero():
+		return b.Deadline.IsZero()
+	case !a.Deadline.Equal(b.Deadline):
+		return a.Deadline.Before(b.Deadline)
+	}
+	return h.seq[a] < h.seq[b]
+}
+
+func (h *deadlineHeap) Swap(i, j int) {
+	h.requests[i], h.requests[j] = h.requests[j], h.requests[i]
+	h.index[h.requests[i]] = i
+	h.index[h.requests[j]] = j
+}
+
+func (h *deadlineHeap) Push(x interface{}) {
+	r := x.(*QueuedRequest)
+	h.index[r] = len(h.requests)
+	h.seq[r] = h.next
+	h.next++
+	h.requests = append(h.requests, r)
+}
+
+func (h *deadlineHeap) Pop() interface{} {
+	r := h.requests[len(h.requests)-1]
+	h.requests = h.requests[:len(h.requests)-1]
+	delete(h.index, r)
+	delete(h.seq, r)
+	return r
+}
+
+// deadlineQueue is a Queue that admits requests with the earliest deadline
+// first.
+type deadlineQueue struct {
+	h deadlineHeap
+}
+
+// NewEDFQueue returns a Queue that admits requests with the earliest context
+// deadline first. Requests without a deadline are admitted in FIFO order
+// after all requests with a deadline. As with the EarliestDeadline
+// discipline, the limiter rejects requests that cannot make their deadlines
+// when their turn comes.
+func NewEDFQueue() Queue {
+	return &deadlineQueue{h: deadlineHeap{
+		index: make(map[*QueuedRequest]int),
+		seq:   make(map[*QueuedRequest]uint64),
+	}}
+}
+
+func (q *deadlineQueue) Push(r *QueuedRequest) {
+	heap.Push(&q.h, r)
+}
+
+func (q *deadlineQueue) Peek() *QueuedRequest {
+	if len(q.h.requests) == 0 {
+		return nil
+	}
+	return q.h.requests[0]
+}
+
+func (q *deadlineQueue) Remove(r *QueuedRequest) {
+	if i, ok := q.h.index[r]; ok {
+		heap.Remove(&q.h, i)
+	}
+}
+
+func (q *deadlineQueue) Len() int {
+	return q.h.Len()
+}
+
+// newQueue returns a Queue created by NewQueue or, if it is nil, the Queue
+// of QueueDiscipline.
+func (l *Limiter) newQueue() Queue {
+	if l.NewQueue != nil {
+		return l.NewQueue()
+	}
+	switch l.QueueDiscipline {
+	case LIFO:
+		return NewLIFOQueue()
+	case AdaptiveLIFO:
+		return &adaptiveQueue{listQueue: newListQueue(false), l: l}
+	case FairShare:
+		return &fairQueue{listQueue: newListQueue(false), l: l}
+	case EarliestDeadline:
+		return NewEDFQueue()
+	}
+	return NewFIFOQueue()
+}
+
+// order returns the Queue that orders the requests of q. It should be
+// called with mu held.
+func (l *Limiter) order(q *list.List) Queue {
+	i := 0
+	if q == &l.lowQueue {
+		i = 1
+	}
+	if l.orders[i] == nil {
+		l.orders[i] = l.newQueue()
+	}
+	return l.orders[i]
+}
@@ -0,0 +1,154 @@
+package maxconnections
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQueues(t *testing.T) {
+	base := time.Unix(0, 0)
+	requests := []*QueuedRequest{
+		{Key: "a", Deadline: base.Add(3 * time.Second)},
+		{Key: "b"},
+		{Key: "c", Deadline: base.Add(1 * time.Second)},
+		{Key: "d", Deadline: base.Add(2 * time.Second)},
+		{Key: "e"},
+	}
+	testCases := []struct {
+		name     string
+		queue    Queue
+		expected string
+	}{
+		{"fifo", NewFIFOQueue(), "acde"},
+		{"lifo", NewLIFOQueue(), "edca"},
+		{"edf", NewEDFQueue(), "cdae"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, r := range requests {
+				tc.queue.Push(r)
+			}
+			// A canceled request leaves the queue.
+			tc.queue.Remove(requests[1])
+			if n := tc.queue.Len(); n != 4 {
+				t.Fatalf("Len() = %d, want 4", n)
+			}
+			order := ""
+			for r := tc.queue.Peek(); r != nil; r = tc.queue.Peek() {
+				order += r.Key
+				tc.queue.Remove(r)
+			}
+			if order != tc.expected {
+				t.Fatalf("order = %s, want %s", order, tc.expected)
+			}
+		})
+	}
+}
+
+// priorityQueue admits requests with the highest priority first.
+type priorityQueue struct {
+	requests []*QueuedRequest
+}
+
+type priorityKey struct{}
+
+func (q *priorityQueue) Push(r *QueuedRequest) {
+	q.requests = append(q.requests, r)
+}
+
+func (q *priorityQueue) Peek() *QueuedRequest {
+	var best *QueuedRequest
+	for _, r := range q.requests {
+		if best == nil || r.Context.Value(priorityKey{}).(int) > best.Context.Value(priorityKey{}).(int) {
+			best = r
+		}
+	}
+	return best
+}
+
+func (q *priorityQueue) Remove(r *QueuedRequest) {
+	for i, x := range q.requests {
+		if x == r {
+			q.requests = append(q.requests[:i], q.requests[i+1:]...)
+			return
+		}
+	}
+}
+
+func (q *priorityQueue) Len() int {
+	return len(q.requests)
+}
+
+func TestNewQueue(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	h := New(1, 5, nil)
+	h.NewQueue = func() Queue { return &priorityQueue{} }
+
+	if _, err := h.enqueueRunning(context.Background(), 1, ""); err != nil {
+		t.Fatalf("enqueueRunning() = %v, want nil", err)
+	}
+	admitted := make(chan int)
+	for i, priority := range []int{1, 3, 2} {
+		priority := priority
+		go func() {
+			ctx := context.WithValue(context.Background(), priorityKey{}, priority)
+			if _, err := h.enqueueRunning(ctx, 1, ""); err != nil {
+				t.Errorf("enqueueRunning() = %v, want nil", err)
+			}
+			admitted <- priority
+		}()
+		waitQueued(t, h, i+1, timeout)
+	}
+
+	for _, expected := range []int{3, 2, 1} {
+		h.releaseRunning(1)
+		select {
+		case priority := <-admitted:
+			if priority != expected {
+				t.Fatalf("admitted priority %d, want %d", priority, expected)
+			}
+		case <-time.After(timeout):
+			t.Fatal("timeout while waiting for a request")
+		}
+	}
+	if n := h.orders[0].Len(); n != 0 {
+		t.Fatalf("queue length = %d, want 0", n)
+	}
+}
+
+func TestEDFQueueHopeless(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	// The EarliestDeadline discipline and NewEDFQueue behave the same.
+	for _, newQueue := range []func() Queue{nil, NewEDFQueue} {
+		h := New(1, 5, nil)
+		h.QueueDiscipline = EarliestDeadline
+		h.NewQueue = newQueue
+		h.EstimateQueueWait = true
+		h.serviceTime.observe(time.Hour)
+
+		if _, err := h.enqueueRunning(context.Background(), 1, ""); err != nil {
+			t.Fatalf("enqueueRunning() = %v, want nil", err)
+		}
+		done := make(chan error)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			_, err := h.enqueueRunning(ctx, 1, "")
+			done <- err
+		}()
+		waitQueued(t, h, 1, timeout)
+
+		h.releaseRunning(1)
+		select {
+		case err := <-done:
+			if err != ErrOverloaded {
+				t.Fatalf("enqueueRunning() = %v for a hopeless request, want %v", err, ErrOverloaded)
+			}
+		case <-time.After(timeout):
+			t.Fatal("timeout while waiting for the request")
+		}
+	}
+}
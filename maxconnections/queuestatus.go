@@ -0,0 +1,103 @@
+package maxconnections
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// QueueStatus describes the place of a request in the queue.
+type QueueStatus struct {
+	// Position is the 1-based position of the request in the queue, the
+	// request at position 1 is admitted next. It is 0 if the request
+	// hasn't been queued, e.g. because the queue is full.
+	Position int
+
+	// Length is the number of queued requests.
+	Length int
+
+	// EstimatedWait is the estimated time until the request is admitted,
+	// or, if the request hasn't been queued, until the queue is drained.
+	// It is zero if there is no estimate, see Limiter.EstimateQueueWait.
+	EstimatedWait time.Duration
+}
+
+type queueStatusKey struct{}
+
+// QueueStatusFromContext returns the queue status of the request. For an
+// admitted request it is the status at the time the request was queued, for
+// a rejected request it is the status at the time of the rejection, so that
+// OverloadHandler can tell the client how busy the server is. It returns
+// false if the request hasn't met the queue.
+func QueueStatusFromContext(ctx context.Context) (QueueStatus, bool) {
+	status, ok := ctx.Value(queueStatusKey{}).(QueueStatus)
+	return status, ok
+}
+
+// queueProgress is a callback for requests that are waiting in the queue.
+type queueProgress struct {
+	interval time.Duration
+	report   func(QueueStatus)
+}
+
+type queueProgressKey struct{}
+
+// withQueueProgress returns a copy of ctx that makes the limiter call report
+// every interval while the request is in the queue.
+func withQueueProgress(ctx context.Context, interval time.Duration, report func(QueueStatus)) context.Context {
+	return context.WithValue(ctx, queueProgressKey{}, &queueProgress{interval: interval, report: report})
+}
+
+// queueStatus returns the status of the waiter e in the queue q. It should be
+// called with mu held.
+func (l *Limiter) queueStatus(q *list.List, e *list.Element) QueueStatus {
+	status := QueueStatus{Length: l.waiting()}
+	units := 0
+	if q == &l.lowQueue {
+		// Deprioritized requests wait for all normal ones.
+		status.Position = l.queue.Len()
+		for f := l.queue.Front(); f != nil; f = f.Next() {
+			units += f.Value.(*waiter).n
+		}
+	}
+	for f := q.Front(); f != nil; f = f.Next() {
+		status.Position++
+		units += f.Value.(*waiter).n
+		if f == e {
+			break
+		}
+	}
+	status.EstimatedWait, _ = l.waitFor(units)
+	return status
+}
+
+// rejectedStatus returns the status for a request that hasn't been queued.
+// It should be called with mu held.
+func (l *Limiter) rejectedStatus() QueueStatus {
+	wait, _ := l.waitFor(l.queuedCost)
+	return QueueStatus{Length: l.waiting(), EstimatedWait: wait}
+}
+
+// setQueueStatusHeaders sets the headers with the queue status.
+func (m *Middleware) setQueueStatusHeaders(h http.Header, status QueueStatus) {
+	if m.QueuePositionHeader != "" {
+		h.Set(m.QueuePositionHeader, strconv.Itoa(status.Position))
+	}
+	if m.QueueEstimateHeader != "" && status.EstimatedWait > 0 {
+		h.Set(m.QueueEstimateHeader, strconv.FormatInt(int64(status.EstimatedWait/time.Millisecond), 10))
+	}
+}
+
+// withQueueProgressHints makes the request send 103 Early Hints responses
+// with its queue status while it is waiting in the queue.
+func (m *Middleware) withQueueProgressHints(w http.ResponseWriter, r *http.Request) *http.Request {
+	if m.QueueProgressInterval <= 0 || !r.ProtoAtLeast(1, 1) {
+		return r
+	}
+	return r.WithContext(withQueueProgress(r.Context(), m.QueueProgressInterval, func(status QueueStatus) {
+		m.setQueueStatusHeaders(w.Header(), status)
+		w.WriteHeader(http.StatusEarlyHints)
+	}))
+}
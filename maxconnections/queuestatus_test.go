@@ -0,0 +1,101 @@
+package maxconnections
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hintsRecorder records the position headers of informational responses.
+type hintsRecorder struct {
+	*httptest.ResponseRecorder
+	mu    sync.Mutex
+	hints []string
+}
+
+func (rec *hintsRecorder) WriteHeader(status int) {
+	if status == http.StatusEarlyHints {
+		rec.mu.Lock()
+		rec.hints = append(rec.hints, rec.Header().Get("X-Queue-Position"))
+		rec.mu.Unlock()
+		return
+	}
+	rec.ResponseRecorder.WriteHeader(status)
+}
+
+func TestQueueStatus(t *testing.T) {
+	release := make(chan struct{})
+	m := New(1, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			<-release
+		}
+	}))
+	m.QueuePositionHeader = "X-Queue-Position"
+	m.QueueProgressInterval = 5 * time.Millisecond
+	var rejected QueueStatus
+	m.OverloadHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rejected, _ = QueueStatusFromContext(r.Context())
+		OverloadHandler.ServeHTTP(w, r)
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/block", nil))
+	}()
+	waitRunning(t, m, 1, time.Second)
+
+	queued := &hintsRecorder{ResponseRecorder: httptest.NewRecorder()}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.ServeHTTP(queued, httptest.NewRequest("GET", "/", nil))
+	}()
+	waitQueued(t, m, 1, time.Second)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the request to be rejected", rec.Code)
+	}
+	if rejected.Position != 0 || rejected.Length != 1 || rec.Header().Get("X-Queue-Position") != "0" {
+		t.Fatalf("status of a rejected request = %+v, header = %q", rejected, rec.Header().Get("X-Queue-Position"))
+	}
+
+	// Let the queued request get a few progress hints.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	queued.mu.Lock()
+	hints := queued.hints
+	queued.mu.Unlock()
+	if len(hints) == 0 || hints[0] != "1" {
+		t.Fatalf("hints = %q, want position 1", hints)
+	}
+	if queued.Code != http.StatusOK || queued.Header().Get("X-Queue-Position") != "1" {
+		t.Fatalf("admitted request: status = %d, position = %q", queued.Code, queued.Header().Get("X-Queue-Position"))
+	}
+}
+
+func TestEstimatedWait(t *testing.T) {
+	l := NewLimiter(2, 10)
+	l.EstimateQueueWait = true
+	l.serviceTime.observe(100 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		l.queue.PushBack(&waiter{n: 1})
+	}
+	l.lowQueue.PushBack(&waiter{n: 2})
+	l.queuedCost = 5
+
+	status := l.queueStatus(&l.lowQueue, l.lowQueue.Front())
+	if status.Position != 4 || status.Length != 4 || status.EstimatedWait != 250*time.Millisecond {
+		t.Fatalf("status = %+v, want position 4 of 4 after 250ms", status)
+	}
+	status = l.queueStatus(&l.queue, l.queue.Front().Next())
+	if status.Position != 2 || status.EstimatedWait != 100*time.Millisecond {
+		t.Fatalf("status = %+v, want position 2 after 100ms", status)
+	}
+}
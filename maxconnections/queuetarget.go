@@ -0,0 +1,32 @@
+package maxconnections
+
+// queueCapacity returns the number of requests that can wait in the queue,
+// see TargetQueueWait. It should be called with mu held.
+func (l *Limiter) queueCapacity() int {
+	if l.TargetQueueWait <= 0 {
+		return l.maxInQueue
+	}
+	serviceTime, ok := l.serviceTime.average()
+	if !ok || serviceTime <= 0 {
+		return l.maxInQueue
+	}
+	// By Little's law, the running units serve maxRunning/serviceTime
+	// requests per unit of time, so the queue drains within the target if
+	// it holds target*maxRunning/serviceTime requests.
+	n := int(float64(l.TargetQueueWait) * float64(l.effectiveMaxRunning()) / float64(serviceTime))
+	if n > l.maxInQueue {
+		n = l.maxInQueue
+	}
+	if n < l.MinInQueue {
+		n = l.MinInQueue
+	}
+	return n
+}
+
+// EffectiveMaxInQueue returns the capacity of the queue derived from
+// TargetQueueWait, or maxInQueue if the target is not set.
+func (l *Limiter) EffectiveMaxInQueue() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.queueCapacity()
+}
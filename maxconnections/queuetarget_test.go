@@ -0,0 +1,66 @@
+package maxconnections
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTargetQueueWait(t *testing.T) {
+	l := NewLimiter(2, 100)
+	l.TargetQueueWait = 500 * time.Millisecond
+	l.MinInQueue = 2
+
+	if n := l.EffectiveMaxInQueue(); n != 100 {
+		t.Fatalf("EffectiveMaxInQueue() = %d without service times, want 100", n)
+	}
+
+	// 2 units serve 20 requests per second, 10 of them in 500ms.
+	l.serviceTime.observe(100 * time.Millisecond)
+	if n := l.EffectiveMaxInQueue(); n != 10 {
+		t.Fatalf("EffectiveMaxInQueue() = %d, want 10", n)
+	}
+	if stats := l.Stats(); stats.EffectiveMaxInQueue != 10 || stats.MaxInQueue != 100 {
+		t.Fatalf("stats = %+v, want the effective capacity of 10", stats)
+	}
+
+	// Handlers have become slow, the queue shrinks to MinInQueue.
+	l.serviceTime = estimator{}
+	l.serviceTime.observe(10 * time.Second)
+	if n := l.EffectiveMaxInQueue(); n != 2 {
+		t.Fatalf("EffectiveMaxInQueue() = %d, want the minimum of 2", n)
+	}
+
+	// Handlers have become fast, the queue grows up to maxInQueue.
+	l.serviceTime = estimator{}
+	l.serviceTime.observe(time.Millisecond)
+	if n := l.EffectiveMaxInQueue(); n != 100 {
+		t.Fatalf("EffectiveMaxInQueue() = %d, want the maximum of 100", n)
+	}
+}
+
+func TestTargetQueueWaitRejects(t *testing.T) {
+	l := NewLimiter(1, 100)
+	l.TargetQueueWait = 100 * time.Millisecond
+	l.serviceTime.observe(100 * time.Millisecond)
+
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.Acquire(ctx)
+	deadline := time.Now().Add(time.Second)
+	for l.Stats().Queued != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the request hasn't been queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := l.Acquire(context.Background()); err != ErrOverloaded {
+		t.Fatalf("Acquire() = %v, want the queue of 1 request to be full", err)
+	}
+}
@@ -0,0 +1,227 @@
+// Package redisbackend implements a maxconnections.Backend that shares a
+// limit of running units between processes using Redis.
+//
+// Every acquired lease is a member of a sorted set scored by its expiration
+// time. Leases are renewed while they are held, so leases of crashed
+// processes expire after TTL and their units become available again.
+package redisbackend
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+// Client is the subset of a Redis client used by Backend. For example, a
+// go-redis client can be adapted as
+//
+//	redisbackend.EvalFunc(func(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+//		return rdb.Eval(ctx, script, keys, args...).Result()
+//	})
+type Client interface {
+	// Eval runs a Lua script and returns its result.
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+// EvalFunc is an adapter to allow the use of ordinary functions as Client.
+type EvalFunc func(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+
+// Eval calls f(ctx, script, keys, args...).
+func (f EvalFunc) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	return f(ctx, script, keys, args...)
+}
+
+// The scripts use two keys: KEYS[1] is a sorted set of lease IDs scored by
+// their expiration time in milliseconds, KEYS[2] is a hash with the number of
+// units of each lease.
+const (
+	expireLeases = `
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local expired = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', now)
+for _, id in ipairs(expired) do
+	redis.call('HDEL', KEYS[2], id)
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+`
+
+	acquireScript = expireLeases + `
+local limit, n, ttl, id = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), ARGV[4]
+local used = 0
+for _, units in ipairs(redis.call('HVALS', KEYS[2])) do
+	used = used + tonumber(units)
+end
+if used + n > limit then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now + ttl, id)
+redis.call('HSET', KEYS[2], id, n)
+redis.call('PEXPIRE', KEYS[1], ttl)
+redis.call('PEXPIRE', KEYS[2], ttl)
+return 1
+`
+
+	renewScript = expireLeases + `
+local ttl, id = tonumber(ARGV[1]), ARGV[2]
+if not redis.call('ZSCORE', KEYS[1], id) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now + ttl, id)
+redis.call('PEXPIRE', KEYS[1], ttl)
+redis.call('PEXPIRE', KEYS[2], ttl)
+return 1
+`
+
+	releaseScript = `
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+return 1
+`
+)
+
+// defaultTTL is the default value of TTL.
+const defaultTTL = 10 * time.Second
+
+// Backend implements the maxconnections.Backend interface.
+type Backend struct {
+	client Client
+	key    string
+	limit  int
+
+	// TTL is the lifetime of a lease that isn't renewed. Leases are renewed
+	// every TTL/3 while they are held. If it is not positive, defaultTTL is
+	// used.
+	TTL time.Duration
+
+	// OnError, if not nil, is called when a lease cannot be renewed or
+	// released.
+	OnError func(err error)
+}
+
+var _ maxconnections.Backend = (*Backend)(nil)
+
+// New returns a Backend that allows up to limit units to be leased at the
+// same time from all processes that use the same key.
+func New(client Client, key string, limit int) *Backend {
+	return &Backend{
+		client: client,
+		key:    key,
+		limit:  limit,
+		TTL:    defaultTTL,
+	}
+}
+
+func (b *Backend) keys() []string {
+	return []string{b.key, b.key + ":units"}
+}
+
+func (b *Backend) ttl() time.Duration {
+	if b.TTL <= 0 {
+		return defaultTTL
+	}
+	return b.TTL
+}
+
+func (b *Backend) ttlMillis() int64 {
+	return int64(b.ttl() / time.Millisecond)
+}
+
+func newLeaseID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func isOne(res interface{}) (bool, error) {
+	switch v := res.(type) {
+	case int64:
+		return v == 1, nil
+	case int:
+		return v == 1, nil
+	}
+	return false, fmt.Errorf("redisbackend: unexpected script result %v (%T)", res, res)
+}
+
+// TryAcquire implements maxconnections.Backend.
+func (b *Backend) TryAcquire(ctx context.Context, n int) (maxconnections.Lease, error) {
+	id, err := newLeaseID()
+	if err != nil {
+		return nil, err
+	}
+	res, err := b.client.Eval(ctx, acquireScript, b.keys(), b.limit, n, b.ttlMillis(), id)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := isOne(res)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	l := &lease{
+		b:    b,
+		id:   id,
+		stop: make(chan struct{}),
+	}
+	go l.renew()
+	return l, nil
+}
+
+func (b *Backend) error(err error) {
+	if b.OnError != nil {
+		b.OnError(err)
+	}
+}
+
+type lease struct {
+	b    *Backend
+	id   string
+	once sync.Once
+	stop chan struct{}
+}
+
+func (l *lease) renew() {
+	interval := l.b.ttl() / 3
+	if interval <= 0 {
+		interval = l.b.ttl()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.stop:
+			return
+		}
+		res, err := l.b.client.Eval(context.Background(), renewScript, l.b.keys(), l.b.ttlMillis(), l.id)
+		if err != nil {
+			l.b.error(err)
+			continue
+		}
+		if ok, err := isOne(res); err != nil || !ok {
+			if err == nil {
+				err = fmt.Errorf("redisbackend: lease %s has expired", l.id)
+			}
+			l.b.error(err)
+			return
+		}
+	}
+}
+
+func (l *lease) Release(ctx context.Context) error {
+	var err error
+	l.once.Do(func() {
+		close(l.stop)
+		_, err = l.b.client.Eval(ctx, releaseScript, l.b.keys(), l.id)
+		if err != nil {
+			l.b.error(err)
+		}
+	})
+	return err
+}
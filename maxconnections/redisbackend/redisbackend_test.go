@@ -0,0 +1,151 @@
+package redisbackend
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis emulates the scripts of Backend.
+type fakeRedis struct {
+	mu     sync.Mutex
+	now    time.Time
+	leases map[string]fakeLease
+	renews int
+}
+
+type fakeLease struct {
+	units   int
+	expires time.Time
+}
+
+func (f *fakeRedis) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for id, l := range f.leases {
+		if !l.expires.After(f.now) {
+			delete(f.leases, id)
+		}
+	}
+
+	switch script {
+	case acquireScript:
+		limit, n, ttl, id := args[0].(int), args[1].(int), args[2].(int64), args[3].(string)
+		used := 0
+		for _, l := range f.leases {
+			used += l.units
+		}
+		if used+n > limit {
+			return int64(0), nil
+		}
+		f.leases[id] = fakeLease{units: n, expires: f.now.Add(time.Duration(ttl) * time.Millisecond)}
+		return int64(1), nil
+	case renewScript:
+		ttl, id := args[0].(int64), args[1].(string)
+		l, ok := f.leases[id]
+		if !ok {
+			return int64(0), nil
+		}
+		l.expires = f.now.Add(time.Duration(ttl) * time.Millisecond)
+		f.leases[id] = l
+		f.renews++
+		return int64(1), nil
+	case releaseScript:
+		delete(f.leases, args[0].(string))
+		return int64(1), nil
+	}
+	panic("unexpected script")
+}
+
+func (f *fakeRedis) advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func TestBackend(t *testing.T) {
+	redis := &fakeRedis{now: time.Unix(0, 0), leases: make(map[string]fakeLease)}
+	b := New(redis, "limit", 3)
+	b.TTL = time.Hour // renewals are tested separately
+
+	ctx := context.Background()
+	l1, err := b.TryAcquire(ctx, 2)
+	if err != nil || l1 == nil {
+		t.Fatalf("TryAcquire(2) = %v, %v; want a lease", l1, err)
+	}
+	if l, err := b.TryAcquire(ctx, 2); err != nil || l != nil {
+		t.Fatalf("TryAcquire(2) = %v, %v; want no lease", l, err)
+	}
+	l2, err := b.TryAcquire(ctx, 1)
+	if err != nil || l2 == nil {
+		t.Fatalf("TryAcquire(1) = %v, %v; want a lease", l2, err)
+	}
+
+	if err := l1.Release(ctx); err != nil {
+		t.Fatalf("Release() = %v", err)
+	}
+	if err := l1.Release(ctx); err != nil {
+		t.Fatalf("second Release() = %v", err)
+	}
+	l3, err := b.TryAcquire(ctx, 2)
+	if err != nil || l3 == nil {
+		t.Fatalf("TryAcquire(2) after Release = %v, %v; want a lease", l3, err)
+	}
+
+	// Leases of crashed processes expire.
+	redis.advance(2 * time.Hour)
+	l4, err := b.TryAcquire(ctx, 3)
+	if err != nil || l4 == nil {
+		t.Fatalf("TryAcquire(3) after expiration = %v, %v; want a lease", l4, err)
+	}
+
+	for _, l := range []interface{ Release(context.Context) error }{l2, l3, l4} {
+		l.Release(ctx)
+	}
+}
+
+func TestRenew(t *testing.T) {
+	redis := &fakeRedis{now: time.Unix(0, 0), leases: make(map[string]fakeLease)}
+	b := New(redis, "limit", 1)
+	b.TTL = 3 * time.Millisecond
+
+	l, err := b.TryAcquire(context.Background(), 1)
+	if err != nil || l == nil {
+		t.Fatalf("TryAcquire(1) = %v, %v; want a lease", l, err)
+	}
+	defer l.Release(context.Background())
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		redis.mu.Lock()
+		renews := redis.renews
+		redis.mu.Unlock()
+		if renews >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout while waiting for the lease to be renewed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestZeroTTL(t *testing.T) {
+	redis := &fakeRedis{now: time.Unix(0, 0), leases: make(map[string]fakeLease)}
+	b := New(redis, "limit", 1)
+	b.TTL = 0
+
+	l, err := b.TryAcquire(context.Background(), 1)
+	if err != nil || l == nil {
+		t.Fatalf("TryAcquire(1) = %v, %v; want a lease", l, err)
+	}
+	defer l.Release(context.Background())
+
+	// The lease lives for the default TTL rather than expiring at once.
+	redis.advance(defaultTTL / 2)
+	if l, err := b.TryAcquire(context.Background(), 1); err != nil || l != nil {
+		t.Fatalf("TryAcquire(1) = %v, %v; want no lease", l, err)
+	}
+}
@@ -0,0 +1,218 @@
+package maxconnections
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// registryShards is the maximum number of shards of a Registry.
+const registryShards = 16
+
+// registryEntry is a tracked limiter.
+type registryEntry struct {
+	key string
+	l   *Limiter
+
+	// refs is the number of callers that have got the limiter from Get and
+	// have not released it yet. Such limiters are never evicted.
+	refs int
+
+	// used is the last time the limiter was got or released.
+	used time.Time
+}
+
+// registryShard is a part of the keys of a Registry.
+type registryShard struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List // front is the most recently used
+}
+
+// Registry tracks a limiter for each key, e.g. for each client address. The
+// number of tracked keys is bounded: when a new key arrives and there is no
+// room for it, the least recently used limiter that is idle is evicted.
+// Limiters that have running or queued requests are never evicted, so a
+// client can't escape its limit by making other keys arrive.
+type Registry struct {
+	// IdleTimeout, if positive, is the period after which idle limiters
+	// that haven't been used are removed even if there is room for them,
+	// so that the state of keys that are gone, e.g. of expired sessions,
+	// doesn't outlive them. Limiters are removed when a key of their shard
+	// is requested. It should be set before the registry is used.
+	IdleTimeout time.Duration
+
+	newLimiter  func(key string) *Limiter
+	shards      []registryShard
+	maxPerShard int
+
+	closed  int32
+	evicted int64
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// NewRegistry returns a Registry that tracks approximately up to maxKeys
+// keys. Limiters for new keys are created by newLimiter.
+func NewRegistry(maxKeys int, newLimiter func(key string) *Limiter) *Registry {
+	if maxKeys < 1 {
+		maxKeys = 1
+	}
+	n := registryShards
+	if maxKeys < n {
+		n = maxKeys
+	}
+	r := &Registry{
+		newLimiter:  newLimiter,
+		shards:      make([]registryShard, n),
+		maxPerShard: (maxKeys + n - 1) / n,
+		now:         time.Now,
+	}
+	for i := range r.shards {
+		r.shards[i].entries = make(map[string]*list.Element)
+	}
+	return r
+}
+
+// shard returns the shard for key.
+func (r *Registry) shard(key string) *registryShard {
+	// FNV-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &r.shards[h%uint32(len(r.shards))]
+}
+
+// Get returns the limiter for key. The limiter is not evicted until release
+// is called, release must be called exactly once. If there is no room for a
+// new key because all tracked limiters are busy, Get returns ErrOverloaded.
+// After Shutdown, Get returns ErrShutdown.
+func (r *Registry) Get(key string) (l *Limiter, release func(), err error) {
+	s := r.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// closed is checked under the shard lock, so Shutdown sees all limiters
+	// that are created before it visits the shard.
+	if atomic.LoadInt32(&r.closed) != 0 {
+		return nil, nil, ErrShutdown
+	}
+	now := r.now()
+	if r.IdleTimeout > 0 {
+		r.expire(s, now)
+	}
+	el, ok := s.entries[key]
+	if ok {
+		s.lru.MoveToFront(el)
+	} else {
+		if s.lru.Len() >= r.maxPerShard && !r.evict(s) {
+			return nil, nil, ErrOverloaded
+		}
+		el = s.lru.PushFront(&registryEntry{key: key, l: r.newLimiter(key)})
+		s.entries[key] = el
+	}
+	e := el.Value.(*registryEntry)
+	e.refs++
+	e.used = now
+	return e.l, func() {
+		now := r.now()
+		s.mu.Lock()
+		e.refs--
+		e.used = now
+		s.mu.Unlock()
+	}, nil
+}
+
+// each calls f for every tracked limiter.
+func (r *Registry) each(f func(key string, l *Limiter)) {
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mu.Lock()
+		entries := make([]*registryEntry, 0, s.lru.Len())
+		for el := s.lru.Front(); el != nil; el = el.Next() {
+			entries = append(entries, el.Value.(*registryEntry))
+		}
+		s.mu.Unlock()
+		for _, e := range entries {
+			f(e.key, e.l)
+		}
+	}
+}
+
+// expire removes from s the idle limiters that haven't been used for
+// IdleTimeout. It should be called with s.mu held.
+func (r *Registry) expire(s *registryShard, now time.Time) {
+	for el := s.lru.Back(); el != nil; {
+		e := el.Value.(*registryEntry)
+		if now.Sub(e.used) < r.IdleTimeout {
+			// The rest of the limiters have been got later.
+			return
+		}
+		prev := el.Prev()
+		if e.refs == 0 && e.l.isIdle() {
+			s.lru.Remove(el)
+			delete(s.entries, e.key)
+			atomic.AddInt64(&r.evicted, 1)
+		}
+		el = prev
+	}
+}
+
+// evict removes the least recently used idle limiter from s. It reports
+// whether a limiter has been removed. It should be called with s.mu held.
+func (r *Registry) evict(s *registryShard) bool {
+	for el := s.lru.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*registryEntry)
+		if e.refs > 0 || !e.l.isIdle() {
+			continue
+		}
+		s.lru.Remove(el)
+		delete(s.entries, e.key)
+		atomic.AddInt64(&r.evicted, 1)
+		return true
+	}
+	return false
+}
+
+// Len returns the number of tracked keys.
+func (r *Registry) Len() int {
+	n := 0
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mu.Lock()
+		n += s.lru.Len()
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Evicted returns the number of limiters that have been evicted.
+func (r *Registry) Evicted() int64 {
+	return atomic.LoadInt64(&r.evicted)
+}
+
+// Shutdown shuts down all tracked limiters and waits for their admitted
+// requests to finish, see Limiter.Shutdown.
+func (r *Registry) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&r.closed, 1)
+	var limiters []*Limiter
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mu.Lock()
+		for el := s.lru.Front(); el != nil; el = el.Next() {
+			limiters = append(limiters, el.Value.(*registryEntry).l)
+		}
+		s.mu.Unlock()
+	}
+	var err error
+	for _, l := range limiters {
+		if e := l.Shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,148 @@
+package maxconnections
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	created := 0
+	reg := NewRegistry(2, func(key string) *Limiter {
+		created++
+		return NewLimiter(1, 0)
+	})
+	if n := len(reg.shards); n != 2 {
+		t.Fatalf("shards = %d, want 2", n)
+	}
+
+	// Find two keys for each shard.
+	keys := map[*registryShard][]string{}
+	for i := 0; len(keys[&reg.shards[0]]) < 2 || len(keys[&reg.shards[1]]) < 2; i++ {
+		key := fmt.Sprintf("10.0.0.%d", i)
+		s := reg.shard(key)
+		keys[s] = append(keys[s], key)
+	}
+	a, b := keys[&reg.shards[0]][0], keys[&reg.shards[0]][1]
+
+	la, releaseA, err := reg.Get(a)
+	if err != nil {
+		t.Fatalf("Get(%q) = %v, want nil", a, err)
+	}
+	if l, release, _ := reg.Get(a); l != la {
+		t.Fatalf("Get(%q) returned a new limiter for a tracked key", a)
+	} else {
+		release()
+	}
+
+	// a is pinned, there is no room for b.
+	if _, _, err := reg.Get(b); err != ErrOverloaded {
+		t.Fatalf("Get(%q) = %v, want %v", b, err, ErrOverloaded)
+	}
+
+	// a is released, but it is still running a request.
+	releaseLimiter, err := la.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseA()
+	if _, _, err := reg.Get(b); err != ErrOverloaded {
+		t.Fatalf("Get(%q) = %v, want %v", b, err, ErrOverloaded)
+	}
+
+	// a is idle and can be evicted.
+	releaseLimiter()
+	lb, releaseB, err := reg.Get(b)
+	if err != nil {
+		t.Fatalf("Get(%q) = %v, want nil", b, err)
+	}
+	releaseB()
+	if lb == la {
+		t.Fatalf("Get(%q) returned the limiter of %q", b, a)
+	}
+	if n := reg.Evicted(); n != 1 {
+		t.Fatalf("Evicted() = %d, want 1", n)
+	}
+	if n := reg.Len(); n != 1 {
+		t.Fatalf("Len() = %d, want 1", n)
+	}
+
+	// Keys of the other shard don't evict b.
+	for _, key := range keys[&reg.shards[1]] {
+		_, release, err := reg.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%q) = %v, want nil", key, err)
+		}
+		release()
+	}
+	if n := reg.Len(); n != 2 {
+		t.Fatalf("Len() = %d, want 2", n)
+	}
+	if created != 4 {
+		t.Fatalf("created = %d, want 4", created)
+	}
+
+	if err := reg.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := reg.Get(b); err != ErrShutdown {
+		t.Fatalf("Get(%q) = %v, want %v", b, err, ErrShutdown)
+	}
+	if _, err := lb.Acquire(context.Background()); err != ErrShutdown {
+		t.Fatalf("Acquire() = %v, want %v", err, ErrShutdown)
+	}
+}
+
+func TestRegistryIdleTimeout(t *testing.T) {
+	now := time.Unix(0, 0)
+	reg := NewRegistry(100, func(key string) *Limiter {
+		return NewLimiter(1, 0)
+	})
+	reg.IdleTimeout = time.Minute
+	reg.now = func() time.Time {
+		return now
+	}
+
+	// Limiters expire when their shard is used, so the keys are of one shard.
+	var keys []string
+	for i := 0; len(keys) < 4; i++ {
+		key := fmt.Sprintf("session-%d", i)
+		if reg.shard(key) == &reg.shards[0] {
+			keys = append(keys, key)
+		}
+	}
+	a, b, c, d := keys[0], keys[1], keys[2], keys[3]
+	get := func(key string) *Limiter {
+		l, release, err := reg.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%q) = %v, want nil", key, err)
+		}
+		release()
+		return l
+	}
+
+	la := get(a)
+	now = now.Add(30 * time.Second)
+	_, releaseB, _ := reg.Get(b)
+	now = now.Add(30 * time.Second)
+
+	// a has expired, b is pinned.
+	if l := get(a); l == la {
+		t.Fatalf("Get(a) returned the expired limiter")
+	}
+	now = now.Add(2 * time.Minute)
+	get(c)
+	if n := reg.Len(); n != 2 {
+		t.Fatalf("Len() = %d, want the pinned limiter and c", n)
+	}
+	releaseB()
+	now = now.Add(time.Minute)
+	get(d)
+	if n := reg.Len(); n != 1 {
+		t.Fatalf("Len() = %d, want the idle limiters to be removed", n)
+	}
+	if n := reg.Evicted(); n != 4 {
+		t.Fatalf("Evicted() = %d, want 4", n)
+	}
+}
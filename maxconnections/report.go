@@ -0,0 +1,158 @@
+package maxconnections
+
+import (
+	"sync"
+	"time"
+)
+
+// reportBuckets is the number of buckets into which ReportWindow is divided.
+const reportBuckets = 60
+
+// reportBucket counts the events of a part of ReportWindow.
+type reportBucket struct {
+	// index is the number of the period of the bucket since the Unix
+	// epoch, buckets of older periods are stale.
+	index     int64
+	arrivals  int64
+	rejected  int64
+	completed int64
+	busy      time.Duration
+}
+
+// reporter keeps the recent events of a limiter for Report.
+type reporter struct {
+	mu      sync.Mutex
+	buckets [reportBuckets]reportBucket
+	since   time.Time
+}
+
+// bucket returns the bucket for now, resetting it if it is stale. It should
+// be called with mu held.
+func (r *reporter) bucket(window time.Duration, now time.Time) *reportBucket {
+	if r.since.IsZero() {
+		r.since = now
+	}
+	index := now.UnixNano() / int64(bucketWidth(window))
+	b := &r.buckets[index%reportBuckets]
+	if b.index != index {
+		*b = reportBucket{index: index}
+	}
+	return b
+}
+
+// bucketWidth returns the period of a bucket.
+func bucketWidth(window time.Duration) time.Duration {
+	width := window / reportBuckets
+	if width <= 0 {
+		width = 1
+	}
+	return width
+}
+
+// arrival records a request that has arrived at now.
+func (r *reporter) arrival(window time.Duration, now time.Time, rejected bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.bucket(window, now)
+	b.arrivals++
+	if rejected {
+		b.rejected++
+	}
+}
+
+// completion records a request that has finished at now after it occupied n
+// running units for serviceTime.
+func (r *reporter) completion(window time.Duration, now time.Time, n int, serviceTime time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.bucket(window, now)
+	b.completed++
+	b.busy += time.Duration(n) * serviceTime
+}
+
+// Report describes the load of a limiter over a recent window, e.g. to be
+// fed to an autoscaler as external metrics, see Limiter.Report.
+type Report struct {
+	// Window is the period that the report covers. It is shorter than
+	// ReportWindow while the limiter is young.
+	Window time.Duration `json:"window"`
+
+	// ArrivalRate is the number of requests per second that have arrived,
+	// whether they have been admitted or not.
+	ArrivalRate float64 `json:"arrival_rate"`
+
+	// ServiceRate is the number of requests per second that have finished.
+	ServiceRate float64 `json:"service_rate"`
+
+	// Utilization is the fraction of the running units that have been
+	// busy, from 0 to 1. The time of a request is counted when it
+	// finishes, so long requests make it uneven.
+	Utilization float64 `json:"utilization"`
+
+	// RejectionRate is the fraction of the arrived requests that have been
+	// rejected because of overload.
+	RejectionRate float64 `json:"rejection_rate"`
+
+	// Running, MaxRunning and Queued are the current state of the limiter,
+	// see Stats.
+	Running    int `json:"running"`
+	MaxRunning int `json:"max_running"`
+	Queued     int `json:"queued"`
+}
+
+// Report returns the load of the limiter over the last ReportWindow. It
+// returns a zero report with the current state if ReportWindow is not set.
+func (l *Limiter) Report() Report {
+	l.mu.Lock()
+	report := Report{
+		Running:    l.runningUnits(),
+		MaxRunning: l.EffectiveMaxRunning(),
+		Queued:     l.waiting(),
+	}
+	l.mu.Unlock()
+	window := l.ReportWindow
+	if window <= 0 {
+		return report
+	}
+
+	now := l.now()
+	width := bucketWidth(window)
+	current := now.UnixNano() / int64(width)
+	var sum reportBucket
+	l.report.mu.Lock()
+	since := l.report.since
+	for _, b := range l.report.buckets {
+		if current-b.index < reportBuckets {
+			sum.arrivals += b.arrivals
+			sum.rejected += b.rejected
+			sum.completed += b.completed
+			sum.busy += b.busy
+		}
+	}
+	l.report.mu.Unlock()
+	if since.IsZero() {
+		return report
+	}
+
+	covered := window
+	if age := now.Sub(since); age < covered {
+		covered = age
+	}
+	if covered <= 0 {
+		return report
+	}
+	report.Window = covered
+	seconds := covered.Seconds()
+	report.ArrivalRate = float64(sum.arrivals) / seconds
+	report.ServiceRate = float64(sum.completed) / seconds
+	if report.MaxRunning > 0 {
+		report.Utilization = sum.busy.Seconds() / (seconds * float64(report.MaxRunning))
+		if report.Utilization > 1 {
+			report.Utilization = 1
+		}
+	}
+	if sum.arrivals > 0 {
+		report.RejectionRate = float64(sum.rejected) / float64(sum.arrivals)
+	}
+	return report
+}
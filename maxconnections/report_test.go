@@ -0,0 +1,65 @@
+package maxconnections
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestReport(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewLimiter(2, 0)
+	l.Clock = &testClock{now: func() time.Time {
+		return now
+	}}
+	l.ReportWindow = time.Minute
+
+	if report := l.Report(); report.Window != 0 || report.MaxRunning != 2 {
+		t.Fatalf("Report() = %+v, want an empty report", report)
+	}
+
+	// 4 requests arrive within 10 seconds, 2 of them run for 5 seconds
+	// each, 2 are rejected.
+	var releases []func()
+	for i := 0; i < 4; i++ {
+		release, err := l.Acquire(context.Background())
+		if i < 2 {
+			if err != nil {
+				t.Fatal(err)
+			}
+			releases = append(releases, release)
+		} else if err != ErrOverloaded {
+			t.Fatalf("request %d: Acquire() = %v, want %v", i, err, ErrOverloaded)
+		}
+	}
+	now = now.Add(5 * time.Second)
+	for _, release := range releases {
+		release()
+	}
+	now = now.Add(5 * time.Second)
+
+	report := l.Report()
+	expected := Report{
+		Window:        10 * time.Second,
+		ArrivalRate:   0.4,
+		ServiceRate:   0.2,
+		Utilization:   0.5,
+		RejectionRate: 0.5,
+		MaxRunning:    2,
+	}
+	near := func(a, b float64) bool {
+		return math.Abs(a-b) < 1e-9
+	}
+	if report.Window != expected.Window || !near(report.ArrivalRate, expected.ArrivalRate) || !near(report.ServiceRate, expected.ServiceRate) ||
+		!near(report.Utilization, expected.Utilization) || !near(report.RejectionRate, expected.RejectionRate) || report.MaxRunning != 2 {
+		t.Fatalf("Report() = %+v, want %+v", report, expected)
+	}
+
+	// The events leave the window.
+	now = now.Add(time.Minute)
+	report = l.Report()
+	if report.Window != time.Minute || report.ArrivalRate != 0 || report.Utilization != 0 {
+		t.Fatalf("Report() = %+v, want no recent events", report)
+	}
+}
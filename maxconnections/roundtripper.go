@@ -0,0 +1,114 @@
+package maxconnections
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// RoundTripper implements the http.RoundTripper interface. It limits the
+// number of outbound requests that are in flight at the same time.
+type RoundTripper struct {
+	// Limiter does the accounting of outbound requests. Its options such
+	// as MaxWaitInQueue, Cost, Backend, Skip and Select apply to the
+	// outbound requests, its handlers are not used.
+	Limiter *Middleware
+
+	next http.RoundTripper
+
+	// SynthesizeResponse makes RoundTrip return a 503 response instead of an
+	// error when the request is rejected.
+	SynthesizeResponse bool
+
+	// PropagationHeaders makes RoundTrip set CriticalityHeader and
+	// TimeoutHeader of outbound requests according to their criticality and
+	// context deadline, so that the upstream prioritizes them as this
+	// process does, see Middleware.PropagationHeaders.
+	PropagationHeaders bool
+}
+
+// NewRoundTripper returns a RoundTripper that sends no more than maxRunning
+// requests through next at the same time. It can enqueue up to maxInQueue
+// requests, other requests are rejected with ErrOverloaded. If next is nil,
+// http.DefaultTransport is used.
+//
+// A request occupies its running units until its response body is closed.
+func NewRoundTripper(maxRunning, maxInQueue int, next http.RoundTripper) *RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &RoundTripper{
+		Limiter: New(maxRunning, maxInQueue, nil),
+		next:    next,
+	}
+}
+
+// releaseBody releases the running units of the request when the response
+// body is closed.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// rejected returns the result of RoundTrip for req that is rejected with
+// err. If synthesize is true, it is a 503 response instead of an error.
+func rejected(req *http.Request, err error, synthesize bool) (*http.Response, error) {
+	if err == ErrCanceled {
+		// Nobody is waiting for a synthesized response.
+		return nil, req.Context().Err()
+	}
+	if !synthesize {
+		return nil, err
+	}
+	body := "503 " + err.Error()
+	return &http.Response{
+		Status:        "503 Service Unavailable",
+		StatusCode:    http.StatusServiceUnavailable,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	l := t.Limiter.limiter(req)
+	if l == nil {
+		return t.next.RoundTrip(req)
+	}
+	a, err := t.Limiter.admit(req, l)
+	if err != nil {
+		return rejected(req, err, t.SynthesizeResponse)
+	}
+	if t.PropagationHeaders {
+		// RoundTrip must not modify the request.
+		req = req.Clone(req.Context())
+		SetPropagationHeaders(req.Context(), req.Header, a.criticality)
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.Limiter.done(a)
+		return nil, err
+	}
+	res.Body = &releaseBody{
+		ReadCloser: res.Body,
+		release: func() {
+			t.Limiter.done(a)
+		},
+	}
+	return res, nil
+}
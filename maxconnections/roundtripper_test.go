@@ -0,0 +1,76 @@
+package maxconnections
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRoundTripper(t *testing.T) {
+	const timeout = 1 * time.Second
+
+	rt := NewRoundTripper(1, 1, roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader("OK")),
+			Request:    req,
+		}, nil
+	}))
+
+	newRequest := func(ctx context.Context) *http.Request {
+		req, err := http.NewRequest("GET", "http://example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req.WithContext(ctx)
+	}
+
+	res, err := rt.RoundTrip(newRequest(context.Background()))
+	if err != nil {
+		t.Fatalf("RoundTrip() = %v, want nil", err)
+	}
+
+	// The first request is in flight until its body is closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := rt.RoundTrip(newRequest(ctx))
+		errs <- err
+	}()
+	waitQueued(t, rt.Limiter, 1, timeout)
+
+	if _, err := rt.RoundTrip(newRequest(context.Background())); err != ErrOverloaded {
+		t.Fatalf("RoundTrip() = %v, want %v", err, ErrOverloaded)
+	}
+	rt.SynthesizeResponse = true
+	synthesized, err := rt.RoundTrip(newRequest(context.Background()))
+	if err != nil || synthesized.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("RoundTrip() = %v, %v; want a 503 response", synthesized, err)
+	}
+	synthesized.Body.Close()
+	rt.SynthesizeResponse = false
+
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("RoundTrip() with a canceled context = %v, want %v", err, context.Canceled)
+	}
+
+	res.Body.Close()
+	res.Body.Close()
+	waitRunning(t, rt.Limiter, 0, timeout)
+
+	res, err = rt.RoundTrip(newRequest(context.Background()))
+	if err != nil {
+		t.Fatalf("RoundTrip() = %v, want nil", err)
+	}
+	res.Body.Close()
+}
@@ -0,0 +1,194 @@
+package maxconnections
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// route is a set of requests with their own limits.
+type route struct {
+	match func(r *http.Request) bool
+	m     *Middleware
+}
+
+// Router implements the http.Handler interface. It passes requests to the
+// handler through limiters selected by registered routes, requests that don't
+// match any route go through the default limiter.
+//
+// Routes can split requests by method, so that slow writes can't starve cheap
+// reads and vice versa, with a cap across both pools:
+//
+//	rt := maxconnections.NewRouter(20, 100, h) // writes
+//	rt.HandleFunc(maxconnections.IsSafeMethod, 100, 1000)
+//	rt.Total(100, 1000)
+type Router struct {
+	handler http.Handler
+	routes  []route
+	def     *Middleware
+
+	// total, if not nil, is the limiter that requests pass through after
+	// the limiter of their route.
+	total *Middleware
+
+	// Skip, if not nil, reports whether the request bypasses all limiters
+	// of the router, see Middleware.Skip.
+	Skip func(r *http.Request) bool
+}
+
+// NewRouter returns a Router for h. The default limiter runs no more than
+// maxRunning requests at the same time and can enqueue up to maxInQueue
+// requests. Routes should be registered before the router starts serving
+// requests.
+func NewRouter(maxRunning, maxInQueue int, h http.Handler) *Router {
+	return &Router{
+		handler: h,
+		def:     New(maxRunning, maxInQueue, h),
+	}
+}
+
+// Default returns the limiter for requests that don't match any route.
+func (rt *Router) Default() *Middleware {
+	return rt.def
+}
+
+// HandleFunc registers a limiter for requests for which match returns true.
+// Routes are matched in the order they are registered. The returned
+// Middleware can be used to configure the limiter.
+func (rt *Router) HandleFunc(match func(r *http.Request) bool, maxRunning, maxInQueue int) *Middleware {
+	m := New(maxRunning, maxInQueue, rt.next())
+	rt.routes = append(rt.routes, route{match: match, m: m})
+	return m
+}
+
+// next returns the handler that the limiters of routes pass requests to.
+func (rt *Router) next() http.Handler {
+	if rt.total != nil {
+		return rt.total
+	}
+	return rt.handler
+}
+
+// Total adds a limiter that all requests pass through after the limiter of
+// their route, so that the routes together run no more than maxRunning
+// requests at the same time and enqueue up to maxInQueue requests. A request
+// keeps its place in the limiter of its route while it waits for the total
+// limiter. The returned Middleware can be used to configure the limiter.
+func (rt *Router) Total(maxRunning, maxInQueue int) *Middleware {
+	rt.total = New(maxRunning, maxInQueue, rt.handler)
+	for _, route := range rt.routes {
+		route.m.handler = rt.total
+	}
+	rt.def.handler = rt.total
+	return rt.total
+}
+
+// IsSafeMethod reports whether r has a safe method, GET, HEAD, OPTIONS or
+// TRACE, that is, whether it is a read. It can be used as a route of Router.
+func IsSafeMethod(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// MatchMethods returns a matcher for requests with any of the methods.
+func MatchMethods(methods ...string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		for _, m := range methods {
+			if r.Method == m {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Handle registers a limiter for requests that match pattern, see
+// MatchPattern.
+func (rt *Router) Handle(pattern string, maxRunning, maxInQueue int) *Middleware {
+	return rt.HandleFunc(MatchPattern(pattern), maxRunning, maxInQueue)
+}
+
+// Limiter returns the limiter for r.
+func (rt *Router) Limiter(r *http.Request) *Middleware {
+	for _, route := range rt.routes {
+		if route.match(r) {
+			return route.m
+		}
+	}
+	return rt.def
+}
+
+// Shutdown shuts down all limiters and waits for their running handlers to
+// finish, see Middleware.Shutdown.
+func (rt *Router) Shutdown(ctx context.Context) error {
+	var err error
+	for _, route := range rt.routes {
+		if e := route.m.Shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	if e := rt.def.Shutdown(ctx); e != nil && err == nil {
+		err = e
+	}
+	if rt.total != nil {
+		if e := rt.total.Shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rt.Skip != nil && rt.Skip(r) {
+		rt.handler.ServeHTTP(w, r)
+		return
+	}
+	rt.Limiter(r).ServeHTTP(w, r)
+}
+
+// MatchPattern returns a matcher for pattern. The pattern has the form
+// "[METHOD ]PATH". If the method is present, only requests with that method
+// match. The path consists of segments separated by slashes. A segment
+// "{name}" or "*" matches any single segment, a final segment "{name...}"
+// matches the rest of the path. A path that ends with a slash matches all
+// paths with that prefix.
+func MatchPattern(pattern string) func(r *http.Request) bool {
+	method := ""
+	if i := strings.IndexAny(pattern, " \t"); i >= 0 {
+		method = pattern[:i]
+		pattern = strings.TrimLeft(pattern[i:], " \t")
+	}
+	prefix := strings.HasSuffix(pattern, "/")
+	segments := strings.Split(strings.Trim(pattern, "/"), "/")
+	if len(segments) == 1 && segments[0] == "" {
+		segments = nil
+	}
+
+	return func(r *http.Request) bool {
+		if method != "" && r.Method != method {
+			return false
+		}
+		path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(path) == 1 && path[0] == "" {
+			path = nil
+		}
+		for i, s := range segments {
+			if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "...}") {
+				return true
+			}
+			if i >= len(path) {
+				return false
+			}
+			if s == "*" || (strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}")) {
+				continue
+			}
+			if s != path[i] {
+				return false
+			}
+		}
+		return len(path) == len(segments) || prefix
+	}
+}
@@ -0,0 +1,127 @@
+package maxconnections
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		method  string
+		path    string
+		match   bool
+	}{
+		{"/", "GET", "/", true},
+		{"/", "GET", "/foo", true},
+		{"/foo", "GET", "/foo", true},
+		{"/foo", "GET", "/foo/bar", false},
+		{"/foo/", "GET", "/foo/bar", true},
+		{"/foo/", "GET", "/foobar", false},
+		{"/users/{id}", "GET", "/users/42", true},
+		{"/users/{id}", "GET", "/users/42/posts", false},
+		{"/users/*/posts", "GET", "/users/42/posts", true},
+		{"/files/{path...}", "GET", "/files/a/b/c", true},
+		{"POST /users", "POST", "/users", true},
+		{"POST /users", "GET", "/users", false},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if match := MatchPattern(tc.pattern)(r); match != tc.match {
+			t.Errorf("MatchPattern(%q) for %s %s = %v, want %v", tc.pattern, tc.method, tc.path, match, tc.match)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	rt := NewRouter(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upload := rt.Handle("POST /upload", 1, 0)
+	internal := rt.HandleFunc(func(r *http.Request) bool {
+		return r.Header.Get("X-Internal") != ""
+	}, 1, 0)
+
+	testCases := []struct {
+		method   string
+		path     string
+		internal bool
+		expected *Middleware
+	}{
+		{"POST", "/upload", false, upload},
+		{"POST", "/upload", true, upload},
+		{"GET", "/upload", true, internal},
+		{"GET", "/", false, rt.Default()},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.internal {
+			r.Header.Set("X-Internal", "1")
+		}
+		if m := rt.Limiter(r); m != tc.expected {
+			t.Errorf("Limiter(%s %s, internal=%v) returned a wrong limiter", tc.method, tc.path, tc.internal)
+		}
+	}
+
+	// Routes have independent limits.
+	if _, err := upload.enqueueRunning(context.Background(), 1, ""); err != nil {
+		t.Fatalf("enqueueRunning() = %v, want nil", err)
+	}
+	rr := httptest.NewRecorder()
+	rt.ServeHTTP(rr, httptest.NewRequest("POST", "/upload", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status code for the saturated route = %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	rr = httptest.NewRecorder()
+	rt.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status code for the default route = %d, want %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestRouterTotal(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	rt := NewRouter(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	reads := rt.HandleFunc(IsSafeMethod, 1, 0)
+	total := rt.Total(2, 0)
+	purges := rt.HandleFunc(MatchMethods("PURGE"), 1, 0)
+
+	serve := func(method string) int {
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(method, "/", nil))
+		return rec.Code
+	}
+	done := make(chan int, 2)
+	go func() { done <- serve("GET") }()
+	<-started
+	go func() { done <- serve("POST") }()
+	<-started
+
+	// Both pools have room only in total, which is full.
+	if status := serve("PURGE"); status != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the total limit to reject the request", status)
+	}
+	if stats := purges.Stats(); stats.Admitted != 1 {
+		t.Fatalf("purges stats = %+v, want the request to pass its own pool", stats)
+	}
+	if stats := total.Stats(); stats.Running != 2 || stats.Overloaded != 1 {
+		t.Fatalf("total stats = %+v", stats)
+	}
+	if stats := reads.Stats(); stats.Running != 1 {
+		t.Fatalf("reads stats = %+v", stats)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if status := <-done; status != http.StatusOK {
+			t.Fatalf("status = %d, want 200", status)
+		}
+	}
+	if err := rt.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
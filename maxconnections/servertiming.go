@@ -0,0 +1,25 @@
+package maxconnections
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// serverTimingMetric formats a Server-Timing metric with the duration d.
+func serverTimingMetric(name string, d time.Duration) string {
+	return name + ";dur=" + strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+// startServerTiming adds the queue wait of a to the Server-Timing header
+// and returns the time when the handler starts.
+func startServerTiming(w http.ResponseWriter, a admission) time.Time {
+	w.Header().Add("Server-Timing", serverTimingMetric("queue", a.wait))
+	return a.l.now()
+}
+
+// finishServerTiming sets the Server-Timing trailer to the duration of the
+// handler that has started at start.
+func finishServerTiming(w http.ResponseWriter, l *Limiter, start time.Time) {
+	w.Header().Set(http.TrailerPrefix+"Server-Timing", serverTimingMetric("handler", l.now().Sub(start)))
+}
@@ -0,0 +1,38 @@
+package maxconnections
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServerTiming(t *testing.T) {
+	m := New(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+		http.NewResponseController(w).Flush()
+	}))
+	m.ServerTiming = true
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if v := resp.Header.Get("Server-Timing"); !strings.HasPrefix(v, "queue;dur=") {
+		t.Fatalf("Server-Timing header = %q, want the queue wait", v)
+	}
+	if v := resp.Trailer.Get("Server-Timing"); !strings.HasPrefix(v, "handler;dur=") {
+		t.Fatalf("Server-Timing trailer = %q, want the handler duration", v)
+	}
+}
+
+func TestServerTimingMetric(t *testing.T) {
+	if v := serverTimingMetric("queue", 1500000); v != "queue;dur=1.500" {
+		t.Fatalf("serverTimingMetric() = %q", v)
+	}
+}
@@ -0,0 +1,103 @@
+package maxconnections
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// sloWindow is the number of recent service times from which the
+	// latency percentile is computed.
+	sloWindow = 256
+
+	// sloEvaluateEvery is how many service times are observed between
+	// evaluations of the percentile.
+	sloEvaluateEvery = 16
+
+	// sloStep is how much the shed fraction changes at each evaluation.
+	sloStep = 0.05
+
+	// maxSLOShedFraction is the maximum shed fraction. Some requests are
+	// always admitted, so that the limiter keeps observing the latency and
+	// can recover.
+	maxSLOShedFraction = 0.9
+)
+
+// latencyWindow keeps recent service times for LatencySLO.
+type latencyWindow struct {
+	mu       sync.Mutex
+	samples  [sloWindow]time.Duration
+	n        int // number of samples in the window
+	pos      int // position of the next sample
+	observed int
+	p95      time.Duration
+	fraction float64
+}
+
+// observe adds d to the window. If it is time to evaluate the percentile, it
+// adjusts the shed fraction according to slo and returns it with true.
+func (w *latencyWindow) observe(d, slo time.Duration) (float64, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples[w.pos] = d
+	w.pos = (w.pos + 1) % sloWindow
+	if w.n < sloWindow {
+		w.n++
+	}
+	w.observed++
+	if w.observed%sloEvaluateEvery != 0 {
+		return 0, false
+	}
+
+	sorted := make([]time.Duration, w.n)
+	copy(sorted, w.samples[:w.n])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	w.p95 = sorted[(w.n*95-1)/100]
+	if w.p95 > slo {
+		w.fraction = math.Min(w.fraction+sloStep, maxSLOShedFraction)
+	} else {
+		w.fraction = math.Max(w.fraction-sloStep, 0)
+	}
+	return w.fraction, true
+}
+
+// percentile returns the latest evaluated p95 of the window.
+func (w *latencyWindow) percentile() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.p95
+}
+
+// observeLatency records the service time d of a request for LatencySLO.
+func (l *Limiter) observeLatency(d time.Duration) {
+	if fraction, ok := l.latency.observe(d, l.LatencySLO); ok {
+		atomic.StoreUint64(&l.sloFraction, math.Float64bits(fraction))
+	}
+}
+
+// SLOShedFraction returns the fraction of requests that are currently
+// rejected because the latency exceeds LatencySLO.
+func (l *Limiter) SLOShedFraction() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&l.sloFraction))
+}
+
+// sloShed reports whether a request should be rejected because the latency
+// exceeds LatencySLO.
+func (l *Limiter) sloShed() bool {
+	if l.LatencySLO <= 0 {
+		return false
+	}
+	fraction := l.SLOShedFraction()
+	if fraction <= 0 {
+		return false
+	}
+	random := l.random
+	if random == nil {
+		random = rand.Float64
+	}
+	return random() < fraction
+}
@@ -0,0 +1,75 @@
+package maxconnections
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLatencySLO(t *testing.T) {
+	now := time.Unix(0, 0)
+	latency := 50 * time.Millisecond
+	l := NewLimiter(10, 0)
+	l.LatencySLO = 100 * time.Millisecond
+	l.Clock = &testClock{
+		now: func() time.Time {
+			return now
+		},
+	}
+	l.random = func() float64 {
+		return 0.5
+	}
+
+	// serve makes n requests that take latency each and returns the
+	// number of rejected requests.
+	serve := func(n int) int {
+		rejected := 0
+		for i := 0; i < n; i++ {
+			release, err := l.Acquire(context.Background())
+			if err == ErrOverloaded {
+				rejected++
+				continue
+			}
+			if err != nil {
+				t.Fatalf("Acquire() = %v, want nil", err)
+			}
+			now = now.Add(latency)
+			release()
+		}
+		return rejected
+	}
+
+	if rejected := serve(sloWindow); rejected != 0 {
+		t.Fatalf("fast requests: rejected = %d, want 0", rejected)
+	}
+	if fraction := l.SLOShedFraction(); fraction != 0 {
+		t.Fatalf("fast requests: SLOShedFraction() = %v, want 0", fraction)
+	}
+
+	latency = 200 * time.Millisecond
+	serve(sloWindow)
+	if fraction := l.SLOShedFraction(); fraction <= 0.5 {
+		t.Fatalf("slow requests: SLOShedFraction() = %v, want more than 0.5", fraction)
+	}
+	if rejected := serve(10); rejected != 10 {
+		t.Fatalf("slow requests: rejected = %d, want 10", rejected)
+	}
+	stats := l.Stats()
+	if stats.LatencyP95 != latency {
+		t.Fatalf("LatencyP95 = %v, want %v", stats.LatencyP95, latency)
+	}
+	if stats.SLOShed == 0 {
+		t.Fatalf("SLOShed = 0, want rejections")
+	}
+
+	// Some requests are still admitted, so the limiter notices when the
+	// latency improves.
+	l.random = func() float64 {
+		return 0.95
+	}
+	latency = 50 * time.Millisecond
+	serve(4 * sloWindow)
+	if fraction := l.SLOShedFraction(); fraction != 0 {
+		t.Fatalf("recovered: SLOShedFraction() = %v, want 0", fraction)
+	}
+}
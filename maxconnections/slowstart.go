@@ -0,0 +1,42 @@
+package maxconnections
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Reset restarts the SlowStart ramp, e.g. after a deploy of an upstream that
+// has cold caches.
+func (l *Limiter) Reset() {
+	atomic.StoreInt64(&l.rampStart, l.now().UnixNano())
+	atomic.StoreInt32(&l.warm, 0)
+}
+
+// EffectiveMaxRunning returns the maximum number of running units with the
+// SlowStart ramp applied.
+func (l *Limiter) EffectiveMaxRunning() int {
+	return int(l.effectiveMaxRunning())
+}
+
+func (l *Limiter) effectiveMaxRunning() int64 {
+	max := atomic.LoadInt64(&l.maxRunning)
+	if l.SlowStart <= 0 || atomic.LoadInt32(&l.warm) != 0 {
+		return max
+	}
+	elapsed := l.now().Sub(time.Unix(0, atomic.LoadInt64(&l.rampStart)))
+	if elapsed >= l.SlowStart {
+		atomic.StoreInt32(&l.warm, 1)
+		return max
+	}
+	min := int64(l.SlowStartMin)
+	if min < 1 {
+		min = 1
+	}
+	if min >= max {
+		return max
+	}
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return min + int64(float64(max-min)*float64(elapsed)/float64(l.SlowStart))
+}
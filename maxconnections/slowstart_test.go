@@ -0,0 +1,47 @@
+package maxconnections
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSlowStart(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewLimiter(11, 0)
+	l.Clock = &testClock{
+		now: func() time.Time {
+			return now
+		},
+	}
+	l.SlowStart = 10 * time.Second
+	l.Reset()
+
+	for _, step := range []struct {
+		elapsed  time.Duration
+		expected int
+	}{
+		{0, 1},
+		{5 * time.Second, 6},
+		{10 * time.Second, 11},
+	} {
+		now = time.Unix(0, 0).Add(step.elapsed)
+		if limit := l.EffectiveMaxRunning(); limit != step.expected {
+			t.Fatalf("EffectiveMaxRunning() after %s = %d, want %d", step.elapsed, limit, step.expected)
+		}
+	}
+
+	now = time.Unix(100, 0)
+	l.Reset()
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire() = %v, want nil", err)
+	}
+	defer release()
+	if _, err := l.Acquire(context.Background()); err != ErrOverloaded {
+		t.Fatalf("Acquire() at the start of the ramp = %v, want %v", err, ErrOverloaded)
+	}
+	if stats := l.Stats(); stats.MaxRunning != 11 || stats.EffectiveMaxRunning != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
@@ -0,0 +1,169 @@
+package maxconnections
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type writeStallKey struct{}
+
+// WriteStallFromContext returns how long the request has been blocked
+// writing its response so far. It is tracked only if TrackWriteStall or
+// StallRelease is set. Slow clients that don't read responses make writes
+// block once the socket buffers are full.
+func WriteStallFromContext(ctx context.Context) time.Duration {
+	sw, _ := ctx.Value(writeStallKey{}).(*stallWriter)
+	if sw == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&sw.stall))
+}
+
+// stallWriter measures how long writes to the client block and releases the
+// running units of the request while a write is stalled.
+type stallWriter struct {
+	http.ResponseWriter
+
+	m   *Middleware
+	l   *Limiter // the limiter that has admitted the request
+	ctx context.Context
+	key string
+
+	// units is the number of running units of the request.
+	units int
+
+	// stall is the total time of writes, it is accessed atomically.
+	stall int64
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// writing is true while a write or a flush is in progress.
+	writing bool
+
+	// held is true while the request occupies its running units.
+	held bool
+
+	// detached is true once the units of the request have been released
+	// for good, see detach.
+	detached bool
+}
+
+// trackWriteStall returns w and r wrapped to track write stalls of the
+// request that occupies n running units of l.
+func (m *Middleware) trackWriteStall(w http.ResponseWriter, r *http.Request, l *Limiter, n int) (*stallWriter, *http.Request) {
+	sw := &stallWriter{
+		ResponseWriter: w,
+		m:              m,
+		l:              l,
+		key:            m.queueKey(r),
+		units:          n,
+		held:           true,
+	}
+	r = r.WithContext(context.WithValue(r.Context(), writeStallKey{}, sw))
+	sw.ctx = r.Context()
+	return sw, r
+}
+
+// release frees the running units while a write is stalled.
+func (sw *stallWriter) release() {
+	sw.mu.Lock()
+	if !sw.writing || !sw.held {
+		sw.mu.Unlock()
+		return
+	}
+	sw.held = false
+	sw.mu.Unlock()
+
+	sw.l.releaseRunning(sw.units)
+	atomic.AddInt64(&sw.l.counters.stallReleases, 1)
+}
+
+// begin is called before a write, the returned function should be called
+// after it.
+func (sw *stallWriter) begin() func() {
+	start := sw.m.now()
+	var timer *time.Timer
+	sw.mu.Lock()
+	sw.writing = true
+	if sw.m.StallRelease > 0 && sw.held {
+		timer = time.AfterFunc(sw.m.StallRelease, sw.release)
+	}
+	sw.mu.Unlock()
+
+	return func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		d := int64(sw.m.now().Sub(start))
+		atomic.AddInt64(&sw.stall, d)
+		atomic.AddInt64(&sw.l.counters.writeStall, d)
+
+		sw.mu.Lock()
+		sw.writing = false
+		held, detached := sw.held, sw.detached
+		sw.mu.Unlock()
+		if held || detached {
+			return
+		}
+
+		// The request waits for its units like a new one. If it cannot
+		// get them, it finishes without them.
+		if _, err := sw.l.enqueueRunning(sw.ctx, sw.units, sw.key); err == nil {
+			sw.mu.Lock()
+			if sw.detached {
+				// The units have been released for good meanwhile.
+				sw.mu.Unlock()
+				sw.l.releaseRunning(sw.units)
+				return
+			}
+			sw.held = true
+			sw.mu.Unlock()
+		}
+	}
+}
+
+// detach stops the tracking of the running units and returns the number of
+// units that the request occupies, so that the caller can release them.
+// Stalled writes don't release or reacquire units afterwards.
+func (sw *stallWriter) detach() int {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.detached = true
+	if !sw.held {
+		return 0
+	}
+	sw.held = false
+	return sw.units
+}
+
+func (sw *stallWriter) Write(p []byte) (int, error) {
+	defer sw.begin()()
+	return sw.ResponseWriter.Write(p)
+}
+
+// FlushError flushes the response, see http.ResponseController.
+func (sw *stallWriter) FlushError() error {
+	defer sw.begin()()
+	return http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+func (sw *stallWriter) Flush() {
+	sw.FlushError()
+}
+
+// Hijack lets the handler take over the connection, see http.Hijacker.
+func (sw *stallWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(sw.ResponseWriter).Hijack()
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer, e.g.
+// to set write deadlines.
+func (sw *stallWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,99 @@
+package maxconnections
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// blockingWriter blocks writes until unblock is closed.
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	unblock chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestStallRelease(t *testing.T) {
+	writing := make(chan struct{})
+	var stall time.Duration
+	h := New(1, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(writing)
+		}
+		w.Write([]byte("hello"))
+		stall = WriteStallFromContext(r.Context())
+	}))
+	h.StallRelease = 10 * time.Millisecond
+
+	slow := &blockingWriter{ResponseRecorder: httptest.NewRecorder(), unblock: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(slow, httptest.NewRequest("GET", "/slow", nil))
+		close(done)
+	}()
+	<-writing
+
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Stats().StallReleases == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the running unit hasn't been released")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("request during the stall: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	close(slow.unblock)
+	<-done
+	if stall < 10*time.Millisecond {
+		t.Errorf("WriteStallFromContext() = %v, want at least 10ms", stall)
+	}
+	stats := h.Stats()
+	if stats.Running != 0 || stats.StallReleases != 1 || stats.WriteStall < stall {
+		t.Fatalf("Stats() = %+v, want nothing running, 1 release and at least %v of write stall", stats, stall)
+	}
+}
+
+func TestTrackWriteStall(t *testing.T) {
+	h := New(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+		http.NewResponseController(w).Flush()
+	}))
+	h.TrackWriteStall = true
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Body.String() != "hello" || !rec.Flushed {
+		t.Fatalf("body = %q, flushed = %v; want hello, true", rec.Body.String(), rec.Flushed)
+	}
+	if stats := h.Stats(); stats.Running != 0 || stats.StallReleases != 0 {
+		t.Fatalf("Stats() = %+v, want nothing running and no releases", stats)
+	}
+}
+
+func TestTrackWriteStallHijack(t *testing.T) {
+	h := New(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			t.Fatal("the writer doesn't implement http.Hijacker")
+		}
+		conn, _, err := hj.Hijack()
+		if err != nil {
+			t.Fatalf("Hijack() = %v, want nil", err)
+		}
+		conn.Close()
+	}))
+	h.TrackWriteStall = true
+
+	client, server := net.Pipe()
+	defer client.Close()
+	h.ServeHTTP(&hijackRecorder{ResponseRecorder: httptest.NewRecorder(), conn: server}, httptest.NewRequest("GET", "/ws", nil))
+}
@@ -0,0 +1,197 @@
+package maxconnections
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+// Stats describes the state of a Limiter.
+type Stats struct {
+	// Running is the number of running units.
+	Running int `json:"running"`
+
+	// MaxRunning is the maximum number of running units.
+	MaxRunning int `json:"max_running"`
+
+	// EffectiveMaxRunning is MaxRunning reduced by the SlowStart ramp.
+	EffectiveMaxRunning int `json:"effective_max_running"`
+
+	// Queued is the number of requests in the queue.
+	Queued int `json:"queued"`
+
+	// MaxInQueue is the capacity of the queue.
+	MaxInQueue int `json:"max_in_queue"`
+
+	// EffectiveMaxInQueue is the capacity of the queue derived from
+	// TargetQueueWait.
+	EffectiveMaxInQueue int `json:"effective_max_in_queue"`
+
+	// Admitted is the number of admitted requests.
+	Admitted int64 `json:"admitted"`
+
+	// Overloaded is the number of requests rejected because of overload.
+	Overloaded int64 `json:"overloaded"`
+
+	// QueueFull and QueueTimeout are the numbers of overloaded requests
+	// that were rejected without waiting, e.g. because the queue was full,
+	// and after waiting in the queue, e.g. because MaxWaitInQueue expired.
+	QueueFull    int64 `json:"queue_full"`
+	QueueTimeout int64 `json:"queue_timeout"`
+
+	// Shed is the number of overloaded requests that were rejected because
+	// of their criticality, see SheddableThreshold.
+	Shed int64 `json:"shed"`
+
+	// SLOShed is the number of overloaded requests that were rejected
+	// because the latency exceeded LatencySLO.
+	SLOShed int64 `json:"slo_shed"`
+
+	// LatencyP95 is the p95 of recent service times and SLOShedFraction is
+	// the fraction of rejected requests. They are tracked only if
+	// LatencySLO is set.
+	LatencyP95      time.Duration `json:"latency_p95"`
+	SLOShedFraction float64       `json:"slo_shed_fraction"`
+
+	// ShutdownRejected is the number of requests rejected because of
+	// Shutdown.
+	ShutdownRejected int64 `json:"shutdown_rejected"`
+
+	// Canceled is the number of requests that were canceled before they
+	// were admitted, e.g. because the client has hung up. QueueCanceled is
+	// the part of them that were canceled while waiting in the queue rather
+	// than on arrival.
+	Canceled      int64 `json:"canceled"`
+	QueueCanceled int64 `json:"queue_canceled"`
+
+	// Duplicates is the number of overloaded requests that were rejected
+	// as duplicates of queued requests, see Middleware.DuplicateKey. With
+	// ReplaceDuplicates they are the replaced older requests.
+	Duplicates int64 `json:"duplicates"`
+
+	// DryRunQueued and DryRunRejected are the numbers of requests that
+	// would have been queued and rejected if DryRun wasn't set. The
+	// requests have been admitted and are counted in Admitted.
+	DryRunQueued   int64 `json:"dry_run_queued"`
+	DryRunRejected int64 `json:"dry_run_rejected"`
+
+	// Paced is the number of requests that have been delayed by pacing,
+	// see Limiter.PaceLimit.
+	Paced int64 `json:"paced"`
+
+	// Evicted is the number of queued requests that have been rejected to
+	// make place for new ones, see Limiter.EvictOldest.
+	Evicted int64 `json:"evicted"`
+
+	// WriteStall is the total time that handlers have been blocked writing
+	// responses, and StallReleases is the number of times running units
+	// were released because of a stalled write. They are tracked only if
+	// the middleware has TrackWriteStall or StallRelease set.
+	WriteStall    time.Duration `json:"write_stall"`
+	StallReleases int64         `json:"stall_releases"`
+
+	// Hijacked is the number of requests that have hijacked their
+	// connections and moved to the LongLived limiter of the middleware.
+	Hijacked int64 `json:"hijacked"`
+
+	// Streamed is the number of requests that have moved to the Streaming
+	// limiter of the middleware when they flushed their responses.
+	Streamed int64 `json:"streamed"`
+}
+
+// counters are cumulative counters of a Limiter.
+type counters struct {
+	admitted         int64
+	overloaded       int64
+	queueFull        int64
+	queueTimeout     int64
+	shed             int64
+	sloShed          int64
+	shutdownRejected int64
+	canceled         int64
+	queueCanceled    int64
+	duplicates       int64
+	dryRunQueued     int64
+	dryRunRejected   int64
+	paced            int64
+	evicted          int64
+	writeStall       int64
+	stallReleases    int64
+	hijacked         int64
+	streamed         int64
+}
+
+// count updates the counters for a request that is rejected with err, or
+// admitted if err is nil.
+func (c *counters) count(err error) {
+	switch err {
+	case nil:
+		atomic.AddInt64(&c.admitted, 1)
+	case ErrShutdown:
+		atomic.AddInt64(&c.shutdownRejected, 1)
+	case ErrCanceled:
+		atomic.AddInt64(&c.canceled, 1)
+	default:
+		atomic.AddInt64(&c.overloaded, 1)
+	}
+}
+
+// countOverload updates the counters for a request that is rejected with
+// ErrOverloaded because of cause.
+func (c *counters) countOverload(cause overload) {
+	switch cause {
+	case overloadQueueFull:
+		atomic.AddInt64(&c.queueFull, 1)
+	case overloadQueueTimeout:
+		atomic.AddInt64(&c.queueTimeout, 1)
+	case overloadShed:
+		atomic.AddInt64(&c.shed, 1)
+	case overloadSLO:
+		atomic.AddInt64(&c.sloShed, 1)
+	}
+}
+
+// Stats returns a snapshot of the state of the limiter.
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	stats := Stats{
+		Running:             l.runningUnits(),
+		MaxRunning:          l.MaxRunning(),
+		EffectiveMaxRunning: l.EffectiveMaxRunning(),
+		Queued:              l.waiting(),
+		MaxInQueue:          l.maxInQueue,
+		EffectiveMaxInQueue: l.queueCapacity(),
+	}
+	l.mu.Unlock()
+
+	stats.Admitted = atomic.LoadInt64(&l.counters.admitted)
+	stats.Overloaded = atomic.LoadInt64(&l.counters.overloaded)
+	stats.QueueFull = atomic.LoadInt64(&l.counters.queueFull)
+	stats.QueueTimeout = atomic.LoadInt64(&l.counters.queueTimeout)
+	stats.Shed = atomic.LoadInt64(&l.counters.shed)
+	stats.SLOShed = atomic.LoadInt64(&l.counters.sloShed)
+	stats.LatencyP95 = l.latency.percentile()
+	stats.SLOShedFraction = l.SLOShedFraction()
+	stats.ShutdownRejected = atomic.LoadInt64(&l.counters.shutdownRejected)
+	stats.Canceled = atomic.LoadInt64(&l.counters.canceled)
+	stats.QueueCanceled = atomic.LoadInt64(&l.counters.queueCanceled)
+	stats.Duplicates = atomic.LoadInt64(&l.counters.duplicates)
+	stats.DryRunQueued = atomic.LoadInt64(&l.counters.dryRunQueued)
+	stats.DryRunRejected = atomic.LoadInt64(&l.counters.dryRunRejected)
+	stats.Paced = atomic.LoadInt64(&l.counters.paced)
+	stats.Evicted = atomic.LoadInt64(&l.counters.evicted)
+	stats.WriteStall = time.Duration(atomic.LoadInt64(&l.counters.writeStall))
+	stats.StallReleases = atomic.LoadInt64(&l.counters.stallReleases)
+	stats.Hijacked = atomic.LoadInt64(&l.counters.hijacked)
+	stats.Streamed = atomic.LoadInt64(&l.counters.streamed)
+	return stats
+}
+
+// PublishExpvar publishes the limiter stats as an expvar variable with
+// the given name, so they are served by the /debug/vars handler. Like
+// expvar.Publish, it panics if the name is already registered.
+func (l *Limiter) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return l.Stats()
+	}))
+}
@@ -0,0 +1,58 @@
+package maxconnections
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// statsTestRuns makes the expvar names unique, as they can't be registered
+// twice, e.g. with -count=2.
+var statsTestRuns int64
+
+func TestStats(t *testing.T) {
+	name := fmt.Sprintf("maxconnections_test_stats_%d", atomic.AddInt64(&statsTestRuns, 1))
+	h := New(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.PublishExpvar(name)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	release, err := h.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire() = %v, want nil", err)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	expected := Stats{
+		Running:             1,
+		MaxRunning:          1,
+		EffectiveMaxRunning: 1,
+		Queued:              0,
+		MaxInQueue:          0,
+		Admitted:            2,
+		Overloaded:          1,
+		QueueFull:           1,
+	}
+	if stats := h.Stats(); stats != expected {
+		t.Fatalf("Stats() = %+v, want %+v", stats, expected)
+	}
+
+	var published Stats
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &published); err != nil {
+		t.Fatal(err)
+	}
+	if published != expected {
+		t.Fatalf("published stats = %+v, want %+v", published, expected)
+	}
+
+	release()
+	h.Shutdown(context.Background())
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if stats := h.Stats(); stats.ShutdownRejected != 1 || stats.Running != 0 {
+		t.Fatalf("Stats() = %+v, want 1 request rejected by shutdown and nothing running", stats)
+	}
+}
@@ -0,0 +1,80 @@
+package maxconnections
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// IsEventStream reports whether the client asks for a stream of server-sent
+// events. It can be used as Middleware.IsStreaming.
+func IsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// streamWriter moves the request from the limiter of the middleware to the
+// Streaming limiter when the handler flushes the response for the first
+// time.
+type streamWriter struct {
+	http.ResponseWriter
+
+	m   *Middleware
+	ctx context.Context
+
+	// release frees the running units of the request in the limiter of
+	// the middleware. It is safe to call it more than once.
+	release func()
+
+	// moved is true once the request has tried to move to Streaming.
+	moved bool
+
+	// a is the admission of Streaming, if the request has moved.
+	a *admission
+}
+
+// move moves the request to the Streaming limiter. If Streaming has no free
+// units, the request stays in the limiter of the middleware: it doesn't wait
+// in the queue of Streaming while it holds its units.
+func (sw *streamWriter) move() {
+	if sw.moved {
+		return
+	}
+	sw.moved = true
+	a, ok := sw.m.Streaming.tryAcquire(sw.ctx, 1)
+	if !ok {
+		return
+	}
+	sw.a = &a
+	atomic.AddInt64(&sw.m.counters.streamed, 1)
+	sw.release()
+}
+
+// done releases the units of Streaming.
+func (sw *streamWriter) done() {
+	if sw.a != nil {
+		sw.a.l.done(*sw.a)
+	}
+}
+
+// FlushError flushes the response, see http.ResponseController.
+func (sw *streamWriter) FlushError() error {
+	sw.move()
+	return http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+func (sw *streamWriter) Flush() {
+	sw.FlushError()
+}
+
+// Hijack lets the handler take over the connection, see http.Hijacker.
+func (sw *streamWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(sw.ResponseWriter).Hijack()
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (sw *streamWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,104 @@
+package maxconnections
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStreaming(t *testing.T) {
+	var m *Middleware
+	var running, streaming []int
+	m = New(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		running = append(running, m.Stats().Running)
+		streaming = append(streaming, m.Streaming.Stats().Running)
+		w.Write([]byte("data: 1\n\n"))
+		http.NewResponseController(w).Flush()
+		running = append(running, m.Stats().Running)
+		streaming = append(streaming, m.Streaming.Stats().Running)
+	}))
+	m.Streaming = NewLimiter(1, 0)
+	m.IsStreaming = IsEventStream
+	m.StreamOnFlush = true
+
+	expect := func(name string, expectedRunning, expectedStreaming []int) {
+		t.Helper()
+		if len(running) != 2 || running[0] != expectedRunning[0] || running[1] != expectedRunning[1] {
+			t.Errorf("%s: running = %v, want %v", name, running, expectedRunning)
+		}
+		if len(streaming) != 2 || streaming[0] != expectedStreaming[0] || streaming[1] != expectedStreaming[1] {
+			t.Errorf("%s: streaming = %v, want %v", name, streaming, expectedStreaming)
+		}
+		running, streaming = nil, nil
+	}
+
+	r := httptest.NewRequest("GET", "/events", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	m.ServeHTTP(httptest.NewRecorder(), r)
+	expect("matched", []int{0, 0}, []int{1, 1})
+
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/download", nil))
+	expect("flushed", []int{1, 0}, []int{0, 1})
+
+	if stats := m.Stats(); stats.Running != 0 || stats.Streamed != 1 {
+		t.Fatalf("stats = %+v, want one streamed request and nothing running", stats)
+	}
+	if stats := m.Streaming.Stats(); stats.Running != 0 || stats.Admitted != 2 {
+		t.Fatalf("streaming stats = %+v, want 2 admitted requests and nothing running", stats)
+	}
+}
+
+func TestStreamingFull(t *testing.T) {
+	var m *Middleware
+	flushed := make(chan int, 1)
+	m = New(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data: 1\n\n"))
+		http.NewResponseController(w).Flush()
+		flushed <- m.Stats().Running
+	}))
+	// Streaming has place in the queue, but the request must not wait
+	// there while it holds its unit.
+	m.Streaming = NewLimiter(1, 10)
+	m.StreamOnFlush = true
+	release, err := m.Streaming.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	go m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/download", nil))
+	select {
+	case running := <-flushed:
+		if running != 1 {
+			t.Fatalf("running = %d after the flush, want the request to keep its unit", running)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the flush waits in the queue of Streaming")
+	}
+	if stats := m.Streaming.Stats(); stats.Queued != 0 || stats.Admitted != 1 {
+		t.Fatalf("streaming stats = %+v, want nothing queued and only the first request admitted", stats)
+	}
+}
+
+func TestStreamingHijack(t *testing.T) {
+	m := New(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			t.Fatal("the writer doesn't implement http.Hijacker")
+		}
+		conn, _, err := hj.Hijack()
+		if err != nil {
+			t.Fatalf("Hijack() = %v, want nil", err)
+		}
+		conn.Close()
+	}))
+	m.Streaming = NewLimiter(1, 0)
+	m.StreamOnFlush = true
+
+	client, server := net.Pipe()
+	defer client.Close()
+	m.ServeHTTP(&hijackRecorder{ResponseRecorder: httptest.NewRecorder(), conn: server}, httptest.NewRequest("GET", "/ws", nil))
+}
@@ -0,0 +1,52 @@
+package maxconnections
+
+import (
+	"sync"
+	"time"
+)
+
+// timerPool contains stopped timers with drained channels. Every queued
+// request needs a timer, reusing them saves allocations under load.
+var timerPool sync.Pool
+
+// startTimer returns a timer of the limiter clock that fires after d. The
+// timer should be returned by stopTimer.
+func (l *Limiter) startTimer(d time.Duration) Timer {
+	return startTimer(l.Clock, d)
+}
+
+// stopTimer stops the timer t started by startTimer.
+func (l *Limiter) stopTimer(t Timer) {
+	stopTimer(t)
+}
+
+// startTimer returns a timer of the clock c, or of SystemClock if c is nil,
+// that fires after d. The timer should be returned by stopTimer.
+func startTimer(c Clock, d time.Duration) Timer {
+	if c != nil {
+		return c.NewTimer(d)
+	}
+	if t, ok := timerPool.Get().(*time.Timer); ok {
+		t.Reset(d)
+		return systemTimer{t}
+	}
+	return systemTimer{time.NewTimer(d)}
+}
+
+// stopTimer stops the timer t and puts it into the pool if it is a timer of
+// SystemClock. The caller must not use t afterwards.
+func stopTimer(t Timer) {
+	st, ok := t.(systemTimer)
+	if !ok {
+		t.Stop()
+		return
+	}
+	if !st.t.Stop() {
+		// The timer has fired, its value may be still in the channel.
+		select {
+		case <-st.t.C:
+		default:
+		}
+	}
+	timerPool.Put(st.t)
+}
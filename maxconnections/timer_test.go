@@ -0,0 +1,33 @@
+package maxconnections
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimerPool(t *testing.T) {
+	l := NewLimiter(1, 1)
+
+	// A fired timer must not leak its value to the next user.
+	timer := l.startTimer(0)
+	time.Sleep(10 * time.Millisecond)
+	l.stopTimer(timer)
+
+	for i := 0; i < 10; i++ {
+		timer := l.startTimer(time.Hour)
+		select {
+		case <-timer.C():
+			t.Fatal("a pooled timer fired too early")
+		default:
+		}
+		l.stopTimer(timer)
+	}
+}
+
+func BenchmarkQueueTimer(b *testing.B) {
+	l := NewLimiter(1, 1)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		l.stopTimer(l.startTimer(time.Second))
+	}
+}
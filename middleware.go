@@ -0,0 +1,67 @@
+// Package middleware composes the middlewares of this repository.
+//
+// The middlewares live in their own packages. Their constructors take the
+// next handler as the last argument, so they are wrapped into Constructors
+// to be listed in the order in which requests pass through them:
+//
+//	h := middleware.Chain(
+//		middleware.Wrap(recovery.New),
+//		middleware.Wrap(requestlog.New),
+//		func(h http.Handler) http.Handler {
+//			return maxconnections.New(10, 100, h)
+//		},
+//		func(h http.Handler) http.Handler {
+//			return timeout.New(5*time.Second, h)
+//		},
+//	).Then(mux)
+//
+// Components can be registered in a Registry by name to be described, and
+// their limits adjusted, by DebugHandler.
+package middleware
+
+import "net/http"
+
+// Constructor wraps a handler into a middleware.
+type Constructor func(http.Handler) http.Handler
+
+// Wrap converts a constructor that returns a concrete middleware type, e.g.
+// recovery.New, into a Constructor.
+func Wrap[T http.Handler](f func(http.Handler) T) Constructor {
+	return func(h http.Handler) http.Handler {
+		return f(h)
+	}
+}
+
+// Stack is an ordered list of middlewares. The first one is the outermost,
+// it sees requests first.
+type Stack []Constructor
+
+// Chain returns a Stack of constructors.
+func Chain(constructors ...Constructor) Stack {
+	return append(Stack(nil), constructors...)
+}
+
+// Append returns a new Stack with constructors added after the middlewares
+// of s. s is not modified, so a common base can be extended differently.
+func (s Stack) Append(constructors ...Constructor) Stack {
+	res := make(Stack, 0, len(s)+len(constructors))
+	res = append(res, s...)
+	return append(res, constructors...)
+}
+
+// Then wraps h into the middlewares of s. If h is nil,
+// http.DefaultServeMux is used.
+func (s Stack) Then(h http.Handler) http.Handler {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	for i := len(s) - 1; i >= 0; i-- {
+		h = s[i](h)
+	}
+	return h
+}
+
+// ThenFunc wraps f into the middlewares of s.
+func (s Stack) ThenFunc(f http.HandlerFunc) http.Handler {
+	return s.Then(f)
+}
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dmage/middleware/recovery"
+)
+
+func tag(name string) Constructor {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Order", name)
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	base := Chain(tag("a"), tag("b"))
+	extended := base.Append(Wrap(recovery.New), tag("c"))
+	other := base.Append(tag("d"))
+
+	h := extended.ThenFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if order := strings.Join(rec.Header().Values("X-Order"), ","); order != "a,b,c" {
+		t.Errorf("order = %s, want a,b,c", order)
+	}
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want the panic to be recovered", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	other.ThenFunc(func(w http.ResponseWriter, r *http.Request) {}).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if order := strings.Join(rec.Header().Values("X-Order"), ","); order != "a,b,d" {
+		t.Errorf("order = %s, want a,b,d", order)
+	}
+}
@@ -0,0 +1,76 @@
+package middlewaretest
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Barrier is an http.Handler that holds requests until Release is called or
+// their contexts are done. It allows to keep a known number of requests
+// running inside a limiter.
+type Barrier struct {
+	mu      sync.Mutex
+	entered int
+	release chan struct{}
+	once    sync.Once
+}
+
+// NewBarrier returns a Barrier that holds requests.
+func NewBarrier() *Barrier {
+	return &Barrier{
+		release: make(chan struct{}),
+	}
+}
+
+func (b *Barrier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	b.entered++
+	b.mu.Unlock()
+	select {
+	case <-b.release:
+	case <-r.Context().Done():
+	}
+}
+
+// Entered returns the number of requests that have reached the handler.
+func (b *Barrier) Entered() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.entered
+}
+
+// WaitEntered waits until n requests have reached the handler. It returns
+// an error if it takes longer than timeout.
+func (b *Barrier) WaitEntered(n int, timeout time.Duration) error {
+	return poll(timeout, func() (int, bool) {
+		entered := b.Entered()
+		return entered, entered >= n
+	}, "%d requests to enter the handler", n)
+}
+
+// Release lets the held requests and all following ones through. It is safe
+// to call it more than once.
+func (b *Barrier) Release() {
+	b.once.Do(func() {
+		close(b.release)
+	})
+}
+
+// poll calls check until it returns true. The error for a timeout describes
+// the awaited state with format and args and the last value returned by
+// check.
+func poll(timeout time.Duration, check func() (int, bool), format string, args ...interface{}) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		got, ok := check()
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout while waiting for "+format+", got %d", append(args, got)...)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,111 @@
+// Package middlewaretest provides utilities for testing configurations of
+// the middlewares: a fake clock, a handler that holds requests until they
+// are released and helpers that drive concurrent requests and wait for
+// limiters to reach a state.
+//
+//	b := middlewaretest.NewBarrier()
+//	m := maxconnections.New(2, 1, b)
+//	batch := middlewaretest.Go(m, 4, nil)
+//	b.WaitEntered(2, time.Second)
+//	middlewaretest.WaitQueued(m, 1, time.Second)
+//	b.Release()
+//	outcomes := batch.Wait() // map[200:3 503:1]
+package middlewaretest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+// FakeClock is a maxconnections.Clock whose time changes only when it is
+// advanced, so that queue timeouts and latency estimates can be tested
+// without sleeping.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+var _ maxconnections.Clock = (*FakeClock)(nil)
+
+// NewFakeClock returns a FakeClock that is set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now implements maxconnections.Clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer implements maxconnections.Clock. The timer fires when the clock
+// is advanced to or past its deadline.
+func (c *FakeClock) NewTimer(d time.Duration) maxconnections.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{
+		c:        c,
+		deadline: c.now.Add(d),
+		ch:       make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		t.ch <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d and fires the timers whose deadlines
+// have passed, earliest first.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		return c.timers[i].deadline.Before(c.timers[j].deadline)
+	})
+	i := 0
+	for i < len(c.timers) && !c.timers[i].deadline.After(c.now) {
+		c.timers[i].ch <- c.now
+		i++
+	}
+	c.timers = append(c.timers[:0], c.timers[i:]...)
+}
+
+// Timers returns the number of timers that haven't fired or been stopped.
+// A limiter with MaxWaitInQueue has a timer for each queued request, so it
+// can be used to wait until requests are queued before Advance.
+func (c *FakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// fakeTimer is a Timer of FakeClock.
+type fakeTimer struct {
+	c        *FakeClock
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	for i, other := range t.c.timers {
+		if other == t {
+			t.c.timers = append(t.c.timers[:i], t.c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package middlewaretest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(0, 0)
+	c := NewFakeClock(start)
+	late := c.NewTimer(2 * time.Second)
+	early := c.NewTimer(time.Second)
+	stopped := c.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Fatal("Stop() = false for a pending timer")
+	}
+	if n := c.Timers(); n != 2 {
+		t.Fatalf("Timers() = %d, want %d", n, 2)
+	}
+
+	c.Advance(time.Second)
+	if now := c.Now(); !now.Equal(start.Add(time.Second)) {
+		t.Fatalf("Now() = %s, want %s", now, start.Add(time.Second))
+	}
+	select {
+	case <-early.C():
+	default:
+		t.Fatal("the timer hasn't fired at its deadline")
+	}
+	select {
+	case <-late.C():
+		t.Fatal("the timer has fired before its deadline")
+	default:
+	}
+	if !late.Stop() || early.Stop() {
+		t.Fatal("Stop() should report whether the timer was pending")
+	}
+}
+
+func TestFakeClockQueueTimeout(t *testing.T) {
+	c := NewFakeClock(time.Unix(0, 0))
+	b := NewBarrier()
+	m := maxconnections.New(1, 1, b)
+	m.Clock = c
+	m.MaxWaitInQueue = time.Minute
+
+	batch := Go(m, 2, nil)
+	if err := b.WaitEntered(1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := WaitQueued(m, 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(time.Minute)
+	if err := WaitQueued(m, 0, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	b.Release()
+	if outcomes := batch.Wait(); outcomes[http.StatusOK] != 1 || outcomes[http.StatusServiceUnavailable] != 1 {
+		t.Fatalf("outcomes = %v, want the queued request to time out", outcomes)
+	}
+}
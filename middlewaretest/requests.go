@@ -0,0 +1,83 @@
+package middlewaretest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+// Outcomes are the numbers of responses by status code.
+type Outcomes map[int]int
+
+// Batch is a set of requests that are served concurrently, see Go.
+type Batch struct {
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	outcomes Outcomes
+}
+
+// Go serves n requests with h, each in its own goroutine, and returns
+// without waiting for them. The i-th request is created by newRequest(i),
+// or is GET / if newRequest is nil.
+func Go(h http.Handler, n int, newRequest func(i int) *http.Request) *Batch {
+	b := &Batch{
+		outcomes: make(Outcomes),
+	}
+	b.wg.Add(n)
+	for i := 0; i < n; i++ {
+		var r *http.Request
+		if newRequest != nil {
+			r = newRequest(i)
+		} else {
+			r = httptest.NewRequest("GET", "/", nil)
+		}
+		go func() {
+			defer b.wg.Done()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			b.mu.Lock()
+			b.outcomes[rec.Code]++
+			b.mu.Unlock()
+		}()
+	}
+	return b
+}
+
+// Wait waits until all requests of b are served and returns their outcomes.
+func (b *Batch) Wait() Outcomes {
+	b.wg.Wait()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := make(Outcomes, len(b.outcomes))
+	for status, n := range b.outcomes {
+		res[status] = n
+	}
+	return res
+}
+
+// StatsSource is a limiter whose state can be waited for, e.g.
+// maxconnections.Limiter or maxconnections.Middleware.
+type StatsSource interface {
+	Stats() maxconnections.Stats
+}
+
+// WaitQueued waits until s has n requests in its queue. It returns an error
+// if it takes longer than timeout.
+func WaitQueued(s StatsSource, n int, timeout time.Duration) error {
+	return poll(timeout, func() (int, bool) {
+		queued := s.Stats().Queued
+		return queued, queued == n
+	}, "%d requests in the queue", n)
+}
+
+// WaitRunning waits until s has n running units. It returns an error if it
+// takes longer than timeout.
+func WaitRunning(s StatsSource, n int, timeout time.Duration) error {
+	return poll(timeout, func() (int, bool) {
+		running := s.Stats().Running
+		return running, running == n
+	}, "%d running units", n)
+}
@@ -0,0 +1,51 @@
+package middlewaretest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+func TestGo(t *testing.T) {
+	b := NewBarrier()
+	m := maxconnections.New(2, 1, b)
+
+	var paths []string
+	batch := Go(m, 4, func(i int) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		paths = append(paths, r.URL.Path)
+		return r
+	})
+	if len(paths) != 4 {
+		t.Fatalf("created %d requests, want %d", len(paths), 4)
+	}
+	if err := b.WaitEntered(2, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := WaitRunning(m, 2, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := WaitQueued(m, 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	b.Release()
+	b.Release()
+
+	outcomes := batch.Wait()
+	if outcomes[http.StatusOK] != 3 || outcomes[http.StatusServiceUnavailable] != 1 {
+		t.Fatalf("outcomes = %v, want 3 admitted requests and 1 rejected", outcomes)
+	}
+	if b.Entered() != 3 {
+		t.Fatalf("Entered() = %d, want %d", b.Entered(), 3)
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	err := WaitQueued(maxconnections.NewLimiter(1, 1), 1, time.Millisecond)
+	if err == nil || err.Error() != "timeout while waiting for 1 requests in the queue, got 0" {
+		t.Fatalf("WaitQueued() = %v, want a timeout", err)
+	}
+}
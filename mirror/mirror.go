@@ -0,0 +1,254 @@
+// Package mirror copies a sample of requests to a secondary handler, e.g. a
+// new version of a backend, to test it with real traffic. Mirrored requests
+// are served asynchronously with their own deadline and their responses are
+// discarded, so the primary path doesn't wait for them.
+//
+// Bodies are buffered to be sent twice. Requests with bodies larger than
+// MaxBodySize are not mirrored, and the number of mirrored requests in
+// flight is capped by MaxConcurrent, so that a slow mirror can't exhaust the
+// memory or the goroutines of the process.
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMaxBodySize   = 64 << 10
+	defaultMaxConcurrent = 16
+	defaultTimeout       = 5 * time.Second
+)
+
+// Stats contains counters collected by Middleware.
+type Stats struct {
+	// Mirrored is the total number of requests that have been sent to the
+	// mirror.
+	Mirrored int64 `json:"mirrored"`
+
+	// BodyTooLarge is the total number of sampled requests that haven't
+	// been mirrored because their bodies exceeded MaxBodySize.
+	BodyTooLarge int64 `json:"body_too_large"`
+
+	// Dropped is the total number of sampled requests that haven't been
+	// mirrored because MaxConcurrent requests were in flight.
+	Dropped int64 `json:"dropped"`
+
+	// Failed is the total number of mirrored requests that have panicked
+	// or got 502 Bad Gateway, e.g. because Upstream has failed to reach
+	// the target.
+	Failed int64 `json:"failed"`
+
+	// InFlight is the number of mirrored requests in flight.
+	InFlight int64 `json:"in_flight"`
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	// handler to invoke.
+	handler http.Handler
+
+	// mirror receives the copies of requests.
+	mirror http.Handler
+
+	// sem contains a token for every mirrored request in flight.
+	sem chan struct{}
+
+	mirrored     int64
+	bodyTooLarge int64
+	dropped      int64
+	failed       int64
+
+	// Fraction is the fraction of requests that are mirrored, from 0 to 1.
+	// By default all requests are mirrored.
+	Fraction float64
+
+	// Match, if not nil, reports whether the request can be mirrored, e.g.
+	// only safe methods.
+	Match func(r *http.Request) bool
+
+	// MaxBodySize is the largest request body that is buffered to be
+	// mirrored. By default it is 64 KiB.
+	MaxBodySize int64
+
+	// Timeout is the deadline of mirrored requests. By default it is 5
+	// seconds.
+	Timeout time.Duration
+
+	// random allows to override rand.Float64 for tests.
+	random func() float64
+}
+
+// New returns an http.Handler that passes requests to h and their copies to
+// mirror. Up to maxConcurrent copies are served at the same time, if
+// maxConcurrent is not positive, the limit is 16.
+func New(mirror http.Handler, maxConcurrent int, h http.Handler) *Middleware {
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultMaxConcurrent
+	}
+	return &Middleware{
+		handler:     h,
+		mirror:      mirror,
+		sem:         make(chan struct{}, maxConcurrent),
+		Fraction:    1,
+		MaxBodySize: defaultMaxBodySize,
+		Timeout:     defaultTimeout,
+		random:      rand.Float64,
+	}
+}
+
+// Upstream returns a handler that sends requests to the target URL, with
+// the path of the request appended to the path of target, and discards the
+// responses. It can be used as the mirror of New. If client is nil,
+// http.DefaultClient is used.
+func Upstream(target *url.URL, client *http.Client) http.Handler {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := *target
+		u.Path = singleJoiningSlash(target.Path, r.URL.Path)
+		u.RawPath = ""
+		u.RawQuery = r.URL.RawQuery
+		req := r.Clone(r.Context())
+		req.URL = &u
+		req.Host = ""
+		req.RequestURI = ""
+		resp, err := client.Do(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		w.WriteHeader(resp.StatusCode)
+	})
+}
+
+func singleJoiningSlash(a, b string) string {
+	switch aslash, bslash := len(a) > 0 && a[len(a)-1] == '/', len(b) > 0 && b[0] == '/'; {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash && a != "" && b != "":
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// discardWriter is a ResponseWriter for mirrored requests. It remembers the
+// status to count failures.
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
+
+// sampled reports whether the request should be mirrored.
+func (m *Middleware) sampled(r *http.Request) bool {
+	if m.Match != nil && !m.Match(r) {
+		return false
+	}
+	return m.Fraction >= 1 || m.random() < m.Fraction
+}
+
+// buffer reads the body of r for the mirror. If the body is larger than
+// MaxBodySize, it returns false and the part that has been read is put back
+// in front of the rest of the body.
+func (m *Middleware) buffer(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > m.MaxBodySize {
+		return nil, false
+	}
+	body := r.Body
+	data, err := io.ReadAll(io.LimitReader(body, m.MaxBodySize+1))
+	r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(data), body), Closer: body}
+	if err != nil || int64(len(data)) > m.MaxBodySize {
+		return nil, false
+	}
+	return data, true
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// send serves req by the mirror.
+func (m *Middleware) send(req *http.Request, cancel context.CancelFunc) {
+	defer func() { <-m.sem }()
+	defer cancel()
+	defer func() {
+		if recover() != nil {
+			atomic.AddInt64(&m.failed, 1)
+		}
+	}()
+	w := &discardWriter{header: make(http.Header)}
+	m.mirror.ServeHTTP(w, req)
+	if w.status == http.StatusBadGateway {
+		atomic.AddInt64(&m.failed, 1)
+	}
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !m.sampled(r) {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+	body, ok := m.buffer(r)
+	if !ok {
+		atomic.AddInt64(&m.bodyTooLarge, 1)
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+	select {
+	case m.sem <- struct{}{}:
+		atomic.AddInt64(&m.mirrored, 1)
+		// The mirrored request doesn't depend on the primary one,
+		// which may finish earlier. It is cloned before the handler
+		// can modify the request.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), m.Timeout)
+		req := r.Clone(ctx)
+		req.Body = http.NoBody
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		req.ContentLength = int64(len(body))
+		go m.send(req, cancel)
+	default:
+		atomic.AddInt64(&m.dropped, 1)
+	}
+	m.handler.ServeHTTP(w, r)
+}
+
+// Stats returns a snapshot of the collected counters.
+func (m *Middleware) Stats() Stats {
+	return Stats{
+		Mirrored:     atomic.LoadInt64(&m.mirrored),
+		BodyTooLarge: atomic.LoadInt64(&m.bodyTooLarge),
+		Dropped:      atomic.LoadInt64(&m.dropped),
+		Failed:       atomic.LoadInt64(&m.failed),
+		InFlight:     int64(len(m.sem)),
+	}
+}
@@ -0,0 +1,118 @@
+package mirror
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	mirrored := make(chan string, 10)
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- r.URL.Path + " " + string(body)
+		w.WriteHeader(http.StatusInternalServerError)
+	}), 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	m.MaxBodySize = 4
+
+	serve := func(path, body string) string {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return rec.Body.String()
+	}
+	if body := serve("/a", "abc"); body != "abc" {
+		t.Fatalf("primary body = %q, want abc", body)
+	}
+	select {
+	case got := <-mirrored:
+		if got != "/a abc" {
+			t.Fatalf("mirrored %q, want the path and the body", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the request is not mirrored")
+	}
+
+	// Large bodies are passed to the primary handler intact.
+	if body := serve("/b", "abcdef"); body != "abcdef" {
+		t.Fatalf("primary body = %q, want abcdef", body)
+	}
+
+	m.Fraction = 0.5
+	m.random = func() float64 { return 0.7 }
+	serve("/c", "")
+
+	deadline := time.Now().Add(time.Second)
+	for m.Stats().InFlight != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the mirrored request is still in flight")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats := m.Stats(); stats.Mirrored != 1 || stats.BodyTooLarge != 1 || stats.Dropped != 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestMirrorConcurrency(t *testing.T) {
+	release := make(chan struct{})
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}), 1, http.NotFoundHandler())
+
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("status = %d, want the primary response", rec.Code)
+		}
+	}
+	close(release)
+	if stats := m.Stats(); stats.Mirrored != 1 || stats.Dropped != 2 {
+		t.Fatalf("stats = %+v, want 1 mirrored and 2 dropped requests", stats)
+	}
+}
+
+func TestUpstream(t *testing.T) {
+	got := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.URL.String()
+		w.Write([]byte("ignored"))
+	}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL + "/v2")
+
+	m := New(Upstream(target, srv.Client()), 1, http.NotFoundHandler())
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users?id=1", nil))
+	select {
+	case u := <-got:
+		if u != "/v2/users?id=1" {
+			t.Fatalf("upstream got %s, want /v2/users?id=1", u)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the request is not mirrored to the upstream")
+	}
+
+	srv.Close()
+	deadline := time.Now().Add(time.Second)
+	for m.Stats().InFlight != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the mirrored request is still in flight")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+	deadline = time.Now().Add(time.Second)
+	for m.Stats().Failed != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats = %+v, want the unreachable upstream to be counted", m.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,478 @@
+// Package multipart enforces a policy on multipart/form-data uploads: the
+// number of parts, the size of each part, the total size of the body and the
+// content types of files. The body is checked while the handler reads it, it
+// is never buffered, so the handler can stream large files. When the body
+// violates the policy, reads from it fail with *Error. Metadata of the parts
+// that have been read so far is available from FromContext.
+package multipart
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultMaxParts     = 100
+	defaultMaxPartSize  = 10 << 20
+	defaultMaxTotalSize = 32 << 20
+
+	// maxHeaderSize is the maximum size of headers of a part.
+	maxHeaderSize = 8 << 10
+
+	// maxPadding is the maximum length of whitespace after a boundary.
+	maxPadding = 1024
+)
+
+// Reasons of rejections, see Error.
+const (
+	ReasonMalformed    = "malformed"
+	ReasonTooManyParts = "too_many_parts"
+	ReasonPartTooLarge = "part_too_large"
+	ReasonTooLarge     = "too_large"
+	ReasonType         = "content_type_not_allowed"
+)
+
+// Error describes why a body was rejected.
+type Error struct {
+	// Reason is one of the Reason constants.
+	Reason string `json:"reason"`
+
+	// Part is the form name of the offending part, if there is one.
+	Part string `json:"part,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Part == "" {
+		return "multipart: " + e.Reason
+	}
+	return fmt.Sprintf("multipart: %s: %s", e.Reason, e.Part)
+}
+
+// Part contains metadata of a part.
+type Part struct {
+	// Name is the form name of the part.
+	Name string `json:"name"`
+
+	// FileName is the file name of the part, it is empty for form fields.
+	FileName string `json:"filename,omitempty"`
+
+	// ContentType is the media type of the part.
+	ContentType string `json:"contentType"`
+
+	// Size is the number of bytes of the part content that have been read.
+	Size int64 `json:"size"`
+}
+
+// Info contains metadata of a multipart body. It is updated while the body
+// is read.
+type Info struct {
+	mu    sync.Mutex
+	parts []Part
+	err   *Error
+	done  bool
+}
+
+// Parts returns the parts that have been read so far.
+func (i *Info) Parts() []Part {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return append([]Part(nil), i.parts...)
+}
+
+// Err returns the policy violation of the body, if any.
+func (i *Info) Err() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.err == nil {
+		return nil
+	}
+	return i.err
+}
+
+// Done reports whether the closing boundary has been read.
+func (i *Info) Done() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.done
+}
+
+type infoKey struct{}
+
+// FromContext returns the metadata of the multipart body of the request with
+// ctx. It returns nil if the request doesn't have a multipart/form-data body.
+func FromContext(ctx context.Context) *Info {
+	info, _ := ctx.Value(infoKey{}).(*Info)
+	return info
+}
+
+type errorKey struct{}
+
+// ErrorFromContext returns the reason of the rejection of the request with
+// ctx. It is available to RejectHandler.
+func ErrorFromContext(ctx context.Context) *Error {
+	err, _ := ctx.Value(errorKey{}).(*Error)
+	return err
+}
+
+func defaultRejectHandler(w http.ResponseWriter, r *http.Request) {
+	err := ErrorFromContext(r.Context())
+	status := http.StatusBadRequest
+	if err != nil && err.Reason == ReasonTooLarge {
+		status = http.StatusRequestEntityTooLarge
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Title  string `json:"title"`
+		Status int    `json:"status"`
+		*Error
+	}{
+		Title:  "invalid multipart body",
+		Status: status,
+		Error:  err,
+	})
+}
+
+// RejectHandler is a default RejectHandler for Middleware. It writes the
+// Error as an RFC 7807 problem.
+var RejectHandler http.Handler = http.HandlerFunc(defaultRejectHandler)
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler http.Handler
+
+	// MaxParts is the maximum number of parts. By default it is 100.
+	MaxParts int
+
+	// MaxPartSize is the maximum size of the content of a part in bytes.
+	// By default it is 10 MiB.
+	MaxPartSize int64
+
+	// MaxTotalSize is the maximum size of the body in bytes. By default it
+	// is 32 MiB.
+	MaxTotalSize int64
+
+	// AllowedTypes are the media types that files may have, e.g.
+	// "image/png" or "image/*". Files without a Content-Type header have
+	// the type application/octet-stream. If it is empty, all types are
+	// allowed. Form fields are not checked.
+	AllowedTypes []string
+
+	// RejectHandler is called for requests that can be rejected before the
+	// handler is called, e.g. because of Content-Length. The reason is
+	// available from ErrorFromContext. Violations found while the handler
+	// reads the body are reported to the handler as read errors.
+	RejectHandler http.Handler
+}
+
+// New returns an http.Handler that enforces the policy on multipart/form-data
+// bodies of requests passed to h. Other requests are passed to h as is.
+func New(h http.Handler) *Middleware {
+	return &Middleware{
+		handler:       h,
+		MaxParts:      defaultMaxParts,
+		MaxPartSize:   defaultMaxPartSize,
+		MaxTotalSize:  defaultMaxTotalSize,
+		RejectHandler: RejectHandler,
+	}
+}
+
+func (m *Middleware) maxParts() int {
+	if m.MaxParts <= 0 {
+		return defaultMaxParts
+	}
+	return m.MaxParts
+}
+
+func (m *Middleware) maxPartSize() int64 {
+	if m.MaxPartSize <= 0 {
+		return defaultMaxPartSize
+	}
+	return m.MaxPartSize
+}
+
+func (m *Middleware) maxTotalSize() int64 {
+	if m.MaxTotalSize <= 0 {
+		return defaultMaxTotalSize
+	}
+	return m.MaxTotalSize
+}
+
+// allowedType reports whether files may have the media type typ.
+func (m *Middleware) allowedType(typ string) bool {
+	if len(m.AllowedTypes) == 0 {
+		return true
+	}
+	for _, t := range m.AllowedTypes {
+		if t == typ || strings.HasSuffix(t, "/*") && strings.HasPrefix(typ, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanner states.
+const (
+	statePreamble = iota
+	stateHeader
+	stateContent
+	stateEpilogue
+)
+
+// scanner follows the structure of a multipart body without buffering it.
+// It keeps only the bytes that may be the beginning of a delimiter or a
+// header.
+type scanner struct {
+	m    *Middleware
+	info *Info
+
+	// delimiter is "\n--" followed by the boundary. The body is scanned as
+	// if it started with a newline, so the first boundary is also found.
+	delimiter []byte
+
+	state   int
+	pending []byte
+	header  []byte
+	total   int64
+}
+
+// fail records err as the violation of the body and returns it.
+func (s *scanner) fail(err *Error) *Error {
+	s.info.mu.Lock()
+	defer s.info.mu.Unlock()
+	s.info.err = err
+	return err
+}
+
+// current returns the part that is being read. It should be called with
+// info.mu held.
+func (s *scanner) current() *Part {
+	return &s.info.parts[len(s.info.parts)-1]
+}
+
+// content counts n bytes of the content of the current part.
+func (s *scanner) content(n int) *Error {
+	if s.state != stateContent || n == 0 {
+		return nil
+	}
+	s.info.mu.Lock()
+	p := s.current()
+	p.Size += int64(n)
+	size, name := p.Size, p.Name
+	s.info.mu.Unlock()
+	if size > s.m.maxPartSize() {
+		return s.fail(&Error{Reason: ReasonPartTooLarge, Part: name})
+	}
+	return nil
+}
+
+// boundary checks whether the delimiter at the beginning of rest is a
+// boundary. It returns the number of bytes of the boundary line and whether
+// it closes the body. If more data is needed, n is 0 and ok is true.
+func (s *scanner) boundary(rest []byte, eof bool) (n int, closing bool, ok bool) {
+	rest = rest[len(s.delimiter):]
+	if bytes.HasPrefix(rest, []byte("--")) {
+		return len(s.delimiter) + 2, true, true
+	}
+	i := 0
+	for i < len(rest) && i <= maxPadding && (rest[i] == ' ' || rest[i] == '\t') {
+		i++
+	}
+	switch {
+	case i < len(rest) && rest[i] == '\n':
+		return len(s.delimiter) + i + 1, false, true
+	case i+1 < len(rest) && rest[i] == '\r' && rest[i+1] == '\n':
+		return len(s.delimiter) + i + 2, false, true
+	case !eof && i <= maxPadding && (i == len(rest) || i+1 == len(rest) && (rest[i] == '\r' || rest[i] == '-')):
+		return 0, false, true
+	}
+	return 0, false, false
+}
+
+// parseHeader starts a new part with the headers collected in s.header.
+func (s *scanner) parseHeader() *Error {
+	r := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(s.header), strings.NewReader("\r\n"))))
+	s.header = s.header[:0]
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		return s.fail(&Error{Reason: ReasonMalformed})
+	}
+	var part Part
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		part.Name = params["name"]
+		part.FileName = params["filename"]
+	}
+	part.ContentType = "text/plain"
+	if part.FileName != "" {
+		part.ContentType = "application/octet-stream"
+	}
+	if ct := header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return s.fail(&Error{Reason: ReasonMalformed, Part: part.Name})
+		}
+		part.ContentType = mediaType
+	}
+	if part.FileName != "" && !s.m.allowedType(part.ContentType) {
+		return s.fail(&Error{Reason: ReasonType, Part: part.Name})
+	}
+	s.info.mu.Lock()
+	s.info.parts = append(s.info.parts, part)
+	s.info.mu.Unlock()
+	s.state = stateContent
+	return nil
+}
+
+// scan processes the pending bytes. If eof is true, there will be no more
+// data.
+func (s *scanner) scan(eof bool) *Error {
+	for len(s.pending) > 0 {
+		switch s.state {
+		case statePreamble, stateContent:
+			i := bytes.Index(s.pending, s.delimiter)
+			if i < 0 {
+				// Keep the bytes that may be the beginning of a delimiter
+				// and the carriage return before it.
+				n := len(s.pending)
+				if !eof {
+					n -= len(s.delimiter)
+				}
+				if n <= 0 {
+					return nil
+				}
+				if err := s.content(n); err != nil {
+					return err
+				}
+				s.pending = s.pending[n:]
+				return nil
+			}
+			n, closing, ok := s.boundary(s.pending[i:], eof)
+			if !ok {
+				// The boundary is followed by something else, so it is a
+				// part of the content.
+				if err := s.content(i + 1); err != nil {
+					return err
+				}
+				s.pending = s.pending[i+1:]
+				continue
+			}
+			// The carriage return before the delimiter is not a part of
+			// the content.
+			end := i
+			if end > 0 && s.pending[end-1] == '\r' {
+				end--
+			}
+			if err := s.content(end); err != nil {
+				return err
+			}
+			if n == 0 {
+				s.pending = s.pending[end:]
+				return nil
+			}
+			s.pending = s.pending[i+n:]
+			if closing {
+				s.state = stateEpilogue
+				s.info.mu.Lock()
+				s.info.done = true
+				s.info.mu.Unlock()
+				continue
+			}
+			s.info.mu.Lock()
+			parts := len(s.info.parts)
+			s.info.mu.Unlock()
+			if parts >= s.m.maxParts() {
+				return s.fail(&Error{Reason: ReasonTooManyParts})
+			}
+			s.state = stateHeader
+		case stateHeader:
+			i := bytes.IndexByte(s.pending, '\n')
+			if i < 0 {
+				if len(s.header)+len(s.pending) > maxHeaderSize {
+					return s.fail(&Error{Reason: ReasonMalformed})
+				}
+				return nil
+			}
+			line := s.pending[:i+1]
+			s.pending = s.pending[i+1:]
+			if len(bytes.TrimRight(line, "\r\n")) == 0 {
+				if err := s.parseHeader(); err != nil {
+					return err
+				}
+				continue
+			}
+			if len(s.header)+len(line) > maxHeaderSize {
+				return s.fail(&Error{Reason: ReasonMalformed})
+			}
+			s.header = append(s.header, line...)
+		case stateEpilogue:
+			s.pending = s.pending[:0]
+		}
+	}
+	return nil
+}
+
+// body enforces the policy while the handler reads it.
+type body struct {
+	io.ReadCloser
+	s   *scanner
+	err error
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.ReadCloser.Read(p)
+	s := b.s
+	s.total += int64(n)
+	if s.total > s.m.maxTotalSize() {
+		b.err = s.fail(&Error{Reason: ReasonTooLarge})
+		return 0, b.err
+	}
+	s.pending = append(s.pending, p[:n]...)
+	if serr := s.scan(err == io.EOF); serr != nil {
+		b.err = serr
+		return 0, b.err
+	}
+	return n, err
+}
+
+func (m *Middleware) reject(w http.ResponseWriter, r *http.Request, err *Error) {
+	m.RejectHandler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), errorKey{}, err)))
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Body == nil || r.Body == http.NoBody || mediaType != "multipart/form-data" {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+	if params["boundary"] == "" {
+		m.reject(w, r, &Error{Reason: ReasonMalformed})
+		return
+	}
+	if r.ContentLength > m.maxTotalSize() {
+		m.reject(w, r, &Error{Reason: ReasonTooLarge})
+		return
+	}
+	info := &Info{}
+	s := &scanner{
+		m:         m,
+		info:      info,
+		delimiter: []byte("\n--" + params["boundary"]),
+		pending:   []byte("\n"),
+	}
+	r = r.WithContext(context.WithValue(r.Context(), infoKey{}, info))
+	r.Body = &body{ReadCloser: r.Body, s: s}
+	m.handler.ServeHTTP(w, r)
+}
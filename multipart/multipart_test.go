@@ -0,0 +1,176 @@
+package multipart
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+type testPart struct {
+	name, filename, contentType, content string
+}
+
+func newRequest(t *testing.T, parts []testPart) *http.Request {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		h := textproto.MIMEHeader{}
+		disposition := `form-data; name="` + p.name + `"`
+		if p.filename != "" {
+			disposition += `; filename="` + p.filename + `"`
+		}
+		h.Set("Content-Disposition", disposition)
+		if p.contentType != "" {
+			h.Set("Content-Type", p.contentType)
+		}
+		pw, err := w.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pw.Write([]byte(p.content))
+	}
+	w.Close()
+	// Small reads make boundaries cross chunks.
+	r := httptest.NewRequest("POST", "/", iotest.HalfReader(iotest.OneByteReader(&buf)))
+	r.Header.Set("Content-Type", w.FormDataContentType())
+	return r
+}
+
+func TestMiddleware(t *testing.T) {
+	testCases := []struct {
+		name   string
+		parts  []testPart
+		reason string
+	}{
+		{
+			name: "valid",
+			parts: []testPart{
+				{name: "title", content: "a\r\n--b"},
+				{name: "file", filename: "a.png", contentType: "image/png", content: strings.Repeat("x", 10)},
+			},
+		},
+		{
+			name: "too many parts",
+			parts: []testPart{
+				{name: "a"}, {name: "b"}, {name: "c"}, {name: "d"},
+			},
+			reason: ReasonTooManyParts,
+		},
+		{
+			name: "part too large",
+			parts: []testPart{
+				{name: "file", filename: "a.png", contentType: "image/png", content: strings.Repeat("x", 11)},
+			},
+			reason: ReasonPartTooLarge,
+		},
+		{
+			name: "type not allowed",
+			parts: []testPart{
+				{name: "file", filename: "a.exe"},
+			},
+			reason: ReasonType,
+		},
+		{
+			name: "too large",
+			parts: []testPart{
+				{name: "a", content: strings.Repeat("x", 10)},
+				{name: "b", content: strings.Repeat("x", 10)},
+				{name: "c", content: strings.Repeat("x", 10)},
+			},
+			reason: ReasonTooLarge,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var info *Info
+			var parseErr error
+			m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				info = FromContext(r.Context())
+				parseErr = r.ParseMultipartForm(1 << 20)
+			}))
+			m.MaxParts = 3
+			m.MaxPartSize = 10
+			m.MaxTotalSize = 400
+			m.AllowedTypes = []string{"image/*"}
+			m.ServeHTTP(httptest.NewRecorder(), newRequest(t, tc.parts))
+
+			if info == nil {
+				t.Fatal("FromContext() = nil")
+			}
+			if tc.reason == "" {
+				if parseErr != nil || info.Err() != nil || !info.Done() {
+					t.Fatalf("ParseMultipartForm() = %v, Err() = %v, Done() = %v; want nil, nil, true", parseErr, info.Err(), info.Done())
+				}
+				expected := []Part{
+					{Name: "title", ContentType: "text/plain", Size: 6},
+					{Name: "file", FileName: "a.png", ContentType: "image/png", Size: 10},
+				}
+				parts := info.Parts()
+				if len(parts) != len(expected) {
+					t.Fatalf("Parts() = %+v, want %+v", parts, expected)
+				}
+				for i := range parts {
+					if parts[i] != expected[i] {
+						t.Errorf("part %d: got %+v, want %+v", i, parts[i], expected[i])
+					}
+				}
+				return
+			}
+			var err *Error
+			if !errors.As(info.Err(), &err) || err.Reason != tc.reason {
+				t.Fatalf("Err() = %v, want reason %s", info.Err(), tc.reason)
+			}
+			if parseErr == nil {
+				t.Fatal("ParseMultipartForm() = nil, want error")
+			}
+		})
+	}
+}
+
+func TestRejectBeforeHandler(t *testing.T) {
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the handler is called")
+	}))
+	m.MaxTotalSize = 10
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", 11)))
+	r.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, r)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Content-Length: status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	r = httptest.NewRequest("POST", "/", strings.NewReader(""))
+	r.Header.Set("Content-Type", "multipart/form-data")
+	rec = httptest.NewRecorder()
+	m.ServeHTTP(rec, r)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("no boundary: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestNotMultipart(t *testing.T) {
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if FromContext(r.Context()) != nil {
+			t.Error("FromContext() != nil for a non-multipart request")
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	m.MaxTotalSize = 1
+	r := httptest.NewRequest("POST", "/", strings.NewReader("a=1&b=2"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, r)
+	if rec.Body.String() != "a=1&b=2" {
+		t.Fatalf("body = %q, want %q", rec.Body.String(), "a=1&b=2")
+	}
+}
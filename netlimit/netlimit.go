@@ -0,0 +1,427 @@
+// Package netlimit protects servers from overload at the socket layer, before
+// requests reach HTTP middlewares.
+package netlimit
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Listener is a net.Listener that limits the number of open connections and
+// the accept rate.
+//
+// When all connection slots are taken, new connections wait in the kernel
+// backlog by default. With MaxPending they are accepted and either wait in a
+// bounded queue or are closed right away, and with EvictIdle connections
+// that don't carry requests are closed to make room for them, so that
+// clients that open connections and send nothing, or trickle bytes like
+// slowloris, cannot exhaust the slots before any request is parsed.
+type Listener struct {
+	net.Listener
+
+	// sem contains a token for each open connection.
+	sem chan struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	dropped  int64
+	rejected int64
+	evicted  int64
+
+	// pending receives connections accepted in the background if
+	// MaxPending is set.
+	pending     chan acceptResult
+	pendingOnce sync.Once
+
+	// connsMu protects conns and the states of the connections.
+	connsMu sync.Mutex
+	conns   map[*conn]struct{}
+
+	// mu protects the token bucket of the accept rate limit.
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	// AcceptRate, if positive, is the maximum number of connections accepted
+	// per second. Connections over the rate wait in the kernel backlog.
+	AcceptRate float64
+
+	// AcceptBurst is the number of connections that can be accepted at once
+	// above AcceptRate after the listener has been idle. It is at least 1.
+	AcceptBurst int
+
+	// Drop, if not nil, is called for every accepted connection before any
+	// data is read from it. If it returns true, the connection is closed
+	// immediately, so that blocked or abusive clients don't cost a TLS
+	// handshake. Dropped connections don't count against the limits.
+	Drop func(remote net.Addr) bool
+
+	// MaxPending, if positive, makes the listener accept connections in
+	// the background while all slots are taken. Up to MaxPending accepted
+	// connections wait for a slot, others are closed immediately, so that
+	// clients fail fast instead of waiting in the kernel backlog. It should
+	// be set before Accept is called.
+	MaxPending int
+
+	// EvictIdle, if positive, makes the listener close connections that
+	// have been idle between requests, or haven't sent a request since
+	// they were accepted, for at least EvictIdle when all slots are taken
+	// and a new connection is waiting. The longest idle connection is
+	// evicted first. It requires ConnState to be installed as
+	// http.Server.ConnState.
+	EvictIdle time.Duration
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// NewListener returns a Listener that accepts connections from ln while fewer
+// than maxConns of them are open. If maxConns is not positive, the number of
+// connections is not limited.
+func NewListener(ln net.Listener, maxConns int) *Listener {
+	l := &Listener{
+		Listener: ln,
+		done:     make(chan struct{}),
+		conns:    make(map[*conn]struct{}),
+		now:      time.Now,
+	}
+	if maxConns > 0 {
+		l.sem = make(chan struct{}, maxConns)
+	}
+	return l
+}
+
+// Dropped returns the number of connections closed because of Drop.
+func (l *Listener) Dropped() int64 {
+	return atomic.LoadInt64(&l.dropped)
+}
+
+// Rejected returns the number of connections closed because the pending
+// queue was full, see MaxPending.
+func (l *Listener) Rejected() int64 {
+	return atomic.LoadInt64(&l.rejected)
+}
+
+// Evicted returns the number of connections closed because of EvictIdle.
+func (l *Listener) Evicted() int64 {
+	return atomic.LoadInt64(&l.evicted)
+}
+
+func (l *Listener) burst() float64 {
+	if l.AcceptBurst < 1 {
+		return 1
+	}
+	return float64(l.AcceptBurst)
+}
+
+// reserve takes a token for the next connection and returns how long Accept
+// should wait to keep AcceptRate.
+func (l *Listener) reserve() time.Duration {
+	if l.AcceptRate <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if l.last.IsZero() {
+		l.tokens = l.burst()
+	} else if now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.AcceptRate
+		if burst := l.burst(); l.tokens > burst {
+			l.tokens = burst
+		}
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.AcceptRate * float64(time.Second))
+}
+
+// acquire waits for a free connection slot, evicting idle connections if
+// EvictIdle is set.
+func (l *Listener) acquire() error {
+	if l.sem == nil {
+		return nil
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	default:
+	}
+
+	var tick <-chan time.Time
+	if l.EvictIdle > 0 {
+		ticker := time.NewTicker(evictCheckInterval(l.EvictIdle))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		if l.EvictIdle > 0 {
+			l.evict()
+		}
+		select {
+		case l.sem <- struct{}{}:
+			return nil
+		case <-l.done:
+			return net.ErrClosed
+		case <-tick:
+		}
+	}
+}
+
+// evictCheckInterval returns how often a waiting Accept looks for idle
+// connections.
+func evictCheckInterval(evictIdle time.Duration) time.Duration {
+	d := evictIdle / 4
+	if d < 10*time.Millisecond {
+		d = 10 * time.Millisecond
+	}
+	if d > time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+// evict closes the connection that has been idle for the longest time if it
+// has been idle for at least EvictIdle.
+func (l *Listener) evict() {
+	now := l.now()
+	var victim *conn
+	l.connsMu.Lock()
+	for c := range l.conns {
+		if c.idle && now.Sub(c.idleSince) >= l.EvictIdle && (victim == nil || c.idleSince.Before(victim.idleSince)) {
+			victim = c
+		}
+	}
+	if victim != nil {
+		victim.idle = false
+	}
+	l.connsMu.Unlock()
+	if victim != nil {
+		victim.Close()
+		atomic.AddInt64(&l.evicted, 1)
+	}
+}
+
+// ConnState tracks the states of connections for EvictIdle. It should be
+// installed as http.Server.ConnState, possibly called by another hook.
+func (l *Listener) ConnState(nc net.Conn, state http.ConnState) {
+	// TLS connections wrap the connections of the listener.
+	for {
+		u, ok := nc.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		nc = u.NetConn()
+	}
+	c, ok := nc.(*conn)
+	if !ok {
+		return
+	}
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	switch state {
+	case http.StateNew, http.StateIdle:
+		c.idle = true
+		c.idleSince = l.now()
+	default:
+		c.idle = false
+	}
+}
+
+// acceptResult is a connection accepted in the background.
+type acceptResult struct {
+	c   net.Conn
+	err error
+}
+
+// acceptLoop accepts connections into the pending queue until the listener
+// is closed.
+func (l *Listener) acceptLoop() {
+	for {
+		c, err := l.accept()
+		if err != nil {
+			select {
+			case l.pending <- acceptResult{err: err}:
+			case <-l.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		select {
+		case l.pending <- acceptResult{c: c}:
+		default:
+			c.Close()
+			atomic.AddInt64(&l.rejected, 1)
+		}
+	}
+}
+
+// accept accepts the next connection that is not dropped.
+func (l *Listener) accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.Drop != nil && l.Drop(c.RemoteAddr()) {
+			c.Close()
+			atomic.AddInt64(&l.dropped, 1)
+			// The slot and the token are reused for the next
+			// connection.
+			continue
+		}
+		return c, nil
+	}
+}
+
+// next returns the next connection, either from the pending queue or from
+// the underlying listener.
+func (l *Listener) next() (net.Conn, error) {
+	if l.MaxPending <= 0 {
+		return l.accept()
+	}
+	l.pendingOnce.Do(func() {
+		l.pending = make(chan acceptResult, l.MaxPending)
+		go l.acceptLoop()
+	})
+	select {
+	case res := <-l.pending:
+		return res.c, res.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Accept waits for a free connection slot and for the next connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	if err := l.acquire(); err != nil {
+		return nil, err
+	}
+	release := func() {
+		if l.sem != nil {
+			<-l.sem
+		}
+	}
+
+	if wait := l.reserve(); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-l.done:
+			timer.Stop()
+			release()
+			return nil, net.ErrClosed
+		}
+	}
+
+	c, err := l.next()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	wrapped := &conn{Conn: c}
+	wrapped.release = func() {
+		l.connsMu.Lock()
+		delete(l.conns, wrapped)
+		l.connsMu.Unlock()
+		release()
+	}
+	l.connsMu.Lock()
+	l.conns[wrapped] = struct{}{}
+	l.connsMu.Unlock()
+	return wrapped, nil
+}
+
+// Close closes the listener. Open connections are not affected.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// conn frees its connection slot when it is closed.
+type conn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+
+	// idle and idleSince are protected by Listener.connsMu.
+	idle      bool
+	idleSince time.Time
+}
+
+func (c *conn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// DropAddrs returns a Drop function that drops connections from the given
+// addresses and networks, e.g. "192.0.2.1" or "198.51.100.0/24".
+func DropAddrs(addrs ...string) (func(remote net.Addr) bool, error) {
+	var nets []*net.IPNet
+	for _, a := range addrs {
+		if !strings.Contains(a, "/") {
+			if strings.Contains(a, ":") {
+				a += "/128"
+			} else {
+				a += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return func(remote net.Addr) bool {
+		var ip net.IP
+		switch addr := remote.(type) {
+		case *net.TCPAddr:
+			ip = addr.IP
+		case *net.UDPAddr:
+			ip = addr.IP
+		default:
+			return false
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// Serve runs srv.Serve on each of the listeners, e.g. ones created by
+// ListenReusePort, and returns the first error. If an acceptor loop fails,
+// the others are stopped by closing srv. After srv.Shutdown, which stops all
+// of them, srv is not closed, so that Shutdown can drain the connections.
+func Serve(srv *http.Server, listeners []net.Listener) error {
+	errs := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			errs <- srv.Serve(ln)
+		}(ln)
+	}
+	err := <-errs
+	if err != http.ErrServerClosed {
+		srv.Close()
+	}
+	for i := 1; i < len(listeners); i++ {
+		<-errs
+	}
+	return err
+}
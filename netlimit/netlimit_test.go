@@ -0,0 +1,318 @@
+package netlimit
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestListenerMaxConns(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := NewListener(inner, 1)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	first := <-accepted
+	select {
+	case <-accepted:
+		t.Fatal("the second connection is accepted while the first one is open")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("the second connection is not accepted after the first one is closed")
+	}
+}
+
+func TestListenerAcceptRate(t *testing.T) {
+	l := NewListener(nil, 0)
+	l.AcceptRate = 10
+	now := time.Unix(0, 0)
+	l.now = func() time.Time {
+		return now
+	}
+
+	for i, expected := range []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		if wait := l.reserve(); wait != expected {
+			t.Fatalf("reserve() #%d = %s, want %s", i, wait, expected)
+		}
+	}
+
+	// Idle time is accumulated up to the burst.
+	l.AcceptBurst = 2
+	now = now.Add(time.Minute)
+	for i, expected := range []time.Duration{0, 0, 100 * time.Millisecond} {
+		if wait := l.reserve(); wait != expected {
+			t.Fatalf("reserve() #%d after idle = %s, want %s", i, wait, expected)
+		}
+	}
+}
+
+func TestListenReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT load balancing is tested on linux only")
+	}
+	listeners, err := ListenReusePort(context.Background(), "tcp", "127.0.0.1:0", 2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listeners[0].Addr().String() != listeners[1].Addr().String() {
+		t.Fatalf("listeners are bound to %s and %s, want the same address", listeners[0].Addr(), listeners[1].Addr())
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	errs := make(chan error)
+	go func() {
+		errs <- Serve(srv, listeners)
+	}()
+
+	res, err := http.Get("http://" + listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "ok" {
+		t.Fatalf("body = %q, want ok", body)
+	}
+
+	srv.Close()
+	if err := <-errs; err != http.ErrServerClosed {
+		t.Fatalf("Serve() = %v, want %v", err, http.ErrServerClosed)
+	}
+}
+
+func TestListenerDrop(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := NewListener(inner, 1)
+	defer ln.Close()
+	blocked := true
+	ln.Drop = func(remote net.Addr) bool {
+		drop := blocked
+		blocked = false
+		return drop
+	}
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	// The first connection is dropped and doesn't take the only slot.
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if n := ln.Dropped(); n != 1 {
+		t.Fatalf("Dropped() = %d, want 1", n)
+	}
+}
+
+func TestDropAddrs(t *testing.T) {
+	drop, err := DropAddrs("192.0.2.1", "198.51.100.0/24", "2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		ip       string
+		expected bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"198.51.100.42", true},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+	}
+	for _, tc := range testCases {
+		if got := drop(&net.TCPAddr{IP: net.ParseIP(tc.ip)}); got != tc.expected {
+			t.Errorf("drop(%s) = %v, want %v", tc.ip, got, tc.expected)
+		}
+	}
+
+	if _, err := DropAddrs("not an address"); err == nil {
+		t.Fatal("DropAddrs() with an invalid address: got nil error")
+	}
+}
+
+func TestListenerMaxPending(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := NewListener(inner, 1)
+	ln.MaxPending = 1
+	defer ln.Close()
+
+	first, err := acceptAfterDial(t, ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	// The first connection holds the slot, the second one waits in the
+	// queue and the third one is closed.
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	deadline := time.Now().Add(time.Second)
+	for ln.Rejected() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Rejected() = %d, want 1", ln.Rejected())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	first.Close()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+// acceptAfterDial dials the listener and accepts the connection.
+func acceptAfterDial(t *testing.T, l *Listener) (net.Conn, error) {
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { c.Close() })
+	return l.Accept()
+}
+
+func TestListenerEvictIdle(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := NewListener(inner, 2)
+	ln.EvictIdle = 20 * time.Millisecond
+	defer ln.Close()
+
+	busy, err := acceptAfterDial(t, ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	ln.ConnState(busy, http.StateNew)
+	ln.ConnState(busy, http.StateActive)
+
+	idle, err := acceptAfterDial(t, ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.ConnState(idle, http.StateNew)
+
+	c, err := acceptAfterDial(t, ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := idle.Read(make([]byte, 1)); err == nil {
+		t.Fatal("the idle connection is not closed")
+	}
+	if _, err := busy.Write([]byte("x")); err != nil {
+		t.Fatalf("the active connection is closed: %v", err)
+	}
+	if evicted := ln.Evicted(); evicted != 1 {
+		t.Fatalf("Evicted() = %d, want 1", evicted)
+	}
+}
+
+func TestServeShutdown(t *testing.T) {
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, ln)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})}
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(srv, listeners)
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		res, err := http.Get("http://" + listeners[0].Addr().String() + "/")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		results <- result{body: string(body), err: err}
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- srv.Shutdown(context.Background())
+	}()
+	if err := <-served; err != http.ErrServerClosed {
+		t.Fatalf("Serve() = %v, want %v", err, http.ErrServerClosed)
+	}
+	close(release)
+	if res := <-results; res.err != nil || res.body != "done" {
+		t.Fatalf("in-flight request: %q, %v, want it to be drained by Shutdown", res.body, res.err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package netlimit
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	controlErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+// ListenReusePort creates n listeners bound to the same address with
+// SO_REUSEPORT, so that the kernel distributes incoming connections between
+// them and they can be accepted by n goroutines in parallel. Each listener
+// is wrapped into a Listener with its own limit of maxConns connections.
+func ListenReusePort(ctx context.Context, network, address string, n, maxConns int) ([]net.Listener, error) {
+	lc := net.ListenConfig{Control: reusePort}
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		ln, err := lc.Listen(ctx, network, address)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, err
+		}
+		// Other listeners should bind to the actual port, even if the
+		// address asks for a random one.
+		address = ln.Addr().String()
+		listeners = append(listeners, NewListener(ln, maxConns))
+	}
+	return listeners, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package netlimit
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ListenReusePort is not supported on this platform.
+func ListenReusePort(ctx context.Context, network, address string, n, maxConns int) ([]net.Listener, error) {
+	return nil, errors.New("netlimit: SO_REUSEPORT is not supported on this platform")
+}
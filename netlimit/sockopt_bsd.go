@@ -0,0 +1,8 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package netlimit
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,8 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+// +build linux
+// +build mips mipsle mips64 mips64le
+
+package netlimit
+
+// soReusePort is SO_REUSEPORT, it is missing in the frozen syscall package.
+const soReusePort = 0x200
@@ -0,0 +1,55 @@
+// Package kafkabroker implements an overflow.Broker that produces jobs to a
+// Kafka topic. Jobs are keyed by their IDs.
+package kafkabroker
+
+import (
+	"context"
+
+	"github.com/dmage/middleware/overflow"
+)
+
+// Producer is the subset of a Kafka client used by Broker. For example, a
+// kafka-go writer can be adapted as
+//
+//	kafkabroker.ProduceFunc(func(ctx context.Context, topic string, key, value []byte) error {
+//		return w.WriteMessages(ctx, kafka.Message{Topic: topic, Key: key, Value: value})
+//	})
+type Producer interface {
+	// Produce writes a message to topic and waits until it is
+	// acknowledged.
+	Produce(ctx context.Context, topic string, key, value []byte) error
+}
+
+// ProduceFunc is an adapter to allow the use of ordinary functions as
+// Producer.
+type ProduceFunc func(ctx context.Context, topic string, key, value []byte) error
+
+// Produce calls f(ctx, topic, key, value).
+func (f ProduceFunc) Produce(ctx context.Context, topic string, key, value []byte) error {
+	return f(ctx, topic, key, value)
+}
+
+// Broker implements overflow.Broker.
+type Broker struct {
+	producer Producer
+	topic    string
+}
+
+var _ overflow.Broker = (*Broker)(nil)
+
+// New returns a Broker that produces jobs to topic.
+func New(producer Producer, topic string) *Broker {
+	return &Broker{
+		producer: producer,
+		topic:    topic,
+	}
+}
+
+// Enqueue implements overflow.Broker.
+func (b *Broker) Enqueue(ctx context.Context, job *overflow.Job) error {
+	data, err := job.Marshal()
+	if err != nil {
+		return err
+	}
+	return b.producer.Produce(ctx, b.topic, []byte(job.ID), data)
+}
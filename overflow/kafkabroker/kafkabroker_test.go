@@ -0,0 +1,25 @@
+package kafkabroker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dmage/middleware/overflow"
+)
+
+func TestEnqueue(t *testing.T) {
+	var topic, key string
+	var value []byte
+	b := New(ProduceFunc(func(ctx context.Context, tp string, k, v []byte) error {
+		topic, key, value = tp, string(k), v
+		return nil
+	}), "reports")
+
+	if err := b.Enqueue(context.Background(), &overflow.Job{ID: "1", Method: "POST", URL: "/reports/"}); err != nil {
+		t.Fatalf("Enqueue() = %v, want nil", err)
+	}
+	job, err := overflow.Unmarshal(value)
+	if topic != "reports" || key != "1" || err != nil || job.ID != "1" {
+		t.Fatalf("produced %q with key %q to %q, want job 1 in reports", value, key, topic)
+	}
+}
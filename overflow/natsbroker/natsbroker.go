@@ -0,0 +1,56 @@
+// Package natsbroker implements an overflow.Broker that publishes jobs to a
+// NATS subject. Core NATS doesn't store messages, so the jobs should be
+// published to a JetStream stream.
+package natsbroker
+
+import (
+	"context"
+
+	"github.com/dmage/middleware/overflow"
+)
+
+// Publisher is the subset of a NATS client used by Broker. For example, a
+// JetStream context can be adapted as
+//
+//	natsbroker.PublishFunc(func(ctx context.Context, subject string, data []byte) error {
+//		_, err := js.Publish(ctx, subject, data)
+//		return err
+//	})
+type Publisher interface {
+	// Publish stores data in subject.
+	Publish(ctx context.Context, subject string, data []byte) error
+}
+
+// PublishFunc is an adapter to allow the use of ordinary functions as
+// Publisher.
+type PublishFunc func(ctx context.Context, subject string, data []byte) error
+
+// Publish calls f(ctx, subject, data).
+func (f PublishFunc) Publish(ctx context.Context, subject string, data []byte) error {
+	return f(ctx, subject, data)
+}
+
+// Broker implements overflow.Broker.
+type Broker struct {
+	publisher Publisher
+	subject   string
+}
+
+var _ overflow.Broker = (*Broker)(nil)
+
+// New returns a Broker that publishes jobs to subject.
+func New(publisher Publisher, subject string) *Broker {
+	return &Broker{
+		publisher: publisher,
+		subject:   subject,
+	}
+}
+
+// Enqueue implements overflow.Broker.
+func (b *Broker) Enqueue(ctx context.Context, job *overflow.Job) error {
+	data, err := job.Marshal()
+	if err != nil {
+		return err
+	}
+	return b.publisher.Publish(ctx, b.subject, data)
+}
@@ -0,0 +1,25 @@
+package natsbroker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dmage/middleware/overflow"
+)
+
+func TestEnqueue(t *testing.T) {
+	var subject string
+	var data []byte
+	b := New(PublishFunc(func(ctx context.Context, s string, d []byte) error {
+		subject, data = s, d
+		return nil
+	}), "jobs.reports")
+
+	if err := b.Enqueue(context.Background(), &overflow.Job{ID: "1", Method: "POST", URL: "/reports/"}); err != nil {
+		t.Fatalf("Enqueue() = %v, want nil", err)
+	}
+	job, err := overflow.Unmarshal(data)
+	if subject != "jobs.reports" || err != nil || job.ID != "1" {
+		t.Fatalf("published %q to %q, want job 1 in jobs.reports", data, subject)
+	}
+}
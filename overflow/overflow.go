@@ -0,0 +1,215 @@
+// Package overflow turns overload into deferred work. Requests to routes that
+// can be processed asynchronously, e.g. report generation or webhooks, are
+// not rejected when a limiter is full: Handler serializes them, enqueues them
+// to an external broker and answers 202 Accepted with a URL where the client
+// can check the status. Workers consume the jobs and replay them through the
+// handler when there is capacity.
+//
+// Handler is meant to be used as an overload handler, e.g.
+//
+//	h := maxconnections.New(100, 10, mux)
+//	of := overflow.New(broker, h.OverloadHandler)
+//	of.Handle("/reports/")
+//	h.OverloadHandler = of
+package overflow
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/dmage/middleware/maxconnections"
+	"github.com/dmage/middleware/requestid"
+)
+
+const defaultMaxBodySize = 1 << 20
+
+// ErrBodyTooLarge is returned when the request body is larger than
+// MaxBodySize.
+var ErrBodyTooLarge = errors.New("overflow: request body is too large")
+
+// Job is a serialized request.
+type Job struct {
+	// ID is the ID of the job. It is the request ID if the request has
+	// one, see requestid.FromContext.
+	ID string `json:"id"`
+
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+
+	// EnqueuedAt is the time when the request was deferred.
+	EnqueuedAt time.Time `json:"enqueued_at"`
+}
+
+// Marshal returns the JSON encoding of the job.
+func (j *Job) Marshal() ([]byte, error) {
+	return json.Marshal(j)
+}
+
+// Unmarshal parses a job encoded by Marshal.
+func Unmarshal(data []byte) (*Job, error) {
+	j := &Job{}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Request returns the request that the job has been created from, so that a
+// worker can pass it to the handler. The request ID is put into ctx.
+func (j *Job) Request(ctx context.Context) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(requestid.NewContext(ctx, j.ID), j.Method, j.URL, bytes.NewReader(j.Body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range j.Header {
+		req.Header[k] = v
+	}
+	req.RequestURI = j.URL
+	return req, nil
+}
+
+// NewJob reads the body of r and returns the job for it. The body can be up
+// to maxBodySize bytes.
+func NewJob(r *http.Request, maxBodySize int64) (*Job, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxBodySize {
+		return nil, ErrBodyTooLarge
+	}
+	id := requestid.FromContext(r.Context())
+	if id == "" {
+		id = requestid.Generate()
+	}
+	return &Job{
+		ID:         id,
+		Method:     r.Method,
+		URL:        r.URL.RequestURI(),
+		Header:     r.Header.Clone(),
+		Body:       body,
+		EnqueuedAt: time.Now(),
+	}, nil
+}
+
+// Broker is an external queue of jobs.
+type Broker interface {
+	// Enqueue durably stores the job for workers.
+	Enqueue(ctx context.Context, job *Job) error
+}
+
+// BrokerFunc is an adapter to allow the use of ordinary functions as Broker.
+type BrokerFunc func(ctx context.Context, job *Job) error
+
+// Enqueue calls f(ctx, job).
+func (f BrokerFunc) Enqueue(ctx context.Context, job *Job) error {
+	return f(ctx, job)
+}
+
+func defaultStatusURL(id string) string {
+	return "/jobs/" + id
+}
+
+// Handler implements the http.Handler interface.
+type Handler struct {
+	broker   Broker
+	fallback http.Handler
+	routes   []func(r *http.Request) bool
+
+	// MaxBodySize is the maximum size of the body of a deferred request.
+	// Requests with larger bodies are passed to the fallback handler. By
+	// default it is 1 MiB.
+	MaxBodySize int64
+
+	// StatusURL returns the URL where the status of the job id can be
+	// checked. It is sent in the Location header and in the response body.
+	// By default it is /jobs/{id}.
+	StatusURL func(id string) string
+
+	// OnError, if not nil, is called when a job cannot be enqueued. The
+	// request is passed to the fallback handler in this case.
+	OnError func(r *http.Request, err error)
+}
+
+// New returns a Handler that enqueues requests to registered routes to
+// broker and passes other requests to fallback, e.g.
+// maxconnections.OverloadHandler.
+func New(broker Broker, fallback http.Handler) *Handler {
+	return &Handler{
+		broker:      broker,
+		fallback:    fallback,
+		MaxBodySize: defaultMaxBodySize,
+		StatusURL:   defaultStatusURL,
+	}
+}
+
+// HandleFunc marks requests for which match returns true as asynchronous.
+func (h *Handler) HandleFunc(match func(r *http.Request) bool) {
+	h.routes = append(h.routes, match)
+}
+
+// Handle marks requests that match pattern as asynchronous, see
+// maxconnections.MatchPattern.
+func (h *Handler) Handle(pattern string) {
+	h.HandleFunc(maxconnections.MatchPattern(pattern))
+}
+
+// async reports whether r can be deferred.
+func (h *Handler) async(r *http.Request) bool {
+	for _, match := range h.routes {
+		if match(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// accepted is the body of a 202 response.
+type accepted struct {
+	ID        string `json:"id"`
+	StatusURL string `json:"status_url"`
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.async(r) {
+		h.fallback.ServeHTTP(w, r)
+		return
+	}
+
+	maxBodySize := h.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = defaultMaxBodySize
+	}
+	job, err := NewJob(r, maxBodySize)
+	if err == nil {
+		err = h.broker.Enqueue(r.Context(), job)
+	}
+	if err != nil {
+		if h.OnError != nil {
+			h.OnError(r, err)
+		}
+		// The body may have been consumed, the fallback handler is expected
+		// to reject the request.
+		h.fallback.ServeHTTP(w, r)
+		return
+	}
+
+	statusURL := h.StatusURL
+	if statusURL == nil {
+		statusURL = defaultStatusURL
+	}
+	body, _ := json.Marshal(accepted{ID: job.ID, StatusURL: statusURL(job.ID)})
+	body = append(body, '\n')
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", statusURL(job.ID))
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(body)
+}
@@ -0,0 +1,121 @@
+package overflow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmage/middleware/maxconnections"
+	"github.com/dmage/middleware/requestid"
+)
+
+func TestHandler(t *testing.T) {
+	var jobs []*Job
+	var brokerErr error
+	broker := BrokerFunc(func(ctx context.Context, job *Job) error {
+		if brokerErr != nil {
+			return brokerErr
+		}
+		data, err := job.Marshal()
+		if err != nil {
+			return err
+		}
+		job, err = Unmarshal(data)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, job)
+		return nil
+	})
+
+	block := make(chan struct{})
+	var replayed string
+	mux := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Block") != "" {
+			<-block
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		replayed = r.Method + " " + r.URL.String() + " " + string(body) + " " + requestid.FromContext(r.Context())
+	})
+	h := maxconnections.New(1, 0, mux)
+	of := New(broker, h.OverloadHandler)
+	of.Handle("/reports/")
+	h.OverloadHandler = of
+
+	// Occupy the limiter.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Block", "1")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}()
+	for h.Stats().Running != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	defer func() {
+		close(block)
+		<-done
+	}()
+
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/reports/sales?year=2026", strings.NewReader("{}"))
+	h.ServeHTTP(rec, r.WithContext(requestid.NewContext(r.Context(), "req-1")))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	if location := rec.Header().Get("Location"); location != "/jobs/req-1" {
+		t.Fatalf("Location = %q, want %q", location, "/jobs/req-1")
+	}
+	var res accepted
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || res.ID != "req-1" {
+		t.Fatalf("response = %q, want the job ID", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/other", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d for a synchronous route, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	var enqueueErr error
+	of.OnError = func(r *http.Request, err error) {
+		enqueueErr = err
+	}
+	brokerErr = errors.New("broker is down")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/reports/x", nil))
+	if rec.Code != http.StatusServiceUnavailable || enqueueErr != brokerErr {
+		t.Fatalf("status = %d, error = %v; want %d, %v", rec.Code, enqueueErr, http.StatusServiceUnavailable, brokerErr)
+	}
+
+	if len(jobs) != 1 {
+		t.Fatalf("got %d jobs, want 1", len(jobs))
+	}
+	req, err := jobs[0].Request(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	if expected := "POST /reports/sales?year=2026 {} req-1"; replayed != expected {
+		t.Fatalf("replayed %q, want %q", replayed, expected)
+	}
+}
+
+func TestBodyTooLarge(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", strings.NewReader("0123456789"))
+	if _, err := NewJob(r, 9); err != ErrBodyTooLarge {
+		t.Fatalf("NewJob() = %v, want %v", err, ErrBodyTooLarge)
+	}
+	r = httptest.NewRequest("POST", "/", strings.NewReader("0123456789"))
+	if job, err := NewJob(r, 10); err != nil || string(job.Body) != "0123456789" || job.ID == "" {
+		t.Fatalf("NewJob() = %+v, %v; want a job with the body", job, err)
+	}
+}
@@ -0,0 +1,55 @@
+// Package sqsbroker implements an overflow.Broker that sends jobs to an
+// Amazon SQS queue.
+package sqsbroker
+
+import (
+	"context"
+
+	"github.com/dmage/middleware/overflow"
+)
+
+// Sender is the subset of an SQS client used by Broker. For example, an AWS
+// SDK v2 client can be adapted as
+//
+//	sqsbroker.SendFunc(func(ctx context.Context, queueURL, body string) error {
+//		_, err := client.SendMessage(ctx, &sqs.SendMessageInput{QueueUrl: &queueURL, MessageBody: &body})
+//		return err
+//	})
+type Sender interface {
+	// SendMessage sends a message with body to the queue.
+	SendMessage(ctx context.Context, queueURL, body string) error
+}
+
+// SendFunc is an adapter to allow the use of ordinary functions as Sender.
+type SendFunc func(ctx context.Context, queueURL, body string) error
+
+// SendMessage calls f(ctx, queueURL, body).
+func (f SendFunc) SendMessage(ctx context.Context, queueURL, body string) error {
+	return f(ctx, queueURL, body)
+}
+
+// Broker implements overflow.Broker.
+type Broker struct {
+	sender   Sender
+	queueURL string
+}
+
+var _ overflow.Broker = (*Broker)(nil)
+
+// New returns a Broker that sends jobs to the queue queueURL.
+func New(sender Sender, queueURL string) *Broker {
+	return &Broker{
+		sender:   sender,
+		queueURL: queueURL,
+	}
+}
+
+// Enqueue implements overflow.Broker. SQS limits the size of messages, so
+// Handler.MaxBodySize should be lowered accordingly.
+func (b *Broker) Enqueue(ctx context.Context, job *overflow.Job) error {
+	data, err := job.Marshal()
+	if err != nil {
+		return err
+	}
+	return b.sender.SendMessage(ctx, b.queueURL, string(data))
+}
@@ -0,0 +1,24 @@
+package sqsbroker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dmage/middleware/overflow"
+)
+
+func TestEnqueue(t *testing.T) {
+	var queueURL, body string
+	b := New(SendFunc(func(ctx context.Context, u, b string) error {
+		queueURL, body = u, b
+		return nil
+	}), "https://sqs.example.com/jobs")
+
+	if err := b.Enqueue(context.Background(), &overflow.Job{ID: "1", Method: "POST", URL: "/reports/"}); err != nil {
+		t.Fatalf("Enqueue() = %v, want nil", err)
+	}
+	job, err := overflow.Unmarshal([]byte(body))
+	if queueURL != "https://sqs.example.com/jobs" || err != nil || job.ID != "1" {
+		t.Fatalf("sent %q to %q, want job 1", body, queueURL)
+	}
+}
@@ -0,0 +1,220 @@
+// Package pageguard validates and caps pagination parameters of requests.
+// Huge page sizes and deep offsets are a common cause of slow handlers that
+// hold running slots of maxconnections for a long time, so such requests are
+// rejected or capped before they reach the handler. Valid parameters are
+// passed to the handler in the request context, see FromContext.
+package pageguard
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/dmage/middleware/decisionlog"
+	"github.com/dmage/middleware/maxconnections"
+)
+
+var (
+	// ErrInvalid is returned for parameters that are not non-negative
+	// integers.
+	ErrInvalid = errors.New("pageguard: invalid pagination parameter")
+
+	// ErrLimitTooLarge is returned when the page size exceeds MaxLimit.
+	ErrLimitTooLarge = errors.New("pageguard: page size is too large")
+
+	// ErrOffsetTooLarge is returned when the offset exceeds MaxOffset.
+	ErrOffsetTooLarge = errors.New("pageguard: offset is too large")
+
+	// ErrCursorTooLong is returned when the cursor is longer than
+	// MaxCursorLength.
+	ErrCursorTooLong = errors.New("pageguard: cursor is too long")
+
+	// ErrCursorAndOffset is returned when both a cursor and an offset are
+	// given.
+	ErrCursorAndOffset = errors.New("pageguard: cursor and offset are mutually exclusive")
+)
+
+// Page contains normalized pagination parameters of a request.
+type Page struct {
+	Limit  int
+	Offset int
+	Cursor string
+}
+
+type pageKey struct{}
+
+// FromContext returns the pagination parameters of the request with ctx. It
+// returns false if the request hasn't passed through the middleware.
+func FromContext(ctx context.Context) (Page, bool) {
+	p, ok := ctx.Value(pageKey{}).(Page)
+	return p, ok
+}
+
+// Rule defines valid pagination parameters.
+type Rule struct {
+	// DefaultLimit is the page size for requests without a limit or with
+	// a zero limit. If it is not positive, MaxLimit is used.
+	DefaultLimit int
+
+	// MaxLimit, if positive, is the maximum page size.
+	MaxLimit int
+
+	// Clamp makes page sizes larger than MaxLimit reduced to MaxLimit
+	// instead of rejected.
+	Clamp bool
+
+	// MaxOffset, if positive, is the maximum offset. Deep offsets are
+	// expensive for most databases, clients should use cursors instead.
+	MaxOffset int
+
+	// MaxCursorLength, if positive, is the maximum length of a cursor.
+	MaxCursorLength int
+}
+
+// parseInt parses a non-negative integer parameter. An empty value is 0.
+func parseInt(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, ErrInvalid
+	}
+	return n, nil
+}
+
+// Parse validates the limit, offset and cursor parameters according to the
+// rule and returns them normalized.
+func (rule Rule) Parse(limit, offset, cursor string) (Page, error) {
+	var p Page
+	var err error
+	if p.Limit, err = parseInt(limit); err != nil {
+		return Page{}, err
+	}
+	if p.Offset, err = parseInt(offset); err != nil {
+		return Page{}, err
+	}
+	p.Cursor = cursor
+
+	if p.Limit == 0 {
+		p.Limit = rule.DefaultLimit
+		if p.Limit <= 0 {
+			p.Limit = rule.MaxLimit
+		}
+	}
+	if rule.MaxLimit > 0 && p.Limit > rule.MaxLimit {
+		if !rule.Clamp {
+			return Page{}, ErrLimitTooLarge
+		}
+		p.Limit = rule.MaxLimit
+	}
+	if rule.MaxOffset > 0 && p.Offset > rule.MaxOffset {
+		return Page{}, ErrOffsetTooLarge
+	}
+	if rule.MaxCursorLength > 0 && len(p.Cursor) > rule.MaxCursorLength {
+		return Page{}, ErrCursorTooLong
+	}
+	if p.Cursor != "" && p.Offset > 0 {
+		return Page{}, ErrCursorAndOffset
+	}
+	return p, nil
+}
+
+func defaultBadRequestHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "400 invalid pagination parameters", http.StatusBadRequest)
+}
+
+// BadRequestHandler is a default BadRequestHandler for Middleware.
+var BadRequestHandler http.Handler = http.HandlerFunc(defaultBadRequestHandler)
+
+// route is a set of requests with their own rule.
+type route struct {
+	match func(r *http.Request) bool
+	rule  Rule
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler  http.Handler
+	routes   []route
+	def      Rule
+	rejected int64
+
+	// LimitParam, OffsetParam and CursorParam are the names of the query
+	// parameters. By default they are "limit", "offset" and "cursor".
+	LimitParam  string
+	OffsetParam string
+	CursorParam string
+
+	// BadRequestHandler is called for requests with invalid or abusive
+	// pagination parameters.
+	BadRequestHandler http.Handler
+
+	// OnReject, if not nil, is called for each rejected request with the
+	// reason of the rejection.
+	OnReject func(r *http.Request, err error)
+}
+
+// New returns an http.Handler that validates pagination parameters of
+// requests with def, unless a more specific rule is registered for them, and
+// passes valid requests to h. Routes should be registered before the
+// middleware starts serving requests.
+func New(h http.Handler, def Rule) *Middleware {
+	return &Middleware{
+		handler:           h,
+		def:               def,
+		LimitParam:        "limit",
+		OffsetParam:       "offset",
+		CursorParam:       "cursor",
+		BadRequestHandler: BadRequestHandler,
+	}
+}
+
+// HandleFunc registers rule for requests for which match returns true.
+// Routes are matched in the order they are registered.
+func (m *Middleware) HandleFunc(match func(r *http.Request) bool, rule Rule) {
+	m.routes = append(m.routes, route{match: match, rule: rule})
+}
+
+// Handle registers rule for requests that match pattern, see
+// maxconnections.MatchPattern.
+func (m *Middleware) Handle(pattern string, rule Rule) {
+	m.HandleFunc(maxconnections.MatchPattern(pattern), rule)
+}
+
+// Rule returns the rule for r.
+func (m *Middleware) Rule(r *http.Request) Rule {
+	for _, route := range m.routes {
+		if route.match(r) {
+			return route.rule
+		}
+	}
+	return m.def
+}
+
+// Rejected returns the number of rejected requests.
+func (m *Middleware) Rejected() int64 {
+	return atomic.LoadInt64(&m.rejected)
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	p, err := m.Rule(r).Parse(query.Get(m.LimitParam), query.Get(m.OffsetParam), query.Get(m.CursorParam))
+	if err != nil {
+		atomic.AddInt64(&m.rejected, 1)
+		decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "pageguard", Action: decisionlog.Deny, Reason: err.Error()})
+		if m.OnReject != nil {
+			m.OnReject(r, err)
+		}
+		m.BadRequestHandler.ServeHTTP(w, r)
+		return
+	}
+	if decisionlog.Sampled(r.Context()) {
+		if limit, err := strconv.Atoi(query.Get(m.LimitParam)); err == nil && limit > p.Limit {
+			decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "pageguard", Action: decisionlog.Transform, Rule: m.LimitParam, Reason: "limit clamped to " + strconv.Itoa(p.Limit)})
+		}
+	}
+	m.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), pageKey{}, p)))
+}
@@ -0,0 +1,79 @@
+package pageguard
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRuleParse(t *testing.T) {
+	rule := Rule{DefaultLimit: 20, MaxLimit: 100, MaxOffset: 1000, MaxCursorLength: 8}
+	testCases := []struct {
+		limit, offset, cursor string
+		expected              Page
+		err                   error
+	}{
+		{"", "", "", Page{Limit: 20}, nil},
+		{"0", "", "", Page{Limit: 20}, nil},
+		{"50", "200", "", Page{Limit: 50, Offset: 200}, nil},
+		{"100", "", "abc", Page{Limit: 100, Cursor: "abc"}, nil},
+		{"101", "", "", Page{}, ErrLimitTooLarge},
+		{"-1", "", "", Page{}, ErrInvalid},
+		{"ten", "", "", Page{}, ErrInvalid},
+		{"", "1001", "", Page{}, ErrOffsetTooLarge},
+		{"", "", "abcdefghi", Page{}, ErrCursorTooLong},
+		{"", "10", "abc", Page{}, ErrCursorAndOffset},
+	}
+	for _, tc := range testCases {
+		p, err := rule.Parse(tc.limit, tc.offset, tc.cursor)
+		if p != tc.expected || err != tc.err {
+			t.Errorf("Parse(%q, %q, %q) = %+v, %v; want %+v, %v", tc.limit, tc.offset, tc.cursor, p, err, tc.expected, tc.err)
+		}
+	}
+
+	rule.Clamp = true
+	if p, err := rule.Parse("1000", "", ""); p.Limit != 100 || err != nil {
+		t.Errorf("clamped Parse(1000) = %+v, %v; want limit 100", p, err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := FromContext(r.Context())
+		if !ok {
+			t.Errorf("%s: no page in context", r.URL)
+		}
+		fmt.Fprintf(w, "%d %d %s", p.Limit, p.Offset, p.Cursor)
+	}), Rule{DefaultLimit: 10, MaxLimit: 50})
+	m.Handle("GET /export/", Rule{MaxLimit: 1000})
+	var reasons []error
+	m.OnReject = func(r *http.Request, err error) {
+		reasons = append(reasons, err)
+	}
+
+	testCases := []struct {
+		url      string
+		status   int
+		expected string
+	}{
+		{"/items", http.StatusOK, "10 0 "},
+		{"/items?limit=20&offset=40", http.StatusOK, "20 40 "},
+		{"/items?limit=500", http.StatusBadRequest, "400 invalid pagination parameters\n"},
+		{"/export/items?limit=500&cursor=x", http.StatusOK, "500 0 x"},
+		{"/export/items", http.StatusOK, "1000 0 "},
+	}
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("GET", tc.url, nil))
+		if rec.Code != tc.status {
+			t.Errorf("%s: status = %d, want %d", tc.url, rec.Code, tc.status)
+		}
+		if body := rec.Body.String(); body != tc.expected {
+			t.Errorf("%s: body = %q, want %q", tc.url, body, tc.expected)
+		}
+	}
+	if m.Rejected() != 1 || len(reasons) != 1 || reasons[0] != ErrLimitTooLarge {
+		t.Fatalf("Rejected() = %d, reasons = %v; want 1 rejection with %v", m.Rejected(), reasons, ErrLimitTooLarge)
+	}
+}
@@ -0,0 +1,264 @@
+// Package paramguard rejects requests with suspicious parameters: duplicate
+// keys (HTTP parameter pollution), values that differ between the query and
+// a form body, too long arrays, and too many or too large parameters.
+// Handlers and frameworks resolve duplicates differently, e.g. the first or
+// the last value wins, so a request that passes a check in one layer can be
+// interpreted differently by the next one.
+package paramguard
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dmage/middleware/decisionlog"
+)
+
+const (
+	defaultMaxParams   = 100
+	defaultMaxValues   = 100
+	defaultMaxSize     = 64 << 10
+	defaultMaxFormBody = 1 << 20
+)
+
+// Reasons of rejections, see Error.
+const (
+	ReasonMalformed = "malformed"
+	ReasonDuplicate = "duplicate"
+	ReasonConflict  = "conflict"
+	ReasonTooMany   = "too_many_params"
+	ReasonTooLarge  = "too_large"
+	ReasonArray     = "array_too_long"
+)
+
+// Error describes why a request was rejected.
+type Error struct {
+	// Reason is one of the Reason constants.
+	Reason string `json:"reason"`
+
+	// Param is the name of the offending parameter, if there is one.
+	Param string `json:"param,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Param == "" {
+		return "paramguard: " + e.Reason
+	}
+	return fmt.Sprintf("paramguard: %s: %s", e.Reason, e.Param)
+}
+
+type errorKey struct{}
+
+// ErrorFromContext returns the reason of the rejection of the request with
+// ctx. It is available to BadRequestHandler.
+func ErrorFromContext(ctx context.Context) *Error {
+	err, _ := ctx.Value(errorKey{}).(*Error)
+	return err
+}
+
+func defaultBadRequestHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(struct {
+		Title  string `json:"title"`
+		Status int    `json:"status"`
+		*Error
+	}{
+		Title:  "invalid request parameters",
+		Status: http.StatusBadRequest,
+		Error:  ErrorFromContext(r.Context()),
+	})
+}
+
+// BadRequestHandler is a default BadRequestHandler for Middleware. It writes
+// the Error as an RFC 7807 problem.
+var BadRequestHandler http.Handler = http.HandlerFunc(defaultBadRequestHandler)
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler http.Handler
+
+	// Arrays are the names of parameters that may be repeated, e.g.
+	// "ids" or "tag[]". Other parameters may be given only once.
+	Arrays []string
+
+	// MaxParams is the maximum number of parameters in the query and the
+	// form body together. By default it is 100.
+	MaxParams int
+
+	// MaxValues is the maximum number of values of an array parameter. By
+	// default it is 100.
+	MaxValues int
+
+	// MaxSize is the maximum total size of parameter names and values in
+	// bytes. By default it is 64 KiB.
+	MaxSize int
+
+	// MaxFormBody is the maximum size of a form body that is inspected. The
+	// body is buffered and passed to the handler. Larger bodies are
+	// rejected. By default it is 1 MiB.
+	MaxFormBody int64
+
+	// BadRequestHandler is called for rejected requests, the reason is
+	// available from ErrorFromContext.
+	BadRequestHandler http.Handler
+}
+
+// New returns an http.Handler that checks parameters of requests and passes
+// valid requests to h.
+func New(h http.Handler) *Middleware {
+	return &Middleware{
+		handler:           h,
+		MaxParams:         defaultMaxParams,
+		MaxValues:         defaultMaxValues,
+		MaxSize:           defaultMaxSize,
+		MaxFormBody:       defaultMaxFormBody,
+		BadRequestHandler: BadRequestHandler,
+	}
+}
+
+func orDefault(value, def int) int {
+	if value <= 0 {
+		return def
+	}
+	return value
+}
+
+// isArray reports whether key may be repeated.
+func (m *Middleware) isArray(key string) bool {
+	for _, a := range m.Arrays {
+		if a == key {
+			return true
+		}
+	}
+	return false
+}
+
+// checkValues checks parameters from one source.
+func (m *Middleware) checkValues(values url.Values) *Error {
+	maxValues := orDefault(m.MaxValues, defaultMaxValues)
+	for key, vs := range values {
+		if len(vs) < 2 {
+			continue
+		}
+		if !m.isArray(key) {
+			return &Error{Reason: ReasonDuplicate, Param: key}
+		}
+		if len(vs) > maxValues {
+			return &Error{Reason: ReasonArray, Param: key}
+		}
+	}
+	return nil
+}
+
+// equal reports whether a and b contain the same values in the same order.
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// check checks the query and the form body of a request.
+func (m *Middleware) check(query, form url.Values) *Error {
+	count, size := 0, 0
+	for _, values := range []url.Values{query, form} {
+		for key, vs := range values {
+			count += len(vs)
+			for _, v := range vs {
+				size += len(key) + len(v)
+			}
+		}
+	}
+	if count > orDefault(m.MaxParams, defaultMaxParams) {
+		return &Error{Reason: ReasonTooMany}
+	}
+	if size > orDefault(m.MaxSize, defaultMaxSize) {
+		return &Error{Reason: ReasonTooLarge}
+	}
+	if err := m.checkValues(query); err != nil {
+		return err
+	}
+	if err := m.checkValues(form); err != nil {
+		return err
+	}
+	for key, vs := range form {
+		qs, ok := query[key]
+		if !ok {
+			continue
+		}
+		// The same key in both places is pollution unless it is the same
+		// value, e.g. a form that posts back its own query.
+		if !m.isArray(key) && !equal(qs, vs) {
+			return &Error{Reason: ReasonConflict, Param: key}
+		}
+	}
+	return nil
+}
+
+// readForm reads the form body of r, if it has one, and replaces r.Body
+// with a reader of the same bytes.
+func (m *Middleware) readForm(r *http.Request) (url.Values, *Error) {
+	if r.Body == nil || r.Method == "GET" || r.Method == "HEAD" {
+		return nil, nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		return nil, nil
+	}
+	maxFormBody := m.MaxFormBody
+	if maxFormBody <= 0 {
+		maxFormBody = defaultMaxFormBody
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxFormBody+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, &Error{Reason: ReasonMalformed}
+	}
+	if int64(len(body)) > maxFormBody {
+		return nil, &Error{Reason: ReasonTooLarge}
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, &Error{Reason: ReasonMalformed}
+	}
+	return form, nil
+}
+
+func (m *Middleware) reject(w http.ResponseWriter, r *http.Request, err *Error) {
+	decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "paramguard", Action: decisionlog.Deny, Rule: err.Param, Reason: err.Reason})
+	m.BadRequestHandler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), errorKey{}, err)))
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// url.ParseQuery drops pairs with a semicolon and reports an error, a
+	// proxy in front of the handler may split them differently.
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil || strings.Contains(r.URL.RawQuery, ";") {
+		m.reject(w, r, &Error{Reason: ReasonMalformed})
+		return
+	}
+	form, perr := m.readForm(r)
+	if perr == nil {
+		perr = m.check(query, form)
+	}
+	if perr != nil {
+		m.reject(w, r, perr)
+		return
+	}
+	m.handler.ServeHTTP(w, r)
+}
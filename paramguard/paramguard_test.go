@@ -0,0 +1,78 @@
+package paramguard
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	m.Arrays = []string{"id"}
+	m.MaxParams = 6
+	m.MaxValues = 3
+	m.MaxSize = 100
+
+	testCases := []struct {
+		method string
+		url    string
+		body   string
+		reason string
+		param  string
+	}{
+		{"GET", "/?a=1&id=1&id=2", "", "", ""},
+		{"GET", "/?a=1&a=2", "", ReasonDuplicate, "a"},
+		{"GET", "/?id=1&id=2&id=3&id=4", "", ReasonArray, "id"},
+		{"GET", "/?a=1&b=2&c=3&d=4&e=5&f=6&g=7", "", ReasonTooMany, ""},
+		{"GET", "/?a=" + strings.Repeat("x", 100), "", ReasonTooLarge, ""},
+		{"GET", "/?a=1;b=2", "", ReasonMalformed, ""},
+		{"GET", "/?a=%zz", "", ReasonMalformed, ""},
+		{"POST", "/?a=1", "b=2", "", ""},
+		{"POST", "/?a=1", "a=1", "", ""},
+		{"POST", "/?a=1", "a=2", ReasonConflict, "a"},
+		{"POST", "/?id=1", "id=2", "", ""},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+		if tc.method == "POST" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, r)
+		if tc.reason == "" {
+			if rec.Code != http.StatusOK || rec.Body.String() != tc.body {
+				t.Errorf("%s %s: status = %d, body = %q; want 200 with the request body", tc.method, tc.url, rec.Code, rec.Body.String())
+			}
+			continue
+		}
+		var problem struct {
+			Status int
+			Reason string
+			Param  string
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+			t.Fatalf("%s %s: unmarshal %q: %v", tc.method, tc.url, rec.Body.String(), err)
+		}
+		if rec.Code != http.StatusBadRequest || problem.Status != http.StatusBadRequest || problem.Reason != tc.reason || problem.Param != tc.param {
+			t.Errorf("%s %s: status = %d, problem = %+v; want 400 with reason %s, param %q", tc.method, tc.url, rec.Code, problem, tc.reason, tc.param)
+		}
+	}
+}
+
+func TestMaxFormBody(t *testing.T) {
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	m.MaxFormBody = 10
+	r := httptest.NewRequest("POST", "/", strings.NewReader("a="+strings.Repeat("x", 10)))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, r)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshotter is implemented by components whose state is expensive to lose
+// on restart, e.g. the counters of quota.MemoryStore or the limit learned by
+// adaptivelimit.Middleware. Without it, every deploy resets daily quotas and
+// makes adaptive limits start from scratch, which causes overload right
+// after the deploy.
+type Snapshotter interface {
+	// Snapshot returns the state of the component as JSON.
+	Snapshot() ([]byte, error)
+
+	// Restore replaces the state of the component with data returned by
+	// Snapshot, possibly of another process.
+	Restore(data []byte) error
+}
+
+// Persist saves the state of s with save every interval until ctx is done,
+// and once more after that, so that the state is saved on a graceful
+// shutdown. Errors are passed to onError if it is not nil.
+//
+//	if err := middleware.RestoreFile(quotas, "/var/lib/app/quotas.json"); err != nil {
+//		log.Print(err)
+//	}
+//	go middleware.Persist(ctx, quotas, time.Minute, middleware.SaveFile("/var/lib/app/quotas.json"), nil)
+func Persist(ctx context.Context, s Snapshotter, interval time.Duration, save func(data []byte) error, onError func(error)) {
+	persist := func() {
+		data, err := s.Snapshot()
+		if err == nil {
+			err = save(data)
+		}
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			persist()
+			return
+		case <-ticker.C:
+			persist()
+		}
+	}
+}
+
+// SaveFile returns a function for Persist that writes snapshots to the file
+// path. The file is replaced atomically, so a crash during the write leaves
+// the previous snapshot.
+func SaveFile(path string) func(data []byte) error {
+	return func(data []byte) error {
+		f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		if err := f.Close(); err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		if err := os.Rename(f.Name(), path); err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		return nil
+	}
+}
+
+// RestoreFile restores the state of s from the file path written by
+// SaveFile. It does nothing if the file doesn't exist, e.g. on the first
+// start.
+func RestoreFile(s Snapshotter, path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.Restore(data)
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeSnapshotter struct {
+	state string
+}
+
+func (s *fakeSnapshotter) Snapshot() ([]byte, error) {
+	return []byte(s.state), nil
+}
+
+func (s *fakeSnapshotter) Restore(data []byte) error {
+	s.state = string(data)
+	return nil
+}
+
+func TestPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	restored := &fakeSnapshotter{state: "initial"}
+	if err := RestoreFile(restored, path); err != nil {
+		t.Fatalf("RestoreFile() without a file: %v", err)
+	}
+	if restored.state != "initial" {
+		t.Fatalf("state = %q, want it to be unchanged without a file", restored.state)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Persist(ctx, &fakeSnapshotter{state: "saved"}, time.Hour, SaveFile(path), func(err error) {
+			t.Errorf("Persist: %v", err)
+		})
+	}()
+	// The state is saved on shutdown even if the interval hasn't passed.
+	cancel()
+	<-done
+
+	if err := RestoreFile(restored, path); err != nil {
+		t.Fatal(err)
+	}
+	if restored.state != "saved" {
+		t.Fatalf("state = %q, want %q", restored.state, "saved")
+	}
+}
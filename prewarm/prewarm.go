@@ -0,0 +1,272 @@
+// Package prewarm keeps connections to upstreams warm, so that requests after
+// an idle period don't pay for TCP connects and TLS handshakes.
+//
+// Transport tracks how many requests are in flight to each upstream. Prewarm
+// sends as many concurrent lightweight requests to every recently used
+// upstream as were in flight at the peak of the last intervals, so that the
+// pool of the underlying transport holds enough idle connections for the
+// next burst. Besides the tail latency, this makes latency-based signals of
+// adaptive limiters less noisy, as they don't see handshakes as slowdowns of
+// upstreams.
+//
+// For TLS upstreams, the underlying transport should have a
+// tls.ClientSessionCache, so that connections that have to be opened anyway
+// resume sessions established by prewarming instead of doing full
+// handshakes.
+package prewarm
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMethod   = "HEAD"
+	defaultPath     = "/"
+	defaultMinConns = 1
+	defaultMaxConns = 16
+	defaultInterval = 30 * time.Second
+	defaultIdle     = 10 * time.Minute
+	defaultTimeout  = 5 * time.Second
+)
+
+type prewarmKey struct{}
+
+// IsPrewarm reports whether a request with ctx is sent by Prewarm.
+func IsPrewarm(ctx context.Context) bool {
+	return ctx.Value(prewarmKey{}) != nil
+}
+
+// Stats contains counters of prewarming requests.
+type Stats struct {
+	// Upstreams is the number of upstreams that are kept warm.
+	Upstreams int `json:"upstreams"`
+
+	// Requests is the total number of prewarming requests.
+	Requests int64 `json:"requests"`
+
+	// Failures is the total number of prewarming requests that have failed.
+	Failures int64 `json:"failures"`
+}
+
+// upstream is the traffic of a single scheme and host.
+type upstream struct {
+	scheme, host string
+	inflight     int
+	peak         int // the peak of the current interval
+	prevPeak     int // the peak of the previous interval
+	lastUsed     time.Time
+}
+
+// Transport implements the http.RoundTripper interface.
+type Transport struct {
+	next http.RoundTripper
+
+	mu        sync.Mutex
+	upstreams map[string]*upstream
+	stats     Stats
+
+	// Method and Path are used for prewarming requests. Upstreams should
+	// answer them cheaply. By default they are HEAD and /.
+	Method string
+	Path   string
+
+	// MinConns and MaxConns bound the number of connections that are kept
+	// warm for each upstream. By default they are 1 and 16.
+	MinConns int
+	MaxConns int
+
+	// Interval is how often Run prewarms connections. It should be less
+	// than the idle connection timeout of the underlying transport. By
+	// default it is 30 seconds.
+	Interval time.Duration
+
+	// Idle is how long an upstream is kept warm after its last request. By
+	// default it is 10 minutes.
+	Idle time.Duration
+
+	// Timeout limits a round of prewarming requests. By default it is 5
+	// seconds.
+	Timeout time.Duration
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// New returns an http.RoundTripper that sends requests through next and
+// tracks the traffic of upstreams. If next is nil, http.DefaultTransport is
+// used.
+func New(next http.RoundTripper) *Transport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &Transport{
+		next:      next,
+		upstreams: make(map[string]*upstream),
+		Method:    defaultMethod,
+		Path:      defaultPath,
+		MinConns:  defaultMinConns,
+		MaxConns:  defaultMaxConns,
+		Interval:  defaultInterval,
+		Idle:      defaultIdle,
+		Timeout:   defaultTimeout,
+		now:       time.Now,
+	}
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if IsPrewarm(req.Context()) {
+		return t.next.RoundTrip(req)
+	}
+
+	key := req.URL.Scheme + "://" + req.URL.Host
+	t.mu.Lock()
+	u, ok := t.upstreams[key]
+	if !ok {
+		u = &upstream{scheme: req.URL.Scheme, host: req.URL.Host}
+		t.upstreams[key] = u
+	}
+	u.inflight++
+	if u.inflight > u.peak {
+		u.peak = u.inflight
+	}
+	u.lastUsed = t.now()
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		u.inflight--
+		t.mu.Unlock()
+	}()
+	return t.next.RoundTrip(req)
+}
+
+// target is the number of connections to keep warm for u. It should be
+// called with mu held.
+func (t *Transport) target(u *upstream) int {
+	n := u.peak
+	if u.prevPeak > n {
+		n = u.prevPeak
+	}
+	minConns, maxConns := t.MinConns, t.MaxConns
+	if minConns <= 0 {
+		minConns = defaultMinConns
+	}
+	if maxConns <= 0 {
+		maxConns = defaultMaxConns
+	}
+	if n < minConns {
+		n = minConns
+	}
+	if n > maxConns {
+		n = maxConns
+	}
+	// Connections that are in use are warm already.
+	return n - u.inflight
+}
+
+// Prewarm sends prewarming requests to upstreams that have been used
+// recently and waits for them, and starts a new interval of peak tracking.
+// The requests of an upstream are sent concurrently, so that the underlying
+// transport has to open a connection for each of them unless it has enough
+// idle ones.
+func (t *Transport) Prewarm(ctx context.Context) {
+	type job struct {
+		u *upstream
+		n int
+	}
+	var jobs []job
+	now := t.now()
+	idle := orDefault(t.Idle, defaultIdle)
+	t.mu.Lock()
+	for key, u := range t.upstreams {
+		if u.inflight == 0 && now.Sub(u.lastUsed) >= idle {
+			delete(t.upstreams, key)
+			continue
+		}
+		if n := t.target(u); n > 0 {
+			jobs = append(jobs, job{u: u, n: n})
+		}
+		u.prevPeak, u.peak = u.peak, u.inflight
+	}
+	t.stats.Upstreams = len(t.upstreams)
+	t.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, prewarmKey{}, true), orDefault(t.Timeout, defaultTimeout))
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		for i := 0; i < j.n; i++ {
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+				t.send(ctx, u)
+			}(j.u)
+		}
+	}
+	wg.Wait()
+}
+
+// send sends a single prewarming request to u.
+func (t *Transport) send(ctx context.Context, u *upstream) {
+	method := t.Method
+	if method == "" {
+		method = defaultMethod
+	}
+	path := t.Path
+	if path == "" {
+		path = defaultPath
+	}
+	err := func() error {
+		req, err := http.NewRequestWithContext(ctx, method, u.scheme+"://"+u.host+path, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := t.next.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		// The body should be read till the end, otherwise the connection
+		// is not returned to the pool.
+		io.Copy(io.Discard, resp.Body)
+		return resp.Body.Close()
+	}()
+
+	t.mu.Lock()
+	t.stats.Requests++
+	if err != nil {
+		t.stats.Failures++
+	}
+	t.mu.Unlock()
+}
+
+// Run calls Prewarm every Interval until ctx is done.
+func (t *Transport) Run(ctx context.Context) {
+	ticker := time.NewTicker(orDefault(t.Interval, defaultInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.Prewarm(ctx)
+		}
+	}
+}
+
+// Stats returns a snapshot of the prewarming statistics.
+func (t *Transport) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
@@ -0,0 +1,108 @@
+package prewarm
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrewarm(t *testing.T) {
+	var mu sync.Mutex
+	conns := 0
+	release := make(chan struct{})
+	inflight := make(chan struct{}, 10)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			inflight <- struct{}{}
+			<-release
+		}
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	now := time.Unix(0, 0)
+	next := &http.Transport{MaxIdleConnsPerHost: 10}
+	defer next.CloseIdleConnections()
+	tr := New(next)
+	tr.MaxConns = 3
+	tr.now = func() time.Time {
+		return now
+	}
+	client := &http.Client{Transport: tr}
+
+	// 4 concurrent requests make the peak, it is limited by MaxConns.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-inflight
+	}
+	close(release)
+	wg.Wait()
+
+	// The idle connections are gone, e.g. closed by the upstream.
+	next.CloseIdleConnections()
+	mu.Lock()
+	conns = 0
+	mu.Unlock()
+
+	tr.Prewarm(context.Background())
+	if stats := tr.Stats(); stats.Upstreams != 1 || stats.Requests != 3 || stats.Failures != 0 {
+		t.Fatalf("Stats() = %+v, want 3 successful requests to 1 upstream", stats)
+	}
+	mu.Lock()
+	if conns < 1 || conns > 3 {
+		t.Errorf("prewarming has opened %d connections, want 1..3", conns)
+	}
+	mu.Unlock()
+
+	// The upstream is forgotten after it has been idle for Idle.
+	now = now.Add(defaultIdle)
+	tr.Prewarm(context.Background())
+	if stats := tr.Stats(); stats.Upstreams != 0 || stats.Requests != 3 {
+		t.Fatalf("Stats() = %+v, want the idle upstream to be forgotten", stats)
+	}
+}
+
+func TestTarget(t *testing.T) {
+	tr := New(nil)
+	tr.MinConns = 2
+	tr.MaxConns = 5
+	testCases := []struct {
+		peak, prevPeak, inflight int
+		expected                 int
+	}{
+		{0, 0, 0, 2},
+		{3, 1, 0, 3},
+		{1, 4, 1, 3},
+		{9, 0, 0, 5},
+		{2, 0, 2, 0},
+	}
+	for _, tc := range testCases {
+		u := &upstream{peak: tc.peak, prevPeak: tc.prevPeak, inflight: tc.inflight}
+		if n := tr.target(u); n != tc.expected {
+			t.Errorf("target(peak=%d, prevPeak=%d, inflight=%d) = %d, want %d", tc.peak, tc.prevPeak, tc.inflight, n, tc.expected)
+		}
+	}
+}
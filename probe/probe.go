@@ -0,0 +1,190 @@
+// Package probe periodically sends synthetic requests through a local
+// handler chain and records their latency and outcomes. It provides a
+// saturation signal that doesn't depend on user traffic.
+package probe
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type probeKey struct{}
+
+// NewContext returns a copy of ctx that marks requests as synthetic probes.
+func NewContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, probeKey{}, true)
+}
+
+// IsProbe reports whether ctx belongs to a synthetic probe. Middlewares that
+// account for usage (quotas, billing) should skip such requests.
+func IsProbe(ctx context.Context) bool {
+	probe, _ := ctx.Value(probeKey{}).(bool)
+	return probe
+}
+
+// Result is an outcome of a single probe.
+type Result struct {
+	// Start is the time when the probe was sent.
+	Start time.Time
+
+	// Latency is the time the handler chain took to respond.
+	Latency time.Duration
+
+	// StatusCode is the response status code.
+	StatusCode int
+
+	// Rejected is true if the request was rejected, see
+	// Scheduler.IsRejected.
+	Rejected bool
+}
+
+// Stats contains statistics collected by Scheduler.
+type Stats struct {
+	// Probes is the number of sent probes.
+	Probes int64
+
+	// Rejected is the number of rejected probes.
+	Rejected int64
+
+	// Last is the result of the last probe.
+	Last Result
+
+	// AvgLatency is the moving average of probe latencies.
+	AvgLatency time.Duration
+}
+
+// responseWriter discards the response body and remembers its status code.
+type responseWriter struct {
+	header     http.Header
+	statusCode int
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return len(p), nil
+}
+
+func defaultNewRequest() *http.Request {
+	r, _ := http.NewRequest("GET", "/", nil)
+	return r
+}
+
+func defaultIsRejected(statusCode int) bool {
+	return statusCode == http.StatusServiceUnavailable || statusCode == http.StatusTooManyRequests
+}
+
+// avgWeight is the weight of a new latency in AvgLatency.
+const avgWeight = 0.2
+
+// Scheduler sends probes through a handler.
+type Scheduler struct {
+	handler  http.Handler
+	interval time.Duration
+
+	mu    sync.Mutex
+	stats Stats
+
+	// NewRequest returns a request for a probe. By default it is GET /.
+	NewRequest func() *http.Request
+
+	// Timeout, if positive, is a deadline for each probe.
+	Timeout time.Duration
+
+	// IsRejected reports whether a probe with the given status code has been
+	// rejected. By default 503 and 429 are rejections.
+	IsRejected func(statusCode int) bool
+
+	// OnResult, if not nil, is called after each probe.
+	OnResult func(Result)
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// New returns a Scheduler that sends probes through h every interval.
+func New(h http.Handler, interval time.Duration) *Scheduler {
+	return &Scheduler{
+		handler:    h,
+		interval:   interval,
+		NewRequest: defaultNewRequest,
+		IsRejected: defaultIsRejected,
+		now:        time.Now,
+	}
+}
+
+// Stats returns a snapshot of the collected statistics.
+func (s *Scheduler) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Probe sends a single probe and records its result.
+func (s *Scheduler) Probe(ctx context.Context) Result {
+	ctx = NewContext(ctx)
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	r := s.NewRequest().WithContext(ctx)
+	w := &responseWriter{header: make(http.Header)}
+
+	start := s.now()
+	s.handler.ServeHTTP(w, r)
+	res := Result{
+		Start:      start,
+		Latency:    s.now().Sub(start),
+		StatusCode: w.statusCode,
+	}
+	if res.StatusCode == 0 {
+		res.StatusCode = http.StatusOK
+	}
+	res.Rejected = s.IsRejected(res.StatusCode)
+
+	s.mu.Lock()
+	s.stats.Probes++
+	if res.Rejected {
+		s.stats.Rejected++
+	}
+	if s.stats.Probes == 1 {
+		s.stats.AvgLatency = res.Latency
+	} else {
+		s.stats.AvgLatency += time.Duration(avgWeight * float64(res.Latency-s.stats.AvgLatency))
+	}
+	s.stats.Last = res
+	s.mu.Unlock()
+
+	if s.OnResult != nil {
+		s.OnResult(res)
+	}
+	return res
+}
+
+// Run sends probes until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Probe(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
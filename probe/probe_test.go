@@ -0,0 +1,76 @@
+package probe
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	statusCode := http.StatusOK
+	s := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsProbe(r.Context()) {
+			t.Errorf("the request is not marked as a probe")
+		}
+		w.WriteHeader(statusCode)
+	}), time.Second)
+
+	now := time.Unix(0, 0)
+	s.now = func() time.Time {
+		now = now.Add(10 * time.Millisecond)
+		return now
+	}
+
+	if res := s.Probe(context.Background()); res.StatusCode != http.StatusOK || res.Rejected || res.Latency != 10*time.Millisecond {
+		t.Fatalf("Probe() = %+v, want an admitted probe with 10ms latency", res)
+	}
+
+	statusCode = http.StatusServiceUnavailable
+	if res := s.Probe(context.Background()); !res.Rejected {
+		t.Fatalf("Probe() = %+v, want a rejected probe", res)
+	}
+
+	stats := s.Stats()
+	if stats.Probes != 2 || stats.Rejected != 1 {
+		t.Fatalf("stats = %+v, want 2 probes and 1 rejection", stats)
+	}
+	if stats.AvgLatency != 10*time.Millisecond {
+		t.Fatalf("stats.AvgLatency = %s, want %s", stats.AvgLatency, 10*time.Millisecond)
+	}
+}
+
+func TestRun(t *testing.T) {
+	s := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), time.Millisecond)
+
+	results := make(chan Result, 1)
+	s.OnResult = func(res Result) {
+		select {
+		case results <- res:
+		default:
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-results:
+	case <-time.After(time.Second):
+		t.Fatal("timeout while waiting for a probe")
+	}
+	if IsProbe(ctx) {
+		t.Fatal("the parent context is marked as a probe")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timeout while waiting for Run to return")
+	}
+}
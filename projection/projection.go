@@ -0,0 +1,262 @@
+// Package projection prunes JSON responses to the fields requested by the
+// client in the fields query parameter, e.g. "?fields=id,author(name,email)",
+// to save bandwidth for clients that need only a part of each resource. The
+// responses are filtered as they are written, the handler is not changed.
+package projection
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/dmage/middleware/jsonredact"
+)
+
+const (
+	// defaultMaxDepth is the default maximum number of keys in a field path.
+	defaultMaxDepth = 8
+
+	// defaultMaxFields is the default maximum number of requested fields.
+	defaultMaxFields = 64
+)
+
+// ErrSyntax is returned by Parse when the fields parameter is malformed.
+var ErrSyntax = errors.New("projection: invalid fields parameter")
+
+// ErrTooDeep is returned by Parse when a field path is longer than allowed.
+var ErrTooDeep = errors.New("projection: fields are nested too deep")
+
+// ErrTooMany is returned by Parse when too many fields are requested.
+var ErrTooMany = errors.New("projection: too many fields")
+
+// Parse parses a fields parameter into field paths. Fields are separated by
+// commas, nested fields are separated by slashes or dots, and parentheses
+// select several subfields, e.g. "id,author(name,email),items/title" is
+// parsed into "id", "author.name", "author.email" and "items.title". A path
+// may have at most maxDepth keys, and at most maxFields paths are returned.
+func Parse(fields string, maxDepth, maxFields int) ([]string, error) {
+	p := &parser{
+		input:     fields,
+		maxDepth:  maxDepth,
+		maxFields: maxFields,
+	}
+	if err := p.list(nil, 0); err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.input) {
+		return nil, ErrSyntax
+	}
+	return p.paths, nil
+}
+
+type parser struct {
+	input     string
+	pos       int
+	maxDepth  int
+	maxFields int
+	paths     []string
+}
+
+// key reads a key, which ends at a delimiter or at the end of the input.
+func (p *parser) key() string {
+	start := p.pos
+	for p.pos < len(p.input) && !strings.ContainsRune(",()/.", rune(p.input[p.pos])) {
+		p.pos++
+	}
+	return strings.TrimSpace(p.input[start:p.pos])
+}
+
+// list reads fields separated by commas until the end of the input or a
+// closing parenthesis. prefix is the path of the parent field.
+func (p *parser) list(prefix []string, depth int) error {
+	for {
+		if err := p.field(prefix, depth); err != nil {
+			return err
+		}
+		if p.pos == len(p.input) || p.input[p.pos] != ',' {
+			return nil
+		}
+		p.pos++
+	}
+}
+
+// field reads a field with its subfields.
+func (p *parser) field(prefix []string, depth int) error {
+	key := p.key()
+	if key == "" {
+		return ErrSyntax
+	}
+	if depth+1 > p.maxDepth {
+		return ErrTooDeep
+	}
+	path := append(prefix[:len(prefix):len(prefix)], key)
+	if p.pos < len(p.input) {
+		switch p.input[p.pos] {
+		case '/', '.':
+			p.pos++
+			return p.field(path, depth+1)
+		case '(':
+			p.pos++
+			if err := p.list(path, depth+1); err != nil {
+				return err
+			}
+			if p.pos == len(p.input) || p.input[p.pos] != ')' {
+				return ErrSyntax
+			}
+			p.pos++
+			return nil
+		}
+	}
+	if len(p.paths) == p.maxFields {
+		return ErrTooMany
+	}
+	p.paths = append(p.paths, strings.Join(path, "."))
+	return nil
+}
+
+// isJSON reports whether contentType is a JSON media type.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || mediaType == "application/x-ndjson" || strings.HasSuffix(mediaType, "+json")
+}
+
+func defaultBadRequestHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "400 invalid fields parameter", http.StatusBadRequest)
+}
+
+// BadRequestHandler is a default BadRequestHandler for Middleware.
+var BadRequestHandler http.Handler = http.HandlerFunc(defaultBadRequestHandler)
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler http.Handler
+
+	// Param is the name of the query parameter. By default it is "fields".
+	Param string
+
+	// MaxDepth is the maximum number of keys in a field path. By default
+	// it is 8.
+	MaxDepth int
+
+	// MaxFields is the maximum number of fields in a request. By default
+	// it is 64.
+	MaxFields int
+
+	// BadRequestHandler is called for requests with a malformed or too
+	// large fields parameter.
+	BadRequestHandler http.Handler
+
+	// OnError, if not nil, is called when a response can't be pruned
+	// because it is not valid JSON. The rest of such response is dropped.
+	OnError func(r *http.Request, err error)
+}
+
+// New returns an http.Handler that prunes successful JSON responses of h to
+// the requested fields. Requests without the fields parameter are passed as
+// is.
+func New(h http.Handler) *Middleware {
+	return &Middleware{
+		handler:           h,
+		Param:             "fields",
+		MaxDepth:          defaultMaxDepth,
+		MaxFields:         defaultMaxFields,
+		BadRequestHandler: BadRequestHandler,
+	}
+}
+
+// responseWriter prunes the response body if it is a successful JSON
+// response.
+type responseWriter struct {
+	http.ResponseWriter
+	m     *Middleware
+	r     *http.Request
+	rules jsonredact.Rules
+
+	wroteHeader bool
+	filter      *jsonredact.Filter
+	err         error
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	h := rw.Header()
+	// Error responses are not pruned, clients need them as they are. Encoded
+	// responses can't be pruned, so they are passed as is too.
+	enc := h.Get("Content-Encoding")
+	if status == http.StatusOK && isJSON(h.Get("Content-Type")) && (enc == "" || enc == "identity") {
+		h.Del("Content-Length")
+		rw.filter = jsonredact.NewFilter(rw.ResponseWriter, rw.rules)
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) fail(err error) {
+	if rw.err == nil {
+		rw.err = err
+		if rw.m.OnError != nil {
+			rw.m.OnError(rw.r, err)
+		}
+	}
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.filter == nil {
+		return rw.ResponseWriter.Write(p)
+	}
+	if rw.err != nil {
+		return 0, rw.err
+	}
+	if _, err := rw.filter.Write(p); err != nil {
+		rw.fail(err)
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// close checks that the pruned response is complete.
+func (rw *responseWriter) close() {
+	if rw.filter != nil && rw.err == nil {
+		if err := rw.filter.Close(); err != nil {
+			rw.fail(err)
+		}
+	}
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fields := r.URL.Query().Get(m.Param)
+	if fields == "" {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+	maxDepth := m.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxDepth
+	}
+	maxFields := m.MaxFields
+	if maxFields <= 0 {
+		maxFields = defaultMaxFields
+	}
+	paths, err := Parse(fields, maxDepth, maxFields)
+	if err != nil {
+		m.BadRequestHandler.ServeHTTP(w, r)
+		return
+	}
+	rw := &responseWriter{
+		ResponseWriter: w,
+		m:              m,
+		r:              r,
+		rules:          jsonredact.Rules{Keep: paths},
+	}
+	defer rw.close()
+	m.handler.ServeHTTP(rw, r)
+}
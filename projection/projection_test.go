@@ -0,0 +1,80 @@
+package projection
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		fields   string
+		expected []string
+		err      error
+	}{
+		{"id", []string{"id"}, nil},
+		{"id, name", []string{"id", "name"}, nil},
+		{"id,author(name,email),items/title", []string{"id", "author.name", "author.email", "items.title"}, nil},
+		{"a(b(c,d),e.f)", []string{"a.b.c", "a.b.d", "a.e.f"}, nil},
+		{"a,,b", nil, ErrSyntax},
+		{"a(b", nil, ErrSyntax},
+		{"a)", nil, ErrSyntax},
+		{"a()", nil, ErrSyntax},
+		{"a.b.c.d", nil, ErrTooDeep},
+		{"a(b(c(d)))", nil, ErrTooDeep},
+		{"a,b,c,d,e", nil, ErrTooMany},
+	}
+	for _, tc := range testCases {
+		paths, err := Parse(tc.fields, 3, 4)
+		if err != tc.err {
+			t.Errorf("%s: err = %v, want %v", tc.fields, err, tc.err)
+			continue
+		}
+		if !reflect.DeepEqual(paths, tc.expected) {
+			t.Errorf("%s: paths = %q, want %q", tc.fields, paths, tc.expected)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": "not found", "code": 404}`))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Length", "75")
+			w.Write([]byte(`{"id": 1, "title": "a", "author": {"name": "b", "email": "c"}, "tags": ["x"]}`))
+		}
+	}))
+
+	testCases := []struct {
+		path     string
+		fields   string
+		status   int
+		expected string
+	}{
+		{"/", "", http.StatusOK, `{"id": 1, "title": "a", "author": {"name": "b", "email": "c"}, "tags": ["x"]}`},
+		{"/", "id,author(name)", http.StatusOK, `{"id":1,"author":{"name":"b"}}`},
+		{"/", "author", http.StatusOK, `{"author":{"name":"b","email":"c"}}`},
+		{"/", "a(", http.StatusBadRequest, "400 invalid fields parameter\n"},
+		{"/missing", "id", http.StatusNotFound, `{"error": "not found", "code": 404}`},
+	}
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("GET", tc.path+"?fields="+url.QueryEscape(tc.fields), nil))
+		if rec.Code != tc.status {
+			t.Errorf("%s?fields=%s: status = %d, want %d", tc.path, tc.fields, rec.Code, tc.status)
+		}
+		if body := rec.Body.String(); body != tc.expected {
+			t.Errorf("%s?fields=%s: body = %s, want %s", tc.path, tc.fields, body, tc.expected)
+		}
+		if tc.fields != "" && tc.status == http.StatusOK && rec.Header().Get("Content-Length") != "" {
+			t.Errorf("%s?fields=%s: Content-Length = %q, want it to be removed", tc.path, tc.fields, rec.Header().Get("Content-Length"))
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Package quota enforces long-horizon usage limits, e.g. 10000 requests per
+// day per API key.
+//
+// Unlike ratelimit, which smooths the traffic over seconds and keeps its
+// buckets in memory, quotas are counted over calendar periods and the
+// counters are kept in a Store that survives restarts, e.g. Redis or an SQL
+// database, so that a deploy doesn't grant every client a fresh quota.
+//
+// The middleware is usually wrapped by auth.Middleware and keyed by
+// auth.PrincipalKey.
+package quota
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/dmage/middleware/auth"
+	"github.com/dmage/middleware/decisionlog"
+)
+
+const (
+	// HeaderLimit, HeaderRemaining and HeaderReset are the response headers
+	// with the quota of the client, the number of requests that are left in
+	// the current period and the number of seconds until the period ends.
+	HeaderLimit     = "X-Quota-Limit"
+	HeaderRemaining = "X-Quota-Remaining"
+	HeaderReset     = "X-Quota-Reset"
+)
+
+func defaultExceededHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "429 quota exceeded", http.StatusTooManyRequests)
+}
+
+// ExceededHandler is a default ExceededHandler for Middleware.
+var ExceededHandler http.Handler = http.HandlerFunc(defaultExceededHandler)
+
+// Period is the calendar period over which requests are counted.
+type Period int
+
+// Periods of quotas.
+const (
+	Hour Period = iota
+	Day
+	Month
+)
+
+func (p Period) String() string {
+	switch p {
+	case Hour:
+		return "hour"
+	case Day:
+		return "day"
+	case Month:
+		return "month"
+	}
+	return "Period(" + strconv.Itoa(int(p)) + ")"
+}
+
+// Bounds returns the start and the end of the period that contains t. The
+// periods are aligned to the calendar of the location of t.
+func (p Period) Bounds(t time.Time) (start, end time.Time) {
+	y, m, d := t.Date()
+	switch p {
+	case Hour:
+		start = time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location())
+		return start, start.Add(time.Hour)
+	case Month:
+		start = time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 1, 0)
+	default:
+		start = time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 0, 1)
+	}
+}
+
+// Stats contains counters collected by Middleware.
+type Stats struct {
+	// Allowed is the total number of requests within their quotas.
+	Allowed int64 `json:"allowed"`
+
+	// Exceeded is the total number of requests that have been rejected
+	// because their quotas were used up.
+	Exceeded int64 `json:"exceeded"`
+
+	// StoreErrors is the total number of requests that have been passed
+	// to the handler unmetered because the store has failed.
+	StoreErrors int64 `json:"store_errors"`
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler http.Handler
+	store   Store
+
+	allowed     int64
+	exceeded    int64
+	storeErrors int64
+
+	// Limit is the number of requests per Period for every key. A negative
+	// value means no limit. It is not used if LimitFunc is set.
+	Limit int64
+
+	// LimitFunc, if not nil, returns the quota of the request, e.g. by the
+	// plan of the principal. A negative value means no limit.
+	LimitFunc func(r *http.Request) int64
+
+	// Period is the period of the quota. By default it is Day.
+	Period Period
+
+	// Location is the time zone of the calendar that periods are aligned
+	// to. By default it is UTC.
+	Location *time.Location
+
+	// Key returns the key of the request. Requests with the empty key are
+	// not metered. By default it is auth.PrincipalKey.
+	Key func(r *http.Request) string
+
+	// Cost, if not nil, returns the number of requests that the request
+	// counts as. If Cost returns a value less than 1, the request counts
+	// as one.
+	Cost func(r *http.Request) int64
+
+	// Headers enables HeaderLimit, HeaderRemaining and HeaderReset on
+	// metered responses. It is set by New.
+	Headers bool
+
+	// ExceededHandler is called for requests over their quotas. The
+	// Retry-After header is set to the end of the period before it is
+	// called.
+	ExceededHandler http.Handler
+
+	// OnStoreError, if not nil, is called when the store fails. Such
+	// requests are passed to the handler, a broken store shouldn't take
+	// the service down.
+	OnStoreError func(r *http.Request, err error)
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// New returns an http.Handler that passes to h up to limit requests per day
+// per key, counted in store.
+func New(store Store, limit int64, h http.Handler) *Middleware {
+	return &Middleware{
+		handler:         h,
+		store:           store,
+		Limit:           limit,
+		Period:          Day,
+		Key:             auth.PrincipalKey,
+		Headers:         true,
+		ExceededHandler: ExceededHandler,
+		now:             time.Now,
+	}
+}
+
+func (m *Middleware) limit(r *http.Request) int64 {
+	if m.LimitFunc != nil {
+		return m.LimitFunc(r)
+	}
+	return m.Limit
+}
+
+func (m *Middleware) cost(r *http.Request) int64 {
+	if m.Cost == nil {
+		return 1
+	}
+	if n := m.Cost(r); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// Usage returns the number of requests that key has made in the current
+// period.
+func (m *Middleware) Usage(ctx context.Context, key string) (int64, error) {
+	counterKey, end := m.counterKey(key)
+	return m.store.Add(ctx, counterKey, 0, end)
+}
+
+// counterKey returns the key of the counter of the current period and the
+// end of the period.
+func (m *Middleware) counterKey(key string) (string, time.Time) {
+	loc := m.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	start, end := m.Period.Bounds(m.now().In(loc))
+	return key + "/" + m.Period.String() + "/" + start.Format("2006-01-02T15"), end
+}
+
+// Stats returns a snapshot of the collected counters.
+func (m *Middleware) Stats() Stats {
+	return Stats{
+		Allowed:     atomic.LoadInt64(&m.allowed),
+		Exceeded:    atomic.LoadInt64(&m.exceeded),
+		StoreErrors: atomic.LoadInt64(&m.storeErrors),
+	}
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := m.Key(r)
+	limit := m.limit(r)
+	if key == "" || limit < 0 {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+
+	counterKey, end := m.counterKey(key)
+	used, err := m.store.Add(r.Context(), counterKey, m.cost(r), end)
+	if err != nil {
+		atomic.AddInt64(&m.storeErrors, 1)
+		if m.OnStoreError != nil {
+			m.OnStoreError(r, err)
+		}
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+
+	reset := strconv.Itoa(int((end.Sub(m.now()) + time.Second - 1) / time.Second))
+	if m.Headers {
+		remaining := limit - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		h := w.Header()
+		h.Set(HeaderLimit, strconv.FormatInt(limit, 10))
+		h.Set(HeaderRemaining, strconv.FormatInt(remaining, 10))
+		h.Set(HeaderReset, reset)
+	}
+	if used > limit {
+		atomic.AddInt64(&m.exceeded, 1)
+		decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "quota", Action: decisionlog.Deny, Rule: m.Period.String(), Reason: "quota of " + strconv.FormatInt(limit, 10) + " requests exceeded"})
+		w.Header().Set("Retry-After", reset)
+		m.ExceededHandler.ServeHTTP(w, r)
+		return
+	}
+	atomic.AddInt64(&m.allowed, 1)
+	m.handler.ServeHTTP(w, r)
+}
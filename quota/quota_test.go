@@ -0,0 +1,104 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBounds(t *testing.T) {
+	tm := time.Date(2024, 1, 31, 13, 45, 0, 0, time.UTC)
+	testCases := []struct {
+		period     Period
+		start, end time.Time
+	}{
+		{Hour, time.Date(2024, 1, 31, 13, 0, 0, 0, time.UTC), time.Date(2024, 1, 31, 14, 0, 0, 0, time.UTC)},
+		{Day, time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{Month, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range testCases {
+		start, end := tc.period.Bounds(tm)
+		if !start.Equal(tc.start) || !end.Equal(tc.end) {
+			t.Errorf("%s: Bounds() = %v, %v, want %v, %v", tc.period, start, end, tc.start, tc.end)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	now := time.Date(2024, 1, 31, 23, 59, 0, 0, time.UTC)
+	store := NewMemoryStore()
+	store.now = func() time.Time {
+		return now
+	}
+	m := New(store, 2, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	m.Key = func(r *http.Request) string {
+		return r.Header.Get("X-Key")
+	}
+	m.now = store.now
+
+	do := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		if key != "" {
+			r.Header.Set("X-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, r)
+		return rec
+	}
+
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		rec := do("a")
+		if rec.Code != expected {
+			t.Fatalf("request %d: status = %d, want %d", i, rec.Code, expected)
+		}
+		if rec.Header().Get(HeaderLimit) != "2" || rec.Header().Get(HeaderReset) != "60" {
+			t.Fatalf("request %d: headers = %v", i, rec.Header())
+		}
+	}
+	if rec := do("a"); rec.Header().Get(HeaderRemaining) != "0" || rec.Header().Get("Retry-After") != "60" {
+		t.Fatalf("headers of a rejected request = %v", rec.Header())
+	}
+	if rec := do("b"); rec.Code != http.StatusOK || rec.Header().Get(HeaderRemaining) != "1" {
+		t.Fatalf("another key: status = %d, remaining = %s", rec.Code, rec.Header().Get(HeaderRemaining))
+	}
+	if rec := do(""); rec.Code != http.StatusOK || rec.Header().Get(HeaderLimit) != "" {
+		t.Fatalf("a request without a key has been metered")
+	}
+	if used, err := m.Usage(context.Background(), "a"); err != nil || used != 4 {
+		t.Fatalf("Usage() = %d, %v, want 4", used, err)
+	}
+
+	// The next day starts with a fresh quota.
+	now = now.Add(time.Minute)
+	if rec := do("a"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d on the next day, want %d", rec.Code, http.StatusOK)
+	}
+	if stats := m.Stats(); stats.Allowed != 4 || stats.Exceeded != 2 {
+		t.Fatalf("stats = %+v, want 4 allowed and 2 exceeded", stats)
+	}
+}
+
+type brokenStore struct{}
+
+func (brokenStore) Add(ctx context.Context, key string, n int64, expires time.Time) (int64, error) {
+	return 0, errors.New("broken")
+}
+
+func TestStoreError(t *testing.T) {
+	m := New(brokenStore{}, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	m.Key = func(r *http.Request) string {
+		return "a"
+	}
+	var reported error
+	m.OnStoreError = func(r *http.Request, err error) {
+		reported = err
+	}
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || reported == nil {
+		t.Fatalf("status = %d, reported = %v, want the request to be passed and the error reported", rec.Code, reported)
+	}
+}
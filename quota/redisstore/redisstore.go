@@ -0,0 +1,72 @@
+// Package redisstore implements a quota.Store that keeps usage counters in
+// Redis.
+package redisstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dmage/middleware/quota"
+)
+
+// Client is the subset of a Redis client used by Store. For example, a
+// go-redis client can be adapted as
+//
+//	redisstore.EvalFunc(func(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+//		return rdb.Eval(ctx, script, keys, args...).Result()
+//	})
+type Client interface {
+	// Eval runs a Lua script and returns its result.
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+// EvalFunc is an adapter to allow the use of ordinary functions as Client.
+type EvalFunc func(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+
+// Eval calls f(ctx, script, keys, args...).
+func (f EvalFunc) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	return f(ctx, script, keys, args...)
+}
+
+// addScript increments the counter and makes it expire at the end of the
+// period.
+const addScript = `
+local v = redis.call('INCRBY', KEYS[1], ARGV[1])
+redis.call('PEXPIREAT', KEYS[1], ARGV[2])
+return v
+`
+
+// Store implements the quota.Store interface. Counters are stored under
+// Prefix + key and expire in Redis when their periods end. Redis should be
+// configured with persistence, otherwise its restarts reset the quotas.
+type Store struct {
+	client Client
+
+	// Prefix is prepended to counter keys to get Redis keys. By default it
+	// is "quota:".
+	Prefix string
+}
+
+var _ quota.Store = (*Store)(nil)
+
+// New returns a Store that uses client.
+func New(client Client) *Store {
+	return &Store{
+		client: client,
+		Prefix: "quota:",
+	}
+}
+
+// Add implements quota.Store.
+func (s *Store) Add(ctx context.Context, key string, n int64, expires time.Time) (int64, error) {
+	res, err := s.client.Eval(ctx, addScript, []string{s.Prefix + key}, n, expires.UnixMilli())
+	if err != nil {
+		return 0, fmt.Errorf("redisstore: add: %w", err)
+	}
+	v, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redisstore: add: unexpected result %T", res)
+	}
+	return v, nil
+}
@@ -0,0 +1,42 @@
+package redisstore
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeRedis emulates the script and records expiration times.
+type fakeRedis struct {
+	values  map[string]int64
+	expires map[string]int64
+}
+
+func (f *fakeRedis) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	if script != addScript {
+		panic("unexpected script")
+	}
+	f.values[keys[0]] += args[0].(int64)
+	f.expires[keys[0]] = args[1].(int64)
+	return f.values[keys[0]], nil
+}
+
+func TestStore(t *testing.T) {
+	redis := &fakeRedis{values: map[string]int64{}, expires: map[string]int64{}}
+	s := New(redis)
+	ctx := context.Background()
+	expires := time.Unix(86400, 0)
+
+	for _, expected := range []int64{1, 3} {
+		v, err := s.Add(ctx, "alice/day/1970-01-01T00", expected-redis.values["quota:alice/day/1970-01-01T00"], expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != expected {
+			t.Fatalf("Add() = %d, want %d", v, expected)
+		}
+	}
+	if exp := redis.expires["quota:alice/day/1970-01-01T00"]; exp != 86400000 {
+		t.Fatalf("expiration = %d ms, want the end of the period", exp)
+	}
+}
@@ -0,0 +1,65 @@
+// Package sqlstore implements a quota.Store that keeps usage counters in an
+// SQL database.
+//
+// The store expects a table like
+//
+//	CREATE TABLE quota_counters (
+//		key     TEXT PRIMARY KEY,
+//		value   BIGINT NOT NULL,
+//		expires TIMESTAMP NOT NULL
+//	);
+//
+// and increments counters with INSERT ... ON CONFLICT ... RETURNING, which
+// is supported by PostgreSQL and SQLite 3.35 or later. Expired counters are
+// not deleted by Add, see DeleteExpired.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/dmage/middleware/quota"
+)
+
+// Store implements the quota.Store interface.
+type Store struct {
+	db *sql.DB
+
+	// Table is the name of the table with counters. By default it is
+	// quota_counters.
+	Table string
+}
+
+var _ quota.Store = (*Store)(nil)
+
+// New returns a Store that uses db.
+func New(db *sql.DB) *Store {
+	return &Store{
+		db:    db,
+		Table: "quota_counters",
+	}
+}
+
+// Add implements quota.Store.
+func (s *Store) Add(ctx context.Context, key string, n int64, expires time.Time) (int64, error) {
+	query := fmt.Sprintf(`INSERT INTO %s (key, value, expires) VALUES ($1, $2, $3)
+ON CONFLICT (key) DO UPDATE SET value = %s.value + excluded.value
+RETURNING value`, s.Table, s.Table)
+	var v int64
+	if err := s.db.QueryRowContext(ctx, query, key, n, expires.UTC()).Scan(&v); err != nil {
+		return 0, fmt.Errorf("sqlstore: add: %w", err)
+	}
+	return v, nil
+}
+
+// DeleteExpired deletes the counters that have expired before now. It should
+// be called periodically, e.g. once a day.
+func (s *Store) DeleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE expires < $1`, s.Table), now.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("sqlstore: delete expired: %w", err)
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,134 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDriver emulates the queries of Store with a map.
+type fakeDriver struct {
+	mu      sync.Mutex
+	values  map[string]int64
+	expires map[string]time.Time
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	return &fakeConn{d: d}, nil
+}
+
+// Connect and Driver implement driver.Connector, so that the driver can be
+// used with sql.OpenDB without a global registration.
+func (d *fakeDriver) Connect(ctx context.Context) (driver.Conn, error) {
+	return d.Open("")
+}
+
+func (d *fakeDriver) Driver() driver.Driver {
+	return d
+}
+
+type fakeConn struct {
+	d *fakeDriver
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, "INSERT INTO quota_counters ") {
+		return nil, errors.New("unexpected query: " + query)
+	}
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	key := args[0].Value.(string)
+	c.d.values[key] += args[1].Value.(int64)
+	if _, ok := c.d.expires[key]; !ok {
+		c.d.expires[key] = args[2].Value.(time.Time)
+	}
+	return &fakeRows{value: c.d.values[key]}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.HasPrefix(query, "DELETE FROM quota_counters ") {
+		return nil, errors.New("unexpected query: " + query)
+	}
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	now := args[0].Value.(time.Time)
+	var n int64
+	for key, expires := range c.d.expires {
+		if expires.Before(now) {
+			delete(c.d.values, key)
+			delete(c.d.expires, key)
+			n++
+		}
+	}
+	return driver.RowsAffected(n), nil
+}
+
+type fakeRows struct {
+	value int64
+	done  bool
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"value"}
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.value
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	d := &fakeDriver{values: map[string]int64{}, expires: map[string]time.Time{}}
+	db := sql.OpenDB(d)
+	defer db.Close()
+
+	s := New(db)
+	ctx := context.Background()
+	expires := time.Unix(86400, 0)
+	for _, expected := range []int64{2, 4} {
+		v, err := s.Add(ctx, "alice/day/1970-01-01T00", 2, expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != expected {
+			t.Fatalf("Add() = %d, want %d", v, expected)
+		}
+	}
+	if _, err := s.Add(ctx, "bob/day/1970-01-02T00", 1, expires.Add(24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := s.DeleteExpired(ctx, expires.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || d.values["bob/day/1970-01-02T00"] != 1 {
+		t.Fatalf("DeleteExpired() = %d, values = %v, want only the counter of the previous day to be deleted", n, d.values)
+	}
+}
@@ -0,0 +1,122 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const cleanupInterval = 1024
+
+// Store keeps the usage counters. The counters should survive restarts of
+// the process, otherwise a restart resets the quotas, so MemoryStore is
+// suitable only for tests and single-instance deployments that can afford
+// it, unless it is persisted with middleware.Persist, see the redisstore and
+// sqlstore packages.
+type Store interface {
+	// Add increments the counter key by n and returns its new value. The
+	// counter should be kept at least until expires, after that it may be
+	// deleted.
+	Add(ctx context.Context, key string, n int64, expires time.Time) (int64, error)
+}
+
+type counter struct {
+	value   int64
+	expires time.Time
+}
+
+// MemoryStore implements the Store interface in memory.
+type MemoryStore struct {
+	mu       sync.Mutex
+	counters map[string]*counter
+	inserts  int
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		counters: make(map[string]*counter),
+		now:      time.Now,
+	}
+}
+
+// Add implements Store.
+func (s *MemoryStore) Add(ctx context.Context, key string, n int64, expires time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	c, ok := s.counters[key]
+	if !ok || !now.Before(c.expires) {
+		c = &counter{}
+		s.counters[key] = c
+		s.inserts++
+		if s.inserts%cleanupInterval == 0 {
+			s.cleanup(now)
+		}
+	}
+	c.value += n
+	if expires.After(c.expires) {
+		c.expires = expires
+	}
+	return c.value, nil
+}
+
+// cleanup removes expired counters. It should be called with mu held.
+func (s *MemoryStore) cleanup(now time.Time) {
+	for key, c := range s.counters {
+		if !now.Before(c.expires) {
+			delete(s.counters, key)
+		}
+	}
+}
+
+// Len returns the number of counters in the store.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.counters)
+}
+
+// snapshotCounter is the JSON form of a counter.
+type snapshotCounter struct {
+	Value   int64     `json:"value"`
+	Expires time.Time `json:"expires"`
+}
+
+// Snapshot returns the unexpired counters as JSON, so that they can be
+// restored after a restart, see middleware.Snapshotter.
+func (s *MemoryStore) Snapshot() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	counters := make(map[string]snapshotCounter, len(s.counters))
+	for key, c := range s.counters {
+		if now.Before(c.expires) {
+			counters[key] = snapshotCounter{Value: c.value, Expires: c.expires}
+		}
+	}
+	return json.Marshal(counters)
+}
+
+// Restore replaces the counters with the ones saved by Snapshot. Counters
+// that have expired since then are skipped.
+func (s *MemoryStore) Restore(data []byte) error {
+	var counters map[string]snapshotCounter
+	if err := json.Unmarshal(data, &counters); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.counters = make(map[string]*counter, len(counters))
+	for key, c := range counters {
+		if now.Before(c.Expires) {
+			s.counters[key] = &counter{value: c.Value, expires: c.Expires}
+		}
+	}
+	return nil
+}
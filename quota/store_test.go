@@ -0,0 +1,68 @@
+package quota
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := NewMemoryStore()
+	s.now = func() time.Time {
+		return now
+	}
+	ctx := context.Background()
+
+	for i, expected := range []int64{1, 3} {
+		n := int64(i + 1)
+		if v, _ := s.Add(ctx, "a", n, now.Add(time.Minute)); v != expected {
+			t.Fatalf("Add(%d) = %d, want %d", n, v, expected)
+		}
+	}
+	now = now.Add(time.Minute)
+	if v, _ := s.Add(ctx, "a", 1, now.Add(time.Minute)); v != 1 {
+		t.Fatalf("Add() after expiration = %d, want 1", v)
+	}
+
+	for i := 0; i < cleanupInterval; i++ {
+		s.Add(ctx, strconv.Itoa(i), 1, now.Add(time.Second))
+	}
+	now = now.Add(time.Hour)
+	for i := 0; i < cleanupInterval; i++ {
+		s.Add(ctx, "new"+strconv.Itoa(i), 1, now.Add(time.Second))
+	}
+	if n := s.Len(); n > cleanupInterval+1 {
+		t.Fatalf("Len() = %d, want expired counters to be removed", n)
+	}
+}
+
+func TestMemoryStoreSnapshot(t *testing.T) {
+	now := time.Unix(0, 0)
+	clock := func() time.Time {
+		return now
+	}
+	s := NewMemoryStore()
+	s.now = clock
+	ctx := context.Background()
+	s.Add(ctx, "day", 5, now.Add(24*time.Hour))
+	s.Add(ctx, "minute", 1, now.Add(time.Minute))
+	data, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Hour)
+	restored := NewMemoryStore()
+	restored.now = clock
+	if err := restored.Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	if n := restored.Len(); n != 1 {
+		t.Fatalf("Len() = %d, want expired counters to be skipped", n)
+	}
+	if v, _ := restored.Add(ctx, "day", 1, now.Add(23*time.Hour)); v != 6 {
+		t.Fatalf("Add() = %d after restore, want %d", v, 6)
+	}
+}
@@ -0,0 +1,52 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+// backend is a maxconnections.Backend that takes tokens from a bucket.
+type backend struct {
+	l   *Limiter
+	key string
+}
+
+// noLease is the lease of a request that has got its tokens. Tokens are not
+// returned when the request finishes.
+type noLease struct{}
+
+func (noLease) Release(ctx context.Context) error {
+	return nil
+}
+
+func (b backend) TryAcquire(ctx context.Context, n int) (maxconnections.Lease, error) {
+	res, _ := b.l.TakeN(ctx, b.key, n)
+	if !res.OK {
+		return nil, nil
+	}
+	return noLease{}, nil
+}
+
+// Backend returns a maxconnections.Backend that admits requests while the
+// bucket of key in l has tokens. A request that is admitted by the
+// concurrency limiter waits for the tokens with its running units until its
+// maximum wait in the queue expires, see maxconnections.Limiter.Backend, so
+// the rate and the concurrency limits make a single rejection decision with
+// the headers and the handlers of the maxconnections middleware.
+func Backend(l *Limiter, key string) maxconnections.Backend {
+	return backend{l: l, key: key}
+}
+
+// NewHybrid returns a maxconnections.Middleware that runs no more than
+// maxRunning requests at the same time, queues up to maxInQueue requests,
+// and passes to h up to rate requests per second with bursts of up to burst
+// requests. Requests that cannot get tokens in time are rejected like
+// requests that time out in the queue, so MaxWaitInQueue of the middleware
+// should be set.
+func NewHybrid(rate float64, burst, maxRunning, maxInQueue int, h http.Handler) *maxconnections.Middleware {
+	m := maxconnections.New(maxRunning, maxInQueue, h)
+	m.Backend = Backend(NewLimiter(rate, burst), "")
+	return m
+}
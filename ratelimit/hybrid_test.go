@@ -0,0 +1,33 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHybrid(t *testing.T) {
+	m := NewHybrid(0.001, 2, 10, 10, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	m.MaxWaitInQueue = 20 * time.Millisecond
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want %d", i, rec.Code, http.StatusOK)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d after the burst", rec.Code, http.StatusServiceUnavailable)
+	}
+	if rec.Header().Get("RateLimit-Remaining") != "" {
+		t.Fatalf("headers = %v, want only the headers of maxconnections", rec.Header())
+	}
+	if stats := m.Stats(); stats.Running != 0 || stats.Admitted != 2 || stats.Overloaded != 1 {
+		t.Fatalf("stats = %+v, want 2 admitted and 1 overloaded request", stats)
+	}
+}
@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// cachedLimit is a limit returned by the lookup of CachedLimits.
+type cachedLimit struct {
+	limit   Limit
+	expires time.Time
+}
+
+// CachedLimits caches the limits of keys returned by a lookup, e.g. from a
+// database of plans, so that the lookup is not made for every request. It
+// can be used as Limiter.KeyLimit:
+//
+//	limits := ratelimit.NewCachedLimits(lookupPlan, time.Minute, 10000)
+//	l := ratelimit.NewLimiter(1, 10)
+//	l.KeyLimit = limits.Limit
+type CachedLimits struct {
+	lookup  func(ctx context.Context, key string) (Limit, error)
+	ttl     time.Duration
+	maxKeys int
+
+	mu     sync.Mutex
+	limits map[string]cachedLimit
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// NewCachedLimits returns CachedLimits that keep the limits returned by
+// lookup for ttl. Up to maxKeys limits are cached at the same time, when
+// there is no room for a new key, an arbitrary limit is evicted.
+func NewCachedLimits(lookup func(ctx context.Context, key string) (Limit, error), ttl time.Duration, maxKeys int) *CachedLimits {
+	if maxKeys < 1 {
+		maxKeys = 1
+	}
+	return &CachedLimits{
+		lookup:  lookup,
+		ttl:     ttl,
+		maxKeys: maxKeys,
+		limits:  make(map[string]cachedLimit),
+		now:     time.Now,
+	}
+}
+
+// Limit returns the limit of key. If the cached limit has expired, it is
+// refreshed by the lookup. If the refresh fails, the expired limit is used
+// until the next refresh and the error is returned only if there is no
+// limit for the key.
+func (c *CachedLimits) Limit(ctx context.Context, key string) (Limit, error) {
+	now := c.now()
+	c.mu.Lock()
+	cached, ok := c.limits[key]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.limit, nil
+	}
+
+	limit, err := c.lookup(ctx, key)
+	if err != nil {
+		if ok {
+			return cached.limit, nil
+		}
+		return Limit{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.limits[key]; !ok && len(c.limits) >= c.maxKeys {
+		c.evict()
+	}
+	c.limits[key] = cachedLimit{limit: limit, expires: now.Add(c.ttl)}
+	return limit, nil
+}
+
+// evict removes an arbitrary cached limit. It should be called with mu held.
+func (c *CachedLimits) evict() {
+	for key := range c.limits {
+		delete(c.limits, key)
+		return
+	}
+}
+
+// Invalidate removes the cached limit of key, e.g. when the plan of the key
+// changes, so that the next request looks it up.
+func (c *CachedLimits) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.limits, key)
+}
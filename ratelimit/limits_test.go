@@ -0,0 +1,112 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCachedLimits(t *testing.T) {
+	now := time.Unix(0, 0)
+	lookups := 0
+	var lookupErr error
+	c := NewCachedLimits(func(ctx context.Context, key string) (Limit, error) {
+		lookups++
+		if lookupErr != nil {
+			return Limit{}, lookupErr
+		}
+		return Limit{Rate: float64(lookups), Burst: lookups}, nil
+	}, time.Minute, 1)
+	c.now = func() time.Time {
+		return now
+	}
+	get := func(key string) Limit {
+		limit, err := c.Limit(context.Background(), key)
+		if err != nil {
+			t.Fatalf("Limit(%q) = %v", key, err)
+		}
+		return limit
+	}
+
+	if limit := get("a"); limit.Burst != 1 {
+		t.Fatalf("Limit(a) = %+v, want the first lookup", limit)
+	}
+	if limit := get("a"); limit.Burst != 1 || lookups != 1 {
+		t.Fatalf("Limit(a) = %+v after %d lookups, want the cached limit", limit, lookups)
+	}
+
+	now = now.Add(time.Minute)
+	if limit := get("a"); limit.Burst != 2 {
+		t.Fatalf("Limit(a) = %+v, want the refreshed limit", limit)
+	}
+
+	// The refresh fails, the expired limit is used.
+	now = now.Add(time.Minute)
+	lookupErr = errors.New("database is down")
+	if limit := get("a"); limit.Burst != 2 {
+		t.Fatalf("Limit(a) = %+v, want the expired limit", limit)
+	}
+	if _, err := c.Limit(context.Background(), "b"); err != lookupErr {
+		t.Fatalf("Limit(b) = %v, want %v", err, lookupErr)
+	}
+
+	lookupErr = nil
+	get("b")
+	if len(c.limits) != 1 {
+		t.Fatalf("%d limits are cached, want 1", len(c.limits))
+	}
+	c.Invalidate("b")
+	if len(c.limits) != 0 {
+		t.Fatalf("the limit hasn't been invalidated")
+	}
+}
+
+func TestKeyLimit(t *testing.T) {
+	m := New(1, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	m.Store.(*MemoryStore).now = func() time.Time {
+		return time.Unix(0, 0)
+	}
+	m.Key = HeaderKey("X-API-Key")
+	m.KeyLimit = func(ctx context.Context, key string) (Limit, error) {
+		switch key {
+		case "paid":
+			return Limit{Rate: 10, Burst: 3}, nil
+		case "broken":
+			return Limit{}, errors.New("unknown plan")
+		}
+		return m.Limit(), nil
+	}
+	var errs int
+	m.OnError = func(err error) {
+		errs++
+	}
+
+	allowed := func(key string) int {
+		n := 0
+		for i := 0; i < 5; i++ {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("X-API-Key", key)
+			rec := httptest.NewRecorder()
+			m.ServeHTTP(rec, r)
+			if rec.Code == http.StatusOK {
+				n++
+			}
+			if i == 0 && key == "paid" && rec.Header().Get("RateLimit-Limit") != "3" {
+				t.Errorf("RateLimit-Limit = %q, want 3", rec.Header().Get("RateLimit-Limit"))
+			}
+		}
+		return n
+	}
+	if n := allowed("free"); n != 1 {
+		t.Fatalf("free: %d requests allowed, want 1", n)
+	}
+	if n := allowed("paid"); n != 3 {
+		t.Fatalf("paid: %d requests allowed, want 3", n)
+	}
+	if n := allowed("broken"); n != 1 || errs != 5 {
+		t.Fatalf("broken: %d requests allowed with %d errors, want the default limit and 5 errors", n, errs)
+	}
+}
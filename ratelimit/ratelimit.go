@@ -0,0 +1,426 @@
+// Package ratelimit limits the rate of requests per key with token buckets.
+// Unlike maxconnections, which limits how many requests run at the same
+// time, it limits how many requests a client can make per second, no matter
+// how fast they are served.
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dmage/middleware/decisionlog"
+)
+
+// ErrLimited is reported to Observer for requests that are rejected because
+// their key has run out of tokens.
+var ErrLimited = errors.New("ratelimit: rate limit exceeded")
+
+// ErrRefundUnsupported is returned by Limiter.RefundN if the store cannot
+// give back tokens.
+var ErrRefundUnsupported = errors.New("ratelimit: store does not support refunds")
+
+func defaultOverloadHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "429 too many requests, please try again later", http.StatusTooManyRequests)
+}
+
+// OverloadHandler is a default OverloadHandler for Middleware.
+var OverloadHandler http.Handler = http.HandlerFunc(defaultOverloadHandler)
+
+// RemoteAddrKey returns the host part of r.RemoteAddr.
+func RemoteAddrKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RefundFailures reports whether status is a server error or 429 Too Many
+// Requests, i.e. whether the request has failed because of the service or
+// its upstreams rather than the client. It can be used as Middleware.Refund.
+func RefundFailures(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+// PathKey returns the path of the request, so that each endpoint gets its
+// own bucket shared by all clients.
+func PathKey(r *http.Request) string {
+	return r.URL.Path
+}
+
+// HeaderKey returns a key function that uses the value of the header name,
+// e.g. an API key. Requests without the header share the empty key.
+func HeaderKey(name string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// Stats contains counters collected by Limiter.
+type Stats struct {
+	// Allowed is the number of allowed requests.
+	Allowed int64 `json:"allowed"`
+
+	// Limited is the number of rejected requests.
+	Limited int64 `json:"limited"`
+
+	// Refunded is the number of allowed requests that have been given
+	// back, see Middleware.Refund.
+	Refunded int64 `json:"refunded"`
+
+	// Keys is the number of buckets tracked by MemoryStore.
+	Keys int `json:"keys"`
+}
+
+// Algorithm defines how requests are counted.
+type Algorithm int
+
+const (
+	// TokenBucket refills the bucket of a key with rate tokens per second
+	// up to burst tokens. A client that has been idle can make burst
+	// requests at once and then continue at rate, so up to about twice
+	// burst requests can be made within burst/rate seconds.
+	TokenBucket Algorithm = iota
+
+	// SlidingWindow allows at most burst requests within any period of
+	// burst/rate seconds. It keeps the times of the requests in the window,
+	// so it needs more memory per key than TokenBucket.
+	SlidingWindow
+)
+
+// Limiter limits the rate of requests per key. By default the state of keys
+// is kept in memory, so the limit is enforced per process. A Limiter can be
+// shared by several middlewares, so that they draw from the same buckets.
+type Limiter struct {
+	// Algorithm is the algorithm of the limiter. It should be set before
+	// the limiter is used.
+	Algorithm Algorithm
+
+	// Store keeps the state of keys. By default it is a MemoryStore. A
+	// store shared by several processes, e.g. redisstore, enforces the
+	// limit across all of them.
+	Store Store
+
+	// KeyLimit, if not nil, returns the limit of key instead of the rate
+	// and the burst of the limiter, e.g. by the plan of an API key, see
+	// CachedLimits. If it fails, the key gets the limit of the limiter and
+	// the error is passed to OnError. The Algorithm of the returned limit
+	// is ignored.
+	KeyLimit func(ctx context.Context, key string) (Limit, error)
+
+	// OnError, if not nil, is called when Store fails. Such requests are
+	// allowed, so that an outage of the store doesn't take the service
+	// down.
+	OnError func(err error)
+
+	rate  float64
+	burst int
+
+	mu    sync.Mutex
+	stats Stats
+}
+
+// NewLimiter returns a Limiter that allows rate requests per second per key
+// on average, with bursts of up to burst requests.
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		Store: NewMemoryStore(),
+		rate:  rate,
+		burst: burst,
+	}
+}
+
+// Limit returns the limit of keys that have no limit of their own, see
+// KeyLimit.
+func (l *Limiter) Limit() Limit {
+	return Limit{
+		Rate:      l.rate,
+		Burst:     l.burst,
+		Algorithm: l.Algorithm,
+	}
+}
+
+// limitOf returns the limit of key.
+func (l *Limiter) limitOf(ctx context.Context, key string) Limit {
+	limit := l.Limit()
+	if l.KeyLimit == nil {
+		return limit
+	}
+	keyLimit, err := l.KeyLimit(ctx, key)
+	if err != nil {
+		if l.OnError != nil {
+			l.OnError(err)
+		}
+		return limit
+	}
+	keyLimit.Algorithm = limit.Algorithm
+	if keyLimit.Burst < 1 {
+		keyLimit.Burst = 1
+	}
+	return keyLimit
+}
+
+// TakeN takes n tokens from the bucket of key in l.Store, see AllowN. If the
+// store fails, the error is passed to OnError and returned with a Result
+// that allows the request.
+func (l *Limiter) TakeN(ctx context.Context, key string, n int) (Result, error) {
+	limit := l.limitOf(ctx, key)
+	res, err := l.Store.Take(ctx, key, n, limit)
+	if err != nil {
+		if l.OnError != nil {
+			l.OnError(err)
+		}
+		res = Result{OK: true}
+	}
+	res.Limit = limit.Burst
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if res.OK {
+		l.stats.Allowed++
+	} else {
+		l.stats.Limited++
+	}
+	return res, err
+}
+
+// RefundN gives back n tokens to the bucket of key, e.g. when a request
+// that has taken them has failed through no fault of the client. It returns
+// ErrRefundUnsupported if l.Store doesn't implement Refunder. Errors of the
+// store are passed to OnError.
+func (l *Limiter) RefundN(ctx context.Context, key string, n int) error {
+	r, ok := l.Store.(Refunder)
+	if !ok {
+		return ErrRefundUnsupported
+	}
+	if err := r.Refund(ctx, key, n, l.limitOf(ctx, key)); err != nil {
+		if l.OnError != nil {
+			l.OnError(err)
+		}
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stats.Refunded++
+	return nil
+}
+
+// AllowN takes n tokens from the bucket of key. If there are not enough
+// tokens, it takes none and returns false with the time after which they
+// will be available. Requests for more than burst tokens are never allowed.
+// With SlidingWindow, the request is counted as n requests.
+func (l *Limiter) AllowN(key string, n int) (ok bool, retryAfter time.Duration) {
+	res, _ := l.TakeN(context.Background(), key, n)
+	return res.OK, res.RetryAfter
+}
+
+// Allow takes one token from the bucket of key, see AllowN.
+func (l *Limiter) Allow(key string) (ok bool, retryAfter time.Duration) {
+	return l.AllowN(key, 1)
+}
+
+// Stats returns a snapshot of the collected counters.
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := l.stats
+	if m, ok := l.Store.(*MemoryStore); ok {
+		stats.Keys = m.Len()
+	}
+	return stats
+}
+
+// Observer receives events of the middleware. Methods are called
+// synchronously and must be safe for concurrent use.
+type Observer interface {
+	// Allowed is called when the request of key is allowed.
+	Allowed(ctx context.Context, key string)
+
+	// Rejected is called when the request of key is rejected with err.
+	// retryAfter is the time after which the request could be allowed, it
+	// is zero if it is unknown.
+	Rejected(ctx context.Context, key string, retryAfter time.Duration, err error)
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	// Limiter keeps the buckets. It can be shared with other middlewares.
+	*Limiter
+
+	// handler to invoke.
+	handler http.Handler
+
+	// Skip, if not nil, reports whether the request bypasses the limiter.
+	// Skipped requests are passed to the handler right away and don't
+	// take tokens, see the exempt package for common rules.
+	Skip func(r *http.Request) bool
+
+	// Key returns the key of the request. By default it is RemoteAddrKey.
+	// Behind reverse proxies, ipfilter.Extractor.Key gives the address of
+	// the client.
+	Key func(r *http.Request) string
+
+	// Cost, if not nil, returns the number of tokens that the request
+	// needs. If Cost returns a value less than 1, the request needs one
+	// token.
+	Cost func(r *http.Request) int
+
+	// OverloadHandler is called for rejected requests. The Retry-After
+	// header is set before it is called, if the wait is known.
+	OverloadHandler http.Handler
+
+	// RateLimitHeaders enables the RateLimit-Limit, RateLimit-Remaining and
+	// RateLimit-Reset headers (draft-ietf-httpapi-ratelimit-headers) on
+	// every response, so that clients can slow down before they are
+	// rejected. It is set by New.
+	RateLimitHeaders bool
+
+	// Observer, if not nil, receives events for every request.
+	Observer Observer
+
+	// Refund, if not nil, is called with the status code of every allowed
+	// response. If it returns true, the tokens of the request are given
+	// back, so that the client isn't charged for failures of the service,
+	// see RefundFailures. It needs a store that implements Refunder. The
+	// rejections of the middleware itself are never refunded.
+	Refund func(status int) bool
+}
+
+// New returns an http.Handler that passes to h up to rate requests per second
+// per key, with bursts of up to burst requests, see NewLimiter.
+func New(rate float64, burst int, h http.Handler) *Middleware {
+	return NewWithLimiter(NewLimiter(rate, burst), h)
+}
+
+// NewWithLimiter returns an http.Handler that passes requests to h when l
+// allows them.
+func NewWithLimiter(l *Limiter, h http.Handler) *Middleware {
+	return &Middleware{
+		Limiter:          l,
+		handler:          h,
+		Key:              RemoteAddrKey,
+		OverloadHandler:  OverloadHandler,
+		RateLimitHeaders: true,
+	}
+}
+
+// cost returns the number of tokens for r.
+func (m *Middleware) cost(r *http.Request) int {
+	if m.Cost == nil {
+		return 1
+	}
+	if n := m.Cost(r); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// seconds returns d in seconds rounded up.
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int((d + time.Second - 1) / time.Second))
+}
+
+// setHeaders sets the RateLimit-* headers for res.
+func (m *Middleware) setHeaders(w http.ResponseWriter, res Result) {
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", seconds(res.Reset))
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.Skip != nil && m.Skip(r) {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+	key := m.Key(r)
+	n := m.cost(r)
+	res, err := m.TakeN(r.Context(), key, n)
+	if m.RateLimitHeaders && err == nil {
+		m.setHeaders(w, res)
+	}
+	if !res.OK {
+		decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "ratelimit", Action: decisionlog.Deny, Rule: key, Reason: "rate limit exceeded"})
+		if m.Observer != nil {
+			m.Observer.Rejected(r.Context(), key, res.RetryAfter, ErrLimited)
+		}
+		if res.RetryAfter > 0 {
+			w.Header().Set("Retry-After", seconds(res.RetryAfter))
+		}
+		m.OverloadHandler.ServeHTTP(w, r)
+		return
+	}
+	decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "ratelimit", Action: decisionlog.Allow, Rule: key})
+	if m.Observer != nil {
+		m.Observer.Allowed(r.Context(), key)
+	}
+	if m.Refund == nil || err != nil {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	m.handler.ServeHTTP(sw, r)
+	if m.Refund(sw.statusCode()) {
+		m.RefundN(r.Context(), key, n)
+	}
+}
+
+// statusWriter remembers the status code of the response. It implements
+// http.Flusher and http.Hijacker when the underlying writer does.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// statusCode returns the status code of the response. Handlers that write
+// nothing respond with 200 OK.
+func (w *statusWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// FlushError flushes the response, see http.ResponseController.
+func (w *statusWriter) FlushError() error {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statusWriter) Flush() {
+	w.FlushError()
+}
+
+// Hijack lets the handler take over the connection, see http.Hijacker.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
@@ -0,0 +1,306 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewLimiter(2, 3)
+	l.Store.(*MemoryStore).now = func() time.Time {
+		return now
+	}
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d: Allow() = false, want true", i)
+		}
+	}
+	ok, retryAfter := l.Allow("a")
+	if ok || retryAfter != 500*time.Millisecond {
+		t.Fatalf("Allow() = %v, %v; want false, 500ms", ok, retryAfter)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Fatalf("other key: Allow() = false, want true")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatalf("after refill: Allow() = false, want true")
+	}
+	if ok, retryAfter := l.AllowN("a", 4); ok || retryAfter != 0 {
+		t.Fatalf("AllowN(4) = %v, %v; want false, 0", ok, retryAfter)
+	}
+
+	expected := Stats{Allowed: 5, Limited: 2, Keys: 2}
+	if stats := l.Stats(); stats != expected {
+		t.Fatalf("Stats() = %+v, want %+v", stats, expected)
+	}
+}
+
+func TestLimiterCleanup(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewLimiter(1, 1)
+	l.Store.(*MemoryStore).now = func() time.Time {
+		return now
+	}
+	l.Allow("old")
+	now = now.Add(time.Minute)
+	for i := 0; i < cleanupInterval; i++ {
+		l.Allow(string(rune('a'+i%26)) + time.Duration(i).String())
+	}
+	if _, ok := l.Store.(*MemoryStore).buckets["old"]; ok {
+		t.Fatalf("the refilled bucket hasn't been removed")
+	}
+}
+
+type testObserver struct {
+	allowed, rejected int
+	retryAfter        time.Duration
+}
+
+func (o *testObserver) Allowed(ctx context.Context, key string) {
+	o.allowed++
+}
+
+func (o *testObserver) Rejected(ctx context.Context, key string, retryAfter time.Duration, err error) {
+	o.rejected++
+	o.retryAfter = retryAfter
+}
+
+func TestMiddleware(t *testing.T) {
+	m := New(0.5, 2, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	m.Store.(*MemoryStore).now = func() time.Time {
+		return time.Unix(0, 0)
+	}
+	m.Key = HeaderKey("X-API-Key")
+	observer := &testObserver{}
+	m.Observer = observer
+
+	testCases := []struct {
+		key        string
+		status     int
+		retryAfter string
+		remaining  string
+		reset      string
+	}{
+		{"a", http.StatusOK, "", "1", "2"},
+		{"a", http.StatusOK, "", "0", "4"},
+		{"a", http.StatusTooManyRequests, "2", "0", "4"},
+		{"b", http.StatusOK, "", "1", "2"},
+	}
+	for i, tc := range testCases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-API-Key", tc.key)
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, r)
+		if rec.Code != tc.status {
+			t.Errorf("request %d: status = %d, want %d", i, rec.Code, tc.status)
+		}
+		h := rec.Header()
+		if v := h.Get("Retry-After"); v != tc.retryAfter {
+			t.Errorf("request %d: Retry-After = %q, want %q", i, v, tc.retryAfter)
+		}
+		if h.Get("RateLimit-Limit") != "2" || h.Get("RateLimit-Remaining") != tc.remaining || h.Get("RateLimit-Reset") != tc.reset {
+			t.Errorf("request %d: RateLimit-Limit = %q, RateLimit-Remaining = %q, RateLimit-Reset = %q; want 2, %s, %s",
+				i, h.Get("RateLimit-Limit"), h.Get("RateLimit-Remaining"), h.Get("RateLimit-Reset"), tc.remaining, tc.reset)
+		}
+	}
+	if observer.allowed != 3 || observer.rejected != 1 {
+		t.Fatalf("observer: allowed = %d, rejected = %d; want 3, 1", observer.allowed, observer.rejected)
+	}
+
+	m.RateLimitHeaders = false
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if v := rec.Header().Get("RateLimit-Limit"); v != "" {
+		t.Fatalf("RateLimit-Limit = %q when headers are disabled", v)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewLimiter(1, 2)
+	l.Algorithm = SlidingWindow
+	l.Store.(*MemoryStore).now = func() time.Time {
+		return now
+	}
+
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatalf("first request: Allow() = false, want true")
+	}
+	now = now.Add(1500 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatalf("second request: Allow() = false, want true")
+	}
+
+	// A token bucket would have been refilled by now, but the window still
+	// contains the second request.
+	now = now.Add(1 * time.Second)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatalf("third request: Allow() = false, want true")
+	}
+	ok, retryAfter := l.Allow("a")
+	if ok || retryAfter != time.Second {
+		t.Fatalf("fourth request: Allow() = %v, %v; want false, 1s", ok, retryAfter)
+	}
+	if ok, retryAfter := l.AllowN("a", 3); ok || retryAfter != 0 {
+		t.Fatalf("AllowN(3) = %v, %v; want false, 0", ok, retryAfter)
+	}
+
+	now = now.Add(1500 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatalf("after the window: Allow() = false, want true")
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Take(ctx context.Context, key string, n int, limit Limit) (Result, error) {
+	return Result{}, errors.New("store is down")
+}
+
+func TestStoreError(t *testing.T) {
+	l := NewLimiter(1, 1)
+	l.Store = failingStore{}
+	var errs int
+	l.OnError = func(err error) {
+		errs++
+	}
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d: Allow() = false, want true", i)
+		}
+	}
+	if errs != 2 {
+		t.Fatalf("OnError has been called %d times, want 2", errs)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	status := http.StatusBadGateway
+	m := New(0.5, 2, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	m.Store.(*MemoryStore).now = func() time.Time {
+		return time.Unix(0, 0)
+	}
+	m.Refund = RefundFailures
+
+	serve := func() int {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Code
+	}
+	for i := 0; i < 5; i++ {
+		if code := serve(); code != http.StatusBadGateway {
+			t.Fatalf("request %d: status = %d, want failures not to be charged", i, code)
+		}
+	}
+	status = http.StatusOK
+	for i := 0; i < 2; i++ {
+		if code := serve(); code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want %d", i, code, http.StatusOK)
+		}
+	}
+	if code := serve(); code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want successful requests to be charged", code)
+	}
+	if stats := m.Stats(); stats.Refunded != 5 || stats.Limited != 1 {
+		t.Fatalf("Stats() = %+v, want 5 refunded and 1 limited requests", stats)
+	}
+}
+
+func TestRefundSlidingWindow(t *testing.T) {
+	l := NewLimiter(1, 2)
+	l.Algorithm = SlidingWindow
+	l.AllowN("a", 2)
+	if err := l.RefundN(context.Background(), "a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatalf("Allow() = false after a refund, want true")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatalf("Allow() = true, want the refund to be a single request")
+	}
+
+	l.Store = failingStore{}
+	if err := l.RefundN(context.Background(), "a", 1); err != ErrRefundUnsupported {
+		t.Fatalf("RefundN() error = %v, want %v", err, ErrRefundUnsupported)
+	}
+}
+
+func TestSkip(t *testing.T) {
+	m := New(0.5, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	m.Skip = func(r *http.Request) bool {
+		return r.Method == "OPTIONS"
+	}
+	for i, tc := range []struct {
+		method string
+		status int
+	}{
+		{"OPTIONS", http.StatusOK},
+		{"GET", http.StatusOK},
+		{"OPTIONS", http.StatusOK},
+		{"GET", http.StatusTooManyRequests},
+	} {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest(tc.method, "/", nil))
+		if rec.Code != tc.status {
+			t.Errorf("request %d: status = %d, want %d", i, rec.Code, tc.status)
+		}
+	}
+	if stats := m.Stats(); stats.Allowed != 1 {
+		t.Fatalf("Allowed = %d, want skipped requests not to be counted", stats.Allowed)
+	}
+}
+
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func TestRefundInterfaces(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws" {
+			hj, ok := w.(http.Hijacker)
+			if !ok {
+				t.Fatal("the writer doesn't implement http.Hijacker")
+			}
+			if _, _, err := hj.Hijack(); err != nil {
+				t.Fatalf("Hijack() = %v, want nil", err)
+			}
+			return
+		}
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("the writer doesn't implement http.Flusher")
+		}
+		f.Flush()
+	})
+	m := New(1, 10, h)
+	m.Refund = RefundFailures
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !rec.Flushed {
+		t.Errorf("the response hasn't been flushed")
+	}
+	hj := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	m.ServeHTTP(hj, httptest.NewRequest("GET", "/ws", nil))
+	if !hj.hijacked {
+		t.Errorf("the connection hasn't been hijacked")
+	}
+}
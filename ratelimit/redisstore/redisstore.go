@@ -0,0 +1,232 @@
+// Package redisstore implements a ratelimit.Store that keeps the state of
+// keys in Redis, so that the limit is enforced across all replicas of a
+// service rather than per process.
+//
+// Every request is counted by a Lua script that runs atomically on the
+// server and uses the server clock. Keys expire once they are equivalent to
+// missing ones, so idle clients don't occupy memory.
+package redisstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/dmage/middleware/ratelimit"
+)
+
+// Client is the subset of a Redis client used by Store. For example, a
+// go-redis client can be adapted as
+//
+//	redisstore.EvalFunc(func(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+//		return rdb.Eval(ctx, script, keys, args...).Result()
+//	})
+type Client interface {
+	// Eval runs a Lua script and returns its result.
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+// EvalFunc is an adapter to allow the use of ordinary functions as Client.
+type EvalFunc func(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+
+// Eval calls f(ctx, script, keys, args...).
+func (f EvalFunc) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	return f(ctx, script, keys, args...)
+}
+
+// The scripts return {ok, retry, remaining, reset}: ok is 1 if the requests
+// are allowed, retry is the number of milliseconds after which they will be
+// allowed, or 0 if they never will, remaining is the number of requests that
+// can be made right away, and reset is the number of milliseconds after which
+// the key has its full quota again.
+const (
+	serverTime = `
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + tonumber(t[2]) / 1000
+`
+
+	// tokenBucketScript keeps the tokens and the time of the last update
+	// in the hash KEYS[1].
+	tokenBucketScript = serverTime + `
+local rate, burst, n = tonumber(ARGV[1]) / 1000, tonumber(ARGV[2]), tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens, last = tonumber(state[1]), tonumber(state[2])
+if not tokens then
+	tokens, last = burst, now
+end
+if now > last then
+	tokens = math.min(burst, tokens + (now - last) * rate)
+	last = now
+end
+local ok, retry, reset = 0, 0, 0
+if tokens >= n then
+	ok = 1
+	tokens = tokens - n
+	redis.call('HSET', KEYS[1], 'tokens', tokens, 'last', last)
+	if rate > 0 then
+		redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate) + 1)
+	end
+elseif n <= burst and rate > 0 then
+	retry = math.ceil((n - tokens) / rate)
+end
+if rate > 0 then
+	reset = math.ceil((burst - tokens) / rate)
+end
+return {ok, retry, math.floor(tokens), reset}
+`
+
+	// slidingWindowScript keeps the requests in the window in the sorted
+	// set KEYS[1] scored by their times.
+	slidingWindowScript = serverTime + `
+local window, burst, n, id = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), ARGV[4]
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local ok, retry, reset = 0, 0, 0
+if count + n <= burst then
+	ok = 1
+	for i = 1, n do
+		redis.call('ZADD', KEYS[1], now, id .. ':' .. i)
+	end
+	count = count + n
+	redis.call('PEXPIRE', KEYS[1], math.ceil(window))
+elseif n <= burst then
+	local oldest = redis.call('ZRANGE', KEYS[1], count + n - burst - 1, count + n - burst - 1, 'WITHSCORES')
+	retry = math.ceil(tonumber(oldest[2]) + window - now)
+end
+if count > 0 then
+	local newest = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+	reset = math.ceil(tonumber(newest[2]) + window - now)
+end
+return {ok, retry, burst - count, reset}
+`
+
+	// refundTokenBucketScript gives back ARGV[3] tokens to the bucket of
+	// tokenBucketScript.
+	refundTokenBucketScript = serverTime + `
+local rate, burst, n = tonumber(ARGV[1]) / 1000, tonumber(ARGV[2]), tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens, last = tonumber(state[1]), tonumber(state[2])
+if not tokens then
+	return 0
+end
+if now > last then
+	tokens = math.min(burst, tokens + (now - last) * rate)
+	last = now
+end
+tokens = math.min(burst, tokens + n)
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'last', last)
+if rate > 0 then
+	redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate) + 1)
+end
+return 1
+`
+
+	// refundSlidingWindowScript removes the ARGV[1] newest requests from the
+	// window of slidingWindowScript.
+	refundSlidingWindowScript = `
+local n = tonumber(ARGV[1])
+if n > 0 then
+	redis.call('ZREMRANGEBYRANK', KEYS[1], -n, -1)
+end
+return 1
+`
+)
+
+// Store implements the ratelimit.Store interface.
+type Store struct {
+	client Client
+
+	// Prefix is prepended to the keys of requests to get Redis keys.
+	Prefix string
+}
+
+var (
+	_ ratelimit.Store    = (*Store)(nil)
+	_ ratelimit.Refunder = (*Store)(nil)
+)
+
+// New returns a Store that keeps the state of keys in Redis under
+// prefix. Limiters of all replicas should use the same prefix and limit.
+func New(client Client, prefix string) *Store {
+	return &Store{
+		client: client,
+		Prefix: prefix,
+	}
+}
+
+func newRequestID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// parseResult parses a result of the scripts.
+func parseResult(res interface{}) (ratelimit.Result, error) {
+	unexpected := fmt.Errorf("redisstore: unexpected script result %v (%T)", res, res)
+	values, _ := res.([]interface{})
+	if len(values) != 4 {
+		return ratelimit.Result{}, unexpected
+	}
+	var ints [4]int64
+	for i, v := range values {
+		n, ok := toInt64(v)
+		if !ok {
+			return ratelimit.Result{}, unexpected
+		}
+		ints[i] = n
+	}
+	return ratelimit.Result{
+		OK:         ints[0] == 1,
+		RetryAfter: time.Duration(ints[1]) * time.Millisecond,
+		Remaining:  int(ints[2]),
+		Reset:      time.Duration(ints[3]) * time.Millisecond,
+	}, nil
+}
+
+// Take implements ratelimit.Store.
+func (s *Store) Take(ctx context.Context, key string, n int, limit ratelimit.Limit) (ratelimit.Result, error) {
+	keys := []string{s.Prefix + key}
+	var res interface{}
+	var err error
+	if limit.Algorithm == ratelimit.SlidingWindow {
+		var id string
+		id, err = newRequestID()
+		if err != nil {
+			return ratelimit.Result{}, err
+		}
+		window := int64(limit.Window() / time.Millisecond)
+		res, err = s.client.Eval(ctx, slidingWindowScript, keys, window, limit.Burst, n, id)
+	} else {
+		res, err = s.client.Eval(ctx, tokenBucketScript, keys, limit.Rate, limit.Burst, n)
+	}
+	if err != nil {
+		return ratelimit.Result{}, err
+	}
+	return parseResult(res)
+}
+
+// Refund implements ratelimit.Refunder.
+func (s *Store) Refund(ctx context.Context, key string, n int, limit ratelimit.Limit) error {
+	keys := []string{s.Prefix + key}
+	var err error
+	if limit.Algorithm == ratelimit.SlidingWindow {
+		_, err = s.client.Eval(ctx, refundSlidingWindowScript, keys, n)
+	} else {
+		_, err = s.client.Eval(ctx, refundTokenBucketScript, keys, limit.Rate, limit.Burst, n)
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package redisstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dmage/middleware/ratelimit"
+)
+
+// fakeRedis returns canned results and records the calls.
+type fakeRedis struct {
+	result interface{}
+	err    error
+
+	script string
+	keys   []string
+	args   []interface{}
+}
+
+func (f *fakeRedis) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	f.script, f.keys, f.args = script, keys, args
+	return f.result, f.err
+}
+
+func TestTake(t *testing.T) {
+	testCases := []struct {
+		name     string
+		result   interface{}
+		expected ratelimit.Result
+		err      bool
+	}{
+		{
+			name:     "allowed",
+			result:   []interface{}{int64(1), int64(0), int64(3), int64(200)},
+			expected: ratelimit.Result{OK: true, Remaining: 3, Reset: 200 * time.Millisecond},
+		},
+		{
+			name:     "limited",
+			result:   []interface{}{int64(0), int64(150), int64(0), int64(500)},
+			expected: ratelimit.Result{RetryAfter: 150 * time.Millisecond, Reset: 500 * time.Millisecond},
+		},
+		{
+			name:   "unexpected",
+			result: []interface{}{int64(1), int64(0)},
+			err:    true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			redis := &fakeRedis{result: tc.result}
+			s := New(redis, "rl:")
+			res, err := s.Take(context.Background(), "a", 2, ratelimit.Limit{Rate: 10, Burst: 5})
+			if res != tc.expected || (err != nil) != tc.err {
+				t.Fatalf("Take() = %+v, %v; want %+v, error %v", res, err, tc.expected, tc.err)
+			}
+			if redis.script != tokenBucketScript || len(redis.keys) != 1 || redis.keys[0] != "rl:a" {
+				t.Fatalf("unexpected call: keys %v", redis.keys)
+			}
+			if redis.args[0] != 10.0 || redis.args[1] != 5 || redis.args[2] != 2 {
+				t.Fatalf("args = %v, want [10 5 2]", redis.args)
+			}
+		})
+	}
+}
+
+func TestTakeSlidingWindow(t *testing.T) {
+	redis := &fakeRedis{result: []interface{}{int64(1), int64(0), int64(4), int64(500)}}
+	s := New(redis, "rl:")
+	limit := ratelimit.Limit{Rate: 10, Burst: 5, Algorithm: ratelimit.SlidingWindow}
+	if res, err := s.Take(context.Background(), "a", 1, limit); !res.OK || err != nil {
+		t.Fatalf("Take() = %+v, %v; want OK", res, err)
+	}
+	if redis.script != slidingWindowScript {
+		t.Fatalf("the sliding window script hasn't been used")
+	}
+	if redis.args[0] != int64(500) || redis.args[1] != 5 || redis.args[2] != 1 {
+		t.Fatalf("args = %v, want [500 5 1 <id>]", redis.args)
+	}
+	id1 := redis.args[3]
+	s.Take(context.Background(), "a", 1, limit)
+	if redis.args[3] == id1 {
+		t.Fatalf("requests have the same id %v", id1)
+	}
+
+	redis.err = errors.New("connection refused")
+	if _, err := s.Take(context.Background(), "a", 1, limit); err != redis.err {
+		t.Fatalf("Take() error = %v, want %v", err, redis.err)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	redis := &fakeRedis{result: int64(1)}
+	s := New(redis, "rl:")
+	if err := s.Refund(context.Background(), "a", 2, ratelimit.Limit{Rate: 10, Burst: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if redis.script != refundTokenBucketScript || redis.keys[0] != "rl:a" || redis.args[2] != 2 {
+		t.Fatalf("unexpected call: keys %v, args %v", redis.keys, redis.args)
+	}
+
+	limit := ratelimit.Limit{Rate: 10, Burst: 5, Algorithm: ratelimit.SlidingWindow}
+	if err := s.Refund(context.Background(), "a", 1, limit); err != nil {
+		t.Fatal(err)
+	}
+	if redis.script != refundSlidingWindowScript || len(redis.args) != 1 || redis.args[0] != 1 {
+		t.Fatalf("unexpected call: args %v", redis.args)
+	}
+
+	redis.err = errors.New("connection refused")
+	if err := s.Refund(context.Background(), "a", 1, limit); err != redis.err {
+		t.Fatalf("Refund() error = %v, want %v", err, redis.err)
+	}
+}
@@ -0,0 +1,291 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit describes how many requests a key can make.
+type Limit struct {
+	// Rate is the number of requests per second on average.
+	Rate float64
+
+	// Burst is the maximum number of requests at once.
+	Burst int
+
+	// Algorithm defines how the requests are counted.
+	Algorithm Algorithm
+}
+
+// Window returns the period within which SlidingWindow allows at most Burst
+// requests.
+func (l Limit) Window() time.Duration {
+	if l.Rate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+}
+
+// Result is the outcome of Store.Take.
+type Result struct {
+	// OK is true if the requests are allowed.
+	OK bool
+
+	// RetryAfter is the time after which the requests will be allowed if
+	// they are not. It is zero if they never will.
+	RetryAfter time.Duration
+
+	// Remaining is the number of requests that the key can make right
+	// away.
+	Remaining int
+
+	// Reset is the time after which the key can make Burst requests again.
+	Reset time.Duration
+
+	// Limit is the Burst of the limit of the key. It is set by
+	// Limiter.TakeN, stores don't need to set it.
+	Limit int
+}
+
+// Store keeps the state of keys.
+type Store interface {
+	// Take records n requests of key if they fit into limit. If they don't,
+	// it records nothing and returns a Result that isn't OK.
+	Take(ctx context.Context, key string, n int, limit Limit) (Result, error)
+}
+
+// Refunder is implemented by stores that can give back requests recorded by
+// Take.
+type Refunder interface {
+	// Refund gives back n requests of key taken with limit, so that they
+	// don't count against it anymore.
+	Refund(ctx context.Context, key string, n int, limit Limit) error
+}
+
+// bucket is the state of a key.
+type bucket struct {
+	// tokens and last are used by TokenBucket.
+	tokens float64
+	last   time.Time
+
+	// times are the times of the requests within the window, oldest
+	// first. They are used by SlidingWindow.
+	times []time.Time
+
+	// limit is the limit of the last request of the key.
+	limit Limit
+}
+
+// cleanupInterval is the number of new keys after which idle buckets are
+// removed.
+const cleanupInterval = 1024
+
+// MemoryStore keeps the state of keys in memory.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	inserts int
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore returns a new MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Len returns the number of tracked buckets.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buckets)
+}
+
+// refill adds the tokens earned by b since its last update.
+func refill(b *bucket, limit Limit, now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.tokens+elapsed.Seconds()*limit.Rate, float64(limit.Burst))
+		b.last = now
+	}
+}
+
+// expire removes from b the times that are out of the window.
+func expire(b *bucket, limit Limit, now time.Time) {
+	window := limit.Window()
+	i := 0
+	for i < len(b.times) && now.Sub(b.times[i]) >= window {
+		i++
+	}
+	b.times = append(b.times[:0], b.times[i:]...)
+}
+
+// idle reports whether b is equivalent to a missing bucket.
+func idle(b *bucket, limit Limit, now time.Time) bool {
+	if limit.Algorithm == SlidingWindow {
+		expire(b, limit, now)
+		return len(b.times) == 0
+	}
+	refill(b, limit, now)
+	return b.tokens >= float64(limit.Burst)
+}
+
+// cleanup removes idle buckets. It should be called with mu held.
+func (s *MemoryStore) cleanup(now time.Time) {
+	for key, b := range s.buckets {
+		if idle(b, b.limit, now) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// takeTokens takes n tokens from b.
+func takeTokens(b *bucket, n int, limit Limit, now time.Time) Result {
+	refill(b, limit, now)
+	var res Result
+	if b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		res.OK = true
+	} else if n <= limit.Burst && limit.Rate > 0 {
+		res.RetryAfter = time.Duration((float64(n) - b.tokens) / limit.Rate * float64(time.Second))
+	}
+	res.Remaining = int(b.tokens)
+	if limit.Rate > 0 {
+		res.Reset = time.Duration((float64(limit.Burst) - b.tokens) / limit.Rate * float64(time.Second))
+	}
+	return res
+}
+
+// takeWindow records n requests in the window of b.
+func takeWindow(b *bucket, n int, limit Limit, now time.Time) Result {
+	expire(b, limit, now)
+	var res Result
+	if len(b.times)+n <= limit.Burst {
+		for i := 0; i < n; i++ {
+			b.times = append(b.times, now)
+		}
+		res.OK = true
+	} else if n <= limit.Burst && limit.Rate > 0 {
+		// The request fits once enough of the oldest requests leave the
+		// window.
+		oldest := b.times[len(b.times)+n-limit.Burst-1]
+		res.RetryAfter = oldest.Add(limit.Window()).Sub(now)
+	}
+	res.Remaining = limit.Burst - len(b.times)
+	if len(b.times) > 0 && limit.Rate > 0 {
+		res.Reset = b.times[len(b.times)-1].Add(limit.Window()).Sub(now)
+	}
+	return res
+}
+
+// Take implements Store. Keys may have different limits, idle buckets are
+// removed according to the limit of their last request.
+func (s *MemoryStore) Take(ctx context.Context, key string, n int, limit Limit) (Result, error) {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.buckets[key]
+	if b == nil {
+		// Clean up before the new bucket is added, it would be removed
+		// as idle.
+		if s.inserts++; s.inserts%cleanupInterval == 0 {
+			s.cleanup(now)
+		}
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		s.buckets[key] = b
+	}
+	b.limit = limit
+	if limit.Algorithm == SlidingWindow {
+		return takeWindow(b, n, limit, now), nil
+	}
+	return takeTokens(b, n, limit, now), nil
+}
+
+var _ Refunder = (*MemoryStore)(nil)
+
+// Refund implements Refunder. TokenBucket gets back n tokens up to Burst,
+// SlidingWindow forgets the n newest requests.
+func (s *MemoryStore) Refund(ctx context.Context, key string, n int, limit Limit) error {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.buckets[key]
+	if b == nil {
+		return nil
+	}
+	if limit.Algorithm == SlidingWindow {
+		expire(b, limit, now)
+		if n > len(b.times) {
+			n = len(b.times)
+		}
+		b.times = b.times[:len(b.times)-n]
+		return nil
+	}
+	refill(b, limit, now)
+	b.tokens = math.Min(b.tokens+float64(n), float64(limit.Burst))
+	return nil
+}
+
+// snapshotBucket is the JSON form of a bucket.
+type snapshotBucket struct {
+	Tokens    float64     `json:"tokens,omitempty"`
+	Last      time.Time   `json:"last"`
+	Times     []time.Time `json:"times,omitempty"`
+	Rate      float64     `json:"rate"`
+	Burst     int         `json:"burst"`
+	Algorithm Algorithm   `json:"algorithm"`
+}
+
+// Snapshot returns the buckets that aren't idle as JSON, so that clients
+// can't get a fresh burst by waiting for a restart, see
+// middleware.Snapshotter.
+func (s *MemoryStore) Snapshot() ([]byte, error) {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buckets := make(map[string]snapshotBucket, len(s.buckets))
+	for key, b := range s.buckets {
+		if idle(b, b.limit, now) {
+			continue
+		}
+		buckets[key] = snapshotBucket{
+			Tokens:    b.tokens,
+			Last:      b.last,
+			Times:     b.times,
+			Rate:      b.limit.Rate,
+			Burst:     b.limit.Burst,
+			Algorithm: b.limit.Algorithm,
+		}
+	}
+	return json.Marshal(buckets)
+}
+
+// Restore replaces the buckets with the ones saved by Snapshot.
+func (s *MemoryStore) Restore(data []byte) error {
+	var buckets map[string]snapshotBucket
+	if err := json.Unmarshal(data, &buckets); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets = make(map[string]*bucket, len(buckets))
+	for key, b := range buckets {
+		s.buckets[key] = &bucket{
+			tokens: b.Tokens,
+			last:   b.Last,
+			times:  b.Times,
+			limit:  Limit{Rate: b.Rate, Burst: b.Burst, Algorithm: b.Algorithm},
+		}
+	}
+	return nil
+}
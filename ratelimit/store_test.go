@@ -0,0 +1,41 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreSnapshot(t *testing.T) {
+	now := time.Unix(0, 0)
+	clock := func() time.Time {
+		return now
+	}
+	s := NewMemoryStore()
+	s.now = clock
+	ctx := context.Background()
+	limit := Limit{Rate: 1, Burst: 2}
+	window := Limit{Rate: 1, Burst: 2, Algorithm: SlidingWindow}
+	s.Take(ctx, "a", 2, limit)
+	s.Take(ctx, "b", 1, window)
+	s.Take(ctx, "idle", 0, limit)
+	data, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewMemoryStore()
+	restored.now = clock
+	if err := restored.Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	if n := restored.Len(); n != 2 {
+		t.Fatalf("Len() = %d, want idle buckets to be skipped", n)
+	}
+	if res, _ := restored.Take(ctx, "a", 1, limit); res.OK {
+		t.Fatalf("Take() = %+v after restore, want the bucket to stay empty", res)
+	}
+	if res, _ := restored.Take(ctx, "b", 1, window); !res.OK || res.Remaining != 0 {
+		t.Fatalf("Take() = %+v after restore, want the last request of the window", res)
+	}
+}
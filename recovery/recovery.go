@@ -0,0 +1,152 @@
+// Package recovery catches panics of handlers, logs them with the stack and
+// responds with 500 Internal Server Error.
+//
+// Middlewares of this repository release their resources with deferred
+// calls, so a panic doesn't leak running units of a maxconnections limiter
+// regardless of whether the recovery middleware wraps the limiter or is
+// wrapped by it.
+package recovery
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+)
+
+func defaultPanicHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "500 internal server error", http.StatusInternalServerError)
+}
+
+// PanicHandler is a default PanicHandler for Middleware.
+var PanicHandler http.Handler = http.HandlerFunc(defaultPanicHandler)
+
+type panicKey struct{}
+
+// PanicFromContext returns the value that the handler has panicked with. It
+// can be used by PanicHandler.
+func PanicFromContext(ctx context.Context) interface{} {
+	return ctx.Value(panicKey{})
+}
+
+// responseWriter remembers whether the response has been started. It
+// implements http.Flusher and http.Hijacker when the underlying writer does.
+type responseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if status >= 200 {
+		// Informational responses, e.g. 103 Early Hints, leave room for
+		// the final one.
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+// FlushError flushes the response, see http.ResponseController.
+func (w *responseWriter) FlushError() error {
+	w.wroteHeader = true
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *responseWriter) Flush() {
+	w.FlushError()
+}
+
+// Hijack lets the handler take over the connection, see http.Hijacker. The
+// response of a hijacked connection can't be replaced after a panic.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.wroteHeader = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler http.Handler
+
+	// Logger is the logger for panics. By default it is slog.Default().
+	Logger *slog.Logger
+
+	// PanicHandler is called to respond to a request whose handler has
+	// panicked, see PanicFromContext. It is not called if the handler has
+	// already started the response, the connection is aborted instead.
+	PanicHandler http.Handler
+
+	// OnPanic, if not nil, is called with the panic value and the stack,
+	// e.g. to report the panic to an error tracker.
+	OnPanic func(r *http.Request, v interface{}, stack []byte)
+
+	// RePanic makes the middleware panic with http.ErrAbortHandler after
+	// the panic has been handled, so that the outer middlewares see the
+	// failure and the server aborts the connection without logging the
+	// panic again.
+	RePanic bool
+}
+
+// New returns an http.Handler that passes requests to h and recovers from
+// its panics.
+func New(h http.Handler) *Middleware {
+	return &Middleware{
+		handler:      h,
+		PanicHandler: PanicHandler,
+	}
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rw := &responseWriter{ResponseWriter: w}
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		if v == http.ErrAbortHandler {
+			// The handler has asked to abort the connection, it is not
+			// an error.
+			panic(v)
+		}
+
+		stack := debug.Stack()
+		logger := m.Logger
+		if logger == nil {
+			logger = slog.Default()
+		}
+		logger.LogAttrs(r.Context(), slog.LevelError, "panic",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("panic", fmt.Sprint(v)),
+			slog.String("stack", string(stack)),
+		)
+		if m.OnPanic != nil {
+			m.OnPanic(r, v, stack)
+		}
+
+		if rw.wroteHeader {
+			// The client has got a part of the response, it can learn
+			// about the failure only from the aborted connection.
+			panic(http.ErrAbortHandler)
+		}
+		m.PanicHandler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), panicKey{}, v)))
+		if m.RePanic {
+			panic(http.ErrAbortHandler)
+		}
+	}()
+	m.handler.ServeHTTP(rw, r)
+}
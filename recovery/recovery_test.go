@@ -0,0 +1,124 @@
+package recovery
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+func TestRecovery(t *testing.T) {
+	var buf bytes.Buffer
+	limiter := maxconnections.New(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/partial" {
+			w.Write([]byte("partial"))
+		}
+		panic("boom")
+	}))
+	m := New(limiter)
+	m.Logger = slog.New(slog.NewTextHandler(&buf, nil))
+	var panicked interface{}
+	m.PanicHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panicked = PanicFromContext(r.Context())
+		PanicHandler.ServeHTTP(w, r)
+	})
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusInternalServerError {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+		}
+		// The running unit of the request has been released, so the next
+		// request is admitted.
+		if running := limiter.Stats().Running; running != 0 {
+			t.Fatalf("running = %d after a panic, want 0", running)
+		}
+	}
+	if panicked != "boom" {
+		t.Fatalf("PanicFromContext() = %v, want boom", panicked)
+	}
+	if !strings.Contains(buf.String(), "panic=boom") || !strings.Contains(buf.String(), "recovery_test.go") {
+		t.Fatalf("the panic hasn't been logged with the stack: %s", buf.String())
+	}
+
+	expectAbort := func(path string) {
+		t.Helper()
+		defer func() {
+			if v := recover(); v != http.ErrAbortHandler {
+				t.Fatalf("%s: recover() = %v, want %v", path, v, http.ErrAbortHandler)
+			}
+		}()
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	expectAbort("/partial")
+	m.RePanic = true
+	expectAbort("/")
+}
+
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func TestInterfaces(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws" {
+			hj, ok := w.(http.Hijacker)
+			if !ok {
+				t.Fatal("the writer doesn't implement http.Hijacker")
+			}
+			if _, _, err := hj.Hijack(); err != nil {
+				t.Fatalf("Hijack() = %v, want nil", err)
+			}
+			return
+		}
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("the writer doesn't implement http.Flusher")
+		}
+		f.Flush()
+	})
+	m := New(h)
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !rec.Flushed {
+		t.Errorf("the response hasn't been flushed")
+	}
+	hj := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	m.ServeHTTP(hj, httptest.NewRequest("GET", "/ws", nil))
+	if !hj.hijacked {
+		t.Errorf("the connection hasn't been hijacked")
+	}
+}
+
+func TestEarlyHints(t *testing.T) {
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		panic("boom")
+	}))
+	m.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	handled := false
+	m.PanicHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled = true
+		PanicHandler.ServeHTTP(w, r)
+	})
+
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !handled {
+		t.Fatalf("PanicHandler hasn't been called after early hints")
+	}
+}
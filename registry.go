@@ -0,0 +1,202 @@
+package middleware
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Registry is a set of named components, such as limiters, circuit breakers
+// and rate limiters, that are described by DebugHandler. Like expvar, it
+// holds components registered by the application, usually once at startup,
+// which other packages of the process can share by name, see Lookup:
+//
+//	m := maxconnections.New(10, 100, h)
+//	middleware.Register("api", m)
+//	http.Handle("/debug/middleware", middleware.DebugHandler(middleware.DefaultRegistry))
+type Registry struct {
+	mu         sync.RWMutex
+	components map[string]interface{}
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		components: make(map[string]interface{}),
+	}
+}
+
+// DefaultRegistry is the Registry used by Register.
+var DefaultRegistry = NewRegistry()
+
+// Register adds a component to DefaultRegistry, see Registry.Register.
+func Register(name string, c interface{}) {
+	DefaultRegistry.Register(name, c)
+}
+
+// Unregister removes a component from DefaultRegistry.
+func Unregister(name string) {
+	DefaultRegistry.Unregister(name)
+}
+
+// Lookup returns the component of DefaultRegistry with the given name if it
+// has the type T. It allows packages of the same process to share a
+// component by name without passing it through their constructors:
+//
+//	// main.go
+//	middleware.Register("upstream-db", maxconnections.NewLimiter(20, 100))
+//
+//	// store/store.go
+//	db, ok := middleware.Lookup[*maxconnections.Limiter]("upstream-db")
+func Lookup[T any](name string) (T, bool) {
+	c, _ := DefaultRegistry.Get(name)
+	v, ok := c.(T)
+	return v, ok
+}
+
+// Register adds the component c with the given name. Like expvar.Publish, it
+// panics if the name is already registered.
+//
+// Any value can be registered. The methods that are described are:
+//
+//   - Stats, which returns a JSON-serializable snapshot of counters,
+//   - Limit or MaxRunning, which return the current limit,
+//   - State, which returns e.g. the state of a circuit breaker,
+//   - Utilization, which returns the used fraction of the limit,
+//   - SetMaxRunning, which allows to change the limit, see Updatable.
+func (reg *Registry) Register(name string, c interface{}) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.components[name]; ok {
+		panic(fmt.Sprintf("middleware: component %q is already registered", name))
+	}
+	reg.components[name] = c
+}
+
+// LoadOrStore returns the component with the given name if it is
+// registered. Otherwise, it registers and returns c. loaded is true if the
+// component has been registered before. It allows packages that share a
+// component to create it on first use in any order.
+func (reg *Registry) LoadOrStore(name string, c interface{}) (actual interface{}, loaded bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if actual, ok := reg.components[name]; ok {
+		return actual, true
+	}
+	reg.components[name] = c
+	return c, false
+}
+
+// Unregister removes the component with the given name.
+func (reg *Registry) Unregister(name string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.components, name)
+}
+
+// Get returns the component with the given name.
+func (reg *Registry) Get(name string) (interface{}, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	c, ok := reg.components[name]
+	return c, ok
+}
+
+// Names returns the sorted names of the registered components.
+func (reg *Registry) Names() []string {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	names := make([]string, 0, len(reg.components))
+	for name := range reg.components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Range calls f for each registered component in the order of their names
+// until f returns false. The components registered or unregistered while
+// Range is running may or may not be visited, f may change the registry.
+func (reg *Registry) Range(f func(name string, c interface{}) bool) {
+	for _, name := range reg.Names() {
+		c, ok := reg.Get(name)
+		if !ok {
+			continue
+		}
+		if !f(name, c) {
+			return
+		}
+	}
+}
+
+// Component describes a registered component.
+type Component struct {
+	Name string `json:"name"`
+
+	// Type is the Go type of the component, e.g. *maxconnections.Middleware.
+	Type string `json:"type"`
+
+	Limit       interface{} `json:"limit,omitempty"`
+	State       interface{} `json:"state,omitempty"`
+	Utilization *float64    `json:"utilization,omitempty"`
+	Stats       interface{} `json:"stats,omitempty"`
+
+	// Adjustable reports whether the limit can be changed by DebugHandler.
+	Adjustable bool `json:"adjustable"`
+}
+
+// Updatable is implemented by components whose limit can be changed at
+// runtime, e.g. maxconnections.Limiter.
+type Updatable interface {
+	MaxRunning() int
+	SetMaxRunning(n int)
+}
+
+// call calls the method of v with the given name if it takes no arguments
+// and returns a single value.
+func call(v interface{}, name string) (interface{}, bool) {
+	m := reflect.ValueOf(v).MethodByName(name)
+	if !m.IsValid() || m.Type().NumIn() != 0 || m.Type().NumOut() != 1 {
+		return nil, false
+	}
+	return m.Call(nil)[0].Interface(), true
+}
+
+// describe returns the description of the component c.
+func describe(name string, c interface{}) Component {
+	d := Component{
+		Name: name,
+		Type: fmt.Sprintf("%T", c),
+	}
+	if limit, ok := call(c, "MaxRunning"); ok {
+		d.Limit = limit
+	} else if limit, ok := call(c, "Limit"); ok {
+		d.Limit = limit
+	}
+	if state, ok := call(c, "State"); ok {
+		d.State = state
+	}
+	if u, ok := c.(interface{ Utilization() float64 }); ok {
+		utilization := u.Utilization()
+		d.Utilization = &utilization
+	}
+	if stats, ok := call(c, "Stats"); ok {
+		d.Stats = stats
+	}
+	_, d.Adjustable = c.(Updatable)
+	return d
+}
+
+// Describe returns the descriptions of the registered components sorted by
+// name.
+func (reg *Registry) Describe() []Component {
+	names := reg.Names()
+	res := make([]Component, 0, len(names))
+	for _, name := range names {
+		if c, ok := reg.Get(name); ok {
+			res = append(res, describe(name, c))
+		}
+	}
+	return res
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+func TestLookup(t *testing.T) {
+	l := maxconnections.NewLimiter(1, 0)
+	Register("test-upstream-db", l)
+	defer Unregister("test-upstream-db")
+
+	if got, ok := Lookup[*maxconnections.Limiter]("test-upstream-db"); !ok || got != l {
+		t.Fatalf("Lookup() = %p, %t, want the registered limiter", got, ok)
+	}
+	if _, ok := Lookup[*maxconnections.Middleware]("test-upstream-db"); ok {
+		t.Fatal("Lookup() of another type succeeded")
+	}
+	if _, ok := Lookup[Updatable]("test-upstream-db"); !ok {
+		t.Fatal("Lookup() of an interface the limiter implements failed")
+	}
+
+	Unregister("test-upstream-db")
+	if _, ok := Lookup[*maxconnections.Limiter]("test-upstream-db"); ok {
+		t.Fatal("Lookup() succeeded after Unregister")
+	}
+}
+
+func TestRegistryLoadOrStore(t *testing.T) {
+	reg := NewRegistry()
+	first := maxconnections.NewLimiter(1, 0)
+	if actual, loaded := reg.LoadOrStore("db", first); loaded || actual != first {
+		t.Fatalf("LoadOrStore() = %v, %t, want the new limiter to be stored", actual, loaded)
+	}
+	if actual, loaded := reg.LoadOrStore("db", maxconnections.NewLimiter(2, 0)); !loaded || actual != first {
+		t.Fatalf("LoadOrStore() = %v, %t, want the registered limiter", actual, loaded)
+	}
+}
+
+func TestRegistryRange(t *testing.T) {
+	reg := NewRegistry()
+	for _, name := range []string{"c", "a", "b"} {
+		reg.Register(name, maxconnections.NewLimiter(1, 0))
+	}
+	var names []string
+	reg.Range(func(name string, c interface{}) bool {
+		names = append(names, name)
+		reg.Unregister(name)
+		return name != "b"
+	})
+	if len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Fatalf("visited %v, want [a b]", names)
+	}
+	if remaining := reg.Names(); len(remaining) != 1 || remaining[0] != "c" {
+		t.Fatalf("Names() = %v, want [c]", remaining)
+	}
+}
@@ -0,0 +1,286 @@
+// Package replay captures samples of live traffic and replays them through a
+// handler chain, so that limiter and policy changes can be checked against
+// real traffic shapes.
+//
+// Records are stored as JSON lines, one request per line.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// Record is a captured request.
+type Record struct {
+	// Offset is the arrival time of the request relative to the start of
+	// the recording.
+	Offset time.Duration `json:"offset"`
+
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+
+	// Body is the request body up to MaxBody bytes. Truncated is set if the
+	// body was longer.
+	Body      []byte `json:"body,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+
+	// Duration is how long the handler was processing the request, and
+	// Status is the response status code.
+	Duration time.Duration `json:"duration"`
+	Status   int           `json:"status"`
+
+	// Annotations are values from the request context, see
+	// Recorder.Annotate.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Request returns a new incoming server request for the record.
+func (rec *Record) Request() *http.Request {
+	r := httptest.NewRequest(rec.Method, rec.URL, bytes.NewReader(rec.Body))
+	for name, values := range rec.Header {
+		r.Header[name] = append([]string(nil), values...)
+	}
+	return r
+}
+
+// Read reads records written by a Recorder.
+func Read(r io.Reader) ([]Record, error) {
+	var records []Record
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+}
+
+// defaultMaxBody is the default value of Recorder.MaxBody.
+const defaultMaxBody = 64 << 10
+
+// statusWriter remembers the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Recorder implements the http.Handler interface. It captures a sample of
+// requests that pass through it.
+type Recorder struct {
+	handler http.Handler
+	start   time.Time
+
+	mu  sync.Mutex
+	enc *json.Encoder
+	rnd *rand.Rand
+
+	// SampleRate is the fraction of requests that are captured.
+	SampleRate float64
+
+	// MaxBody is the maximum number of body bytes that are captured. The
+	// handler always gets the whole body.
+	MaxBody int64
+
+	// Annotate, if not nil, returns values that should be captured along
+	// with the request, e.g. the tenant from the request context. It is
+	// called after the handler.
+	Annotate func(r *http.Request) map[string]string
+
+	// OnError, if not nil, is called when a record cannot be written.
+	OnError func(err error)
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// NewRecorder returns an http.Handler that runs h and writes records of the
+// requests to w. By default all requests are captured.
+func NewRecorder(w io.Writer, h http.Handler) *Recorder {
+	return &Recorder{
+		handler:    h,
+		start:      time.Now(),
+		enc:        json.NewEncoder(w),
+		rnd:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		SampleRate: 1,
+		MaxBody:    defaultMaxBody,
+		now:        time.Now,
+	}
+}
+
+func (rec *Recorder) sample() bool {
+	if rec.SampleRate >= 1 {
+		return true
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.rnd.Float64() < rec.SampleRate
+}
+
+func (rec *Recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !rec.sample() {
+		rec.handler.ServeHTTP(w, r)
+		return
+	}
+
+	arrived := rec.now()
+	record := Record{
+		Offset: arrived.Sub(rec.start),
+		Method: r.Method,
+		URL:    r.URL.RequestURI(),
+		Header: r.Header.Clone(),
+	}
+	if r.Host != "" {
+		record.URL = "http://" + r.Host + record.URL
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, rec.MaxBody+1))
+		if int64(len(body)) > rec.MaxBody {
+			record.Body = body[:rec.MaxBody]
+			record.Truncated = true
+		} else {
+			record.Body = body
+		}
+		// Give the handler the bytes that have been read and the rest of
+		// the body, including a read error if there was one.
+		rest := io.Reader(r.Body)
+		if err != nil {
+			rest = errorReader{err}
+		}
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), rest), r.Body}
+	}
+
+	sw := &statusWriter{ResponseWriter: w}
+	rec.handler.ServeHTTP(sw, r)
+
+	record.Duration = rec.now().Sub(arrived)
+	record.Status = sw.status
+	if record.Status == 0 {
+		record.Status = http.StatusOK
+	}
+	if rec.Annotate != nil {
+		record.Annotations = rec.Annotate(r)
+	}
+
+	rec.mu.Lock()
+	err := rec.enc.Encode(&record)
+	rec.mu.Unlock()
+	if err != nil && rec.OnError != nil {
+		rec.OnError(err)
+	}
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Result is the outcome of a replayed request.
+type Result struct {
+	Record *Record
+
+	// Status is the status code of the response.
+	Status int
+
+	// Latency is the time from the replayed arrival until the handler
+	// returned.
+	Latency time.Duration
+}
+
+// Replayer sends records through a handler.
+type Replayer struct {
+	handler http.Handler
+
+	// Speed scales the time between arrivals: with 2 the requests arrive
+	// twice as fast as they were recorded. If Speed is not positive, all
+	// requests are sent at once.
+	Speed float64
+
+	// Restore, if not nil, returns the request with the context restored
+	// from the record annotations, see Recorder.Annotate.
+	Restore func(r *http.Request, annotations map[string]string) *http.Request
+}
+
+// NewReplayer returns a Replayer that sends requests to h. By default the
+// requests arrive with the recorded timing.
+func NewReplayer(h http.Handler) *Replayer {
+	return &Replayer{
+		handler: h,
+		Speed:   1,
+	}
+}
+
+// Replay sends the records concurrently, each at its recorded offset, and
+// waits for all responses. If ctx is done, the requests that haven't been
+// sent yet are skipped and get status 0.
+func (p *Replayer) Replay(ctx context.Context, records []Record) []Result {
+	results := make([]Result, len(records))
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range records {
+		record := &records[i]
+		results[i].Record = record
+		if p.Speed > 0 {
+			at := start.Add(time.Duration(float64(record.Offset) / p.Speed))
+			timer := time.NewTimer(time.Until(at))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		r := record.Request().WithContext(ctx)
+		if p.Restore != nil {
+			r = p.Restore(r, record.Annotations)
+		}
+		wg.Add(1)
+		go func(result *Result, r *http.Request) {
+			defer wg.Done()
+			arrived := time.Now()
+			w := httptest.NewRecorder()
+			p.handler.ServeHTTP(w, r)
+			result.Latency = time.Since(arrived)
+			result.Status = w.Code
+		}(&results[i], r)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,117 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+type tenantKey struct{}
+
+func TestRecordReplay(t *testing.T) {
+	var buf bytes.Buffer
+	rec := NewRecorder(&buf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != "hello, world" {
+			t.Errorf("handler got body %q, want %q", body, "hello, world")
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	rec.MaxBody = 5
+	rec.Annotate = func(r *http.Request) map[string]string {
+		return map[string]string{"tenant": r.Header.Get("X-Tenant")}
+	}
+	now := rec.start
+	rec.now = func() time.Time {
+		now = now.Add(10 * time.Millisecond)
+		return now
+	}
+
+	r := httptest.NewRequest("POST", "http://example.com/upload?x=1", strings.NewReader("hello, world"))
+	r.Header.Set("X-Tenant", "acme")
+	rec.ServeHTTP(httptest.NewRecorder(), r)
+
+	records, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	record := records[0]
+	if record.Offset != 10*time.Millisecond || record.Duration != 10*time.Millisecond {
+		t.Errorf("offset, duration = %s, %s; want 10ms, 10ms", record.Offset, record.Duration)
+	}
+	if record.Method != "POST" || record.URL != "http://example.com/upload?x=1" || record.Status != http.StatusCreated {
+		t.Errorf("record = %s %s %d, want POST http://example.com/upload?x=1 201", record.Method, record.URL, record.Status)
+	}
+	if string(record.Body) != "hello" || !record.Truncated {
+		t.Errorf("body = %q, truncated = %v; want %q, true", record.Body, record.Truncated, "hello")
+	}
+	if record.Annotations["tenant"] != "acme" {
+		t.Errorf("annotations = %v, want tenant=acme", record.Annotations)
+	}
+
+	var tenant string
+	p := NewReplayer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, _ = r.Context().Value(tenantKey{}).(string)
+		if r.Host != "example.com" || r.URL.Path != "/upload" {
+			t.Errorf("replayed request to %s%s, want example.com/upload", r.Host, r.URL.Path)
+		}
+	}))
+	p.Restore = func(r *http.Request, annotations map[string]string) *http.Request {
+		return r.WithContext(context.WithValue(r.Context(), tenantKey{}, annotations["tenant"]))
+	}
+	results := p.Replay(context.Background(), records)
+	if len(results) != 1 || results[0].Status != http.StatusOK {
+		t.Fatalf("Replay() = %+v, want one result with status 200", results)
+	}
+	if tenant != "acme" {
+		t.Fatalf("restored tenant = %q, want acme", tenant)
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	var buf bytes.Buffer
+	rec := NewRecorder(&buf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec.SampleRate = 0
+	rec.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if buf.Len() != 0 {
+		t.Fatalf("recorded %q with SampleRate 0, want nothing", buf.String())
+	}
+}
+
+func TestReplayThroughLimiter(t *testing.T) {
+	// Three requests arrive at once, the limiter can run one and queue one.
+	records := []Record{
+		{Method: "GET", URL: "/"},
+		{Method: "GET", URL: "/"},
+		{Method: "GET", URL: "/"},
+	}
+	release := make(chan struct{})
+	h := maxconnections.New(1, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	go func() {
+		for h.Stats().Overloaded == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+	}()
+
+	results := NewReplayer(h).Replay(context.Background(), records)
+	statuses := map[int]int{}
+	for _, r := range results {
+		statuses[r.Status]++
+	}
+	if statuses[http.StatusOK] != 2 || statuses[http.StatusServiceUnavailable] != 1 {
+		t.Fatalf("statuses = %v, want 2 OK and 1 overloaded", statuses)
+	}
+}
@@ -0,0 +1,147 @@
+// Package requestid ensures that every request has an ID. The ID is taken
+// from a request header set by a proxy or a client, or generated, and is
+// available to the handlers and other middlewares through the request
+// context, so that logs, metrics and error responses of one request can be
+// correlated. The package has no dependencies in this repository, so any
+// middleware can use it.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// DefaultHeader is the default header that carries request IDs.
+const DefaultHeader = "X-Request-Id"
+
+const defaultMaxLength = 128
+
+type requestIDKey struct{}
+
+// NewContext returns a copy of ctx that carries the request ID id.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// FromContext returns the request ID from ctx, or an empty string.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Generate returns a new random request ID of 32 hex digits.
+func Generate() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("requestid: " + err.Error())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// valid reports whether id can be accepted from a client: it is not empty,
+// not longer than maxLength and consists of printable ASCII characters, so
+// that it is safe to put into logs and headers.
+func valid(id string, maxLength int) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler http.Handler
+
+	// Header is the request header with the inbound request ID. By default
+	// it is X-Request-Id. If it is empty, inbound IDs are ignored.
+	Header string
+
+	// ResponseHeader, if not empty, is the response header that is set to
+	// the request ID. By default it is X-Request-Id.
+	ResponseHeader string
+
+	// MaxLength is the maximum length of an inbound request ID. Longer or
+	// otherwise invalid IDs are replaced with generated ones. By default it
+	// is 128.
+	MaxLength int
+
+	// Generate returns a new request ID. By default it is Generate.
+	Generate func() string
+}
+
+// New returns an http.Handler that passes requests to h with request IDs in
+// their context, see FromContext.
+func New(h http.Handler) *Middleware {
+	return &Middleware{
+		handler:        h,
+		Header:         DefaultHeader,
+		ResponseHeader: DefaultHeader,
+		MaxLength:      defaultMaxLength,
+		Generate:       Generate,
+	}
+}
+
+// requestID returns the ID for r.
+func (m *Middleware) requestID(r *http.Request) string {
+	if m.Header != "" {
+		maxLength := m.MaxLength
+		if maxLength <= 0 {
+			maxLength = defaultMaxLength
+		}
+		if id := r.Header.Get(m.Header); valid(id, maxLength) {
+			return id
+		}
+	}
+	if m.Generate != nil {
+		return m.Generate()
+	}
+	return Generate()
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := m.requestID(r)
+	if m.ResponseHeader != "" {
+		w.Header().Set(m.ResponseHeader, id)
+	}
+	m.handler.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+}
+
+// Transport implements the http.RoundTripper interface. It sets the request
+// ID from the context of outbound requests, so that the upstream logs them
+// under the same ID.
+type Transport struct {
+	next http.RoundTripper
+
+	// Header is the request header that is set to the request ID. By
+	// default it is X-Request-Id.
+	Header string
+}
+
+// NewTransport returns a Transport that sends requests through next. If next
+// is nil, http.DefaultTransport is used.
+func NewTransport(next http.RoundTripper) *Transport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &Transport{
+		next:   next,
+		Header: DefaultHeader,
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := FromContext(req.Context()); id != "" && t.Header != "" && req.Header.Get(t.Header) == "" {
+		// RoundTrip must not modify the request.
+		req = req.Clone(req.Context())
+		req.Header.Set(t.Header, id)
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,76 @@
+package requestid
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestMiddleware(t *testing.T) {
+	var upstream string
+	client := &http.Client{
+		Transport: NewTransport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			upstream = req.Header.Get("X-Request-Id")
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+				Request:    req,
+			}, nil
+		})),
+	}
+
+	var id string
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = FromContext(r.Context())
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		res, err := client.Do(req.WithContext(r.Context()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}))
+	m.Generate = func() string {
+		return "generated"
+	}
+
+	testCases := []struct {
+		inbound  string
+		expected string
+	}{
+		{"", "generated"},
+		{"abc-123", "abc-123"},
+		{"with space", "generated"},
+		{strings.Repeat("x", 129), "generated"},
+	}
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Request-Id", tc.inbound)
+		m.ServeHTTP(rec, r)
+
+		if id != tc.expected {
+			t.Errorf("%q: FromContext() = %q, want %q", tc.inbound, id, tc.expected)
+		}
+		if got := rec.Header().Get("X-Request-Id"); got != tc.expected {
+			t.Errorf("%q: response header = %q, want %q", tc.inbound, got, tc.expected)
+		}
+		if upstream != tc.expected {
+			t.Errorf("%q: outbound header = %q, want %q", tc.inbound, upstream, tc.expected)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	a, b := Generate(), Generate()
+	if len(a) != 32 || a == b {
+		t.Fatalf("Generate() = %q, %q; want two different IDs of 32 characters", a, b)
+	}
+}
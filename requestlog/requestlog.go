@@ -0,0 +1,233 @@
+// Package requestlog logs one structured record per request with log/slog.
+// The record has the method, the path, the status code, the size of the
+// response body, the duration, and, if they are known, the queue wait of a
+// maxconnections limiter and the request ID.
+package requestlog
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dmage/middleware/maxconnections"
+	"github.com/dmage/middleware/requestid"
+)
+
+// DefaultLevel returns slog.LevelError for 5xx responses and slog.LevelInfo
+// for other ones. It is the default Level of Middleware.
+func DefaultLevel(status int) slog.Level {
+	if status >= 500 {
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+// entry collects attributes of a request that are added by inner handlers.
+type entry struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+type entryKey struct{}
+
+// AddAttrs adds attributes to the record of the request with ctx. It does
+// nothing if the request is not logged.
+func AddAttrs(ctx context.Context, attrs ...slog.Attr) {
+	e, _ := ctx.Value(entryKey{}).(*entry)
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.attrs = append(e.attrs, attrs...)
+}
+
+// contextAttrs returns the attributes that inner middlewares put into ctx.
+func contextAttrs(ctx context.Context) []slog.Attr {
+	var attrs []slog.Attr
+	if wait := maxconnections.QueueWaitFromContext(ctx); wait > 0 {
+		attrs = append(attrs, slog.Duration("queue_wait", wait))
+	}
+	if id := requestid.FromContext(ctx); id != "" {
+		attrs = append(attrs, slog.String("request_id", id))
+	}
+	return attrs
+}
+
+// Annotate returns an http.Handler that adds the queue wait and the request
+// ID of requests to their records and passes them to h. The middleware sees
+// only the context of the request it gets, so when it wraps a limiter or the
+// requestid middleware, their handler should be wrapped with Annotate.
+func Annotate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AddAttrs(r.Context(), contextAttrs(r.Context())...)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func hasAttr(attrs []slog.Attr, key string) bool {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler http.Handler
+
+	// Logger is the logger for the records. By default it is
+	// slog.Default().
+	Logger *slog.Logger
+
+	// Message is the message of the records. By default it is "request".
+	Message string
+
+	// Level returns the level of the record for the response status. By
+	// default it is DefaultLevel.
+	Level func(status int) slog.Level
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// New returns an http.Handler that passes requests to h and logs them.
+func New(h http.Handler) *Middleware {
+	return &Middleware{
+		handler: h,
+		Message: "request",
+		Level:   DefaultLevel,
+		now:     time.Now,
+	}
+}
+
+// responseWriter records the status code and the size of the response. It
+// implements http.Flusher, http.Hijacker and io.ReaderFrom when the
+// underlying writer does.
+type responseWriter struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	hijacked bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom lets the underlying writer use sendfile, see io.ReaderFrom.
+func (w *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		// Hide ReadFrom of w from io.Copy.
+		n, err = io.Copy(struct{ io.Writer }{w.ResponseWriter}, src)
+	}
+	w.bytes += n
+	return n, err
+}
+
+// FlushError flushes the response, see http.ResponseController.
+func (w *responseWriter) FlushError() error {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *responseWriter) Flush() {
+	w.FlushError()
+}
+
+// Hijack lets the handler take over the connection, see http.Hijacker.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := m.now()
+	e := &entry{}
+	ctx := context.WithValue(r.Context(), entryKey{}, e)
+	rw := &responseWriter{ResponseWriter: w}
+
+	panicked := true
+	defer func() {
+		status := rw.status
+		switch {
+		case rw.hijacked:
+			status = http.StatusSwitchingProtocols
+		case panicked && status == 0:
+			// The server closes the connection without a response.
+			status = http.StatusInternalServerError
+		case status == 0:
+			status = http.StatusOK
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Int64("bytes", rw.bytes),
+			slog.Duration("duration", m.now().Sub(start)),
+		}
+		if panicked {
+			attrs = append(attrs, slog.String("error", "handler panicked"))
+		}
+		e.mu.Lock()
+		added := e.attrs
+		e.mu.Unlock()
+		// The attributes from inner handlers are more specific than the
+		// ones from the context of the middleware.
+		for _, attr := range contextAttrs(r.Context()) {
+			if !hasAttr(added, attr.Key) {
+				attrs = append(attrs, attr)
+			}
+		}
+		attrs = append(attrs, added...)
+
+		logger := m.Logger
+		if logger == nil {
+			logger = slog.Default()
+		}
+		level := DefaultLevel
+		if m.Level != nil {
+			level = m.Level
+		}
+		logger.LogAttrs(r.Context(), level(status), m.Message, attrs...)
+	}()
+	m.handler.ServeHTTP(rw, r.WithContext(ctx))
+	panicked = false
+}
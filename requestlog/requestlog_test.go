@@ -0,0 +1,130 @@
+package requestlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmage/middleware/maxconnections"
+	"github.com/dmage/middleware/requestid"
+)
+
+func newLogger(buf *bytes.Buffer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+}
+
+func TestRecord(t *testing.T) {
+	var buf bytes.Buffer
+	now := time.Unix(0, 0)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now = now.Add(250 * time.Millisecond)
+		AddAttrs(r.Context(), slog.String("user", "u1"))
+		w.WriteHeader(http.StatusTeapot)
+		io.Copy(w, strings.NewReader("0123456789"))
+	})
+	limiter := maxconnections.New(1, 0, Annotate(handler))
+	m := New(requestid.New(limiter))
+	m.Logger = newLogger(&buf)
+	m.now = func() time.Time {
+		return now
+	}
+
+	r := httptest.NewRequest("POST", "/tea?x=1", nil)
+	r.Header.Set("X-Request-Id", "req-1")
+	m.ServeHTTP(httptest.NewRecorder(), r)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("%q: %v", buf.String(), err)
+	}
+	expected := map[string]interface{}{
+		"level":      "INFO",
+		"msg":        "request",
+		"method":     "POST",
+		"path":       "/tea",
+		"status":     float64(http.StatusTeapot),
+		"bytes":      float64(10),
+		"duration":   float64(250 * time.Millisecond),
+		"request_id": "req-1",
+		"user":       "u1",
+	}
+	if len(record) != len(expected) {
+		t.Errorf("record = %v, want %v", record, expected)
+	}
+	for k, v := range expected {
+		if record[k] != v {
+			t.Errorf("%s = %v, want %v", k, record[k], v)
+		}
+	}
+}
+
+// hijackRecorder is a ResponseRecorder that can be hijacked.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (w hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	a, b := net.Pipe()
+	b.Close()
+	return a, bufio.NewReadWriter(bufio.NewReader(a), bufio.NewWriter(a)), nil
+}
+
+func TestInterfaces(t *testing.T) {
+	var buf bytes.Buffer
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws" {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Fatalf("Hijack() = %v, want nil", err)
+			}
+			conn.Close()
+			return
+		}
+		w.(http.Flusher).Flush()
+		if _, ok := w.(io.ReaderFrom); !ok {
+			t.Errorf("the writer doesn't implement io.ReaderFrom")
+		}
+		panic(http.ErrAbortHandler)
+	}))
+	m.Logger = newLogger(&buf)
+
+	rec := httptest.NewRecorder()
+	func() {
+		defer func() {
+			if err := recover(); err != http.ErrAbortHandler {
+				t.Fatalf("recover() = %v, want %v", err, http.ErrAbortHandler)
+			}
+		}()
+		m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	}()
+	if !rec.Flushed {
+		t.Errorf("the response hasn't been flushed")
+	}
+	m.ServeHTTP(hijackRecorder{httptest.NewRecorder()}, httptest.NewRequest("GET", "/ws", nil))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d records, want 2: %s", len(lines), buf.String())
+	}
+	if !strings.Contains(lines[0], `"status":200`) || !strings.Contains(lines[0], `"error":"handler panicked"`) {
+		t.Errorf("record of the panicked request = %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"status":101`) {
+		t.Errorf("record of the hijacked request = %s", lines[1])
+	}
+}
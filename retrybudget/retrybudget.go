@@ -0,0 +1,182 @@
+// Package retrybudget limits the share of retried requests. When a service is
+// overloaded and rejects requests, every client that retries multiplies the
+// load, and the retries keep the service overloaded after the original spike
+// is gone. The middleware counts first attempts and retries, and rejects
+// retries that exceed a budget, e.g. 10% of first attempts, so that retries
+// cannot amplify the overload.
+package retrybudget
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dmage/middleware/decisionlog"
+)
+
+const (
+	defaultHeader = "X-Retry-Attempt"
+	defaultRatio  = 0.1
+	defaultWindow = 10 * time.Second
+)
+
+func defaultRejectHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "503 retry budget exhausted, please try again later", http.StatusServiceUnavailable)
+}
+
+// RejectHandler is a default RejectHandler for Middleware.
+var RejectHandler http.Handler = http.HandlerFunc(defaultRejectHandler)
+
+// Stats contains counters collected by Middleware.
+type Stats struct {
+	// FirstAttempts and Retries are the total numbers of first attempts
+	// and retries that have been passed to the handler.
+	FirstAttempts int64 `json:"first_attempts"`
+	Retries       int64 `json:"retries"`
+
+	// Rejected is the total number of retries rejected because the budget
+	// was exhausted.
+	Rejected int64 `json:"rejected"`
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler http.Handler
+
+	// mu protects the fields below up to the configuration.
+	mu          sync.Mutex
+	windowStart time.Time
+	first       float64
+	retries     float64
+	prevFirst   float64
+	prevRetries float64
+	stats       Stats
+
+	// Header is the name of the request header that carries the number of
+	// the attempt. Requests without the header or with the value 0 are first
+	// attempts, other requests are retries. By default it is
+	// X-Retry-Attempt. It is not used if IsRetry is set.
+	Header string
+
+	// IsRetry, if not nil, reports whether the request is a retry.
+	IsRetry func(r *http.Request) bool
+
+	// Ratio is the maximum number of retries per first attempt, e.g. 0.1
+	// lets through one retry per ten first attempts. By default it is 0.1.
+	Ratio float64
+
+	// MinRetries is the number of retries per Window that are allowed
+	// regardless of Ratio, so that retries of a service with little traffic
+	// are not rejected.
+	MinRetries int
+
+	// Window is the period over which the requests are counted. The counts
+	// of the previous window are weighted by the part of it that overlaps
+	// with the last Window, so the budget doesn't reset abruptly. By
+	// default it is 10 seconds.
+	Window time.Duration
+
+	// RejectHandler is called for retries that exceed the budget.
+	RejectHandler http.Handler
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// New returns an http.Handler that passes requests to h while retries stay
+// within the budget.
+func New(h http.Handler) *Middleware {
+	return &Middleware{
+		handler:       h,
+		Header:        defaultHeader,
+		Ratio:         defaultRatio,
+		Window:        defaultWindow,
+		RejectHandler: RejectHandler,
+		now:           time.Now,
+	}
+}
+
+// isRetry reports whether r is a retry.
+func (m *Middleware) isRetry(r *http.Request) bool {
+	if m.IsRetry != nil {
+		return m.IsRetry(r)
+	}
+	header := m.Header
+	if header == "" {
+		header = defaultHeader
+	}
+	v := r.Header.Get(header)
+	if v == "" {
+		return false
+	}
+	n, err := strconv.Atoi(v)
+	return err != nil || n > 0
+}
+
+// advance moves the window forward to now. It should be called with mu held.
+func (m *Middleware) advance(window time.Duration, now time.Time) (weight float64) {
+	elapsed := now.Sub(m.windowStart)
+	switch {
+	case elapsed >= 2*window:
+		m.prevFirst, m.prevRetries = 0, 0
+		m.first, m.retries = 0, 0
+		m.windowStart = now
+		elapsed = 0
+	case elapsed >= window:
+		m.prevFirst, m.prevRetries = m.first, m.retries
+		m.first, m.retries = 0, 0
+		m.windowStart = m.windowStart.Add(window)
+		elapsed -= window
+	}
+	return 1 - float64(elapsed)/float64(window)
+}
+
+// allow counts the request and reports whether it may be passed to the
+// handler.
+func (m *Middleware) allow(retry bool) bool {
+	window := m.Window
+	if window <= 0 {
+		window = defaultWindow
+	}
+	now := m.now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	weight := m.advance(window, now)
+	if !retry {
+		m.first++
+		m.stats.FirstAttempts++
+		return true
+	}
+
+	first := m.first + weight*m.prevFirst
+	retries := m.retries + weight*m.prevRetries
+	if retries+1 > float64(m.MinRetries) && retries+1 > m.Ratio*first {
+		m.stats.Rejected++
+		return false
+	}
+	m.retries++
+	m.stats.Retries++
+	return true
+}
+
+// Stats returns a snapshot of the collected counters.
+func (m *Middleware) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	retry := m.isRetry(r)
+	if !m.allow(retry) {
+		decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "retrybudget", Action: decisionlog.Deny, Reason: "retry budget exhausted"})
+		m.RejectHandler.ServeHTTP(w, r)
+		return
+	}
+	if retry {
+		decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "retrybudget", Action: decisionlog.Allow, Reason: "retry within budget"})
+	}
+	m.handler.ServeHTTP(w, r)
+}
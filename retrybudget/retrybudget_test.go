@@ -0,0 +1,64 @@
+package retrybudget
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	now := time.Unix(0, 0)
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	m.MinRetries = 1
+	m.Window = 10 * time.Second
+	m.now = func() time.Time {
+		return now
+	}
+
+	serve := func(attempt string) int {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		if attempt != "" {
+			r.Header.Set("X-Retry-Attempt", attempt)
+		}
+		m.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	steps := []struct {
+		advance time.Duration
+		attempt string
+		n       int
+		code    int
+	}{
+		{0, "1", 1, http.StatusOK}, // MinRetries
+		{0, "2", 1, http.StatusServiceUnavailable},
+		{0, "", 19, http.StatusOK},
+		{0, "0", 1, http.StatusOK},
+		{0, "1", 1, http.StatusOK}, // 2 retries per 20 first attempts
+		{0, "1", 1, http.StatusServiceUnavailable},
+
+		// Half of the previous window still counts.
+		{15 * time.Second, "1", 1, http.StatusServiceUnavailable},
+		{0, "", 10, http.StatusOK},
+		{0, "1", 1, http.StatusOK},
+
+		// The counts are reset after two idle windows.
+		{time.Minute, "1", 1, http.StatusOK},
+		{0, "1", 1, http.StatusServiceUnavailable},
+	}
+	for i, step := range steps {
+		now = now.Add(step.advance)
+		for j := 0; j < step.n; j++ {
+			if code := serve(step.attempt); code != step.code {
+				t.Fatalf("step %d: status = %d, want %d", i, code, step.code)
+			}
+		}
+	}
+
+	expected := Stats{FirstAttempts: 30, Retries: 4, Rejected: 4}
+	if stats := m.Stats(); stats != expected {
+		t.Fatalf("Stats() = %+v, want %+v", stats, expected)
+	}
+}
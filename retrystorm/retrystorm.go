@@ -0,0 +1,273 @@
+// Package retrystorm detects clients that retry rejected requests sooner than
+// they were asked to and escalates their treatment.
+package retrystorm
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RemoteAddrKey returns the host part of r.RemoteAddr.
+func RemoteAddrKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func defaultIsRejection(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+func defaultBlockedHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "429 too many retries, please respect Retry-After", http.StatusTooManyRequests)
+}
+
+// BlockedHandler is a default BlockedHandler for Detector.
+var BlockedHandler http.Handler = http.HandlerFunc(defaultBlockedHandler)
+
+// Stats contains counters collected by Detector.
+type Stats struct {
+	// Violations is the number of requests that arrived before the
+	// Retry-After period of a previous rejection was over.
+	Violations int64
+
+	// Blocked is the number of requests rejected because their key was
+	// blocked.
+	Blocked int64
+
+	// Offenders is the number of keys that currently have violations.
+	Offenders int
+}
+
+// client is the state of a key.
+type client struct {
+	// retryAt is the time after which the client may retry.
+	retryAt time.Time
+
+	// violations is the number of consecutive violations.
+	violations int
+
+	// blockedUntil is the time until which the key is blocked.
+	blockedUntil time.Time
+}
+
+// Detector implements the http.Handler interface.
+type Detector struct {
+	handler http.Handler
+	key     func(r *http.Request) string
+
+	mu      sync.Mutex
+	clients map[string]*client
+	stats   Stats
+	inserts int
+
+	// IsRejection reports whether a response status code means that the
+	// request was rejected. By default 429 and 503 are rejections.
+	IsRejection func(statusCode int) bool
+
+	// DefaultRetryAfter is used for rejections without a Retry-After header.
+	DefaultRetryAfter time.Duration
+
+	// MaxRetryAfter caps the escalated Retry-After. For every violation the
+	// Retry-After advertised to the client is doubled.
+	MaxRetryAfter time.Duration
+
+	// BlockThreshold, if positive, is the number of consecutive violations
+	// after which the key is blocked for BlockDuration. Requests of blocked
+	// keys are processed by BlockedHandler without invoking the handler.
+	BlockThreshold int
+	BlockDuration  time.Duration
+
+	// BlockedHandler is called for requests of blocked keys.
+	BlockedHandler http.Handler
+
+	// Tarpit, if positive, delays rejections of violating requests, so that
+	// aggressive clients slow down.
+	Tarpit time.Duration
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// New returns an http.Handler that invokes h and watches for clients,
+// identified by key, that retry rejected requests too early. If key is nil,
+// RemoteAddrKey is used.
+func New(key func(r *http.Request) string, h http.Handler) *Detector {
+	if key == nil {
+		key = RemoteAddrKey
+	}
+	return &Detector{
+		handler: h,
+		key:     key,
+		clients: make(map[string]*client),
+
+		IsRejection:       defaultIsRejection,
+		DefaultRetryAfter: time.Second,
+		MaxRetryAfter:     time.Minute,
+		BlockDuration:     time.Minute,
+		BlockedHandler:    BlockedHandler,
+		now:               time.Now,
+	}
+}
+
+// Stats returns a snapshot of the collected counters.
+func (d *Detector) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := d.stats
+	for _, c := range d.clients {
+		if c.violations > 0 {
+			stats.Offenders++
+		}
+	}
+	return stats
+}
+
+// cleanupInterval is the number of new keys after which stale keys are
+// removed.
+const cleanupInterval = 1024
+
+// cleanup removes keys that are neither waiting for a retry nor blocked. It
+// should be called with mu held.
+func (d *Detector) cleanup(now time.Time) {
+	for key, c := range d.clients {
+		if now.After(c.retryAt.Add(d.MaxRetryAfter)) && now.After(c.blockedUntil) {
+			delete(d.clients, key)
+		}
+	}
+}
+
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int((d + time.Second - 1) / time.Second))
+}
+
+// observe checks the request of key that arrives at now. It returns the
+// number of consecutive violations of key and, if the key is blocked, how
+// long it remains blocked.
+func (d *Detector) observe(key string, now time.Time) (violations int, blocked time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := d.clients[key]
+	if c == nil {
+		return 0, 0
+	}
+	if now.Before(c.blockedUntil) {
+		d.stats.Blocked++
+		return c.violations, c.blockedUntil.Sub(now)
+	}
+	if !now.Before(c.retryAt) {
+		// The client has respected Retry-After.
+		c.violations = 0
+		return 0, 0
+	}
+
+	c.violations++
+	d.stats.Violations++
+	if d.BlockThreshold > 0 && c.violations >= d.BlockThreshold {
+		c.blockedUntil = now.Add(d.BlockDuration)
+		d.stats.Blocked++
+		return c.violations, d.BlockDuration
+	}
+	return c.violations, 0
+}
+
+// reject records that the request of key was rejected at now with the given
+// Retry-After.
+func (d *Detector) reject(key string, now time.Time, retryAfter time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := d.clients[key]
+	if c == nil {
+		c = &client{}
+		d.clients[key] = c
+		if d.inserts++; d.inserts%cleanupInterval == 0 {
+			d.cleanup(now)
+		}
+	}
+	c.retryAt = now.Add(retryAfter)
+}
+
+// escalate returns the Retry-After for a client with the given number of
+// violations.
+func (d *Detector) escalate(retryAfter time.Duration, violations int) time.Duration {
+	for i := 0; i < violations && retryAfter < d.MaxRetryAfter; i++ {
+		retryAfter *= 2
+	}
+	if retryAfter > d.MaxRetryAfter {
+		retryAfter = d.MaxRetryAfter
+	}
+	return retryAfter
+}
+
+// responseWriter intercepts rejections of the wrapped handler.
+type responseWriter struct {
+	http.ResponseWriter
+	d           *Detector
+	r           *http.Request
+	key         string
+	now         time.Time
+	violations  int
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if w.d.IsRejection(statusCode) {
+		retryAfter := w.d.DefaultRetryAfter
+		if seconds, err := strconv.Atoi(w.Header().Get("Retry-After")); err == nil && seconds >= 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		retryAfter = w.d.escalate(retryAfter, w.violations)
+		w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+		w.d.reject(w.key, w.now, retryAfter)
+
+		if w.violations > 0 && w.d.Tarpit > 0 {
+			timer := time.NewTimer(w.d.Tarpit)
+			select {
+			case <-timer.C:
+			case <-w.r.Context().Done():
+				timer.Stop()
+			}
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (d *Detector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := d.key(r)
+	now := d.now()
+	violations, blocked := d.observe(key, now)
+	if blocked > 0 {
+		w.Header().Set("Retry-After", retryAfterSeconds(blocked))
+		d.BlockedHandler.ServeHTTP(w, r)
+		return
+	}
+
+	d.handler.ServeHTTP(&responseWriter{
+		ResponseWriter: w,
+		d:              d,
+		r:              r,
+		key:            key,
+		now:            now,
+		violations:     violations,
+	}, r)
+}
@@ -0,0 +1,69 @@
+package retrystorm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDetector(t *testing.T) {
+	statusCode := http.StatusServiceUnavailable
+	d := New(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "overloaded", statusCode)
+	}))
+	d.BlockThreshold = 3
+	d.BlockDuration = 10 * time.Second
+
+	now := time.Unix(0, 0)
+	d.now = func() time.Time {
+		return now
+	}
+
+	serve := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		d.ServeHTTP(rr, r)
+		return rr
+	}
+
+	testCases := []struct {
+		after      time.Duration
+		statusCode int
+		retryAfter string
+	}{
+		{0, http.StatusServiceUnavailable, "1"},
+		{2 * time.Second, http.StatusServiceUnavailable, "1"},        // respected
+		{100 * time.Millisecond, http.StatusServiceUnavailable, "2"}, // violation 1
+		{100 * time.Millisecond, http.StatusServiceUnavailable, "4"}, // violation 2
+		{100 * time.Millisecond, http.StatusTooManyRequests, "10"},   // violation 3, blocked
+		{5 * time.Second, http.StatusTooManyRequests, "5"},           // still blocked
+	}
+	for i, tc := range testCases {
+		now = now.Add(tc.after)
+		rr := serve()
+		if rr.Code != tc.statusCode {
+			t.Fatalf("request %d: status code = %d, want %d", i, rr.Code, tc.statusCode)
+		}
+		if retryAfter := rr.Header().Get("Retry-After"); retryAfter != tc.retryAfter {
+			t.Fatalf("request %d: Retry-After = %q, want %q", i, retryAfter, tc.retryAfter)
+		}
+	}
+
+	stats := d.Stats()
+	if stats.Violations != 3 || stats.Blocked != 2 || stats.Offenders != 1 {
+		t.Fatalf("stats = %+v, want 3 violations, 2 blocked, 1 offender", stats)
+	}
+
+	// After the block is over and the client waits, it's welcome again.
+	now = now.Add(time.Minute)
+	statusCode = http.StatusOK
+	if rr := serve(); rr.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if stats := d.Stats(); stats.Offenders != 0 {
+		t.Fatalf("stats.Offenders = %d, want 0", stats.Offenders)
+	}
+}
@@ -0,0 +1,274 @@
+// Package sim replays request traces through a model of the maxconnections
+// limiter, so that maxRunning and maxInQueue can be tuned offline.
+package sim
+
+import (
+	"container/heap"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+// Request is a request in a trace.
+type Request struct {
+	// Arrival is the time when the request arrives, relative to the start
+	// of the trace.
+	Arrival time.Duration
+
+	// Latency is the time the handler needs to process the request.
+	Latency time.Duration
+}
+
+// Config is a limiter configuration to evaluate. The fields have the same
+// meaning as the corresponding parameters of maxconnections.Middleware.
+type Config struct {
+	MaxRunning            int
+	MaxInQueue            int
+	MaxWaitInQueue        time.Duration
+	QueueDiscipline       maxconnections.QueueDiscipline
+	AdaptiveLIFOThreshold time.Duration
+}
+
+// Result describes how the requests of a trace were handled.
+type Result struct {
+	// Requests is the number of requests in the trace.
+	Requests int
+
+	// Admitted is the number of requests that were run.
+	Admitted int
+
+	// Rejected is the number of requests rejected because the queue was
+	// full.
+	Rejected int
+
+	// TimedOut is the number of requests rejected because they waited in
+	// the queue longer than MaxWaitInQueue.
+	TimedOut int
+
+	// MeanWait, P50Wait, P99Wait and MaxWait describe the queue wait of
+	// admitted requests.
+	MeanWait time.Duration
+	P50Wait  time.Duration
+	P99Wait  time.Duration
+	MaxWait  time.Duration
+}
+
+// RejectionRate returns the fraction of requests that were not admitted.
+func (r Result) RejectionRate() float64 {
+	if r.Requests == 0 {
+		return 0
+	}
+	return float64(r.Rejected+r.TimedOut) / float64(r.Requests)
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("admitted %d/%d, rejected %d, timed out %d, wait mean %s p50 %s p99 %s max %s",
+		r.Admitted, r.Requests, r.Rejected, r.TimedOut, r.MeanWait, r.P50Wait, r.P99Wait, r.MaxWait)
+}
+
+// completions is a min-heap of times when running requests finish.
+type completions []time.Duration
+
+func (c completions) Len() int            { return len(c) }
+func (c completions) Less(i, j int) bool  { return c[i] < c[j] }
+func (c completions) Swap(i, j int)       { c[i], c[j] = c[j], c[i] }
+func (c *completions) Push(x interface{}) { *c = append(*c, x.(time.Duration)) }
+func (c *completions) Pop() interface{} {
+	old := *c
+	x := old[len(old)-1]
+	*c = old[:len(old)-1]
+	return x
+}
+
+// simulation is the state of a single Run.
+type simulation struct {
+	cfg     Config
+	now     time.Duration
+	running completions
+
+	// queue contains queued requests in arrival order.
+	queue []Request
+
+	waits  []time.Duration
+	result Result
+}
+
+func (s *simulation) run(req Request) {
+	s.waits = append(s.waits, s.now-req.Arrival)
+	heap.Push(&s.running, s.now+req.Latency)
+}
+
+// next returns the index of the queued request to admit.
+func (s *simulation) next() int {
+	last := len(s.queue) - 1
+	switch s.cfg.QueueDiscipline {
+	case maxconnections.LIFO:
+		return last
+	case maxconnections.AdaptiveLIFO:
+		if s.now-s.queue[0].Arrival > s.cfg.AdaptiveLIFOThreshold {
+			return last
+		}
+	}
+	return 0
+}
+
+func (s *simulation) dispatch() {
+	for len(s.running) < s.cfg.MaxRunning && len(s.queue) > 0 {
+		i := s.next()
+		req := s.queue[i]
+		s.queue = append(s.queue[:i], s.queue[i+1:]...)
+		s.run(req)
+	}
+}
+
+// Run replays the trace through a limiter with the configuration cfg. The
+// trace doesn't have to be sorted.
+func Run(cfg Config, trace []Request) Result {
+	requests := make([]Request, len(trace))
+	copy(requests, trace)
+	sort.SliceStable(requests, func(i, j int) bool {
+		return requests[i].Arrival < requests[j].Arrival
+	})
+
+	s := &simulation{cfg: cfg}
+	s.result.Requests = len(requests)
+	const never = time.Duration(math.MaxInt64)
+	for {
+		arrival, completion, expiration := never, never, never
+		if len(requests) > 0 {
+			arrival = requests[0].Arrival
+		}
+		if len(s.running) > 0 {
+			completion = s.running[0]
+		}
+		if cfg.MaxWaitInQueue > 0 && len(s.queue) > 0 {
+			// The queue is in arrival order, so its first request
+			// expires first.
+			expiration = s.queue[0].Arrival + cfg.MaxWaitInQueue
+		}
+
+		// Ties are resolved in favor of completions, so that a freed slot
+		// can still be used by a request that is about to expire or arrive.
+		switch {
+		case completion != never && completion <= arrival && completion <= expiration:
+			s.now = completion
+			heap.Pop(&s.running)
+			s.dispatch()
+		case expiration != never && expiration <= arrival:
+			s.now = expiration
+			s.queue = s.queue[1:]
+			s.result.TimedOut++
+		case arrival != never:
+			s.now = arrival
+			req := requests[0]
+			requests = requests[1:]
+			switch {
+			case len(s.running) < cfg.MaxRunning:
+				s.run(req)
+			case len(s.queue) < cfg.MaxInQueue:
+				s.queue = append(s.queue, req)
+			default:
+				s.result.Rejected++
+			}
+		default:
+			s.summarize()
+			return s.result
+		}
+	}
+}
+
+func (s *simulation) summarize() {
+	s.result.Admitted = len(s.waits)
+	if len(s.waits) == 0 {
+		return
+	}
+	sort.Slice(s.waits, func(i, j int) bool {
+		return s.waits[i] < s.waits[j]
+	})
+	var total time.Duration
+	for _, w := range s.waits {
+		total += w
+	}
+	s.result.MeanWait = total / time.Duration(len(s.waits))
+	s.result.P50Wait = percentile(s.waits, 0.50)
+	s.result.P99Wait = percentile(s.waits, 0.99)
+	s.result.MaxWait = s.waits[len(s.waits)-1]
+}
+
+// percentile returns the p-th percentile of sorted values.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// Poisson returns a synthetic trace of requests that arrive at the given rate
+// per second during d. The latency of each request is returned by latency.
+func Poisson(rnd *rand.Rand, rate float64, d time.Duration, latency func(rnd *rand.Rand) time.Duration) []Request {
+	var trace []Request
+	var t time.Duration
+	for {
+		t += time.Duration(rnd.ExpFloat64() / rate * float64(time.Second))
+		if t >= d {
+			return trace
+		}
+		trace = append(trace, Request{
+			Arrival: t,
+			Latency: latency(rnd),
+		})
+	}
+}
+
+// Constant returns a latency function that always returns d.
+func Constant(d time.Duration) func(rnd *rand.Rand) time.Duration {
+	return func(rnd *rand.Rand) time.Duration {
+		return d
+	}
+}
+
+// Exponential returns a latency function with exponentially distributed
+// values with the given mean.
+func Exponential(mean time.Duration) func(rnd *rand.Rand) time.Duration {
+	return func(rnd *rand.Rand) time.Duration {
+		return time.Duration(rnd.ExpFloat64() * float64(mean))
+	}
+}
+
+// ReadTrace reads a recorded trace in CSV format. Each record contains the
+// arrival time and the latency of a request in milliseconds, e.g. "12.5,40".
+// Lines starting with # are ignored.
+func ReadTrace(r io.Reader) ([]Request, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 2
+	var trace []Request
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return trace, nil
+		} else if err != nil {
+			return nil, err
+		}
+		var ms [2]float64
+		for i, field := range record {
+			ms[i], err = strconv.ParseFloat(field, 64)
+			if err != nil {
+				line, _ := cr.FieldPos(i)
+				return nil, fmt.Errorf("sim: line %d: %v", line, err)
+			}
+		}
+		trace = append(trace, Request{
+			Arrival: time.Duration(ms[0] * float64(time.Millisecond)),
+			Latency: time.Duration(ms[1] * float64(time.Millisecond)),
+		})
+	}
+}
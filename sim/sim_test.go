@@ -0,0 +1,118 @@
+package sim
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+func ms(n int) time.Duration {
+	return time.Duration(n) * time.Millisecond
+}
+
+func TestRun(t *testing.T) {
+	// Four requests arrive at once, each needs 10ms.
+	trace := []Request{
+		{Arrival: 0, Latency: ms(10)},
+		{Arrival: 0, Latency: ms(10)},
+		{Arrival: 0, Latency: ms(10)},
+		{Arrival: 0, Latency: ms(10)},
+	}
+
+	testCases := []struct {
+		name     string
+		cfg      Config
+		expected Result
+	}{
+		{
+			name: "enough slots",
+			cfg:  Config{MaxRunning: 4},
+			expected: Result{
+				Requests: 4,
+				Admitted: 4,
+			},
+		},
+		{
+			name: "queue",
+			cfg:  Config{MaxRunning: 1, MaxInQueue: 2},
+			expected: Result{
+				Requests: 4,
+				Admitted: 3,
+				Rejected: 1,
+				MeanWait: ms(10),
+				P50Wait:  ms(10),
+				P99Wait:  ms(20),
+				MaxWait:  ms(20),
+			},
+		},
+		{
+			name: "queue timeout",
+			cfg:  Config{MaxRunning: 1, MaxInQueue: 3, MaxWaitInQueue: ms(15)},
+			expected: Result{
+				Requests: 4,
+				Admitted: 2,
+				TimedOut: 2,
+				MeanWait: ms(5),
+				P50Wait:  0,
+				P99Wait:  ms(10),
+				MaxWait:  ms(10),
+			},
+		},
+	}
+	for _, tc := range testCases {
+		if result := Run(tc.cfg, trace); result != tc.expected {
+			t.Errorf("%s: Run() = %+v, want %+v", tc.name, result, tc.expected)
+		}
+	}
+}
+
+func TestRunLIFO(t *testing.T) {
+	trace := []Request{
+		{Arrival: 0, Latency: ms(10)},
+		{Arrival: ms(1), Latency: ms(10)},
+		{Arrival: ms(2), Latency: ms(10)},
+	}
+	cfg := Config{MaxRunning: 1, MaxInQueue: 2, QueueDiscipline: maxconnections.LIFO}
+	// The last request runs at 10ms, the second one at 20ms.
+	result := Run(cfg, trace)
+	if result.MaxWait != ms(19) {
+		t.Fatalf("MaxWait = %s, want %s", result.MaxWait, ms(19))
+	}
+}
+
+func TestPoisson(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	trace := Poisson(rnd, 1000, time.Second, Constant(ms(1)))
+	if len(trace) < 900 || len(trace) > 1100 {
+		t.Fatalf("len(trace) = %d, want about 1000", len(trace))
+	}
+
+	// A single slot is loaded at about 100%, so with no queue many
+	// requests are rejected, and a queue reduces rejections.
+	noQueue := Run(Config{MaxRunning: 1}, trace)
+	withQueue := Run(Config{MaxRunning: 1, MaxInQueue: 10}, trace)
+	if withQueue.RejectionRate() >= noQueue.RejectionRate() {
+		t.Fatalf("rejection rate with queue = %v, without = %v; want less with queue", withQueue.RejectionRate(), noQueue.RejectionRate())
+	}
+}
+
+func TestReadTrace(t *testing.T) {
+	trace, err := ReadTrace(strings.NewReader("# arrival,latency\n0,10\n2.5,40\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Request{
+		{Arrival: 0, Latency: ms(10)},
+		{Arrival: 2500 * time.Microsecond, Latency: ms(40)},
+	}
+	if len(trace) != len(expected) || trace[0] != expected[0] || trace[1] != expected[1] {
+		t.Fatalf("ReadTrace() = %v, want %v", trace, expected)
+	}
+
+	if _, err := ReadTrace(strings.NewReader("0,x\n")); err == nil {
+		t.Fatal("ReadTrace() with invalid latency: got nil error")
+	}
+}
@@ -0,0 +1,141 @@
+// Package sni routes TLS connections and HTTP requests by the server name
+// that the client has sent in the TLS handshake, so that one listener can
+// serve several domains with their own certificates, handlers and limits.
+package sni
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/dmage/middleware/tlslimit"
+)
+
+// ErrUnknownServerName is returned to the TLS stack when no route matches the
+// server name of the handshake and there is no default route.
+var ErrUnknownServerName = errors.New("sni: unknown server name")
+
+// Route is the configuration for a set of server names.
+type Route struct {
+	// Config, if not nil, is used for handshakes with the server names of
+	// the route, e.g. it holds their certificates. If it has no NextProtos,
+	// they are inherited from the base config, see Router.TLSConfig. Note
+	// that http.Server adds "h2" only to its own copy of the base config, so
+	// routes should list it to keep HTTP/2.
+	Config *tls.Config
+
+	// Handler serves requests of the route. It can be a chain of middlewares
+	// with their own limiters.
+	Handler http.Handler
+
+	// Handshakes, if not nil, limits the number of concurrent handshakes of
+	// the route.
+	Handshakes *tlslimit.Limiter
+}
+
+// Router implements the http.Handler interface. It passes connections and
+// requests to routes registered for their server names. Routes should be
+// registered before the router starts serving.
+type Router struct {
+	routes map[string]*Route
+
+	// Default, if not nil, is used for server names that don't match any
+	// route and for clients that don't send a server name.
+	Default *Route
+}
+
+// NewRouter returns an empty Router.
+func NewRouter() *Router {
+	return &Router{
+		routes: make(map[string]*Route),
+	}
+}
+
+// Handle registers route for serverName. The name "*.example.com" matches
+// subdomains of example.com one level deep, unless they have their own
+// routes.
+func (rt *Router) Handle(serverName string, route *Route) {
+	rt.routes[strings.ToLower(serverName)] = route
+}
+
+// Route returns the route for serverName, or nil.
+func (rt *Router) Route(serverName string) *Route {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if name != "" {
+		if route, ok := rt.routes[name]; ok {
+			return route
+		}
+		if i := strings.IndexByte(name, '.'); i >= 0 {
+			if route, ok := rt.routes["*"+name[i:]]; ok {
+				return route
+			}
+		}
+	}
+	return rt.Default
+}
+
+// TLSConfig returns a copy of base that uses the configs of the routes for
+// their server names. If there is no default route, connections with unknown
+// server names are passed to GetConfigForClient of base, if it has one, or
+// served with base.
+func (rt *Router) TLSConfig(base *tls.Config) *tls.Config {
+	cfg := base.Clone()
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	configs := make(map[*Route]*tls.Config)
+	prepare := func(route *Route) {
+		if route == nil || route.Config == nil {
+			return
+		}
+		c := route.Config.Clone()
+		if len(c.NextProtos) == 0 {
+			c.NextProtos = cfg.NextProtos
+		}
+		configs[route] = c
+	}
+	for _, route := range rt.routes {
+		prepare(route)
+	}
+	prepare(rt.Default)
+
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		route := rt.Route(hello.ServerName)
+		if route == nil {
+			if base == nil {
+				return nil, ErrUnknownServerName
+			}
+			if base.GetConfigForClient != nil {
+				return base.GetConfigForClient(hello)
+			}
+			if len(base.Certificates) == 0 && base.GetCertificate == nil {
+				return nil, ErrUnknownServerName
+			}
+			return nil, nil
+		}
+		if route.Handshakes != nil {
+			if err := route.Handshakes.Admit(hello); err != nil {
+				return nil, err
+			}
+		}
+		return configs[route], nil
+	}
+	return cfg
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The server name of the handshake is used rather than the Host header,
+	// so that a client can't reach a domain through a connection to another
+	// one.
+	serverName := ""
+	if r.TLS != nil {
+		serverName = r.TLS.ServerName
+	}
+	route := rt.Route(serverName)
+	if route == nil || route.Handler == nil {
+		http.Error(w, "421 misdirected request", http.StatusMisdirectedRequest)
+		return
+	}
+	route.Handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,143 @@
+package sni
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newCertificate(t *testing.T, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestRoute(t *testing.T) {
+	rt := NewRouter()
+	a := &Route{}
+	wildcard := &Route{}
+	b := &Route{}
+	rt.Handle("a.example.com", a)
+	rt.Handle("*.example.com", wildcard)
+	rt.Handle("b.example.com", b)
+
+	testCases := []struct {
+		serverName string
+		expected   *Route
+	}{
+		{"a.example.com", a},
+		{"A.Example.COM.", a},
+		{"b.example.com", b},
+		{"c.example.com", wildcard},
+		{"x.c.example.com", nil},
+		{"example.com", nil},
+		{"", nil},
+	}
+	for _, tc := range testCases {
+		if route := rt.Route(tc.serverName); route != tc.expected {
+			t.Errorf("Route(%q) = %p, want %p", tc.serverName, route, tc.expected)
+		}
+	}
+
+	rt.Default = &Route{}
+	if route := rt.Route("example.com"); route != rt.Default {
+		t.Errorf("Route() = %p, want the default route %p", route, rt.Default)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+	}
+	rt := NewRouter()
+	rt.Handle("a.example", &Route{
+		Config:  &tls.Config{Certificates: []tls.Certificate{newCertificate(t, "a.example")}},
+		Handler: handler("a"),
+	})
+	rt.Handle("b.example", &Route{
+		Config:  &tls.Config{Certificates: []tls.Certificate{newCertificate(t, "b.example")}},
+		Handler: handler("b"),
+	})
+
+	srv := httptest.NewUnstartedServer(rt)
+	srv.TLS = rt.TLSConfig(&tls.Config{Certificates: []tls.Certificate{newCertificate(t, "default")}})
+	srv.StartTLS()
+	defer srv.Close()
+
+	testCases := []struct {
+		serverName string
+		host       string
+		commonName string
+		status     int
+		body       string
+	}{
+		{"a.example", "a.example", "a.example", http.StatusOK, "a"},
+		{"b.example", "b.example", "b.example", http.StatusOK, "b"},
+		// The route is selected by the server name, not by the Host header.
+		{"a.example", "b.example", "a.example", http.StatusOK, "a"},
+		{"c.example", "c.example", "default", http.StatusMisdirectedRequest, ""},
+	}
+	for _, tc := range testCases {
+		var commonName string
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					ServerName:         tc.serverName,
+					InsecureSkipVerify: true,
+					VerifyConnection: func(cs tls.ConnectionState) error {
+						commonName = cs.PeerCertificates[0].Subject.CommonName
+						return nil
+					},
+				},
+			},
+		}
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req.Host = tc.host
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.serverName, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if commonName != tc.commonName {
+			t.Errorf("%s: certificate = %q, want %q", tc.serverName, commonName, tc.commonName)
+		}
+		if res.StatusCode != tc.status {
+			t.Errorf("%s: status = %d, want %d", tc.serverName, res.StatusCode, tc.status)
+		}
+		if tc.status == http.StatusOK && string(body) != tc.body {
+			t.Errorf("%s: body = %q, want %q", tc.serverName, body, tc.body)
+		}
+	}
+}
+
+func TestUnknownServerName(t *testing.T) {
+	rt := NewRouter()
+	cfg := rt.TLSConfig(nil)
+	if _, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{ServerName: "unknown.example"}); err != ErrUnknownServerName {
+		t.Fatalf("GetConfigForClient() = %v, want %v", err, ErrUnknownServerName)
+	}
+}
@@ -0,0 +1,201 @@
+// Package supportbundle gathers diagnostics of a process into a single
+// archive that can be attached to an issue: the effective middleware
+// configuration, stats published with expvar (e.g. with
+// maxconnections.Limiter.PublishExpvar), recent decision log entries and
+// version information.
+//
+// The archive is a gzipped tar with JSON files. Values that may identify
+// clients or carry credentials are sanitized: the command line is not
+// included, and rate limit keys in decisions are replaced with hashes.
+package supportbundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/dmage/middleware/config"
+	"github.com/dmage/middleware/decisionlog"
+)
+
+const modulePath = "github.com/dmage/middleware"
+
+// excludedVars are expvar variables that are not included in bundles.
+var excludedVars = map[string]bool{
+	// The command line may contain credentials.
+	"cmdline": true,
+}
+
+// Version describes the build of the process.
+type Version struct {
+	GoVersion string `json:"go_version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+
+	// Main is the path and the version of the main module.
+	Main string `json:"main,omitempty"`
+
+	// Middleware is the version of this repository the binary is built
+	// with.
+	Middleware string `json:"middleware,omitempty"`
+
+	// Settings are the build settings, e.g. vcs.revision.
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// BuildVersion returns the version information of the running binary.
+func BuildVersion() Version {
+	v := Version{
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	v.Main = info.Main.Path + "@" + info.Main.Version
+	if info.Main.Path == modulePath {
+		v.Middleware = info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			v.Middleware = dep.Version
+		}
+	}
+	v.Settings = make(map[string]string)
+	for _, s := range info.Settings {
+		v.Settings[s.Key] = s.Value
+	}
+	return v
+}
+
+// hash returns a short stable hash of s that allows to tell values apart
+// without revealing them.
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// SanitizeEntry is a default SanitizeEntry for Bundle. It replaces rules of
+// rate limit decisions, which are client keys such as addresses or API
+// keys, with hashes.
+func SanitizeEntry(e *decisionlog.Entry) {
+	decisions := make([]decisionlog.Decision, len(e.Decisions))
+	copy(decisions, e.Decisions)
+	for i, d := range decisions {
+		if d.Middleware == "ratelimit" && d.Rule != "" {
+			decisions[i].Rule = hash(d.Rule)
+		}
+	}
+	e.Decisions = decisions
+}
+
+// Bundle collects diagnostics. Nil sources are skipped.
+type Bundle struct {
+	// Config is the middleware policy document of the process.
+	Config *config.Config
+
+	// DecisionLog provides recent decisions.
+	DecisionLog *decisionlog.Middleware
+
+	// SanitizeEntry is called for every decision log entry before it is
+	// added to the bundle.
+	SanitizeEntry func(e *decisionlog.Entry)
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// New returns a Bundle with the default sanitizer.
+func New() *Bundle {
+	return &Bundle{
+		SanitizeEntry: SanitizeEntry,
+		now:           time.Now,
+	}
+}
+
+// files returns the contents of the bundle.
+func (b *Bundle) files() map[string]interface{} {
+	files := map[string]interface{}{
+		"version.json": BuildVersion(),
+	}
+	if b.Config != nil {
+		files["config.json"] = b.Config
+		files["effective.json"] = b.Config.EffectiveAt(b.now())
+	}
+
+	vars := make(map[string]json.RawMessage)
+	expvar.Do(func(kv expvar.KeyValue) {
+		if excludedVars[kv.Key] {
+			return
+		}
+		vars[kv.Key] = json.RawMessage(kv.Value.String())
+	})
+	files["stats.json"] = vars
+
+	if b.DecisionLog != nil {
+		entries := b.DecisionLog.Entries()
+		if b.SanitizeEntry != nil {
+			for i := range entries {
+				b.SanitizeEntry(&entries[i])
+			}
+		}
+		files["decisions.json"] = entries
+	}
+	return files
+}
+
+// Write writes the bundle to w as a gzipped tar.
+func (b *Bundle) Write(w io.Writer) error {
+	files := b.files()
+	now := b.now()
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	for _, name := range []string{"version.json", "config.json", "effective.json", "stats.json", "decisions.json"} {
+		v, ok := files[name]
+		if !ok {
+			continue
+		}
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    "supportbundle/" + name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: now,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Handler returns an http.Handler that serves the bundle as a download. It
+// exposes internals of the process and should be protected like
+// /debug/pprof.
+func (b *Bundle) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := "supportbundle-" + b.now().UTC().Format("20060102-150405") + ".tar.gz"
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		w.Header().Set("Cache-Control", "no-store")
+		b.Write(w)
+	})
+}
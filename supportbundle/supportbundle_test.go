@@ -0,0 +1,87 @@
+package supportbundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dmage/middleware/config"
+	"github.com/dmage/middleware/decisionlog"
+)
+
+// testVar is registered once, as expvar panics on a second registration,
+// e.g. with -count=2.
+var testVar = expvar.NewInt("supportbundle_test")
+
+func TestBundle(t *testing.T) {
+	c, err := config.Parse(strings.NewReader(`{"defaults": {"timeout": "5s"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl := decisionlog.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "ratelimit", Action: decisionlog.Deny, Rule: "secret-api-key"})
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	dl.SampleRate = 1
+	dl.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	testVar.Set(42)
+
+	b := New()
+	b.Config = c
+	b.DecisionLog = dl
+	rec := httptest.NewRecorder()
+	b.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/supportbundle", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/gzip" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[h.Name] = string(data)
+	}
+
+	for _, name := range []string{"version.json", "config.json", "effective.json", "stats.json", "decisions.json"} {
+		if _, ok := files["supportbundle/"+name]; !ok {
+			t.Errorf("the bundle has no %s", name)
+		}
+	}
+	var stats map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(files["supportbundle/stats.json"]), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if string(stats["supportbundle_test"]) != "42" {
+		t.Errorf("stats = %s, want the published variable", files["supportbundle/stats.json"])
+	}
+	if _, ok := stats["cmdline"]; ok {
+		t.Errorf("stats include the command line")
+	}
+	if decisions := files["supportbundle/decisions.json"]; strings.Contains(decisions, "secret-api-key") || !strings.Contains(decisions, "sha256:") {
+		t.Errorf("decisions = %s, want the rate limit key to be hashed", decisions)
+	}
+	if !strings.Contains(files["supportbundle/effective.json"], `"timeout": "5s"`) {
+		t.Errorf("effective.json = %s", files["supportbundle/effective.json"])
+	}
+}
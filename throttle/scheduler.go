@@ -0,0 +1,227 @@
+package throttle
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrExceedsBurst is returned by WaitN when n is greater than the burst of
+// the scheduler, so the bytes could never be granted at once.
+var ErrExceedsBurst = errors.New("throttle: n exceeds the burst")
+
+// cleanupInterval is how many new flows are created between sweeps of idle
+// flows.
+const cleanupInterval = 1024
+
+// flow is the state of a single key.
+type flow struct {
+	// finish is the virtual finish time of the latest waiter of the flow.
+	finish  float64
+	pending int
+}
+
+// waiter is a request for bytes.
+type waiter struct {
+	f        *flow
+	n        float64
+	start    float64 // virtual start time
+	finish   float64 // virtual finish time
+	index    int     // index in the queue, -1 if it has been removed
+	ready    chan struct{}
+	released bool
+}
+
+// waitQueue is a min-heap of waiters ordered by their virtual finish times.
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+
+func (q waitQueue) Less(i, j int) bool { return q[i].finish < q[j].finish }
+
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waitQueue) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waitQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
+}
+
+// Scheduler shares a global budget of bytes per second between keys in
+// proportion to their weights. It is a token bucket for the total rate,
+// waiters are served in order of their virtual finish times (start-time fair
+// queuing), so a key that sends a lot can't take the share of other keys
+// that are waiting, and an idle key doesn't accumulate credit.
+type Scheduler struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	virtual float64
+	flows   map[string]*flow
+	queue   waitQueue
+	timer   *time.Timer
+	inserts int
+
+	// Weight returns the weight of the key. Non-positive weights are
+	// treated as 1. By default all keys have the weight 1.
+	Weight func(key string) float64
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// NewScheduler returns a Scheduler that grants rate bytes per second in
+// total with bursts of up to burst bytes.
+func NewScheduler(rate float64, burst int) *Scheduler {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Scheduler{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		flows:  make(map[string]*flow),
+		now:    time.Now,
+	}
+}
+
+// Burst returns the maximum number of bytes that can be granted at once.
+func (s *Scheduler) Burst() int {
+	return int(s.burst)
+}
+
+func (s *Scheduler) weight(key string) float64 {
+	if s.Weight == nil {
+		return 1
+	}
+	if w := s.Weight(key); w > 0 {
+		return w
+	}
+	return 1
+}
+
+// getFlow returns the flow of key. It should be called with mu held.
+func (s *Scheduler) getFlow(key string) *flow {
+	f := s.flows[key]
+	if f == nil {
+		if s.inserts++; s.inserts%cleanupInterval == 0 {
+			for k, f := range s.flows {
+				if f.pending == 0 && f.finish <= s.virtual {
+					delete(s.flows, k)
+				}
+			}
+		}
+		f = &flow{}
+		s.flows[key] = f
+	}
+	return f
+}
+
+// refill adds tokens accumulated since the last update. It should be called
+// with mu held.
+func (s *Scheduler) refill(now time.Time) {
+	if !s.last.IsZero() {
+		s.tokens += now.Sub(s.last).Seconds() * s.rate
+		if s.tokens > s.burst {
+			s.tokens = s.burst
+		}
+	}
+	s.last = now
+}
+
+// dispatch grants tokens to waiters in order of their finish times and
+// schedules itself for the time when the next waiter can be served. It
+// should be called with mu held.
+func (s *Scheduler) dispatch() {
+	s.refill(s.now())
+	for len(s.queue) > 0 {
+		w := s.queue[0]
+		if w.n > s.tokens {
+			wait := time.Duration((w.n - s.tokens) / s.rate * float64(time.Second))
+			if s.timer == nil {
+				s.timer = time.AfterFunc(wait, func() {
+					s.mu.Lock()
+					defer s.mu.Unlock()
+					s.dispatch()
+				})
+			} else {
+				s.timer.Reset(wait)
+			}
+			return
+		}
+		heap.Pop(&s.queue)
+		s.tokens -= w.n
+		s.virtual = w.start
+		w.f.pending--
+		w.released = true
+		close(w.ready)
+	}
+}
+
+// WaitN blocks until n bytes are granted to key or ctx is done.
+func (s *Scheduler) WaitN(ctx context.Context, key string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	if float64(n) > s.burst {
+		return ErrExceedsBurst
+	}
+
+	s.mu.Lock()
+	f := s.getFlow(key)
+	w := &waiter{
+		f:     f,
+		n:     float64(n),
+		start: math.Max(s.virtual, f.finish),
+		ready: make(chan struct{}),
+	}
+	w.finish = w.start + w.n/s.weight(key)
+	f.finish = w.finish
+	f.pending++
+	heap.Push(&s.queue, w)
+	if w.index == 0 {
+		s.dispatch()
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if w.released {
+		// The bytes have been granted concurrently with the cancellation,
+		// return them.
+		s.tokens += w.n
+		if s.tokens > s.burst {
+			s.tokens = s.burst
+		}
+	} else {
+		heap.Remove(&s.queue, w.index)
+		f.pending--
+	}
+	s.dispatch()
+	return ctx.Err()
+}
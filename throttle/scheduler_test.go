@@ -0,0 +1,73 @@
+package throttle
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSchedulerWeights(t *testing.T) {
+	s := NewScheduler(100000, 1000)
+	s.Weight = func(key string) float64 {
+		if key == "b" {
+			return 3
+		}
+		return 1
+	}
+	// Spend the initial burst, so that both keys compete from the start.
+	if err := s.WaitN(context.Background(), "", 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	for _, key := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			for i := 0; i < 12; i++ {
+				if err := s.WaitN(context.Background(), key, 1000); err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				order = append(order, key)
+				mu.Unlock()
+			}
+		}(key)
+	}
+	wg.Wait()
+
+	b := 0
+	for _, key := range order[:12] {
+		if key == "b" {
+			b++
+		}
+	}
+	if b < 8 || b > 10 {
+		t.Fatalf("b has got %d of the first 12 grants, want about 9: %v", b, order)
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	s := NewScheduler(1, 10)
+	if err := s.WaitN(context.Background(), "a", 11); err != ErrExceedsBurst {
+		t.Fatalf("WaitN() of more than the burst = %v, want %v", err, ErrExceedsBurst)
+	}
+	if err := s.WaitN(context.Background(), "a", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.WaitN(ctx, "a", 5); err != context.DeadlineExceeded {
+		t.Fatalf("WaitN() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) != 0 || s.flows["a"].pending != 0 {
+		t.Fatalf("the canceled waiter hasn't been removed")
+	}
+}
@@ -0,0 +1,91 @@
+// Package throttle limits the bandwidth of responses. The total bandwidth is
+// capped by a Scheduler, and keys, e.g. tenants, share it in proportion to
+// their weights.
+package throttle
+
+import (
+	"net/http"
+
+	"github.com/dmage/middleware/ratelimit"
+)
+
+const defaultChunkSize = 16 * 1024
+
+// responseWriter waits for the scheduler before writing each chunk.
+type responseWriter struct {
+	http.ResponseWriter
+	r         *http.Request
+	s         *Scheduler
+	key       string
+	chunkSize int
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > w.chunkSize {
+			chunk = chunk[:w.chunkSize]
+		}
+		if err := w.s.WaitN(w.r.Context(), w.key, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler   http.Handler
+	scheduler *Scheduler
+
+	// Key returns the key of the request. By default it is
+	// ratelimit.RemoteAddrKey.
+	Key func(r *http.Request) string
+
+	// ChunkSize is the maximum number of bytes that are written after a
+	// single wait. Smaller chunks make the sharing smoother at the cost of
+	// more writes. It is capped by the burst of the scheduler. By default
+	// it is 16 KiB.
+	ChunkSize int
+}
+
+// New returns an http.Handler that passes requests to h and paces writes of
+// response bodies using s. The scheduler can be shared between several
+// middlewares to cap their total bandwidth.
+func New(s *Scheduler, h http.Handler) *Middleware {
+	return &Middleware{
+		handler:   h,
+		scheduler: s,
+		Key:       ratelimit.RemoteAddrKey,
+		ChunkSize: defaultChunkSize,
+	}
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	chunkSize := m.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	if burst := m.scheduler.Burst(); chunkSize > burst {
+		chunkSize = burst
+	}
+	m.handler.ServeHTTP(&responseWriter{
+		ResponseWriter: w,
+		r:              r,
+		s:              m.scheduler,
+		key:            m.Key(r),
+		chunkSize:      chunkSize,
+	}, r)
+}
@@ -0,0 +1,39 @@
+package throttle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	body := strings.Repeat("x", 2500)
+	var writes int
+	s := NewScheduler(1e6, 1000)
+	m := New(s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	m.ChunkSize = 4096
+
+	rec := httptest.NewRecorder()
+	counter := &countingWriter{ResponseWriter: rec, writes: &writes}
+	m.ServeHTTP(counter, httptest.NewRequest("GET", "/", nil))
+	if rec.Body.String() != body {
+		t.Fatalf("body has %d bytes, want %d", rec.Body.Len(), len(body))
+	}
+	// ChunkSize is capped by the burst of the scheduler.
+	if writes != 3 {
+		t.Fatalf("the body has been written in %d chunks, want 3", writes)
+	}
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	writes *int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w.writes++
+	return w.ResponseWriter.Write(p)
+}
@@ -0,0 +1,251 @@
+// Package timeout limits the time handlers have to serve requests. When the
+// deadline of a request expires, its context is canceled and, unless the
+// handler has already started the response, TimeoutHandler writes an error
+// response right away. Later writes of the handler are discarded.
+//
+// Unlike http.TimeoutHandler, the handler runs in the goroutine of the
+// request and writes to the client directly, so responses are not buffered
+// and Flusher and Hijacker keep working. ServeHTTP returns only when the
+// handler returns, so a maxconnections middleware that wraps it keeps the
+// running units of the request until the handler stops working.
+package timeout
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dmage/middleware/decisionlog"
+	"github.com/dmage/middleware/maxconnections"
+)
+
+const timeoutBody = "503 request timed out\n"
+
+func defaultTimeoutHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(timeoutBody)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(timeoutBody))
+}
+
+// TimeoutHandler is a default TimeoutHandler for Middleware. It sets
+// Content-Length, so that the client gets the complete response while the
+// handler is still finishing.
+var TimeoutHandler http.Handler = http.HandlerFunc(defaultTimeoutHandler)
+
+// route is a set of requests with their own timeout.
+type route struct {
+	match   func(r *http.Request) bool
+	timeout time.Duration
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler  http.Handler
+	routes   []route
+	def      time.Duration
+	timedOut int64
+
+	// TimeoutHandler is called when the deadline of a request expires
+	// before the handler has started the response, e.g. to write 503 or
+	// 504. It runs concurrently with the handler, whose writes are blocked
+	// meanwhile and discarded afterwards.
+	TimeoutHandler http.Handler
+}
+
+// New returns an http.Handler that runs h with the timeout d, unless a more
+// specific timeout is registered for the request. If d is not positive,
+// such requests have no timeout. Routes should be registered before the
+// middleware starts serving requests.
+func New(d time.Duration, h http.Handler) *Middleware {
+	return &Middleware{
+		handler:        h,
+		def:            d,
+		TimeoutHandler: TimeoutHandler,
+	}
+}
+
+// HandleFunc registers timeout d for requests for which match returns true.
+// Routes are matched in the order they are registered.
+func (m *Middleware) HandleFunc(match func(r *http.Request) bool, d time.Duration) {
+	m.routes = append(m.routes, route{match: match, timeout: d})
+}
+
+// Handle registers timeout d for requests that match pattern, see
+// maxconnections.MatchPattern.
+func (m *Middleware) Handle(pattern string, d time.Duration) {
+	m.HandleFunc(maxconnections.MatchPattern(pattern), d)
+}
+
+// Timeout returns the timeout for r.
+func (m *Middleware) Timeout(r *http.Request) time.Duration {
+	for _, route := range m.routes {
+		if route.match(r) {
+			return route.timeout
+		}
+	}
+	return m.def
+}
+
+// TimedOut returns the number of requests that have timed out.
+func (m *Middleware) TimedOut() int64 {
+	return atomic.LoadInt64(&m.timedOut)
+}
+
+// writer passes writes of the handler to the client until the request times
+// out. The handler gets its own header map, so that TimeoutHandler can use
+// the headers of the response concurrently.
+type writer struct {
+	w      http.ResponseWriter
+	header http.Header
+	ctx    context.Context
+
+	// mu protects the fields below and serializes access to w.
+	mu          sync.Mutex
+	wroteHeader bool
+	hijacked    bool
+	timedOut    bool
+}
+
+// expired reports whether the request has timed out. The handler may see
+// the context done before the timeout response is written, so the deadline
+// is checked as well. It should be called with mu held.
+func (tw *writer) expired() bool {
+	return tw.timedOut || tw.ctx.Err() == context.DeadlineExceeded
+}
+
+func (tw *writer) Header() http.Header {
+	return tw.header
+}
+
+// writeHeader sends the headers of the handler. It should be called with mu
+// held.
+func (tw *writer) writeHeader(status int) {
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	dst := tw.w.Header()
+	for k, v := range tw.header {
+		dst[k] = v
+	}
+	tw.w.WriteHeader(status)
+}
+
+func (tw *writer) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.expired() || tw.hijacked {
+		return
+	}
+	tw.writeHeader(status)
+}
+
+func (tw *writer) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.expired() {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.hijacked {
+		return 0, http.ErrHijacked
+	}
+	tw.writeHeader(http.StatusOK)
+	return tw.w.Write(p)
+}
+
+// FlushError flushes the response, see http.ResponseController.
+func (tw *writer) FlushError() error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.expired() {
+		return http.ErrHandlerTimeout
+	}
+	if tw.hijacked {
+		return http.ErrHijacked
+	}
+	tw.writeHeader(http.StatusOK)
+	return http.NewResponseController(tw.w).Flush()
+}
+
+func (tw *writer) Flush() {
+	tw.FlushError()
+}
+
+// Hijack lets the handler take over the connection, see http.Hijacker. A
+// hijacked request can no longer time out.
+func (tw *writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.expired() {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	conn, rw, err := http.NewResponseController(tw.w).Hijack()
+	if err == nil {
+		tw.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// timeout marks the request as timed out and writes the timeout response if
+// the handler hasn't started its response.
+func (m *Middleware) timeout(tw *writer, r *http.Request) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.hijacked {
+		return
+	}
+	tw.timedOut = true
+	atomic.AddInt64(&m.timedOut, 1)
+	decisionlog.Record(r.Context(), decisionlog.Decision{Middleware: "timeout", Action: decisionlog.Deny, Reason: "deadline exceeded"})
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	m.TimeoutHandler.ServeHTTP(tw.w, r)
+	http.NewResponseController(tw.w).Flush()
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d := m.Timeout(r)
+	if d <= 0 {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	tw := &writer{
+		w:      w,
+		header: w.Header().Clone(),
+		ctx:    ctx,
+	}
+	finished := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(finished)
+		if ctx.Err() == context.DeadlineExceeded {
+			m.timeout(tw, r)
+		}
+	})
+
+	m.handler.ServeHTTP(tw, r)
+
+	if !stop() {
+		// The timeout response may be still being written, it should be
+		// done before the request is finished.
+		<-finished
+	}
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.expired() && !tw.hijacked {
+		tw.writeHeader(http.StatusOK)
+	}
+}
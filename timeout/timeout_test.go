@@ -0,0 +1,92 @@
+package timeout
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncRecorder is a ResponseRecorder that can be inspected while the handler
+// is running.
+type syncRecorder struct {
+	mu sync.Mutex
+	*httptest.ResponseRecorder
+}
+
+func (rec *syncRecorder) Write(p []byte) (int, error) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.ResponseRecorder.Write(p)
+}
+
+func (rec *syncRecorder) body() string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.Body.String()
+}
+
+func TestTimeout(t *testing.T) {
+	var lateErr, ctxErr error
+	m := New(time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Handler", "1")
+		<-r.Context().Done()
+		ctxErr = r.Context().Err()
+		_, lateErr = w.Write([]byte("late"))
+	}))
+
+	rec := &syncRecorder{ResponseRecorder: httptest.NewRecorder()}
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.body() != timeoutBody {
+		t.Errorf("status = %d, body = %q; want 503 with the timeout body", rec.Code, rec.body())
+	}
+	if rec.Header().Get("X-Handler") != "" {
+		t.Errorf("headers of the handler have leaked into the timeout response")
+	}
+	if ctxErr != context.DeadlineExceeded || lateErr != http.ErrHandlerTimeout {
+		t.Errorf("context error = %v, late write error = %v; want %v, %v", ctxErr, lateErr, context.DeadlineExceeded, http.ErrHandlerTimeout)
+	}
+	if m.TimedOut() != 1 {
+		t.Errorf("TimedOut() = %d, want 1", m.TimedOut())
+	}
+}
+
+func TestTimeoutAfterHeaders(t *testing.T) {
+	m := New(time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("partial"))
+		<-r.Context().Done()
+		w.Write([]byte(" late"))
+	}))
+
+	rec := &syncRecorder{ResponseRecorder: httptest.NewRecorder()}
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusAccepted || rec.body() != "partial" {
+		t.Fatalf("status = %d, body = %q; want 202 partial", rec.Code, rec.body())
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	m := New(time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Handler", "1")
+		if _, ok := r.Context().Deadline(); ok {
+			w.Write([]byte("deadline"))
+		}
+	}))
+	m.Handle("/stream/", 0)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/stream/events", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "" {
+		t.Errorf("without timeout: status = %d, body = %q; want 200 and no deadline", rec.Code, rec.Body.String())
+	}
+
+	m.HandleFunc(func(r *http.Request) bool { return true }, time.Minute)
+	rec = httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "deadline" || rec.Header().Get("X-Handler") != "1" {
+		t.Errorf("with timeout: status = %d, body = %q, headers = %v; want 200 with a deadline", rec.Code, rec.Body.String(), rec.Header())
+	}
+}
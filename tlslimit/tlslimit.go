@@ -0,0 +1,103 @@
+// Package tlslimit limits the number of concurrent TLS handshakes. Handshakes
+// are CPU-heavy, so a storm of new connections can starve established ones
+// of CPU even if the number of connections is limited, see netlimit.
+package tlslimit
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTooManyHandshakes is returned to the TLS stack when a handshake is
+// rejected. The client gets an alert and the connection is closed.
+var ErrTooManyHandshakes = errors.New("tlslimit: too many concurrent handshakes")
+
+// Limiter limits the number of concurrent TLS handshakes of the configs
+// returned by Config.
+type Limiter struct {
+	// sem contains a token for each handshake in progress.
+	sem chan struct{}
+
+	rejected int64
+
+	// MaxWait, if positive, is the maximum time a handshake can wait for its
+	// turn. By default handshakes over the limit are rejected immediately.
+	MaxWait time.Duration
+}
+
+// New returns a Limiter that allows up to maxHandshakes handshakes at the
+// same time.
+func New(maxHandshakes int) *Limiter {
+	if maxHandshakes < 1 {
+		maxHandshakes = 1
+	}
+	return &Limiter{
+		sem: make(chan struct{}, maxHandshakes),
+	}
+}
+
+// InProgress returns the number of handshakes in progress.
+func (l *Limiter) InProgress() int {
+	return len(l.sem)
+}
+
+// Rejected returns the number of rejected handshakes.
+func (l *Limiter) Rejected() int64 {
+	return atomic.LoadInt64(&l.rejected)
+}
+
+// wait takes a token for a handshake. done is closed when the handshake is
+// aborted.
+func (l *Limiter) wait(done <-chan struct{}) error {
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	default:
+	}
+	if l.MaxWait > 0 {
+		timer := time.NewTimer(l.MaxWait)
+		defer timer.Stop()
+		select {
+		case l.sem <- struct{}{}:
+			return nil
+		case <-timer.C:
+		case <-done:
+		}
+	}
+	atomic.AddInt64(&l.rejected, 1)
+	return ErrTooManyHandshakes
+}
+
+// Admit waits for the turn of the handshake of hello. On success the
+// handshake holds its place until it is finished, successfully or not.
+func (l *Limiter) Admit(hello *tls.ClientHelloInfo) error {
+	// The context of the handshake is done when the handshake is finished.
+	ctx := hello.Context()
+	if err := l.wait(ctx.Done()); err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		<-l.sem
+	}()
+	return nil
+}
+
+// Config returns a copy of cfg that is limited by l. If cfg has its own
+// GetConfigForClient, it is called after the handshake is admitted.
+func (l *Limiter) Config(cfg *tls.Config) *tls.Config {
+	cfg = cfg.Clone()
+	next := cfg.GetConfigForClient
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if err := l.Admit(hello); err != nil {
+			return nil, err
+		}
+		if next == nil {
+			return nil, nil
+		}
+		return next(hello)
+	}
+	return cfg
+}
@@ -0,0 +1,90 @@
+package tlslimit
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := New(1)
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = l.Config(&tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if hello.ServerName == "slow.example" {
+				started <- struct{}{}
+				<-unblock
+			}
+			return nil, nil
+		},
+	})
+	srv.StartTLS()
+	defer srv.Close()
+
+	dial := func(serverName string) error {
+		conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- dial("slow.example")
+	}()
+	<-started
+
+	if err := dial("fast.example"); err == nil {
+		t.Fatalf("handshake over the limit succeeded")
+	}
+	if n := l.Rejected(); n != 1 {
+		t.Fatalf("Rejected() = %d, want 1", n)
+	}
+
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Fatalf("slow handshake: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for l.InProgress() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("InProgress() = %d, want 0", l.InProgress())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := dial("fast.example"); err != nil {
+		t.Fatalf("handshake after the slow one is finished: %v", err)
+	}
+}
+
+func TestMaxWait(t *testing.T) {
+	l := New(1)
+	l.MaxWait = 10 * time.Millisecond
+	l.sem <- struct{}{}
+
+	done := make(chan struct{})
+	start := time.Now()
+	if err := l.wait(done); err != ErrTooManyHandshakes {
+		t.Fatalf("wait() = %v, want %v", err, ErrTooManyHandshakes)
+	}
+	if elapsed := time.Since(start); elapsed < l.MaxWait {
+		t.Fatalf("wait() returned after %s, want at least %s", elapsed, l.MaxWait)
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond)
+		<-l.sem
+	}()
+	l.MaxWait = time.Minute
+	if err := l.wait(done); err != nil {
+		t.Fatalf("wait() = %v, want nil", err)
+	}
+}
@@ -0,0 +1,262 @@
+// Package writedeadline sets read and write deadlines of requests with
+// http.ResponseController. Server-wide timeouts have to fit the slowest
+// endpoint and the slowest client, so they are either too long for most
+// requests or too short for large downloads. The middleware overrides them per
+// request based on the route, the size of the content and the class of the
+// client, and aborts writes to clients that stall longer than a budget.
+package writedeadline
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/dmage/middleware/maxconnections"
+)
+
+// Rule defines deadlines for requests. Zero values keep the deadlines of the
+// server.
+type Rule struct {
+	// Read, if positive, is the time to read the request body, counted
+	// from the start of the handler.
+	Read time.Duration
+
+	// Write, if positive, is the time to write the response, counted from
+	// the start of the handler.
+	Write time.Duration
+
+	// MinRate, if positive, is the minimum transfer rate in bytes per
+	// second. The read deadline is extended by the time to read
+	// Content-Length of the request at this rate, and the write deadline by
+	// the time to write Content-Length of the response, if the handler sets
+	// it before the response is written.
+	MinRate float64
+
+	// StallBudget, if positive, is the total time that writes of the
+	// response may be blocked. Once it is used up, writes fail and the
+	// connection is closed, so a client that doesn't read the response
+	// doesn't hold the handler until the write deadline.
+	StallBudget time.Duration
+}
+
+// scale returns the rule with durations multiplied by k.
+func (rule Rule) scale(k float64) Rule {
+	rule.Read = time.Duration(float64(rule.Read) * k)
+	rule.Write = time.Duration(float64(rule.Write) * k)
+	rule.StallBudget = time.Duration(float64(rule.StallBudget) * k)
+	if rule.MinRate > 0 {
+		rule.MinRate /= k
+	}
+	return rule
+}
+
+// transferTime returns the time to transfer size bytes at the minimum rate.
+func (rule Rule) transferTime(size int64) time.Duration {
+	if rule.MinRate <= 0 || size <= 0 {
+		return 0
+	}
+	return time.Duration(float64(size) / rule.MinRate * float64(time.Second))
+}
+
+// route is a set of requests with their own rule.
+type route struct {
+	match func(r *http.Request) bool
+	rule  Rule
+}
+
+// Middleware implements the http.Handler interface.
+type Middleware struct {
+	handler http.Handler
+	routes  []route
+	def     Rule
+	aborted int64
+
+	// Class, if not nil, returns the class of the client, e.g. "mobile" or
+	// "partner".
+	Class func(r *http.Request) string
+
+	// ClassScale maps client classes to factors by which deadlines of
+	// their requests are multiplied, e.g. 3 for clients on slow networks.
+	// Classes without a factor use the rule as is.
+	ClassScale map[string]float64
+
+	// OnAbort, if not nil, is called when a write of the request fails
+	// after its stall budget has been used up.
+	OnAbort func(r *http.Request)
+
+	// now allows to override time.Now for tests.
+	now func() time.Time
+}
+
+// New returns an http.Handler that sets deadlines of requests passed to h
+// according to def, unless a more specific rule is registered for them.
+// Routes should be registered before the middleware starts serving requests.
+func New(h http.Handler, def Rule) *Middleware {
+	return &Middleware{
+		handler: h,
+		def:     def,
+		now:     time.Now,
+	}
+}
+
+// HandleFunc registers rule for requests for which match returns true.
+// Routes are matched in the order they are registered.
+func (m *Middleware) HandleFunc(match func(r *http.Request) bool, rule Rule) {
+	m.routes = append(m.routes, route{match: match, rule: rule})
+}
+
+// Handle registers rule for requests that match pattern, see
+// maxconnections.MatchPattern.
+func (m *Middleware) Handle(pattern string, rule Rule) {
+	m.HandleFunc(maxconnections.MatchPattern(pattern), rule)
+}
+
+// Rule returns the rule for r, scaled for the class of its client.
+func (m *Middleware) Rule(r *http.Request) Rule {
+	rule := m.def
+	for _, route := range m.routes {
+		if route.match(r) {
+			rule = route.rule
+			break
+		}
+	}
+	if m.Class != nil {
+		if k, ok := m.ClassScale[m.Class(r)]; ok && k > 0 {
+			rule = rule.scale(k)
+		}
+	}
+	return rule
+}
+
+// Aborted returns the number of requests whose writes have been aborted
+// because of their stall budget.
+func (m *Middleware) Aborted() int64 {
+	return atomic.LoadInt64(&m.aborted)
+}
+
+// writer sets the write deadline before every write.
+type writer struct {
+	http.ResponseWriter
+	m    *Middleware
+	r    *http.Request
+	rc   *http.ResponseController
+	rule Rule
+
+	// deadline is the write deadline of the response, it is zero if there
+	// is none.
+	deadline time.Time
+
+	// budget is the remaining stall budget.
+	budget time.Duration
+
+	wroteHeader bool
+	aborted     bool
+}
+
+// setDeadline sets the earliest of the response deadline and the end of the
+// stall budget.
+func (w *writer) setDeadline() {
+	d := w.deadline
+	if w.rule.StallBudget > 0 {
+		if b := w.m.now().Add(w.budget); d.IsZero() || b.Before(d) {
+			d = b
+		}
+	}
+	if !d.IsZero() {
+		w.rc.SetWriteDeadline(d)
+	}
+}
+
+// do runs a write with the deadline set and charges its time to the stall
+// budget.
+func (w *writer) do(write func() error) {
+	w.setDeadline()
+	start := w.m.now()
+	err := write()
+	w.budget -= w.m.now().Sub(start)
+	if err != nil && w.rule.StallBudget > 0 && w.budget <= 0 && !w.aborted {
+		w.aborted = true
+		atomic.AddInt64(&w.m.aborted, 1)
+		if w.m.OnAbort != nil {
+			w.m.OnAbort(w.r)
+		}
+	}
+}
+
+func (w *writer) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if size, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil && w.rule.MinRate > 0 {
+			if w.deadline.IsZero() {
+				w.deadline = w.m.now()
+			}
+			w.deadline = w.deadline.Add(w.rule.transferTime(size))
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *writer) Write(p []byte) (n int, err error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.do(func() error {
+		n, err = w.ResponseWriter.Write(p)
+		return err
+	})
+	return n, err
+}
+
+// FlushError flushes the response, see http.ResponseController.
+func (w *writer) FlushError() (err error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.do(func() error {
+		err = w.rc.Flush()
+		return err
+	})
+	return err
+}
+
+func (w *writer) Flush() {
+	w.FlushError()
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rule := m.Rule(r)
+	if rule == (Rule{}) {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+
+	start := m.now()
+	rc := http.NewResponseController(w)
+	if read := rule.Read + rule.transferTime(r.ContentLength); read > 0 {
+		rc.SetReadDeadline(start.Add(read))
+	}
+
+	ww := &writer{
+		ResponseWriter: w,
+		m:              m,
+		r:              r,
+		rc:             rc,
+		rule:           rule,
+		budget:         rule.StallBudget,
+	}
+	if rule.Write > 0 {
+		ww.deadline = start.Add(rule.Write)
+	}
+	ww.setDeadline()
+
+	// The deadlines stay on the connection, so the write deadline is
+	// cleared for the following requests on it.
+	defer rc.SetWriteDeadline(time.Time{})
+	m.handler.ServeHTTP(ww, r)
+}
@@ -0,0 +1,116 @@
+package writedeadline
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deadlineWriter records deadlines and emulates a client that takes delay
+// to receive each write.
+type deadlineWriter struct {
+	*httptest.ResponseRecorder
+	now           *time.Time
+	delay         time.Duration
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (w *deadlineWriter) SetReadDeadline(t time.Time) error {
+	w.readDeadline = t
+	return nil
+}
+
+func (w *deadlineWriter) SetWriteDeadline(t time.Time) error {
+	w.writeDeadline = t
+	return nil
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	*w.now = w.now.Add(w.delay)
+	if !w.writeDeadline.IsZero() && w.now.After(w.writeDeadline) {
+		return 0, errors.New("i/o timeout")
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestDeadlines(t *testing.T) {
+	now := time.Unix(0, 0)
+	var writeDeadline time.Time
+	var w *deadlineWriter
+	m := New(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Length", "1000")
+		rw.Write([]byte("x"))
+		writeDeadline = w.writeDeadline
+	}), Rule{Read: time.Second, Write: 2 * time.Second, MinRate: 100})
+	m.now = func() time.Time {
+		return now
+	}
+	m.Handle("/slow/", Rule{Write: time.Minute})
+	m.Class = func(r *http.Request) string {
+		return r.Header.Get("X-Client-Class")
+	}
+	m.ClassScale = map[string]float64{"mobile": 2}
+
+	testCases := []struct {
+		path  string
+		class string
+		body  string
+		read  time.Duration
+		write time.Duration
+	}{
+		{"/", "", strings.Repeat("x", 200), 3 * time.Second, 12 * time.Second},
+		{"/", "mobile", strings.Repeat("x", 200), 6 * time.Second, 24 * time.Second},
+		{"/slow/report", "", "", 0, time.Minute},
+	}
+	for _, tc := range testCases {
+		w = &deadlineWriter{ResponseRecorder: httptest.NewRecorder(), now: &now}
+		r := httptest.NewRequest("POST", tc.path, strings.NewReader(tc.body))
+		r.Header.Set("X-Client-Class", tc.class)
+		m.ServeHTTP(w, r)
+
+		var expectedRead time.Time
+		if tc.read > 0 {
+			expectedRead = now.Add(tc.read)
+		}
+		if !w.readDeadline.Equal(expectedRead) {
+			t.Errorf("%s %q: read deadline = %v, want %v", tc.path, tc.class, w.readDeadline, expectedRead)
+		}
+		if expected := now.Add(tc.write); !writeDeadline.Equal(expected) {
+			t.Errorf("%s %q: write deadline = %v, want %v", tc.path, tc.class, writeDeadline, expected)
+		}
+		if !w.writeDeadline.IsZero() {
+			t.Errorf("%s %q: the write deadline hasn't been cleared", tc.path, tc.class)
+		}
+	}
+}
+
+func TestStallBudget(t *testing.T) {
+	now := time.Unix(0, 0)
+	var errs []error
+	m := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			_, err := w.Write([]byte("x"))
+			errs = append(errs, err)
+		}
+	}), Rule{Write: time.Minute, StallBudget: 5 * time.Second})
+	m.now = func() time.Time {
+		return now
+	}
+	var aborted int
+	m.OnAbort = func(r *http.Request) {
+		aborted++
+	}
+
+	w := &deadlineWriter{ResponseRecorder: httptest.NewRecorder(), now: &now, delay: 3 * time.Second}
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if errs[0] != nil || errs[1] == nil || errs[2] == nil {
+		t.Fatalf("write errors = %v, want only the first write to succeed", errs)
+	}
+	if aborted != 1 || m.Aborted() != 1 {
+		t.Fatalf("OnAbort has been called %d times, Aborted() = %d; want 1, 1", aborted, m.Aborted())
+	}
+}